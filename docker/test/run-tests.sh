@@ -1,6 +1,11 @@
 #!/bin/bash
 
 export COMPOSE_FILE=docker-compose.test.yml
+
+# pass "opensearch" as the first argument to run the tests against OpenSearch
+if [ "$1" = "opensearch" ]; then
+  export COMPOSE_FILE=docker-compose.test.yml:docker-compose.opensearch.yml
+fi
 export COMPOSE_PROJECT_NAME=monstache
 
 # The network created by docker-compose will be called ${COMPOSE_PROJECT_NAME}_test as we have the network test in docker-compose
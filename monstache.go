@@ -2,40 +2,84 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
+	"database/sql"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"math/big"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httputil"
 	"net/http/pprof"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"plugin"
+	"reflect"
 	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/BurntSushi/toml"
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/defaults"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/secretsmanager/secretsmanageriface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/coreos/go-systemd/daemon"
 	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
+	"github.com/klauspost/compress/zstd"
+	"github.com/lib/pq"
 	"github.com/olivere/elastic"
-	aws "github.com/olivere/elastic/aws/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/robertkrimen/otto"
 	_ "github.com/robertkrimen/otto/underscore"
 	"github.com/rwynn/gtm"
@@ -44,6 +88,7 @@ import (
 	"golang.org/x/net/context"
 	"gopkg.in/Graylog2/go-gelf.v2/gelf"
 	"gopkg.in/natefinch/lumberjack.v2"
+	"gopkg.in/yaml.v2"
 )
 
 var infoLog = log.New(os.Stdout, "INFO ", log.Flags())
@@ -52,42 +97,196 @@ var statsLog = log.New(os.Stdout, "STATS ", log.Flags())
 var traceLog = log.New(os.Stdout, "TRACE ", log.Flags())
 var errorLog = log.New(os.Stderr, "ERROR ", log.Flags())
 
+// verboseLogs is 1 while verbose logging is on.  It can be switched at
+// runtime with the log level endpoint or a config reload
+var verboseLogs int32
+
+var nsFilter = &namespaceFilter{filter: gtm.ChainOpFilters()}
 var mapperPlugin func(*monstachemap.MapperPluginInput) (*monstachemap.MapperPluginOutput, error)
 var filterPlugin func(*monstachemap.MapperPluginInput) (bool, error)
 var processPlugin func(*monstachemap.ProcessPluginInput) error
 var pipePlugin func(string, bool) ([]interface{}, error)
+var sinkPlugin func() (monstachemap.Sink, error)
 var mapEnvs = make(map[string]*executionEnv)
 var filterEnvs = make(map[string]*executionEnv)
 var pipeEnvs = make(map[string]*executionEnv)
 var mapIndexTypes = make(map[string]*indexTypeMapping)
+var indexTemplates = make(map[string]*indexTemplate)
+var indexBulkSettings = make(map[string]*indexBulk)
+var runtimeFields = make(map[string]map[string]interface{})
+var indexBulks = make(map[string]*elastic.BulkProcessor)
+var versionFields = make(map[string]*versionField)
+var reindexJobs = make(map[string]*reindexJob)
+var shadowIndexes = make(map[string]*shadowIndex)
+var ingestPipelines = make(map[string]*ingestPipeline)
+var rollovers = make(map[string]*rollover)
+var updateConflicts = make(map[string]*updateConflict)
+var updateConflictRequests sync.Map
+var updateConflictsDropped int64
+var updateConflictRefetchC = make(chan *gtm.Op, 1000)
+var deadLetters *deadLetterQueue
+var audit *auditLog
+var docDumps *documentDumper
+var notifications *notifier
+var recentErrors = newLogRing(recentErrorsSize)
+var secondary *secondaryCluster
+var sinks []sink
+var ndjsonOut *ndjsonWriter
+var recorder *eventRecorder
+var bulkRequestLimits = make(map[*elastic.BulkProcessor]int64)
+var bulkErrorPolicies = make(map[string]*bulkErrorPolicy)
+var defaultBulkErrorPolicy *bulkErrorPolicy
+var bulkRetries sync.Map
+var bulkState = &bulkGate{}
+var orphans *orphanSweeper
+var bulkCallbacks sync.Map
+var pressure *backpressure
+var pressuredBulks []*pressuredBulk
+var directReads *directReadScheduler
+var pluginLookups *monstachemap.Batcher
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+var sizer *bulkSizer
+var throttle *bulkThrottle
+var metrics *monstacheMetrics
+var tracing *tracer
+var replicationLag *lagMonitor
+var docStats *documentStats
+var syncStatus *syncStatusTracker
+var partition *namespacePartition
+var readyState = &readiness{lastAdvance: time.Now()}
+var secrets = make(map[string]*secret)
+var secretsLock sync.RWMutex
+var secretsManager secretsmanageriface.SecretsManagerAPI
+var routingExprs = make(map[string]*routingExpr)
+var joins = make(map[string]*joinRelation)
+var unwinds = make(map[string]*unwind)
+var numberFormats = make(map[string]*numberFormat)
+var dateFormats = make(map[string]*dateFormat)
+var fieldExclusions = make(map[string][][]string)
+var redactions = make(map[string][]*fieldRedaction)
+var piiScans = make(map[string][]*piiScan)
+var coercions = make(map[string][]*coercion)
+var geoFields = make(map[string][]*geoField)
+var copyFields = make(map[string][]*copyField)
+var enrichments = make(map[string][]*enrichment)
+var references *referenceCache
+var documentSizes = make(map[string]*documentSize)
+var offloads = make(map[string]*offload)
+var tombstones = make(map[string]*tombstone)
+var deleteRoutings = make(map[string]*deleteRouting)
+var documentsTruncated int64
+var eventsCoalesced int64
+
+// lastIndexedAt is when an index worker last took or finished an event and
+// indexQueueDepth the number of events waiting for the index workers
+var lastIndexedAt = time.Now().UnixNano()
+var indexQueueDepth = func() int { return 0 }
+var checkpoints *checkpointTracker
+var embeddings = make(map[string][]*embedding)
+var tikaFields = make(map[string][]*tikaField)
+var languageRoutings = make(map[string]*languageRouting)
+var fileFilters = make(map[string]*fileFilter)
+var tika *tikaClient
+var chaos *faultInjector
 var relates = make(map[string][]*relation)
 var fileNamespaces = make(map[string]bool)
+var fileMetadataNamespaces = make(map[string]bool)
 var patchNamespaces = make(map[string]bool)
 var tmNamespaces = make(map[string]bool)
 var routingNamespaces = make(map[string]bool)
+var partialUpdateNamespaces = make(map[string]bool)
+var arrayUpdateNamespaces = make(map[string]bool)
+var streamJSONNamespaces = make(map[string]bool)
 var mux sync.Mutex
 
 var chunksRegex = regexp.MustCompile("\\.chunks$")
 var systemsRegex = regexp.MustCompile("system\\..+$")
 var exitStatus = 0
 var mongoDialInfo *mgo.DialInfo
+var mongoAWS *mongoAWSAuth
+var mongoCAs *certPool
+var mongoClientCert *clientCertificate
+var mongoLogins = &mongoRotation{}
+var csfle *csfleDecrypter
+var routingChanges *routingTracker
+var schemaDrift *schemaDriftDetector
 var statusReqC = make(chan *statusRequest)
 
+// shutdownSigs receives the signals which stop the sync.  A Windows service
+// stop request is delivered as SIGTERM
+var shutdownSigs = make(chan os.Signal, 1)
+var pauseReqC = make(chan *pauseRequest)
+var resyncOpC = make(chan *gtm.Op)
+var resyncs *resyncer
+
 const version = "4.19.6"
 const mongoURLDefault string = "localhost"
 const resumeNameDefault string = "default"
 const elasticMaxConnsDefault int = 4
+const serverlessVersionDefault string = "2.11.0"
 const elasticClientTimeoutDefault int = 0
+const secretRefreshSecondsDefault int = 300
 const elasticMaxDocsDefault int = -1
 const elasticMaxBytesDefault int = 8 * 1024 * 1024
+const elasticMaxContentLengthDefault int = 100 * 1024 * 1024
+const sqsMaxBatchEntries = 10
+const adaptiveBulkMinBytesDefault = 256 * 1024
+const adaptiveBulkTargetMsDefault = 1000
 const gtmChannelSizeDefault int = 512
 const typeFromFuture string = "_doc"
 const fileDownloadersDefault = 10
+const indexWorkersDefault = 5
+const indexLaneBuffer = 64
+const namespaceMatchCacheSize = 10000
+const referenceMaxDocsDefault = 100000
+const fileReadBufferSize = 255 * 1024
 const relateThreadsDefault = 10
 const relateBufferDefault = 1000
 const postProcessorsDefault = 10
 const redact = "REDACTED"
+const mongoAWSMechanism = "MONGODB-AWS"
+const stsGetCallerIdentity = "Action=GetCallerIdentity&Version=2011-06-15"
 const configDatabaseNameDefault = "monstache"
+const configDocumentDefault = "default"
+const mappingSampleSizeDefault = 100
+const tracingServiceNameDefault = "monstache"
+const tracingBatchSize = 512
+const tracingMaxLinks = 128
+const resumeStallTimeout = time.Minute
+const statsdPrefixDefault = "monstache."
+const statsdFlushSecondsDefault = 10
+const drainTimeoutSecondsDefault = 30
+const checkpointIntervalSecondsDefault = 10
+const clusterLeaseSecondsDefault = 30
+const clusterHeartbeatSecondsDefault = 10
+const statsdMaxPacket = 1432
+const dumpMaxBytes = 16 * 1024
+const notifyRateLimitDefault = 300
+const recentErrorsSize = 200
+const verifyRangeSize = 500
+const verifyReportMaxIds = 1000
+const repairBatchSizeDefault = 500
+const orphanSweepBatchSizeDefault = 1000
+const routingCacheSizeDefault = 100000
+const schemaDriftMaxFields = 1000
+const tombstonePurgeInterval = time.Hour
+const tikaConcurrencyDefault = 4
+const chaosPauseSecondsDefault = 5
+const previewSizeDefault = 10
+const offloadPreviewBytesDefault = 256
+const deleteRoutingCacheSizeDefault = 100000
+const preImageAttempts = 5
+const maxRecordedEventBytes = 64 * 1024 * 1024
+const tikaTimeoutSecondsDefault = 60
+const notifyBulkFailureSecondsDefault = 60
+const (
+	notifyBulkFailure    = "bulk-failure"
+	notifyResumeGap      = "resume-gap"
+	notifyPluginPanic    = "plugin-panic"
+	notifyReplicationLag = "replication-lag"
+	notifySchemaDrift    = "schema-drift"
+)
 const relateQueueOverloadMsg = "Relate queue is full. Skipping relate for %v.(%v) to keep pipeline healthy."
 
 type deleteStrategy int
@@ -96,6 +295,8 @@ const (
 	statelessDeleteStrategy deleteStrategy = iota
 	statefulDeleteStrategy
 	ignoreDeleteStrategy
+	cacheDeleteStrategy
+	preImageDeleteStrategy
 )
 
 type stringargs []string
@@ -104,6 +305,255 @@ type awsConnect struct {
 	AccessKey string `toml:"access-key"`
 	SecretKey string `toml:"secret-key"`
 	Region    string
+	Service   string
+}
+
+// sinkEvent is a mapped change delivered to the configured sinks.  The
+// operation is one of index, update or delete.  Doc is nil for deletes
+type sinkEvent struct {
+	Operation string
+	Namespace string
+	Index     string
+	ID        string
+	Timestamp time.Time
+	Doc       map[string]interface{}
+	Changes   map[string]interface{}
+	// position is the resume position of the change.  It is 0 for direct
+	// reads
+	position bson.MongoTimestamp
+}
+
+// sink is an output which receives the same stream of changes as
+// Elasticsearch
+type sink interface {
+	write(ev *sinkEvent) error
+	flush() error
+	close() error
+}
+
+// redisSink keeps documents in Redis under namespace:id keys, either as a
+// hash of top level fields or as a RedisJSON document
+type redisSink struct {
+	Address   string
+	Password  string `json:"-"`
+	Database  int
+	Mode      string
+	KeyPrefix string `toml:"key-prefix"`
+	lock      sync.Mutex
+	conn      net.Conn
+	reader    *bufio.Reader
+}
+
+// notificationSink publishes change notifications to an SQS queue or an SNS
+// topic.  The payload is the full document, the changes or only the id and
+// operation
+type notificationSink struct {
+	QueueURL     string `toml:"queue-url"`
+	TopicARN     string `toml:"topic-arn"`
+	Region       string
+	AccessKey    string `toml:"access-key"`
+	SecretKey    string `toml:"secret-key" json:"-"`
+	Payload      string
+	FlushSeconds int `toml:"flush-seconds"`
+	sqs          sqsiface.SQSAPI
+	sns          snsiface.SNSAPI
+	lock         sync.Mutex
+	entries      []*sqs.SendMessageBatchRequestEntry
+	stopC        chan bool
+}
+
+// webhookSink POSTs batches of changes as a JSON array to an HTTP endpoint.
+// When a secret is set the body is signed with HMAC-SHA256 in the
+// X-Monstache-Signature header
+type webhookSink struct {
+	URL            string
+	Secret         string `json:"-"`
+	Headers        map[string]string
+	BatchSize      int `toml:"batch-size"`
+	FlushSeconds   int `toml:"flush-seconds"`
+	Concurrency    int
+	MaxRetries     int `toml:"max-retries"`
+	RetryBackoffMs int `toml:"retry-backoff-ms"`
+	TimeoutSeconds int `toml:"timeout-seconds"`
+	client         *http.Client
+	lock           sync.Mutex
+	events         []interface{}
+	sem            chan bool
+	wg             sync.WaitGroup
+	stopC          chan bool
+}
+
+// archiveSink writes gzipped NDJSON batches of change events to S3 or any
+// S3 compatible store such as GCS.  Objects are partitioned by namespace
+// and hour so that a time range can be replayed
+type archiveSink struct {
+	Bucket         string
+	Prefix         string
+	Region         string
+	Endpoint       string
+	ForcePathStyle bool   `toml:"force-path-style"`
+	AccessKey      string `toml:"access-key"`
+	SecretKey      string `toml:"secret-key" json:"-"`
+	MaxEvents      int    `toml:"max-events"`
+	FlushSeconds   int    `toml:"flush-seconds"`
+	s3             s3iface.S3API
+	lock           sync.Mutex
+	batches        map[string][]*sinkEvent
+	seq            uint64
+	stopC          chan bool
+}
+
+// meilisearchSink keeps documents in Meilisearch indexes.  Changes are
+// batched per index and the resulting tasks are checked on each flush
+type meilisearchSink struct {
+	URL                string
+	APIKey             string                            `toml:"api-key" json:"-"`
+	IndexPrefix        string                            `toml:"index-prefix"`
+	Indexes            map[string]string                 `toml:"indexes"`
+	PrimaryKey         string                            `toml:"primary-key"`
+	Settings           map[string]map[string]interface{} `toml:"settings"`
+	BatchSize          int                               `toml:"batch-size"`
+	FlushSeconds       int                               `toml:"flush-seconds"`
+	TaskTimeoutSeconds int                               `toml:"task-timeout-seconds"`
+	client             *http.Client
+	lock               sync.Mutex
+	runs               map[string][]*sinkRun
+	pending            int
+	stopC              chan bool
+}
+
+// sinkRun is a run of consecutive changes of the same kind to an index.
+// Runs are sent in order so that the changes are applied in the order they
+// happened
+type sinkRun struct {
+	operation string
+	docs      []interface{}
+}
+
+// typesenseSink keeps documents in Typesense collections using the JSONL
+// import API
+type typesenseSink struct {
+	URL              string
+	APIKey           string                            `toml:"api-key" json:"-"`
+	CollectionPrefix string                            `toml:"collection-prefix"`
+	Collections      map[string]string                 `toml:"collections"`
+	Schemas          map[string]map[string]interface{} `toml:"schemas"`
+	BatchSize        int                               `toml:"batch-size"`
+	FlushSeconds     int                               `toml:"flush-seconds"`
+	client           *http.Client
+	lock             sync.Mutex
+	runs             map[string][]*sinkRun
+	pending          int
+	stopC            chan bool
+}
+
+// postgresSink upserts documents into a table with namespace, id and a
+// JSONB doc column.  Documents are keyed by namespace and id so that
+// collections with overlapping ids can share the table
+type postgresSink struct {
+	URL          string `json:"-"`
+	Table        string
+	CreateTable  bool `toml:"create-table"`
+	BatchSize    int  `toml:"batch-size"`
+	FlushSeconds int  `toml:"flush-seconds"`
+	db           *sql.DB
+	lock         sync.Mutex
+	runs         []*sinkRun
+	pending      int
+	stopC        chan bool
+}
+
+// pluginSink adapts a Sink from a plugin to the internal sink interface
+type pluginSink struct {
+	sink monstachemap.Sink
+}
+
+// ndjsonWriter writes bulk actions exactly as they are sent to Elasticsearch
+// eventRecorder captures the change events read to a file which the
+// replay-file option feeds back through the pipeline
+type eventRecorder struct {
+	file     *os.File
+	lock     sync.Mutex
+	compress bool
+}
+
+// recordedEvent is a line of a recording
+type recordedEvent struct {
+	ID                interface{}            `json:"id"`
+	Operation         string                 `json:"op"`
+	Namespace         string                 `json:"ns"`
+	Timestamp         bson.MongoTimestamp    `json:"ts"`
+	Source            int                    `json:"source"`
+	Data              map[string]interface{} `json:"data,omitempty"`
+	Doc               interface{}            `json:"doc,omitempty"`
+	UpdateDescription map[string]interface{} `json:"updateDescription,omitempty"`
+}
+
+type ndjsonWriter struct {
+	w    io.Writer
+	file *os.File
+	lock sync.Mutex
+}
+
+// kafkaSink publishes changes to Kafka through a Confluent REST Proxy v3
+type kafkaSink struct {
+	RestURL      string            `toml:"rest-url"`
+	ClusterID    string            `toml:"cluster-id"`
+	TopicPrefix  string            `toml:"topic-prefix"`
+	Topics       map[string]string `toml:"topics"`
+	Username     string
+	Password     string `json:"-"`
+	BatchSize    int    `toml:"batch-size"`
+	FlushSeconds int    `toml:"flush-seconds"`
+	client       *http.Client
+	lock         sync.Mutex
+	batches      map[string][]interface{}
+	stopC        chan bool
+}
+
+// natsSink publishes changes to NATS JetStream subjects derived from the
+// namespace.  Each message has a Nats-Msg-Id built from the resume position
+// of the change so that the stream drops messages published again after a
+// restart.  Publishes are retried until JetStream acknowledges them
+type natsSink struct {
+	URL            string `json:"-"`
+	Username       string
+	Password       string            `json:"-"`
+	Token          string            `json:"-"`
+	SubjectPrefix  string            `toml:"subject-prefix"`
+	Subjects       map[string]string `toml:"subjects"`
+	Payload        string
+	BatchSize      int `toml:"batch-size"`
+	FlushSeconds   int `toml:"flush-seconds"`
+	MaxRetries     int `toml:"max-retries"`
+	RetryBackoffMs int `toml:"retry-backoff-ms"`
+	TimeoutSeconds int `toml:"timeout-seconds"`
+	lock           sync.Mutex
+	pending        []*natsMessage
+	sendLock       sync.Mutex
+	conn           net.Conn
+	reader         *bufio.Reader
+	inbox          string
+	seq            uint64
+	stopC          chan bool
+}
+
+// natsMessage is a change waiting to be acknowledged by JetStream
+type natsMessage struct {
+	subject string
+	id      string
+	headers map[string]string
+	data    []byte
+}
+
+// awsSigningTransport signs requests with AWS SigV4 for a configurable
+// service name.  OpenSearch Serverless uses aoss and requires the
+// x-amz-content-sha256 header
+type awsSigningTransport struct {
+	transport http.RoundTripper
+	signer    *v4.Signer
+	region    string
+	service   string
 }
 
 type executionEnv struct {
@@ -137,3708 +587,22556 @@ type indexTypeMapping struct {
 	Type      string
 }
 
-type findConf struct {
-	vm            *otto.Otto
-	ns            string
-	name          string
-	session       *mgo.Session
-	byId          bool
-	multi         bool
-	pipe          bool
-	pipeAllowDisk bool
+type indexTemplate struct {
+	Namespace     string
+	Name          string
+	Path          string
+	IndexPatterns []string `toml:"index-patterns"`
+	Priority      int
+	Overwrite     bool
+	Settings      map[string]interface{}
+	Mappings      map[string]interface{}
 }
 
-type findCall struct {
-	config  *findConf
-	session *mgo.Session
-	query   interface{}
-	db      string
-	col     string
-	limit   int
-	sort    []string
-	sel     map[string]int
+type indexSettings struct {
+	Namespace       string
+	Shards          int
+	Replicas        *int
+	RefreshInterval string `toml:"refresh-interval"`
+	Analysis        map[string]interface{}
 }
 
-type logFiles struct {
-	Info  string
-	Warn  string
-	Error string
-	Trace string
-	Stats string
+type runtimeField struct {
+	Namespace string
+	Name      string
+	Type      string
+	Script    string
 }
 
-type indexingMeta struct {
-	Routing         string
-	Index           string
-	Type            string
-	Parent          string
-	Version         int64
-	VersionType     string
-	Pipeline        string
-	RetryOnConflict int
-	Skip            bool
-	ID              string
+type indexBulk struct {
+	Index      string
+	Workers    int
+	MaxDocs    int `toml:"max-docs"`
+	MaxBytes   int `toml:"max-bytes"`
+	MaxSeconds int `toml:"max-seconds"`
 }
 
-type outputChans struct {
-	indexC   chan *gtm.Op
-	processC chan *gtm.Op
-	fileC    chan *gtm.Op
-	relateC  chan *gtm.Op
-	filter   gtm.OpFilter
+type versionField struct {
+	Namespace   string
+	Field       string
+	VersionType string `toml:"version-type"`
 }
 
-type mongoDialSettings struct {
-	Timeout      int
-	Ssl          bool
-	ReadTimeout  int `toml:"read-timeout"`
-	WriteTimeout int `toml:"write-timeout"`
+type ingestPipeline struct {
+	Namespace  string
+	Name       string
+	Path       string
+	definition map[string]interface{}
+	chained    *ingestPipeline
 }
 
-type mongoSessionSettings struct {
-	SocketTimeout int `toml:"socket-timeout"`
-	SyncTimeout   int `toml:"sync-timeout"`
+type updateConflict struct {
+	Namespace       string
+	RetryOnConflict int `toml:"retry-on-conflict"`
+	Policy          string
 }
 
-type mongoX509Settings struct {
-	ClientCertPemFile string `toml:"client-cert-pem-file"`
-	ClientKeyPemFile  string `toml:"client-key-pem-file"`
+// pendingUpdate is an update in flight with the _id of its document in
+// MongoDB for the conflict policy
+type pendingUpdate struct {
+	*updateConflict
+	id interface{}
 }
 
-type gtmSettings struct {
-	ChannelSize    int    `toml:"channel-size"`
-	BufferSize     int    `toml:"buffer-size"`
-	BufferDuration string `toml:"buffer-duration"`
+type bulkErrorPolicy struct {
+	Class        string
+	Retries      int
+	BackoffMs    int `toml:"backoff-ms"`
+	MaxBackoffMs int `toml:"max-backoff-ms"`
+	Action       string
 }
 
-type httpServerCtx struct {
-	httpServer *http.Server
-	bulk       *elastic.BulkProcessor
-	config     *configOptions
-	shutdown   bool
-	started    time.Time
+// backpressure slows indexing while Elasticsearch rejects requests.  Each
+// rejection raises the level which pauses intake for longer and reduces the
+// number of concurrent indexing workers and bulk requests in flight.  The
+// bulk processors are flushed at an interval which doubles with each level.
+// Levels decay while bulk requests succeed
+type backpressure struct {
+	lock        sync.Mutex
+	workers     int
+	active      int
+	bulks       []*pressuredBulk
+	bulkWorkers int
+	inFlight    int
+	level       int
+	until       time.Time
+	lastChange  time.Time
 }
 
-type instanceStatus struct {
-	Enabled      bool                `json:"enabled"`
-	Pid          int                 `json:"pid"`
-	Hostname     string              `json:"hostname"`
-	ClusterName  string              `json:"cluster"`
-	ResumeName   string              `json:"resumeName"`
-	LastTs       bson.MongoTimestamp `json:"lastTs"`
-	LastTsFormat string              `json:"lastTsFormat,omitempty"`
+// pressuredBulk is a bulk processor flushed by the backpressure instead of
+// its own flush interval
+type pressuredBulk struct {
+	bulk     *elastic.BulkProcessor
+	interval time.Duration
+	workers  int
+	flushed  time.Time
 }
 
-type statusResponse struct {
-	enabled bool
-	lastTs  bson.MongoTimestamp
+// bulkSizer adapts the size of the bulk requests of the main bulk processor
+// and the number of index workers to the round-trip latency of bulk
+// requests.  Both grow while requests complete well within the target
+// latency and shrink when requests are slow or rejected
+type bulkSizer struct {
+	lock     sync.Mutex
+	bulk     *elastic.BulkProcessor
+	minBytes int64
+	maxBytes int64
+	size     int64
+	target   time.Duration
+	workers  int
+	allowed  int
+	active   int
+	pending  int64
+	flushing int32
+	starts   sync.Map
 }
 
-type statusRequest struct {
-	responseC chan *statusResponse
+// bulkThrottle holds the limits of the main bulk processor which are
+// changed by reloading the config file.  A bulk processor keeps the batch
+// limits and workers it was started with, so lower limits are applied by
+// flushing it early and by holding back its workers
+type bulkThrottle struct {
+	lock     sync.Mutex
+	bulk     *elastic.BulkProcessor
+	started  indexBulk
+	limits   indexBulk
+	docs     int
+	bytes    int64
+	inFlight int
+	flushed  time.Time
+	flushing int32
 }
 
-type configOptions struct {
-	EnableTemplate           bool
-	EnvDelimiter             string
-	MongoURL                 string               `toml:"mongo-url"`
-	MongoConfigURL           string               `toml:"mongo-config-url"`
-	MongoPemFile             string               `toml:"mongo-pem-file"`
-	MongoValidatePemFile     bool                 `toml:"mongo-validate-pem-file"`
-	MongoOpLogDatabaseName   string               `toml:"mongo-oplog-database-name"`
-	MongoOpLogCollectionName string               `toml:"mongo-oplog-collection-name"`
-	MongoDialSettings        mongoDialSettings    `toml:"mongo-dial-settings"`
-	MongoSessionSettings     mongoSessionSettings `toml:"mongo-session-settings"`
-	MongoX509Settings        mongoX509Settings    `toml:"mongo-x509-settings"`
-	GtmSettings              gtmSettings          `toml:"gtm-settings"`
-	AWSConnect               awsConnect           `toml:"aws-connect"`
-	Logs                     logFiles             `toml:"logs"`
-	GraylogAddr              string               `toml:"graylog-addr"`
-	ElasticUrls              stringargs           `toml:"elasticsearch-urls"`
-	ElasticUser              string               `toml:"elasticsearch-user"`
-	ElasticPassword          string               `toml:"elasticsearch-password"`
-	ElasticPemFile           string               `toml:"elasticsearch-pem-file"`
-	ElasticValidatePemFile   bool                 `toml:"elasticsearch-validate-pem-file"`
-	ElasticVersion           string               `toml:"elasticsearch-version"`
-	ElasticHealth0           int                  `toml:"elasticsearch-healthcheck-timeout-startup"`
-	ElasticHealth1           int                  `toml:"elasticsearch-healthcheck-timeout"`
-	ResumeName               string               `toml:"resume-name"`
-	NsRegex                  string               `toml:"namespace-regex"`
-	NsDropRegex              string               `toml:"namespace-drop-regex"`
-	NsExcludeRegex           string               `toml:"namespace-exclude-regex"`
-	NsDropExcludeRegex       string               `toml:"namespace-drop-exclude-regex"`
-	ClusterName              string               `toml:"cluster-name"`
-	Print                    bool                 `toml:"print-config"`
-	Version                  bool
-	Pprof                    bool
-	DisableChangeEvents      bool `toml:"disable-change-events"`
-	EnableEasyJSON           bool `toml:"enable-easy-json"`
-	Stats                    bool
-	IndexStats               bool   `toml:"index-stats"`
-	StatsDuration            string `toml:"stats-duration"`
-	StatsIndexFormat         string `toml:"stats-index-format"`
-	Gzip                     bool
-	Verbose                  bool
-	Resume                   bool
-	ResumeWriteUnsafe        bool  `toml:"resume-write-unsafe"`
-	ResumeFromTimestamp      int64 `toml:"resume-from-timestamp"`
-	Replay                   bool
-	DroppedDatabases         bool   `toml:"dropped-databases"`
-	DroppedCollections       bool   `toml:"dropped-collections"`
-	IndexFiles               bool   `toml:"index-files"`
-	IndexAsUpdate            bool   `toml:"index-as-update"`
-	FileHighlighting         bool   `toml:"file-highlighting"`
-	EnablePatches            bool   `toml:"enable-patches"`
-	FailFast                 bool   `toml:"fail-fast"`
-	IndexOplogTime           bool   `toml:"index-oplog-time"`
-	OplogTsFieldName         string `toml:"oplog-ts-field-name"`
-	OplogDateFieldName       string `toml:"oplog-date-field-name"`
-	OplogDateFieldFormat     string `toml:"oplog-date-field-format"`
-	ExitAfterDirectReads     bool   `toml:"exit-after-direct-reads"`
-	MergePatchAttr           string `toml:"merge-patch-attribute"`
-	ElasticMaxConns          int    `toml:"elasticsearch-max-conns"`
-	ElasticRetry             bool   `toml:"elasticsearch-retry"`
-	ElasticMaxDocs           int    `toml:"elasticsearch-max-docs"`
-	ElasticMaxBytes          int    `toml:"elasticsearch-max-bytes"`
-	ElasticMaxSeconds        int    `toml:"elasticsearch-max-seconds"`
-	ElasticClientTimeout     int    `toml:"elasticsearch-client-timeout"`
-	ElasticMajorVersion      int
-	ElasticMinorVersion      int
-	MaxFileSize              int64 `toml:"max-file-size"`
-	ConfigFile               string
-	Script                   []javascript
-	Filter                   []javascript
-	Pipeline                 []javascript
-	Mapping                  []indexTypeMapping
-	Relate                   []relation
-	FileNamespaces           stringargs `toml:"file-namespaces"`
-	PatchNamespaces          stringargs `toml:"patch-namespaces"`
-	Workers                  stringargs
-	Worker                   string
-	ChangeStreamNs           stringargs     `toml:"change-stream-namespaces"`
-	DirectReadNs             stringargs     `toml:"direct-read-namespaces"`
-	DirectReadSplitMax       int            `toml:"direct-read-split-max"`
-	DirectReadConcur         int            `toml:"direct-read-concur"`
-	DirectReadNoTimeout      bool           `toml:"direct-read-no-timeout"`
-	MapperPluginPath         string         `toml:"mapper-plugin-path"`
-	EnableHTTPServer         bool           `toml:"enable-http-server"`
-	HTTPServerAddr           string         `toml:"http-server-addr"`
-	TimeMachineNamespaces    stringargs     `toml:"time-machine-namespaces"`
-	TimeMachineIndexPrefix   string         `toml:"time-machine-index-prefix"`
-	TimeMachineIndexSuffix   string         `toml:"time-machine-index-suffix"`
-	TimeMachineDirectReads   bool           `toml:"time-machine-direct-reads"`
-	PipeAllowDisk            bool           `toml:"pipe-allow-disk"`
-	RoutingNamespaces        stringargs     `toml:"routing-namespaces"`
-	DeleteStrategy           deleteStrategy `toml:"delete-strategy"`
-	DeleteIndexPattern       string         `toml:"delete-index-pattern"`
-	ConfigDatabaseName       string         `toml:"config-database-name"`
-	FileDownloaders          int            `toml:"file-downloaders"`
-	RelateThreads            int            `toml:"relate-threads"`
-	RelateBuffer             int            `toml:"relate-buffer"`
-	PostProcessors           int            `toml:"post-processors"`
-	PruneInvalidJSON         bool           `toml:"prune-invalid-json"`
-	Debug                    bool
+type monstacheMetrics struct {
+	registry       *prometheus.Registry
+	events         *prometheus.CounterVec
+	documents      *prometheus.CounterVec
+	bulkLatency    *prometheus.HistogramVec
+	bulkFailures   *prometheus.CounterVec
+	pluginDuration *prometheus.HistogramVec
+	lag            *prometheus.GaugeVec
+	schemaDrifts   *prometheus.GaugeVec
+	faults         *prometheus.CounterVec
+	checkpointTs   int64
+	bulkStarts     sync.Map
+	statsd         *statsdClient
+	queueLock      sync.Mutex
+	queues         map[string]func() int
 }
 
-func (rel *relation) IsIdentity() bool {
-	if rel.SrcField == "_id" && rel.MatchField == "_id" {
-		return true
-	} else {
-		return false
-	}
+// statsdClient sends metrics to a StatsD server with DogStatsD tags.
+// Counters and gauges are aggregated until the next flush while timings are
+// sent as they are observed
+type statsdClient struct {
+	conn     net.Conn
+	prefix   string
+	lock     sync.Mutex
+	counters map[string]int64
+	gauges   map[string]float64
+	buf      bytes.Buffer
 }
 
-func (l *logFiles) enabled() bool {
-	return l.Info != "" || l.Warn != "" || l.Error != "" || l.Trace != "" || l.Stats != ""
+type bulkExecution struct {
+	name string
+	id   int64
 }
 
-func (s *mongoX509Settings) enabled() bool {
-	return s.ClientCertPemFile != "" || s.ClientKeyPemFile != ""
+// tracer exports spans to an OTLP collector using the JSON encoding over HTTP
+type tracer struct {
+	endpoint    string
+	serviceName string
+	sampleRatio float64
+	client      *http.Client
+	spansC      chan *traceSpan
+	flushC      chan chan bool
+	events      sync.Map
+	enqueued    sync.Map
+	flushes     sync.Map
 }
 
-func (s *mongoX509Settings) validate() error {
-	if s.ClientCertPemFile != "" || s.ClientKeyPemFile != "" {
-		if s.ClientCertPemFile == "" {
-			return errors.New("Client cert pem file missing for X509 authentication")
-		} else if s.ClientKeyPemFile == "" {
-			return errors.New("Client key pem file missing for X509 authentication")
-		}
-	}
-	return nil
+type traceSpan struct {
+	tracer     *tracer
+	traceID    [16]byte
+	spanID     [8]byte
+	parentID   [8]byte
+	name       string
+	start      time.Time
+	end        time.Time
+	attributes map[string]string
+	links      []traceLink
+	err        string
 }
 
-func (ac *awsConnect) validate() error {
-	if ac.AccessKey == "" && ac.SecretKey == "" {
-		return nil
-	} else if ac.AccessKey != "" && ac.SecretKey != "" {
-		return nil
-	}
-	return errors.New("AWS connect settings must include both access-key and secret-key")
+// lagMonitor tracks how far the cluster time of the events read trails the
+// wall clock and alerts when it exceeds the configured threshold
+type lagMonitor struct {
+	lock        sync.Mutex
+	threshold   time.Duration
+	alertURL    string
+	clusterName string
+	resumeName  string
+	client      *http.Client
+	namespace   string
+	lag         time.Duration
+	exceeded    bool
 }
 
-func (ac *awsConnect) enabled() bool {
-	return ac.AccessKey != "" || ac.SecretKey != ""
+// checkpointTracker counts the change events read but not yet handed to
+// the bulk processors by their timestamp.  A resume position before the
+// earliest of them is safe to save once the bulk processors are flushed
+type checkpointTracker struct {
+	lock    sync.Mutex
+	pending map[bson.MongoTimestamp]int
 }
 
-func (arg *deleteStrategy) String() string {
-	return fmt.Sprintf("%d", *arg)
+// syncStatusTracker follows the progress of each namespace for the status
+// endpoint
+type syncStatusTracker struct {
+	lock       sync.Mutex
+	session    *mgo.Session
+	namespaces map[string]*namespaceSyncStatus
+	started    map[*gtm.Op]bool
 }
 
-func (arg *deleteStrategy) Set(value string) (err error) {
-	var i int
-	if i, err = strconv.Atoi(value); err != nil {
-		return
-	}
-	ds := deleteStrategy(i)
-	*arg = ds
-	return
+type namespaceSyncStatus struct {
+	LastApplied   string              `json:"last_applied,omitempty"`
+	LastAppliedTs bson.MongoTimestamp `json:"last_applied_ts,omitempty"`
+	LagSeconds    float64             `json:"lag_seconds"`
+	DirectRead    *directReadProgress `json:"direct_read,omitempty"`
+	Pending       int                 `json:"pending"`
+	LastError     string              `json:"last_error,omitempty"`
+	LastErrorAt   string              `json:"last_error_at,omitempty"`
 }
 
-func (args *stringargs) String() string {
-	return fmt.Sprintf("%s", *args)
+type directReadProgress struct {
+	Read           int64 `json:"read"`
+	EstimatedTotal int64 `json:"estimated_total"`
 }
 
-func (args *stringargs) Set(value string) error {
-	*args = append(*args, value)
-	return nil
+// namespacePartition shares the namespaces among the live members of a
+// partition group.  Each namespace belongs to the member with the highest
+// hash of the member and namespace names, so a change of membership only
+// moves the namespaces of the members which joined or left
+type namespacePartition struct {
+	lock    sync.RWMutex
+	session *mgo.Session
+	db      string
+	group   string
+	member  string
+	lease   time.Duration
+	members []string
+	seen    sync.Map
 }
 
-func (config *configOptions) readShards() bool {
-	return len(config.ChangeStreamNs) == 0 && config.MongoConfigURL != ""
+type directReadPriority struct {
+	Namespace string
+	Priority  int
 }
 
-func afterBulk(executionId int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
-	if response != nil && response.Errors {
-		failed := response.Failed()
-		if failed != nil {
-			for _, item := range failed {
-				if item.Status == 409 {
-					// ignore version conflict since this simply means the doc
-					// is already in the index
-					continue
-				}
-				json, err := json.Marshal(item)
-				if err != nil {
-					errorLog.Printf("Unable to marshal bulk response item: %s", err)
-				} else {
-					errorLog.Printf("Bulk response item: %s", string(json))
-				}
-			}
-		}
-	}
+// namespaceCursor overrides the cursor settings of gtm-settings and
+// direct-read-no-timeout for the change stream and direct reads of a
+// namespace
+type namespaceCursor struct {
+	Namespace    string
+	BatchSize    int  `toml:"batch-size"`
+	MaxAwaitSecs int  `toml:"max-await-secs"`
+	NoTimeout    bool `toml:"no-timeout"`
 }
 
-func (config *configOptions) useTypeFromFuture() (use bool) {
-	if config.ElasticMajorVersion > 6 {
-		use = true
-	} else if config.ElasticMajorVersion == 6 && config.ElasticMinorVersion >= 2 {
-		use = true
-	}
-	return
+// gtmContexts merges the ops of the gtm contexts started for the
+// namespaces with their own cursor settings
+type gtmContexts struct {
+	contexts     []*gtm.OpCtxMulti
+	OpC          gtm.OpChan
+	ErrC         chan error
+	DirectReadWg *sync.WaitGroup
+	sessions     []*mgo.Session
+	forwarders   sync.WaitGroup
+	stopped      sync.Once
 }
 
-func (config *configOptions) parseElasticsearchVersion(number string) (err error) {
-	if number == "" {
-		err = errors.New("Elasticsearch version cannot be blank")
-	} else {
-		versionParts := strings.Split(number, ".")
-		var majorVersion, minorVersion int
-		majorVersion, err = strconv.Atoi(versionParts[0])
-		if err == nil {
-			config.ElasticMajorVersion = majorVersion
-			if majorVersion == 0 {
-				err = errors.New("Invalid Elasticsearch major version 0")
-			}
-		}
-		if len(versionParts) > 1 {
-			minorVersion, err = strconv.Atoi(versionParts[1])
-			if err == nil {
-				config.ElasticMinorVersion = minorVersion
-			}
-		}
-	}
-	return
+// directReadScheduler shares a budget of documents in flight and a rate of
+// documents read among all direct reads.  Namespaces waiting for the budget
+// are served in proportion to their priority
+type directReadScheduler struct {
+	lock     sync.Mutex
+	budget   int
+	rate     float64
+	tokens   float64
+	refilled time.Time
+	weights  map[string]float64
+	served   map[string]float64
+	waiting  map[string]int
+	inflight int
+	held     sync.Map
 }
 
-func (config *configOptions) newBulkProcessor(client *elastic.Client) (bulk *elastic.BulkProcessor, err error) {
-	bulkService := client.BulkProcessor().Name("monstache")
-	bulkService.Workers(config.ElasticMaxConns)
-	bulkService.Stats(config.Stats)
-	bulkService.BulkActions(config.ElasticMaxDocs)
-	bulkService.BulkSize(config.ElasticMaxBytes)
-	if config.ElasticRetry == false {
-		bulkService.Backoff(&elastic.StopBackoff{})
-	}
-	bulkService.After(afterBulk)
-	bulkService.FlushInterval(time.Duration(config.ElasticMaxSeconds) * time.Second)
-	return bulkService.Do(context.Background())
+type notifyWebhook struct {
+	URL    string
+	Format string
+	Events []string
 }
 
-func (config *configOptions) newStatsBulkProcessor(client *elastic.Client) (bulk *elastic.BulkProcessor, err error) {
-	bulkService := client.BulkProcessor().Name("monstache-stats")
-	bulkService.Workers(1)
-	bulkService.Stats(false)
-	bulkService.BulkActions(-1)
-	bulkService.BulkSize(-1)
-	bulkService.After(afterBulk)
-	bulkService.FlushInterval(time.Duration(5) * time.Second)
-	return bulkService.Do(context.Background())
+// notifier sends notifications of failures to webhooks.  Repeats of the
+// same notification are suppressed for the rate limit interval
+type notifier struct {
+	lock              sync.Mutex
+	webhooks          []notifyWebhook
+	interval          time.Duration
+	bulkFailureWindow time.Duration
+	clusterName       string
+	resumeName        string
+	client            *http.Client
+	sent              map[string]time.Time
+	suppressed        map[string]int
+	failingSince      time.Time
+	bulkFailures      int
+	bulkFailing       bool
 }
 
-func (config *configOptions) needsSecureScheme() bool {
-	if len(config.ElasticUrls) > 0 {
-		for _, url := range config.ElasticUrls {
-			if strings.HasPrefix(url, "https") {
-				return true
-			}
-		}
-	}
-	return false
+type notification struct {
+	Event       string `json:"event"`
+	Status      string `json:"status"`
+	Message     string `json:"message"`
+	Namespace   string `json:"namespace,omitempty"`
+	ResumeName  string `json:"resume_name"`
+	ClusterName string `json:"cluster_name,omitempty"`
+	Suppressed  int    `json:"suppressed,omitempty"`
+	Timestamp   string `json:"timestamp"`
+}
 
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments,omitempty"`
 }
 
-func (config *configOptions) newElasticClient() (client *elastic.Client, err error) {
-	var clientOptions []elastic.ClientOptionFunc
-	var httpClient *http.Client
-	clientOptions = append(clientOptions, elastic.SetSniff(false))
-	if config.needsSecureScheme() {
-		clientOptions = append(clientOptions, elastic.SetScheme("https"))
-	}
-	if len(config.ElasticUrls) > 0 {
-		clientOptions = append(clientOptions, elastic.SetURL(config.ElasticUrls...))
-	} else {
-		config.ElasticUrls = append(config.ElasticUrls, elastic.DefaultURL)
-	}
-	if config.Verbose {
-		clientOptions = append(clientOptions, elastic.SetTraceLog(traceLog))
-		clientOptions = append(clientOptions, elastic.SetErrorLog(errorLog))
-	}
-	if config.ElasticUser != "" {
-		clientOptions = append(clientOptions, elastic.SetBasicAuth(config.ElasticUser, config.ElasticPassword))
-	}
-	if config.ElasticRetry {
-		d1, d2 := time.Duration(50)*time.Millisecond, time.Duration(20)*time.Second
-		retrier := elastic.NewBackoffRetrier(elastic.NewExponentialBackoff(d1, d2))
-		clientOptions = append(clientOptions, elastic.SetRetrier(retrier))
-	}
-	httpClient, err = config.NewHTTPClient()
-	if err != nil {
-		return client, err
-	}
-	clientOptions = append(clientOptions, elastic.SetHttpClient(httpClient))
-	clientOptions = append(clientOptions,
-		elastic.SetHealthcheckTimeoutStartup(time.Duration(config.ElasticHealth0)*time.Second))
-	clientOptions = append(clientOptions,
-		elastic.SetHealthcheckTimeout(time.Duration(config.ElasticHealth1)*time.Second))
-	return elastic.NewClient(clientOptions...)
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Fields []slackField `json:"fields"`
 }
 
-func (config *configOptions) testElasticsearchConn(client *elastic.Client) (err error) {
-	var number string
-	url := config.ElasticUrls[0]
-	number, err = client.ElasticsearchVersion(url)
-	if err == nil {
-		infoLog.Printf("Successfully connected to Elasticsearch version %s", number)
-		err = config.parseElasticsearchVersion(number)
-	}
-	return
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
 }
 
-func deleteIndexes(client *elastic.Client, db string, config *configOptions) (err error) {
-	var indices = []string{strings.ToLower(db + ".*")}
-	for ns, m := range mapIndexTypes {
-		dbCol := strings.SplitN(ns, ".", 2)
-		if dbCol[0] == db && m.Index != "" {
-			index := strings.ToLower(m.Index)
-			for _, cur := range indices {
-				if cur == index {
-					index = ""
-					break
-				}
-			}
-			if index != "" {
-				indices = append(indices, index)
-			}
-		}
-	}
-	_, err = client.DeleteIndex(indices...).Do(context.Background())
-	return
+type lagAlert struct {
+	Status           string  `json:"status"`
+	Namespace        string  `json:"namespace"`
+	LagSeconds       float64 `json:"lag_seconds"`
+	ThresholdSeconds float64 `json:"threshold_seconds"`
+	ResumeName       string  `json:"resume_name"`
+	ClusterName      string  `json:"cluster_name,omitempty"`
+	Timestamp        string  `json:"timestamp"`
 }
 
-func deleteIndex(client *elastic.Client, namespace string, config *configOptions) (err error) {
-	ctx := context.Background()
-	index := strings.ToLower(namespace)
-	if m := mapIndexTypes[namespace]; m != nil {
-		if m.Index != "" {
-			index = strings.ToLower(m.Index)
-		}
-	}
-	_, err = client.DeleteIndex(index).Do(ctx)
-	return err
+type traceLink struct {
+	traceID [16]byte
+	spanID  [8]byte
 }
 
-func ensureFileMapping(client *elastic.Client) (err error) {
-	ctx := context.Background()
-	pipeline := map[string]interface{}{
-		"description": "Extract file information",
-		"processors": [1]map[string]interface{}{
-			{
-				"attachment": map[string]interface{}{
-					"field": "file",
-				},
-			},
-		},
-	}
-	_, err = client.IngestPutPipeline("attachment").BodyJson(pipeline).Do(ctx)
-	return err
+type deadLetter struct {
+	Timestamp string      `json:"timestamp"`
+	Action    string      `json:"action"`
+	Document  string      `json:"document,omitempty"`
+	Status    int         `json:"status"`
+	Error     interface{} `json:"error"`
 }
 
-func defaultIndexTypeMapping(config *configOptions, op *gtm.Op) *indexTypeMapping {
-	typeName := typeFromFuture
-	if !config.useTypeFromFuture() {
-		typeName = op.GetCollection()
-	}
-	return &indexTypeMapping{
-		Namespace: op.Namespace,
-		Index:     strings.ToLower(op.Namespace),
-		Type:      typeName,
-	}
+type deadLetterQueue struct {
+	index    string
+	typeName string
+	bulk     *elastic.BulkProcessor
+	file     *os.File
+	compress bool
+	lock     sync.Mutex
 }
 
-func mapIndexType(config *configOptions, op *gtm.Op) *indexTypeMapping {
-	mapping := defaultIndexTypeMapping(config, op)
-	if m := mapIndexTypes[op.Namespace]; m != nil {
-		if m.Index != "" {
-			mapping.Index = m.Index
-		}
-		if m.Type != "" {
-			mapping.Type = m.Type
-		}
-	}
-	return mapping
+// auditLog records the outcome of every document sent to Elasticsearch
+type auditLog struct {
+	index    string
+	typeName string
+	bulk     *elastic.BulkProcessor
+	file     *os.File
+	lock     sync.Mutex
+	pending  sync.Map
 }
 
-func opIDToString(op *gtm.Op) string {
-	var opIDStr string
-	switch id := op.Id.(type) {
-	case bson.ObjectId:
-		opIDStr = id.Hex()
-	case bson.Binary:
-		opIDStr = monstachemap.EncodeBinData(monstachemap.Binary{id})
-	case float64:
-		intID := int(id)
-		if id == float64(intID) {
-			opIDStr = fmt.Sprintf("%v", intID)
-		} else {
-			opIDStr = fmt.Sprintf("%v", op.Id)
-		}
-	case float32:
-		intID := int(id)
-		if id == float32(intID) {
-			opIDStr = fmt.Sprintf("%v", intID)
-		} else {
-			opIDStr = fmt.Sprintf("%v", op.Id)
-		}
-	default:
-		opIDStr = fmt.Sprintf("%v", op.Id)
-	}
-	return opIDStr
+// documentDumper logs sampled documents before and after mapping along
+// with the bulk actions generated for them
+type documentDumper struct {
+	rate    float64
+	ids     map[string]bool
+	sampled sync.Map
 }
 
-func convertSliceJavascript(a []interface{}) []interface{} {
-	var avs []interface{}
-	for _, av := range a {
-		var avc interface{}
-		switch achild := av.(type) {
-		case map[string]interface{}:
-			avc = convertMapJavascript(achild)
-		case []interface{}:
-			avc = convertSliceJavascript(achild)
-		case bson.ObjectId:
-			avc = achild.Hex()
-		default:
-			avc = av
-		}
-		avs = append(avs, avc)
-	}
-	return avs
+type auditEntry struct {
+	Timestamp string `json:"timestamp"`
+	Namespace string `json:"namespace"`
+	ID        string `json:"id"`
+	Operation string `json:"operation"`
+	Action    string `json:"action"`
+	Index     string `json:"index"`
+	ResumeTs  string `json:"resume_ts,omitempty"`
+	Outcome   string `json:"outcome"`
+	Status    int    `json:"status,omitempty"`
+	Error     string `json:"error,omitempty"`
 }
 
-func convertMapJavascript(e map[string]interface{}) map[string]interface{} {
-	o := make(map[string]interface{})
-	for k, v := range e {
-		switch child := v.(type) {
-		case map[string]interface{}:
-			o[k] = convertMapJavascript(child)
-		case []interface{}:
-			o[k] = convertSliceJavascript(child)
-		case bson.ObjectId:
-			o[k] = child.Hex()
-		default:
-			o[k] = v
-		}
-	}
-	return o
+// rawBulkRequest resubmits the lines of a previously serialized bulk request
+type rawBulkRequest []string
+
+// coalescer holds insert and update events for the coalesce window so that
+// rapid changes to a document are indexed once with its latest state
+type coalescer struct {
+	lock       sync.Mutex
+	config     *configOptions
+	window     time.Duration
+	namespaces map[string]bool
+	pending    map[string]*gtm.Op
+	out        func(*gtm.Op)
 }
 
-func fixSlicePruneInvalidJSON(id string, key string, a []interface{}) []interface{} {
-	var avs []interface{}
-	for _, av := range a {
-		var avc interface{}
-		switch achild := av.(type) {
-		case map[string]interface{}:
-			avc = fixPruneInvalidJSON(id, achild)
-		case []interface{}:
-			avc = fixSlicePruneInvalidJSON(id, key, achild)
-		case time.Time:
-			year := achild.Year()
-			if year < 0 || year > 9999 {
-				// year outside of valid range
-				warnLog.Printf("Dropping key %s element: invalid time.Time value: %s for document _id: %s", key, achild, id)
-				continue
-			} else {
-				avc = av
-			}
-		case float64:
-			if math.IsNaN(achild) {
-				// causes an error in the json serializer
-				warnLog.Printf("Dropping key %s element: invalid float64 value: %v for document _id: %s", key, achild, id)
-				continue
-			} else if math.IsInf(achild, 0) {
-				// causes an error in the json serializer
-				warnLog.Printf("Dropping key %s element: invalid float64 value: %v for document _id: %s", key, achild, id)
-				continue
-			} else {
-				avc = av
-			}
-		default:
-			avc = av
-		}
-		avs = append(avs, avc)
-	}
-	return avs
+// spillQueue buffers events between change capture and the index workers.
+// Events are held in memory up to the memory budget and the payload of
+// further events is written to a spill file until the workers catch up
+type spillQueue struct {
+	lock     sync.Mutex
+	ready    *sync.Cond
+	budget   int64
+	used     int64
+	items    []*spillItem
+	file     *os.File
+	compress bool
+	writeOff int64
+	readOff  int64
+	spilled  int
+	closed   bool
 }
 
-func fixPruneInvalidJSON(id string, e map[string]interface{}) map[string]interface{} {
-	o := make(map[string]interface{})
-	for k, v := range e {
-		switch child := v.(type) {
-		case map[string]interface{}:
-			o[k] = fixPruneInvalidJSON(id, child)
-		case []interface{}:
-			o[k] = fixSlicePruneInvalidJSON(id, k, child)
-		case time.Time:
-			year := child.Year()
-			if year < 0 || year > 9999 {
-				// year outside of valid range
-				warnLog.Printf("Dropping key %s: invalid time.Time value: %s for document _id: %s", k, child, id)
-				continue
-			} else {
-				o[k] = v
-			}
-		case float64:
-			if math.IsNaN(child) {
-				// causes an error in the json serializer
-				warnLog.Printf("Dropping key %s: invalid float64 value: %v for document _id: %s", k, child, id)
-				continue
-			} else if math.IsInf(child, 0) {
-				// causes an error in the json serializer
-				warnLog.Printf("Dropping key %s: invalid float64 value: %v for document _id: %s", k, child, id)
-				continue
-			} else {
-				o[k] = v
-			}
-		default:
-			o[k] = v
-		}
-	}
-	return o
+type spillItem struct {
+	op      *gtm.Op
+	size    int64
+	spilled bool
 }
 
-func deepExportValue(a interface{}) (b interface{}) {
-	switch t := a.(type) {
-	case otto.Value:
-		ex, err := t.Export()
-		if t.Class() == "Date" {
-			ex, err = time.Parse("Mon, 2 Jan 2006 15:04:05 MST", t.String())
-		}
-		if err == nil {
-			b = deepExportValue(ex)
-		} else {
-			errorLog.Printf("Error exporting from javascript: %s", err)
-		}
-	case map[string]interface{}:
-		b = deepExportMap(t)
-	case []map[string]interface{}:
-		b = deepExportMapSlice(t)
-	case []interface{}:
-		b = deepExportSlice(t)
-	default:
-		b = a
-	}
-	return
+// spillRecord is the payload of an event written to the spill file
+type spillRecord struct {
+	Data              map[string]interface{} `bson:"data,omitempty"`
+	Doc               interface{}            `bson:"doc,omitempty"`
+	UpdateDescription map[string]interface{} `bson:"update,omitempty"`
 }
 
-func deepExportMapSlice(a []map[string]interface{}) []interface{} {
-	var avs []interface{}
-	for _, av := range a {
-		avs = append(avs, deepExportMap(av))
-	}
-	return avs
+// bulkItemCallback is told the final outcome of a request added to a bulk
+// processor: its response item, or the error which failed the whole bulk
+// request.  Retried requests are reported once their retries are over
+type bulkItemCallback func(item *elastic.BulkResponseItem, err error)
+
+type monstacheStats struct {
+	elastic.BulkProcessorStats
+	UpdateConflictsDropped int64
+	DocumentsTruncated     int64
+	EventsCoalesced        int64
+	Secondary              *secondaryStats           `json:",omitempty"`
+	Shadows                map[string]shadowStats    `json:",omitempty"`
+	Namespaces             map[string]documentCounts `json:",omitempty"`
+	Indexes                map[string]documentCounts `json:",omitempty"`
 }
 
-func deepExportSlice(a []interface{}) []interface{} {
-	var avs []interface{}
-	for _, av := range a {
-		avs = append(avs, deepExportValue(av))
-	}
-	return avs
+// documentCounts are the outcomes of the documents sent for a namespace or
+// an index.  Failed documents are also counted by their action
+type documentCounts struct {
+	Indexed int64
+	Updated int64
+	Deleted int64
+	Skipped int64
+	Failed  int64
 }
 
-func deepExportMap(e map[string]interface{}) map[string]interface{} {
-	o := make(map[string]interface{})
-	for k, v := range e {
-		o[k] = deepExportValue(v)
-	}
-	return o
+type documentStats struct {
+	lock       sync.Mutex
+	namespaces map[string]*documentCounts
+	indexes    map[string]*documentCounts
+	pending    sync.Map
 }
 
-func mapDataJavascript(op *gtm.Op) error {
-	names := []string{"", op.Namespace}
-	for _, name := range names {
-		if env := mapEnvs[name]; env != nil {
-			env.lock.Lock()
-			defer env.lock.Unlock()
-			arg := convertMapJavascript(op.Data)
-			arg2 := op.Namespace
-			arg3 := convertMapJavascript(op.UpdateDescription)
-			val, err := env.VM.Call("module.exports", arg, arg, arg2, arg3)
-			if err != nil {
-				return err
-			}
-			if strings.ToLower(val.Class()) == "object" {
-				data, err := val.Export()
-				if err != nil {
-					return err
-				} else if data == val {
-					return errors.New("Exported function must return an object")
-				} else {
-					dm := data.(map[string]interface{})
-					op.Data = deepExportMap(dm)
-				}
-			} else {
-				indexed, err := val.ToBoolean()
-				if err != nil {
-					return err
-				} else if !indexed {
-					op.Data = nil
-					break
-				}
-			}
-		}
-	}
-	return nil
+// secondaryCluster receives a copy of every bulk request sent to the primary
+// cluster.  It retries and acknowledges independently of the primary
+type secondaryCluster struct {
+	client  *elastic.Client
+	bulk    *elastic.BulkProcessor
+	started sync.Map
+	pending int64
+	failed  int64
+	lag     int64
 }
 
-func mapDataGolang(s *mgo.Session, op *gtm.Op) error {
-	session := s.Copy()
-	defer session.Close()
-	input := &monstachemap.MapperPluginInput{
-		Document:          op.Data,
-		Namespace:         op.Namespace,
-		Database:          op.GetDatabase(),
-		Collection:        op.GetCollection(),
-		Operation:         op.Operation,
-		Session:           session,
-		UpdateDescription: op.UpdateDescription,
-	}
-	output, err := mapperPlugin(input)
-	if err != nil {
-		return err
-	}
-	if output != nil {
-		if output.Drop {
-			op.Data = nil
-		} else {
-			if output.Skip {
-				op.Data = map[string]interface{}{}
-			} else if output.Passthrough == false {
-				if output.Document == nil {
-					return errors.New("Map function must return a non-nil document")
-				}
-				op.Data = output.Document
-			}
-			meta := make(map[string]interface{})
-			if output.Skip {
-				meta["skip"] = true
-			}
-			if output.Index != "" {
-				meta["index"] = output.Index
-			}
-			if output.ID != "" {
-				meta["id"] = output.ID
-			}
-			if output.Type != "" {
-				meta["type"] = output.Type
-			}
-			if output.Routing != "" {
-				meta["routing"] = output.Routing
-			}
-			if output.Parent != "" {
-				meta["parent"] = output.Parent
-			}
-			if output.Version != 0 {
-				meta["version"] = output.Version
-			}
-			if output.VersionType != "" {
-				meta["versionType"] = output.VersionType
-			}
-			if output.Pipeline != "" {
-				meta["pipeline"] = output.Pipeline
-			}
-			if output.RetryOnConflict != 0 {
-				meta["retryOnConflict"] = output.RetryOnConflict
-			}
-			if len(meta) > 0 {
-				op.Data["_meta_monstache"] = meta
-			}
-		}
-	}
-	return nil
+type secondaryStats struct {
+	Pending   int64
+	Failed    int64
+	LagMillis int64
 }
 
-func mapData(session *mgo.Session, config *configOptions, op *gtm.Op) error {
-	if mapperPlugin != nil {
-		return mapDataGolang(session, op)
-	}
-	return mapDataJavascript(op)
+// shadowStats are the outcomes of the documents sampled for a shadow index.
+// Rejected documents were refused by the shadow index
+type shadowStats struct {
+	Index    string
+	Sampled  int64
+	Matched  int64
+	Differed int64
+	Rejected int64
 }
 
-func extractData(srcField string, data map[string]interface{}) (result interface{}, err error) {
-	var cur map[string]interface{} = data
-	fields := strings.Split(srcField, ".")
-	flen := len(fields)
-	for i, field := range fields {
-		if i+1 == flen {
-			result = cur[field]
-		} else {
-			if next, ok := cur[field].(map[string]interface{}); ok {
-				cur = next
-			} else {
-				break
-			}
-		}
-	}
-	if result == nil {
-		var detail interface{}
-		b, e := json.Marshal(data)
-		if e == nil {
-			detail = string(b)
-		} else {
-			detail = err
-		}
-		err = fmt.Errorf("Source field %s not found in document: %s", srcField, detail)
-	}
-	return
+// namespaceSettings are common per-namespace settings.  The settings in
+// namespace-defaults apply to every namespace.  A [[namespace]] entry
+// overrides them field by field and the dedicated tables such as
+// [[ingest-pipeline]], [[routing]], [[exclude-fields]] and [[index-bulk]]
+// take precedence over both
+type namespaceSettings struct {
+	Namespace       string
+	Pipeline        string
+	RoutingField    string   `toml:"routing-field"`
+	RoutingTemplate string   `toml:"routing-template"`
+	ExcludeFields   []string `toml:"exclude-fields"`
+	Workers         int
+	MaxDocs         int `toml:"max-docs"`
+	MaxBytes        int `toml:"max-bytes"`
+	MaxSeconds      int `toml:"max-seconds"`
 }
 
-func buildSelector(matchField string, data interface{}) bson.M {
-	sel := bson.M{}
-	var cur bson.M = sel
-	fields := strings.Split(matchField, ".")
-	flen := len(fields)
-	for i, field := range fields {
-		if i+1 == flen {
-			cur[field] = data
-		} else {
-			next := bson.M{}
-			cur[field] = next
-			cur = next
-		}
-	}
-	return sel
+type routingExpr struct {
+	Namespace string
+	Field     string
+	Template  string
+	extract   func(doc map[string]interface{}) (string, error)
 }
 
-func processRelated(session *mgo.Session, bulk *elastic.BulkProcessor, elastic *elastic.Client, config *configOptions, root *gtm.Op, out *outputChans) (err error) {
-	var q []*gtm.Op
-	batch := []*gtm.Op{root}
-	depth := 1
-	s := session.Copy()
-	if config.DirectReadNoTimeout {
-		s.SetCursorTimeout(0)
-	}
-	defer s.Close()
-	for len(batch) > 0 {
-		for _, e := range batch {
-			op := e
-			if op.Data == nil {
-				continue
-			}
-			rs := relates[op.Namespace]
-			if len(rs) == 0 {
-				continue
-			}
-			for _, r := range rs {
-				if r.MaxDepth > 0 && r.MaxDepth < depth {
-					continue
-				}
-				if op.IsDelete() && r.IsIdentity() {
-					rop := &gtm.Op{
-						Id:        op.Id,
-						Operation: op.Operation,
-						Namespace: r.WithNamespace,
-						Source:    op.Source,
-						Timestamp: op.Timestamp,
-						Data:      op.Data,
-					}
-					doDelete(config, elastic, session, bulk, rop)
-					q = append(q, rop)
-					continue
-				}
-				var srcData interface{}
-				if srcData, err = extractData(r.SrcField, op.Data); err != nil {
-					processErr(err, config)
-					continue
-				}
-				var sel bson.M
-				if r.DotNotation {
-					sel = bson.M{r.MatchField: srcData}
-				} else {
-					sel = buildSelector(r.MatchField, srcData)
-				}
-				col := s.DB(r.db).C(r.col)
-				query := col.Find(sel)
-				iter := query.Iter()
-				doc := map[string]interface{}{}
-				for iter.Next(doc) {
-					now := time.Now().UTC()
-					tstamp := bson.MongoTimestamp(now.Unix() << 32)
-					offset := bson.MongoTimestamp(now.Nanosecond())
-					rop := &gtm.Op{
-						Id:                doc["_id"],
-						Data:              doc,
-						Operation:         root.Operation,
-						Namespace:         r.WithNamespace,
-						Source:            gtm.DirectQuerySource,
-						Timestamp:         tstamp | offset,
-						UpdateDescription: root.UpdateDescription,
-					}
-					doc = map[string]interface{}{}
-					if out.filter != nil && !out.filter(rop) {
-						continue
-					}
-					if processPlugin != nil {
-						pop := &gtm.Op{
-							Id:                rop.Id,
-							Operation:         rop.Operation,
-							Namespace:         rop.Namespace,
-							Source:            rop.Source,
-							Timestamp:         rop.Timestamp,
-							UpdateDescription: rop.UpdateDescription,
-						}
-						var data []byte
-						data, err = bson.Marshal(rop.Data)
-						if err == nil {
-							var m map[string]interface{}
-							err = bson.Unmarshal(data, &m)
-							if err == nil {
-								pop.Data = m
-							}
-						}
-						out.processC <- pop
-					}
-					skip := false
-					if rs2 := relates[rop.Namespace]; len(rs2) != 0 {
-						skip = true
-						visit := false
-						for _, r2 := range rs2 {
-							if r2.KeepSrc {
-								skip = false
-							}
-							if r2.MaxDepth < 1 || r2.MaxDepth >= (depth+1) {
-								visit = true
-							}
-						}
-						if visit {
-							q = append(q, rop)
-						}
-					}
-					if !skip {
-						if hasFileContent(rop, config) {
-							out.fileC <- rop
-						} else {
-							out.indexC <- rop
-						}
-					}
-				}
-				iter.Close()
-			}
-		}
-		depth++
-		batch = q
-		q = nil
-	}
-	return
+type joinRelation struct {
+	Namespace       string
+	Field           string
+	Name            string
+	ParentNamespace string `toml:"parent-namespace"`
+	ParentField     string `toml:"parent-field"`
 }
 
-func prepareDataForIndexing(config *configOptions, op *gtm.Op) {
-	data := op.Data
-	if config.IndexOplogTime {
-		secs := int64(op.Timestamp >> 32)
-		t := time.Unix(secs, 0).UTC()
-		data[config.OplogTsFieldName] = op.Timestamp
-		data[config.OplogDateFieldName] = t.Format(config.OplogDateFieldFormat)
-	}
-	delete(data, "_id")
-	delete(data, "_meta_monstache")
-	if config.PruneInvalidJSON {
-		op.Data = fixPruneInvalidJSON(opIDToString(op), data)
-	}
-	op.Data = monstachemap.ConvertMapForJSON(op.Data)
+type unwind struct {
+	Namespace   string
+	Field       string
+	Key         string
+	ParentField string `toml:"parent-field"`
 }
 
-func parseIndexMeta(op *gtm.Op) (meta *indexingMeta) {
-	meta = &indexingMeta{
-		Version:     int64(op.Timestamp),
-		VersionType: "external",
-	}
-	if m, ok := op.Data["_meta_monstache"]; ok {
-		switch m.(type) {
-		case map[string]interface{}:
-			metaAttrs := m.(map[string]interface{})
-			meta.load(metaAttrs)
-		case otto.Value:
-			ex, err := m.(otto.Value).Export()
-			if err == nil && ex != m {
-				switch ex.(type) {
-				case map[string]interface{}:
-					metaAttrs := ex.(map[string]interface{})
-					meta.load(metaAttrs)
-				default:
-					errorLog.Println("Invalid indexing metadata")
-				}
-			}
-		default:
-			errorLog.Println("Invalid indexing metadata")
-		}
-	}
-	return meta
+type numberFormat struct {
+	Namespace     string
+	Decimal       string
+	Long          string
+	ScalingFactor int64 `toml:"scaling-factor"`
 }
 
-func addFileContent(s *mgo.Session, op *gtm.Op, config *configOptions) (err error) {
-	session := s.Copy()
-	defer session.Close()
-	op.Data["file"] = ""
-	var gridByteBuffer bytes.Buffer
-	db, bucket :=
-		session.DB(op.GetDatabase()),
-		strings.SplitN(op.GetCollection(), ".", 2)[0]
-	encoder := base64.NewEncoder(base64.StdEncoding, &gridByteBuffer)
-	file, err := db.GridFS(bucket).OpenId(op.Id)
-	if err != nil {
-		return
-	}
-	defer file.Close()
-	if config.MaxFileSize > 0 {
-		if file.Size() > config.MaxFileSize {
-			warnLog.Printf("File %s md5(%s) exceeds max file size. file content omitted.",
-				file.Name(), file.MD5())
-			return
-		}
-	}
-	if _, err = io.Copy(encoder, file); err != nil {
-		return
-	}
-	if err = encoder.Close(); err != nil {
-		return
-	}
-	op.Data["file"] = string(gridByteBuffer.Bytes())
-	return
+// dateFormat normalizes the dates of the documents of a namespace.  Dates
+// are converted to timezone and emitted as format.  Strings and numbers in
+// fields are first read as dates with the first of input-formats which
+// matches, in input-timezone when they carry no offset
+type dateFormat struct {
+	Namespace     string
+	Timezone      string
+	Format        string
+	Fields        []string
+	InputFormats  []string `toml:"input-formats"`
+	InputTimezone string   `toml:"input-timezone"`
+	location      *time.Location
+	inputLocation *time.Location
+	layout        string
+	paths         [][]string
 }
 
-func notMonstache(config *configOptions) gtm.OpFilter {
-	db := config.ConfigDatabaseName
-	return func(op *gtm.Op) bool {
-		return op.GetDatabase() != db
-	}
+type fieldExclusion struct {
+	Namespace string
+	Fields    []string
 }
 
-func notChunks(op *gtm.Op) bool {
-	return !chunksRegex.MatchString(op.GetCollection())
+// fieldRedaction drops, hashes or masks fields of the documents of a
+// namespace.  Hashes are an HMAC-SHA256 keyed by the salt.  Masks replace
+// all but the last keep-last characters with *
+type fieldRedaction struct {
+	Namespace string
+	Fields    []string
+	Action    string
+	Salt      string
+	KeepLast  int `toml:"keep-last"`
+	paths     [][]string
 }
 
-func notConfig(op *gtm.Op) bool {
-	return op.GetDatabase() != "config"
+// piiScan replaces the PII found in text fields of a namespace with stable
+// tokens or hashes keyed by the salt.  Values matching a pattern of the
+// allow list are kept
+type piiScan struct {
+	Namespace string
+	Fields    []string
+	Detectors []string
+	Action    string
+	Salt      string
+	Allow     []string
+	paths     [][]string
+	re        *regexp.Regexp
+	allow     []*regexp.Regexp
 }
 
-func notSystem(op *gtm.Op) bool {
-	return !systemsRegex.MatchString(op.GetCollection())
+type coercion struct {
+	Namespace string
+	Field     string
+	Type      string
+	Format    string
+	OnError   string `toml:"on-error"`
 }
 
-func filterWithRegex(regex string) gtm.OpFilter {
-	var validNameSpace = regexp.MustCompile(regex)
-	return func(op *gtm.Op) bool {
-		if op.IsDrop() {
-			return true
-		}
-		return validNameSpace.MatchString(op.Namespace)
-	}
+// embedding enriches documents with a dense vector computed by an embedding
+// endpoint from the text of one or more fields.  Requests from concurrent
+// workers are batched and vectors are cached by the hash of the text
+type embedding struct {
+	Namespace      string
+	Fields         []string
+	Target         string
+	URL            string
+	Model          string
+	APIKey         string `toml:"api-key" json:"-"`
+	Dims           int
+	BatchSize      int    `toml:"batch-size"`
+	BatchMs        int    `toml:"batch-ms"`
+	CacheSize      int    `toml:"cache-size"`
+	TimeoutSeconds int    `toml:"timeout-seconds"`
+	OnError        string `toml:"on-error"`
+	once           sync.Once
+	requests       chan *embeddingRequest
+	client         *http.Client
+	cacheMutex     sync.Mutex
+	cache          map[string][]float64
 }
 
-func filterDropWithRegex(regex string) gtm.OpFilter {
-	var validNameSpace = regexp.MustCompile(regex)
-	return func(op *gtm.Op) bool {
-		if op.IsDrop() {
-			return validNameSpace.MatchString(op.Namespace)
-		}
-		return true
-	}
+// semanticField marks a field for semantic search.  With an inference-id the
+// field is mapped as semantic_text; otherwise an ELSER inference processor
+// writes sparse tokens for the field into target
+type semanticField struct {
+	Namespace   string
+	Field       string
+	Target      string
+	ModelID     string `toml:"model-id"`
+	InferenceID string `toml:"inference-id"`
 }
 
-func filterWithPlugin() gtm.OpFilter {
-	return func(op *gtm.Op) bool {
-		var keep bool = true
-		if (op.IsInsert() || op.IsUpdate()) && op.Data != nil {
-			keep = false
-			input := &monstachemap.MapperPluginInput{
-				Document:          op.Data,
-				Namespace:         op.Namespace,
-				Database:          op.GetDatabase(),
-				Collection:        op.GetCollection(),
-				Operation:         op.Operation,
-				UpdateDescription: op.UpdateDescription,
-			}
-			if ok, err := filterPlugin(input); err == nil {
-				keep = ok
-			} else {
-				errorLog.Println(err)
-			}
-		}
-		return keep
-	}
+// languageRouting routes the text fields of a namespace by the language of
+// each document, read from a field or detected with Tika.  In subfield mode
+// each field becomes an object with the text under the language code, such
+// as content.en, and in index mode the document goes to the index of the
+// namespace suffixed with the code.  Each language is mapped with its own
+// analyzer
+type languageRouting struct {
+	Namespace     string
+	Fields        []string
+	LanguageField string `toml:"language-field"`
+	Detect        bool
+	Languages     []string
+	Default       string
+	Mode          string
+	Analyzers     map[string]string
+	supported     map[string]bool
 }
 
-func filterWithScript() gtm.OpFilter {
-	return func(op *gtm.Op) bool {
-		var keep = true
-		if (op.IsInsert() || op.IsUpdate()) && op.Data != nil {
-			nss := []string{"", op.Namespace}
-			for _, ns := range nss {
-				if env := filterEnvs[ns]; env != nil {
-					keep = false
-					arg := convertMapJavascript(op.Data)
-					arg2 := op.Namespace
-					arg3 := convertMapJavascript(op.UpdateDescription)
-					env.lock.Lock()
-					defer env.lock.Unlock()
-					val, err := env.VM.Call("module.exports", arg, arg, arg2, arg3)
-					if err != nil {
-						errorLog.Println(err)
-					} else {
-						if ok, err := val.ToBoolean(); err == nil {
-							keep = ok
-						} else {
-							errorLog.Println(err)
-						}
-					}
-				}
-				if !keep {
-					break
-				}
-			}
-		}
-		return keep
-	}
+// tikaClient extracts text and metadata from files with an Apache Tika
+// server in place of the attachment ingest processor
+type tikaClient struct {
+	url      string
+	maxBytes int64
+	client   *http.Client
+	slots    chan struct{}
 }
 
-func filterInverseWithRegex(regex string) gtm.OpFilter {
-	var invalidNameSpace = regexp.MustCompile(regex)
-	return func(op *gtm.Op) bool {
-		if op.IsDrop() {
-			return true
-		}
-		return !invalidNameSpace.MatchString(op.Namespace)
-	}
+// chaosSettings inject failures at random to check that retries, resume
+// positions and the dead letter index preserve data.  Rates are the
+// fraction of reads, requests, plugin calls or events affected.  Never use
+// in production
+type chaosSettings struct {
+	MongoErrorRate    float64 `toml:"mongo-error-rate"`
+	ElasticErrorRate  float64 `toml:"elasticsearch-error-rate"`
+	PluginTimeoutRate float64 `toml:"plugin-timeout-rate"`
+	PauseRate         float64 `toml:"pause-rate"`
+	PauseSeconds      int     `toml:"pause-seconds"`
+	Seed              int64
 }
 
-func filterDropInverseWithRegex(regex string) gtm.OpFilter {
-	var invalidNameSpace = regexp.MustCompile(regex)
-	return func(op *gtm.Op) bool {
-		if op.IsDrop() {
-			return !invalidNameSpace.MatchString(op.Namespace)
-		}
-		return true
-	}
+// faultInjector decides which operations fail when chaos testing
+type faultInjector struct {
+	settings chaosSettings
+	lock     sync.Mutex
+	random   *rand.Rand
 }
 
-func ensureClusterTTL(session *mgo.Session, config *configOptions) error {
-	col := session.DB(config.ConfigDatabaseName).C("cluster")
-	return col.EnsureIndex(mgo.Index{
-		Key:         []string{"expireAt"},
-		Background:  true,
-		ExpireAfter: time.Duration(30) * time.Second,
-	})
+// chaosTransport answers a share of the requests to Elasticsearch with a
+// 429 or 503 status without sending them
+type chaosTransport struct {
+	transport http.RoundTripper
 }
 
-func enableProcess(s *mgo.Session, config *configOptions) (bool, error) {
-	session := s.Copy()
-	defer session.Close()
-	col := session.DB(config.ConfigDatabaseName).C("cluster")
-	doc := make(map[string]interface{})
-	doc["_id"] = config.ResumeName
-	doc["pid"] = os.Getpid()
-	if host, err := os.Hostname(); err == nil {
-		doc["host"] = host
-	} else {
-		return false, err
-	}
-	doc["expireAt"] = time.Now().UTC()
-	err := col.Insert(doc)
-	if err == nil {
-		ensureEnabled(s, config)
-		return true, nil
-	}
-	if mgo.IsDup(err) {
-		return false, nil
-	}
-	return false, err
+// chaosConn breaks a share of the reads from MongoDB as a reset connection
+// would
+type chaosConn struct {
+	net.Conn
 }
 
-func resetClusterState(session *mgo.Session, config *configOptions) error {
-	col := session.DB(config.ConfigDatabaseName).C("cluster")
-	return col.RemoveId(config.ResumeName)
+// fileFilter decides which GridFS files of a namespace have their content
+// indexed.  Other files are indexed with their metadata only.  Content
+// types may end in /* to match a whole type such as video/*
+type fileFilter struct {
+	Namespace           string
+	ContentTypes        []string `toml:"content-types"`
+	Extensions          []string
+	ExcludeContentTypes []string `toml:"exclude-content-types"`
+	ExcludeExtensions   []string `toml:"exclude-extensions"`
+	MaxBytes            int64    `toml:"max-bytes"`
 }
 
-func ensureEnabled(s *mgo.Session, config *configOptions) (enabled bool, err error) {
-	session := s.Copy()
-	defer session.Close()
-	col := session.DB(config.ConfigDatabaseName).C("cluster")
-	doc := make(map[string]interface{})
-	if err = col.FindId(config.ResumeName).One(doc); err == nil {
-		if doc["pid"] != nil && doc["host"] != nil {
-			var hostname string
-			pid := doc["pid"].(int)
-			host := doc["host"].(string)
-			if hostname, err = os.Hostname(); err == nil {
-				enabled = (pid == os.Getpid() && host == hostname)
-				if enabled {
-					err = col.UpdateId(config.ResumeName,
-						bson.M{"$currentDate": bson.M{"expireAt": true}})
-				}
-			}
-		}
-	}
-	return
+// tikaField extracts the content at the URL in a field of the documents of
+// a namespace into target
+type tikaField struct {
+	Namespace string
+	Field     string
+	Target    string
 }
 
-func resumeWork(ctx *gtm.OpCtxMulti, session *mgo.Session, config *configOptions) {
-	col := session.DB(config.ConfigDatabaseName).C("monstache")
-	doc := make(map[string]interface{})
-	col.FindId(config.ResumeName).One(doc)
-	if doc["ts"] != nil {
-		ts := doc["ts"].(bson.MongoTimestamp)
-		ctx.Since(ts)
-	}
-	drained := false
-	for !drained {
-		select {
-		case _, open := <-ctx.OpC:
-			if !open {
-				drained = true
-			}
-		default:
-			drained = true
-		}
-	}
-	ctx.Resume()
+type embeddingRequest struct {
+	text   string
+	result chan embeddingResult
 }
 
-func saveTimestamp(s *mgo.Session, ts bson.MongoTimestamp, config *configOptions) error {
-	session := s.Copy()
-	if config.ResumeWriteUnsafe {
-		session.SetSafe(nil)
-	}
-	defer session.Close()
-	col := session.DB(config.ConfigDatabaseName).C("monstache")
-	doc := make(map[string]interface{})
-	doc["ts"] = ts
-	_, err := col.UpsertId(config.ResumeName, bson.M{"$set": doc})
-	return err
+type embeddingResult struct {
+	vector []float64
+	err    error
 }
 
-func (config *configOptions) parseCommandLineFlags() *configOptions {
-	flag.BoolVar(&config.Print, "print-config", false, "Print the configuration and then exit")
-	flag.BoolVar(&config.EnableTemplate, "tpl", false, "True to interpret the config file as a template")
-	flag.StringVar(&config.EnvDelimiter, "env-delimiter", ",", "A delimiter to use when splitting environment variable values")
-	flag.StringVar(&config.MongoURL, "mongo-url", "", "MongoDB server or router server connection URL")
-	flag.StringVar(&config.MongoConfigURL, "mongo-config-url", "", "MongoDB config server connection URL")
-	flag.StringVar(&config.MongoPemFile, "mongo-pem-file", "", "Path to a PEM file for secure connections to MongoDB")
-	flag.BoolVar(&config.MongoValidatePemFile, "mongo-validate-pem-file", true, "Set to boolean false to not validate the MongoDB PEM file")
-	flag.StringVar(&config.MongoOpLogDatabaseName, "mongo-oplog-database-name", "", "Override the database name which contains the mongodb oplog")
-	flag.StringVar(&config.MongoOpLogCollectionName, "mongo-oplog-collection-name", "", "Override the collection name which contains the mongodb oplog")
-	flag.StringVar(&config.GraylogAddr, "graylog-addr", "", "Send logs to a Graylog server at this address")
-	flag.StringVar(&config.ElasticVersion, "elasticsearch-version", "", "Specify elasticsearch version directly instead of getting it from the server")
-	flag.StringVar(&config.ElasticUser, "elasticsearch-user", "", "The elasticsearch user name for basic auth")
-	flag.StringVar(&config.ElasticPassword, "elasticsearch-password", "", "The elasticsearch password for basic auth")
-	flag.StringVar(&config.ElasticPemFile, "elasticsearch-pem-file", "", "Path to a PEM file for secure connections to elasticsearch")
-	flag.BoolVar(&config.ElasticValidatePemFile, "elasticsearch-validate-pem-file", true, "Set to boolean false to not validate the Elasticsearch PEM file")
-	flag.IntVar(&config.ElasticMaxConns, "elasticsearch-max-conns", 0, "Elasticsearch max connections")
-	flag.IntVar(&config.PostProcessors, "post-processors", 0, "Number of post-processing go routines")
-	flag.IntVar(&config.FileDownloaders, "file-downloaders", 0, "GridFs download go routines")
-	flag.IntVar(&config.RelateThreads, "relate-threads", 0, "Number of threads dedicated to processing relationships")
-	flag.IntVar(&config.RelateBuffer, "relate-buffer", 0, "Number of relates to queue before skipping and reporting an error")
-	flag.BoolVar(&config.ElasticRetry, "elasticsearch-retry", false, "True to retry failed request to Elasticsearch")
-	flag.IntVar(&config.ElasticMaxDocs, "elasticsearch-max-docs", 0, "Number of docs to hold before flushing to Elasticsearch")
-	flag.IntVar(&config.ElasticMaxBytes, "elasticsearch-max-bytes", 0, "Number of bytes to hold before flushing to Elasticsearch")
-	flag.IntVar(&config.ElasticMaxSeconds, "elasticsearch-max-seconds", 0, "Number of seconds before flushing to Elasticsearch")
-	flag.IntVar(&config.ElasticClientTimeout, "elasticsearch-client-timeout", 0, "Number of seconds before a request to Elasticsearch is timed out")
-	flag.Int64Var(&config.MaxFileSize, "max-file-size", 0, "GridFs file content exceeding this limit in bytes will not be indexed in Elasticsearch")
-	flag.StringVar(&config.ConfigFile, "f", "", "Location of configuration file")
-	flag.BoolVar(&config.DroppedDatabases, "dropped-databases", true, "True to delete indexes from dropped databases")
-	flag.BoolVar(&config.DroppedCollections, "dropped-collections", true, "True to delete indexes from dropped collections")
-	flag.BoolVar(&config.Version, "v", false, "True to print the version number")
-	flag.BoolVar(&config.Gzip, "gzip", false, "True to enable gzip for requests to Elasticsearch")
-	flag.BoolVar(&config.Verbose, "verbose", false, "True to output verbose messages")
-	flag.BoolVar(&config.Pprof, "pprof", false, "True to enable pprof endpoints")
-	flag.BoolVar(&config.DisableChangeEvents, "disable-change-events", false, "True to disable listening for changes.  You must provide direct-reads in this case")
-	flag.BoolVar(&config.EnableEasyJSON, "enable-easy-json", false, "True to enable easy-json serialization")
-	flag.BoolVar(&config.Stats, "stats", false, "True to print out statistics")
-	flag.BoolVar(&config.IndexStats, "index-stats", false, "True to index stats in elasticsearch")
-	flag.StringVar(&config.StatsDuration, "stats-duration", "", "The duration after which stats are logged")
-	flag.StringVar(&config.StatsIndexFormat, "stats-index-format", "", "time.Time supported format to use for the stats index names")
-	flag.BoolVar(&config.Resume, "resume", false, "True to capture the last timestamp of this run and resume on a subsequent run")
-	flag.Int64Var(&config.ResumeFromTimestamp, "resume-from-timestamp", 0, "Timestamp to resume syncing from")
-	flag.BoolVar(&config.ResumeWriteUnsafe, "resume-write-unsafe", false, "True to speedup writes of the last timestamp synched for resuming at the cost of error checking")
-	flag.BoolVar(&config.Replay, "replay", false, "True to replay all events from the oplog and index them in elasticsearch")
-	flag.BoolVar(&config.IndexFiles, "index-files", false, "True to index gridfs files into elasticsearch. Requires the elasticsearch mapper-attachments (deprecated) or ingest-attachment plugin")
-	flag.BoolVar(&config.IndexAsUpdate, "index-as-update", false, "True to index documents as updates instead of overwrites")
-	flag.BoolVar(&config.FileHighlighting, "file-highlighting", false, "True to enable the ability to highlight search times for a file query")
-	flag.BoolVar(&config.EnablePatches, "enable-patches", false, "True to include an json-patch field on updates")
-	flag.BoolVar(&config.FailFast, "fail-fast", false, "True to exit if a single _bulk request fails")
-	flag.BoolVar(&config.IndexOplogTime, "index-oplog-time", false, "True to add date/time information from the oplog to each document when indexing")
-	flag.BoolVar(&config.ExitAfterDirectReads, "exit-after-direct-reads", false, "True to exit the program after reading directly from the configured namespaces")
-	flag.StringVar(&config.MergePatchAttr, "merge-patch-attribute", "", "Attribute to store json-patch values under")
-	flag.StringVar(&config.ResumeName, "resume-name", "", "Name under which to load/store the resume state. Defaults to 'default'")
-	flag.StringVar(&config.ClusterName, "cluster-name", "", "Name of the monstache process cluster")
-	flag.StringVar(&config.Worker, "worker", "", "The name of this worker in a multi-worker configuration")
-	flag.StringVar(&config.MapperPluginPath, "mapper-plugin-path", "", "The path to a .so file to load as a document mapper plugin")
-	flag.StringVar(&config.NsRegex, "namespace-regex", "", "A regex which is matched against an operation's namespace (<database>.<collection>).  Only operations which match are synched to elasticsearch")
-	flag.StringVar(&config.NsDropRegex, "namespace-drop-regex", "", "A regex which is matched against a drop operation's namespace (<database>.<collection>).  Only drop operations which match are synched to elasticsearch")
-	flag.StringVar(&config.NsExcludeRegex, "namespace-exclude-regex", "", "A regex which is matched against an operation's namespace (<database>.<collection>).  Only operations which do not match are synched to elasticsearch")
-	flag.StringVar(&config.NsDropExcludeRegex, "namespace-drop-exclude-regex", "", "A regex which is matched against a drop operation's namespace (<database>.<collection>).  Only drop operations which do not match are synched to elasticsearch")
-	flag.Var(&config.ChangeStreamNs, "change-stream-namespace", "A list of change stream namespaces")
-	flag.Var(&config.DirectReadNs, "direct-read-namespace", "A list of direct read namespaces")
-	flag.IntVar(&config.DirectReadSplitMax, "direct-read-split-max", 0, "Max number of times to split a collection for direct reads")
-	flag.IntVar(&config.DirectReadConcur, "direct-read-concur", 0, "Max number of direct-read-namespaces to read concurrently. By default all given are read concurrently")
-	flag.Var(&config.RoutingNamespaces, "routing-namespace", "A list of namespaces that override routing information")
-	flag.Var(&config.TimeMachineNamespaces, "time-machine-namespace", "A list of direct read namespaces")
-	flag.StringVar(&config.TimeMachineIndexPrefix, "time-machine-index-prefix", "", "A prefix to preprend to time machine indexes")
-	flag.StringVar(&config.TimeMachineIndexSuffix, "time-machine-index-suffix", "", "A suffix to append to time machine indexes")
-	flag.BoolVar(&config.DirectReadNoTimeout, "direct-read-no-timeout", false, "True to set the no cursor timeout flag for direct reads")
-	flag.BoolVar(&config.TimeMachineDirectReads, "time-machine-direct-reads", false, "True to index the results of direct reads into the any time machine indexes")
-	flag.BoolVar(&config.PipeAllowDisk, "pipe-allow-disk", false, "True to allow MongoDB to use the disk for pipeline options with lots of results")
-	flag.Var(&config.ElasticUrls, "elasticsearch-url", "A list of Elasticsearch URLs")
-	flag.Var(&config.FileNamespaces, "file-namespace", "A list of file namespaces")
-	flag.Var(&config.PatchNamespaces, "patch-namespace", "A list of patch namespaces")
-	flag.Var(&config.Workers, "workers", "A list of worker names")
-	flag.BoolVar(&config.EnableHTTPServer, "enable-http-server", false, "True to enable an internal http server")
-	flag.StringVar(&config.HTTPServerAddr, "http-server-addr", "", "The address the internal http server listens on")
-	flag.BoolVar(&config.PruneInvalidJSON, "prune-invalid-json", false, "True to omit values which do not serialize to JSON such as +Inf and -Inf and thus cause errors")
-	flag.Var(&config.DeleteStrategy, "delete-strategy", "Stategy to use for deletes. 0=stateless,1=stateful,2=ignore")
-	flag.StringVar(&config.DeleteIndexPattern, "delete-index-pattern", "", "An Elasticsearch index-pattern to restric the scope of stateless deletes")
-	flag.StringVar(&config.ConfigDatabaseName, "config-database-name", "", "The MongoDB database name that monstache uses to store metadata")
-	flag.StringVar(&config.OplogTsFieldName, "oplog-ts-field-name", "", "Field name to use for the oplog timestamp")
-	flag.StringVar(&config.OplogDateFieldName, "oplog-date-field-name", "", "Field name to use for the oplog date")
-	flag.StringVar(&config.OplogDateFieldFormat, "oplog-date-field-format", "", "Format to use for the oplog date")
-	flag.BoolVar(&config.Debug, "debug", false, "True to enable verbose debug information")
-	flag.Parse()
-	return config
+// copyField gathers the values of source fields into an aggregate target
+// field while leaving the source fields in place
+type copyField struct {
+	Namespace string
+	Fields    []string
+	Target    string
 }
 
-func (config *configOptions) loadReplacements() {
-	if config.Relate != nil {
-		for _, r := range config.Relate {
-			if r.Namespace != "" || r.WithNamespace != "" {
-				dbCol := strings.SplitN(r.WithNamespace, ".", 2)
-				if len(dbCol) != 2 {
-					panic("Replacement namespace is invalid: " + r.WithNamespace)
-				}
-				database, collection := dbCol[0], dbCol[1]
-				r := &relation{
-					Namespace:     r.Namespace,
-					WithNamespace: r.WithNamespace,
-					SrcField:      r.SrcField,
-					MatchField:    r.MatchField,
-					DotNotation:   r.DotNotation,
-					KeepSrc:       r.KeepSrc,
-					MaxDepth:      r.MaxDepth,
-					db:            database,
-					col:           collection,
-				}
-				if r.SrcField == "" {
-					r.SrcField = "_id"
-				}
-				if r.MatchField == "" {
-					r.MatchField = "_id"
-				}
-				relates[r.Namespace] = append(relates[r.Namespace], r)
-			} else {
-				panic("Relates must specify namespace and with-namespace")
-			}
-		}
-	}
+// referenceCollection is a small collection preloaded into memory and kept
+// current with a change stream so that documents can be joined with it
+type referenceCollection struct {
+	Namespace string
+	Key       string
+	MaxDocs   int `toml:"max-docs"`
+	db        string
+	col       string
+	byID      map[interface{}]map[string]interface{}
+	byKey     map[interface{}]map[string]interface{}
 }
 
-func (config *configOptions) loadIndexTypes() {
-	if config.Mapping != nil {
-		for _, m := range config.Mapping {
-			if m.Namespace != "" && (m.Index != "" || m.Type != "") {
-				mapIndexTypes[m.Namespace] = &indexTypeMapping{
-					Namespace: m.Namespace,
-					Index:     strings.ToLower(m.Index),
-					Type:      m.Type,
-				}
-			} else {
-				panic("Mappings must specify namespace and at least one of index and type")
-			}
-		}
-	}
+// referenceCache holds the documents of the reference collections
+type referenceCache struct {
+	lock        sync.RWMutex
+	collections map[string]*referenceCollection
 }
 
-func (config *configOptions) loadPipelines() {
-	for _, s := range config.Pipeline {
-		if s.Path == "" && s.Script == "" {
-			panic("Pipelines must specify path or script attributes")
-		}
-		if s.Path != "" && s.Script != "" {
-			panic("Pipelines must specify path or script but not both")
-		}
-		if s.Path != "" {
-			if script, err := ioutil.ReadFile(s.Path); err == nil {
-				s.Script = string(script[:])
-			} else {
-				panic(fmt.Sprintf("Unable to load pipeline at path %s: %s", s.Path, err))
-			}
-		}
-		if _, exists := filterEnvs[s.Namespace]; exists {
-			panic(fmt.Sprintf("Multiple pipelines with namespace: %s", s.Namespace))
-		}
-		env := &executionEnv{
-			VM:     otto.New(),
-			Script: s.Script,
-			lock:   &sync.Mutex{},
-		}
-		if err := env.VM.Set("module", make(map[string]interface{})); err != nil {
-			panic(err)
-		}
-		if _, err := env.VM.Run(env.Script); err != nil {
-			panic(err)
-		}
-		val, err := env.VM.Run("module.exports")
-		if err != nil {
-			panic(err)
-		} else if !val.IsFunction() {
-			panic("module.exports must be a function")
-		}
-		pipeEnvs[s.Namespace] = env
-	}
+// enrichment sets a target field to the reference documents whose key is
+// the value of a field.  Arrays of keys yield arrays of documents
+type enrichment struct {
+	Namespace string
+	Reference string
+	Field     string
+	Target    string
+	Fields    []string
 }
 
-func (config *configOptions) loadFilters() {
-	for _, s := range config.Filter {
-		if s.Script != "" || s.Path != "" {
-			if s.Path != "" && s.Script != "" {
-				panic("Filters must specify path or script but not both")
-			}
-			if s.Path != "" {
-				if script, err := ioutil.ReadFile(s.Path); err == nil {
-					s.Script = string(script[:])
-				} else {
-					panic(fmt.Sprintf("Unable to load filter at path %s: %s", s.Path, err))
-				}
-			}
-			if _, exists := filterEnvs[s.Namespace]; exists {
-				panic(fmt.Sprintf("Multiple filters with namespace: %s", s.Namespace))
-			}
-			env := &executionEnv{
-				VM:     otto.New(),
-				Script: s.Script,
-				lock:   &sync.Mutex{},
-			}
-			if err := env.VM.Set("module", make(map[string]interface{})); err != nil {
-				panic(err)
-			}
-			if _, err := env.VM.Run(env.Script); err != nil {
-				panic(err)
-			}
-			val, err := env.VM.Run("module.exports")
-			if err != nil {
-				panic(err)
-			} else if !val.IsFunction() {
-				panic("module.exports must be a function")
-			}
-			filterEnvs[s.Namespace] = env
-		} else {
-			panic("Filters must specify path or script attributes")
-		}
-	}
+type geoField struct {
+	Namespace string
+	Field     string
+	Type      string
+	OnError   string `toml:"on-error"`
 }
 
-func (config *configOptions) loadScripts() {
-	for _, s := range config.Script {
-		if s.Script != "" || s.Path != "" {
-			if s.Path != "" && s.Script != "" {
-				panic("Scripts must specify path or script but not both")
-			}
-			if s.Path != "" {
-				if script, err := ioutil.ReadFile(s.Path); err == nil {
-					s.Script = string(script[:])
-				} else {
-					panic(fmt.Sprintf("Unable to load script at path %s: %s", s.Path, err))
-				}
-			}
-			if _, exists := mapEnvs[s.Namespace]; exists {
-				panic(fmt.Sprintf("Multiple scripts with namespace: %s", s.Namespace))
-			}
-			env := &executionEnv{
-				VM:     otto.New(),
-				Script: s.Script,
-				lock:   &sync.Mutex{},
-			}
-			if err := env.VM.Set("module", make(map[string]interface{})); err != nil {
-				panic(err)
-			}
-			if _, err := env.VM.Run(env.Script); err != nil {
-				panic(err)
-			}
-			val, err := env.VM.Run("module.exports")
-			if err != nil {
-				panic(err)
-			} else if !val.IsFunction() {
-				panic("module.exports must be a function")
-			}
+// documentSize limits the JSON size of documents in a namespace.  Fields are
+// truncated (strings) or dropped largest first until the document fits
+type documentSize struct {
+	Namespace string
+	MaxBytes  int `toml:"max-bytes"`
+	Fields    []string
+	Action    string
+}
 
-			mapEnvs[s.Namespace] = env
-			if s.Routing {
-				routingNamespaces[s.Namespace] = true
-			}
-		} else {
-			panic("Scripts must specify path or script")
-		}
-	}
+// offloadStore is the S3 compatible bucket, such as one in GCS, holding the
+// fields offloaded from large documents.  Objects are keyed by namespace,
+// document id and field so that changes overwrite them
+type offloadStore struct {
+	Bucket         string
+	Prefix         string
+	Region         string
+	Endpoint       string
+	ForcePathStyle bool   `toml:"force-path-style"`
+	AccessKey      string `toml:"access-key"`
+	SecretKey      string `toml:"secret-key" json:"-"`
+	URLPrefix      string `toml:"url-prefix"`
+	s3             s3iface.S3API
 }
 
-func (config *configOptions) loadPlugins() *configOptions {
-	if config.MapperPluginPath != "" {
-		funcDefined := false
-		p, err := plugin.Open(config.MapperPluginPath)
-		if err != nil {
-			panic(fmt.Sprintf("Unable to load mapper plugin %s: %s", config.MapperPluginPath, err))
-		}
-		mapper, err := p.Lookup("Map")
-		if err == nil {
-			funcDefined = true
-			switch mapper.(type) {
-			case func(*monstachemap.MapperPluginInput) (*monstachemap.MapperPluginOutput, error):
-				mapperPlugin = mapper.(func(*monstachemap.MapperPluginInput) (*monstachemap.MapperPluginOutput, error))
-			default:
-				panic(fmt.Sprintf("Plugin 'Map' function must be typed %T", mapperPlugin))
-			}
-		}
-		filter, err := p.Lookup("Filter")
-		if err == nil {
-			funcDefined = true
-			switch filter.(type) {
-			case func(*monstachemap.MapperPluginInput) (bool, error):
-				filterPlugin = filter.(func(*monstachemap.MapperPluginInput) (bool, error))
-			default:
-				panic(fmt.Sprintf("Plugin 'Filter' function must be typed %T", filterPlugin))
-			}
+// offload moves fields of the documents of a namespace larger than
+// min-bytes to the offload store.  Each field is replaced by a pointer to
+// its object with a preview of its text
+type offload struct {
+	Namespace    string
+	Fields       []string
+	MinBytes     int `toml:"min-bytes"`
+	PreviewBytes int `toml:"preview-bytes"`
+}
 
-		}
-		process, err := p.Lookup("Process")
-		if err == nil {
-			funcDefined = true
-			switch process.(type) {
-			case func(*monstachemap.ProcessPluginInput) error:
-				processPlugin = process.(func(*monstachemap.ProcessPluginInput) error)
-			default:
-				panic(fmt.Sprintf("Plugin 'Process' function must be typed %T", processPlugin))
-			}
-		}
-		pipe, err := p.Lookup("Pipeline")
-		if err == nil {
-			funcDefined = true
-			switch pipe.(type) {
-			case func(string, bool) ([]interface{}, error):
-				pipePlugin = pipe.(func(string, bool) ([]interface{}, error))
-			default:
-				panic(fmt.Sprintf("Plugin 'Pipeline' function must be typed %T", pipePlugin))
+// offloadObject is a field value waiting to be uploaded
+type offloadObject struct {
+	key         string
+	contentType string
+	body        []byte
+}
+
+// deleteRouting chooses how the index and routing of the deleted documents
+// of a namespace are found, since deletes only carry the document id.
+// cache remembers them as documents are indexed and pre-image reads them
+// from the MongoDB pre-image of the deleted document.  Both fall back to
+// searching Elasticsearch by id
+type deleteRouting struct {
+	Namespace string
+	Strategy  string
+	CacheSize int `toml:"cache-size"`
+	strategy  deleteStrategy
+	cache     *routingTracker
+}
+
+// tombstone marks the deleted documents of a namespace with a flag and the
+// time of the delete instead of deleting them.  Tombstones older than the
+// retention are purged
+type tombstone struct {
+	Namespace      string
+	Field          string
+	DeletedAtField string `toml:"deleted-at-field"`
+	Retention      string
+	retention      time.Duration
+}
+
+type rollover struct {
+	Namespace    string
+	MaxAge       string `toml:"max-age"`
+	MaxDocs      int64  `toml:"max-docs"`
+	MaxSize      string `toml:"max-size"`
+	CheckSeconds int    `toml:"check-seconds"`
+}
+
+type reindex struct {
+	Namespace string
+	Path      string
+	KeepOld   bool `toml:"keep-old"`
+}
+
+// reindexJob tracks a namespace being reindexed into a new versioned index.
+// Direct reads write to the new index while change events are written to
+// both the current alias and the new index until the alias is swapped
+type reindexJob struct {
+	reindex
+	body     map[string]interface{}
+	alias    string
+	target   string
+	previous []string
+	concrete bool
+	active   int32
+	pending  sync.WaitGroup
+	reads    sync.Map
+}
+
+// shadow sends a sample of the documents of a namespace to a shadow index
+// as well.  The copies are mapped by a candidate plugin or indexed with a
+// candidate index body and compared with the documents indexed normally
+type shadow struct {
+	Namespace string
+	Index     string
+	Path      string
+	Plugin    string
+	Percent   float64
+}
+
+type shadowIndex struct {
+	shadow
+	body     map[string]interface{}
+	mapper   func(*monstachemap.MapperPluginInput) (*monstachemap.MapperPluginOutput, error)
+	target   string
+	sampled  int64
+	matched  int64
+	differed int64
+	rejected int64
+}
+
+// shadowDiff lists the fields in dot notation which a shadow document
+// added, removed or changed
+type shadowDiff struct {
+	Added   []string
+	Removed []string
+	Changed []string
+}
+
+// verifyReport is the result of comparing a namespace with its index.  At
+// most verifyReportMaxIds ids of each kind are listed
+type verifyReport struct {
+	Namespace       string            `json:"namespace"`
+	Index           string            `json:"index"`
+	Command         string            `json:"command"`
+	Started         time.Time         `json:"started"`
+	Finished        time.Time         `json:"finished"`
+	DurationMs      int64             `json:"durationMs"`
+	Synced          bool              `json:"synced"`
+	Documents       int               `json:"documents"`
+	Indexed         int64             `json:"indexed"`
+	Checked         int               `json:"checked"`
+	Ranges          int               `json:"ranges"`
+	DifferingRanges int               `json:"differingRanges"`
+	MissingCount    int               `json:"missingCount"`
+	ExtraCount      int               `json:"extraCount"`
+	MismatchedCount int               `json:"mismatchedCount"`
+	ReindexCount    int               `json:"reindexCount,omitempty"`
+	DeleteCount     int               `json:"deleteCount,omitempty"`
+	Missing         []string          `json:"missing,omitempty"`
+	Extra           []string          `json:"extra,omitempty"`
+	Mismatched      []*verifyMismatch `json:"mismatched,omitempty"`
+}
+
+// verifyMismatch is a document which differs from its mapped source
+type verifyMismatch struct {
+	ID string `json:"id"`
+	*shadowDiff
+}
+
+type verifier struct {
+	config *configOptions
+	mongo  *mgo.Session
+	client *elastic.Client
+	report *verifyReport
+	seen   map[string]bool // ids compared by a full comparison
+	repair *repairer
+}
+
+// orphanSweeper periodically deletes the documents of an index whose
+// MongoDB documents no longer exist.  They are left behind when deletes fall
+// out of the oplog window during an outage
+type orphanSweeper struct {
+	config   *configOptions
+	mongo    *mgo.Session
+	client   *elastic.Client
+	bulk     *elastic.BulkProcessor
+	interval time.Duration
+	stopC    chan bool
+	doneC    chan bool
+}
+
+// bulkGate tracks whether the bulk processors are running.  Requests added
+// from outside the event loop go through it because adding to a stopped
+// processor panics
+type bulkGate struct {
+	lock    sync.RWMutex
+	stopped bool
+}
+
+// schemaDriftDetector compares the fields emitted to each index with the
+// fields of its mapping and reports those left unmapped or mapped by dynamic
+// mapping with an unexpected type
+type schemaDriftDetector struct {
+	config   *configOptions
+	client   *elastic.Client
+	lock     sync.Mutex
+	indexes  map[string]*observedSchema
+	reported map[string]bool
+}
+
+// observedSchema is the family of each field path emitted to an index
+type observedSchema struct {
+	namespace string
+	fields    map[string]string
+}
+
+// routedCopy is where a document was indexed
+type routedCopy struct {
+	Index   string
+	Routing string
+}
+
+// routingTracker remembers the routing each document of a routed namespace
+// was indexed with so that the copy left under the old routing can be
+// deleted when the routing changes
+type routingTracker struct {
+	size  int
+	cache map[string]routedCopy
+	keys  []string
+	next  int
+	lock  sync.Mutex
+}
+
+// repairer sends the requests which repair the documents found out of sync
+// in batches of repair-batch-size.  Without repair-apply the repairs are
+// only reported
+type repairer struct {
+	apply  bool
+	size   int
+	rate   int
+	bulk   *elastic.BulkService
+	last   time.Time
+	failed int
+}
+
+type findConf struct {
+	vm            *otto.Otto
+	ns            string
+	name          string
+	session       *mgo.Session
+	byId          bool
+	multi         bool
+	pipe          bool
+	pipeAllowDisk bool
+}
+
+type findCall struct {
+	config  *findConf
+	session *mgo.Session
+	query   interface{}
+	db      string
+	col     string
+	limit   int
+	sort    []string
+	sel     map[string]int
+}
+
+// logFields are the correlation fields of a log line.  They are only
+// written with JSON logs since text log messages already name the document
+type logFields struct {
+	Namespace  string      `json:"namespace,omitempty"`
+	ID         interface{} `json:"id,omitempty"`
+	Operation  string      `json:"operation,omitempty"`
+	Index      string      `json:"index,omitempty"`
+	ResumeTs   string      `json:"resume_ts,omitempty"`
+	ErrorClass string      `json:"error_class,omitempty"`
+}
+
+type jsonLogEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"msg"`
+	logFields
+}
+
+// jsonLogWriter turns the lines of a log.Logger into JSON objects
+type jsonLogWriter struct {
+	out   io.Writer
+	level string
+	lock  sync.Mutex
+}
+
+type logFiles struct {
+	Info  string
+	Warn  string
+	Error string
+	Trace string
+	Stats string
+}
+
+type indexingMeta struct {
+	Routing         string
+	Index           string
+	Type            string
+	Parent          string
+	Version         int64
+	VersionType     string
+	Pipeline        string
+	RetryOnConflict int
+	Skip            bool
+	ID              string
+	offloads        []*offloadObject
+}
+
+type outputChans struct {
+	indexC   chan *gtm.Op
+	processC chan *gtm.Op
+	fileC    chan *gtm.Op
+	relateC  chan *gtm.Op
+	filter   gtm.OpFilter
+}
+
+type mongoDialSettings struct {
+	Timeout        int
+	Ssl            bool
+	ReadTimeout    int      `toml:"read-timeout"`
+	WriteTimeout   int      `toml:"write-timeout"`
+	ConnectTimeout int      `toml:"connect-timeout"`
+	MaxPoolSize    int      `toml:"max-pool-size"`
+	MinPoolSize    int      `toml:"min-pool-size"`
+	MaxIdleTimeMs  int      `toml:"max-idle-time-ms"`
+	PoolTimeout    int      `toml:"pool-timeout"`
+	ReadPreference string   `toml:"read-preference"`
+	Compressors    []string `toml:"compressors"`
+}
+
+type mongoSessionSettings struct {
+	SocketTimeout int `toml:"socket-timeout"`
+	SyncTimeout   int `toml:"sync-timeout"`
+}
+
+type mongoX509Settings struct {
+	ClientCertPemFile string `toml:"client-cert-pem-file"`
+	ClientKeyPemFile  string `toml:"client-key-pem-file"`
+}
+
+// kerberosSettings authenticate to MongoDB with GSSAPI.  The principal
+// authenticates with the password or with the keys in the keytab
+type kerberosSettings struct {
+	Principal   string `toml:"principal"`
+	Password    string `toml:"password"`
+	Keytab      string `toml:"keytab"`
+	ServiceName string `toml:"service-name"`
+	ServiceHost string `toml:"service-host"`
+	Krb5Config  string `toml:"krb5-config"`
+}
+
+// csfleSettings decide what happens to fields encrypted by client-side field
+// level encryption.  keep indexes the encrypted binary as is
+type csfleSettings struct {
+	Policy            string
+	KeyVaultNamespace string `toml:"key-vault-namespace"`
+	LocalMasterKey    string `toml:"local-master-key"`
+	AWSAccessKey      string `toml:"aws-access-key"`
+	AWSSecretKey      string `toml:"aws-secret-key"`
+}
+
+type gtmSettings struct {
+	ChannelSize           int    `toml:"channel-size"`
+	BufferSize            int    `toml:"buffer-size"`
+	BufferDuration        string `toml:"buffer-duration"`
+	ChangeStreamBatchSize int    `toml:"change-stream-batch-size"`
+	MaxAwaitSecs          int    `toml:"max-await-secs"`
+}
+
+type apiKeyTransport struct {
+	transport http.RoundTripper
+	path      string
+	header    string
+	modTime   time.Time
+	lock      sync.RWMutex
+}
+
+// clientCertificate is the certificate presented to Elasticsearch or
+// MongoDB for mutual TLS.  It is reloaded when its files or secrets change
+type clientCertificate struct {
+	target  string
+	certOpt string
+	keyOpt  string
+	cert    string
+	key     string
+	loaded  string
+	current *tls.Certificate
+	rotated func(*tls.Certificate)
+	lock    sync.RWMutex
+}
+
+// certPool is the CA bundle which verifies the servers of TLS connections.
+// It is reloaded when its file or secret changes so that a rotated CA
+// applies to new connections
+type certPool struct {
+	target string
+	source func() string
+	loaded string
+	pool   *x509.CertPool
+	lock   sync.RWMutex
+}
+
+// mongoRotation logs the MongoDB sessions in again when the credentials of
+// the connection URL or the X509 client certificate rotate.  Connections
+// which are already authenticated stay open while new connections use the
+// new credentials
+type mongoRotation struct {
+	sessions []*mgo.Session
+	cred     *mgo.Credential
+	lock     sync.Mutex
+}
+
+type gzipTransport struct {
+	transport http.RoundTripper
+	level     int
+}
+
+// traceTransport dumps the requests to Elasticsearch and their responses to
+// the trace log while verbose logging is on
+type traceTransport struct {
+	transport http.RoundTripper
+}
+
+// bulkSplitTransport bisects bulk requests which Elasticsearch rejects with
+// 413 Request Entity Too Large.  A bulk processor keeps a failed batch and
+// resends it on every commit, so the halves are sent here until each is
+// accepted and the processor is answered for the whole batch
+type bulkSplitTransport struct {
+	transport http.RoundTripper
+}
+
+// bulkSplitResponse is the bulk response answered for a split batch
+type bulkSplitResponse struct {
+	Took   int                                 `json:"took"`
+	Errors bool                                `json:"errors"`
+	Items  []map[string]map[string]interface{} `json:"items"`
+}
+
+// bulkAction is the action line of a bulk request followed by its source
+type bulkAction struct {
+	lines [][]byte
+	op    string
+	meta  map[string]interface{}
+}
+
+// verboseLogger logs to a logger only while verbose logging is on
+type verboseLogger struct {
+	logger *log.Logger
+}
+
+// namespaceFilter is the filter built from the namespace regexes.  It is
+// replaced when the config file is reloaded
+type namespaceFilter struct {
+	lock    sync.RWMutex
+	filter  gtm.OpFilter
+	matches *sync.Map
+	cached  int32
+}
+
+// namespaceMatch is the key of a cached namespace filter decision.  The
+// namespace regexes only depend on the namespace and whether op is a drop
+type namespaceMatch struct {
+	namespace string
+	drop      bool
+}
+
+// configReloader applies changes to the config file while running.  Only
+// the namespace regexes, verbose and debug are changed live and the other
+// changed options are reported as requiring a restart
+type configReloader struct {
+	lock   sync.Mutex
+	config *configOptions
+	file   *configOptions
+	live   *configOptions
+}
+
+// configReload is the outcome of a reload
+type configReload struct {
+	Applied []string `json:"applied"`
+	Restart []string `json:"restart"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// logLevel is the verbosity of the logs which may be changed at runtime.
+// Debug logs the MongoDB driver activity to the trace log
+type logLevel struct {
+	Verbose *bool `json:"verbose,omitempty"`
+	Debug   *bool `json:"debug,omitempty"`
+}
+
+// httpCredential grants a role on the http server by basic auth or by a
+// bearer token.  The read role can view stats and status and the admin role
+// can also pause, resume, resync and reload.  Probes are always open
+type httpCredential struct {
+	User     string
+	Password string
+	Token    string
+	Role     string
+}
+
+const (
+	httpRoleRead  = "read"
+	httpRoleAdmin = "admin"
+)
+
+type httpServerCtx struct {
+	httpServer *http.Server
+	bulk       *elastic.BulkProcessor
+	mongo      *mgo.Session
+	client     *elastic.Client
+	config     *configOptions
+	reloader   *configReloader
+	shutdown   bool
+	started    time.Time
+}
+
+// readiness is the progress of the event loop reported by /readyz.  On
+// startup the direct reads finish first and then the change events catch up
+// to within catchUpLag of the cluster time.  Once the process has started it
+// stays started
+type readiness struct {
+	lock               sync.Mutex
+	directReadsPending bool
+	lastTs             bson.MongoTimestamp
+	savedTs            bson.MongoTimestamp
+	lastAdvance        time.Time
+	catchUpLag         time.Duration
+	catchUpSince       time.Time
+	eventLag           time.Duration
+	eventAt            time.Time
+	started            bool
+}
+
+type instanceStatus struct {
+	Enabled      bool                `json:"enabled"`
+	Pid          int                 `json:"pid"`
+	Hostname     string              `json:"hostname"`
+	ClusterName  string              `json:"cluster"`
+	ResumeName   string              `json:"resumeName"`
+	LastTs       bson.MongoTimestamp `json:"lastTs"`
+	LastTsFormat string              `json:"lastTsFormat,omitempty"`
+}
+
+// supportResume is the resume state captured in a support bundle
+type supportResume struct {
+	ResumeName   string              `json:"resumeName"`
+	Enabled      bool                `json:"enabled"`
+	LastTs       bson.MongoTimestamp `json:"lastTs"`
+	LastTsFormat string              `json:"lastTsFormat,omitempty"`
+	Saved        *resumeToken        `json:"saved,omitempty"`
+	Error        string              `json:"error,omitempty"`
+}
+
+// logRing keeps the most recent lines written to a logger
+type logRing struct {
+	lock  sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+type statusResponse struct {
+	enabled bool
+	lastTs  bson.MongoTimestamp
+}
+
+type statusRequest struct {
+	responseC chan *statusResponse
+}
+
+// pauseRequest asks the event loop to pause or resume syncing a namespace
+// or, when the namespace is empty, all namespaces
+type pauseRequest struct {
+	namespace string
+	pause     bool
+	responseC chan *pauseStatus
+}
+
+// pauseStatus is the response of the pause and resume endpoints
+type pauseStatus struct {
+	Paused     bool     `json:"paused"`
+	Namespaces []string `json:"namespaces"`
+	Held       int      `json:"held"`
+	Checkpoint string   `json:"checkpoint,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// syncPause holds the events of paused namespaces until they are resumed.
+// It is only used by the event loop
+type syncPause struct {
+	all        bool
+	namespaces map[string]bool
+	held       []*gtm.Op
+}
+
+// resyncer runs direct reads of single namespaces requested through the
+// admin API while the process keeps syncing
+type resyncer struct {
+	session *mgo.Session
+	options *gtm.Options
+	config  *configOptions
+	lock    sync.Mutex
+	active  map[string]*resyncJob
+}
+
+type resyncJob struct {
+	namespace string
+	selector  bson.M
+	read      int64
+	err       error
+	doneC     chan struct{}
+}
+
+// resyncProgress is streamed by the resync endpoint until the read is done
+type resyncProgress struct {
+	Namespace string `json:"namespace"`
+	Read      int64  `json:"read"`
+	Done      bool   `json:"done"`
+	Error     string `json:"error,omitempty"`
+}
+
+type configOptions struct {
+	EnableTemplate           bool
+	EnvDelimiter             string
+	MongoURL                 string               `toml:"mongo-url"`
+	MongoConfigURL           string               `toml:"mongo-config-url"`
+	MongoPemFile             string               `toml:"mongo-pem-file"`
+	MongoValidatePemFile     bool                 `toml:"mongo-validate-pem-file"`
+	MongoAWSAuth             bool                 `toml:"mongo-aws-auth"`
+	MongoTLSMinVersion       string               `toml:"mongo-tls-min-version"`
+	MongoTLSCipherSuites     stringargs           `toml:"mongo-tls-cipher-suites"`
+	MongoOpLogDatabaseName   string               `toml:"mongo-oplog-database-name"`
+	MongoOpLogCollectionName string               `toml:"mongo-oplog-collection-name"`
+	MongoDialSettings        mongoDialSettings    `toml:"mongo-dial-settings"`
+	MongoSessionSettings     mongoSessionSettings `toml:"mongo-session-settings"`
+	MongoX509Settings        mongoX509Settings    `toml:"mongo-x509-settings"`
+	MongoKerberosSettings    kerberosSettings     `toml:"mongo-kerberos-settings"`
+	GtmSettings              gtmSettings          `toml:"gtm-settings"`
+	CSFLE                    csfleSettings        `toml:"csfle"`
+	Chaos                    chaosSettings        `toml:"chaos"`
+	AWSConnect               awsConnect           `toml:"aws-connect"`
+	KafkaSink                *kafkaSink           `toml:"kafka-sink"`
+	RedisSink                *redisSink           `toml:"redis-sink"`
+	NotificationSink         *notificationSink    `toml:"notification-sink"`
+	WebhookSink              *webhookSink         `toml:"webhook-sink"`
+	ArchiveSink              *archiveSink         `toml:"archive-sink"`
+	OffloadStore             *offloadStore        `toml:"offload-store"`
+	MeilisearchSink          *meilisearchSink     `toml:"meilisearch-sink"`
+	TypesenseSink            *typesenseSink       `toml:"typesense-sink"`
+	PostgresSink             *postgresSink        `toml:"postgres-sink"`
+	NATSSink                 *natsSink            `toml:"nats-sink"`
+	DisableElasticsearch     bool                 `toml:"disable-elasticsearch"`
+	NDJSONFile               string               `toml:"ndjson-file"`
+	RecordFile               string               `toml:"record-file"`
+	ReplayFile               string               `toml:"replay-file"`
+	DryRun                   bool                 `toml:"dry-run"`
+	Logs                     logFiles             `toml:"logs"`
+	GraylogAddr              string               `toml:"graylog-addr"`
+	LogFormat                string               `toml:"log-format"`
+	ElasticUrls              stringargs           `toml:"elasticsearch-urls"`
+	ElasticUser              string               `toml:"elasticsearch-user"`
+	ElasticPassword          string               `toml:"elasticsearch-password"`
+	ElasticAPIKey            string               `toml:"elasticsearch-api-key"`
+	ElasticAPIKeyFile        string               `toml:"elasticsearch-api-key-file"`
+	ElasticCloudID           string               `toml:"elasticsearch-cloud-id"`
+	SecondaryElasticUrls     stringargs           `toml:"secondary-elasticsearch-urls"`
+	DebugSampleRate          float64              `toml:"debug-sample-rate"`
+	DebugDocumentIds         stringargs           `toml:"debug-document-ids"`
+	NotifyWebhooks           []notifyWebhook      `toml:"notify-webhook"`
+	NotifyRateLimit          int                  `toml:"notify-rate-limit"`
+	NotifyBulkFailureSeconds int                  `toml:"notify-bulk-failure-seconds"`
+	SecondaryElasticUser     string               `toml:"secondary-elasticsearch-user"`
+	SecondaryElasticPassword string               `toml:"secondary-elasticsearch-password"`
+	SecondaryElasticAPIKey   string               `toml:"secondary-elasticsearch-api-key"`
+	ElasticPemFile           string               `toml:"elasticsearch-pem-file"`
+	ElasticValidatePemFile   bool                 `toml:"elasticsearch-validate-pem-file"`
+	ElasticClientCert        string               `toml:"elasticsearch-client-cert"`
+	ElasticClientKey         string               `toml:"elasticsearch-client-key"`
+	ElasticTLSMinVersion     string               `toml:"elasticsearch-tls-min-version"`
+	ElasticTLSCipherSuites   stringargs           `toml:"elasticsearch-tls-cipher-suites"`
+	ElasticVersion           string               `toml:"elasticsearch-version"`
+	ElasticHealth0           int                  `toml:"elasticsearch-healthcheck-timeout-startup"`
+	ElasticHealth1           int                  `toml:"elasticsearch-healthcheck-timeout"`
+	ResumeName               string               `toml:"resume-name"`
+	NsRegex                  string               `toml:"namespace-regex"`
+	NsDropRegex              string               `toml:"namespace-drop-regex"`
+	NsExcludeRegex           string               `toml:"namespace-exclude-regex"`
+	NsDropExcludeRegex       string               `toml:"namespace-drop-exclude-regex"`
+	ClusterName              string               `toml:"cluster-name"`
+	ClusterLeaseSeconds      int                  `toml:"cluster-lease-seconds"`
+	ClusterHeartbeatSeconds  int                  `toml:"cluster-heartbeat-seconds"`
+	PartitionName            string               `toml:"partition-name"`
+	PartitionMember          string               `toml:"partition-member"`
+	Print                    bool                 `toml:"print-config"`
+	Version                  bool
+	Pprof                    bool
+	PprofUser                string `toml:"pprof-user"`
+	PprofPassword            string `toml:"pprof-password"`
+	AdminUser                string `toml:"admin-user"`
+	AdminPassword            string `toml:"admin-password"`
+	Metrics                  bool
+	StatsdAddr               string  `toml:"statsd-addr"`
+	StatsdPrefix             string  `toml:"statsd-prefix"`
+	StatsdFlushSeconds       int     `toml:"statsd-flush-seconds"`
+	TracingEndpoint          string  `toml:"tracing-endpoint"`
+	ReplicationLagThreshold  int     `toml:"replication-lag-threshold"`
+	ReplicationLagAlertURL   string  `toml:"replication-lag-alert-url"`
+	ReadyLagSeconds          int     `toml:"ready-lag-seconds"`
+	TracingServiceName       string  `toml:"tracing-service-name"`
+	TracingSampleRatio       float64 `toml:"tracing-sample-ratio"`
+	DisableChangeEvents      bool    `toml:"disable-change-events"`
+	EnableEasyJSON           bool    `toml:"enable-easy-json"`
+	Stats                    bool
+	IndexStats               bool   `toml:"index-stats"`
+	StatsDuration            string `toml:"stats-duration"`
+	StatsIndexFormat         string `toml:"stats-index-format"`
+	DeadLetterIndex          string `toml:"dead-letter-index"`
+	DeadLetterFile           string `toml:"dead-letter-file"`
+	AuditIndex               string `toml:"audit-index"`
+	AuditFile                string `toml:"audit-file"`
+	UUIDRepresentation       string `toml:"uuid-representation"`
+	BinaryEncoding           string `toml:"binary-encoding"`
+	ReplayDeadLetters        bool
+	PreviewNamespaces        stringargs
+	PreviewSize              int
+	Gzip                     bool
+	GzipLevel                int `toml:"gzip-level"`
+	Verbose                  bool
+	Resume                   bool
+	ResumeWriteUnsafe        bool  `toml:"resume-write-unsafe"`
+	ResumeFromTimestamp      int64 `toml:"resume-from-timestamp"`
+	Replay                   bool
+	DroppedDatabases         bool   `toml:"dropped-databases"`
+	DroppedCollections       bool   `toml:"dropped-collections"`
+	IndexFiles               bool   `toml:"index-files"`
+	IndexAsUpdate            bool   `toml:"index-as-update"`
+	FileHighlighting         bool   `toml:"file-highlighting"`
+	EnablePatches            bool   `toml:"enable-patches"`
+	FailFast                 bool   `toml:"fail-fast"`
+	IndexOplogTime           bool   `toml:"index-oplog-time"`
+	OplogTsFieldName         string `toml:"oplog-ts-field-name"`
+	OplogDateFieldName       string `toml:"oplog-date-field-name"`
+	OplogDateFieldFormat     string `toml:"oplog-date-field-format"`
+	ExitAfterDirectReads     bool   `toml:"exit-after-direct-reads"`
+	DrainTimeoutSeconds      int    `toml:"drain-timeout-seconds"`
+	CheckpointInterval       int    `toml:"checkpoint-interval-seconds"`
+	CheckpointMode           string `toml:"checkpoint-mode"`
+	MergePatchAttr           string `toml:"merge-patch-attribute"`
+	ElasticMaxConns          int    `toml:"elasticsearch-max-conns"`
+	ElasticRetry             bool   `toml:"elasticsearch-retry"`
+	AdaptiveBackpressure     bool   `toml:"adaptive-backpressure"`
+	AdaptiveBulk             bool   `toml:"adaptive-bulk"`
+	AdaptiveBulkMinBytes     int    `toml:"adaptive-bulk-min-bytes"`
+	AdaptiveBulkTargetMs     int    `toml:"adaptive-bulk-target-ms"`
+	ElasticMaxDocs           int    `toml:"elasticsearch-max-docs"`
+	ElasticMaxBytes          int    `toml:"elasticsearch-max-bytes"`
+	ElasticMaxContentLength  int    `toml:"elasticsearch-max-content-length"`
+	ElasticMaxSeconds        int    `toml:"elasticsearch-max-seconds"`
+	ElasticClientTimeout     int    `toml:"elasticsearch-client-timeout"`
+	SecretRefreshSeconds     int    `toml:"secret-refresh-seconds"`
+	ElasticMajorVersion      int
+	ElasticMinorVersion      int
+	OpenSearch               bool `toml:"opensearch"`
+	OpenSearchMajorVersion   int
+	OpenSearchMinorVersion   int
+	MaxFileSize              int64  `toml:"max-file-size"`
+	FileChunkBytes           int64  `toml:"file-chunk-bytes"`
+	TikaURL                  string `toml:"tika-url"`
+	TikaConcurrency          int    `toml:"tika-concurrency"`
+	TikaMaxBytes             int64  `toml:"tika-max-bytes"`
+	TikaTimeoutSeconds       int    `toml:"tika-timeout-seconds"`
+	ConfigFile               string
+	Profile                  string
+	Script                   []javascript
+	Filter                   []javascript
+	Pipeline                 []javascript
+	Mapping                  []indexTypeMapping
+	IndexTemplate            []indexTemplate `toml:"index-template"`
+	IndexBulk                []indexBulk     `toml:"index-bulk"`
+	IndexSettings            []indexSettings `toml:"index-settings"`
+	RuntimeField             []runtimeField  `toml:"runtime-field"`
+	VersionField             []versionField  `toml:"version-field"`
+	Reindex                  []reindex
+	Shadow                   []shadow
+	IngestPipeline           []ingestPipeline `toml:"ingest-pipeline"`
+	Rollover                 []rollover
+	UpdateConflict           []updateConflict  `toml:"update-conflict"`
+	BulkError                []bulkErrorPolicy `toml:"bulk-error"`
+	Routing                  []routingExpr
+	Join                     []joinRelation
+	Unwind                   []unwind
+	NumberFormat             []numberFormat   `toml:"number-format"`
+	DateFormat               []dateFormat     `toml:"date-format"`
+	ExcludeFields            []fieldExclusion `toml:"exclude-fields"`
+	Redact                   []fieldRedaction
+	PII                      []piiScan `toml:"pii"`
+	Coerce                   []coercion
+	Geo                      []geoField
+	CopyField                []copyField `toml:"copy-field"`
+	Reference                []referenceCollection
+	Enrich                   []enrichment
+	DocumentSize             []documentSize  `toml:"document-size"`
+	DeleteRouting            []deleteRouting `toml:"delete-routing"`
+	Offload                  []offload       `toml:"offload"`
+	Tombstone                []tombstone
+	Embedding                []*embedding
+	TikaField                []tikaField       `toml:"tika-field"`
+	FileFilter               []fileFilter      `toml:"file-filter"`
+	SemanticField            []semanticField   `toml:"semantic-field"`
+	LanguageRouting          []languageRouting `toml:"language-routing"`
+	Relate                   []relation
+	NamespaceDefaults        *namespaceSettings  `toml:"namespace-defaults"`
+	Namespace                []namespaceSettings `toml:"namespace"`
+	FileNamespaces           stringargs          `toml:"file-namespaces"`
+	FileMetadataNamespaces   stringargs          `toml:"file-metadata-namespaces"`
+	PatchNamespaces          stringargs          `toml:"patch-namespaces"`
+	PartialUpdateNamespaces  stringargs          `toml:"partial-update-namespaces"`
+	ArrayUpdateNamespaces    stringargs          `toml:"array-update-namespaces"`
+	StreamJSONNamespaces     stringargs          `toml:"stream-json-namespaces"`
+	SampleMappingNamespaces  stringargs          `toml:"sample-mapping-namespaces"`
+	MappingSampleSize        int                 `toml:"mapping-sample-size"`
+	Workers                  stringargs
+	Worker                   string
+	ChangeStreamNs           stringargs           `toml:"change-stream-namespaces"`
+	DirectReadNs             stringargs           `toml:"direct-read-namespaces"`
+	ReplayUntil              string               `toml:"replay-until"`
+	VerifySample             int                  `toml:"verify-sample"`
+	VerifyReport             string               `toml:"verify-report"`
+	VerifyReportFormat       string               `toml:"verify-report-format"`
+	VerifyReportIndex        string               `toml:"verify-report-index"`
+	ContentHashField         string               `toml:"content-hash-field"`
+	RepairApply              bool                 `toml:"repair-apply"`
+	RepairBatchSize          int                  `toml:"repair-batch-size"`
+	RepairRate               int                  `toml:"repair-rate"`
+	OrphanSweepSeconds       int                  `toml:"orphan-sweep-seconds"`
+	OrphanSweepBatchSize     int                  `toml:"orphan-sweep-batch-size"`
+	DeleteRoutingChanges     bool                 `toml:"delete-routing-changes"`
+	RoutingCacheSize         int                  `toml:"routing-cache-size"`
+	SchemaDriftSeconds       int                  `toml:"schema-drift-seconds"`
+	ReplayNamespaces         stringargs           `toml:"replay-namespaces"`
+	DirectReadSplitMax       int                  `toml:"direct-read-split-max"`
+	DirectReadConcur         int                  `toml:"direct-read-concur"`
+	DirectReadBudget         int                  `toml:"direct-read-budget"`
+	LookupBatchWindowMs      int                  `toml:"lookup-batch-window-ms"`
+	LookupBatchMax           int                  `toml:"lookup-batch-max"`
+	DirectReadRate           int                  `toml:"direct-read-rate"`
+	DirectReadPriorities     []directReadPriority `toml:"direct-read-priority"`
+	NamespaceCursors         []namespaceCursor    `toml:"namespace-cursor"`
+	DirectReadNoTimeout      bool                 `toml:"direct-read-no-timeout"`
+	MapperPluginPath         string               `toml:"mapper-plugin-path"`
+	EnableHTTPServer         bool                 `toml:"enable-http-server"`
+	HTTPServerAddr           string               `toml:"http-server-addr"`
+	HTTPServerTLSCert        string               `toml:"http-server-tls-cert"`
+	HTTPServerTLSKey         string               `toml:"http-server-tls-key"`
+	HTTPCredentials          []httpCredential     `toml:"http-credential"`
+	TimeMachineNamespaces    stringargs           `toml:"time-machine-namespaces"`
+	TimeMachineIndexPrefix   string               `toml:"time-machine-index-prefix"`
+	TimeMachineIndexSuffix   string               `toml:"time-machine-index-suffix"`
+	TimeMachineDirectReads   bool                 `toml:"time-machine-direct-reads"`
+	PipeAllowDisk            bool                 `toml:"pipe-allow-disk"`
+	RoutingNamespaces        stringargs           `toml:"routing-namespaces"`
+	DeleteStrategy           deleteStrategy       `toml:"delete-strategy"`
+	DeleteIndexPattern       string               `toml:"delete-index-pattern"`
+	ConfigDatabaseName       string               `toml:"config-database-name"`
+	ConfigCollection         string               `toml:"config-collection"`
+	ConfigDocument           string               `toml:"config-document"`
+	FileDownloaders          int                  `toml:"file-downloaders"`
+	IndexWorkers             int                  `toml:"index-workers"`
+	CoalesceWindowMs         int                  `toml:"coalesce-window-ms"`
+	CoalesceNamespaces       stringargs           `toml:"coalesce-namespaces"`
+	MemoryBudgetMB           int                  `toml:"memory-budget-mb"`
+	SpillDir                 string               `toml:"spill-dir"`
+	DiskCompression          string               `toml:"disk-compression"`
+	RelateThreads            int                  `toml:"relate-threads"`
+	RelateBuffer             int                  `toml:"relate-buffer"`
+	PostProcessors           int                  `toml:"post-processors"`
+	PruneInvalidJSON         bool                 `toml:"prune-invalid-json"`
+	Debug                    bool
+	unknownOptions           []string
+	central                  *centralConfig
+	extraConfigFiles         []string
+	overrides                map[string]interface{}
+	secretPrefix             string
+}
+
+func (rel *relation) IsIdentity() bool {
+	if rel.SrcField == "_id" && rel.MatchField == "_id" {
+		return true
+	} else {
+		return false
+	}
+}
+
+func (l *logFiles) enabled() bool {
+	return l.Info != "" || l.Warn != "" || l.Error != "" || l.Trace != "" || l.Stats != ""
+}
+
+func (s *mongoX509Settings) enabled() bool {
+	return s.ClientCertPemFile != "" || s.ClientKeyPemFile != ""
+}
+
+func (s *mongoX509Settings) validate() error {
+	if s.ClientCertPemFile != "" || s.ClientKeyPemFile != "" {
+		if s.ClientCertPemFile == "" {
+			return errors.New("Client cert pem file missing for X509 authentication")
+		} else if s.ClientKeyPemFile == "" {
+			return errors.New("Client key pem file missing for X509 authentication")
+		}
+	}
+	return nil
+}
+
+func (s *kerberosSettings) enabled() bool {
+	return s.Principal != "" || s.Password != "" || s.Keytab != ""
+}
+
+func (s *kerberosSettings) validate() error {
+	if s.Principal == "" {
+		return errors.New("Principal missing for Kerberos authentication")
+	}
+	if s.Password != "" && s.Keytab != "" {
+		return errors.New("Kerberos authentication takes a password or a keytab but not both")
+	}
+	if s.Keytab != "" {
+		if _, err := os.Stat(s.Keytab); err != nil {
+			return fmt.Errorf("Unable to read Kerberos keytab: %s", err)
+		}
+	}
+	return nil
+}
+
+// apply points the GSSAPI library at the keytab and krb5.conf, which it
+// only reads from the environment
+func (s *kerberosSettings) apply(dialInfo *mgo.DialInfo) error {
+	if s.Keytab != "" {
+		if err := os.Setenv("KRB5_CLIENT_KTNAME", s.Keytab); err != nil {
+			return err
+		}
+	}
+	if s.Krb5Config != "" {
+		if err := os.Setenv("KRB5_CONFIG", s.Krb5Config); err != nil {
+			return err
+		}
+	}
+	dialInfo.Mechanism = "GSSAPI"
+	dialInfo.Username = s.Principal
+	dialInfo.Password = s.Password
+	dialInfo.Source = "$external"
+	dialInfo.Service = s.ServiceName
+	dialInfo.ServiceHost = s.ServiceHost
+	return nil
+}
+
+func (ks *kafkaSink) enabled() bool {
+	return ks != nil && ks.RestURL != ""
+}
+
+func (ks *kafkaSink) validate() error {
+	if ks.ClusterID == "" {
+		return errors.New("Kafka sink must include cluster-id")
+	}
+	return nil
+}
+
+func (ks *kafkaSink) topic(namespace string) string {
+	if topic := ks.Topics[namespace]; topic != "" {
+		return topic
+	}
+	return ks.TopicPrefix + namespace
+}
+
+func (ks *kafkaSink) start() {
+	if ks.BatchSize <= 0 {
+		ks.BatchSize = 100
+	}
+	if ks.FlushSeconds <= 0 {
+		ks.FlushSeconds = 5
+	}
+	ks.client = &http.Client{Timeout: 30 * time.Second}
+	ks.batches = make(map[string][]interface{})
+	ks.stopC = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(time.Duration(ks.FlushSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ks.flush(); err != nil {
+					errorLog.Printf("Unable to publish to Kafka: %s", err)
+				}
+			case <-ks.stopC:
+				return
+			}
+		}
+	}()
+}
+
+func (rs *redisSink) enabled() bool {
+	return rs != nil && rs.Address != ""
+}
+
+func (rs *redisSink) validate() error {
+	switch rs.Mode {
+	case "", "hash", "json":
+	default:
+		return errors.New("Redis sink mode must be one of hash or json")
+	}
+	return nil
+}
+
+func (rs *redisSink) key(ev *sinkEvent) string {
+	return rs.KeyPrefix + ev.Namespace + ":" + ev.ID
+}
+
+func (rs *redisSink) dial() (err error) {
+	if rs.conn, err = net.DialTimeout("tcp", rs.Address, 10*time.Second); err != nil {
+		return
+	}
+	rs.reader = bufio.NewReader(rs.conn)
+	if rs.Password != "" {
+		if _, err = rs.command("AUTH", rs.Password); err != nil {
+			return
+		}
+	}
+	if rs.Database != 0 {
+		_, err = rs.command("SELECT", strconv.Itoa(rs.Database))
+	}
+	return
+}
+
+// command sends a command in the Redis serialization protocol and reads the
+// reply
+func (rs *redisSink) command(args ...string) (interface{}, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	rs.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if _, err := rs.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(rs.reader)
+}
+
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("Empty reply from Redis")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		replies := make([]interface{}, n)
+		for i := range replies {
+			if replies[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return replies, nil
+	}
+	return nil, fmt.Errorf("Unexpected reply from Redis: %s", line)
+}
+
+// commands returns the commands which apply an event.  Hash documents are
+// replaced on index and merged on update.  JSON documents use JSON.MERGE
+// for updates
+func (rs *redisSink) commands(ev *sinkEvent) (cmds [][]string, err error) {
+	key := rs.key(ev)
+	if ev.Operation == "delete" {
+		return [][]string{{"DEL", key}}, nil
+	}
+	if rs.Mode == "json" {
+		doc, err := json.Marshal(ev.Doc)
+		if err != nil {
+			return nil, err
+		}
+		if ev.Operation == "update" {
+			return [][]string{{"JSON.MERGE", key, "$", string(doc)}}, nil
+		}
+		return [][]string{{"JSON.SET", key, "$", string(doc)}}, nil
+	}
+	hset := []string{"HSET", key}
+	for field, val := range ev.Doc {
+		str, isStr := val.(string)
+		if !isStr {
+			b, err := json.Marshal(val)
+			if err != nil {
+				return nil, err
+			}
+			str = string(b)
+		}
+		hset = append(hset, field, str)
+	}
+	if ev.Operation == "index" {
+		cmds = append(cmds, []string{"MULTI"}, []string{"DEL", key})
+		if len(hset) > 2 {
+			cmds = append(cmds, hset)
+		}
+		cmds = append(cmds, []string{"EXEC"})
+	} else if len(hset) > 2 {
+		cmds = append(cmds, hset)
+	}
+	return
+}
+
+func (rs *redisSink) write(ev *sinkEvent) error {
+	cmds, err := rs.commands(ev)
+	if err != nil {
+		return err
+	}
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	if rs.conn == nil {
+		if err = rs.dial(); err != nil {
+			rs.reset()
+			return err
+		}
+	}
+	for _, cmd := range cmds {
+		if _, err = rs.command(cmd...); err != nil {
+			// drop the connection so that a partial transaction is discarded
+			rs.reset()
+			return err
+		}
+	}
+	return nil
+}
+
+func (rs *redisSink) reset() {
+	if rs.conn != nil {
+		rs.conn.Close()
+		rs.conn = nil
+	}
+}
+
+func (rs *redisSink) flush() error {
+	return nil
+}
+
+func (rs *redisSink) close() error {
+	rs.lock.Lock()
+	defer rs.lock.Unlock()
+	rs.reset()
+	return nil
+}
+
+func (ns *notificationSink) enabled() bool {
+	return ns != nil && (ns.QueueURL != "" || ns.TopicARN != "")
+}
+
+func (ns *notificationSink) validate() error {
+	if ns.QueueURL != "" && ns.TopicARN != "" {
+		return errors.New("Notification sink must specify queue-url or topic-arn but not both")
+	}
+	if ns.Region == "" {
+		return errors.New("Notification sink must specify region")
+	}
+	switch ns.Payload {
+	case "", "document", "diff", "id":
+	default:
+		return errors.New("Notification sink payload must be one of document, diff or id")
+	}
+	return nil
+}
+
+func (ns *notificationSink) start() error {
+	if ns.Payload == "" {
+		ns.Payload = "document"
+	}
+	if ns.FlushSeconds <= 0 {
+		ns.FlushSeconds = 1
+	}
+	creds := (&awsConnect{AccessKey: ns.AccessKey, SecretKey: ns.SecretKey}).credentials()
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(ns.Region), Credentials: creds})
+	if err != nil {
+		return err
+	}
+	if ns.QueueURL != "" {
+		ns.sqs = sqs.New(sess)
+	} else {
+		ns.sns = sns.New(sess)
+	}
+	ns.stopC = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(time.Duration(ns.FlushSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ns.flush(); err != nil {
+					errorLog.Printf("Unable to send notifications: %s", err)
+				}
+			case <-ns.stopC:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (ns *notificationSink) message(ev *sinkEvent) (string, error) {
+	b, err := ev.message(ns.Payload)
+	return string(b), err
+}
+
+// message builds the body of an event for the document, diff or id payload.
+// The diff payload uses the update description when the change carries one
+// and otherwise the document
+func (ev *sinkEvent) message(payload string) ([]byte, error) {
+	msg := ev.header()
+	switch payload {
+	case "document":
+		if ev.Doc != nil {
+			msg["document"] = ev.Doc
+		}
+	case "diff":
+		if ev.Changes != nil {
+			msg["changes"] = ev.Changes
+		} else if ev.Doc != nil {
+			msg["document"] = ev.Doc
+		}
+	}
+	return json.Marshal(msg)
+}
+
+func (ns *notificationSink) attributes(ev *sinkEvent) map[string]*string {
+	return map[string]*string{
+		"operation": aws.String(ev.Operation),
+		"namespace": aws.String(ev.Namespace),
+	}
+}
+
+func (ns *notificationSink) write(ev *sinkEvent) error {
+	body, err := ns.message(ev)
+	if err != nil {
+		return err
+	}
+	if ns.sns != nil {
+		attrs := make(map[string]*sns.MessageAttributeValue)
+		for name, val := range ns.attributes(ev) {
+			attrs[name] = &sns.MessageAttributeValue{DataType: aws.String("String"), StringValue: val}
+		}
+		_, err = ns.sns.Publish(&sns.PublishInput{
+			TopicArn:          aws.String(ns.TopicARN),
+			Message:           aws.String(body),
+			MessageAttributes: attrs,
+		})
+		return err
+	}
+	attrs := make(map[string]*sqs.MessageAttributeValue)
+	for name, val := range ns.attributes(ev) {
+		attrs[name] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: val}
+	}
+	entry := &sqs.SendMessageBatchRequestEntry{
+		MessageBody:       aws.String(body),
+		MessageAttributes: attrs,
+	}
+	if strings.HasSuffix(ns.QueueURL, ".fifo") {
+		// keep the changes of a document in order
+		sum := sha256.Sum256([]byte(body))
+		entry.MessageGroupId = aws.String(ev.Namespace + ":" + ev.ID)
+		entry.MessageDeduplicationId = aws.String(hex.EncodeToString(sum[:]))
+	}
+	ns.lock.Lock()
+	ns.entries = append(ns.entries, entry)
+	var batch []*sqs.SendMessageBatchRequestEntry
+	if len(ns.entries) >= sqsMaxBatchEntries {
+		batch, ns.entries = cutSQSBatch(ns.entries)
+	}
+	ns.lock.Unlock()
+	if batch != nil {
+		failed, err := ns.send(batch)
+		ns.requeue(failed)
+		return err
+	}
+	return nil
+}
+
+// cutSQSBatch splits off the entries of one SendMessageBatch request
+func cutSQSBatch(entries []*sqs.SendMessageBatchRequestEntry) (batch, rest []*sqs.SendMessageBatchRequestEntry) {
+	n := len(entries)
+	if n > sqsMaxBatchEntries {
+		n = sqsMaxBatchEntries
+	}
+	return entries[:n:n], entries[n:]
+}
+
+// flush sends the queued SQS messages in batches of at most 10.  Messages
+// which are not sent are queued again unless SQS rejected them as invalid
+func (ns *notificationSink) flush() error {
+	if ns.sqs == nil {
+		return nil
+	}
+	ns.lock.Lock()
+	entries := ns.entries
+	ns.entries = nil
+	ns.lock.Unlock()
+	for len(entries) > 0 {
+		var batch []*sqs.SendMessageBatchRequestEntry
+		batch, entries = cutSQSBatch(entries)
+		if failed, err := ns.send(batch); err != nil {
+			// later messages wait for the failed ones to keep them in order
+			ns.requeue(append(failed, entries...))
+			return err
+		}
+	}
+	return nil
+}
+
+// send sends one batch and returns the messages to send again
+func (ns *notificationSink) send(batch []*sqs.SendMessageBatchRequestEntry) (retry []*sqs.SendMessageBatchRequestEntry, err error) {
+	for i, entry := range batch {
+		entry.Id = aws.String(strconv.Itoa(i))
+	}
+	out, err := ns.sqs.SendMessageBatch(&sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(ns.QueueURL),
+		Entries:  batch,
+	})
+	if err != nil {
+		return batch, err
+	}
+	for _, failed := range out.Failed {
+		errorLog.Printf("Unable to send notification to SQS: %s", aws.StringValue(failed.Message))
+		if i, err := strconv.Atoi(aws.StringValue(failed.Id)); err == nil && i < len(batch) && !aws.BoolValue(failed.SenderFault) {
+			retry = append(retry, batch[i])
+		}
+	}
+	if len(out.Failed) > 0 {
+		err = fmt.Errorf("%d of %d notifications were not sent", len(out.Failed), len(batch))
+	}
+	return
+}
+
+// requeue puts messages which were not sent back in front of the queue
+func (ns *notificationSink) requeue(entries []*sqs.SendMessageBatchRequestEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	ns.lock.Lock()
+	ns.entries = append(entries, ns.entries...)
+	ns.lock.Unlock()
+}
+
+func (ns *notificationSink) close() error {
+	close(ns.stopC)
+	return ns.flush()
+}
+
+func (ws *webhookSink) enabled() bool {
+	return ws != nil && ws.URL != ""
+}
+
+func (ws *webhookSink) validate() error {
+	if _, err := url.Parse(ws.URL); err != nil {
+		return fmt.Errorf("Webhook sink URL is invalid: %s", err)
+	}
+	if ws.Concurrency < 0 || ws.MaxRetries < 0 {
+		return errors.New("Webhook sink concurrency and max-retries must not be negative")
+	}
+	return nil
+}
+
+func (ws *webhookSink) start() {
+	if ws.BatchSize <= 0 {
+		ws.BatchSize = 100
+	}
+	if ws.FlushSeconds <= 0 {
+		ws.FlushSeconds = 5
+	}
+	if ws.Concurrency <= 0 {
+		ws.Concurrency = 2
+	}
+	if ws.RetryBackoffMs <= 0 {
+		ws.RetryBackoffMs = 500
+	}
+	if ws.TimeoutSeconds <= 0 {
+		ws.TimeoutSeconds = 30
+	}
+	ws.client = &http.Client{Timeout: time.Duration(ws.TimeoutSeconds) * time.Second}
+	ws.sem = make(chan bool, ws.Concurrency)
+	ws.stopC = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(time.Duration(ws.FlushSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ws.flush(); err != nil {
+					errorLog.Printf("Unable to post changes to webhook: %s", err)
+				}
+			case <-ws.stopC:
+				return
+			}
+		}
+	}()
+}
+
+func (ws *webhookSink) write(ev *sinkEvent) error {
+	event := ev.header()
+	if ev.Doc != nil {
+		event["document"] = ev.Doc
+	}
+	ws.lock.Lock()
+	ws.events = append(ws.events, event)
+	var batch []interface{}
+	if len(ws.events) >= ws.BatchSize {
+		batch = ws.events
+		ws.events = nil
+	}
+	ws.lock.Unlock()
+	if batch != nil {
+		// full batches are posted in the background up to the concurrency limit
+		ws.sem <- true
+		ws.wg.Add(1)
+		go func() {
+			defer ws.wg.Done()
+			defer func() { <-ws.sem }()
+			if err := ws.post(batch); err != nil {
+				errorLog.Printf("Unable to post changes to webhook: %s", err)
+				ws.requeue(batch)
+			}
+		}()
+	}
+	return nil
+}
+
+// flush waits for batches in flight and posts the pending events, which
+// include those of batches in flight which failed
+func (ws *webhookSink) flush() (err error) {
+	ws.wg.Wait()
+	ws.lock.Lock()
+	batch := ws.events
+	ws.events = nil
+	ws.lock.Unlock()
+	if len(batch) > 0 {
+		ws.sem <- true
+		if err = ws.post(batch); err != nil {
+			ws.requeue(batch)
+		}
+		<-ws.sem
+	}
+	return
+}
+
+// requeue puts events which were not posted back in front of the queue
+func (ws *webhookSink) requeue(batch []interface{}) {
+	ws.lock.Lock()
+	ws.events = append(batch, ws.events...)
+	ws.lock.Unlock()
+}
+
+func (ws *webhookSink) signature(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(ws.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends a batch and retries with exponential backoff on connection
+// errors, 429 and 5xx responses
+func (ws *webhookSink) post(batch []interface{}) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	backoff := time.Duration(ws.RetryBackoffMs) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		if retry, err = ws.send(body); err == nil || !retry || attempt >= ws.MaxRetries {
+			return err
+		}
+		warnLog.Printf("Retrying webhook post in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+func (ws *webhookSink) send(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", ws.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, val := range ws.Headers {
+		req.Header.Set(name, val)
+	}
+	if ws.Secret != "" {
+		req.Header.Set("X-Monstache-Signature", ws.signature(body))
+	}
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("Webhook returned status %d", resp.StatusCode)
+}
+
+func (ws *webhookSink) close() error {
+	close(ws.stopC)
+	return ws.flush()
+}
+
+// newS3 connects to S3 or an S3 compatible store at endpoint
+func newS3(accessKey, secretKey, region, endpoint string, forcePathStyle bool) (s3iface.S3API, error) {
+	cfg := &aws.Config{
+		Credentials:      (&awsConnect{AccessKey: accessKey, SecretKey: secretKey}).credentials(),
+		S3ForcePathStyle: aws.Bool(forcePathStyle),
+	}
+	if region != "" {
+		cfg.Region = aws.String(region)
+	} else {
+		cfg.Region = aws.String("auto")
+	}
+	if endpoint != "" {
+		cfg.Endpoint = aws.String(endpoint)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return s3.New(sess), nil
+}
+
+func (as *archiveSink) enabled() bool {
+	return as != nil && as.Bucket != ""
+}
+
+func (as *archiveSink) validate() error {
+	if as.Region == "" && as.Endpoint == "" {
+		return errors.New("Archive sink must specify region or endpoint")
+	}
+	return nil
+}
+
+func (as *archiveSink) start() error {
+	if as.MaxEvents <= 0 {
+		as.MaxEvents = 10000
+	}
+	if as.FlushSeconds <= 0 {
+		as.FlushSeconds = 60
+	}
+	var err error
+	if as.s3, err = newS3(as.AccessKey, as.SecretKey, as.Region, as.Endpoint, as.ForcePathStyle); err != nil {
+		return err
+	}
+	as.batches = make(map[string][]*sinkEvent)
+	as.stopC = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(time.Duration(as.FlushSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := as.flush(); err != nil {
+					errorLog.Printf("Unable to archive changes: %s", err)
+				}
+			case <-as.stopC:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// partition is the key prefix of the objects holding an event
+func (as *archiveSink) partition(ev *sinkEvent) string {
+	return fmt.Sprintf("%snamespace=%s/hour=%s/", as.Prefix, ev.Namespace, ev.Timestamp.UTC().Format("2006-01-02-15"))
+}
+
+func (as *archiveSink) write(ev *sinkEvent) error {
+	part := as.partition(ev)
+	as.lock.Lock()
+	as.batches[part] = append(as.batches[part], ev)
+	var batch []*sinkEvent
+	if len(as.batches[part]) >= as.MaxEvents {
+		batch = as.batches[part]
+		delete(as.batches, part)
+	}
+	as.lock.Unlock()
+	if batch != nil {
+		if err := as.upload(part, batch); err != nil {
+			as.requeue(part, batch)
+			return err
+		}
+	}
+	return nil
+}
+
+func (as *archiveSink) flush() (err error) {
+	as.lock.Lock()
+	batches := as.batches
+	as.batches = make(map[string][]*sinkEvent)
+	as.lock.Unlock()
+	for part, batch := range batches {
+		if e := as.upload(part, batch); e != nil {
+			err = e
+			as.requeue(part, batch)
+		}
+	}
+	return
+}
+
+// requeue puts events which were not uploaded back in front of their
+// partition
+func (as *archiveSink) requeue(part string, batch []*sinkEvent) {
+	as.lock.Lock()
+	as.batches[part] = append(batch, as.batches[part]...)
+	as.lock.Unlock()
+}
+
+// upload writes a batch as one object named after the time of its first
+// event so that objects in a partition sort in the order of the changes
+func (as *archiveSink) upload(part string, batch []*sinkEvent) error {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, ev := range batch {
+		event := ev.header()
+		if ev.Doc != nil {
+			event["document"] = ev.Doc
+		}
+		if ev.Changes != nil {
+			event["changes"] = ev.Changes
+		}
+		if err := enc.Encode(event); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	seq := atomic.AddUint64(&as.seq, 1)
+	key := fmt.Sprintf("%s%d-%06d.ndjson.gz", part, batch[0].Timestamp.UnixNano(), seq)
+	_, err := as.s3.PutObject(&s3.PutObjectInput{
+		Bucket:          aws.String(as.Bucket),
+		Key:             aws.String(key),
+		Body:            bytes.NewReader(buf.Bytes()),
+		ContentType:     aws.String("application/x-ndjson"),
+		ContentEncoding: aws.String("gzip"),
+	})
+	return err
+}
+
+func (as *archiveSink) close() error {
+	close(as.stopC)
+	return as.flush()
+}
+
+var meilisearchUIDRegex = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+func (ms *meilisearchSink) enabled() bool {
+	return ms != nil && ms.URL != ""
+}
+
+func (ms *meilisearchSink) validate() error {
+	for _, uid := range ms.Indexes {
+		if uid == "" || meilisearchUIDRegex.MatchString(uid) {
+			return fmt.Errorf("Meilisearch index %q may only contain alphanumeric characters, hyphens and underscores", uid)
+		}
+	}
+	return nil
+}
+
+// index is the Meilisearch index uid for a namespace
+func (ms *meilisearchSink) index(namespace string) string {
+	if uid := ms.Indexes[namespace]; uid != "" {
+		return uid
+	}
+	return meilisearchUIDRegex.ReplaceAllString(ms.IndexPrefix+namespace, "_")
+}
+
+// start creates the indexes with settings and waits for Meilisearch to
+// apply them before any documents are sent
+func (ms *meilisearchSink) start() error {
+	if ms.PrimaryKey == "" {
+		ms.PrimaryKey = "id"
+	}
+	if ms.BatchSize <= 0 {
+		ms.BatchSize = 1000
+	}
+	if ms.FlushSeconds <= 0 {
+		ms.FlushSeconds = 5
+	}
+	if ms.TaskTimeoutSeconds <= 0 {
+		ms.TaskTimeoutSeconds = 60
+	}
+	ms.client = &http.Client{Timeout: 30 * time.Second}
+	ms.runs = make(map[string][]*sinkRun)
+	for namespace, settings := range ms.Settings {
+		uid := ms.index(namespace)
+		task, err := ms.request("POST", "/indexes", map[string]interface{}{
+			"uid":        uid,
+			"primaryKey": ms.PrimaryKey,
+		})
+		if err != nil {
+			return err
+		}
+		if err = ms.waitTask(task); err != nil && !strings.Contains(err.Error(), "index_already_exists") {
+			return err
+		}
+		if task, err = ms.request("PATCH", "/indexes/"+uid+"/settings", settings); err != nil {
+			return err
+		}
+		if err = ms.waitTask(task); err != nil {
+			return fmt.Errorf("Unable to apply settings to Meilisearch index %s: %s", uid, err)
+		}
+	}
+	ms.stopC = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(time.Duration(ms.FlushSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ms.flush(); err != nil {
+					errorLog.Printf("Unable to write changes to Meilisearch: %s", err)
+				}
+			case <-ms.stopC:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// request sends a JSON body and returns the uid of the enqueued task
+func (ms *meilisearchSink) request(method, path string, body interface{}) (task int64, err error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(ms.URL, "/")+path, bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ms.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+ms.APIKey)
+	}
+	resp, err := ms.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	var result struct {
+		TaskUID int64  `json:"taskUid"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		return 0, fmt.Errorf("Meilisearch returned status %d: %s (%s)", resp.StatusCode, result.Message, result.Code)
+	}
+	return result.TaskUID, nil
+}
+
+// waitTask polls a task until it has been processed
+func (ms *meilisearchSink) waitTask(task int64) error {
+	deadline := time.Now().Add(time.Duration(ms.TaskTimeoutSeconds) * time.Second)
+	for {
+		req, err := http.NewRequest("GET", fmt.Sprintf("%s/tasks/%d", strings.TrimRight(ms.URL, "/"), task), nil)
+		if err != nil {
+			return err
+		}
+		if ms.APIKey != "" {
+			req.Header.Set("Authorization", "Bearer "+ms.APIKey)
+		}
+		resp, err := ms.client.Do(req)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Status string `json:"status"`
+			Error  *struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		switch result.Status {
+		case "succeeded":
+			return nil
+		case "failed", "canceled":
+			if result.Error != nil {
+				return fmt.Errorf("Meilisearch task %d failed: %s (%s)", task, result.Error.Message, result.Error.Code)
+			}
+			return fmt.Errorf("Meilisearch task %d %s", task, result.Status)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("Timed out waiting for Meilisearch task %d", task)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (ms *meilisearchSink) write(ev *sinkEvent) error {
+	var item interface{} = ev.ID
+	if ev.Operation != "delete" {
+		doc := make(map[string]interface{}, len(ev.Doc)+1)
+		for k, v := range ev.Doc {
+			doc[k] = v
+		}
+		doc[ms.PrimaryKey] = ev.ID
+		item = doc
+	}
+	uid := ms.index(ev.Namespace)
+	ms.lock.Lock()
+	ms.runs[uid] = appendSinkRun(ms.runs[uid], ev.Operation, item)
+	ms.pending++
+	full := ms.pending >= ms.BatchSize
+	ms.lock.Unlock()
+	if full {
+		return ms.flush()
+	}
+	return nil
+}
+
+// flush sends the queued changes and checks the status of every task.
+// Index operations replace documents and updates merge fields into them.
+// The runs of an index from the first one which failed are queued again
+func (ms *meilisearchSink) flush() (err error) {
+	ms.lock.Lock()
+	batch := ms.runs
+	ms.runs = make(map[string][]*sinkRun)
+	ms.pending = 0
+	ms.lock.Unlock()
+	type sentRun struct {
+		uid  string
+		run  int
+		task int64
+	}
+	var tasks []sentRun
+	failed := make(map[string]int)
+	for uid, runs := range batch {
+		for i, run := range runs {
+			var task int64
+			var e error
+			switch run.operation {
+			case "index":
+				task, e = ms.request("POST", "/indexes/"+uid+"/documents?primaryKey="+url.QueryEscape(ms.PrimaryKey), run.docs)
+			case "update":
+				task, e = ms.request("PUT", "/indexes/"+uid+"/documents?primaryKey="+url.QueryEscape(ms.PrimaryKey), run.docs)
+			case "delete":
+				task, e = ms.request("POST", "/indexes/"+uid+"/documents/delete-batch", run.docs)
+			}
+			if e != nil {
+				err = e
+				errorLog.Printf("Unable to %s %d documents in Meilisearch index %s: %s", run.operation, len(run.docs), uid, e)
+				failed[uid] = i
+				break
+			}
+			tasks = append(tasks, sentRun{uid: uid, run: i, task: task})
+		}
+	}
+	for _, sent := range tasks {
+		if first, ok := failed[sent.uid]; ok && first <= sent.run {
+			continue
+		}
+		if e := ms.waitTask(sent.task); e != nil {
+			err = e
+			errorLog.Println(e)
+			failed[sent.uid] = sent.run
+		}
+	}
+	if len(failed) > 0 {
+		ms.lock.Lock()
+		for uid, first := range failed {
+			ms.pending += requeueSinkRuns(ms.runs, uid, batch[uid][first:])
+		}
+		ms.lock.Unlock()
+	}
+	return
+}
+
+func (ms *meilisearchSink) close() error {
+	close(ms.stopC)
+	return ms.flush()
+}
+
+// requeueSinkRuns puts runs which were not applied back in front of the
+// runs queued for key since and returns the number of changes they hold
+func requeueSinkRuns(queued map[string][]*sinkRun, key string, failed []*sinkRun) (n int) {
+	queued[key] = append(failed[:len(failed):len(failed)], queued[key]...)
+	for _, run := range failed {
+		n += len(run.docs)
+	}
+	return
+}
+
+func appendSinkRun(runs []*sinkRun, operation string, item interface{}) []*sinkRun {
+	if n := len(runs); n > 0 && runs[n-1].operation == operation {
+		runs[n-1].docs = append(runs[n-1].docs, item)
+		return runs
+	}
+	return append(runs, &sinkRun{operation: operation, docs: []interface{}{item}})
+}
+
+func (ts *typesenseSink) enabled() bool {
+	return ts != nil && ts.URL != ""
+}
+
+func (ts *typesenseSink) validate() error {
+	for namespace, schema := range ts.Schemas {
+		if schema["fields"] == nil {
+			return fmt.Errorf("Typesense schema for %s must include fields", namespace)
+		}
+	}
+	return nil
+}
+
+func (ts *typesenseSink) collection(namespace string) string {
+	if name := ts.Collections[namespace]; name != "" {
+		return name
+	}
+	return ts.CollectionPrefix + namespace
+}
+
+// start creates the collections which have a schema.  Existing collections
+// are left as they are
+func (ts *typesenseSink) start() error {
+	if ts.BatchSize <= 0 {
+		ts.BatchSize = 1000
+	}
+	if ts.FlushSeconds <= 0 {
+		ts.FlushSeconds = 5
+	}
+	ts.client = &http.Client{Timeout: 60 * time.Second}
+	ts.runs = make(map[string][]*sinkRun)
+	for namespace, schema := range ts.Schemas {
+		body := map[string]interface{}{"name": ts.collection(namespace)}
+		for k, v := range schema {
+			if k != "name" {
+				body[k] = v
+			}
+		}
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		resp, err := ts.do("POST", "/collections", "application/json", b)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusConflict {
+			return fmt.Errorf("Unable to create Typesense collection %s: status %d", body["name"], resp.StatusCode)
+		}
+	}
+	ts.stopC = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(time.Duration(ts.FlushSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ts.flush(); err != nil {
+					errorLog.Printf("Unable to write changes to Typesense: %s", err)
+				}
+			case <-ts.stopC:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (ts *typesenseSink) do(method, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(ts.URL, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req.Header.Set("X-TYPESENSE-API-KEY", ts.APIKey)
+	return ts.client.Do(req)
+}
+
+func (ts *typesenseSink) write(ev *sinkEvent) error {
+	var item interface{} = ev.ID
+	if ev.Operation != "delete" {
+		doc := make(map[string]interface{}, len(ev.Doc)+1)
+		for k, v := range ev.Doc {
+			doc[k] = v
+		}
+		doc["id"] = ev.ID
+		item = doc
+	}
+	name := ts.collection(ev.Namespace)
+	ts.lock.Lock()
+	ts.runs[name] = appendSinkRun(ts.runs[name], ev.Operation, item)
+	ts.pending++
+	full := ts.pending >= ts.BatchSize
+	ts.lock.Unlock()
+	if full {
+		return ts.flush()
+	}
+	return nil
+}
+
+// flush imports the queued changes.  Index operations upsert whole
+// documents, updates emplace the changed fields and deletes remove documents
+// by id.  The runs of a collection from the first one which failed are
+// queued again
+func (ts *typesenseSink) flush() (err error) {
+	ts.lock.Lock()
+	batch := ts.runs
+	ts.runs = make(map[string][]*sinkRun)
+	ts.pending = 0
+	ts.lock.Unlock()
+	for name, runs := range batch {
+		for i, run := range runs {
+			var e error
+			switch run.operation {
+			case "index":
+				e = ts.importDocs(name, "upsert", run.docs)
+			case "update":
+				e = ts.importDocs(name, "emplace", run.docs)
+			case "delete":
+				e = ts.deleteDocs(name, run.docs)
+			}
+			if e != nil {
+				err = e
+				errorLog.Printf("Unable to %s %d documents in Typesense collection %s: %s", run.operation, len(run.docs), name, e)
+				ts.lock.Lock()
+				ts.pending += requeueSinkRuns(ts.runs, name, runs[i:])
+				ts.lock.Unlock()
+				break
+			}
+		}
+	}
+	return
+}
+
+// importDocs sends documents as JSONL.  The response has one result line
+// per document
+func (ts *typesenseSink) importDocs(name, action string, docs []interface{}) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, doc := range docs {
+		if err := enc.Encode(doc); err != nil {
+			return err
+		}
+	}
+	path := fmt.Sprintf("/collections/%s/documents/import?action=%s", url.PathEscape(name), action)
+	resp, err := ts.do("POST", path, "text/plain", body.Bytes())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Typesense returned status %d", resp.StatusCode)
+	}
+	dec := json.NewDecoder(resp.Body)
+	failed := 0
+	for dec.More() {
+		var result struct {
+			Success bool   `json:"success"`
+			Error   string `json:"error"`
+		}
+		if err = dec.Decode(&result); err != nil {
+			return err
+		}
+		if !result.Success {
+			failed++
+			errorLog.Printf("Unable to import document into Typesense collection %s: %s", name, result.Error)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d documents were not imported", failed, len(docs))
+	}
+	return nil
+}
+
+func (ts *typesenseSink) deleteDocs(name string, ids []interface{}) error {
+	quoted := make([]string, len(ids))
+	for i, id := range ids {
+		quoted[i] = "`" + fmt.Sprint(id) + "`"
+	}
+	filter := "id:[" + strings.Join(quoted, ",") + "]"
+	path := fmt.Sprintf("/collections/%s/documents?filter_by=%s", url.PathEscape(name), url.QueryEscape(filter))
+	resp, err := ts.do("DELETE", path, "", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Typesense returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (ts *typesenseSink) close() error {
+	close(ts.stopC)
+	return ts.flush()
+}
+
+func (ps *postgresSink) enabled() bool {
+	return ps != nil && ps.URL != ""
+}
+
+// table quotes the optionally schema qualified table name
+func (ps *postgresSink) table() string {
+	parts := strings.Split(ps.Table, ".")
+	for i, part := range parts {
+		parts[i] = pq.QuoteIdentifier(part)
+	}
+	return strings.Join(parts, ".")
+}
+
+func (ps *postgresSink) start() (err error) {
+	if ps.Table == "" {
+		ps.Table = "monstache_documents"
+	}
+	if ps.BatchSize <= 0 {
+		ps.BatchSize = 500
+	}
+	if ps.FlushSeconds <= 0 {
+		ps.FlushSeconds = 5
+	}
+	if ps.db, err = sql.Open("postgres", ps.URL); err != nil {
+		return
+	}
+	if err = ps.db.Ping(); err != nil {
+		return
+	}
+	if ps.CreateTable {
+		_, err = ps.db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+			namespace text NOT NULL,
+			id text NOT NULL,
+			doc jsonb,
+			updated_at timestamptz NOT NULL,
+			PRIMARY KEY (namespace, id))`, ps.table()))
+		if err != nil {
+			return
+		}
+	}
+	ps.stopC = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(time.Duration(ps.FlushSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := ps.flush(); err != nil {
+					errorLog.Printf("Unable to write changes to PostgreSQL: %s", err)
+				}
+			case <-ps.stopC:
+				return
+			}
+		}
+	}()
+	return
+}
+
+func (ps *postgresSink) write(ev *sinkEvent) error {
+	ps.lock.Lock()
+	ps.runs = appendSinkRun(ps.runs, ev.Operation, ev)
+	ps.pending++
+	full := ps.pending >= ps.BatchSize
+	ps.lock.Unlock()
+	if full {
+		return ps.flush()
+	}
+	return nil
+}
+
+// statement builds one statement for a run of changes.  Index operations
+// replace the doc, updates merge the changed top level fields into it and
+// deletes remove the rows.  A key may only appear once in an upsert so the
+// changes to a document within a run are combined first
+func (ps *postgresSink) statement(run *sinkRun) (query string, args []interface{}, err error) {
+	type key struct{ namespace, id string }
+	var keys []key
+	events := make(map[key]*sinkEvent)
+	for _, item := range run.docs {
+		ev := item.(*sinkEvent)
+		k := key{ev.Namespace, ev.ID}
+		prev := events[k]
+		if prev == nil {
+			keys = append(keys, k)
+		} else if run.operation == "update" {
+			doc := make(map[string]interface{}, len(prev.Doc)+len(ev.Doc))
+			for f, v := range prev.Doc {
+				doc[f] = v
+			}
+			for f, v := range ev.Doc {
+				doc[f] = v
+			}
+			merged := *ev
+			merged.Doc = doc
+			ev = &merged
+		}
+		events[k] = ev
+	}
+	if run.operation == "delete" {
+		var conds []string
+		for _, k := range keys {
+			args = append(args, k.namespace, k.id)
+			conds = append(conds, fmt.Sprintf("($%d, $%d)", len(args)-1, len(args)))
+		}
+		query = fmt.Sprintf("DELETE FROM %s WHERE (namespace, id) IN (%s)", ps.table(), strings.Join(conds, ", "))
+		return
+	}
+	var values []string
+	for _, k := range keys {
+		ev := events[k]
+		doc, e := json.Marshal(ev.Doc)
+		if e != nil {
+			return "", nil, e
+		}
+		args = append(args, k.namespace, k.id, string(doc), ev.Timestamp)
+		n := len(args)
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d::jsonb, $%d)", n-3, n-2, n-1, n))
+	}
+	update := "excluded.doc"
+	if run.operation == "update" {
+		update = fmt.Sprintf("COALESCE(%s.doc, '{}'::jsonb) || excluded.doc", ps.table())
+	}
+	query = fmt.Sprintf("INSERT INTO %s (namespace, id, doc, updated_at) VALUES %s "+
+		"ON CONFLICT (namespace, id) DO UPDATE SET doc = %s, updated_at = excluded.updated_at",
+		ps.table(), strings.Join(values, ", "), update)
+	return
+}
+
+// flush applies the queued runs in order in one transaction.  The runs are
+// queued again if the transaction fails
+func (ps *postgresSink) flush() error {
+	ps.lock.Lock()
+	runs := ps.runs
+	ps.runs = nil
+	ps.pending = 0
+	ps.lock.Unlock()
+	if len(runs) == 0 {
+		return nil
+	}
+	err := ps.apply(runs)
+	if err != nil {
+		ps.lock.Lock()
+		ps.runs = append(runs, ps.runs...)
+		for _, run := range runs {
+			ps.pending += len(run.docs)
+		}
+		ps.lock.Unlock()
+	}
+	return err
+}
+
+func (ps *postgresSink) apply(runs []*sinkRun) error {
+	tx, err := ps.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		query, args, err := ps.statement(run)
+		if err == nil {
+			_, err = tx.Exec(query, args...)
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Unable to %s %d documents: %s", run.operation, len(run.docs), err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (ps *postgresSink) close() error {
+	close(ps.stopC)
+	err := ps.flush()
+	ps.db.Close()
+	return err
+}
+
+func (ps *pluginSink) write(ev *sinkEvent) error {
+	doc := &monstachemap.SinkDocument{
+		ID:                ev.ID,
+		Index:             ev.Index,
+		Namespace:         ev.Namespace,
+		Timestamp:         ev.Timestamp,
+		Document:          ev.Doc,
+		UpdateDescription: ev.Changes,
+	}
+	switch ev.Operation {
+	case "index":
+		return ps.sink.Index(doc)
+	case "update":
+		return ps.sink.Update(doc)
+	default:
+		return ps.sink.Delete(doc)
+	}
+}
+
+func (ps *pluginSink) flush() error {
+	return ps.sink.Flush()
+}
+
+func (ps *pluginSink) close() error {
+	err := ps.sink.Flush()
+	if closer, ok := ps.sink.(io.Closer); ok {
+		if e := closer.Close(); e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// newNDJSONWriter opens the NDJSON output.  A path of - writes to stdout
+func newNDJSONWriter(path string) (nw *ndjsonWriter, err error) {
+	if path == "-" {
+		return &ndjsonWriter{w: os.Stdout}, nil
+	}
+	nw = &ndjsonWriter{}
+	if nw.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err != nil {
+		return nil, err
+	}
+	nw.w = nw.file
+	return
+}
+
+func (nw *ndjsonWriter) write(req elastic.BulkableRequest) error {
+	lines, err := req.Source()
+	if err != nil {
+		return err
+	}
+	nw.lock.Lock()
+	defer nw.lock.Unlock()
+	_, err = io.WriteString(nw.w, strings.Join(lines, "\n")+"\n")
+	return err
+}
+
+func (nw *ndjsonWriter) close() {
+	if nw == nil || nw.file == nil {
+		return
+	}
+	nw.file.Close()
+}
+
+func newEventRecorder(path string, compress bool) (*eventRecorder, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &eventRecorder{file: file, compress: compress}, nil
+}
+
+// record appends an event to the recording as a line of MongoDB extended
+// JSON so that the BSON types of the values survive a replay
+func (r *eventRecorder) record(op *gtm.Op) error {
+	if r == nil {
+		return nil
+	}
+	data, err := bson.MarshalJSON(&recordedEvent{
+		ID:                op.Id,
+		Operation:         op.Operation,
+		Namespace:         op.Namespace,
+		Timestamp:         op.Timestamp,
+		Source:            int(op.Source),
+		Data:              op.Data,
+		Doc:               op.Doc,
+		UpdateDescription: op.UpdateDescription,
+	})
+	if err != nil {
+		return err
+	}
+	data = append(bytes.TrimSpace(data), '\n')
+	if r.compress {
+		// each event is a zstd frame like the dead letters
+		data = zstdEncoder.EncodeAll(data, nil)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	_, err = r.file.Write(data)
+	return err
+}
+
+func (r *eventRecorder) close() {
+	if r == nil {
+		return
+	}
+	r.file.Close()
+}
+
+// readRecordedEvent decodes a line of a recording
+func readRecordedEvent(line []byte) (*gtm.Op, error) {
+	var ev recordedEvent
+	if err := bson.UnmarshalJSON(line, &ev); err != nil {
+		return nil, err
+	}
+	return &gtm.Op{
+		Id:                ev.ID,
+		Operation:         ev.Operation,
+		Namespace:         ev.Namespace,
+		Timestamp:         ev.Timestamp,
+		Source:            gtm.QuerySource(ev.Source),
+		Data:              ev.Data,
+		Doc:               ev.Doc,
+		UpdateDescription: ev.UpdateDescription,
+	}, nil
+}
+
+// replayRecording feeds the events of a recording through the pipeline in
+// the order they were recorded and stops monstache after the last one
+func replayRecording(path string, opC chan<- *gtm.Op) {
+	file, err := os.Open(path)
+	if err != nil {
+		errorLog.Printf("Unable to open recording %s: %s", path, err)
+	} else {
+		defer file.Close()
+		in, err := recordingReader(file)
+		if err != nil {
+			errorLog.Printf("Unable to read recording %s: %s", path, err)
+		} else {
+			defer in.Close()
+			scanner := bufio.NewScanner(in)
+			scanner.Buffer(make([]byte, 64*1024), maxRecordedEventBytes)
+			count, line := 0, 0
+			for scanner.Scan() {
+				line++
+				if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+					continue
+				}
+				op, err := readRecordedEvent(scanner.Bytes())
+				if err != nil {
+					errorLog.Printf("Skipping line %d of recording %s: %s", line, path, err)
+					continue
+				}
+				opC <- op
+				count++
+			}
+			if err = scanner.Err(); err != nil {
+				errorLog.Printf("Unable to read recording %s: %s", path, err)
+			}
+			infoLog.Printf("Replayed %d events from recording %s", count, path)
+		}
+	}
+	select {
+	case shutdownSigs <- syscall.SIGTERM:
+	default:
+	}
+}
+
+// recordingReader reads a recording decompressed if it was written
+// compressed.  Like the dead letter file the compression is detected so
+// that recordings stay readable after changing the disk compression
+func recordingReader(file io.Reader) (io.ReadCloser, error) {
+	in := bufio.NewReader(file)
+	if magic, _ := in.Peek(len(zstdMagic)); !isZstd(magic) {
+		return ioutil.NopCloser(in), nil
+	}
+	dec, err := zstd.NewReader(in)
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+
+// addBulkRequest queues a request for Elasticsearch and copies it to the
+// NDJSON output
+func addBulkRequest(config *configOptions, bulk *elastic.BulkProcessor, op *gtm.Op, index string, req elastic.BulkableRequest) {
+	span := tracing.start(op, "bulk enqueue")
+	span.set("index", index)
+	if ndjsonOut != nil {
+		if err := ndjsonOut.write(req); err != nil {
+			errorLog.Printf("Unable to write bulk action as NDJSON: %s", err)
+		}
+	}
+	if config.DisableElasticsearch {
+		forgetBulkItem(req)
+	} else {
+		if _, err := req.Source(); err != nil {
+			// the bulk processor drops requests which cannot be serialized
+			errorLog.Printf("Unable to serialize bulk request: %s", err)
+			bulkItemDone(req, nil, err)
+			span.finish(err)
+			return
+		}
+		target := bulkForIndex(bulk, index)
+		if tooLarge(target, req) {
+			errorLog.Printf("Bulk request is too large to index: %s", req)
+			deadLetters.add(req, http.StatusRequestEntityTooLarge, "request entity too large")
+			bulkItemDone(req, nil, errBulkRequestTooLarge)
+			span.finish(errBulkRequestTooLarge)
+			return
+		}
+		tracing.enqueue(span, req)
+		docStats.enqueue(op, req)
+		syncStatus.enqueue(op, req)
+		audit.enqueue(op, index, req)
+		docDumps.action(op, req)
+		target.Add(req)
+		sizer.added(target, req)
+		throttle.added(target, req)
+	}
+	span.finish(nil)
+}
+
+// tooLarge returns true if req would push a batch of bulk beyond the
+// http.max_content_length of Elasticsearch
+func tooLarge(bulk *elastic.BulkProcessor, req elastic.BulkableRequest) bool {
+	limit, ok := bulkRequestLimits[bulk]
+	if !ok {
+		return false
+	}
+	n, err := bulkRequestBytes(req)
+	return err == nil && n > limit
+}
+
+// bulkRequestBytes returns the size of req in the body of a bulk request
+func bulkRequestBytes(req elastic.BulkableRequest) (n int64, err error) {
+	var lines []string
+	if lines, err = req.Source(); err != nil {
+		return
+	}
+	for _, line := range lines {
+		n += int64(len(line)) + 1
+	}
+	return
+}
+
+func kafkaHeader(name, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":  name,
+		"value": base64.StdEncoding.EncodeToString([]byte(value)),
+	}
+}
+
+// write queues a record keyed by document id.  Deletes are published as
+// tombstones without a value
+func (ks *kafkaSink) write(ev *sinkEvent) error {
+	record := map[string]interface{}{
+		"key": map[string]interface{}{"type": "JSON", "data": ev.ID},
+		"headers": []interface{}{
+			kafkaHeader("operation", ev.Operation),
+			kafkaHeader("namespace", ev.Namespace),
+			kafkaHeader("timestamp", ev.Timestamp.Format(time.RFC3339)),
+		},
+	}
+	if ev.Doc != nil {
+		record["value"] = map[string]interface{}{"type": "JSON", "data": ev.Doc}
+	}
+	topic := ks.topic(ev.Namespace)
+	ks.lock.Lock()
+	ks.batches[topic] = append(ks.batches[topic], record)
+	full := len(ks.batches[topic]) >= ks.BatchSize
+	ks.lock.Unlock()
+	if full {
+		return ks.flush()
+	}
+	return nil
+}
+
+func (ks *kafkaSink) flush() (err error) {
+	ks.lock.Lock()
+	batches := ks.batches
+	ks.batches = make(map[string][]interface{})
+	ks.lock.Unlock()
+	for topic, records := range batches {
+		failed, e := ks.produce(topic, records)
+		if e != nil {
+			err = e
+		}
+		if len(failed) > 0 {
+			// records which were not published are sent again with the next flush
+			ks.lock.Lock()
+			ks.batches[topic] = append(failed, ks.batches[topic]...)
+			ks.lock.Unlock()
+		}
+	}
+	return
+}
+
+// produce sends records in streaming mode: one JSON record after another in
+// the request body and one result per record in the response.  It returns
+// the records which were not published
+func (ks *kafkaSink) produce(topic string, records []interface{}) (failed []interface{}, err error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, record := range records {
+		if err = enc.Encode(record); err != nil {
+			return records, err
+		}
+	}
+	endpoint := fmt.Sprintf("%s/v3/clusters/%s/topics/%s/records",
+		strings.TrimRight(ks.RestURL, "/"), url.PathEscape(ks.ClusterID), url.PathEscape(topic))
+	req, err := http.NewRequest("POST", endpoint, &body)
+	if err != nil {
+		return records, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ks.Username != "" {
+		req.SetBasicAuth(ks.Username, ks.Password)
+	}
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return records, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return records, fmt.Errorf("Kafka REST proxy returned status %d for topic %s", resp.StatusCode, topic)
+	}
+	dec := json.NewDecoder(resp.Body)
+	n := 0
+	for ; dec.More() && n < len(records); n++ {
+		var result struct {
+			ErrorCode int    `json:"error_code"`
+			Message   string `json:"message"`
+		}
+		if err = dec.Decode(&result); err != nil {
+			break
+		}
+		if result.ErrorCode >= 300 {
+			failed = append(failed, records[n])
+			errorLog.Printf("Unable to publish record to Kafka topic %s: %s", topic, result.Message)
+		}
+	}
+	// records without a result are not known to be published
+	failed = append(failed, records[n:]...)
+	if len(failed) > 0 && err == nil {
+		err = fmt.Errorf("%d of %d records were not published to topic %s", len(failed), len(records), topic)
+	}
+	return
+}
+
+func (ks *kafkaSink) close() error {
+	close(ks.stopC)
+	return ks.flush()
+}
+
+func (s *natsSink) enabled() bool {
+	return s != nil && s.URL != ""
+}
+
+func (s *natsSink) validate() error {
+	u, err := url.Parse(s.URL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("NATS sink URL %s is invalid. Use nats://host:port or tls://host:port", s.URL)
+	}
+	switch u.Scheme {
+	case "nats", "tls":
+	default:
+		return errors.New("NATS sink URL scheme must be one of nats or tls")
+	}
+	switch s.Payload {
+	case "", "document", "diff", "id":
+	default:
+		return errors.New("NATS sink payload must be one of document, diff or id")
+	}
+	if s.MaxRetries < 0 || s.RetryBackoffMs < 0 || s.TimeoutSeconds < 0 {
+		return errors.New("NATS sink max-retries, retry-backoff-ms and timeout-seconds must not be negative")
+	}
+	return nil
+}
+
+func (s *natsSink) start() {
+	if s.Payload == "" {
+		s.Payload = "document"
+	}
+	if s.SubjectPrefix == "" {
+		s.SubjectPrefix = "monstache."
+	}
+	if s.BatchSize <= 0 {
+		s.BatchSize = 100
+	}
+	if s.FlushSeconds <= 0 {
+		s.FlushSeconds = 1
+	}
+	if s.MaxRetries == 0 {
+		s.MaxRetries = 5
+	}
+	if s.RetryBackoffMs == 0 {
+		s.RetryBackoffMs = 500
+	}
+	if s.TimeoutSeconds == 0 {
+		s.TimeoutSeconds = 10
+	}
+	s.stopC = make(chan bool)
+	go func() {
+		ticker := time.NewTicker(time.Duration(s.FlushSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.flush(); err != nil {
+					errorLog.Printf("Unable to publish to NATS: %s", err)
+				}
+			case <-s.stopC:
+				return
+			}
+		}
+	}()
+}
+
+var natsSubjectReplacer = strings.NewReplacer(" ", "_", "\t", "_", "*", "_", ">", "_")
+
+// subject is the subject of a namespace.  The database and collection are
+// separate tokens so that consumers can subscribe to a whole database
+func (s *natsSink) subject(namespace string) string {
+	if subject := s.Subjects[namespace]; subject != "" {
+		return subject
+	}
+	return s.SubjectPrefix + natsSubjectReplacer.Replace(namespace)
+}
+
+// dedupeID identifies a change for JetStream deduplication.  Changes read
+// from the change stream are identified by their resume position.  Direct
+// reads have none and are identified by their content so that documents
+// read again unchanged are dropped
+func (ev *sinkEvent) dedupeID(payload []byte) string {
+	if ev.position != 0 {
+		return fmt.Sprintf("%s:%s:%s:%d", ev.Namespace, ev.ID, ev.Operation, ev.position)
+	}
+	sum := sha256.Sum256(append([]byte(ev.Namespace+"\x00"+ev.ID+"\x00"+ev.Operation+"\x00"), payload...))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *natsSink) write(ev *sinkEvent) error {
+	data, err := ev.message(s.Payload)
+	if err != nil {
+		return err
+	}
+	msg := &natsMessage{
+		subject: s.subject(ev.Namespace),
+		id:      ev.dedupeID(data),
+		headers: map[string]string{
+			"Monstache-Operation": ev.Operation,
+			"Monstache-Namespace": ev.Namespace,
+		},
+		data: data,
+	}
+	s.lock.Lock()
+	s.pending = append(s.pending, msg)
+	full := len(s.pending) >= s.BatchSize
+	s.lock.Unlock()
+	if full {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush publishes the pending messages.  Messages which are not
+// acknowledged are published again with the same ids after a backoff and
+// stay pending once the retries are exhausted
+func (s *natsSink) flush() error {
+	s.lock.Lock()
+	msgs := s.pending
+	s.pending = nil
+	s.lock.Unlock()
+	if len(msgs) == 0 {
+		return nil
+	}
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	var err error
+	for attempt := 0; ; attempt++ {
+		if msgs, err = s.publish(msgs); len(msgs) == 0 {
+			return nil
+		}
+		if attempt >= s.MaxRetries {
+			// the messages are published again with the next flush
+			s.lock.Lock()
+			s.pending = append(msgs, s.pending...)
+			s.lock.Unlock()
+			return fmt.Errorf("%d messages were not acknowledged by JetStream: %s", len(msgs), err)
+		}
+		warnLog.Printf("Retrying %d messages not acknowledged by JetStream: %s", len(msgs), err)
+		time.Sleep(time.Duration(s.RetryBackoffMs<<uint(attempt)) * time.Millisecond)
+	}
+}
+
+// publish sends the messages with a reply subject each and waits for the
+// acknowledgements.  It returns the messages which were not acknowledged
+func (s *natsSink) publish(msgs []*natsMessage) (failed []*natsMessage, err error) {
+	if s.conn == nil {
+		if err = s.dial(); err != nil {
+			s.reset()
+			return msgs, err
+		}
+	}
+	waiting := make(map[string]*natsMessage, len(msgs))
+	s.conn.SetDeadline(time.Now().Add(time.Duration(s.TimeoutSeconds) * time.Second))
+	w := bufio.NewWriter(s.conn)
+	for _, msg := range msgs {
+		s.seq++
+		reply := fmt.Sprintf("%s.%d", s.inbox, s.seq)
+		waiting[reply] = msg
+		var hdr bytes.Buffer
+		hdr.WriteString("NATS/1.0\r\nNats-Msg-Id: " + msg.id + "\r\n")
+		names := make([]string, 0, len(msg.headers))
+		for name := range msg.headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			hdr.WriteString(name + ": " + msg.headers[name] + "\r\n")
+		}
+		hdr.WriteString("\r\n")
+		fmt.Fprintf(w, "HPUB %s %s %d %d\r\n", msg.subject, reply, hdr.Len(), hdr.Len()+len(msg.data))
+		w.Write(hdr.Bytes())
+		w.Write(msg.data)
+		w.WriteString("\r\n")
+	}
+	if err = w.Flush(); err != nil {
+		s.reset()
+		return msgs, err
+	}
+	unacked := make(map[*natsMessage]bool, len(msgs))
+	for len(waiting) > 0 {
+		reply, hdr, ack, e := s.next()
+		if e != nil {
+			err = e
+			s.reset()
+			break
+		}
+		msg := waiting[reply]
+		if msg == nil {
+			continue
+		}
+		delete(waiting, reply)
+		if e = natsAckError(hdr, ack); e != nil {
+			err = fmt.Errorf("Unable to publish to subject %s: %s", msg.subject, e)
+			unacked[msg] = true
+		}
+	}
+	for _, msg := range waiting {
+		unacked[msg] = true
+	}
+	for _, msg := range msgs {
+		if unacked[msg] {
+			failed = append(failed, msg)
+		}
+	}
+	return
+}
+
+// natsAckError returns the error of a JetStream publish acknowledgement.
+// A reply with a status header such as 503 means that no stream listens on
+// the subject
+func natsAckError(hdr, ack []byte) error {
+	if status := strings.Fields(strings.SplitN(string(hdr), "\r\n", 2)[0]); len(status) > 1 {
+		if status[1] == "503" {
+			return errors.New("No stream listens on the subject")
+		}
+		return fmt.Errorf("Status %s", strings.Join(status[1:], " "))
+	}
+	var result struct {
+		Stream string `json:"stream"`
+		Error  *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(ack, &result); err != nil {
+		return fmt.Errorf("Invalid acknowledgement %q", ack)
+	}
+	if result.Error != nil {
+		return fmt.Errorf("%s (%d)", result.Error.Description, result.Error.Code)
+	}
+	if result.Stream == "" {
+		return errors.New("Acknowledgement without a stream")
+	}
+	return nil
+}
+
+// dial connects, upgrading to TLS for tls URLs or when the server requires
+// it, and subscribes to the inbox receiving the acknowledgements
+func (s *natsSink) dial() (err error) {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return
+	}
+	if s.conn, err = net.DialTimeout("tcp", u.Host, 10*time.Second); err != nil {
+		return
+	}
+	s.conn.SetDeadline(time.Now().Add(time.Duration(s.TimeoutSeconds) * time.Second))
+	s.reader = bufio.NewReader(s.conn)
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("Unexpected greeting from NATS: %s", strings.TrimSpace(line))
+	}
+	var info struct {
+		Headers     bool `json:"headers"`
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err = json.Unmarshal([]byte(line[5:]), &info); err != nil {
+		return
+	}
+	if !info.Headers {
+		return errors.New("The NATS server does not support headers. JetStream requires NATS 2.2 or later")
+	}
+	if u.Scheme == "tls" || info.TLSRequired {
+		conn := tls.Client(s.conn, &tls.Config{ServerName: u.Hostname()})
+		if err = conn.Handshake(); err != nil {
+			return
+		}
+		s.conn, s.reader = conn, bufio.NewReader(conn)
+	}
+	connect := map[string]interface{}{
+		"verbose":       false,
+		"pedantic":      false,
+		"headers":       true,
+		"no_responders": true,
+		"lang":          "go",
+		"name":          "monstache",
+		"version":       version,
+		"protocol":      1,
+	}
+	if s.Username != "" {
+		connect["user"], connect["pass"] = s.Username, s.Password
+	} else if u.User != nil {
+		pass, _ := u.User.Password()
+		connect["user"], connect["pass"] = u.User.Username(), pass
+	}
+	if s.Token != "" {
+		connect["auth_token"] = s.Token
+	}
+	b, err := json.Marshal(connect)
+	if err != nil {
+		return
+	}
+	nuid := make([]byte, 12)
+	crand.Read(nuid)
+	s.inbox = "_INBOX." + hex.EncodeToString(nuid)
+	if _, err = fmt.Fprintf(s.conn, "CONNECT %s\r\nSUB %s.* 1\r\nPING\r\n", b, s.inbox); err != nil {
+		return
+	}
+	for {
+		if line, err = s.line(); err != nil {
+			return
+		}
+		if line == "PONG" {
+			return nil
+		}
+	}
+}
+
+// line reads a protocol line, answering pings and returning server errors
+func (s *natsSink) line() (string, error) {
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		line = strings.TrimSuffix(line, "\r\n")
+		switch {
+		case line == "PING":
+			if _, err = s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return "", err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return "", fmt.Errorf("NATS error: %s", strings.TrimSpace(line[4:]))
+		case line == "+OK" || strings.HasPrefix(line, "INFO "):
+		default:
+			return line, nil
+		}
+	}
+}
+
+// next reads the next message delivered to the inbox
+func (s *natsSink) next() (subject string, hdr, payload []byte, err error) {
+	for {
+		var line string
+		if line, err = s.line(); err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		hdrSize, size := 0, 0
+		switch {
+		case len(fields) >= 4 && fields[0] == "MSG":
+			size, err = strconv.Atoi(fields[len(fields)-1])
+		case len(fields) >= 5 && fields[0] == "HMSG":
+			if hdrSize, err = strconv.Atoi(fields[len(fields)-2]); err == nil {
+				size, err = strconv.Atoi(fields[len(fields)-1])
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return
+		}
+		if hdrSize > size {
+			return "", nil, nil, fmt.Errorf("Invalid NATS message: %s", line)
+		}
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(s.reader, data); err != nil {
+			return
+		}
+		return fields[1], data[:hdrSize], data[hdrSize:size], nil
+	}
+}
+
+func (s *natsSink) reset() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+func (s *natsSink) close() error {
+	close(s.stopC)
+	err := s.flush()
+	s.sendLock.Lock()
+	defer s.sendLock.Unlock()
+	s.reset()
+	return err
+}
+
+// sinkNames lists the configured sinks
+func (config *configOptions) sinkNames() (names []string) {
+	if config.DryRun {
+		return []string{"ndjson"}
+	}
+	if config.KafkaSink.enabled() {
+		names = append(names, "kafka")
+	}
+	if config.RedisSink.enabled() {
+		names = append(names, "redis")
+	}
+	if config.NotificationSink.enabled() {
+		names = append(names, "notifications")
+	}
+	if config.WebhookSink.enabled() {
+		names = append(names, "webhook")
+	}
+	if config.ArchiveSink.enabled() {
+		names = append(names, "archive")
+	}
+	if config.MeilisearchSink.enabled() {
+		names = append(names, "meilisearch")
+	}
+	if config.TypesenseSink.enabled() {
+		names = append(names, "typesense")
+	}
+	if config.PostgresSink.enabled() {
+		names = append(names, "postgres")
+	}
+	if config.NATSSink.enabled() {
+		names = append(names, "nats")
+	}
+	if config.NDJSONFile != "" {
+		names = append(names, "ndjson")
+	}
+	if sinkPlugin != nil {
+		names = append(names, "plugin")
+	}
+	return
+}
+
+// newSinks starts the configured sinks
+func (config *configOptions) newSinks() (err error) {
+	if config.DryRun {
+		return
+	}
+	if config.KafkaSink.enabled() {
+		ks := config.KafkaSink
+		ks.start()
+		sinks = append(sinks, ks)
+		infoLog.Printf("Publishing changes to Kafka through %s", ks.RestURL)
+	}
+	if config.RedisSink.enabled() {
+		sinks = append(sinks, config.RedisSink)
+		infoLog.Printf("Writing changes to Redis at %s", config.RedisSink.Address)
+	}
+	if config.NotificationSink.enabled() {
+		if err = config.NotificationSink.start(); err != nil {
+			return
+		}
+		sinks = append(sinks, config.NotificationSink)
+		infoLog.Println("Sending change notifications to AWS")
+	}
+	if config.WebhookSink.enabled() {
+		ws := config.WebhookSink
+		ws.start()
+		sinks = append(sinks, ws)
+		infoLog.Printf("Posting changes to webhook %s", ws.URL)
+	}
+	if config.ArchiveSink.enabled() {
+		if err = config.ArchiveSink.start(); err != nil {
+			return
+		}
+		sinks = append(sinks, config.ArchiveSink)
+		infoLog.Printf("Archiving changes to bucket %s", config.ArchiveSink.Bucket)
+	}
+	if config.MeilisearchSink.enabled() {
+		if err = config.MeilisearchSink.start(); err != nil {
+			return
+		}
+		sinks = append(sinks, config.MeilisearchSink)
+		infoLog.Printf("Writing changes to Meilisearch at %s", config.MeilisearchSink.URL)
+	}
+	if config.TypesenseSink.enabled() {
+		if err = config.TypesenseSink.start(); err != nil {
+			return
+		}
+		sinks = append(sinks, config.TypesenseSink)
+		infoLog.Printf("Writing changes to Typesense at %s", config.TypesenseSink.URL)
+	}
+	if config.PostgresSink.enabled() {
+		if err = config.PostgresSink.start(); err != nil {
+			return
+		}
+		sinks = append(sinks, config.PostgresSink)
+		infoLog.Printf("Writing changes to PostgreSQL table %s", config.PostgresSink.Table)
+	}
+	if config.NATSSink.enabled() {
+		config.NATSSink.start()
+		sinks = append(sinks, config.NATSSink)
+		u, _ := url.Parse(config.NATSSink.URL)
+		infoLog.Printf("Publishing changes to NATS JetStream at %s", u.Host)
+	}
+	if sinkPlugin != nil {
+		var s monstachemap.Sink
+		if s, err = sinkPlugin(); err != nil {
+			return
+		}
+		sinks = append(sinks, &pluginSink{sink: s})
+		infoLog.Println("Writing changes to plugin sink")
+	}
+	return
+}
+
+// header describes the event without the document
+func (ev *sinkEvent) header() map[string]interface{} {
+	return map[string]interface{}{
+		"operation": ev.Operation,
+		"namespace": ev.Namespace,
+		"index":     ev.Index,
+		"id":        ev.ID,
+		"timestamp": ev.Timestamp.Format(time.RFC3339),
+	}
+}
+
+// opTime is the time of the change in the oplog or the current time for
+// direct reads
+func opTime(op *gtm.Op) time.Time {
+	if op.Timestamp == 0 {
+		return time.Now().UTC()
+	}
+	return time.Unix(int64(op.Timestamp>>32), 0).UTC()
+}
+
+func emitSinkEvent(ev *sinkEvent) {
+	for _, s := range sinks {
+		if err := s.write(ev); err != nil {
+			errorLog.Printf("Unable to write %s of document %s in %s to sink: %s", ev.Operation, ev.ID, ev.Namespace, err)
+		}
+	}
+}
+
+// flushSinks flushes every sink and returns the last error.  Changes which
+// a sink failed to write stay queued in the sink
+func flushSinks() (err error) {
+	for _, s := range sinks {
+		if e := s.flush(); e != nil {
+			errorLog.Printf("Unable to flush sink: %s", e)
+			err = e
+		}
+	}
+	return
+}
+
+func closeSinks() (err error) {
+	for _, s := range sinks {
+		if e := s.close(); e != nil {
+			errorLog.Printf("Unable to close sink: %s", e)
+			err = e
+		}
+	}
+	return
+}
+
+func (ac *awsConnect) validate() error {
+	switch ac.Service {
+	case "", "es", "aoss":
+	default:
+		return errors.New("AWS connect service must be one of es or aoss")
+	}
+	if ac.AccessKey == "" && ac.SecretKey == "" {
+		if ac.Region == "" {
+			return errors.New("AWS connect settings must include region when using the default credentials chain")
+		}
+		return nil
+	} else if ac.AccessKey != "" && ac.SecretKey != "" {
+		return nil
+	}
+	return errors.New("AWS connect settings must include both access-key and secret-key")
+}
+
+func (ac *awsConnect) enabled() bool {
+	return ac.AccessKey != "" || ac.SecretKey != "" || ac.Service != ""
+}
+
+func (ac *awsConnect) serverless() bool {
+	return ac.Service == "aoss"
+}
+
+// credentials returns the static credentials when configured and otherwise
+// the default AWS chain of environment, shared config and instance roles
+func (ac *awsConnect) credentials() *credentials.Credentials {
+	if ac.AccessKey != "" {
+		return credentials.NewStaticCredentials(ac.AccessKey, ac.SecretKey, "")
+	}
+	return defaults.CredChain(defaults.Config(), defaults.Handlers())
+}
+
+func (t *awsSigningTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.URL.Scheme = "https"
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	sum := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	if _, err := t.signer.Sign(req, bytes.NewReader(body), t.service, t.region, time.Now().UTC()); err != nil {
+		return nil, err
+	}
+	return t.transport.RoundTrip(req)
+}
+
+func (arg *deleteStrategy) String() string {
+	return fmt.Sprintf("%d", *arg)
+}
+
+func (arg *deleteStrategy) Set(value string) (err error) {
+	var i int
+	if i, err = strconv.Atoi(value); err != nil {
+		return
+	}
+	ds := deleteStrategy(i)
+	*arg = ds
+	return
+}
+
+func (args *stringargs) String() string {
+	return fmt.Sprintf("%s", *args)
+}
+
+func (args *stringargs) Set(value string) error {
+	*args = append(*args, value)
+	return nil
+}
+
+func (config *configOptions) readShards() bool {
+	return len(config.ChangeStreamNs) == 0 && config.MongoConfigURL != ""
+}
+
+// afterBulkFor returns the after callback of a bulk processor.  The processor
+// is used to resubmit failed items according to the bulk error policies
+func afterBulkFor(name string, bulk **elastic.BulkProcessor) elastic.BulkAfterFunc {
+	return func(executionId int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+		defer pressure.endBulk()
+		metrics.bulkFinished(name, executionId)
+		tracing.bulkFinished(name, executionId, response, err)
+		if name == "monstache" {
+			defer throttle.endBulk()
+			sizer.finished(executionId, bulkRejected(response, err))
+		}
+		afterBulk(*bulk, requests, response, err)
+	}
+}
+
+// beforeBulkFor returns the before callback of a bulk processor
+func beforeBulkFor(name string) elastic.BulkBeforeFunc {
+	return func(executionId int64, requests []elastic.BulkableRequest) {
+		pressure.beginBulk()
+		metrics.bulkStarted(name, executionId)
+		tracing.bulkStarted(name, executionId, requests)
+		if name == "monstache" {
+			throttle.beginBulk()
+			sizer.started(executionId)
+		}
+		if secondary != nil {
+			secondary.mirror(executionId, requests)
+		}
+	}
+}
+
+func afterBulk(bulk *elastic.BulkProcessor, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+	if err != nil && response == nil {
+		if bulkRejected(nil, err) {
+			pressure.rejected()
+		}
+		for _, req := range requests {
+			recordBulkFailure(req, bulkRequestIndex(req), "request")
+		}
+		if bulkState.active() {
+			// the requests stay queued in the bulk processor and are sent
+			// again with its next commit
+			return
+		}
+		// the bulk processor is stopping and drops the requests
+		defer docStats.done(requests)
+		defer audit.done(requests, nil, err)
+		defer notifications.bulkOutcome(len(requests))
+		for _, req := range requests {
+			deadLetters.add(req, 0, err.Error())
+			bulkItemDone(req, nil, err)
+		}
+	}
+	if response == nil {
+		return
+	}
+	if bulkRejected(response, nil) {
+		pressure.rejected()
+	} else {
+		pressure.succeeded()
+	}
+	for i, items := range response.Items {
+		if i >= len(requests) {
+			break
+		}
+		for opType, item := range items {
+			if item.Status < 300 {
+				if len(bulkErrorPolicies) > 0 {
+					bulkRetries.Delete(requests[i])
+				}
+				bulkItemDone(requests[i], item, nil)
+				continue
+			}
+			if !handleBulkItemFailure(bulk, opType, item, requests[i]) {
+				bulkItemDone(requests[i], item, nil)
+			}
+		}
+	}
+	docStats.done(requests)
+	audit.done(requests, response, nil)
+	notifications.bulkOutcome(len(response.Failed()))
+}
+
+const backpressureMaxLevel = 8
+const backpressureDecay = 5 * time.Second
+const backpressureMaxFlushInterval = time.Minute
+
+func newBackpressure(workers int, bulks []*pressuredBulk) *backpressure {
+	bp := &backpressure{workers: workers, bulks: bulks}
+	for _, pb := range bulks {
+		bp.bulkWorkers += pb.workers
+	}
+	return bp
+}
+
+// allowedBulks is the number of bulk requests which may be in flight
+func (bp *backpressure) allowedBulks() int {
+	n := bp.bulkWorkers >> uint(bp.level)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// flushInterval is the flush interval of a bulk processor at the current
+// level
+func (bp *backpressure) flushInterval(interval time.Duration) time.Duration {
+	interval <<= uint(bp.level)
+	if interval > backpressureMaxFlushInterval {
+		interval = backpressureMaxFlushInterval
+	}
+	return interval
+}
+
+// scaledInterval is flushInterval for callers which do not hold the lock
+func (bp *backpressure) scaledInterval(interval time.Duration) time.Duration {
+	if bp == nil {
+		return interval
+	}
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+	return bp.flushInterval(interval)
+}
+
+// flush flushes each bulk processor once its flush interval at the current
+// level has passed since it was last flushed
+func (bp *backpressure) flush() {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		var due []*pressuredBulk
+		bp.lock.Lock()
+		for _, pb := range bp.bulks {
+			if pb.interval > 0 && now.Sub(pb.flushed) >= bp.flushInterval(pb.interval) {
+				pb.flushed = now
+				due = append(due, pb)
+			}
+		}
+		bp.lock.Unlock()
+		for _, pb := range due {
+			bulkState.flush(pb.bulk)
+		}
+	}
+}
+
+// beginBulk blocks a bulk processor worker until its request may be sent
+func (bp *backpressure) beginBulk() {
+	if bp == nil {
+		return
+	}
+	bp.lock.Lock()
+	for bp.inFlight >= bp.allowedBulks() {
+		bp.lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		bp.lock.Lock()
+	}
+	bp.inFlight++
+	bp.lock.Unlock()
+}
+
+func (bp *backpressure) endBulk() {
+	if bp == nil {
+		return
+	}
+	bp.lock.Lock()
+	bp.inFlight--
+	bp.lock.Unlock()
+}
+
+// allowed is the number of workers which may index concurrently
+func (bp *backpressure) allowed() int {
+	n := bp.workers >> uint(bp.level)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+func (bp *backpressure) pause() time.Duration {
+	p := 250 * time.Millisecond << uint(bp.level)
+	if p > 30*time.Second {
+		p = 30 * time.Second
+	}
+	return p
+}
+
+// acquire blocks until a worker may index
+func (bp *backpressure) acquire() {
+	if bp == nil {
+		return
+	}
+	bp.lock.Lock()
+	for {
+		wait := bp.until.Sub(time.Now())
+		if wait <= 0 && bp.active < bp.allowed() {
+			break
+		}
+		if wait <= 0 {
+			wait = 50 * time.Millisecond
+		}
+		bp.lock.Unlock()
+		time.Sleep(wait)
+		bp.lock.Lock()
+	}
+	bp.active++
+	bp.lock.Unlock()
+}
+
+func (bp *backpressure) release() {
+	if bp == nil {
+		return
+	}
+	bp.lock.Lock()
+	bp.active--
+	bp.lock.Unlock()
+}
+
+func (bp *backpressure) rejected() {
+	if bp == nil {
+		return
+	}
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+	now := time.Now()
+	if now.Before(bp.until) {
+		// requests sent before the pause are still being rejected
+		return
+	}
+	if bp.level < backpressureMaxLevel {
+		bp.level++
+	}
+	bp.lastChange = now
+	bp.until = bp.lastChange.Add(bp.pause())
+	warnLog.Printf("Elasticsearch is rejecting requests. Pausing indexing for %s with %d workers and %d bulk requests in flight",
+		bp.pause(), bp.allowed(), bp.allowedBulks())
+}
+
+func (bp *backpressure) succeeded() {
+	if bp == nil {
+		return
+	}
+	bp.lock.Lock()
+	defer bp.lock.Unlock()
+	if bp.level > 0 && time.Since(bp.lastChange) >= backpressureDecay {
+		bp.level--
+		bp.lastChange = time.Now()
+		if bp.level == 0 {
+			infoLog.Println("Elasticsearch accepting requests again. Resuming full indexing")
+		}
+	}
+}
+
+// bulkRejected is true if Elasticsearch rejected a bulk request or any of
+// its items because it is overloaded
+func bulkRejected(response *elastic.BulkResponse, err error) bool {
+	if e, ok := err.(*elastic.Error); ok {
+		var errorType string
+		if e.Details != nil {
+			errorType = e.Details.Type
+		}
+		if isRejection(e.Status, errorType) {
+			return true
+		}
+	}
+	if response == nil {
+		return false
+	}
+	for _, items := range response.Items {
+		for _, item := range items {
+			var errorType string
+			if item.Error != nil {
+				errorType = item.Error.Type
+			}
+			if isRejection(item.Status, errorType) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func newBulkSizer(config *configOptions, bulk *elastic.BulkProcessor) *bulkSizer {
+	bs := &bulkSizer{
+		bulk:     bulk,
+		minBytes: int64(config.AdaptiveBulkMinBytes),
+		maxBytes: int64(config.ElasticMaxBytes),
+		target:   time.Duration(config.AdaptiveBulkTargetMs) * time.Millisecond,
+		workers:  config.IndexWorkers,
+		allowed:  config.IndexWorkers,
+	}
+	if bs.maxBytes <= 0 {
+		bs.maxBytes = int64(elasticMaxBytesDefault)
+	}
+	bs.size = bs.maxBytes
+	return bs
+}
+
+// acquire blocks until an index worker may index
+func (bs *bulkSizer) acquire() {
+	if bs == nil {
+		return
+	}
+	bs.lock.Lock()
+	for bs.active >= bs.allowed {
+		bs.lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		bs.lock.Lock()
+	}
+	bs.active++
+	bs.lock.Unlock()
+}
+
+func (bs *bulkSizer) release() {
+	if bs == nil {
+		return
+	}
+	bs.lock.Lock()
+	bs.active--
+	bs.lock.Unlock()
+}
+
+// added counts the bytes of a request added to the main bulk processor and
+// flushes it once they reach the current bulk size
+func (bs *bulkSizer) added(bulk *elastic.BulkProcessor, req elastic.BulkableRequest) {
+	if bs == nil || bulk != bs.bulk {
+		return
+	}
+	n, err := bulkRequestBytes(req)
+	if err != nil {
+		return
+	}
+	pending := atomic.AddInt64(&bs.pending, n)
+	bs.lock.Lock()
+	size := bs.size
+	bs.lock.Unlock()
+	if pending >= size && atomic.CompareAndSwapInt32(&bs.flushing, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&bs.flushing, 0)
+			bs.bulk.Flush()
+		}()
+	}
+}
+
+func (bs *bulkSizer) started(id int64) {
+	if bs == nil {
+		return
+	}
+	atomic.StoreInt64(&bs.pending, 0)
+	bs.starts.Store(id, time.Now())
+}
+
+// finished adjusts the bulk size and workers to the latency of a bulk
+// request.  Sizes shrink by half and grow by a quarter
+func (bs *bulkSizer) finished(id int64, rejected bool) {
+	if bs == nil {
+		return
+	}
+	start, ok := bs.starts.Load(id)
+	if !ok {
+		return
+	}
+	bs.starts.Delete(id)
+	took := time.Since(start.(time.Time))
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	switch {
+	case rejected || took > bs.target:
+		bs.size /= 2
+		if bs.size < bs.minBytes {
+			bs.size = bs.minBytes
+		}
+		if rejected {
+			bs.allowed /= 2
+		} else {
+			bs.allowed--
+		}
+		if bs.allowed < 1 {
+			bs.allowed = 1
+		}
+	case took < bs.target/2:
+		bs.size += bs.size / 4
+		if bs.size > bs.maxBytes {
+			bs.size = bs.maxBytes
+		}
+		if bs.allowed < bs.workers {
+			bs.allowed++
+		}
+	}
+}
+
+func newBulkThrottle(bulk *elastic.BulkProcessor, settings *indexBulk) *bulkThrottle {
+	return &bulkThrottle{
+		bulk:    bulk,
+		started: *settings,
+		limits:  *settings,
+		flushed: time.Now(),
+	}
+}
+
+// lowered is true if a batch limit is below the limit the bulk processor
+// was started with.  Negative limits are unlimited
+func lowered(limit, started int) bool {
+	return limit >= 0 && (started < 0 || limit < started)
+}
+
+// set changes the limits of the bulk processor.  The names of the options
+// raised above the limits it was started with are returned since those
+// take a restart
+func (bt *bulkThrottle) set(limits indexBulk) (restart []string) {
+	if bt == nil {
+		return
+	}
+	if limits.Workers > bt.started.Workers {
+		restart = append(restart, "elasticsearch-max-conns")
+		limits.Workers = bt.started.Workers
+	}
+	// the limits the bulk processor was started with are the lowest
+	if lowered(bt.started.MaxDocs, limits.MaxDocs) {
+		restart = append(restart, "elasticsearch-max-docs")
+		limits.MaxDocs = bt.started.MaxDocs
+	}
+	if lowered(bt.started.MaxBytes, limits.MaxBytes) {
+		restart = append(restart, "elasticsearch-max-bytes")
+		limits.MaxBytes = bt.started.MaxBytes
+	}
+	bt.lock.Lock()
+	bt.limits = limits
+	bt.lock.Unlock()
+	return
+}
+
+func (bt *bulkThrottle) current() indexBulk {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return bt.limits
+}
+
+// added counts a request added to the bulk processor and flushes it once
+// the batch reaches a lowered limit
+func (bt *bulkThrottle) added(bulk *elastic.BulkProcessor, req elastic.BulkableRequest) {
+	if bt == nil || bulk != bt.bulk {
+		return
+	}
+	n, err := bulkRequestBytes(req)
+	if err != nil {
+		return
+	}
+	bt.lock.Lock()
+	bt.docs++
+	bt.bytes += n
+	full := (lowered(bt.limits.MaxDocs, bt.started.MaxDocs) && bt.docs >= bt.limits.MaxDocs) ||
+		(lowered(bt.limits.MaxBytes, bt.started.MaxBytes) && bt.bytes >= int64(bt.limits.MaxBytes))
+	bt.lock.Unlock()
+	if full && atomic.CompareAndSwapInt32(&bt.flushing, 0, 1) {
+		go func() {
+			defer atomic.StoreInt32(&bt.flushing, 0)
+			bulkState.flush(bt.bulk)
+		}()
+	}
+}
+
+// beginBulk blocks a worker of the bulk processor while the workers in
+// flight reach the current limit
+func (bt *bulkThrottle) beginBulk() {
+	if bt == nil {
+		return
+	}
+	bt.lock.Lock()
+	for bt.inFlight >= bt.limits.Workers && bt.inFlight > 0 {
+		bt.lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		bt.lock.Lock()
+	}
+	bt.inFlight++
+	bt.docs, bt.bytes = 0, 0
+	bt.lock.Unlock()
+}
+
+func (bt *bulkThrottle) endBulk() {
+	if bt == nil {
+		return
+	}
+	bt.lock.Lock()
+	bt.inFlight--
+	bt.lock.Unlock()
+}
+
+// flush flushes the bulk processor at the current flush interval, which is
+// stretched by the backpressure level
+func (bt *bulkThrottle) flush() {
+	if bt == nil {
+		return
+	}
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		bt.lock.Lock()
+		interval := pressure.scaledInterval(time.Duration(bt.limits.MaxSeconds) * time.Second)
+		due := interval > 0 && now.Sub(bt.flushed) >= interval
+		if due {
+			bt.flushed = now
+		}
+		bt.lock.Unlock()
+		if due {
+			bulkState.flush(bt.bulk)
+		}
+	}
+}
+
+// isRejection is true for errors indicating that Elasticsearch is overloaded
+func isRejection(status int, errorType string) bool {
+	return status == 429 ||
+		errorType == "es_rejected_execution_exception" ||
+		errorType == "circuit_breaking_exception"
+}
+
+func classifyBulkError(item *elastic.BulkResponseItem) string {
+	var errorType string
+	if item.Error != nil {
+		errorType = item.Error.Type
+	}
+	switch {
+	case item.Status == 429 || errorType == "es_rejected_execution_exception":
+		return "rejected"
+	case item.Status == 409:
+		return "conflict"
+	case errorType == "mapper_parsing_exception" ||
+		errorType == "strict_dynamic_mapping_exception" ||
+		errorType == "document_parsing_exception" ||
+		errorType == "illegal_argument_exception":
+		return "mapping"
+	}
+	return "other"
+}
+
+// handleBulkItemFailure applies the error policy to a failed item.  It
+// returns true if the request is retried
+func handleBulkItemFailure(bulk *elastic.BulkProcessor, opType string, item *elastic.BulkResponseItem, req elastic.BulkableRequest) (retried bool) {
+	class := classifyBulkError(item)
+	recordBulkFailure(req, item.Index, class)
+	if item.Status == http.StatusRequestEntityTooLarge {
+		// the batch was split down to this request which is too large on
+		// its own so retrying it cannot succeed
+		deadLetters.add(req, item.Status, item.Error)
+		return
+	}
+	if class == "conflict" && opType == "update" && handleUpdateConflict(item, req) {
+		return
+	}
+	policy := bulkErrorPolicies[class]
+	if policy == nil && defaultBulkErrorPolicy != nil && bulkRetryStatusCodes[item.Status] {
+		if defaultBulkErrorPolicy.retry(bulk, req) {
+			return true
+		}
+	}
+	if policy == nil {
+		if class == "conflict" {
+			// ignore version conflict since this simply means the doc
+			// is already in the index
+			return
+		}
+		logBulkItem(item)
+		deadLetters.add(req, item.Status, item.Error)
+		return
+	}
+	if policy.retry(bulk, req) {
+		return true
+	}
+	switch policy.Action {
+	case "drop":
+	case "dead-letter":
+		if deadLetters != nil {
+			deadLetters.add(req, item.Status, item.Error)
+			break
+		}
+		logBulkItem(item)
+	default:
+		logBulkItem(item)
+	}
+	return
+}
+
+func logBulkItem(item *elastic.BulkResponseItem) {
+	json, err := json.Marshal(item)
+	if err != nil {
+		errorLog.Printf("Unable to marshal bulk response item: %s", err)
+	} else {
+		fields := &logFields{ID: item.Id, Index: item.Index, ErrorClass: classifyBulkError(item)}
+		logWith(errorLog, fields, "Bulk response item: %s", string(json))
+	}
+}
+
+// retry resubmits a failed request after an exponential backoff.  It returns
+// false once the retries of the policy are exhausted
+func (p *bulkErrorPolicy) retry(bulk *elastic.BulkProcessor, req elastic.BulkableRequest) bool {
+	attempts := 0
+	if v, ok := bulkRetries.Load(req); ok {
+		attempts = v.(int)
+	}
+	if bulk == nil || attempts >= p.Retries {
+		bulkRetries.Delete(req)
+		return false
+	}
+	bulkRetries.Store(req, attempts+1)
+	time.AfterFunc(p.backoff(attempts), func() {
+		if !bulkState.add(bulk, req) {
+			bulkRetries.Delete(req)
+			deadLetters.add(req, 0, errBulkRetryStopped.Error())
+			bulkItemDone(req, nil, errBulkRetryStopped)
+		}
+	})
+	return true
+}
+
+func (p *bulkErrorPolicy) backoff(attempt int) time.Duration {
+	backoff := time.Duration(p.BackoffMs) * time.Millisecond
+	max := time.Duration(p.MaxBackoffMs) * time.Millisecond
+	for i := 0; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+func (r rawBulkRequest) String() string {
+	return strings.Join(r, "\n")
+}
+
+func (r rawBulkRequest) Source() ([]string, error) {
+	return r, nil
+}
+
+func (config *configOptions) newDeadLetterQueue(client *elastic.Client) (dlq *deadLetterQueue, err error) {
+	if config.DeadLetterFile != "" {
+		dlq = &deadLetterQueue{compress: config.DiskCompression == "zstd"}
+		dlq.file, err = os.OpenFile(config.DeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		return
+	}
+	if config.DeadLetterIndex == "" {
+		return
+	}
+	dlq = &deadLetterQueue{index: strings.ToLower(config.DeadLetterIndex)}
+	if config.useTypelessAPI() {
+		dlq.typeName = ""
+	} else if config.useTypeFromFuture() {
+		dlq.typeName = typeFromFuture
+	} else {
+		dlq.typeName = "deadletter"
+	}
+	bulkService := client.BulkProcessor().Name("monstache-dead-letters")
+	bulkService.Workers(1)
+	bulkService.Stats(false)
+	bulkService.BulkActions(-1)
+	bulkService.BulkSize(-1)
+	bulkService.After(func(id int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+		if err != nil {
+			errorLog.Printf("Unable to write dead letters: %s", err)
+		} else if response != nil && response.Errors {
+			errorLog.Printf("Unable to write %d dead letters", len(response.Failed()))
+		}
+	})
+	bulkService.FlushInterval(time.Duration(5) * time.Second)
+	dlq.bulk, err = bulkService.Do(context.Background())
+	return
+}
+
+func (config *configOptions) newAuditLog(client *elastic.Client) (al *auditLog, err error) {
+	if config.AuditFile != "" {
+		al = &auditLog{}
+		al.file, err = os.OpenFile(config.AuditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		return
+	}
+	if config.AuditIndex == "" {
+		return
+	}
+	al = &auditLog{index: strings.ToLower(config.AuditIndex)}
+	if config.useTypelessAPI() {
+		al.typeName = ""
+	} else if config.useTypeFromFuture() {
+		al.typeName = typeFromFuture
+	} else {
+		al.typeName = "audit"
+	}
+	bulkService := client.BulkProcessor().Name("monstache-audit")
+	bulkService.Workers(1)
+	bulkService.Stats(false)
+	bulkService.BulkActions(-1)
+	bulkService.BulkSize(-1)
+	bulkService.After(func(id int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+		if err != nil {
+			errorLog.Printf("Unable to write audit log: %s", err)
+		} else if response != nil && response.Errors {
+			errorLog.Printf("Unable to write %d audit log entries", len(response.Failed()))
+		}
+	})
+	bulkService.FlushInterval(time.Duration(5) * time.Second)
+	al.bulk, err = bulkService.Do(context.Background())
+	return
+}
+
+// enqueue holds the audit entry of a request until its bulk response.  It
+// is safe to call on a nil log
+func (al *auditLog) enqueue(op *gtm.Op, index string, req elastic.BulkableRequest) {
+	if al == nil || op == nil {
+		return
+	}
+	entry := &auditEntry{
+		Namespace: op.Namespace,
+		ID:        fmt.Sprintf("%v", op.Id),
+		Operation: op.Operation,
+		Index:     index,
+	}
+	switch req.(type) {
+	case *elastic.BulkIndexRequest:
+		entry.Action = "index"
+	case *elastic.BulkUpdateRequest:
+		entry.Action = "update"
+	case *elastic.BulkDeleteRequest:
+		entry.Action = "delete"
+	}
+	if op.Timestamp != 0 {
+		entry.ResumeTs = fmt.Sprintf("%d:%d", op.Timestamp>>32, uint32(op.Timestamp))
+	}
+	al.pending.Store(req, entry)
+}
+
+// done records the outcome of the requests of a bulk response.  Requests
+// retried by a bulk error policy stay pending until their final outcome
+func (al *auditLog) done(requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+	if al == nil {
+		return
+	}
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	for i, req := range requests {
+		v, ok := al.pending.Load(req)
+		if !ok {
+			continue
+		}
+		entry := *v.(*auditEntry)
+		entry.Timestamp = now
+		entry.Outcome = "ok"
+		if response == nil {
+			entry.Outcome = "failed"
+			if err != nil {
+				entry.Error = err.Error()
+			}
+		} else if i < len(response.Items) {
+			for _, item := range response.Items[i] {
+				entry.Status = item.Status
+				if item.Status >= 300 {
+					entry.Outcome = "failed"
+					if item.Error != nil {
+						entry.Error = item.Error.Type + ": " + item.Error.Reason
+					}
+				}
+			}
+		}
+		if _, retrying := bulkRetries.Load(req); retrying && entry.Outcome == "failed" {
+			entry.Outcome = "retrying"
+		} else {
+			al.pending.Delete(req)
+		}
+		al.write(&entry)
+	}
+}
+
+func (al *auditLog) write(entry *auditEntry) {
+	if al.bulk != nil {
+		al.bulk.Add(elastic.NewBulkIndexRequest().Index(al.index).Type(al.typeName).Doc(entry))
+		return
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		errorLog.Printf("Unable to marshal audit log entry: %s", err)
+		return
+	}
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if _, err = al.file.Write(append(b, '\n')); err != nil {
+		errorLog.Printf("Unable to write audit log: %s", err)
+	}
+}
+
+func (al *auditLog) close() {
+	if al == nil {
+		return
+	}
+	if al.bulk != nil {
+		al.bulk.Stop()
+	}
+	if al.file != nil {
+		al.file.Close()
+	}
+}
+
+// add records a failed bulk request.  It is safe to call on a nil queue
+func (dlq *deadLetterQueue) add(req elastic.BulkableRequest, status int, reason interface{}) {
+	if dlq == nil {
+		return
+	}
+	lines, err := req.Source()
+	if err != nil || len(lines) == 0 {
+		return
+	}
+	dl := &deadLetter{
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Action:    lines[0],
+		Status:    status,
+		Error:     reason,
+	}
+	if len(lines) > 1 {
+		dl.Document = lines[1]
+	}
+	if dlq.bulk != nil {
+		dlq.bulk.Add(elastic.NewBulkIndexRequest().Index(dlq.index).Type(dlq.typeName).Doc(dl))
+		return
+	}
+	b, err := json.Marshal(dl)
+	if err != nil {
+		errorLog.Printf("Unable to marshal dead letter: %s", err)
+		return
+	}
+	b = append(b, '\n')
+	if dlq.compress {
+		// each dead letter is a zstd frame so that the file stays
+		// readable as a whole while it is appended to
+		b = zstdEncoder.EncodeAll(b, nil)
+	}
+	dlq.lock.Lock()
+	defer dlq.lock.Unlock()
+	if _, err = dlq.file.Write(b); err != nil {
+		errorLog.Printf("Unable to write dead letter: %s", err)
+	}
+}
+
+func (dlq *deadLetterQueue) close() {
+	if dlq == nil {
+		return
+	}
+	if dlq.bulk != nil {
+		dlq.bulk.Stop()
+	}
+	if dlq.file != nil {
+		dlq.file.Close()
+	}
+}
+
+func (dl *deadLetter) request() rawBulkRequest {
+	if dl.Document == "" {
+		return rawBulkRequest{dl.Action}
+	}
+	return rawBulkRequest{dl.Action, dl.Document}
+}
+
+// resubmitDeadLetters sends dead letters to Elasticsearch in a single bulk
+// request and returns whether each one succeeded
+func resubmitDeadLetters(client *elastic.Client, dls []*deadLetter) (ok []bool, err error) {
+	ok = make([]bool, len(dls))
+	if len(dls) == 0 {
+		return
+	}
+	service := client.Bulk()
+	for _, dl := range dls {
+		service.Add(dl.request())
+	}
+	resp, err := service.Do(context.Background())
+	if err != nil {
+		return
+	}
+	for i, items := range resp.Items {
+		for _, item := range items {
+			ok[i] = item.Status < 300 || item.Status == 409
+		}
+	}
+	return
+}
+
+func replayDeadLetterFile(client *elastic.Client, path string) (replayed, remaining int, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	compressed := isZstd(b)
+	if b, err = decompressDisk(b); err != nil {
+		return
+	}
+	var dls []*deadLetter
+	var failed [][]byte
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		dl := &deadLetter{}
+		if e := json.Unmarshal(line, dl); e != nil {
+			failed = append(failed, line)
+			continue
+		}
+		dls = append(dls, dl)
+	}
+	const batch = 500
+	for start := 0; start < len(dls); start += batch {
+		end := start + batch
+		if end > len(dls) {
+			end = len(dls)
+		}
+		var ok []bool
+		if ok, err = resubmitDeadLetters(client, dls[start:end]); err != nil {
+			return
+		}
+		for i, dl := range dls[start:end] {
+			if ok[i] {
+				replayed++
+				continue
+			}
+			line, _ := json.Marshal(dl)
+			failed = append(failed, line)
+		}
+	}
+	remaining = len(failed)
+	var out []byte
+	for _, line := range failed {
+		out = append(out, line...)
+		out = append(out, '\n')
+	}
+	if compressed && len(out) > 0 {
+		out = zstdEncoder.EncodeAll(out, nil)
+	}
+	err = ioutil.WriteFile(path, out, 0644)
+	return
+}
+
+func replayDeadLetterIndex(client *elastic.Client, index string) (replayed, remaining int, err error) {
+	ctx := context.Background()
+	scroll := client.Scroll(index).Size(500)
+	for {
+		var results *elastic.SearchResult
+		results, err = scroll.Do(ctx)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			return
+		}
+		var dls []*deadLetter
+		var hits []*elastic.SearchHit
+		for _, hit := range results.Hits.Hits {
+			dl := &deadLetter{}
+			if hit.Source == nil || json.Unmarshal(*hit.Source, dl) != nil {
+				remaining++
+				continue
+			}
+			dls = append(dls, dl)
+			hits = append(hits, hit)
+		}
+		var ok []bool
+		if ok, err = resubmitDeadLetters(client, dls); err != nil {
+			return
+		}
+		deletes := client.Bulk()
+		for i, hit := range hits {
+			if ok[i] {
+				replayed++
+				deletes.Add(elastic.NewBulkDeleteRequest().Index(hit.Index).Type(hit.Type).Id(hit.Id))
+			} else {
+				remaining++
+			}
+		}
+		if deletes.NumberOfActions() > 0 {
+			if _, err = deletes.Do(ctx); err != nil {
+				return
+			}
+		}
+	}
+	scroll.Clear(ctx)
+	return
+}
+
+func replayDeadLetters(client *elastic.Client, config *configOptions) (err error) {
+	var replayed, remaining int
+	if config.DeadLetterFile != "" {
+		replayed, remaining, err = replayDeadLetterFile(client, config.DeadLetterFile)
+	} else {
+		replayed, remaining, err = replayDeadLetterIndex(client, strings.ToLower(config.DeadLetterIndex))
+	}
+	if err == nil {
+		infoLog.Printf("Replayed %d dead letters. %d could not be replayed.", replayed, remaining)
+	}
+	return
+}
+
+// handleUpdateConflict applies the configured policy to an update which still
+// conflicted after its retries were exhausted
+func handleUpdateConflict(item *elastic.BulkResponseItem, req elastic.BulkableRequest) bool {
+	v, ok := updateConflictRequests.Load(req)
+	if !ok {
+		return false
+	}
+	uc := v.(*pendingUpdate)
+	switch uc.Policy {
+	case "drop":
+		atomic.AddInt64(&updateConflictsDropped, 1)
+	case "refetch":
+		op := &gtm.Op{
+			Id:        uc.id,
+			Namespace: uc.Namespace,
+			Operation: "u",
+			Source:    gtm.DirectQuerySource,
+			Timestamp: bson.MongoTimestamp(time.Now().Unix() << 32),
+		}
+		select {
+		case updateConflictRefetchC <- op:
+		default:
+			errorLog.Printf("Refetch queue is full. Dropping conflicting update of %s in %s.", item.Id, item.Index)
+		}
+	default:
+		errorLog.Printf("Update of %s in %s failed with a version conflict after %d retries",
+			item.Id, item.Index, uc.RetryOnConflict)
+	}
+	return true
+}
+
+// documentID reverses opIDToString for the common _id types
+func documentID(id string) interface{} {
+	if bson.IsObjectIdHex(id) {
+		return bson.ObjectIdHex(id)
+	}
+	if i, err := strconv.ParseInt(id, 10, 64); err == nil {
+		return i
+	}
+	return id
+}
+
+var errBulkRequestTooLarge = errors.New("Bulk request is too large to index")
+var errBulkRetryStopped = errors.New("Bulk processor stopped before the retry")
+
+// onBulkItem registers a callback told the outcome of req.  It must be
+// called before req is added to a bulk processor.  Callbacks registered
+// for the same request are called in order
+func onBulkItem(req elastic.BulkableRequest, cb bulkItemCallback) {
+	if reflect.TypeOf(req).Kind() != reflect.Ptr {
+		// only requests with an identity can be told apart in responses
+		return
+	}
+	if prev, loaded := bulkCallbacks.LoadOrStore(req, cb); loaded {
+		first := prev.(bulkItemCallback)
+		bulkCallbacks.Store(req, bulkItemCallback(func(item *elastic.BulkResponseItem, err error) {
+			first(item, err)
+			cb(item, err)
+		}))
+	}
+}
+
+func bulkItemDone(req elastic.BulkableRequest, item *elastic.BulkResponseItem, err error) {
+	if reflect.TypeOf(req).Kind() != reflect.Ptr {
+		return
+	}
+	if cb, ok := bulkCallbacks.Load(req); ok {
+		bulkCallbacks.Delete(req)
+		cb.(bulkItemCallback)(item, err)
+	}
+}
+
+// forgetBulkItem drops the callbacks of a request which is not sent to
+// Elasticsearch
+func forgetBulkItem(req elastic.BulkableRequest) {
+	if reflect.TypeOf(req).Kind() == reflect.Ptr {
+		bulkCallbacks.Delete(req)
+		updateConflictRequests.Delete(req)
+	}
+}
+
+// refetchConflicts reindexes documents whose updates conflicted from the
+// current state in MongoDB
+func refetchConflicts(config *configOptions, mongo *mgo.Session, bulk *elastic.BulkProcessor, client *elastic.Client) {
+	for op := range updateConflictRefetchC {
+		session := mongo.Copy()
+		col := session.DB(op.GetDatabase()).C(op.GetCollection())
+		var doc map[string]interface{}
+		err := col.FindId(op.Id).One(&doc)
+		session.Close()
+		if err != nil {
+			logWith(errorLog, opLogFields(op), "Unable to refetch conflicting document %v in %s: %s", op.Id, op.Namespace, err)
+			continue
+		}
+		op.Data = doc
+		if err = doIndex(config, mongo, bulk, client, op); err != nil {
+			processOpErr(err, config, op)
+		}
+	}
+}
+
+// recordUpdateConflict applies the retry_on_conflict setting of the namespace
+// to an update and remembers the document until the update is done for
+// conflict handling
+func recordUpdateConflict(req *elastic.BulkUpdateRequest, op *gtm.Op, retry int) {
+	uc := updateConflicts[op.Namespace]
+	if uc == nil {
+		if retry != 0 {
+			req.RetryOnConflict(retry)
+		}
+		return
+	}
+	if retry == 0 {
+		retry = uc.RetryOnConflict
+	}
+	if retry != 0 {
+		req.RetryOnConflict(retry)
+	}
+	updateConflictRequests.Store(req, &pendingUpdate{updateConflict: uc, id: op.Id})
+	onBulkItem(req, func(item *elastic.BulkResponseItem, err error) {
+		updateConflictRequests.Delete(req)
+	})
+}
+
+func (config *configOptions) useTypeFromFuture() (use bool) {
+	if config.ElasticMajorVersion > 6 {
+		use = true
+	} else if config.ElasticMajorVersion == 6 && config.ElasticMinorVersion >= 2 {
+		use = true
+	}
+	return
+}
+
+// useTypelessAPI is true for servers which reject the _type field in bulk
+// metadata (Elasticsearch 8+ and OpenSearch 2+)
+func (config *configOptions) useTypelessAPI() bool {
+	if config.OpenSearch {
+		return config.OpenSearchMajorVersion >= 2
+	}
+	return config.ElasticMajorVersion >= 8
+}
+
+// useDeltaUpdates is true when oplog updates should be delivered as deltas
+// rather than fetched from MongoDB.  This is only possible when tailing the
+// oplog directly and partial updates are configured
+func (config *configOptions) useDeltaUpdates() bool {
+	if config.DisableChangeEvents || len(config.ChangeStreamNs) > 0 {
+		return false
+	}
+	return len(partialUpdateNamespaces) > 0 || len(arrayUpdateNamespaces) > 0
+}
+
+// parseOpenSearchVersion records the OpenSearch version and maps it onto the
+// Elasticsearch version it is API compatible with (7.10) so that feature
+// detection based on the Elasticsearch version continues to work
+func (config *configOptions) parseOpenSearchVersion(number string) (err error) {
+	if number == "" {
+		return errors.New("OpenSearch version cannot be blank")
+	}
+	versionParts := strings.Split(number, ".")
+	if config.OpenSearchMajorVersion, err = strconv.Atoi(versionParts[0]); err != nil {
+		return
+	}
+	if config.OpenSearchMajorVersion == 0 {
+		return errors.New("Invalid OpenSearch major version 0")
+	}
+	if len(versionParts) > 1 {
+		if config.OpenSearchMinorVersion, err = strconv.Atoi(versionParts[1]); err != nil {
+			return
+		}
+	}
+	config.OpenSearch = true
+	config.ElasticMajorVersion = 7
+	config.ElasticMinorVersion = 10
+	return
+}
+
+func (config *configOptions) parseServerVersion(number string) error {
+	if config.OpenSearch {
+		return config.parseOpenSearchVersion(number)
+	}
+	return config.parseElasticsearchVersion(number)
+}
+
+func parseServerInfo(body []byte) (number string, openSearch bool, err error) {
+	var info struct {
+		Version struct {
+			Number       string `json:"number"`
+			Distribution string `json:"distribution"`
+		} `json:"version"`
+	}
+	if err = json.Unmarshal(body, &info); err == nil {
+		number = info.Version.Number
+		openSearch = info.Version.Distribution == "opensearch"
+	}
+	return
+}
+
+func (config *configOptions) parseElasticsearchVersion(number string) (err error) {
+	if number == "" {
+		err = errors.New("Elasticsearch version cannot be blank")
+	} else {
+		versionParts := strings.Split(number, ".")
+		var majorVersion, minorVersion int
+		majorVersion, err = strconv.Atoi(versionParts[0])
+		if err == nil {
+			config.ElasticMajorVersion = majorVersion
+			if majorVersion == 0 {
+				err = errors.New("Invalid Elasticsearch major version 0")
+			}
+		}
+		if len(versionParts) > 1 {
+			minorVersion, err = strconv.Atoi(versionParts[1])
+			if err == nil {
+				config.ElasticMinorVersion = minorVersion
+			}
+		}
+	}
+	return
+}
+
+func (config *configOptions) newBulkProcessor(client *elastic.Client) (bulk *elastic.BulkProcessor, err error) {
+	settings := &indexBulk{
+		Workers:    config.ElasticMaxConns,
+		MaxDocs:    config.ElasticMaxDocs,
+		MaxBytes:   config.ElasticMaxBytes,
+		MaxSeconds: config.ElasticMaxSeconds,
+	}
+	return config.newBulkProcessorWithSettings(client, "monstache", settings)
+}
+
+func (config *configOptions) newBulkProcessorWithSettings(client *elastic.Client, name string, settings *indexBulk) (bulk *elastic.BulkProcessor, err error) {
+	bulkService := client.BulkProcessor().Name(name)
+	bulkService.Workers(settings.Workers)
+	bulkService.Stats(config.Stats)
+	bulkService.BulkActions(settings.MaxDocs)
+	bulkService.BulkSize(settings.MaxBytes)
+	if config.ElasticRetry == false {
+		bulkService.Backoff(&elastic.StopBackoff{})
+	}
+	if len(bulkErrorPolicies) > 0 {
+		// failed items are retried per error class in afterBulk
+		bulkService.RetryItemStatusCodes()
+	}
+	bulkService.Before(beforeBulkFor(name))
+	bulkService.After(afterBulkFor(name, &bulk))
+	interval := time.Duration(settings.MaxSeconds) * time.Second
+	if name == "monstache" {
+		// the main bulk processor is flushed by its throttle
+		interval = 0
+	} else if !config.AdaptiveBackpressure {
+		bulkService.FlushInterval(interval)
+	}
+	if bulk, err = bulkService.Do(context.Background()); err != nil {
+		return
+	}
+	if name == "monstache" {
+		throttle = newBulkThrottle(bulk, settings)
+	}
+	if config.ElasticMaxContentLength > 0 {
+		// a batch is sent once it reaches MaxBytes so it holds at most
+		// MaxBytes plus the size of the request which filled it
+		bulkRequestLimits[bulk] = int64(config.ElasticMaxContentLength - settings.MaxBytes)
+	}
+	if config.AdaptiveBackpressure {
+		pressuredBulks = append(pressuredBulks, &pressuredBulk{
+			bulk:     bulk,
+			interval: interval,
+			workers:  settings.Workers,
+			flushed:  time.Now(),
+		})
+	}
+	return
+}
+
+// newSecondaryCluster connects to the secondary cluster, reusing the primary
+// connection settings except for the URLs and credentials
+func (config *configOptions) newSecondaryCluster() (sc *secondaryCluster, err error) {
+	if len(config.SecondaryElasticUrls) == 0 {
+		return
+	}
+	sconfig := *config
+	sconfig.ElasticUrls = config.SecondaryElasticUrls
+	sconfig.ElasticUser = config.SecondaryElasticUser
+	sconfig.ElasticPassword = config.SecondaryElasticPassword
+	sconfig.ElasticAPIKey = config.SecondaryElasticAPIKey
+	sconfig.ElasticAPIKeyFile = ""
+	sconfig.secretPrefix = "secondary-"
+	sc = &secondaryCluster{}
+	if sc.client, err = sconfig.newElasticClient(); err != nil {
+		return nil, err
+	}
+	bulkService := sc.client.BulkProcessor().Name("monstache-secondary")
+	bulkService.Workers(config.ElasticMaxConns)
+	bulkService.BulkActions(config.ElasticMaxDocs)
+	bulkService.BulkSize(config.ElasticMaxBytes)
+	bulkService.FlushInterval(time.Duration(config.ElasticMaxSeconds) * time.Second)
+	bulkService.Before(sc.before)
+	bulkService.After(sc.after)
+	if sc.bulk, err = bulkService.Do(context.Background()); err != nil {
+		return nil, err
+	}
+	infoLog.Printf("Writing to secondary Elasticsearch cluster at %v", config.SecondaryElasticUrls)
+	return
+}
+
+// mirror copies the requests of a primary bulk commit to the secondary
+func (sc *secondaryCluster) mirror(executionID int64, requests []elastic.BulkableRequest) {
+	atomic.AddInt64(&sc.pending, int64(len(requests)))
+	for _, req := range requests {
+		sc.bulk.Add(req)
+	}
+}
+
+func (sc *secondaryCluster) before(executionID int64, requests []elastic.BulkableRequest) {
+	sc.started.Store(executionID, time.Now())
+}
+
+func (sc *secondaryCluster) after(executionID int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+	atomic.AddInt64(&sc.pending, -int64(len(requests)))
+	if started, ok := sc.started.Load(executionID); ok {
+		sc.started.Delete(executionID)
+		atomic.StoreInt64(&sc.lag, int64(time.Since(started.(time.Time))/time.Millisecond))
+	}
+	if err != nil {
+		atomic.AddInt64(&sc.failed, int64(len(requests)))
+		errorLog.Printf("Secondary bulk request failed: %s", err)
+		return
+	}
+	for _, item := range response.Failed() {
+		if item.Status == 409 {
+			continue
+		}
+		atomic.AddInt64(&sc.failed, 1)
+		errorLog.Printf("Secondary bulk item failed: %+v", item.Error)
+	}
+}
+
+func (sc *secondaryCluster) stats() *secondaryStats {
+	if sc == nil {
+		return nil
+	}
+	return &secondaryStats{
+		Pending:   atomic.LoadInt64(&sc.pending),
+		Failed:    atomic.LoadInt64(&sc.failed),
+		LagMillis: atomic.LoadInt64(&sc.lag),
+	}
+}
+
+func (sc *secondaryCluster) stop() {
+	if sc == nil {
+		return
+	}
+	sc.bulk.Stop()
+}
+
+// newIndexBulkProcessors starts a dedicated bulk processor for each index
+// with overridden bulk settings.  Unset values inherit the global settings.
+func (config *configOptions) newIndexBulkProcessors(client *elastic.Client) (err error) {
+	for index, ib := range indexBulkSettings {
+		settings := &indexBulk{
+			Index:      index,
+			Workers:    config.ElasticMaxConns,
+			MaxDocs:    config.ElasticMaxDocs,
+			MaxBytes:   config.ElasticMaxBytes,
+			MaxSeconds: config.ElasticMaxSeconds,
+		}
+		if ib.Workers != 0 {
+			settings.Workers = ib.Workers
+		}
+		if ib.MaxDocs != 0 {
+			settings.MaxDocs = ib.MaxDocs
+		}
+		if ib.MaxBytes != 0 {
+			settings.MaxBytes = ib.MaxBytes
+		}
+		if ib.MaxSeconds != 0 {
+			settings.MaxSeconds = ib.MaxSeconds
+		}
+		if config.ElasticMaxContentLength > 0 && settings.MaxBytes >= config.ElasticMaxContentLength {
+			return fmt.Errorf("Max bytes of index %s must be less than elasticsearch-max-content-length", index)
+		}
+		var bulk *elastic.BulkProcessor
+		if bulk, err = config.newBulkProcessorWithSettings(client, "monstache-"+index, settings); err != nil {
+			return
+		}
+		indexBulks[index] = bulk
+	}
+	return
+}
+
+// bulkForIndex returns the bulk processor dedicated to index if one is
+// configured, otherwise the default bulk processor
+func bulkForIndex(bulk *elastic.BulkProcessor, index string) *elastic.BulkProcessor {
+	if ib := indexBulks[strings.ToLower(index)]; ib != nil {
+		return ib
+	}
+	return bulk
+}
+
+// flushBulks flushes the bulk processors and then the sinks.  It returns
+// the error of a sink which failed to flush
+func flushBulks(bulk *elastic.BulkProcessor) error {
+	bulk.Flush()
+	for _, ib := range indexBulks {
+		ib.Flush()
+	}
+	if secondary != nil {
+		secondary.bulk.Flush()
+	}
+	return flushSinks()
+}
+
+// stopBulks stops the bulk processors and closes the sinks.  It returns the
+// error of a sink which failed to flush its pending changes
+func stopBulks(bulk *elastic.BulkProcessor) (err error) {
+	bulkState.set(true)
+	bulk.Stop()
+	for _, ib := range indexBulks {
+		ib.Stop()
+	}
+	// the primary flushes into the secondary so it must stop last
+	secondary.stop()
+	err = closeSinks()
+	ndjsonOut.close()
+	recorder.close()
+	return
+}
+
+func startBulks(bulk *elastic.BulkProcessor) {
+	bulk.Start(context.Background())
+	for _, ib := range indexBulks {
+		ib.Start(context.Background())
+	}
+	bulkState.set(false)
+}
+
+func (g *bulkGate) set(stopped bool) {
+	g.lock.Lock()
+	g.stopped = stopped
+	g.lock.Unlock()
+}
+
+func (g *bulkGate) active() bool {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return !g.stopped
+}
+
+// flush flushes a bulk processor unless the bulk processors are stopped
+func (g *bulkGate) flush(bulk *elastic.BulkProcessor) bool {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	if g.stopped {
+		return false
+	}
+	bulk.Flush()
+	return true
+}
+
+// add adds the request unless the bulk processors are stopped.  The
+// processors cannot stop while a request is being added
+func (g *bulkGate) add(bulk *elastic.BulkProcessor, req elastic.BulkableRequest) bool {
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	if g.stopped {
+		return false
+	}
+	bulk.Add(req)
+	return true
+}
+
+func statsOf(bulk *elastic.BulkProcessor) monstacheStats {
+	stats := monstacheStats{
+		BulkProcessorStats:     bulkStatsOf(bulk),
+		UpdateConflictsDropped: atomic.LoadInt64(&updateConflictsDropped),
+		DocumentsTruncated:     atomic.LoadInt64(&documentsTruncated),
+		EventsCoalesced:        atomic.LoadInt64(&eventsCoalesced),
+		Secondary:              secondary.stats(),
+		Shadows:                shadowStatsOf(),
+	}
+	stats.Namespaces, stats.Indexes = docStats.snapshot()
+	return stats
+}
+
+func newDocumentStats() *documentStats {
+	return &documentStats{
+		namespaces: make(map[string]*documentCounts),
+		indexes:    make(map[string]*documentCounts),
+	}
+}
+
+func (c *documentCounts) add(action string) {
+	switch action {
+	case "indexed":
+		c.Indexed++
+	case "updated":
+		c.Updated++
+	case "deleted":
+		c.Deleted++
+	case "skipped":
+		c.Skipped++
+	case "failed":
+		c.Failed++
+	}
+}
+
+func countsFor(counts map[string]*documentCounts, key string) *documentCounts {
+	c := counts[key]
+	if c == nil {
+		c = &documentCounts{}
+		counts[key] = c
+	}
+	return c
+}
+
+func (ds *documentStats) count(action, namespace, index string) {
+	if ds == nil {
+		return
+	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	if namespace != "" {
+		countsFor(ds.namespaces, namespace).add(action)
+	}
+	if index != "" {
+		countsFor(ds.indexes, index).add(action)
+	}
+}
+
+// enqueue remembers the namespace of a request until its bulk response so
+// failures can be attributed to it
+func (ds *documentStats) enqueue(op *gtm.Op, req elastic.BulkableRequest) {
+	if ds == nil || op == nil {
+		return
+	}
+	ds.pending.Store(req, op.Namespace)
+}
+
+func (ds *documentStats) failed(req elastic.BulkableRequest, index string) {
+	if ds == nil {
+		return
+	}
+	var namespace string
+	if ns, ok := ds.pending.Load(req); ok {
+		namespace = ns.(string)
+	}
+	ds.count("failed", namespace, index)
+}
+
+func (ds *documentStats) done(requests []elastic.BulkableRequest) {
+	if ds == nil {
+		return
+	}
+	for _, req := range requests {
+		ds.pending.Delete(req)
+	}
+}
+
+func (ds *documentStats) snapshot() (namespaces, indexes map[string]documentCounts) {
+	if ds == nil {
+		return
+	}
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+	namespaces = make(map[string]documentCounts, len(ds.namespaces))
+	for ns, c := range ds.namespaces {
+		namespaces[ns] = *c
+	}
+	indexes = make(map[string]documentCounts, len(ds.indexes))
+	for index, c := range ds.indexes {
+		indexes[index] = *c
+	}
+	return
+}
+
+// recordDocument counts a document in the metrics and the stats
+func recordDocument(action string, op *gtm.Op, index string) {
+	metrics.document(action, op, index)
+	docStats.count(action, op.Namespace, index)
+}
+
+func recordBulkFailure(req elastic.BulkableRequest, index, class string) {
+	metrics.bulkFailed(index, class)
+	docStats.failed(req, index)
+}
+
+func newSyncStatusTracker(session *mgo.Session) *syncStatusTracker {
+	return &syncStatusTracker{
+		session:    session,
+		namespaces: make(map[string]*namespaceSyncStatus),
+		started:    make(map[*gtm.Op]bool),
+	}
+}
+
+func (t *syncStatusTracker) statusFor(namespace string) *namespaceSyncStatus {
+	st := t.namespaces[namespace]
+	if st == nil {
+		st = &namespaceSyncStatus{}
+		t.namespaces[namespace] = st
+	}
+	return st
+}
+
+// startEvent counts an event read for its namespace as pending
+func (t *syncStatusTracker) startEvent(op *gtm.Op) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	st := t.statusFor(op.Namespace)
+	st.Pending++
+	t.started[op] = true
+	if op.IsSourceDirect() {
+		if st.DirectRead == nil {
+			st.DirectRead = &directReadProgress{}
+			go t.estimate(op.Namespace)
+		}
+		st.DirectRead.Read++
+	}
+}
+
+// finishEvent records an event handed to the bulk processor or dropped
+func (t *syncStatusTracker) finishEvent(op *gtm.Op, err error) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.started[op] {
+		return
+	}
+	delete(t.started, op)
+	st := t.statusFor(op.Namespace)
+	st.Pending--
+	if err != nil {
+		st.LastError = err.Error()
+		st.LastErrorAt = time.Now().UTC().Format(time.RFC3339)
+	}
+	if op.IsSourceOplog() {
+		applied := time.Unix(int64(op.Timestamp>>32), 0)
+		st.LastAppliedTs = op.Timestamp
+		st.LastApplied = applied.UTC().Format(time.RFC3339)
+		st.LagSeconds = time.Since(applied).Seconds()
+	}
+}
+
+func (t *syncStatusTracker) failed(namespace, reason string) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	st := t.statusFor(namespace)
+	st.LastError = reason
+	st.LastErrorAt = time.Now().UTC().Format(time.RFC3339)
+}
+
+// enqueue records the failure of the bulk request of op
+func (t *syncStatusTracker) enqueue(op *gtm.Op, req elastic.BulkableRequest) {
+	if t == nil || op == nil {
+		return
+	}
+	ns := op.Namespace
+	onBulkItem(req, func(item *elastic.BulkResponseItem, err error) {
+		if err != nil {
+			t.failed(ns, err.Error())
+		} else if item != nil && item.Error != nil {
+			t.failed(ns, fmt.Sprintf("%s: %s", item.Error.Type, item.Error.Reason))
+		}
+	})
+}
+
+// estimate looks up the number of documents of a namespace from the
+// collection metadata once its direct read starts
+func (t *syncStatusTracker) estimate(namespace string) {
+	if t.session == nil {
+		return
+	}
+	parts := strings.SplitN(namespace, ".", 2)
+	if len(parts) != 2 {
+		return
+	}
+	s := t.session.Copy()
+	defer s.Close()
+	n, err := s.DB(parts[0]).C(parts[1]).Count()
+	if err != nil {
+		return
+	}
+	t.lock.Lock()
+	t.statusFor(namespace).DirectRead.EstimatedTotal = int64(n)
+	t.lock.Unlock()
+}
+
+func (t *syncStatusTracker) snapshot() map[string]namespaceSyncStatus {
+	namespaces := make(map[string]namespaceSyncStatus)
+	if t == nil {
+		return namespaces
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for ns, st := range t.namespaces {
+		c := *st
+		if st.DirectRead != nil {
+			dr := *st.DirectRead
+			c.DirectRead = &dr
+		}
+		namespaces[ns] = c
+	}
+	return namespaces
+}
+
+// bulkStatsOf sums the statistics of the default and per-index bulk processors
+func bulkStatsOf(bulk *elastic.BulkProcessor) elastic.BulkProcessorStats {
+	stats := bulk.Stats()
+	for _, ib := range indexBulks {
+		s := ib.Stats()
+		stats.Flushed += s.Flushed
+		stats.Committed += s.Committed
+		stats.Indexed += s.Indexed
+		stats.Created += s.Created
+		stats.Updated += s.Updated
+		stats.Deleted += s.Deleted
+		stats.Succeeded += s.Succeeded
+		stats.Failed += s.Failed
+		stats.Workers = append(stats.Workers, s.Workers...)
+	}
+	return stats
+}
+
+func (config *configOptions) newStatsBulkProcessor(client *elastic.Client) (bulk *elastic.BulkProcessor, err error) {
+	bulkService := client.BulkProcessor().Name("monstache-stats")
+	bulkService.Workers(1)
+	bulkService.Stats(false)
+	bulkService.BulkActions(-1)
+	bulkService.BulkSize(-1)
+	bulkService.After(afterBulkFor("monstache-stats", &bulk))
+	bulkService.FlushInterval(time.Duration(5) * time.Second)
+	bulk, err = bulkService.Do(context.Background())
+	return
+}
+
+// apiKeyHeader builds the Authorization header value for an API key given
+// either as id:key or in the already encoded base64 form
+func apiKeyHeader(key string) string {
+	key = strings.TrimSpace(key)
+	if strings.Contains(key, ":") {
+		key = base64.StdEncoding.EncodeToString([]byte(key))
+	}
+	return "ApiKey " + key
+}
+
+func isInlinePEM(value string) bool {
+	return strings.Contains(value, "-----BEGIN")
+}
+
+// readPEM returns PEM data given inline or read from the file it names
+func readPEM(value string) ([]byte, error) {
+	if isInlinePEM(value) {
+		return []byte(value), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+// pemName describes a PEM value in messages without its contents
+func pemName(value string) string {
+	if isInlinePEM(value) {
+		return "inline PEM"
+	}
+	return value
+}
+
+// start loads the certificate and watches it for changes
+func (c *clientCertificate) start() error {
+	if err := c.reload(); err != nil {
+		return err
+	}
+	go c.watch()
+	return nil
+}
+
+// reload loads the certificate again if the PEM data changed.  Rotated
+// secrets replace the configured values
+func (c *clientCertificate) reload() error {
+	certPEM, err := readPEM(secretValue(c.certOpt, c.cert))
+	if err != nil {
+		return err
+	}
+	keyPEM, err := readPEM(secretValue(c.keyOpt, c.key))
+	if err != nil {
+		return err
+	}
+	loaded := string(certPEM) + string(keyPEM)
+	c.lock.RLock()
+	unchanged := loaded == c.loaded
+	c.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	if pair.Leaf == nil {
+		if pair.Leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	c.lock.Lock()
+	first := c.current == nil
+	c.current, c.loaded = &pair, loaded
+	c.lock.Unlock()
+	if !first {
+		infoLog.Printf("Reloaded the %s client certificate", c.target)
+		if c.rotated != nil {
+			c.rotated(&pair)
+		}
+	}
+	return nil
+}
+
+func (c *clientCertificate) watch() {
+	for range time.Tick(10 * time.Second) {
+		if err := c.reload(); err != nil {
+			errorLog.Printf("Unable to reload %s client certificate: %s", c.target, err)
+		}
+	}
+}
+
+// get is the GetClientCertificate of the TLS config.  New connections
+// present the latest certificate loaded
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.current, nil
+}
+
+// start loads the CA bundle and watches it for changes
+func (p *certPool) start() error {
+	if err := p.reload(); err != nil {
+		return err
+	}
+	go p.watch()
+	return nil
+}
+
+// reload loads the CA bundle again if the PEM data changed.  A bundle
+// without certificates is only accepted at startup so that a partly written
+// file does not replace a working bundle
+func (p *certPool) reload() error {
+	name := p.source()
+	ca, err := readPEM(name)
+	if err != nil {
+		return err
+	}
+	p.lock.RLock()
+	first, unchanged := p.pool == nil, string(ca) == p.loaded
+	p.lock.RUnlock()
+	if unchanged && !first {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(ca); !ok {
+		if !first {
+			return fmt.Errorf("No certs parsed successfully from %s", pemName(name))
+		}
+		errorLog.Printf("No certs parsed successfully from %s", pemName(name))
+	}
+	p.lock.Lock()
+	p.pool, p.loaded = pool, string(ca)
+	p.lock.Unlock()
+	if !first {
+		infoLog.Printf("Reloaded the %s CA certificates", p.target)
+	}
+	return nil
+}
+
+func (p *certPool) watch() {
+	for range time.Tick(10 * time.Second) {
+		if err := p.reload(); err != nil {
+			errorLog.Printf("Unable to reload %s CA certificates: %s", p.target, err)
+		}
+	}
+}
+
+// apply makes a TLS config verify servers with the bundle.  Go only
+// verifies against a fixed pool so, unless verification is turned off, the
+// chain is verified by the config with the latest bundle loaded
+func (p *certPool) apply(tlsConfig *tls.Config) {
+	p.lock.RLock()
+	tlsConfig.RootCAs = p.pool
+	p.lock.RUnlock()
+	if tlsConfig.InsecureSkipVerify {
+		return
+	}
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyConnection = p.verify
+}
+
+// verify is the VerifyConnection of a TLS config
+func (p *certPool) verify(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("Server presented no certificate")
+	}
+	p.lock.RLock()
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         p.pool,
+		Intermediates: x509.NewCertPool(),
+	}
+	p.lock.RUnlock()
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// track adds a session to log in again when the credentials rotate
+func (r *mongoRotation) track(session *mgo.Session) {
+	r.lock.Lock()
+	r.sessions = append(r.sessions, session)
+	r.lock.Unlock()
+}
+
+// login logs the tracked sessions in with cred.  The reserved connections
+// are released first so that no connection is logged out under a query
+func (r *mongoRotation) login(cred *mgo.Credential) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.cred = cred
+	for _, session := range r.sessions {
+		session.Refresh()
+		session.LogoutAll()
+		if err := session.Login(cred); err != nil {
+			errorLog.Printf("Unable to log in to MongoDB with the rotated credentials: %s", err)
+		}
+	}
+}
+
+// rotateURL logs in with the user and password of a rotated connection URL
+func (r *mongoRotation) rotateURL(inURL string) {
+	parseURL, _ := splitDriverURLOptions(inURL)
+	dialInfo, err := mgo.ParseURL(parseURL)
+	if err != nil {
+		errorLog.Printf("Unable to parse the rotated MongoDB URL: %s", err)
+		return
+	}
+	if mongoDialInfo == nil || mongoAWS != nil || dialInfo.Username == "" {
+		warnLog.Println("MongoDB URL changed; restart monstache to apply it")
+		return
+	}
+	if dialInfo.Username == mongoDialInfo.Username && dialInfo.Password == mongoDialInfo.Password {
+		return
+	}
+	cred := &mgo.Credential{
+		Username:  dialInfo.Username,
+		Password:  dialInfo.Password,
+		Mechanism: dialInfo.Mechanism,
+		Source:    dialInfo.Source,
+	}
+	if cred.Source == "" {
+		cred.Source = dialInfo.Database
+	}
+	if cred.Source == "" {
+		cred.Source = "admin"
+	}
+	// shards dialed from now on copy the new credentials
+	mongoDialInfo.Username, mongoDialInfo.Password = dialInfo.Username, dialInfo.Password
+	r.login(cred)
+	infoLog.Printf("Logged in to MongoDB as %s with the rotated credentials", cred.Username)
+}
+
+// rotateCertificate logs in with a rotated X509 client certificate when its
+// subject, which is the user, changed
+func (r *mongoRotation) rotateCertificate(cert *tls.Certificate) {
+	r.lock.Lock()
+	cred := r.cred
+	r.lock.Unlock()
+	if cred != nil && cred.Certificate != nil && bytes.Equal(cred.Certificate.RawSubject, cert.Leaf.RawSubject) {
+		return
+	}
+	r.login(&mgo.Credential{Mechanism: "MONGODB-X509", Certificate: cert.Leaf})
+}
+
+func newAPIKeyTransport(config *configOptions, transport http.RoundTripper) (*apiKeyTransport, error) {
+	t := &apiKeyTransport{
+		transport: transport,
+		path:      config.ElasticAPIKeyFile,
+	}
+	if t.path == "" {
+		t.header = apiKeyHeader(config.ElasticAPIKey)
+		return t, nil
+	}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	go t.watch()
+	return t, nil
+}
+
+func (t *apiKeyTransport) reload() error {
+	info, err := os.Stat(t.path)
+	if err != nil {
+		return err
+	}
+	t.lock.RLock()
+	unchanged := info.ModTime().Equal(t.modTime)
+	t.lock.RUnlock()
+	if unchanged {
+		return nil
+	}
+	b, err := ioutil.ReadFile(t.path)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(b)) == 0 {
+		return fmt.Errorf("API key file %s is empty", t.path)
+	}
+	t.lock.Lock()
+	t.header = apiKeyHeader(string(b))
+	t.modTime = info.ModTime()
+	t.lock.Unlock()
+	return nil
+}
+
+func (t *apiKeyTransport) watch() {
+	for range time.Tick(10 * time.Second) {
+		if err := t.reload(); err != nil {
+			errorLog.Printf("Unable to reload Elasticsearch API key from %s: %s", t.path, err)
+		}
+	}
+}
+
+func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.lock.RLock()
+	header := t.header
+	t.lock.RUnlock()
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", header)
+	return t.transport.RoundTrip(r)
+}
+
+// secret is a config option whose value is a reference to a secret held in
+// Vault (vault:path#key) or AWS Secrets Manager (aws-sm:name or
+// aws-sm:name#key).  The resolved value replaces the reference in the config
+// and is refreshed every secret-refresh-seconds
+type secret struct {
+	ref   string
+	value string
+}
+
+// liveSecretOptions are applied to new requests when the secret changes.
+// Other options are only read at startup and require a restart
+var liveSecretOptions = map[string]bool{
+	"elasticsearch-user":               true,
+	"elasticsearch-password":           true,
+	"elasticsearch-api-key":            true,
+	"secondary-elasticsearch-user":     true,
+	"secondary-elasticsearch-password": true,
+	"secondary-elasticsearch-api-key":  true,
+	"pprof-password":                   true,
+	"admin-password":                   true,
+	"elasticsearch-client-cert":        true,
+	"elasticsearch-client-key":         true,
+	"elasticsearch-pem-file":           true,
+	"mongo-url":                        true,
+}
+
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, "vault:") || strings.HasPrefix(value, "aws-sm:")
+}
+
+// secretOptions returns the credential options which may reference a secret
+func (config *configOptions) secretOptions() map[string]*string {
+	opts := map[string]*string{
+		"mongo-url":                        &config.MongoURL,
+		"mongo-config-url":                 &config.MongoConfigURL,
+		"elasticsearch-user":               &config.ElasticUser,
+		"elasticsearch-password":           &config.ElasticPassword,
+		"elasticsearch-api-key":            &config.ElasticAPIKey,
+		"secondary-elasticsearch-user":     &config.SecondaryElasticUser,
+		"secondary-elasticsearch-password": &config.SecondaryElasticPassword,
+		"secondary-elasticsearch-api-key":  &config.SecondaryElasticAPIKey,
+		"pprof-password":                   &config.PprofPassword,
+		"admin-password":                   &config.AdminPassword,
+		"elasticsearch-pem-file":           &config.ElasticPemFile,
+		"elasticsearch-client-cert":        &config.ElasticClientCert,
+		"elasticsearch-client-key":         &config.ElasticClientKey,
+		"aws-connect.access-key":           &config.AWSConnect.AccessKey,
+		"aws-connect.secret-key":           &config.AWSConnect.SecretKey,
+		"mongo-kerberos-settings.password": &config.MongoKerberosSettings.Password,
+		"csfle.local-master-key":           &config.CSFLE.LocalMasterKey,
+		"csfle.aws-secret-key":             &config.CSFLE.AWSSecretKey,
+	}
+	if config.KafkaSink != nil {
+		opts["kafka-sink.password"] = &config.KafkaSink.Password
+	}
+	if config.RedisSink != nil {
+		opts["redis-sink.password"] = &config.RedisSink.Password
+	}
+	if config.NotificationSink != nil {
+		opts["notification-sink.access-key"] = &config.NotificationSink.AccessKey
+		opts["notification-sink.secret-key"] = &config.NotificationSink.SecretKey
+	}
+	if config.WebhookSink != nil {
+		opts["webhook-sink.secret"] = &config.WebhookSink.Secret
+	}
+	if config.ArchiveSink != nil {
+		opts["archive-sink.access-key"] = &config.ArchiveSink.AccessKey
+		opts["archive-sink.secret-key"] = &config.ArchiveSink.SecretKey
+	}
+	if config.OffloadStore != nil {
+		opts["offload-store.access-key"] = &config.OffloadStore.AccessKey
+		opts["offload-store.secret-key"] = &config.OffloadStore.SecretKey
+	}
+	if config.MeilisearchSink != nil {
+		opts["meilisearch-sink.api-key"] = &config.MeilisearchSink.APIKey
+	}
+	if config.TypesenseSink != nil {
+		opts["typesense-sink.api-key"] = &config.TypesenseSink.APIKey
+	}
+	if config.PostgresSink != nil {
+		opts["postgres-sink.url"] = &config.PostgresSink.URL
+	}
+	if config.NATSSink != nil {
+		opts["nats-sink.url"] = &config.NATSSink.URL
+		opts["nats-sink.password"] = &config.NATSSink.Password
+		opts["nats-sink.token"] = &config.NATSSink.Token
+	}
+	for i, e := range config.Embedding {
+		opts[fmt.Sprintf("embedding.%d.api-key", i)] = &e.APIKey
+	}
+	for i := range config.HTTPCredentials {
+		opts[fmt.Sprintf("http-credential.%d.password", i)] = &config.HTTPCredentials[i].Password
+		opts[fmt.Sprintf("http-credential.%d.token", i)] = &config.HTTPCredentials[i].Token
+	}
+	return opts
+}
+
+// resolveSecrets replaces secret references in the credential options with
+// their values
+func (config *configOptions) resolveSecrets() error {
+	for name, target := range config.secretOptions() {
+		if !isSecretRef(*target) {
+			continue
+		}
+		value, err := config.resolveSecret(*target)
+		if err != nil {
+			return fmt.Errorf("Unable to resolve secret for %s: %s", name, err)
+		}
+		secretsLock.Lock()
+		secrets[name] = &secret{ref: *target, value: value}
+		secretsLock.Unlock()
+		*target = value
+	}
+	return nil
+}
+
+// refreshSecrets periodically resolves the secrets again
+func (config *configOptions) refreshSecrets() {
+	for range time.Tick(time.Duration(config.SecretRefreshSeconds) * time.Second) {
+		secretsLock.RLock()
+		refs := make(map[string]string, len(secrets))
+		for name, s := range secrets {
+			refs[name] = s.ref
+		}
+		secretsLock.RUnlock()
+		for name, ref := range refs {
+			value, err := config.resolveSecret(ref)
+			if err != nil {
+				errorLog.Printf("Unable to refresh secret for %s: %s", name, err)
+				continue
+			}
+			secretsLock.Lock()
+			s := secrets[name]
+			changed := s.value != value
+			s.value = value
+			secretsLock.Unlock()
+			if !changed {
+				continue
+			}
+			if name == "mongo-url" {
+				mongoLogins.rotateURL(value)
+			}
+			if liveSecretOptions[name] || strings.HasPrefix(name, "http-credential.") {
+				infoLog.Printf("Secret for %s changed and was applied", name)
+			} else {
+				warnLog.Printf("Secret for %s changed; restart monstache to apply it", name)
+			}
+		}
+	}
+}
+
+// secretValue returns the current value of the secret referenced by the
+// option or def if the option is not a secret
+func secretValue(name string, def string) string {
+	secretsLock.RLock()
+	defer secretsLock.RUnlock()
+	if s := secrets[name]; s != nil {
+		return s.value
+	}
+	return def
+}
+
+func hasSecret(names ...string) bool {
+	secretsLock.RLock()
+	defer secretsLock.RUnlock()
+	for _, name := range names {
+		if secrets[name] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (config *configOptions) resolveSecret(ref string) (string, error) {
+	if strings.HasPrefix(ref, "vault:") {
+		return vaultSecret(strings.TrimPrefix(ref, "vault:"))
+	}
+	return config.awsSecret(strings.TrimPrefix(ref, "aws-sm:"))
+}
+
+func splitSecretKey(ref string) (name string, key string) {
+	name = ref
+	if i := strings.LastIndex(ref, "#"); i != -1 {
+		name, key = ref[:i], ref[i+1:]
+	}
+	return
+}
+
+func secretField(data map[string]interface{}, key string) (string, error) {
+	v, ok := data[key]
+	if !ok {
+		return "", fmt.Errorf("Key %s not found", key)
+	}
+	switch value := v.(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	default:
+		return fmt.Sprintf("%v", value), nil
+	}
+}
+
+// vaultSecret reads a key from a KV secret using the VAULT_ADDR, VAULT_TOKEN
+// and optional VAULT_NAMESPACE environment variables.  Both version 1 and
+// version 2 of the KV engine are supported.  For version 2 the path includes
+// the data segment, e.g. vault:secret/data/monstache#password
+func vaultSecret(ref string) (string, error) {
+	path, key := splitSecretKey(ref)
+	if key == "" {
+		return "", fmt.Errorf("Vault secret %s must include a #key", path)
+	}
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	url := strings.TrimSuffix(addr, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("Vault returned %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	var body struct {
+		Data map[string]interface{}
+	}
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err = dec.Decode(&body); err != nil {
+		return "", err
+	}
+	data := body.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		data = inner
+	}
+	return secretField(data, key)
+}
+
+// awsSecret reads a secret string from AWS Secrets Manager.  When a #key is
+// given the secret string is parsed as JSON and the key is returned
+func (config *configOptions) awsSecret(ref string) (string, error) {
+	name, key := splitSecretKey(ref)
+	if secretsManager == nil {
+		cfg := &aws.Config{}
+		if config.AWSConnect.Region != "" {
+			cfg.Region = aws.String(config.AWSConnect.Region)
+		}
+		if config.AWSConnect.AccessKey != "" && !isSecretRef(config.AWSConnect.AccessKey) {
+			cfg.Credentials = config.AWSConnect.credentials()
+		}
+		sess, err := session.NewSession(cfg)
+		if err != nil {
+			return "", err
+		}
+		secretsManager = secretsmanager.New(sess)
+	}
+	out, err := secretsManager.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return "", err
+	}
+	value := aws.StringValue(out.SecretString)
+	if key == "" {
+		return value, nil
+	}
+	var data map[string]interface{}
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+	if err = dec.Decode(&data); err != nil {
+		return "", fmt.Errorf("Secret %s is not JSON: %s", name, err)
+	}
+	return secretField(data, key)
+}
+
+// secretAuthTransport sets the Elasticsearch credentials from the current
+// value of their secrets so that rotated credentials apply without a restart
+type secretAuthTransport struct {
+	transport http.RoundTripper
+	prefix    string
+	user      string
+	password  string
+	apiKey    string
+}
+
+func (t *secretAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	apiKey := secretValue(t.prefix+"elasticsearch-api-key", t.apiKey)
+	user := secretValue(t.prefix+"elasticsearch-user", t.user)
+	password := secretValue(t.prefix+"elasticsearch-password", t.password)
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	if apiKey != "" {
+		r.Header.Set("Authorization", apiKeyHeader(apiKey))
+	} else if user != "" {
+		r.SetBasicAuth(user, password)
+	}
+	return t.transport.RoundTrip(r)
+}
+
+func (t *gzipTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body == nil || req.Header.Get("Content-Encoding") != "" {
+		return t.transport.RoundTrip(req)
+	}
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, t.level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(w, req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err = w.Close(); err != nil {
+		return nil, err
+	}
+	compressed := buf.Bytes()
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Content-Encoding", "gzip")
+	r.ContentLength = int64(len(compressed))
+	r.Body = ioutil.NopCloser(bytes.NewReader(compressed))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(compressed)), nil
+	}
+	return t.transport.RoundTrip(r)
+}
+
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !verbose() {
+		return t.transport.RoundTrip(req)
+	}
+	if out, err := httputil.DumpRequestOut(req, true); err == nil {
+		traceLog.Printf("%s\n", out)
+	}
+	resp, err := t.transport.RoundTrip(req)
+	if err == nil {
+		if out, err := httputil.DumpResponse(resp, true); err == nil {
+			traceLog.Printf("%s\n", out)
+		}
+	}
+	return resp, err
+}
+
+func (t *bulkSplitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "POST" || !strings.HasSuffix(req.URL.Path, "/_bulk") ||
+		req.Body == nil || req.Header.Get("Content-Encoding") != "" {
+		return t.transport.RoundTrip(req)
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusRequestEntityTooLarge {
+		return resp, err
+	}
+	resp.Body.Close()
+	actions, err := parseBulkActions(body)
+	if err != nil {
+		return nil, err
+	}
+	split, err := t.bisect(req, actions)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(split)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         resp.Proto,
+		ProtoMajor:    resp.ProtoMajor,
+		ProtoMinor:    resp.ProtoMinor,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader(b)),
+		ContentLength: int64(len(b)),
+		Request:       req,
+	}, nil
+}
+
+// bisect sends each half of actions.  The items of an action which is too
+// large on its own are answered with 413
+func (t *bulkSplitTransport) bisect(req *http.Request, actions []*bulkAction) (*bulkSplitResponse, error) {
+	if len(actions) == 1 {
+		errorLog.Printf("Bulk request is too large to index: %s", actions[0].lines[0])
+		return failedBulkActions(actions, http.StatusRequestEntityTooLarge, "request_entity_too_large", "request entity too large"), nil
+	}
+	split := &bulkSplitResponse{}
+	mid := len(actions) / 2
+	for _, half := range [][]*bulkAction{actions[:mid], actions[mid:]} {
+		result, err := t.send(req, half)
+		if err != nil {
+			return nil, err
+		}
+		split.Took += result.Took
+		split.Errors = split.Errors || result.Errors
+		split.Items = append(split.Items, result.Items...)
+	}
+	return split, nil
+}
+
+func (t *bulkSplitTransport) send(req *http.Request, actions []*bulkAction) (*bulkSplitResponse, error) {
+	var body bytes.Buffer
+	for _, action := range actions {
+		for _, line := range action.lines {
+			body.Write(line)
+			body.WriteByte('\n')
+		}
+	}
+	half := req.Clone(req.Context())
+	half.Body = ioutil.NopCloser(bytes.NewReader(body.Bytes()))
+	half.ContentLength = int64(body.Len())
+	resp, err := t.transport.RoundTrip(half)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return t.bisect(req, actions)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		// every action of the half failed with the status of the request
+		return failedBulkActions(actions, resp.StatusCode, "http_status_error", string(b)), nil
+	}
+	result := &bulkSplitResponse{}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	if err = decoder.Decode(result); err != nil {
+		return nil, err
+	}
+	if len(result.Items) != len(actions) {
+		return nil, fmt.Errorf("Bulk response has %d items for %d actions", len(result.Items), len(actions))
+	}
+	return result, nil
+}
+
+// parseBulkActions splits the body of a bulk request into its actions.  All
+// actions but delete are followed by a source line
+func parseBulkActions(body []byte) (actions []*bulkAction, err error) {
+	lines := bytes.Split(bytes.TrimRight(body, "\n"), []byte("\n"))
+	for i := 0; i < len(lines); i++ {
+		var action map[string]map[string]interface{}
+		if err = json.Unmarshal(lines[i], &action); err != nil {
+			return nil, fmt.Errorf("Unable to parse bulk action: %s", err)
+		}
+		ba := &bulkAction{lines: [][]byte{lines[i]}}
+		for op, meta := range action {
+			ba.op, ba.meta = op, meta
+		}
+		if ba.op != "delete" {
+			if i++; i == len(lines) {
+				return nil, fmt.Errorf("Bulk action %s has no source", lines[i-1])
+			}
+			ba.lines = append(ba.lines, lines[i])
+		}
+		actions = append(actions, ba)
+	}
+	return
+}
+
+// failedBulkActions answers each action with a failed bulk response item
+func failedBulkActions(actions []*bulkAction, status int, errorType, reason string) *bulkSplitResponse {
+	failed := &bulkSplitResponse{Errors: true}
+	for _, ba := range actions {
+		item := map[string]interface{}{
+			"status": status,
+			"error":  map[string]interface{}{"type": errorType, "reason": reason},
+		}
+		for _, key := range []string{"_index", "_type", "_id"} {
+			if v, ok := ba.meta[key]; ok {
+				item[key] = v
+			}
+		}
+		failed.Items = append(failed.Items, map[string]map[string]interface{}{ba.op: item})
+	}
+	return failed
+}
+
+func (vl verboseLogger) Printf(format string, v ...interface{}) {
+	if verbose() {
+		vl.logger.Printf(format, v...)
+	}
+}
+
+func verbose() bool {
+	return atomic.LoadInt32(&verboseLogs) == 1
+}
+
+func setVerbose(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&verboseLogs, v)
+}
+
+func (config *configOptions) needsSecureScheme() bool {
+	if len(config.ElasticUrls) > 0 {
+		for _, url := range config.ElasticUrls {
+			if strings.HasPrefix(url, "https") {
+				return true
+			}
+		}
+	}
+	return false
+
+}
+
+func (config *configOptions) newElasticClient() (client *elastic.Client, err error) {
+	var clientOptions []elastic.ClientOptionFunc
+	var httpClient *http.Client
+	clientOptions = append(clientOptions, elastic.SetSniff(false))
+	if config.needsSecureScheme() {
+		clientOptions = append(clientOptions, elastic.SetScheme("https"))
+	}
+	if len(config.ElasticUrls) > 0 {
+		clientOptions = append(clientOptions, elastic.SetURL(config.ElasticUrls...))
+	} else {
+		config.ElasticUrls = append(config.ElasticUrls, elastic.DefaultURL)
+	}
+	// verbose logging may be switched on later so the error log is always
+	// set and requests are traced by the transport
+	clientOptions = append(clientOptions, elastic.SetErrorLog(verboseLogger{errorLog}))
+	if config.ElasticUser != "" {
+		clientOptions = append(clientOptions, elastic.SetBasicAuth(config.ElasticUser, config.ElasticPassword))
+	}
+	if config.ElasticRetry {
+		d1, d2 := time.Duration(50)*time.Millisecond, time.Duration(20)*time.Second
+		retrier := elastic.NewBackoffRetrier(elastic.NewExponentialBackoff(d1, d2))
+		clientOptions = append(clientOptions, elastic.SetRetrier(retrier))
+	}
+	httpClient, err = config.NewHTTPClient()
+	if err != nil {
+		return client, err
+	}
+	httpClient.Transport = &bulkSplitTransport{transport: &traceTransport{transport: httpClient.Transport}}
+	clientOptions = append(clientOptions, elastic.SetHttpClient(httpClient))
+	if config.AWSConnect.serverless() || config.DisableElasticsearch {
+		// serverless collections do not serve the root endpoint used by health checks
+		clientOptions = append(clientOptions, elastic.SetHealthcheck(false))
+	}
+	clientOptions = append(clientOptions,
+		elastic.SetHealthcheckTimeoutStartup(time.Duration(config.ElasticHealth0)*time.Second))
+	clientOptions = append(clientOptions,
+		elastic.SetHealthcheckTimeout(time.Duration(config.ElasticHealth1)*time.Second))
+	return elastic.NewClient(clientOptions...)
+}
+
+// cloudIDURL decodes the Elasticsearch endpoint of an Elastic Cloud ID.  The
+// ID is name:base64(host[:port]$es-uuid$kibana-uuid)
+func cloudIDURL(cloudID string) (string, error) {
+	parts := strings.SplitN(cloudID, ":", 2)
+	encoded := parts[len(parts)-1]
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		if decoded, err = base64.URLEncoding.DecodeString(encoded); err != nil {
+			return "", fmt.Errorf("Unable to decode Elastic Cloud ID: %s", err)
+		}
+	}
+	segs := strings.Split(string(decoded), "$")
+	if len(segs) < 2 || segs[0] == "" || segs[1] == "" {
+		return "", errors.New("Elastic Cloud ID must contain a host and an Elasticsearch UUID")
+	}
+	host, port := segs[0], "443"
+	if i := strings.LastIndex(host, ":"); i != -1 {
+		host, port = host[:i], host[i+1:]
+	}
+	return fmt.Sprintf("https://%s.%s:%s", segs[1], host, port), nil
+}
+
+func (config *configOptions) testElasticsearchConn(client *elastic.Client) (err error) {
+	var number string
+	var openSearch bool
+	var resp *elastic.Response
+	resp, err = client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   "/",
+	})
+	if err != nil {
+		return
+	}
+	if number, openSearch, err = parseServerInfo(resp.Body); err != nil {
+		return
+	}
+	if openSearch {
+		config.OpenSearch = true
+		infoLog.Printf("Successfully connected to OpenSearch version %s", number)
+	} else {
+		if config.OpenSearch {
+			return fmt.Errorf("OpenSearch was configured but the server reports Elasticsearch version %s", number)
+		}
+		infoLog.Printf("Successfully connected to Elasticsearch version %s", number)
+	}
+	err = config.parseServerVersion(number)
+	return
+}
+
+func deleteIndexes(client *elastic.Client, db string, config *configOptions) (err error) {
+	var indices = []string{strings.ToLower(db + ".*")}
+	for ns, m := range mapIndexTypes {
+		dbCol := strings.SplitN(ns, ".", 2)
+		if dbCol[0] == db && m.Index != "" {
+			index := strings.ToLower(m.Index)
+			for _, cur := range indices {
+				if cur == index {
+					index = ""
+					break
+				}
+			}
+			if index != "" {
+				indices = append(indices, index)
+			}
+		}
+	}
+	_, err = client.DeleteIndex(indices...).Do(context.Background())
+	return
+}
+
+func deleteIndex(client *elastic.Client, namespace string, config *configOptions) (err error) {
+	ctx := context.Background()
+	index := strings.ToLower(namespace)
+	if m := mapIndexTypes[namespace]; m != nil {
+		if m.Index != "" {
+			index = strings.ToLower(m.Index)
+		}
+	}
+	_, err = client.DeleteIndex(index).Do(ctx)
+	return err
+}
+
+func ensureFileMapping(client *elastic.Client, config *configOptions) (err error) {
+	ctx := context.Background()
+	processor := map[string]interface{}{
+		"attachment": map[string]interface{}{
+			"field": "file",
+		},
+	}
+	if config.FileChunkBytes > 0 {
+		// each chunk of the file is extracted into its own attachment
+		processor = map[string]interface{}{
+			"foreach": map[string]interface{}{
+				"field": "file",
+				"processor": map[string]interface{}{
+					"attachment": map[string]interface{}{
+						"field":        "_ingest._value.data",
+						"target_field": "_ingest._value.attachment",
+					},
+				},
+			},
+		}
+	}
+	pipeline := map[string]interface{}{
+		"description": "Extract file information",
+		"processors":  [1]map[string]interface{}{processor},
+	}
+	_, err = client.IngestPutPipeline("attachment").BodyJson(pipeline).Do(ctx)
+	return err
+}
+
+// inferFieldMapping returns the Elasticsearch mapping for a sampled value.
+// Values of documents already converted for JSON are recognized as well
+func inferFieldMapping(val interface{}) map[string]interface{} {
+	switch v := val.(type) {
+	case time.Time, monstachemap.Time, bson.MongoTimestamp:
+		return map[string]interface{}{"type": "date"}
+	case bool:
+		return map[string]interface{}{"type": "boolean"}
+	case int, int32, int64:
+		return map[string]interface{}{"type": "long"}
+	case float32, float64, bson.Decimal128, monstachemap.Decimal128:
+		return map[string]interface{}{"type": "double"}
+	case bson.ObjectId, bson.Binary, monstachemap.Binary:
+		return map[string]interface{}{"type": "keyword"}
+	case string:
+		if _, err := time.Parse(time.RFC3339, v); err == nil {
+			return map[string]interface{}{"type": "date"}
+		}
+		if len(v) <= 256 && !strings.ContainsAny(v, " \t\n") {
+			return map[string]interface{}{"type": "keyword"}
+		}
+		return map[string]interface{}{
+			"type": "text",
+			"fields": map[string]interface{}{
+				"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256},
+			},
+		}
+	case map[string]interface{}:
+		if t, ok := v["type"].(string); ok && v["coordinates"] != nil {
+			if t == "Point" {
+				return map[string]interface{}{"type": "geo_point"}
+			}
+			return map[string]interface{}{"type": "geo_shape"}
+		}
+		_, lat := v["lat"].(float64)
+		_, lon := v["lon"].(float64)
+		if lat && lon && len(v) == 2 {
+			return map[string]interface{}{"type": "geo_point"}
+		}
+		return map[string]interface{}{"properties": inferProperties(v, nil)}
+	case []interface{}:
+		var m map[string]interface{}
+		for _, elem := range v {
+			m = mergeFieldMapping(m, inferFieldMapping(elem))
+		}
+		return m
+	}
+	return nil
+}
+
+// mergeFieldMapping combines the mappings inferred from different documents.
+// Numbers widen to double, anything mixed with text becomes text and other
+// conflicts fall back to keyword
+func mergeFieldMapping(a, b map[string]interface{}) map[string]interface{} {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	ap, aObj := a["properties"].(map[string]interface{})
+	bp, bObj := b["properties"].(map[string]interface{})
+	if aObj && bObj {
+		for k, v := range bp {
+			ap[k] = mergeFieldMapping(asMapping(ap[k]), asMapping(v))
+		}
+		return a
+	}
+	at, bt := a["type"], b["type"]
+	switch {
+	case at == bt:
+		return a
+	case at == "text":
+		return a
+	case bt == "text":
+		return b
+	case (at == "long" || at == "double") && (bt == "long" || bt == "double"):
+		return map[string]interface{}{"type": "double"}
+	}
+	return map[string]interface{}{"type": "keyword"}
+}
+
+func asMapping(v interface{}) map[string]interface{} {
+	m, _ := v.(map[string]interface{})
+	return m
+}
+
+func inferProperties(doc map[string]interface{}, props map[string]interface{}) map[string]interface{} {
+	if props == nil {
+		props = make(map[string]interface{})
+	}
+	for k, v := range doc {
+		if k == "_id" || k == "_meta_monstache" {
+			continue
+		}
+		if m := mergeFieldMapping(asMapping(props[k]), inferFieldMapping(v)); m != nil {
+			props[k] = m
+		}
+	}
+	return props
+}
+
+// ensureSampledMappings creates the index of each sampled namespace with a
+// mapping inferred from a random sample of its documents.  Existing indexes
+// are left alone
+func ensureSampledMappings(mongo *mgo.Session, client *elastic.Client, config *configOptions) error {
+	session := mongo.Copy()
+	defer session.Close()
+	ctx := context.Background()
+	for _, ns := range config.SampleMappingNamespaces {
+		indexType := mapIndexType(config, &gtm.Op{Namespace: ns})
+		exists, err := client.IndexExists(indexType.Index).Do(ctx)
+		if err != nil {
+			return fmt.Errorf("Unable to check index %s: %s", indexType.Index, err)
+		}
+		if exists {
+			continue
+		}
+		parts := strings.SplitN(ns, ".", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid sample mapping namespace %s", ns)
+		}
+		var props map[string]interface{}
+		var doc map[string]interface{}
+		pipe := []bson.M{{"$sample": bson.M{"size": config.MappingSampleSize}}}
+		iter := session.DB(parts[0]).C(parts[1]).Pipe(pipe).Iter()
+		for iter.Next(&doc) {
+			props = inferProperties(doc, props)
+			doc = nil
+		}
+		if err = iter.Close(); err != nil {
+			return fmt.Errorf("Unable to sample namespace %s: %s", ns, err)
+		}
+		var mappings interface{} = map[string]interface{}{"properties": props}
+		if indexType.Type != "" && !config.useTypelessAPI() && config.ElasticMajorVersion < 7 {
+			mappings = map[string]interface{}{indexType.Type: mappings}
+		}
+		_, err = client.CreateIndex(indexType.Index).BodyJson(map[string]interface{}{
+			"mappings": mappings,
+		}).Do(ctx)
+		if err != nil {
+			return fmt.Errorf("Unable to create index %s with sampled mapping: %s", indexType.Index, err)
+		}
+		infoLog.Printf("Created index %s with a mapping sampled from %s", indexType.Index, ns)
+	}
+	return nil
+}
+
+// ensureRuntimeFields installs runtime fields into the mapping of existing
+// indexes.  New indexes receive them through the index template
+func ensureRuntimeFields(client *elastic.Client, config *configOptions) error {
+	if len(runtimeFields) == 0 {
+		return nil
+	}
+	if config.ElasticMajorVersion < 7 || (config.ElasticMajorVersion == 7 && config.ElasticMinorVersion < 11) {
+		return errors.New("Runtime fields require Elasticsearch 7.11 or later")
+	}
+	ctx := context.Background()
+	for ns, fields := range runtimeFields {
+		index := indexPattern(mapIndexType(config, &gtm.Op{Namespace: ns}).Index)
+		exists, err := client.IndexExists(index).Do(ctx)
+		if err != nil {
+			return fmt.Errorf("Unable to check index %s: %s", index, err)
+		}
+		if !exists {
+			continue
+		}
+		_, err = client.PerformRequest(ctx, elastic.PerformRequestOptions{
+			Method: "PUT",
+			Path:   "/" + url.PathEscape(index) + "/_mapping",
+			Body:   map[string]interface{}{"runtime": fields},
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to put runtime fields for namespace %s: %s", ns, err)
+		}
+		infoLog.Printf("Installed %d runtime fields into index %s", len(fields), index)
+	}
+	return nil
+}
+
+func ensureIngestPipelines(client *elastic.Client) error {
+	installed := make(map[string]bool)
+	for _, pipeline := range ingestPipelines {
+		// chained pipelines are installed before the pipelines calling them
+		for _, ip := range []*ingestPipeline{pipeline.chained, pipeline} {
+			if ip == nil || ip.definition == nil || installed[ip.Name] {
+				continue
+			}
+			if _, err := client.IngestPutPipeline(ip.Name).BodyJson(ip.definition).Do(context.Background()); err != nil {
+				return fmt.Errorf("Unable to put ingest pipeline %s for namespace %s: %s", ip.Name, ip.Namespace, err)
+			}
+			installed[ip.Name] = true
+			infoLog.Printf("Installed ingest pipeline %s", ip.Name)
+		}
+	}
+	return nil
+}
+
+func (ro *rollover) conditions() map[string]interface{} {
+	conditions := make(map[string]interface{})
+	if ro.MaxAge != "" {
+		conditions["max_age"] = ro.MaxAge
+	}
+	if ro.MaxDocs > 0 {
+		conditions["max_docs"] = ro.MaxDocs
+	}
+	if ro.MaxSize != "" {
+		conditions["max_size"] = ro.MaxSize
+	}
+	return conditions
+}
+
+// ensureAlias creates the first index behind a rollover alias unless the
+// alias already exists
+func (ro *rollover) ensureAlias(client *elastic.Client, config *configOptions, alias string) (err error) {
+	ctx := context.Background()
+	resp, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method:       "HEAD",
+		Path:         "/_alias/" + url.PathEscape(alias),
+		IgnoreErrors: []int{404},
+	})
+	if err != nil || resp.StatusCode == 200 {
+		return
+	}
+	exists, err := client.IndexExists(alias).Do(ctx)
+	if err != nil {
+		return
+	}
+	if exists {
+		return fmt.Errorf("Index %s exists and is not a rollover alias", alias)
+	}
+	aliasBody := map[string]interface{}{}
+	if config.ElasticMajorVersion > 6 || (config.ElasticMajorVersion == 6 && config.ElasticMinorVersion >= 4) {
+		aliasBody["is_write_index"] = true
+	}
+	_, err = client.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   "/" + url.PathEscape(alias+"-000001"),
+		Body: map[string]interface{}{
+			"aliases": map[string]interface{}{alias: aliasBody},
+		},
+	})
+	if err == nil {
+		infoLog.Printf("Created index %s-000001 for rollover alias %s", alias, alias)
+	}
+	return
+}
+
+func (ro *rollover) run(client *elastic.Client, alias string) {
+	ticker := time.NewTicker(time.Duration(ro.CheckSeconds) * time.Second)
+	defer ticker.Stop()
+	body := map[string]interface{}{"conditions": ro.conditions()}
+	for range ticker.C {
+		resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+			Method: "POST",
+			Path:   "/" + url.PathEscape(alias) + "/_rollover",
+			Body:   body,
+		})
+		if err != nil {
+			errorLog.Printf("Unable to rollover alias %s: %s", alias, err)
+			continue
+		}
+		var result struct {
+			RolledOver bool   `json:"rolled_over"`
+			NewIndex   string `json:"new_index"`
+		}
+		if err = json.Unmarshal(resp.Body, &result); err == nil && result.RolledOver {
+			infoLog.Printf("Rolled over alias %s to index %s", alias, result.NewIndex)
+		}
+	}
+}
+
+func startRollovers(client *elastic.Client, config *configOptions) error {
+	for _, ro := range rollovers {
+		alias := mapIndexType(config, &gtm.Op{Namespace: ro.Namespace}).Index
+		if err := ro.ensureAlias(client, config, alias); err != nil {
+			return fmt.Errorf("Unable to set up rollover for namespace %s: %s", ro.Namespace, err)
+		}
+		go ro.run(client, alias)
+	}
+	return nil
+}
+
+func (config *configOptions) useComposableTemplates() bool {
+	if config.ElasticMajorVersion > 7 {
+		return true
+	}
+	return config.ElasticMajorVersion == 7 && config.ElasticMinorVersion >= 8
+}
+
+func (it *indexTemplate) indexName() string {
+	if m := mapIndexTypes[it.Namespace]; m != nil && m.Index != "" {
+		return indexPattern(m.Index)
+	}
+	return strings.ToLower(it.Namespace)
+}
+
+func (it *indexTemplate) templateName() string {
+	return "monstache-" + strings.Replace(it.indexName(), "*", "", -1)
+}
+
+func (it *indexTemplate) body(config *configOptions) (body map[string]interface{}, err error) {
+	tpl := map[string]interface{}{}
+	if len(it.Settings) > 0 {
+		tpl["settings"] = it.Settings
+	}
+	if len(it.Mappings) > 0 {
+		tpl["mappings"] = it.Mappings
+	}
+	var b []byte
+	if b, err = json.Marshal(tpl); err != nil {
+		return
+	}
+	h := fnv.New32a()
+	h.Write(b)
+	version := int(h.Sum32() & math.MaxInt32)
+	body = map[string]interface{}{
+		"index_patterns": it.IndexPatterns,
+		"version":        version,
+	}
+	if config.useComposableTemplates() {
+		body["template"] = tpl
+		body["priority"] = it.Priority
+		body["_meta"] = map[string]interface{}{
+			"managed_by": "monstache",
+			"namespace":  it.Namespace,
+		}
+	} else {
+		for k, v := range tpl {
+			body[k] = v
+		}
+		body["order"] = it.Priority
+	}
+	return
+}
+
+func (it *indexTemplate) currentVersion(client *elastic.Client, path string) (exists bool, version int, err error) {
+	var resp *elastic.Response
+	resp, err = client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method:       "GET",
+		Path:         path,
+		IgnoreErrors: []int{404},
+	})
+	if err != nil || resp.StatusCode == 404 {
+		return
+	}
+	exists = true
+	var found struct {
+		IndexTemplates []struct {
+			IndexTemplate struct {
+				Version int `json:"version"`
+			} `json:"index_template"`
+		} `json:"index_templates"`
+	}
+	var legacy map[string]struct {
+		Version int `json:"version"`
+	}
+	if strings.HasPrefix(path, "/_index_template/") {
+		if err = json.Unmarshal(resp.Body, &found); err == nil && len(found.IndexTemplates) > 0 {
+			version = found.IndexTemplates[0].IndexTemplate.Version
+		}
+	} else if err = json.Unmarshal(resp.Body, &legacy); err == nil {
+		if t, ok := legacy[it.Name]; ok {
+			version = t.Version
+		}
+	}
+	return
+}
+
+func ensureIndexTemplates(client *elastic.Client, config *configOptions) error {
+	var templates []*indexTemplate
+	for _, it := range indexTemplates {
+		templates = append(templates, it)
+	}
+	for _, lr := range languageRoutings {
+		templates = append(templates, lr.templates()...)
+	}
+	for _, it := range templates {
+		body, err := it.body(config)
+		if err != nil {
+			return fmt.Errorf("Unable to build index template %s: %s", it.Name, err)
+		}
+		path := "/_template/" + url.PathEscape(it.Name)
+		if config.useComposableTemplates() {
+			path = "/_index_template/" + url.PathEscape(it.Name)
+		}
+		exists, version, err := it.currentVersion(client, path)
+		if err != nil {
+			return fmt.Errorf("Unable to get index template %s: %s", it.Name, err)
+		}
+		if exists {
+			if version == body["version"] {
+				continue
+			}
+			if !it.Overwrite {
+				return fmt.Errorf("Index template %s already exists with different content. "+
+					"Remove it or set overwrite = true for namespace %s", it.Name, it.Namespace)
+			}
+		}
+		params := url.Values{}
+		if !exists {
+			params.Set("create", "true")
+		}
+		_, err = client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+			Method: "PUT",
+			Path:   path,
+			Params: params,
+			Body:   body,
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to put index template %s for namespace %s: %s", it.Name, it.Namespace, err)
+		}
+		infoLog.Printf("Installed index template %s for namespace %s", it.Name, it.Namespace)
+	}
+	return nil
+}
+
+func (job *reindexJob) isActive() bool {
+	return atomic.LoadInt32(&job.active) == 1
+}
+
+// start creates the new versioned index and records the indexes currently
+// behind the alias.  The alias is the index the namespace normally maps to
+func (job *reindexJob) start(client *elastic.Client, config *configOptions) (err error) {
+	job.alias = mapIndexType(config, &gtm.Op{Namespace: job.Namespace}).Index
+	job.target = fmt.Sprintf("%s-%s", job.alias, time.Now().UTC().Format("20060102150405"))
+	resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method:       "GET",
+		Path:         "/_alias/" + url.PathEscape(job.alias),
+		IgnoreErrors: []int{404},
+	})
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == 200 {
+		var aliases map[string]interface{}
+		if err = json.Unmarshal(resp.Body, &aliases); err != nil {
+			return
+		}
+		for index := range aliases {
+			job.previous = append(job.previous, index)
+		}
+	} else {
+		var exists bool
+		if exists, err = client.IndexExists(job.alias).Do(context.Background()); err != nil {
+			return
+		}
+		if exists {
+			if job.KeepOld {
+				return fmt.Errorf("Index %s is not an alias and cannot be kept after reindexing", job.alias)
+			}
+			job.previous, job.concrete = []string{job.alias}, true
+		}
+	}
+	_, err = client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "PUT",
+		Path:   "/" + url.PathEscape(job.target),
+		Body:   job.body,
+	})
+	if err != nil {
+		return
+	}
+	atomic.StoreInt32(&job.active, 1)
+	infoLog.Printf("Reindexing namespace %s into index %s", job.Namespace, job.target)
+	return
+}
+
+// finish points the alias at the new index in a single atomic request and
+// removes the previous indexes unless they should be kept
+func (job *reindexJob) finish(client *elastic.Client) (err error) {
+	var actions []map[string]interface{}
+	for _, index := range job.previous {
+		if job.concrete {
+			actions = append(actions, map[string]interface{}{
+				"remove_index": map[string]interface{}{"index": index},
+			})
+		} else {
+			actions = append(actions, map[string]interface{}{
+				"remove": map[string]interface{}{"index": index, "alias": job.alias},
+			})
+		}
+	}
+	actions = append(actions, map[string]interface{}{
+		"add": map[string]interface{}{"index": job.target, "alias": job.alias},
+	})
+	_, err = client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "POST",
+		Path:   "/_aliases",
+		Body:   map[string]interface{}{"actions": actions},
+	})
+	if err != nil {
+		return
+	}
+	atomic.StoreInt32(&job.active, 0)
+	infoLog.Printf("Alias %s swapped to index %s", job.alias, job.target)
+	if job.KeepOld || job.concrete {
+		return
+	}
+	for _, index := range job.previous {
+		if _, err = client.DeleteIndex(index).Do(context.Background()); err != nil {
+			return fmt.Errorf("Unable to delete previous index %s: %s", index, err)
+		}
+		infoLog.Printf("Deleted previous index %s", index)
+	}
+	return
+}
+
+func startReindexes(client *elastic.Client, config *configOptions) error {
+	for _, job := range reindexJobs {
+		if err := job.start(client, config); err != nil {
+			return fmt.Errorf("Unable to start reindex of namespace %s: %s", job.Namespace, err)
+		}
+	}
+	return nil
+}
+
+// finishReindexes waits for all direct reads of reindexed namespaces to be
+// queued for indexing, flushes them to Elasticsearch and swaps the aliases
+func finishReindexes(client *elastic.Client, bulk *elastic.BulkProcessor) {
+	if len(reindexJobs) == 0 {
+		return
+	}
+	for _, job := range reindexJobs {
+		job.pending.Wait()
+	}
+	flushBulks(bulk)
+	for _, job := range reindexJobs {
+		if err := job.finish(client); err != nil {
+			errorLog.Printf("Unable to complete reindex of namespace %s: %s", job.Namespace, err)
+		}
+	}
+}
+
+// reindexCopy returns a copy of a change event to be written to the new index
+// of a namespace being reindexed, or nil if no copy is needed
+func reindexCopy(op *gtm.Op) *gtm.Op {
+	job := reindexJobs[op.Namespace]
+	if job == nil || !job.isActive() || !op.IsSourceOplog() || len(job.previous) == 0 {
+		return nil
+	}
+	rop := *op
+	rop.Source = gtm.DirectQuerySource
+	if op.Data != nil {
+		rop.Data = make(map[string]interface{}, len(op.Data))
+		for k, v := range op.Data {
+			rop.Data[k] = v
+		}
+	}
+	return &rop
+}
+
+// start creates the shadow index with the candidate index body unless it
+// already exists.  The shadow index defaults to the index of the namespace
+// with a -shadow suffix
+func (si *shadowIndex) start(client *elastic.Client, config *configOptions) (err error) {
+	target := strings.ToLower(si.Index)
+	if target == "" {
+		target = mapIndexType(config, &gtm.Op{Namespace: si.Namespace}).Index + "-shadow"
+	}
+	exists, err := client.IndexExists(target).Do(context.Background())
+	if err != nil {
+		return
+	}
+	if exists {
+		if si.body != nil {
+			warnLog.Printf("Shadow index %s already exists and keeps its current mapping", target)
+		}
+	} else {
+		_, err = client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+			Method: "PUT",
+			Path:   "/" + url.PathEscape(target),
+			Body:   si.body,
+		})
+		if err != nil {
+			return
+		}
+	}
+	si.target = target
+	infoLog.Printf("Shadowing %v%% of namespace %s into index %s", si.Percent, si.Namespace, target)
+	return
+}
+
+func startShadows(client *elastic.Client, config *configOptions) error {
+	if config.DisableElasticsearch {
+		return nil
+	}
+	for _, si := range shadowIndexes {
+		if err := si.start(client, config); err != nil {
+			return fmt.Errorf("Unable to start shadow index of namespace %s: %s", si.Namespace, err)
+		}
+	}
+	return nil
+}
+
+// samples returns true if the document of op is shadowed.  Documents are
+// chosen by their id so that every change to a sampled document is shadowed
+func (si *shadowIndex) samples(op *gtm.Op) bool {
+	if si.target == "" {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(opIDToString(op)))
+	return float64(h.Sum32()%10000) < si.Percent*100
+}
+
+// shadowCopy returns a copy of a change event to be mapped for the shadow
+// index of its namespace, or nil if the document is not sampled
+func shadowCopy(op *gtm.Op) *gtm.Op {
+	si := shadowIndexes[op.Namespace]
+	if si == nil || op.Data == nil || unwinds[op.Namespace] != nil || !si.samples(op) {
+		return nil
+	}
+	sop := *op
+	// mapping may change nested values in place
+	sop.Data = copyValue(op.Data).(map[string]interface{})
+	return &sop
+}
+
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = copyValue(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for i, e := range t {
+			a[i] = copyValue(e)
+		}
+		return a
+	}
+	return v
+}
+
+// indexShadow maps the copy of a change event with the candidate plugin,
+// writes it to the shadow index and reports how it differs from the
+// document of op as it was indexed normally
+func indexShadow(config *configOptions, mongo *mgo.Session, bulk *elastic.BulkProcessor, op, sop *gtm.Op) {
+	si := shadowIndexes[sop.Namespace]
+	atomic.AddInt64(&si.sampled, 1)
+	var err error
+	if si.mapper != nil {
+		err = mapDataGolang(mongo, sop, nil, si.mapper)
+	} else if mapperPlugin != nil {
+		err = mapDataGolang(mongo, sop, nil, mapperPlugin)
+	} else {
+		err = mapDataJavascript(sop)
+	}
+	if err != nil {
+		logWith(errorLog, opLogFields(op), "Unable to map shadow document %v in %s: %s", op.Id, op.Namespace, err)
+		return
+	}
+	var meta *indexingMeta
+	if sop.Data != nil {
+		var ok bool
+		if meta, ok = transformDocument(config, sop); !ok || meta.Skip {
+			sop.Data = nil
+		}
+	}
+	diff, err := compareShadow(indexedDocument(config, op), indexedDocument(config, sop))
+	if err != nil {
+		logWith(errorLog, opLogFields(op), "Unable to compare shadow document %v in %s: %s", op.Id, op.Namespace, err)
+	} else if diff == nil {
+		atomic.AddInt64(&si.matched, 1)
+	} else {
+		atomic.AddInt64(&si.differed, 1)
+		infoLog.Printf("Shadow document %v in %s differs: added %v, removed %v, changed %v",
+			op.Id, op.Namespace, diff.Added, diff.Removed, diff.Changed)
+	}
+	if sop.Data == nil {
+		si.delete(config, bulk, sop)
+		return
+	}
+	req := elastic.NewBulkIndexRequest()
+	req.UseEasyJSON(config.EnableEasyJSON)
+	req.Index(si.target)
+	req.Type(mapIndexType(config, sop).Type)
+	req.Id(meta.idOr(opIDToString(sop)))
+	req.Doc(bulkDocument(config, sop))
+	if meta.Routing != "" {
+		req.Routing(meta.Routing)
+	}
+	if meta.Version != 0 {
+		req.Version(meta.Version)
+	}
+	if meta.VersionType != "" {
+		req.VersionType(meta.VersionType)
+	}
+	si.add(bulk, req)
+}
+
+func (si *shadowIndex) delete(config *configOptions, bulk *elastic.BulkProcessor, op *gtm.Op) {
+	req := elastic.NewBulkDeleteRequest()
+	req.UseEasyJSON(config.EnableEasyJSON)
+	req.Index(si.target)
+	req.Id(opIDToString(op))
+	req.Version(int64(op.Timestamp))
+	req.VersionType("external")
+	si.add(bulk, req)
+}
+
+func (si *shadowIndex) add(bulk *elastic.BulkProcessor, req elastic.BulkableRequest) {
+	onBulkItem(req, func(item *elastic.BulkResponseItem, err error) {
+		if err != nil || (item != nil && item.Error != nil && item.Status != http.StatusNotFound) {
+			atomic.AddInt64(&si.rejected, 1)
+		}
+	})
+	bulk.Add(req)
+}
+
+// indexedDocument returns the document of a mapped event as sent in its
+// bulk request or nil if it was dropped
+func indexedDocument(config *configOptions, op *gtm.Op) interface{} {
+	if op.Data == nil {
+		return nil
+	}
+	if _, skipped := op.Data["_meta_monstache"]; skipped {
+		return nil
+	}
+	return bulkDocument(config, op)
+}
+
+// compareShadow compares documents by their JSON encoding.  It returns nil
+// if they are the same
+func compareShadow(doc, shadowDoc interface{}) (diff *shadowDiff, err error) {
+	var a, b interface{}
+	for _, d := range []struct {
+		doc interface{}
+		out *interface{}
+	}{{doc, &a}, {shadowDoc, &b}} {
+		if d.doc == nil {
+			continue
+		}
+		var data []byte
+		if data, err = json.Marshal(d.doc); err != nil {
+			return
+		}
+		if err = json.Unmarshal(data, d.out); err != nil {
+			return
+		}
+	}
+	diff = &shadowDiff{}
+	diff.compare("", a, b)
+	if len(diff.Added)+len(diff.Removed)+len(diff.Changed) == 0 {
+		return nil, nil
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return
+}
+
+func (diff *shadowDiff) compare(path string, a, b interface{}) {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if !aok || !bok {
+		if !reflect.DeepEqual(a, b) {
+			if path == "" {
+				path = "."
+			}
+			diff.Changed = append(diff.Changed, path)
+		}
+		return
+	}
+	for k, v := range am {
+		field := k
+		if path != "" {
+			field = path + "." + k
+		}
+		if w, ok := bm[k]; ok {
+			diff.compare(field, v, w)
+		} else {
+			diff.Removed = append(diff.Removed, field)
+		}
+	}
+	for k := range bm {
+		if _, ok := am[k]; !ok {
+			if path != "" {
+				k = path + "." + k
+			}
+			diff.Added = append(diff.Added, k)
+		}
+	}
+}
+
+func shadowStatsOf() map[string]shadowStats {
+	if len(shadowIndexes) == 0 {
+		return nil
+	}
+	stats := make(map[string]shadowStats)
+	for ns, si := range shadowIndexes {
+		stats[ns] = shadowStats{
+			Index:    si.target,
+			Sampled:  atomic.LoadInt64(&si.sampled),
+			Matched:  atomic.LoadInt64(&si.matched),
+			Differed: atomic.LoadInt64(&si.differed),
+			Rejected: atomic.LoadInt64(&si.rejected),
+		}
+	}
+	return stats
+}
+
+func newDirectReadScheduler(config *configOptions) *directReadScheduler {
+	s := &directReadScheduler{
+		budget:   config.DirectReadBudget,
+		rate:     float64(config.DirectReadRate),
+		tokens:   float64(config.DirectReadRate),
+		refilled: time.Now(),
+		weights:  make(map[string]float64),
+		served:   make(map[string]float64),
+		waiting:  make(map[string]int),
+	}
+	for _, p := range config.DirectReadPriorities {
+		s.weights[p.Namespace] = float64(p.Priority)
+	}
+	return s
+}
+
+// setRate changes the number of documents read per second
+func (s *directReadScheduler) setRate(rate int) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.rate = float64(rate)
+	if s.tokens > s.rate {
+		s.tokens = s.rate
+	}
+}
+
+func (s *directReadScheduler) weight(ns string) float64 {
+	if w := s.weights[ns]; w > 0 {
+		return w
+	}
+	return 1
+}
+
+// next returns the waiting namespace which has been served least
+// relative to its priority
+func (s *directReadScheduler) next() (next string) {
+	least := math.MaxFloat64
+	for ns, n := range s.waiting {
+		if n == 0 {
+			continue
+		}
+		if served := s.served[ns]; served < least || (served == least && ns < next) {
+			least, next = served, ns
+		}
+	}
+	return
+}
+
+func (s *directReadScheduler) ready(ns string) bool {
+	if s.rate > 0 {
+		now := time.Now()
+		s.tokens += now.Sub(s.refilled).Seconds() * s.rate
+		if s.tokens > s.rate {
+			s.tokens = s.rate
+		}
+		s.refilled = now
+		if s.tokens < 1 {
+			return false
+		}
+	}
+	if s.budget > 0 && s.inflight >= s.budget {
+		return false
+	}
+	return s.next() == ns
+}
+
+// acquire blocks the direct read of op until it fits into the budget and
+// it is the turn of its namespace
+func (s *directReadScheduler) acquire(op *gtm.Op) {
+	if s == nil {
+		return
+	}
+	ns := op.Namespace
+	s.lock.Lock()
+	if s.waiting[ns] == 0 {
+		// namespaces joining late start level with those already waiting
+		// instead of making up for the time they were not reading
+		if least := s.served[s.next()]; s.served[ns] < least {
+			s.served[ns] = least
+		}
+	}
+	s.waiting[ns]++
+	for !s.ready(ns) {
+		s.lock.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		s.lock.Lock()
+	}
+	s.waiting[ns]--
+	s.served[ns] += 1 / s.weight(ns)
+	s.inflight++
+	if s.rate > 0 {
+		s.tokens--
+	}
+	s.lock.Unlock()
+	s.held.Store(op, true)
+}
+
+// done returns the budget held by op once it is indexed or dropped
+func (s *directReadScheduler) done(op *gtm.Op) {
+	if s == nil || op == nil {
+		return
+	}
+	if _, ok := s.held.Load(op); ok {
+		s.held.Delete(op)
+		s.lock.Lock()
+		s.inflight--
+		s.lock.Unlock()
+	}
+}
+
+func scheduleDirectReads(filter gtm.OpFilter) gtm.OpFilter {
+	return func(op *gtm.Op) bool {
+		keep := filter(op)
+		if keep {
+			directReads.acquire(op)
+		}
+		return keep
+	}
+}
+
+func countReindexReads(filter gtm.OpFilter) gtm.OpFilter {
+	return func(op *gtm.Op) bool {
+		keep := filter(op)
+		if keep && op.IsSourceDirect() {
+			if job := reindexJobs[op.Namespace]; job != nil {
+				job.pending.Add(1)
+				job.reads.Store(op, true)
+			}
+		}
+		return keep
+	}
+}
+
+func reindexReadDone(op *gtm.Op) {
+	if op.IsSourceDirect() {
+		if job := reindexJobs[op.Namespace]; job != nil {
+			if _, ok := job.reads.Load(op); ok {
+				job.reads.Delete(op)
+				job.pending.Done()
+			}
+		}
+	}
+}
+
+func defaultIndexTypeMapping(config *configOptions, op *gtm.Op) *indexTypeMapping {
+	typeName := typeFromFuture
+	if config.useTypelessAPI() {
+		typeName = ""
+	} else if !config.useTypeFromFuture() {
+		typeName = op.GetCollection()
+	}
+	return &indexTypeMapping{
+		Namespace: op.Namespace,
+		Index:     strings.ToLower(op.Namespace),
+		Type:      typeName,
+	}
+}
+
+func mapIndexType(config *configOptions, op *gtm.Op) *indexTypeMapping {
+	mapping := defaultIndexTypeMapping(config, op)
+	if m := mapIndexTypes[op.Namespace]; m != nil {
+		if m.Index != "" {
+			mapping.Index = m.Index
+			if op.Data != nil && isDatedIndex(m.Index) {
+				mapping.Index = datedIndexName(m.Index, op.Data)
+			}
+		}
+		if m.Type != "" && !config.useTypelessAPI() {
+			mapping.Type = m.Type
+		}
+	}
+	if job := reindexJobs[op.Namespace]; job != nil && job.isActive() {
+		if !op.IsSourceOplog() || len(job.previous) == 0 {
+			mapping.Index = job.target
+		}
+	}
+	return mapping
+}
+
+var indexDateRegex = regexp.MustCompile(`\{([^{}:]+):([^{}]+)\}`)
+
+var indexDateLayout = strings.NewReplacer(
+	"yyyy", "2006", "yy", "06", "MM", "01", "dd", "02",
+	"HH", "15", "mm", "04", "ss", "05")
+
+func isDatedIndex(index string) bool {
+	return indexDateRegex.MatchString(index)
+}
+
+// lowerIndexName lowercases an index name except for the date formats of
+// {field:format} placeholders
+func lowerIndexName(index string) string {
+	var sb strings.Builder
+	last := 0
+	for _, loc := range indexDateRegex.FindAllStringIndex(index, -1) {
+		sb.WriteString(strings.ToLower(index[last:loc[0]]))
+		sb.WriteString(index[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	sb.WriteString(strings.ToLower(index[last:]))
+	return sb.String()
+}
+
+// indexPattern replaces the date placeholders of an index name with
+// wildcards so that it matches every dated index
+func indexPattern(index string) string {
+	return indexDateRegex.ReplaceAllString(index, "*")
+}
+
+// datedIndexName resolves placeholders such as {created:yyyy.MM} from the date
+// in a field of the document.  Documents without a valid date are indexed
+// into an index with the suffix undated in place of the date
+func datedIndexName(index string, doc map[string]interface{}) string {
+	return indexDateRegex.ReplaceAllStringFunc(index, func(placeholder string) string {
+		parts := indexDateRegex.FindStringSubmatch(placeholder)
+		field, format := parts[1], parts[2]
+		var t time.Time
+		val, _ := fieldValue(doc, field)
+		switch v := val.(type) {
+		case time.Time:
+			t = v
+		case string:
+			if parsed, err := time.Parse(time.RFC3339, v); err == nil {
+				t = parsed
+			}
+		case int64:
+			t = time.Unix(0, v*int64(time.Millisecond))
+		case float64:
+			t = time.Unix(0, int64(v)*int64(time.Millisecond))
+		}
+		if t.IsZero() {
+			return "undated"
+		}
+		return t.UTC().Format(indexDateLayout.Replace(format))
+	})
+}
+
+func opIDToString(op *gtm.Op) string {
+	var opIDStr string
+	switch id := op.Id.(type) {
+	case bson.ObjectId:
+		opIDStr = id.Hex()
+	case bson.Binary:
+		opIDStr = monstachemap.EncodeBinData(monstachemap.Binary{Binary: id})
+	case float64:
+		intID := int(id)
+		if id == float64(intID) {
+			opIDStr = fmt.Sprintf("%v", intID)
+		} else {
+			opIDStr = fmt.Sprintf("%v", op.Id)
+		}
+	case float32:
+		intID := int(id)
+		if id == float32(intID) {
+			opIDStr = fmt.Sprintf("%v", intID)
+		} else {
+			opIDStr = fmt.Sprintf("%v", op.Id)
+		}
+	default:
+		opIDStr = fmt.Sprintf("%v", op.Id)
+	}
+	return opIDStr
+}
+
+func convertSliceJavascript(a []interface{}) []interface{} {
+	var avs []interface{}
+	for _, av := range a {
+		var avc interface{}
+		switch achild := av.(type) {
+		case map[string]interface{}:
+			avc = convertMapJavascript(achild)
+		case []interface{}:
+			avc = convertSliceJavascript(achild)
+		case bson.ObjectId:
+			avc = achild.Hex()
+		default:
+			avc = av
+		}
+		avs = append(avs, avc)
+	}
+	return avs
+}
+
+func convertMapJavascript(e map[string]interface{}) map[string]interface{} {
+	o := make(map[string]interface{})
+	for k, v := range e {
+		switch child := v.(type) {
+		case map[string]interface{}:
+			o[k] = convertMapJavascript(child)
+		case []interface{}:
+			o[k] = convertSliceJavascript(child)
+		case bson.ObjectId:
+			o[k] = child.Hex()
+		default:
+			o[k] = v
+		}
+	}
+	return o
+}
+
+func fixSlicePruneInvalidJSON(id string, key string, a []interface{}) []interface{} {
+	var avs []interface{}
+	for _, av := range a {
+		var avc interface{}
+		switch achild := av.(type) {
+		case map[string]interface{}:
+			avc = fixPruneInvalidJSON(id, achild)
+		case []interface{}:
+			avc = fixSlicePruneInvalidJSON(id, key, achild)
+		case time.Time:
+			year := achild.Year()
+			if year < 0 || year > 9999 {
+				// year outside of valid range
+				warnLog.Printf("Dropping key %s element: invalid time.Time value: %s for document _id: %s", key, achild, id)
+				continue
+			} else {
+				avc = av
+			}
+		case float64:
+			if math.IsNaN(achild) {
+				// causes an error in the json serializer
+				warnLog.Printf("Dropping key %s element: invalid float64 value: %v for document _id: %s", key, achild, id)
+				continue
+			} else if math.IsInf(achild, 0) {
+				// causes an error in the json serializer
+				warnLog.Printf("Dropping key %s element: invalid float64 value: %v for document _id: %s", key, achild, id)
+				continue
+			} else {
+				avc = av
+			}
+		default:
+			avc = av
+		}
+		avs = append(avs, avc)
+	}
+	return avs
+}
+
+func fixPruneInvalidJSON(id string, e map[string]interface{}) map[string]interface{} {
+	o := make(map[string]interface{})
+	for k, v := range e {
+		switch child := v.(type) {
+		case map[string]interface{}:
+			o[k] = fixPruneInvalidJSON(id, child)
+		case []interface{}:
+			o[k] = fixSlicePruneInvalidJSON(id, k, child)
+		case time.Time:
+			year := child.Year()
+			if year < 0 || year > 9999 {
+				// year outside of valid range
+				warnLog.Printf("Dropping key %s: invalid time.Time value: %s for document _id: %s", k, child, id)
+				continue
+			} else {
+				o[k] = v
+			}
+		case float64:
+			if math.IsNaN(child) {
+				// causes an error in the json serializer
+				warnLog.Printf("Dropping key %s: invalid float64 value: %v for document _id: %s", k, child, id)
+				continue
+			} else if math.IsInf(child, 0) {
+				// causes an error in the json serializer
+				warnLog.Printf("Dropping key %s: invalid float64 value: %v for document _id: %s", k, child, id)
+				continue
+			} else {
+				o[k] = v
+			}
+		default:
+			o[k] = v
+		}
+	}
+	return o
+}
+
+func deepExportValue(a interface{}) (b interface{}) {
+	switch t := a.(type) {
+	case otto.Value:
+		ex, err := t.Export()
+		if t.Class() == "Date" {
+			ex, err = time.Parse("Mon, 2 Jan 2006 15:04:05 MST", t.String())
+		}
+		if err == nil {
+			b = deepExportValue(ex)
+		} else {
+			errorLog.Printf("Error exporting from javascript: %s", err)
+		}
+	case map[string]interface{}:
+		b = deepExportMap(t)
+	case []map[string]interface{}:
+		b = deepExportMapSlice(t)
+	case []interface{}:
+		b = deepExportSlice(t)
+	default:
+		b = a
+	}
+	return
+}
+
+func deepExportMapSlice(a []map[string]interface{}) []interface{} {
+	var avs []interface{}
+	for _, av := range a {
+		avs = append(avs, deepExportMap(av))
+	}
+	return avs
+}
+
+func deepExportSlice(a []interface{}) []interface{} {
+	var avs []interface{}
+	for _, av := range a {
+		avs = append(avs, deepExportValue(av))
+	}
+	return avs
+}
+
+func deepExportMap(e map[string]interface{}) map[string]interface{} {
+	o := make(map[string]interface{})
+	for k, v := range e {
+		o[k] = deepExportValue(v)
+	}
+	return o
+}
+
+func mapDataJavascript(op *gtm.Op) error {
+	names := []string{"", op.Namespace}
+	for _, name := range names {
+		if env := mapEnvs[name]; env != nil {
+			env.lock.Lock()
+			defer env.lock.Unlock()
+			arg := convertMapJavascript(op.Data)
+			arg2 := op.Namespace
+			arg3 := convertMapJavascript(op.UpdateDescription)
+			val, err := env.VM.Call("module.exports", arg, arg, arg2, arg3)
+			if err != nil {
+				return err
+			}
+			if strings.ToLower(val.Class()) == "object" {
+				data, err := val.Export()
+				if err != nil {
+					return err
+				} else if data == val {
+					return errors.New("Exported function must return an object")
+				} else {
+					dm := data.(map[string]interface{})
+					op.Data = deepExportMap(dm)
+				}
+			} else {
+				indexed, err := val.ToBoolean()
+				if err != nil {
+					return err
+				} else if !indexed {
+					op.Data = nil
+					break
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func mapDataGolang(s *mgo.Session, op *gtm.Op, span *traceSpan, mapper func(*monstachemap.MapperPluginInput) (*monstachemap.MapperPluginOutput, error)) error {
+	session := s.Copy()
+	defer session.Close()
+	input := &monstachemap.MapperPluginInput{
+		Document:          op.Data,
+		Namespace:         op.Namespace,
+		Database:          op.GetDatabase(),
+		Collection:        op.GetCollection(),
+		Operation:         op.Operation,
+		Session:           session,
+		UpdateDescription: op.UpdateDescription,
+		Span:              span.lookup,
+		Lookup:            pluginLookups,
+	}
+	if references != nil {
+		input.References = references
+	}
+	var output *monstachemap.MapperPluginOutput
+	done := metrics.pluginTimer("map", op.Namespace)
+	err := callPlugin("map", op, func() (err error) {
+		output, err = mapper(input)
+		return
+	})
+	done()
+	if err != nil {
+		return err
+	}
+	if output != nil {
+		if output.Drop {
+			op.Data = nil
+		} else {
+			if output.Skip {
+				op.Data = map[string]interface{}{}
+			} else if output.Passthrough == false {
+				if output.Document == nil {
+					return errors.New("Map function must return a non-nil document")
+				}
+				op.Data = output.Document
+			}
+			meta := make(map[string]interface{})
+			if output.Skip {
+				meta["skip"] = true
+			}
+			if output.Index != "" {
+				meta["index"] = output.Index
+			}
+			if output.ID != "" {
+				meta["id"] = output.ID
+			}
+			if output.Type != "" {
+				meta["type"] = output.Type
+			}
+			if output.Routing != "" {
+				meta["routing"] = output.Routing
+			}
+			if output.Parent != "" {
+				meta["parent"] = output.Parent
+			}
+			if output.Version != 0 {
+				meta["version"] = output.Version
+			}
+			if output.VersionType != "" {
+				meta["versionType"] = output.VersionType
+			}
+			if output.Pipeline != "" {
+				meta["pipeline"] = output.Pipeline
+			}
+			if output.RetryOnConflict != 0 {
+				meta["retryOnConflict"] = output.RetryOnConflict
+			}
+			if len(meta) > 0 {
+				op.Data["_meta_monstache"] = meta
+			}
+		}
+	}
+	return nil
+}
+
+func mapData(session *mgo.Session, config *configOptions, op *gtm.Op) (err error) {
+	span := tracing.start(op, "map")
+	defer func() { span.finish(err) }()
+	if mapperPlugin != nil {
+		return mapDataGolang(session, op, span, mapperPlugin)
+	}
+	return mapDataJavascript(op)
+}
+
+func extractData(srcField string, data map[string]interface{}) (result interface{}, err error) {
+	var cur map[string]interface{} = data
+	fields := strings.Split(srcField, ".")
+	flen := len(fields)
+	for i, field := range fields {
+		if i+1 == flen {
+			result = cur[field]
+		} else {
+			if next, ok := cur[field].(map[string]interface{}); ok {
+				cur = next
+			} else {
+				break
+			}
+		}
+	}
+	if result == nil {
+		var detail interface{}
+		b, e := json.Marshal(data)
+		if e == nil {
+			detail = string(b)
+		} else {
+			detail = err
+		}
+		err = fmt.Errorf("Source field %s not found in document: %s", srcField, detail)
+	}
+	return
+}
+
+func buildSelector(matchField string, data interface{}) bson.M {
+	sel := bson.M{}
+	var cur bson.M = sel
+	fields := strings.Split(matchField, ".")
+	flen := len(fields)
+	for i, field := range fields {
+		if i+1 == flen {
+			cur[field] = data
+		} else {
+			next := bson.M{}
+			cur[field] = next
+			cur = next
+		}
+	}
+	return sel
+}
+
+func processRelated(session *mgo.Session, bulk *elastic.BulkProcessor, elastic *elastic.Client, config *configOptions, root *gtm.Op, out *outputChans) (err error) {
+	var q []*gtm.Op
+	batch := []*gtm.Op{root}
+	depth := 1
+	s := session.Copy()
+	if config.DirectReadNoTimeout {
+		s.SetCursorTimeout(0)
+	}
+	defer s.Close()
+	for len(batch) > 0 {
+		for _, e := range batch {
+			op := e
+			if op.Data == nil {
+				continue
+			}
+			rs := relates[op.Namespace]
+			if len(rs) == 0 {
+				continue
+			}
+			for _, r := range rs {
+				if r.MaxDepth > 0 && r.MaxDepth < depth {
+					continue
+				}
+				if op.IsDelete() && r.IsIdentity() {
+					rop := &gtm.Op{
+						Id:        op.Id,
+						Operation: op.Operation,
+						Namespace: r.WithNamespace,
+						Source:    op.Source,
+						Timestamp: op.Timestamp,
+						Data:      op.Data,
+					}
+					doDelete(config, elastic, session, bulk, rop)
+					q = append(q, rop)
+					continue
+				}
+				var srcData interface{}
+				if srcData, err = extractData(r.SrcField, op.Data); err != nil {
+					processErr(err, config)
+					continue
+				}
+				var sel bson.M
+				if r.DotNotation {
+					sel = bson.M{r.MatchField: srcData}
+				} else {
+					sel = buildSelector(r.MatchField, srcData)
+				}
+				col := s.DB(r.db).C(r.col)
+				query := col.Find(sel)
+				iter := query.Iter()
+				doc := map[string]interface{}{}
+				for iter.Next(doc) {
+					now := time.Now().UTC()
+					tstamp := bson.MongoTimestamp(now.Unix() << 32)
+					offset := bson.MongoTimestamp(now.Nanosecond())
+					rop := &gtm.Op{
+						Id:                doc["_id"],
+						Data:              doc,
+						Operation:         root.Operation,
+						Namespace:         r.WithNamespace,
+						Source:            gtm.DirectQuerySource,
+						Timestamp:         tstamp | offset,
+						UpdateDescription: root.UpdateDescription,
+					}
+					doc = map[string]interface{}{}
+					if out.filter != nil && !out.filter(rop) {
+						continue
+					}
+					if processPlugin != nil {
+						pop := &gtm.Op{
+							Id:                rop.Id,
+							Operation:         rop.Operation,
+							Namespace:         rop.Namespace,
+							Source:            rop.Source,
+							Timestamp:         rop.Timestamp,
+							UpdateDescription: rop.UpdateDescription,
+						}
+						var data []byte
+						data, err = bson.Marshal(rop.Data)
+						if err == nil {
+							var m map[string]interface{}
+							err = bson.Unmarshal(data, &m)
+							if err == nil {
+								pop.Data = m
+							}
+						}
+						out.processC <- pop
+					}
+					skip := false
+					if rs2 := relates[rop.Namespace]; len(rs2) != 0 {
+						skip = true
+						visit := false
+						for _, r2 := range rs2 {
+							if r2.KeepSrc {
+								skip = false
+							}
+							if r2.MaxDepth < 1 || r2.MaxDepth >= (depth+1) {
+								visit = true
+							}
+						}
+						if visit {
+							q = append(q, rop)
+						}
+					}
+					if !skip {
+						if hasFileContent(rop, config) {
+							out.fileC <- rop
+						} else {
+							out.indexC <- rop
+						}
+					}
+				}
+				iter.Close()
+			}
+		}
+		depth++
+		batch = q
+		q = nil
+	}
+	return
+}
+
+func prepareDataForIndexing(config *configOptions, op *gtm.Op) {
+	data := op.Data
+	if config.IndexOplogTime {
+		secs := int64(op.Timestamp >> 32)
+		t := time.Unix(secs, 0).UTC()
+		data[config.OplogTsFieldName] = op.Timestamp
+		data[config.OplogDateFieldName] = t.Format(config.OplogDateFieldFormat)
+	}
+	delete(data, "_id")
+	delete(data, "_meta_monstache")
+	if streamsJSON(config, op) {
+		return
+	}
+	if config.PruneInvalidJSON {
+		op.Data = fixPruneInvalidJSON(opIDToString(op), data)
+	}
+	op.Data = monstachemap.ConvertMapForJSON(op.Data)
+}
+
+// streamsJSON returns true if the document of op is converted for JSON as
+// the bulk request is encoded.  This saves copying the document when
+// nothing besides the request reads the converted document
+func streamsJSON(config *configOptions, op *gtm.Op) bool {
+	ns := op.Namespace
+	if !streamJSONNamespaces[ns] || config.PruneInvalidJSON || len(sinks) > 0 {
+		return false
+	}
+	if patchNamespaces[ns] || tmNamespaces[ns] || documentSizes[ns] != nil || offloads[ns] != nil {
+		return false
+	}
+	return !hasFileContent(op, config)
+}
+
+// bulkDocument is the document of op as given to a bulk request
+func bulkDocument(config *configOptions, op *gtm.Op) interface{} {
+	if streamsJSON(config, op) {
+		return monstachemap.Document(op.Data)
+	}
+	return op.Data
+}
+
+// fieldValue returns the value at a dotted path of a document
+func fieldValue(doc map[string]interface{}, path string) (val interface{}, ok bool) {
+	return fieldPathValue(doc, strings.Split(path, "."))
+}
+
+func fieldPathValue(doc map[string]interface{}, path []string) (val interface{}, ok bool) {
+	val = doc
+	for _, seg := range path {
+		m, isMap := val.(map[string]interface{})
+		if !isMap {
+			return nil, false
+		}
+		if val, ok = m[seg]; !ok {
+			return
+		}
+	}
+	return val, val != nil
+}
+
+var routingTemplateRegex = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// compile prepares the extraction of the routing value so that field paths
+// and templates are not parsed for every document
+func (re *routingExpr) compile() {
+	if re.Field != "" {
+		field, path := re.Field, strings.Split(re.Field, ".")
+		re.extract = func(doc map[string]interface{}) (string, error) {
+			val, ok := fieldPathValue(doc, path)
+			if !ok {
+				return "", fmt.Errorf("Routing field %s not found", field)
+			}
+			return fmt.Sprint(val), nil
+		}
+		return
+	}
+	// literals[i] precedes the value of paths[i] and the last literal
+	// follows the last value
+	var literals []string
+	var names []string
+	var paths [][]string
+	last := 0
+	for _, m := range routingTemplateRegex.FindAllStringSubmatchIndex(re.Template, -1) {
+		literals = append(literals, re.Template[last:m[0]])
+		name := re.Template[m[2]:m[3]]
+		names = append(names, name)
+		paths = append(paths, strings.Split(name, "."))
+		last = m[1]
+	}
+	literals = append(literals, re.Template[last:])
+	re.extract = func(doc map[string]interface{}) (string, error) {
+		var b strings.Builder
+		var err error
+		for i, path := range paths {
+			b.WriteString(literals[i])
+			if val, ok := fieldPathValue(doc, path); ok {
+				fmt.Fprint(&b, val)
+			} else {
+				err = fmt.Errorf("Routing template field %s not found", names[i])
+			}
+		}
+		b.WriteString(literals[len(paths)])
+		if err != nil {
+			return "", err
+		}
+		return b.String(), nil
+	}
+}
+
+// eval computes the routing value of a document from either a field path or
+// a template such as "{org}-{region}" where each {path} is a field path
+func (re *routingExpr) eval(doc map[string]interface{}) (routing string, err error) {
+	if re.extract != nil {
+		return re.extract(doc)
+	}
+	if re.Field != "" {
+		val, ok := fieldValue(doc, re.Field)
+		if !ok {
+			return "", fmt.Errorf("Routing field %s not found", re.Field)
+		}
+		return fmt.Sprintf("%v", val), nil
+	}
+	routing = routingTemplateRegex.ReplaceAllStringFunc(re.Template, func(m string) string {
+		path := m[1 : len(m)-1]
+		val, ok := fieldValue(doc, path)
+		if !ok {
+			err = fmt.Errorf("Routing template field %s not found", path)
+			return ""
+		}
+		return fmt.Sprintf("%v", val)
+	})
+	return
+}
+
+// apply adds the join field to a document and routes children to their parent
+func (j *joinRelation) apply(op *gtm.Op, meta *indexingMeta) error {
+	if j.ParentField == "" {
+		op.Data[j.Field] = j.Name
+		return nil
+	}
+	val, ok := fieldValue(op.Data, j.ParentField)
+	if !ok {
+		return fmt.Errorf("Parent field %s not found", j.ParentField)
+	}
+	parent := opIDToString(&gtm.Op{Id: val})
+	op.Data[j.Field] = map[string]interface{}{
+		"name":   j.Name,
+		"parent": parent,
+	}
+	if meta.Routing == "" {
+		meta.Routing = parent
+	}
+	return nil
+}
+
+// formatDecimal converts a Decimal128 according to the configured format.
+// scaled emits the value multiplied by the scaling factor as an integer.
+// scaled_float emits the value rounded to the precision of the scaling factor
+// as a string so that Elasticsearch receives it without float conversion
+func (nf *numberFormat) formatDecimal(dec bson.Decimal128) interface{} {
+	if nf.Decimal == "" || nf.Decimal == "number" {
+		return dec
+	}
+	r, ok := new(big.Rat).SetString(dec.String())
+	if !ok {
+		return nil
+	}
+	if nf.Decimal == "string" {
+		return dec.String()
+	}
+	factor := new(big.Rat).SetInt64(nf.ScalingFactor)
+	scaled := new(big.Rat).Mul(r, factor)
+	num, den := scaled.Num(), scaled.Denom()
+	rounded, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	if new(big.Int).Abs(new(big.Int).Mul(rem, big.NewInt(2))).Cmp(den) >= 0 {
+		rounded.Add(rounded, big.NewInt(int64(num.Sign())))
+	}
+	if nf.Decimal == "scaled" {
+		if rounded.IsInt64() {
+			return rounded.Int64()
+		}
+		return rounded.String()
+	}
+	digits := len(strconv.FormatInt(nf.ScalingFactor, 10)) - 1
+	return new(big.Rat).SetFrac(rounded, big.NewInt(nf.ScalingFactor)).FloatString(digits)
+}
+
+func (nf *numberFormat) format(v interface{}) interface{} {
+	switch child := v.(type) {
+	case map[string]interface{}:
+		for k, cv := range child {
+			child[k] = nf.format(cv)
+		}
+	case []interface{}:
+		for i, cv := range child {
+			child[i] = nf.format(cv)
+		}
+	case bson.Decimal128:
+		return nf.formatDecimal(child)
+	case int64:
+		if nf.Long == "string" {
+			return strconv.FormatInt(child, 10)
+		}
+	}
+	return v
+}
+
+// parse reads a string or a number as a date.  ok is false when none of the
+// input formats match
+func (df *dateFormat) parse(val interface{}) (t time.Time, ok bool) {
+	for _, f := range df.InputFormats {
+		if f == "unix" || f == "unix_ms" {
+			n, isNum := geoNumber(val)
+			if str, isStr := val.(string); isStr {
+				var err error
+				n, err = strconv.ParseFloat(strings.TrimSpace(str), 64)
+				isNum = err == nil
+			}
+			if !isNum {
+				continue
+			}
+			if f == "unix" {
+				n *= 1000
+			}
+			return time.Unix(0, int64(n)*int64(time.Millisecond)).UTC(), true
+		}
+		str, isStr := val.(string)
+		if !isStr {
+			continue
+		}
+		layout := time.RFC3339
+		if f != "rfc3339" {
+			layout = indexDateLayout.Replace(f)
+		}
+		if parsed, err := time.ParseInLocation(layout, strings.TrimSpace(str), df.inputLocation); err == nil {
+			return parsed, true
+		}
+	}
+	return
+}
+
+// formatTime converts a date to the timezone and output format
+func (df *dateFormat) formatTime(t time.Time) interface{} {
+	if df.location != nil {
+		t = t.In(df.location)
+	}
+	switch df.Format {
+	case "":
+		return t
+	case "iso":
+		return t.Format("2006-01-02T15:04:05.000Z07:00")
+	case "epoch_millis":
+		return t.UnixNano() / int64(time.Millisecond)
+	case "epoch_second":
+		return t.Unix()
+	}
+	return t.Format(df.layout)
+}
+
+func (df *dateFormat) format(v interface{}) interface{} {
+	switch child := v.(type) {
+	case map[string]interface{}:
+		for k, cv := range child {
+			child[k] = df.format(cv)
+		}
+	case []interface{}:
+		for i, cv := range child {
+			child[i] = df.format(cv)
+		}
+	case time.Time:
+		return df.formatTime(child)
+	}
+	return v
+}
+
+// normalize reads the date fields of a document as dates and formats every
+// date of the document.  Values which cannot be read are left as is
+func (df *dateFormat) normalize(doc map[string]interface{}) {
+	for _, path := range df.paths {
+		transformField(doc, path, func(val interface{}) (interface{}, bool, error) {
+			if t, ok := df.parse(val); ok {
+				return t, false, nil
+			}
+			return val, false, nil
+		})
+	}
+	df.format(doc)
+}
+
+// removeField deletes a (possibly dotted) field from a document.  Arrays of
+// sub-documents along the path have the field removed from each element
+func removeField(val interface{}, path []string) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		if len(path) == 1 {
+			delete(v, path[0])
+		} else if child, ok := v[path[0]]; ok {
+			removeField(child, path[1:])
+		}
+	case []interface{}:
+		for _, elem := range v {
+			removeField(elem, path)
+		}
+	}
+}
+
+// coerce converts a value to the target type of the rule.  Date formats are
+// Go time layouts or one of unix and unix_ms for epoch numbers
+func (c *coercion) coerce(val interface{}) (interface{}, error) {
+	if val == nil {
+		return nil, nil
+	}
+	str := fmt.Sprintf("%v", val)
+	switch c.Type {
+	case "string":
+		return str, nil
+	case "long":
+		switch v := val.(type) {
+		case int, int32, int64:
+			return v, nil
+		case float64:
+			return int64(v), nil
+		}
+		return strconv.ParseInt(strings.TrimSpace(str), 10, 64)
+	case "double":
+		switch v := val.(type) {
+		case float64:
+			return v, nil
+		case int:
+			return float64(v), nil
+		case int64:
+			return float64(v), nil
+		}
+		return strconv.ParseFloat(strings.TrimSpace(str), 64)
+	case "boolean":
+		if b, ok := val.(bool); ok {
+			return b, nil
+		}
+		return strconv.ParseBool(strings.TrimSpace(str))
+	case "date":
+		if t, ok := val.(time.Time); ok {
+			return t, nil
+		}
+		switch c.Format {
+		case "unix", "unix_ms":
+			n, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+			if err != nil {
+				return nil, err
+			}
+			if c.Format == "unix" {
+				n *= 1000
+			}
+			return time.Unix(0, int64(n)*int64(time.Millisecond)).UTC(), nil
+		case "":
+			return time.Parse(time.RFC3339, str)
+		}
+		return time.Parse(c.Format, str)
+	}
+	return val, nil
+}
+
+// transformField replaces the value at a dotted path using fn.  Arrays along
+// the path are transformed element by element.  remove is true when fn asks
+// for the field to be dropped
+func transformField(val interface{}, path []string, fn func(interface{}) (interface{}, bool, error)) (err error) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		child, ok := v[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) > 1 {
+			return transformField(child, path[1:], fn)
+		}
+		if arr, isArr := child.([]interface{}); isArr {
+			for i, elem := range arr {
+				var remove bool
+				if arr[i], remove, err = fn(elem); err != nil {
+					return
+				} else if remove {
+					arr[i] = nil
+				}
+			}
+			return
+		}
+		var out interface{}
+		var remove bool
+		if out, remove, err = fn(child); err != nil {
+			return
+		}
+		if remove {
+			delete(v, path[0])
+		} else {
+			v[path[0]] = out
+		}
+	case []interface{}:
+		for _, elem := range v {
+			if err = transformField(elem, path, fn); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// coerceFields applies the coercion rules of the namespace.  ok is false when
+// a rule with the skip-document policy fails
+func coerceFields(op *gtm.Op) (ok bool) {
+	for _, c := range coercions[op.Namespace] {
+		rule := c
+		err := transformField(op.Data, strings.Split(rule.Field, "."), func(val interface{}) (interface{}, bool, error) {
+			out, err := rule.coerce(val)
+			if err == nil {
+				return out, false, nil
+			}
+			switch rule.OnError {
+			case "null":
+				return nil, false, nil
+			case "drop-field":
+				return nil, true, nil
+			case "skip-document":
+				return nil, false, err
+			}
+			return val, false, nil
+		})
+		if err != nil {
+			logWith(warnLog, opLogFields(op), "Skipping document %v in %s: unable to coerce %s to %s: %s", op.Id, op.Namespace, rule.Field, rule.Type, err)
+			return false
+		}
+	}
+	return true
+}
+
+func geoNumber(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// geoPosition validates a [lon, lat] position
+func geoPosition(val interface{}) (lon, lat float64, err error) {
+	pos, ok := val.([]interface{})
+	if !ok || len(pos) < 2 {
+		return 0, 0, errors.New("position must be an array of longitude and latitude")
+	}
+	var okLon, okLat bool
+	lon, okLon = geoNumber(pos[0])
+	lat, okLat = geoNumber(pos[1])
+	if !okLon || !okLat {
+		return 0, 0, errors.New("position coordinates must be numbers")
+	}
+	if lon < -180 || lon > 180 || lat < -90 || lat > 90 {
+		return 0, 0, fmt.Errorf("position [%v, %v] is out of range", lon, lat)
+	}
+	return
+}
+
+// validateGeoCoordinates checks the nesting of GeoJSON coordinates. depth is
+// 0 for a position, 1 for a list of positions and so on
+func validateGeoCoordinates(val interface{}, depth int) error {
+	if depth == 0 {
+		_, _, err := geoPosition(val)
+		return err
+	}
+	list, ok := val.([]interface{})
+	if !ok || len(list) == 0 {
+		return errors.New("coordinates must be a non-empty array")
+	}
+	for _, elem := range list {
+		if err := validateGeoCoordinates(elem, depth-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var geoDepths = map[string]int{
+	"Point":           0,
+	"MultiPoint":      1,
+	"LineString":      1,
+	"MultiLineString": 2,
+	"Polygon":         2,
+	"MultiPolygon":    3,
+}
+
+func validateGeoJSON(geo map[string]interface{}) error {
+	geoType, _ := geo["type"].(string)
+	if geoType == "GeometryCollection" {
+		geometries, ok := geo["geometries"].([]interface{})
+		if !ok {
+			return errors.New("geometry collection must have geometries")
+		}
+		for _, g := range geometries {
+			m, ok := g.(map[string]interface{})
+			if !ok {
+				return errors.New("geometry must be an object")
+			}
+			if err := validateGeoJSON(m); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	depth, ok := geoDepths[geoType]
+	if !ok {
+		return fmt.Errorf("unsupported geometry type %v", geo["type"])
+	}
+	if err := validateGeoCoordinates(geo["coordinates"], depth); err != nil {
+		return err
+	}
+	if geoType == "Polygon" || geoType == "MultiPolygon" {
+		polygons := []interface{}{geo["coordinates"]}
+		if geoType == "MultiPolygon" {
+			polygons = geo["coordinates"].([]interface{})
+		}
+		for _, polygon := range polygons {
+			for _, ring := range polygon.([]interface{}) {
+				positions := ring.([]interface{})
+				if len(positions) < 4 || fmt.Sprint(positions[0]) != fmt.Sprint(positions[len(positions)-1]) {
+					return errors.New("polygon rings must be closed with at least 4 positions")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// convert turns GeoJSON or a legacy [lon, lat] pair into an Elasticsearch
+// geo_point or geo_shape value
+func (g *geoField) convert(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case []interface{}:
+		lon, lat, err := geoPosition(v)
+		if err != nil {
+			return nil, err
+		}
+		if g.Type == "geo_point" {
+			return map[string]interface{}{"lat": lat, "lon": lon}, nil
+		}
+		return map[string]interface{}{"type": "Point", "coordinates": []interface{}{lon, lat}}, nil
+	case map[string]interface{}:
+		if err := validateGeoJSON(v); err != nil {
+			return nil, err
+		}
+		if g.Type == "geo_shape" {
+			return v, nil
+		}
+		if v["type"] != "Point" {
+			return nil, fmt.Errorf("geo_point requires a Point but got %v", v["type"])
+		}
+		lon, lat, _ := geoPosition(v["coordinates"])
+		return map[string]interface{}{"lat": lat, "lon": lon}, nil
+	}
+	return nil, fmt.Errorf("unsupported geo value %v", val)
+}
+
+// convertGeoFields applies the geo fields of the namespace.  ok is false when
+// a field with the skip-document policy is malformed
+func convertGeoFields(op *gtm.Op) (ok bool) {
+	for _, g := range geoFields[op.Namespace] {
+		parent, name, ok := fieldParent(op.Data, g.Field)
+		if !ok {
+			continue
+		}
+		val, exists := parent[name]
+		if !exists || val == nil {
+			continue
+		}
+		out, err := g.convert(val)
+		if err == nil {
+			parent[name] = out
+			continue
+		}
+		switch g.OnError {
+		case "keep":
+		case "null":
+			parent[name] = nil
+		case "skip-document":
+			logWith(warnLog, opLogFields(op), "Skipping document %v in %s: invalid geometry in %s: %s", op.Id, op.Namespace, g.Field, err)
+			return false
+		default:
+			delete(parent, name)
+		}
+	}
+	return true
+}
+
+func appendCopyValues(values []interface{}, val interface{}) []interface{} {
+	switch v := val.(type) {
+	case nil, map[string]interface{}:
+	case []interface{}:
+		for _, elem := range v {
+			values = appendCopyValues(values, elem)
+		}
+	case string:
+		if v != "" {
+			values = append(values, v)
+		}
+	default:
+		values = append(values, fmt.Sprintf("%v", v))
+	}
+	return values
+}
+
+// enrichDocument sets the enrichment targets of the namespace to the
+// reference documents matching the keys in their fields
+func enrichDocument(op *gtm.Op) {
+	for _, e := range enrichments[op.Namespace] {
+		val, ok := fieldValue(op.Data, e.Field)
+		if !ok {
+			continue
+		}
+		if keys, isArray := val.([]interface{}); isArray {
+			var docs []interface{}
+			for _, key := range keys {
+				if doc := references.Get(e.Reference, key); doc != nil {
+					docs = append(docs, e.project(doc))
+				}
+			}
+			if docs != nil {
+				op.Data[e.Target] = docs
+			}
+		} else if doc := references.Get(e.Reference, val); doc != nil {
+			op.Data[e.Target] = e.project(doc)
+		}
+	}
+}
+
+// project copies the enrichment fields of a reference document so that the
+// cached document is never changed while indexing
+func (e *enrichment) project(doc map[string]interface{}) map[string]interface{} {
+	if len(e.Fields) == 0 {
+		return cloneReferenceValue(doc).(map[string]interface{})
+	}
+	out := make(map[string]interface{}, len(e.Fields))
+	for _, field := range e.Fields {
+		if val, ok := doc[field]; ok {
+			out[field] = cloneReferenceValue(val)
+		}
+	}
+	return out
+}
+
+func cloneReferenceValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			out[k] = cloneReferenceValue(e)
+		}
+		return out
+	case bson.M:
+		return cloneReferenceValue(map[string]interface{}(v))
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, e := range v {
+			out[i] = cloneReferenceValue(e)
+		}
+		return out
+	}
+	return val
+}
+
+// Get returns the cached document of a reference namespace with the key or
+// nil.  The document is shared and must not be changed
+func (rc *referenceCache) Get(namespace string, key interface{}) map[string]interface{} {
+	if rc == nil {
+		return nil
+	}
+	rc.lock.RLock()
+	defer rc.lock.RUnlock()
+	if c := rc.collections[namespace]; c != nil {
+		return c.byKey[monstachemap.LookupKey(key)]
+	}
+	return nil
+}
+
+func (rc *referenceCache) put(c *referenceCollection, doc map[string]interface{}) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	id := monstachemap.LookupKey(doc["_id"])
+	if old := c.byID[id]; old != nil {
+		if key, ok := fieldValue(old, c.Key); ok {
+			delete(c.byKey, monstachemap.LookupKey(key))
+		}
+	} else if len(c.byID) >= c.MaxDocs {
+		warnLog.Printf("Reference %s exceeds %d documents. Document %v not cached.", c.Namespace, c.MaxDocs, doc["_id"])
+		return
+	}
+	c.byID[id] = doc
+	if key, ok := fieldValue(doc, c.Key); ok {
+		c.byKey[monstachemap.LookupKey(key)] = doc
+	}
+}
+
+func (rc *referenceCache) remove(c *referenceCollection, id interface{}) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	id = monstachemap.LookupKey(id)
+	if old := c.byID[id]; old != nil {
+		delete(c.byID, id)
+		if key, ok := fieldValue(old, c.Key); ok {
+			delete(c.byKey, monstachemap.LookupKey(key))
+		}
+	}
+}
+
+func (rc *referenceCache) reset(c *referenceCollection) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	c.byID = make(map[interface{}]map[string]interface{})
+	c.byKey = make(map[interface{}]map[string]interface{})
+}
+
+// load reads all documents of a reference collection into the cache
+func (rc *referenceCache) load(s *mgo.Session, c *referenceCollection) error {
+	rc.reset(c)
+	iter := s.DB(c.db).C(c.col).Find(nil).Limit(c.MaxDocs + 1).Iter()
+	doc := make(map[string]interface{})
+	for iter.Next(&doc) {
+		rc.put(c, doc)
+		doc = make(map[string]interface{})
+	}
+	return iter.Close()
+}
+
+// start preloads the reference collections and keeps them current with
+// change streams
+func (rc *referenceCache) start(mongo *mgo.Session) {
+	if rc == nil {
+		return
+	}
+	for _, c := range rc.collections {
+		s := mongo.Copy()
+		if err := rc.load(s, c); err != nil {
+			errorLog.Printf("Unable to load reference %s: %s", c.Namespace, err)
+		} else {
+			infoLog.Printf("Loaded %d documents of reference %s", len(c.byID), c.Namespace)
+		}
+		s.Close()
+		go rc.watch(mongo, c)
+	}
+}
+
+type referenceChange struct {
+	OperationType string                 `bson:"operationType"`
+	FullDocument  map[string]interface{} `bson:"fullDocument"`
+	DocumentKey   map[string]interface{} `bson:"documentKey"`
+}
+
+// watch applies the changes of a reference collection.  The collection is
+// loaded again each time the change stream is opened again
+func (rc *referenceCache) watch(mongo *mgo.Session, c *referenceCollection) {
+	reload := false
+	for {
+		s := mongo.Copy()
+		stream, err := s.DB(c.db).C(c.col).Watch([]bson.M{}, mgo.ChangeStreamOptions{
+			FullDocument:   mgo.UpdateLookup,
+			MaxAwaitTimeMS: time.Minute,
+		})
+		if err == nil && reload {
+			err = rc.load(s, c)
+		}
+		if err == nil {
+			reload = true
+			for {
+				var change referenceChange
+				if stream.Next(&change) {
+					rc.apply(c, &change)
+				} else if !stream.Timeout() {
+					break
+				}
+			}
+			err = stream.Err()
+		}
+		if stream != nil {
+			stream.Close()
+		}
+		s.Close()
+		if err != nil {
+			errorLog.Printf("Unable to watch reference %s: %s", c.Namespace, err)
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+func (rc *referenceCache) apply(c *referenceCollection, change *referenceChange) {
+	switch change.OperationType {
+	case "insert", "update", "replace":
+		if change.FullDocument != nil {
+			rc.put(c, change.FullDocument)
+		}
+	case "delete":
+		rc.remove(c, change.DocumentKey["_id"])
+	case "drop":
+		rc.reset(c)
+	}
+}
+
+// copyFieldValues fills the copy field targets of the namespace.  Targets
+// shared by several rules accumulate the values of all of them
+func copyFieldValues(op *gtm.Op) {
+	for _, c := range copyFields[op.Namespace] {
+		values, _ := op.Data[c.Target].([]interface{})
+		for _, field := range c.Fields {
+			if val, ok := fieldValue(op.Data, field); ok {
+				values = appendCopyValues(values, val)
+			}
+		}
+		if len(values) > 0 {
+			op.Data[c.Target] = values
+		}
+	}
+}
+
+// fieldParent returns the document holding the last segment of a dotted path
+func fieldParent(doc map[string]interface{}, path string) (parent map[string]interface{}, name string, ok bool) {
+	segs := strings.Split(path, ".")
+	parent = doc
+	for _, seg := range segs[:len(segs)-1] {
+		if parent, ok = parent[seg].(map[string]interface{}); !ok {
+			return
+		}
+	}
+	return parent, segs[len(segs)-1], true
+}
+
+func jsonSize(val interface{}) int {
+	b, err := json.Marshal(val)
+	if err != nil {
+		return 0
+	}
+	return len(b)
+}
+
+// truncateString cuts a string by about excess bytes on a rune boundary
+func truncateString(str string, excess int) string {
+	n := len(str) - excess
+	if n <= 0 {
+		return ""
+	}
+	for n > 0 && !utf8.RuneStart(str[n]) {
+		n--
+	}
+	return str[:n]
+}
+
+// enforce shrinks a document to max-bytes.  The paths of changed fields are
+// recorded in _truncated_fields.  ok is false when the document still does
+// not fit
+func (ds *documentSize) enforce(doc map[string]interface{}) (truncated []string, ok bool) {
+	size := jsonSize(doc)
+	if size <= ds.MaxBytes {
+		return nil, true
+	}
+	type candidate struct {
+		path string
+		size int
+	}
+	var candidates []candidate
+	if len(ds.Fields) > 0 {
+		for _, field := range ds.Fields {
+			if val, exists := fieldValue(doc, field); exists {
+				candidates = append(candidates, candidate{field, jsonSize(val)})
+			}
+		}
+	} else {
+		for field, val := range doc {
+			candidates = append(candidates, candidate{field, jsonSize(val)})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].size > candidates[j].size
+	})
+	for _, c := range candidates {
+		parent, name, _ := fieldParent(doc, c.path)
+		str, isStr := parent[name].(string)
+		// leave room for the path in the _truncated_fields marker
+		excess := size - ds.MaxBytes + len(`,"_truncated_fields":[""]`) + len(c.path)
+		if ds.Action == "truncate" && isStr && excess < len(str) {
+			parent[name] = truncateString(str, excess)
+		} else {
+			delete(parent, name)
+		}
+		truncated = append(truncated, c.path)
+		doc["_truncated_fields"] = truncated
+		if size = jsonSize(doc); size <= ds.MaxBytes {
+			break
+		}
+	}
+	return truncated, size <= ds.MaxBytes
+}
+
+// limitDocumentSize applies the document size limit of the namespace.  ok is
+// false when the document cannot be made to fit
+func limitDocumentSize(op *gtm.Op) (ok bool) {
+	ds := documentSizes[op.Namespace]
+	if ds == nil {
+		return true
+	}
+	truncated, ok := ds.enforce(op.Data)
+	if len(truncated) > 0 {
+		atomic.AddInt64(&documentsTruncated, 1)
+		logWith(warnLog, opLogFields(op), "Truncated fields %v of document %v in %s to fit %d bytes", truncated, op.Id, op.Namespace, ds.MaxBytes)
+	}
+	if !ok {
+		logWith(errorLog, opLogFields(op), "Skipping document %v in %s: larger than %d bytes after truncation", op.Id, op.Namespace, ds.MaxBytes)
+	}
+	return
+}
+
+func (config *configOptions) loadOffloads() {
+	for _, o := range config.Offload {
+		if o.Namespace == "" || len(o.Fields) == 0 {
+			panic("Offloads must specify namespace and fields")
+		}
+		if _, exists := offloads[o.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple offloads with namespace: %s", o.Namespace))
+		}
+		if o.MinBytes < 0 || o.PreviewBytes < 0 {
+			panic(fmt.Sprintf("Offload min-bytes and preview-bytes for %s must not be negative", o.Namespace))
+		}
+		of := o
+		if of.PreviewBytes == 0 {
+			of.PreviewBytes = offloadPreviewBytesDefault
+		}
+		offloads[o.Namespace] = &of
+	}
+}
+
+// apply replaces the fields of a document larger than min-bytes with
+// pointers to their objects in the store and returns the objects to upload
+func (of *offload) apply(store *offloadStore, op *gtm.Op) (objects []*offloadObject) {
+	if op.Data == nil || jsonSize(op.Data) <= of.MinBytes {
+		return
+	}
+	id := opIDToString(op)
+	for _, field := range of.Fields {
+		parent, name, ok := fieldParent(op.Data, field)
+		if !ok || parent[name] == nil {
+			continue
+		}
+		obj, preview := offloadValue(parent[name], of.PreviewBytes)
+		if obj == nil {
+			continue
+		}
+		obj.key = store.key(op.Namespace, id, field)
+		pointer := map[string]interface{}{
+			"url":          store.url(obj.key),
+			"bytes":        len(obj.body),
+			"content_type": obj.contentType,
+		}
+		if preview != "" {
+			pointer["preview"] = preview
+		}
+		parent[name] = pointer
+		objects = append(objects, obj)
+	}
+	return
+}
+
+// offloadValue encodes a field for upload.  Strings are stored as text,
+// binary as is and anything else as JSON.  The preview is the start of the
+// text of strings and JSON
+func offloadValue(val interface{}, previewBytes int) (obj *offloadObject, preview string) {
+	var text string
+	switch v := val.(type) {
+	case string:
+		obj = &offloadObject{contentType: "text/plain; charset=utf-8", body: []byte(v)}
+		text = v
+	case []byte:
+		return &offloadObject{contentType: "application/octet-stream", body: v}, ""
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, ""
+		}
+		obj = &offloadObject{contentType: "application/json", body: data}
+		text = string(data)
+	}
+	if len(text) > previewBytes {
+		text = truncateString(text, len(text)-previewBytes)
+	}
+	return obj, text
+}
+
+func (st *offloadStore) enabled() bool {
+	return st != nil && st.Bucket != ""
+}
+
+func (st *offloadStore) validate() error {
+	if st.Region == "" && st.Endpoint == "" {
+		return errors.New("Offload store must specify region or endpoint")
+	}
+	return nil
+}
+
+func (st *offloadStore) start() (err error) {
+	st.s3, err = newS3(st.AccessKey, st.SecretKey, st.Region, st.Endpoint, st.ForcePathStyle)
+	return
+}
+
+// key is the object name of a field of a document
+func (st *offloadStore) key(ns, id, field string) string {
+	return fmt.Sprintf("%s%s/%s/%s", st.Prefix, ns, url.PathEscape(id), field)
+}
+
+// url is the pointer to an object.  It is an s3 URL unless url-prefix is
+// set, for example to a CDN or a public bucket endpoint
+func (st *offloadStore) url(key string) string {
+	if st.URLPrefix != "" {
+		return st.URLPrefix + key
+	}
+	return fmt.Sprintf("s3://%s/%s", st.Bucket, key)
+}
+
+// upload stores the offloaded fields of a document before the pointers to
+// them are indexed
+func (st *offloadStore) upload(objects []*offloadObject) error {
+	for _, obj := range objects {
+		_, err := st.s3.PutObject(&s3.PutObjectInput{
+			Bucket:      aws.String(st.Bucket),
+			Key:         aws.String(obj.key),
+			Body:        bytes.NewReader(obj.body),
+			ContentType: aws.String(obj.contentType),
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to offload %s: %s", obj.key, err)
+		}
+	}
+	return nil
+}
+
+// remove deletes the offloaded fields of a deleted document.  Objects which
+// were never offloaded are deleted without error
+func (st *offloadStore) remove(ns, id string) {
+	of := offloads[ns]
+	if of == nil || !st.enabled() {
+		return
+	}
+	for _, field := range of.Fields {
+		key := st.key(ns, id, field)
+		_, err := st.s3.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(st.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			errorLog.Printf("Unable to delete offloaded %s: %s", key, err)
+		}
+	}
+}
+
+// text joins the string values of the source fields of a document
+func (e *embedding) text(doc map[string]interface{}) string {
+	var parts []string
+	for _, field := range e.Fields {
+		if val, ok := fieldValue(doc, field); ok {
+			if str := strings.TrimSpace(fmt.Sprintf("%v", val)); str != "" {
+				parts = append(parts, str)
+			}
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+func (e *embedding) start() {
+	e.requests = make(chan *embeddingRequest, e.BatchSize)
+	e.client = &http.Client{Timeout: time.Duration(e.TimeoutSeconds) * time.Second}
+	e.cache = make(map[string][]float64)
+	go e.batch()
+}
+
+// batch groups requests until the batch is full or batch-ms have passed
+// since the first request of the batch and then fetches the whole batch
+func (e *embedding) batch() {
+	for req := range e.requests {
+		batch := []*embeddingRequest{req}
+		timer := time.NewTimer(time.Duration(e.BatchMs) * time.Millisecond)
+	collect:
+		for len(batch) < e.BatchSize {
+			select {
+			case next := <-e.requests:
+				batch = append(batch, next)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		texts := make([]string, len(batch))
+		for i, r := range batch {
+			texts[i] = r.text
+		}
+		vectors, err := e.fetch(texts)
+		for i, r := range batch {
+			if err != nil {
+				r.result <- embeddingResult{err: err}
+			} else {
+				r.result <- embeddingResult{vector: vectors[i]}
+			}
+		}
+	}
+}
+
+// fetch calls an OpenAI compatible embeddings endpoint
+func (e *embedding) fetch(texts []string) (vectors [][]float64, err error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"model": e.Model,
+		"input": texts,
+	})
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("POST", e.URL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+e.APIKey)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Embedding endpoint returned status %d", resp.StatusCode)
+	}
+	var result struct {
+		Data []struct {
+			Index     int
+			Embedding []float64
+		}
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return
+	}
+	if len(result.Data) != len(texts) {
+		return nil, fmt.Errorf("Embedding endpoint returned %d vectors for %d inputs", len(result.Data), len(texts))
+	}
+	vectors = make([][]float64, len(texts))
+	for _, d := range result.Data {
+		if d.Index < 0 || d.Index >= len(texts) {
+			return nil, fmt.Errorf("Embedding endpoint returned invalid index %d", d.Index)
+		}
+		if e.Dims > 0 && len(d.Embedding) != e.Dims {
+			return nil, fmt.Errorf("Embedding endpoint returned %d dims but %d are configured", len(d.Embedding), e.Dims)
+		}
+		vectors[d.Index] = d.Embedding
+	}
+	return
+}
+
+// embed returns the vector for a document.  vector is nil when the document
+// has no text in the source fields
+func (e *embedding) embed(doc map[string]interface{}) (vector []float64, err error) {
+	text := e.text(doc)
+	if text == "" {
+		return
+	}
+	e.once.Do(e.start)
+	sum := sha256.Sum256([]byte(e.Model + "\x00" + text))
+	key := hex.EncodeToString(sum[:])
+	e.cacheMutex.Lock()
+	vector = e.cache[key]
+	e.cacheMutex.Unlock()
+	if vector != nil {
+		return
+	}
+	req := &embeddingRequest{text: text, result: make(chan embeddingResult, 1)}
+	e.requests <- req
+	res := <-req.result
+	if res.err != nil {
+		return nil, res.err
+	}
+	e.cacheMutex.Lock()
+	if len(e.cache) >= e.CacheSize {
+		e.cache = make(map[string][]float64)
+	}
+	e.cache[key] = res.vector
+	e.cacheMutex.Unlock()
+	return res.vector, nil
+}
+
+// embedFields adds the configured vectors to a document.  ok is false when
+// an embedding with the skip-document policy fails
+func embedFields(op *gtm.Op) (ok bool) {
+	for _, e := range embeddings[op.Namespace] {
+		vector, err := e.embed(op.Data)
+		if err != nil {
+			if e.OnError == "skip-document" {
+				logWith(warnLog, opLogFields(op), "Skipping document %v in %s: unable to embed %s: %s", op.Id, op.Namespace, e.Target, err)
+				return false
+			}
+			logWith(warnLog, opLogFields(op), "Indexing document %v in %s without %s: %s", op.Id, op.Namespace, e.Target, err)
+			continue
+		}
+		if vector != nil {
+			op.Data[e.Target] = vector
+		}
+	}
+	return true
+}
+
+func newTikaClient(config *configOptions) *tikaClient {
+	return &tikaClient{
+		url:      strings.TrimRight(config.TikaURL, "/"),
+		maxBytes: config.TikaMaxBytes,
+		client:   &http.Client{Timeout: time.Duration(config.TikaTimeoutSeconds) * time.Second},
+		slots:    make(chan struct{}, config.TikaConcurrency),
+	}
+}
+
+// extract sends size bytes of content to Tika and returns the text and the
+// metadata Tika extracted.  A negative size means the size is unknown.  At
+// most tika-concurrency extractions run at once
+func (t *tikaClient) extract(r io.Reader, size int64) (map[string]interface{}, error) {
+	t.slots <- struct{}{}
+	defer func() { <-t.slots }()
+	req, err := http.NewRequest("PUT", t.url+"/rmeta/text", r)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Tika returned status %d", resp.StatusCode)
+	}
+	var docs []map[string]interface{}
+	if err = json.NewDecoder(resp.Body).Decode(&docs); err != nil {
+		return nil, err
+	}
+	return tikaAttachment(docs), nil
+}
+
+// tikaAttachment builds the attachment field from the recursive metadata of
+// Tika.  The first document is the file itself; the others are embedded
+// documents whose text is appended.  The fields are named like those of the
+// attachment ingest processor
+func tikaAttachment(docs []map[string]interface{}) map[string]interface{} {
+	metadata := make(map[string]interface{})
+	var content []string
+	var contentType interface{}
+	for i, doc := range docs {
+		if text, ok := doc["X-TIKA:content"].(string); ok && strings.TrimSpace(text) != "" {
+			content = append(content, strings.TrimSpace(text))
+		}
+		if i > 0 {
+			continue
+		}
+		for k, v := range doc {
+			if strings.HasPrefix(k, "X-TIKA:") || strings.HasPrefix(k, "X-Parsed-By") {
+				continue
+			}
+			metadata[k] = v
+		}
+		contentType = doc["Content-Type"]
+	}
+	text := strings.Join(content, "\n")
+	return map[string]interface{}{
+		"content":        text,
+		"content_type":   contentType,
+		"content_length": len(text),
+		"metadata":       metadata,
+	}
+}
+
+// detectLanguage returns the ISO 639-1 code of the language of text
+func (t *tikaClient) detectLanguage(text string) (string, error) {
+	t.slots <- struct{}{}
+	defer func() { <-t.slots }()
+	req, err := http.NewRequest("PUT", t.url+"/language/string", strings.NewReader(text))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=UTF-8")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Tika returned status %d", resp.StatusCode)
+	}
+	code, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64))
+	return strings.TrimSpace(string(code)), err
+}
+
+// extractFile extracts a GridFS file in place of encoding it for the
+// attachment pipeline
+func (t *tikaClient) extractFile(file *mgo.GridFile) (map[string]interface{}, error) {
+	if t.maxBytes > 0 && file.Size() > t.maxBytes {
+		return nil, fmt.Errorf("File %s of %d bytes exceeds tika-max-bytes", file.Name(), file.Size())
+	}
+	return t.extract(file, file.Size())
+}
+
+// extractURL downloads the content at a URL and extracts it
+func (t *tikaClient) extractURL(url string) (map[string]interface{}, error) {
+	resp, err := t.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Download of %s returned status %d", url, resp.StatusCode)
+	}
+	if t.maxBytes > 0 && resp.ContentLength > t.maxBytes {
+		return nil, fmt.Errorf("Content of %s of %d bytes exceeds tika-max-bytes", url, resp.ContentLength)
+	}
+	if t.maxBytes > 0 {
+		// read one byte more than allowed to detect larger content
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, t.maxBytes+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > t.maxBytes {
+			return nil, fmt.Errorf("Content of %s exceeds tika-max-bytes", url)
+		}
+		return t.extract(bytes.NewReader(data), int64(len(data)))
+	}
+	return t.extract(resp.Body, resp.ContentLength)
+}
+
+// extractTikaFields sets the target of each Tika field of the namespace to
+// the content extracted from the URL in its field.  Documents whose content
+// cannot be extracted are indexed without it
+func extractTikaFields(op *gtm.Op) {
+	for _, tf := range tikaFields[op.Namespace] {
+		val, ok := fieldValue(op.Data, tf.Field)
+		url, isString := val.(string)
+		if !ok || !isString || url == "" {
+			continue
+		}
+		attachment, err := tika.extractURL(url)
+		if err != nil {
+			logWith(warnLog, opLogFields(op), "Indexing document %v in %s without %s: %s", op.Id, op.Namespace, tf.Target, err)
+			continue
+		}
+		op.Data[tf.Target] = attachment
+	}
+}
+
+func excludeFields(op *gtm.Op) {
+	fields, ok := fieldExclusions[op.Namespace]
+	if !ok {
+		fields = fieldExclusions[""]
+	}
+	for _, path := range fields {
+		removeField(op.Data, path)
+	}
+}
+
+// piiPatterns detect PII in text.  ssn is a US social security number and
+// nino a UK national insurance number
+var piiPatterns = []struct {
+	name    string
+	pattern string
+}{
+	{"email", `[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`},
+	{"ssn", `\b\d{3}-\d{2}-\d{4}\b`},
+	{"nino", `\b[A-CEGHJ-PR-TW-Z]{2} ?\d{2} ?\d{2} ?\d{2} ?[A-D]\b`},
+	{"phone", `(?:\+\d{1,3}[\s.-]?)?(?:\(\d{3}\)|\b\d{3})[\s.-]?\d{3}[\s.-]?\d{4}\b`},
+}
+
+// compile joins the detectors of the scan into one expression with a named
+// group per detector so that text is scanned once
+func (p *piiScan) compile() error {
+	if len(p.Detectors) == 0 {
+		for _, d := range piiPatterns {
+			p.Detectors = append(p.Detectors, d.name)
+		}
+	}
+	var groups []string
+	for _, d := range piiPatterns {
+		for _, name := range p.Detectors {
+			if name == d.name {
+				groups = append(groups, fmt.Sprintf("(?P<%s>%s)", d.name, d.pattern))
+			}
+		}
+	}
+	if len(groups) != len(p.Detectors) {
+		return fmt.Errorf("PII detectors for %s must be some of email, ssn, nino or phone", p.Namespace)
+	}
+	p.re = regexp.MustCompile(strings.Join(groups, "|"))
+	for _, a := range p.Allow {
+		re, err := regexp.Compile("^(?:" + a + ")$")
+		if err != nil {
+			return fmt.Errorf("Invalid PII allow pattern %s for %s: %s", a, p.Namespace, err)
+		}
+		p.allow = append(p.allow, re)
+	}
+	return nil
+}
+
+// scan replaces the PII in text which is not allowed
+func (p *piiScan) scan(text string) string {
+	matches := p.re.FindAllStringSubmatchIndex(text, -1)
+	if len(matches) == 0 {
+		return text
+	}
+	names := p.re.SubexpNames()
+	var b strings.Builder
+	last := 0
+	for _, m := range matches {
+		value := text[m[0]:m[1]]
+		b.WriteString(text[last:m[0]])
+		last = m[1]
+		if p.allowed(value) {
+			b.WriteString(value)
+			continue
+		}
+		kind := ""
+		for i := 1; i < len(names); i++ {
+			if m[2*i] >= 0 {
+				kind = names[i]
+				break
+			}
+		}
+		b.WriteString(p.token(kind, value))
+	}
+	b.WriteString(text[last:])
+	return b.String()
+}
+
+func (p *piiScan) allowed(value string) bool {
+	for _, re := range p.allow {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// token is a keyed hash of the normalized value, so that the same email
+// or number written differently yields the same token
+func (p *piiScan) token(kind, value string) string {
+	if kind == "email" {
+		value = strings.ToLower(value)
+	} else {
+		value = strings.Map(func(r rune) rune {
+			if unicode.IsDigit(r) || unicode.IsUpper(r) {
+				return r
+			}
+			return -1
+		}, value)
+	}
+	mac := hmac.New(sha256.New, []byte(p.Salt))
+	mac.Write([]byte(kind + ":" + value))
+	sum := hex.EncodeToString(mac.Sum(nil))
+	if p.Action == "hash" {
+		return sum
+	}
+	return "<" + kind + ":" + sum[:16] + ">"
+}
+
+func (p *piiScan) scanField(val interface{}, path []string) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		child, ok := v[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) > 1 {
+			p.scanField(child, path[1:])
+		} else {
+			v[path[0]] = p.scanValue(child)
+		}
+	case []interface{}:
+		for _, elem := range v {
+			p.scanField(elem, path)
+		}
+	}
+}
+
+// scanValue replaces the PII of a string or of the strings of an array
+func (p *piiScan) scanValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case string:
+		return p.scan(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, elem := range v {
+			out[i] = p.scanValue(elem)
+		}
+		return out
+	}
+	return val
+}
+
+// scanPII replaces the PII in the text fields of a document
+func scanPII(ns string, doc map[string]interface{}) {
+	for _, p := range piiScans[ns] {
+		for _, path := range p.paths {
+			p.scanField(doc, path)
+		}
+	}
+}
+
+// redactFields applies the redactions of a namespace to a document.  It runs
+// after mapping and every other field setting, just before the document is
+// handed to Elasticsearch and the sinks
+func redactFields(ns string, doc map[string]interface{}) {
+	for _, r := range redactions[ns] {
+		for _, path := range r.paths {
+			r.redact(doc, path)
+		}
+	}
+}
+
+func (r *fieldRedaction) redact(val interface{}, path []string) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		child, ok := v[path[0]]
+		if !ok {
+			return
+		}
+		if len(path) > 1 {
+			r.redact(child, path[1:])
+		} else if r.Action == "drop" {
+			delete(v, path[0])
+		} else {
+			v[path[0]] = r.replace(child)
+		}
+	case []interface{}:
+		for _, elem := range v {
+			r.redact(elem, path)
+		}
+	}
+}
+
+// replace hashes or masks a value.  Arrays are replaced element by element
+// so that equal elements still hash alike
+func (r *fieldRedaction) replace(val interface{}) interface{} {
+	if val == nil {
+		return nil
+	}
+	if a, ok := val.([]interface{}); ok {
+		out := make([]interface{}, len(a))
+		for i, elem := range a {
+			out[i] = r.replace(elem)
+		}
+		return out
+	}
+	text, ok := val.(string)
+	if !ok {
+		if b, err := json.Marshal(val); err == nil {
+			text = string(b)
+		} else {
+			text = fmt.Sprintf("%v", val)
+		}
+	}
+	if r.Action == "hash" {
+		mac := hmac.New(sha256.New, []byte(r.Salt))
+		mac.Write([]byte(text))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	runes := []rune(text)
+	keep := r.KeepLast
+	if keep >= len(runes) {
+		keep = 0
+	}
+	return strings.Repeat("*", len(runes)-keep) + string(runes[len(runes)-keep:])
+}
+
+// redactChanges returns a copy of an update description with the PII scans
+// and redactions of the namespace applied to its dotted updatedFields.
+// Array indexes in the dotted names are ignored when matching fields
+func redactChanges(ns string, changes map[string]interface{}) map[string]interface{} {
+	rs, scans := redactions[ns], piiScans[ns]
+	updated, ok := changes["updatedFields"].(map[string]interface{})
+	if len(rs)+len(scans) == 0 || !ok {
+		return changes
+	}
+	fields := make(map[string]interface{}, len(updated))
+	keyParts := make(map[string][]string, len(updated))
+	for k, v := range updated {
+		fields[k] = copyValue(v)
+		for _, part := range strings.Split(k, ".") {
+			if _, err := strconv.Atoi(part); err != nil {
+				keyParts[k] = append(keyParts[k], part)
+			}
+		}
+	}
+	for _, p := range scans {
+		for _, path := range p.paths {
+			for key, parts := range keyParts {
+				if hasPathPrefix(parts, path) {
+					fields[key] = p.scanValue(fields[key])
+				} else if hasPathPrefix(path, parts) {
+					holder := map[string]interface{}{key: fields[key]}
+					p.scanField(holder, append([]string{key}, path[len(parts):]...))
+					fields[key] = holder[key]
+				}
+			}
+		}
+	}
+	for _, r := range rs {
+		for _, path := range r.paths {
+			for key, parts := range keyParts {
+				v, ok := fields[key]
+				if !ok {
+					continue
+				}
+				if hasPathPrefix(parts, path) {
+					// the field is the redacted field or inside it
+					if r.Action == "drop" {
+						delete(fields, key)
+					} else {
+						fields[key] = r.replace(v)
+					}
+				} else if hasPathPrefix(path, parts) {
+					holder := map[string]interface{}{key: v}
+					r.redact(holder, append([]string{key}, path[len(parts):]...))
+					fields[key] = holder[key]
+				}
+			}
+		}
+	}
+	out := make(map[string]interface{}, len(changes))
+	for k, v := range changes {
+		out[k] = v
+	}
+	out["updatedFields"] = fields
+	return out
+}
+
+func hasPathPrefix(path, prefix []string) bool {
+	if len(prefix) > len(path) {
+		return false
+	}
+	for i := range prefix {
+		if path[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// documentVersion reads an external version from a (possibly dotted) field
+// of a document.  Dates are converted to milliseconds since the epoch
+func documentVersion(doc map[string]interface{}, field string) (version int64, ok bool) {
+	val, ok := fieldValue(doc, field)
+	if !ok {
+		return
+	}
+	switch v := val.(type) {
+	case int:
+		version = int64(v)
+	case int32:
+		version = int64(v)
+	case int64:
+		version = v
+	case float64:
+		version = int64(v)
+	case bson.MongoTimestamp:
+		version = int64(v)
+	case time.Time:
+		version = v.UnixNano() / int64(time.Millisecond)
+	case string:
+		var err error
+		version, err = strconv.ParseInt(v, 10, 64)
+		ok = err == nil
+	default:
+		ok = false
+	}
+	if version < 0 {
+		ok = false
+	}
+	return
+}
+
+func parseIndexMeta(op *gtm.Op) (meta *indexingMeta) {
+	meta = &indexingMeta{
+		Version:     int64(op.Timestamp),
+		VersionType: "external",
+	}
+	if ip := namespacePipeline(op.Namespace); ip != nil {
+		meta.Pipeline = ip.Name
+	}
+	if re := namespaceRouting(op.Namespace); re != nil {
+		if routing, err := re.eval(op.Data); err == nil {
+			meta.Routing = routing
+		} else {
+			logWith(warnLog, opLogFields(op), "Unable to route document %v in %s: %s", op.Id, op.Namespace, err)
+		}
+	}
+	if vf := versionFields[op.Namespace]; vf != nil {
+		if version, ok := documentVersion(op.Data, vf.Field); ok {
+			meta.Version, meta.VersionType = version, vf.VersionType
+		} else {
+			warnLog.Printf("Document %v in %s has no valid version in field %s. Indexing without a version.",
+				op.Id, op.Namespace, vf.Field)
+			meta.Version, meta.VersionType = 0, ""
+		}
+	}
+	if m, ok := op.Data["_meta_monstache"]; ok {
+		switch m.(type) {
+		case map[string]interface{}:
+			metaAttrs := m.(map[string]interface{})
+			meta.load(metaAttrs)
+		case otto.Value:
+			ex, err := m.(otto.Value).Export()
+			if err == nil && ex != m {
+				switch ex.(type) {
+				case map[string]interface{}:
+					metaAttrs := ex.(map[string]interface{})
+					meta.load(metaAttrs)
+				default:
+					errorLog.Println("Invalid indexing metadata")
+				}
+			}
+		default:
+			errorLog.Println("Invalid indexing metadata")
+		}
+	}
+	return meta
+}
+
+func addFileContent(s *mgo.Session, op *gtm.Op, config *configOptions) (err error) {
+	session := s.Copy()
+	defer session.Close()
+	if tika == nil {
+		op.Data["file"] = ""
+	}
+	db, bucket :=
+		session.DB(op.GetDatabase()),
+		strings.SplitN(op.GetCollection(), ".", 2)[0]
+	file, err := db.GridFS(bucket).OpenId(op.Id)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	if config.MaxFileSize > 0 {
+		if file.Size() > config.MaxFileSize {
+			warnLog.Printf("File %s md5(%s) exceeds max file size. file content omitted.",
+				file.Name(), file.MD5())
+			return
+		}
+	}
+	if ff := fileFilters[op.Namespace]; ff != nil {
+		contentType := file.ContentType()
+		if md, ok := op.Data["metadata"].(map[string]interface{}); ok && contentType == "" {
+			contentType, _ = md["contentType"].(string)
+		}
+		if !ff.allows(file.Name(), contentType, file.Size()) {
+			delete(op.Data, "file")
+			return
+		}
+	}
+	if tika != nil {
+		var attachment map[string]interface{}
+		if attachment, err = tika.extractFile(file); err == nil {
+			op.Data["attachment"] = attachment
+		}
+		return
+	}
+	if config.FileChunkBytes > 0 {
+		var chunks []map[string]interface{}
+		if chunks, err = encodeFileChunks(file, file.Size(), config.FileChunkBytes); err == nil {
+			op.Data["file"] = chunks
+		}
+		return
+	}
+	var content string
+	if content, err = encodeFile(file, file.Size()); err == nil {
+		op.Data["file"] = content
+	}
+	return
+}
+
+// encodeFile streams the size bytes of a file into its base64 encoding.
+// The encoding is written into a buffer of its final size so that the
+// file is never held in memory besides its encoding
+func encodeFile(r io.Reader, size int64) (string, error) {
+	var content strings.Builder
+	content.Grow(base64.StdEncoding.EncodedLen(int(size)))
+	encoder := base64.NewEncoder(base64.StdEncoding, &content)
+	buf := make([]byte, fileReadBufferSize)
+	if _, err := io.CopyBuffer(encoder, io.LimitReader(r, size), buf); err != nil {
+		return "", err
+	}
+	if err := encoder.Close(); err != nil {
+		return "", err
+	}
+	return content.String(), nil
+}
+
+// encodeFileChunks splits a file into separately base64 encoded chunks of
+// at most chunkSize bytes for the foreach attachment pipeline
+func encodeFileChunks(r io.Reader, size int64, chunkSize int64) ([]map[string]interface{}, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+	if chunkSize > size {
+		chunkSize = size
+	}
+	var chunks []map[string]interface{}
+	buf := make([]byte, chunkSize)
+	r = io.LimitReader(r, size)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			chunks = append(chunks, map[string]interface{}{
+				"data": base64.StdEncoding.EncodeToString(buf[:n]),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return chunks, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func notMonstache(config *configOptions) gtm.OpFilter {
+	db := config.ConfigDatabaseName
+	return func(op *gtm.Op) bool {
+		return op.GetDatabase() != db
+	}
+}
+
+func notChunks(op *gtm.Op) bool {
+	return !chunksRegex.MatchString(op.GetCollection())
+}
+
+func notConfig(op *gtm.Op) bool {
+	return op.GetDatabase() != "config"
+}
+
+func notSystem(op *gtm.Op) bool {
+	return !systemsRegex.MatchString(op.GetCollection())
+}
+
+// set rebuilds the filter chain from the namespace regexes.  The current
+// chain is kept if any regex is invalid
+func (nf *namespaceFilter) set(config *configOptions) error {
+	regexes := []string{config.NsRegex, config.NsDropRegex, config.NsExcludeRegex, config.NsDropExcludeRegex}
+	for _, regex := range regexes {
+		if _, err := regexp.Compile(regex); err != nil {
+			return fmt.Errorf("Invalid namespace regex %s: %s", regex, err)
+		}
+	}
+	var chain []gtm.OpFilter
+	if config.NsRegex != "" {
+		chain = append(chain, filterWithRegex(config.NsRegex))
+	}
+	if config.NsDropRegex != "" {
+		chain = append(chain, filterDropWithRegex(config.NsDropRegex))
+	}
+	if config.NsExcludeRegex != "" {
+		chain = append(chain, filterInverseWithRegex(config.NsExcludeRegex))
+	}
+	if config.NsDropExcludeRegex != "" {
+		chain = append(chain, filterDropInverseWithRegex(config.NsDropExcludeRegex))
+	}
+	nf.lock.Lock()
+	nf.filter = gtm.ChainOpFilters(chain...)
+	nf.matches = &sync.Map{}
+	atomic.StoreInt32(&nf.cached, 0)
+	nf.lock.Unlock()
+	return nil
+}
+
+// match applies the namespace regexes once per namespace and caches the
+// decision until the regexes change
+func (nf *namespaceFilter) match(op *gtm.Op) bool {
+	nf.lock.RLock()
+	filter, matches := nf.filter, nf.matches
+	nf.lock.RUnlock()
+	if matches == nil {
+		return filter(op)
+	}
+	key := namespaceMatch{op.Namespace, op.IsDrop()}
+	if keep, ok := matches.Load(key); ok {
+		return keep.(bool)
+	}
+	keep := filter(op)
+	if atomic.AddInt32(&nf.cached, 1) <= namespaceMatchCacheSize {
+		matches.Store(key, keep)
+	}
+	return keep
+}
+
+func filterWithRegex(regex string) gtm.OpFilter {
+	var validNameSpace = regexp.MustCompile(regex)
+	return func(op *gtm.Op) bool {
+		if op.IsDrop() {
+			return true
+		}
+		return validNameSpace.MatchString(op.Namespace)
+	}
+}
+
+func filterDropWithRegex(regex string) gtm.OpFilter {
+	var validNameSpace = regexp.MustCompile(regex)
+	return func(op *gtm.Op) bool {
+		if op.IsDrop() {
+			return validNameSpace.MatchString(op.Namespace)
+		}
+		return true
+	}
+}
+
+func filterWithPlugin() gtm.OpFilter {
+	return func(op *gtm.Op) bool {
+		var keep bool = true
+		if (op.IsInsert() || op.IsUpdate()) && op.Data != nil {
+			keep = false
+			input := &monstachemap.MapperPluginInput{
+				Document:          op.Data,
+				Namespace:         op.Namespace,
+				Database:          op.GetDatabase(),
+				Collection:        op.GetCollection(),
+				Operation:         op.Operation,
+				UpdateDescription: op.UpdateDescription,
+			}
+			var ok bool
+			done := metrics.pluginTimer("filter", op.Namespace)
+			err := callPlugin("filter", op, func() (err error) {
+				ok, err = filterPlugin(input)
+				return
+			})
+			done()
+			if err == nil {
+				keep = ok
+			} else {
+				errorLog.Println(err)
+			}
+		}
+		return keep
+	}
+}
+
+func filterWithScript() gtm.OpFilter {
+	return func(op *gtm.Op) bool {
+		var keep = true
+		if (op.IsInsert() || op.IsUpdate()) && op.Data != nil {
+			nss := []string{"", op.Namespace}
+			for _, ns := range nss {
+				if env := filterEnvs[ns]; env != nil {
+					keep = false
+					arg := convertMapJavascript(op.Data)
+					arg2 := op.Namespace
+					arg3 := convertMapJavascript(op.UpdateDescription)
+					env.lock.Lock()
+					defer env.lock.Unlock()
+					val, err := env.VM.Call("module.exports", arg, arg, arg2, arg3)
+					if err != nil {
+						errorLog.Println(err)
+					} else {
+						if ok, err := val.ToBoolean(); err == nil {
+							keep = ok
+						} else {
+							errorLog.Println(err)
+						}
+					}
+				}
+				if !keep {
+					break
+				}
+			}
+		}
+		return keep
+	}
+}
+
+func filterInverseWithRegex(regex string) gtm.OpFilter {
+	var invalidNameSpace = regexp.MustCompile(regex)
+	return func(op *gtm.Op) bool {
+		if op.IsDrop() {
+			return true
+		}
+		return !invalidNameSpace.MatchString(op.Namespace)
+	}
+}
+
+func filterDropInverseWithRegex(regex string) gtm.OpFilter {
+	var invalidNameSpace = regexp.MustCompile(regex)
+	return func(op *gtm.Op) bool {
+		if op.IsDrop() {
+			return !invalidNameSpace.MatchString(op.Namespace)
+		}
+		return true
+	}
+}
+
+func ensureClusterTTL(session *mgo.Session, config *configOptions) error {
+	col := session.DB(config.ConfigDatabaseName).C("cluster")
+	return col.EnsureIndex(mgo.Index{
+		Key:         []string{"expireAt"},
+		Background:  true,
+		ExpireAfter: time.Duration(30) * time.Second,
+	})
+}
+
+// enableProcess takes the lease of the cluster if it is free, expired or
+// already held by this process.  The lease expires on its own so a standby
+// takes over without waiting for the TTL monitor to remove the document
+func enableProcess(s *mgo.Session, config *configOptions) (bool, error) {
+	session := s.Copy()
+	defer session.Close()
+	col := session.DB(config.ConfigDatabaseName).C("cluster")
+	host, err := os.Hostname()
+	if err != nil {
+		return false, err
+	}
+	sel, doc := clusterLease(config, os.Getpid(), host, time.Now().UTC())
+	_, err = col.Upsert(sel, doc)
+	if err == nil {
+		return true, nil
+	}
+	if mgo.IsDup(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func newNamespacePartition(session *mgo.Session, config *configOptions) *namespacePartition {
+	return &namespacePartition{
+		session: session,
+		db:      config.ConfigDatabaseName,
+		group:   config.PartitionName,
+		member:  config.PartitionMember,
+		lease:   time.Duration(config.ClusterLeaseSeconds) * time.Second,
+	}
+}
+
+// owns returns true if the namespace belongs to this member.  Database
+// wide events, which have no collection, are applied by every member
+func (p *namespacePartition) owns(ns string) bool {
+	if p == nil || !strings.Contains(ns, ".") {
+		return true
+	}
+	p.seen.Store(ns, true)
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	return partitionOwner(p.members, ns) == p.member
+}
+
+// partitionOwner returns the member with the highest hash of the member and
+// namespace names
+func partitionOwner(members []string, ns string) (owner string) {
+	var highest uint64
+	for _, member := range members {
+		h := fnv.New64a()
+		h.Write([]byte(member))
+		h.Write([]byte{0})
+		h.Write([]byte(ns))
+		// fnv alone barely spreads names differing in a single byte
+		sum := h.Sum64()
+		sum ^= sum >> 33
+		sum *= 0xff51afd7ed558ccd
+		sum ^= sum >> 33
+		sum *= 0xc4ceb9fe1a85ec53
+		sum ^= sum >> 33
+		if owner == "" || sum > highest {
+			owner, highest = member, sum
+		}
+	}
+	return
+}
+
+// ensureTTL removes the documents of members which stopped without leaving
+func (p *namespacePartition) ensureTTL() error {
+	s := p.session.Copy()
+	defer s.Close()
+	return s.DB(p.db).C("partition").EnsureIndex(mgo.Index{
+		Key:         []string{"expireAt"},
+		Background:  true,
+		ExpireAfter: p.lease,
+	})
+}
+
+// join renews the lease of this member and reloads the live members.  It
+// returns the namespaces seen so far which this member took over from
+// another member
+func (p *namespacePartition) join() (gained []string, err error) {
+	s := p.session.Copy()
+	defer s.Close()
+	col := s.DB(p.db).C("partition")
+	now := time.Now().UTC()
+	if _, err = col.UpsertId(p.group+":"+p.member, bson.M{
+		"group":      p.group,
+		"member":     p.member,
+		"expireAt":   now,
+		"leaseUntil": now.Add(p.lease),
+	}); err != nil {
+		return
+	}
+	var docs []struct {
+		Member string `bson:"member"`
+	}
+	sel := bson.M{"group": p.group, "leaseUntil": bson.M{"$gte": now}}
+	if err = col.Find(sel).Select(bson.M{"member": 1}).All(&docs); err != nil {
+		return
+	}
+	members := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		members = append(members, doc.Member)
+	}
+	sort.Strings(members)
+	p.lock.Lock()
+	previous := p.members
+	p.members = members
+	p.lock.Unlock()
+	if strings.Join(previous, ",") == strings.Join(members, ",") {
+		return
+	}
+	infoLog.Printf("Members of partition group %s are %s", p.group, strings.Join(members, ", "))
+	if len(previous) == 0 {
+		return
+	}
+	p.seen.Range(func(k, v interface{}) bool {
+		ns := k.(string)
+		if partitionOwner(members, ns) == p.member && partitionOwner(previous, ns) != p.member {
+			gained = append(gained, ns)
+		}
+		return true
+	})
+	sort.Strings(gained)
+	return
+}
+
+// run renews the membership on every heartbeat and resyncs the namespaces
+// taken over from other members, whose recent events this member skipped
+func (p *namespacePartition) run(heartbeat time.Duration) {
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+	for range ticker.C {
+		gained, err := p.join()
+		if err != nil {
+			errorLog.Printf("Unable to renew membership of partition group %s: %s", p.group, err)
+			continue
+		}
+		for _, ns := range gained {
+			if resyncs == nil {
+				break
+			}
+			if _, err := resyncs.start(ns, nil); err != nil {
+				warnLog.Printf("Unable to resync namespace %s taken over in partition group %s: %s", ns, p.group, err)
+			}
+		}
+	}
+}
+
+// leave removes this member so the others take over its namespaces without
+// waiting for its lease to expire
+func (p *namespacePartition) leave() {
+	if p == nil {
+		return
+	}
+	s := p.session.Copy()
+	defer s.Close()
+	s.DB(p.db).C("partition").RemoveId(p.group + ":" + p.member)
+}
+
+// clusterLease returns the selector matching the lease document of the
+// cluster when it may be taken by the process and the document taking it
+func clusterLease(config *configOptions, pid int, host string, now time.Time) (sel bson.M, doc bson.M) {
+	sel = bson.M{
+		"_id": config.ResumeName,
+		"$or": []bson.M{
+			{"leaseUntil": bson.M{"$lt": now}},
+			{"pid": pid, "host": host},
+		},
+	}
+	doc = bson.M{
+		"_id":        config.ResumeName,
+		"pid":        pid,
+		"host":       host,
+		"expireAt":   now,
+		"leaseUntil": now.Add(time.Duration(config.ClusterLeaseSeconds) * time.Second),
+	}
+	return
+}
+
+func resetClusterState(session *mgo.Session, config *configOptions) error {
+	col := session.DB(config.ConfigDatabaseName).C("cluster")
+	return col.RemoveId(config.ResumeName)
+}
+
+func ensureEnabled(s *mgo.Session, config *configOptions) (enabled bool, err error) {
+	session := s.Copy()
+	defer session.Close()
+	col := session.DB(config.ConfigDatabaseName).C("cluster")
+	doc := make(map[string]interface{})
+	if err = col.FindId(config.ResumeName).One(doc); err == nil {
+		if doc["pid"] != nil && doc["host"] != nil {
+			var hostname string
+			pid := doc["pid"].(int)
+			host := doc["host"].(string)
+			if hostname, err = os.Hostname(); err == nil {
+				enabled = (pid == os.Getpid() && host == hostname)
+				if enabled {
+					now := time.Now().UTC()
+					err = col.Update(bson.M{"_id": config.ResumeName, "pid": pid, "host": host},
+						bson.M{"$set": bson.M{
+							"expireAt":   now,
+							"leaseUntil": now.Add(time.Duration(config.ClusterLeaseSeconds) * time.Second),
+						}})
+					if err == mgo.ErrNotFound {
+						enabled, err = false, nil
+					}
+					if err != nil {
+						enabled = false
+					}
+				}
+			}
+		}
+	}
+	return
+}
+
+// startGtm starts a gtm context for each of the split options.  The
+// sessions of a context are copies limited to the batch size of its
+// cursor since change streams take their batch size from the session
+func startGtm(sessions []*mgo.Session, split []*gtm.Options, cursors []namespaceCursor) *gtmContexts {
+	gc := &gtmContexts{DirectReadWg: &sync.WaitGroup{}}
+	for i, opts := range split {
+		ss := sessions
+		if i > 0 && cursors[i].BatchSize > 0 {
+			ss = make([]*mgo.Session, len(sessions))
+			for j, session := range sessions {
+				ss[j] = session.Copy()
+				ss[j].SetBatch(cursors[i].BatchSize)
+			}
+			gc.sessions = append(gc.sessions, ss...)
+		}
+		gc.contexts = append(gc.contexts, gtm.StartMulti(ss, opts))
+	}
+	if len(gc.contexts) == 1 {
+		ctx := gc.contexts[0]
+		gc.OpC, gc.ErrC, gc.DirectReadWg = ctx.OpC, ctx.ErrC, ctx.DirectReadWg
+		return gc
+	}
+	gc.OpC = make(gtm.OpChan, split[0].ChannelSize)
+	gc.ErrC = make(chan error, split[0].ChannelSize)
+	for _, ctx := range gc.contexts {
+		gc.DirectReadWg.Add(1)
+		gc.forwarders.Add(2)
+		go func(ctx *gtm.OpCtxMulti) {
+			defer gc.DirectReadWg.Done()
+			ctx.DirectReadWg.Wait()
+		}(ctx)
+		go func(c gtm.OpChan) {
+			defer gc.forwarders.Done()
+			for op := range c {
+				gc.OpC <- op
+			}
+		}(ctx.OpC)
+		go func(c chan error) {
+			defer gc.forwarders.Done()
+			for err := range c {
+				gc.ErrC <- err
+			}
+		}(ctx.ErrC)
+	}
+	return gc
+}
+
+func (gc *gtmContexts) Since(ts bson.MongoTimestamp) {
+	for _, ctx := range gc.contexts {
+		ctx.Since(ts)
+	}
+}
+
+func (gc *gtmContexts) Pause() {
+	for _, ctx := range gc.contexts {
+		ctx.Pause()
+	}
+}
+
+func (gc *gtmContexts) Resume() {
+	for _, ctx := range gc.contexts {
+		ctx.Resume()
+	}
+}
+
+// AddShardListener adds the shards to the context tailing the oplog
+func (gc *gtmContexts) AddShardListener(configSession *mgo.Session, opts *gtm.Options, handler gtm.ShardInsertHandler) {
+	gc.contexts[0].AddShardListener(configSession, opts, handler)
+}
+
+// Stop stops the contexts and closes the merged channels once the ops of
+// every context are forwarded
+func (gc *gtmContexts) Stop() {
+	gc.stopped.Do(func() {
+		var wg sync.WaitGroup
+		for _, ctx := range gc.contexts {
+			wg.Add(1)
+			go func(ctx *gtm.OpCtxMulti) {
+				defer wg.Done()
+				ctx.Stop()
+			}(ctx)
+		}
+		wg.Wait()
+		for _, s := range gc.sessions {
+			s.Close()
+		}
+		if len(gc.contexts) > 1 {
+			gc.forwarders.Wait()
+			close(gc.OpC)
+			close(gc.ErrC)
+		}
+	})
+}
+
+func resumeWork(ctx *gtmContexts, session *mgo.Session, config *configOptions) {
+	col := session.DB(config.ConfigDatabaseName).C("monstache")
+	doc := make(map[string]interface{})
+	col.FindId(config.ResumeName).One(doc)
+	if doc["ts"] != nil {
+		ts := doc["ts"].(bson.MongoTimestamp)
+		ctx.Since(ts)
+	}
+	drained := false
+	for !drained {
+		select {
+		case _, open := <-ctx.OpC:
+			if !open {
+				drained = true
+			}
+		default:
+			drained = true
+		}
+	}
+	ctx.Resume()
+}
+
+func saveTimestamp(s *mgo.Session, ts bson.MongoTimestamp, config *configOptions) error {
+	if config.DryRun {
+		return nil
+	}
+	session := s.Copy()
+	if config.ResumeWriteUnsafe {
+		session.SetSafe(nil)
+	}
+	defer session.Close()
+	col := session.DB(config.ConfigDatabaseName).C("monstache")
+	doc := make(map[string]interface{})
+	doc["ts"] = ts
+	_, err := col.UpsertId(config.ResumeName, bson.M{"$set": doc})
+	return err
+}
+
+func newCheckpointTracker() *checkpointTracker {
+	return &checkpointTracker{pending: make(map[bson.MongoTimestamp]int)}
+}
+
+func (c *checkpointTracker) startEvent(op *gtm.Op) {
+	if c == nil || !op.IsSourceOplog() {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.pending[op.Timestamp]++
+}
+
+func (c *checkpointTracker) finishEvent(op *gtm.Op) {
+	if c == nil || !op.IsSourceOplog() {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if n := c.pending[op.Timestamp]; n > 1 {
+		c.pending[op.Timestamp] = n - 1
+	} else {
+		delete(c.pending, op.Timestamp)
+	}
+}
+
+// position returns the resume position to save for the checkpoint mode.
+// after-ack stops short of the earliest event still in flight while
+// before-ack advances to the latest event read
+func (c *checkpointTracker) position(config *configOptions, read bson.MongoTimestamp) bson.MongoTimestamp {
+	if c == nil || config.CheckpointMode == "before-ack" {
+		return read
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for ts := range c.pending {
+		if ts <= read {
+			read = ts - 1
+		}
+	}
+	return read
+}
+
+func (config *configOptions) parseCommandLineFlags() *configOptions {
+	config.defineFlags(flag.CommandLine)
+	flag.Parse()
+	if err := config.loadFlagEnvironment(flag.CommandLine); err != nil {
+		panic(err)
+	}
+	return config
+}
+
+// defineFlags registers the command line flags of the options in fs
+func (config *configOptions) defineFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&config.Print, "print-config", false, "Print the configuration and then exit")
+	fs.BoolVar(&config.EnableTemplate, "tpl", false, "True to interpret the config file as a template")
+	fs.StringVar(&config.EnvDelimiter, "env-delimiter", ",", "A delimiter to use when splitting environment variable values")
+	fs.StringVar(&config.MongoURL, "mongo-url", "", "MongoDB server or router server connection URL")
+	fs.StringVar(&config.MongoConfigURL, "mongo-config-url", "", "MongoDB config server connection URL")
+	fs.StringVar(&config.MongoPemFile, "mongo-pem-file", "", "Path to a PEM file for secure connections to MongoDB")
+	fs.BoolVar(&config.MongoValidatePemFile, "mongo-validate-pem-file", true, "Set to boolean false to not validate the MongoDB PEM file")
+	fs.StringVar(&config.MongoTLSMinVersion, "mongo-tls-min-version", "", "The minimum TLS version of connections to MongoDB. One of 1.0, 1.1, 1.2 or 1.3")
+	fs.Var(&config.MongoTLSCipherSuites, "mongo-tls-cipher-suite", "A cipher suite allowed for TLS 1.2 and earlier connections to MongoDB, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	fs.BoolVar(&config.MongoAWSAuth, "mongo-aws-auth", false, "True to authenticate to MongoDB with MONGODB-AWS using the default AWS credentials chain. Same as authMechanism=MONGODB-AWS on the connection URL")
+	fs.StringVar(&config.MongoOpLogDatabaseName, "mongo-oplog-database-name", "", "Override the database name which contains the mongodb oplog")
+	fs.StringVar(&config.MongoOpLogCollectionName, "mongo-oplog-collection-name", "", "Override the collection name which contains the mongodb oplog")
+	fs.StringVar(&config.GraylogAddr, "graylog-addr", "", "Send logs to a Graylog server at this address")
+	fs.StringVar(&config.LogFormat, "log-format", "", "The format of log lines: text or json")
+	fs.StringVar(&config.ElasticVersion, "elasticsearch-version", "", "Specify elasticsearch version directly instead of getting it from the server")
+	fs.BoolVar(&config.OpenSearch, "opensearch", false, "True to target OpenSearch instead of Elasticsearch")
+	fs.StringVar(&config.RecordFile, "record-file", "", "A file to record the change events read to for a later replay with replay-file")
+	fs.StringVar(&config.ReplayFile, "replay-file", "", "A file recorded with record-file whose events are indexed in place of reading MongoDB. Monstache stops after the last event")
+	fs.StringVar(&config.NDJSONFile, "ndjson-file", "", "A file to copy bulk actions to as NDJSON. Use - for stdout")
+	fs.BoolVar(&config.DisableElasticsearch, "disable-elasticsearch", false, "True to write changes only to the configured sinks and not to Elasticsearch")
+	fs.BoolVar(&config.DryRun, "dry-run", false, "True to write bulk actions as NDJSON instead of sending them and to leave Elasticsearch, the sinks and the saved state untouched")
+	fs.StringVar(&config.ElasticUser, "elasticsearch-user", "", "The elasticsearch user name for basic auth")
+	fs.StringVar(&config.ElasticPassword, "elasticsearch-password", "", "The elasticsearch password for basic auth")
+	fs.StringVar(&config.ElasticAPIKey, "elasticsearch-api-key", "", "The elasticsearch API key as id:key or base64 encoded")
+	fs.StringVar(&config.ElasticAPIKeyFile, "elasticsearch-api-key-file", "", "Path to a file containing the elasticsearch API key. The file is reloaded when changed")
+	fs.StringVar(&config.ElasticCloudID, "elasticsearch-cloud-id", "", "The Elastic Cloud ID of the deployment to connect to instead of elasticsearch-url")
+	fs.Var(&config.SecondaryElasticUrls, "secondary-elasticsearch-url", "A list of URLs of a secondary Elasticsearch cluster which receives the same writes")
+	fs.Float64Var(&config.DebugSampleRate, "debug-sample-rate", 0, "Fraction of documents between 0 and 1 to log before and after mapping along with their bulk actions")
+	fs.Var(&config.DebugDocumentIds, "debug-document-id", "A list of document ids to log before and after mapping along with their bulk actions")
+	fs.IntVar(&config.NotifyRateLimit, "notify-rate-limit", 0, "Minimum number of seconds between repeats of the same webhook notification")
+	fs.IntVar(&config.NotifyBulkFailureSeconds, "notify-bulk-failure-seconds", 0, "Number of seconds bulk requests must keep failing before a webhook notification is sent")
+	fs.StringVar(&config.SecondaryElasticUser, "secondary-elasticsearch-user", "", "The secondary elasticsearch user name for basic auth")
+	fs.StringVar(&config.SecondaryElasticPassword, "secondary-elasticsearch-password", "", "The secondary elasticsearch password for basic auth")
+	fs.StringVar(&config.SecondaryElasticAPIKey, "secondary-elasticsearch-api-key", "", "The secondary elasticsearch API key as id:key or base64 encoded")
+	fs.StringVar(&config.ElasticPemFile, "elasticsearch-pem-file", "", "Path to a PEM file for secure connections to elasticsearch")
+	fs.BoolVar(&config.ElasticValidatePemFile, "elasticsearch-validate-pem-file", true, "Set to boolean false to not validate the Elasticsearch PEM file")
+	fs.StringVar(&config.ElasticTLSMinVersion, "elasticsearch-tls-min-version", "", "The minimum TLS version of connections to Elasticsearch. One of 1.0, 1.1, 1.2 or 1.3")
+	fs.Var(&config.ElasticTLSCipherSuites, "elasticsearch-tls-cipher-suite", "A cipher suite allowed for TLS 1.2 and earlier connections to Elasticsearch, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	fs.StringVar(&config.ElasticClientCert, "elasticsearch-client-cert", "", "Path to a PEM client certificate, or the PEM itself, for mutual TLS to elasticsearch. Reloaded when it changes")
+	fs.StringVar(&config.ElasticClientKey, "elasticsearch-client-key", "", "Path to the PEM private key of the client certificate, or the PEM itself")
+	fs.IntVar(&config.ElasticMaxConns, "elasticsearch-max-conns", 0, "Elasticsearch max connections")
+	fs.IntVar(&config.PostProcessors, "post-processors", 0, "Number of post-processing go routines")
+	fs.IntVar(&config.FileDownloaders, "file-downloaders", 0, "GridFs download go routines")
+	fs.IntVar(&config.IndexWorkers, "index-workers", 0, "Number of go routines which map and index documents concurrently")
+	fs.IntVar(&config.CoalesceWindowMs, "coalesce-window-ms", 0, "Number of milliseconds to hold changes to a document so that successive changes are indexed once")
+	fs.Var(&config.CoalesceNamespaces, "coalesce-namespace", "A list of namespaces to coalesce changes in.  Defaults to all namespaces")
+	fs.IntVar(&config.MemoryBudgetMB, "memory-budget-mb", 0, "Megabytes of pending events to buffer in memory before spilling them to disk")
+	fs.StringVar(&config.DiskCompression, "disk-compression", "", "Compression of spilled events, the dead letter file, recordings and exported resume positions.  Either none or zstd")
+	fs.StringVar(&config.SpillDir, "spill-dir", "", "Directory of the file pending events are spilled to.  Defaults to the temp directory")
+	fs.IntVar(&config.RelateThreads, "relate-threads", 0, "Number of threads dedicated to processing relationships")
+	fs.IntVar(&config.RelateBuffer, "relate-buffer", 0, "Number of relates to queue before skipping and reporting an error")
+	fs.BoolVar(&config.ElasticRetry, "elasticsearch-retry", false, "True to retry failed request to Elasticsearch")
+	fs.BoolVar(&config.AdaptiveBackpressure, "adaptive-backpressure", false, "True to slow down indexing while Elasticsearch rejects requests")
+	fs.BoolVar(&config.AdaptiveBulk, "adaptive-bulk", false, "True to adapt the size of bulk requests and the number of index workers to the latency of Elasticsearch")
+	fs.IntVar(&config.AdaptiveBulkMinBytes, "adaptive-bulk-min-bytes", 0, "Smallest size in bytes of adaptive bulk requests.  The largest is elasticsearch-max-bytes")
+	fs.IntVar(&config.AdaptiveBulkTargetMs, "adaptive-bulk-target-ms", 0, "Target round-trip latency in milliseconds of adaptive bulk requests")
+	fs.IntVar(&config.ElasticMaxDocs, "elasticsearch-max-docs", 0, "Number of docs to hold before flushing to Elasticsearch")
+	fs.IntVar(&config.ElasticMaxBytes, "elasticsearch-max-bytes", 0, "Number of bytes to hold before flushing to Elasticsearch")
+	fs.IntVar(&config.ElasticMaxContentLength, "elasticsearch-max-content-length", 0, "The http.max_content_length of Elasticsearch.  Requests which cannot fit a batch below it are dead-lettered before they are queued")
+	fs.IntVar(&config.ElasticMaxSeconds, "elasticsearch-max-seconds", 0, "Number of seconds before flushing to Elasticsearch")
+	fs.IntVar(&config.ElasticClientTimeout, "elasticsearch-client-timeout", 0, "Number of seconds before a request to Elasticsearch is timed out")
+	fs.IntVar(&config.SecretRefreshSeconds, "secret-refresh-seconds", 0, "Number of seconds between refreshes of credentials resolved from Vault or AWS Secrets Manager")
+	fs.Int64Var(&config.MaxFileSize, "max-file-size", 0, "GridFs file content exceeding this limit in bytes will not be indexed in Elasticsearch")
+	fs.StringVar(&config.TikaURL, "tika-url", "", "URL of an Apache Tika server which extracts the text and metadata of GridFS files and tika-field URLs in place of the attachment ingest processor")
+	fs.IntVar(&config.TikaConcurrency, "tika-concurrency", 0, "Maximum number of files sent to Tika at once")
+	fs.Int64Var(&config.TikaMaxBytes, "tika-max-bytes", 0, "Files larger than this many bytes are not sent to Tika. 0 sends files of any size")
+	fs.IntVar(&config.TikaTimeoutSeconds, "tika-timeout-seconds", 0, "Number of seconds before a download or a Tika extraction is timed out")
+	fs.Int64Var(&config.FileChunkBytes, "file-chunk-bytes", 0, "When greater than 0 GridFs file content is indexed as a list of base64 encoded chunks of at most this many bytes each")
+	fs.Var(&configFileArgs{config}, "f", "Location of configuration file. Repeat to merge several files with later files taking precedence")
+	fs.StringVar(&config.Profile, "profile", "", "Name of the profile to apply from the configuration file")
+	fs.BoolVar(&config.DroppedDatabases, "dropped-databases", true, "True to delete indexes from dropped databases")
+	fs.BoolVar(&config.DroppedCollections, "dropped-collections", true, "True to delete indexes from dropped collections")
+	fs.BoolVar(&config.Version, "v", false, "True to print the version number")
+	fs.BoolVar(&config.Gzip, "gzip", false, "True to enable gzip for requests to Elasticsearch")
+	fs.IntVar(&config.GzipLevel, "gzip-level", 0, "The gzip compression level (1-9) to use for requests to Elasticsearch when gzip is enabled")
+	fs.BoolVar(&config.Verbose, "verbose", false, "True to output verbose messages")
+	fs.BoolVar(&config.Pprof, "pprof", false, "True to enable pprof endpoints")
+	fs.StringVar(&config.PprofUser, "pprof-user", "", "The user required with HTTP basic auth to access the pprof endpoints")
+	fs.StringVar(&config.PprofPassword, "pprof-password", "", "The password required with HTTP basic auth to access the pprof endpoints")
+	fs.StringVar(&config.AdminUser, "admin-user", "", "The user required with HTTP basic auth to access the pause and resume endpoints")
+	fs.StringVar(&config.AdminPassword, "admin-password", "", "The password required with HTTP basic auth to access the pause and resume endpoints")
+	fs.BoolVar(&config.Metrics, "metrics", false, "True to expose Prometheus metrics at /metrics on the http server")
+	fs.StringVar(&config.StatsdAddr, "statsd-addr", "", "The host:port of a StatsD or DogStatsD agent to send metrics to over UDP")
+	fs.StringVar(&config.StatsdPrefix, "statsd-prefix", "", "Prefix of the metric names sent to StatsD")
+	fs.IntVar(&config.StatsdFlushSeconds, "statsd-flush-seconds", 0, "Number of seconds between flushes of metrics to StatsD")
+	fs.IntVar(&config.ReplicationLagThreshold, "replication-lag-threshold", 0, "Number of seconds of replication lag after which /readyz fails and an alert is sent")
+	fs.IntVar(&config.ReadyLagSeconds, "ready-lag-seconds", 0, "Number of seconds the change events read may trail the cluster time before /readyz first reports ready. 0 reports ready once direct reads are done")
+	fs.StringVar(&config.ReplicationLagAlertURL, "replication-lag-alert-url", "", "URL to POST a JSON alert to when replication lag exceeds or recovers from the threshold")
+	fs.StringVar(&config.TracingEndpoint, "tracing-endpoint", "", "URL of an OTLP/HTTP collector to export traces of the event pipeline to")
+	fs.StringVar(&config.TracingServiceName, "tracing-service-name", "", "The service.name reported with exported traces")
+	fs.Float64Var(&config.TracingSampleRatio, "tracing-sample-ratio", 0, "Fraction of change events to trace between 0 and 1")
+	fs.BoolVar(&config.DisableChangeEvents, "disable-change-events", false, "True to disable listening for changes.  You must provide direct-reads in this case")
+	fs.BoolVar(&config.EnableEasyJSON, "enable-easy-json", false, "True to enable easy-json serialization")
+	fs.BoolVar(&config.Stats, "stats", false, "True to print out statistics")
+	fs.BoolVar(&config.IndexStats, "index-stats", false, "True to index stats in elasticsearch")
+	fs.StringVar(&config.StatsDuration, "stats-duration", "", "The duration after which stats are logged")
+	fs.StringVar(&config.StatsIndexFormat, "stats-index-format", "", "time.Time supported format to use for the stats index names")
+	fs.StringVar(&config.DeadLetterIndex, "dead-letter-index", "", "The Elasticsearch index to write failed bulk items to")
+	fs.StringVar(&config.DeadLetterFile, "dead-letter-file", "", "The local file to write failed bulk items to")
+	fs.StringVar(&config.AuditIndex, "audit-index", "", "The Elasticsearch index to record the outcome of every document written to")
+	fs.StringVar(&config.AuditFile, "audit-file", "", "The local file to append the outcome of every document written to")
+	fs.StringVar(&config.UUIDRepresentation, "uuid-representation", "", "The byte order of legacy binary subtype 3 UUIDs: standard, java-legacy, csharp-legacy or python-legacy")
+	fs.StringVar(&config.BinaryEncoding, "binary-encoding", "", "How to render binary values which are not UUIDs: base64, hex or drop")
+	fs.BoolVar(&config.ReplayDeadLetters, "replay-dead-letters", false, "True to resubmit the items in the dead-letter index or file and exit")
+	fs.BoolVar(&config.Resume, "resume", false, "True to capture the last timestamp of this run and resume on a subsequent run")
+	fs.Int64Var(&config.ResumeFromTimestamp, "resume-from-timestamp", 0, "Timestamp to resume syncing from")
+	fs.StringVar(&config.ReplayUntil, "replay-until", "", "Stop once the events up to this RFC3339 time, number or now have been read. The replay command defaults to now")
+	fs.Var(&config.ReplayNamespaces, "replay-namespace", "A namespace to restrict the events read to. Use with the replay command")
+	fs.Var(&config.PreviewNamespaces, "ns", "A namespace to sample documents from. Use with the preview command")
+	fs.IntVar(&config.PreviewSize, "preview-size", 0, "Number of documents the preview command samples per namespace")
+	fs.IntVar(&config.VerifySample, "verify-sample", 0, "Number of ranges of ids starting at random documents which the verify command compares per namespace. 0 compares every document")
+	fs.StringVar(&config.ContentHashField, "content-hash-field", "", "Field set to the SHA-256 of the JSON of each document after mapping. The verify command compares only this field when set")
+	fs.StringVar(&config.VerifyReport, "verify-report", "", "File to write the report of missing, extra and mismatched ids found by the verify and repair commands to")
+	fs.StringVar(&config.VerifyReportFormat, "verify-report-format", "", "Format of the verify report file: json (default) or csv")
+	fs.StringVar(&config.VerifyReportIndex, "verify-report-index", "", "The Elasticsearch index to record the report of each namespace checked by the verify and repair commands in")
+	fs.BoolVar(&config.RepairApply, "repair-apply", false, "True for the repair command to reindex and delete documents. Otherwise it only reports the repairs it would make")
+	fs.IntVar(&config.RepairBatchSize, "repair-batch-size", 0, "Number of documents the repair command sends to Elasticsearch per bulk request")
+	fs.IntVar(&config.RepairRate, "repair-rate", 0, "Max number of documents per second the repair command sends to Elasticsearch. 0 is unlimited")
+	fs.IntVar(&config.SchemaDriftSeconds, "schema-drift-seconds", 0, "Number of seconds between comparisons of the fields emitted to each index with its mapping. Fields left unmapped or mapped with an unexpected type are reported. 0 disables the comparison")
+	fs.IntVar(&config.OrphanSweepSeconds, "orphan-sweep-seconds", 0, "Number of seconds between sweeps which delete the documents of Elasticsearch whose MongoDB documents no longer exist. 0 disables sweeps")
+	fs.IntVar(&config.OrphanSweepBatchSize, "orphan-sweep-batch-size", 0, "Number of ids an orphan sweep checks in MongoDB at once")
+	fs.BoolVar(&config.DeleteRoutingChanges, "delete-routing-changes", false, "True to delete the copy of a document left under its old routing when its routing changes")
+	fs.IntVar(&config.RoutingCacheSize, "routing-cache-size", 0, "Number of documents whose routing is remembered to detect routing changes")
+	fs.BoolVar(&config.ResumeWriteUnsafe, "resume-write-unsafe", false, "True to speedup writes of the last timestamp synched for resuming at the cost of error checking")
+	fs.BoolVar(&config.Replay, "replay", false, "True to replay all events from the oplog and index them in elasticsearch")
+	fs.BoolVar(&config.IndexFiles, "index-files", false, "True to index gridfs files into elasticsearch. Requires the elasticsearch mapper-attachments (deprecated) or ingest-attachment plugin")
+	fs.BoolVar(&config.IndexAsUpdate, "index-as-update", false, "True to index documents as updates instead of overwrites")
+	fs.BoolVar(&config.FileHighlighting, "file-highlighting", false, "True to enable the ability to highlight search times for a file query")
+	fs.BoolVar(&config.EnablePatches, "enable-patches", false, "True to include an json-patch field on updates")
+	fs.BoolVar(&config.FailFast, "fail-fast", false, "True to exit if a single _bulk request fails")
+	fs.BoolVar(&config.IndexOplogTime, "index-oplog-time", false, "True to add date/time information from the oplog to each document when indexing")
+	fs.BoolVar(&config.ExitAfterDirectReads, "exit-after-direct-reads", false, "True to exit the program after reading directly from the configured namespaces")
+	fs.IntVar(&config.DrainTimeoutSeconds, "drain-timeout-seconds", 0, "Number of seconds to wait for pending events to be indexed when shutting down")
+	fs.IntVar(&config.CheckpointInterval, "checkpoint-interval-seconds", 0, "Number of seconds between saves of the resume position")
+	fs.StringVar(&config.CheckpointMode, "checkpoint-mode", "", "after-ack saves the resume position once the events before it are acknowledged by Elasticsearch, so events may be indexed again after a restart. before-ack saves the position of the events read, so events in flight may be lost after a crash but are never indexed twice")
+	fs.StringVar(&config.MergePatchAttr, "merge-patch-attribute", "", "Attribute to store json-patch values under")
+	fs.StringVar(&config.ResumeName, "resume-name", "", "Name under which to load/store the resume state. Defaults to 'default'")
+	fs.StringVar(&config.ClusterName, "cluster-name", "", "Name of the monstache process cluster")
+	fs.IntVar(&config.ClusterLeaseSeconds, "cluster-lease-seconds", 0, "Number of seconds the active process of a cluster holds its lease without renewing it")
+	fs.IntVar(&config.ClusterHeartbeatSeconds, "cluster-heartbeat-seconds", 0, "Number of seconds between renewals of the lease or attempts of standby processes to take it")
+	fs.StringVar(&config.PartitionName, "partition-name", "", "Name of a group of processes which share the namespaces to sync among themselves")
+	fs.StringVar(&config.PartitionMember, "partition-member", "", "Stable name of this process in the partition group. Defaults to the hostname")
+	fs.StringVar(&config.Worker, "worker", "", "The name of this worker in a multi-worker configuration")
+	fs.StringVar(&config.MapperPluginPath, "mapper-plugin-path", "", "The path to a .so file to load as a document mapper plugin")
+	fs.StringVar(&config.NsRegex, "namespace-regex", "", "A regex which is matched against an operation's namespace (<database>.<collection>).  Only operations which match are synched to elasticsearch")
+	fs.StringVar(&config.NsDropRegex, "namespace-drop-regex", "", "A regex which is matched against a drop operation's namespace (<database>.<collection>).  Only drop operations which match are synched to elasticsearch")
+	fs.StringVar(&config.NsExcludeRegex, "namespace-exclude-regex", "", "A regex which is matched against an operation's namespace (<database>.<collection>).  Only operations which do not match are synched to elasticsearch")
+	fs.StringVar(&config.NsDropExcludeRegex, "namespace-drop-exclude-regex", "", "A regex which is matched against a drop operation's namespace (<database>.<collection>).  Only drop operations which do not match are synched to elasticsearch")
+	fs.Var(&config.ChangeStreamNs, "change-stream-namespace", "A list of change stream namespaces")
+	fs.Var(&config.DirectReadNs, "direct-read-namespace", "A list of direct read namespaces")
+	fs.IntVar(&config.DirectReadSplitMax, "direct-read-split-max", 0, "Max number of times to split a collection for direct reads")
+	fs.IntVar(&config.DirectReadConcur, "direct-read-concur", 0, "Max number of direct-read-namespaces to read concurrently. By default all given are read concurrently")
+	fs.IntVar(&config.LookupBatchWindowMs, "lookup-batch-window-ms", 0, "Number of milliseconds golang plugins wait to batch lookups of documents made with the Lookup batcher")
+	fs.IntVar(&config.LookupBatchMax, "lookup-batch-max", 0, "Max number of values in a batched lookup query of golang plugins")
+	fs.IntVar(&config.DirectReadBudget, "direct-read-budget", 0, "Max number of directly read documents being indexed at once across all direct-read-namespaces")
+	fs.IntVar(&config.DirectReadRate, "direct-read-rate", 0, "Max number of documents read per second across all direct-read-namespaces")
+	fs.Var(&config.RoutingNamespaces, "routing-namespace", "A list of namespaces that override routing information")
+	fs.Var(&config.TimeMachineNamespaces, "time-machine-namespace", "A list of direct read namespaces")
+	fs.StringVar(&config.TimeMachineIndexPrefix, "time-machine-index-prefix", "", "A prefix to preprend to time machine indexes")
+	fs.StringVar(&config.TimeMachineIndexSuffix, "time-machine-index-suffix", "", "A suffix to append to time machine indexes")
+	fs.BoolVar(&config.DirectReadNoTimeout, "direct-read-no-timeout", false, "True to set the no cursor timeout flag for direct reads")
+	fs.BoolVar(&config.TimeMachineDirectReads, "time-machine-direct-reads", false, "True to index the results of direct reads into the any time machine indexes")
+	fs.BoolVar(&config.PipeAllowDisk, "pipe-allow-disk", false, "True to allow MongoDB to use the disk for pipeline options with lots of results")
+	fs.Var(&config.ElasticUrls, "elasticsearch-url", "A list of Elasticsearch URLs")
+	fs.Var(&config.FileNamespaces, "file-namespace", "A list of file namespaces")
+	fs.Var(&config.FileMetadataNamespaces, "file-metadata-namespace", "A list of GridFS files namespaces whose file metadata is indexed without reading the file content")
+	fs.Var(&config.PatchNamespaces, "patch-namespace", "A list of patch namespaces")
+	fs.Var(&config.PartialUpdateNamespaces, "partial-update-namespace", "A list of namespaces whose updates are sent as partial documents built from the change description")
+	fs.Var(&config.ArrayUpdateNamespaces, "array-update-namespace", "A list of namespaces whose updates are sent as partial documents or, when they change array elements, as scripts which change the arrays in place")
+	fs.Var(&config.StreamJSONNamespaces, "stream-json-namespace", "A list of namespaces whose documents are converted to JSON while encoding instead of being copied first")
+	fs.Var(&config.SampleMappingNamespaces, "sample-mapping-namespace", "A list of namespaces whose index mapping is inferred from sampled documents when the index is created")
+	fs.IntVar(&config.MappingSampleSize, "mapping-sample-size", 0, "The number of documents to sample per namespace when inferring mappings")
+	fs.Var(&config.Workers, "workers", "A list of worker names")
+	fs.BoolVar(&config.EnableHTTPServer, "enable-http-server", false, "True to enable an internal http server")
+	fs.StringVar(&config.HTTPServerAddr, "http-server-addr", "", "The address the internal http server listens on")
+	fs.StringVar(&config.HTTPServerTLSCert, "http-server-tls-cert", "", "Path to a PEM certificate to serve the internal http server over TLS")
+	fs.StringVar(&config.HTTPServerTLSKey, "http-server-tls-key", "", "Path to the PEM private key of http-server-tls-cert")
+	fs.BoolVar(&config.PruneInvalidJSON, "prune-invalid-json", false, "True to omit values which do not serialize to JSON such as +Inf and -Inf and thus cause errors")
+	fs.Var(&config.DeleteStrategy, "delete-strategy", "Stategy to use for deletes. 0=stateless,1=stateful,2=ignore")
+	fs.StringVar(&config.DeleteIndexPattern, "delete-index-pattern", "", "An Elasticsearch index-pattern to restric the scope of stateless deletes")
+	fs.StringVar(&config.ConfigDatabaseName, "config-database-name", "", "The MongoDB database name that monstache uses to store metadata")
+	fs.StringVar(&config.ConfigCollection, "config-collection", "", "A collection in the config database holding a document of options which override the config file")
+	fs.StringVar(&config.ConfigDocument, "config-document", "", "The _id of the document in the config collection to read options from")
+	fs.StringVar(&config.OplogTsFieldName, "oplog-ts-field-name", "", "Field name to use for the oplog timestamp")
+	fs.StringVar(&config.OplogDateFieldName, "oplog-date-field-name", "", "Field name to use for the oplog date")
+	fs.StringVar(&config.OplogDateFieldFormat, "oplog-date-field-format", "", "Format to use for the oplog date")
+	fs.BoolVar(&config.Debug, "debug", false, "True to enable verbose debug information")
+	config.defineOptionFlags(fs)
+}
+
+// optionValue is the flag of a scalar option which has no flag of its own
+type optionValue struct {
+	field reflect.Value
+}
+
+func (v *optionValue) String() string {
+	if !v.field.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(v.field.Interface())
+}
+
+func (v *optionValue) Set(value string) error {
+	parsed, err := parseOptionValue(v.field.Type(), value)
+	if err != nil {
+		return err
+	}
+	v.field.Set(reflect.ValueOf(parsed).Convert(v.field.Type()))
+	return nil
+}
+
+func (v *optionValue) IsBoolFlag() bool {
+	return v.field.IsValid() && v.field.Kind() == reflect.Bool
+}
+
+// tableOptionValue is the flag of a key of a table option such as
+// gtm-settings.buffer-size.  Values are kept in the overrides which are
+// merged over the config file
+type tableOptionValue struct {
+	overrides map[string]interface{}
+	table     string
+	key       string
+	typ       reflect.Type
+}
+
+func (v *tableOptionValue) String() string {
+	if v.overrides == nil {
+		return ""
+	}
+	table, _ := v.overrides[v.table].(map[string]interface{})
+	if table == nil || table[v.key] == nil {
+		return ""
+	}
+	return fmt.Sprint(table[v.key])
+}
+
+func (v *tableOptionValue) Set(value string) error {
+	table, _ := v.overrides[v.table].(map[string]interface{})
+	if table == nil {
+		table = make(map[string]interface{})
+		v.overrides[v.table] = table
+	}
+	if v.typ.Kind() == reflect.Slice && v.typ.Elem().Kind() == reflect.String {
+		list, _ := table[v.key].([]interface{})
+		table[v.key] = append(list, value)
+		return nil
+	}
+	parsed, err := parseOptionValue(v.typ, value)
+	if err != nil {
+		return err
+	}
+	table[v.key] = normalizeConfigValue(parsed)
+	return nil
+}
+
+func (v *tableOptionValue) IsBoolFlag() bool {
+	return v.typ != nil && v.typ.Kind() == reflect.Bool
+}
+
+// tableListValue is the flag of a list of tables such as mapping.  Each
+// value is a JSON object, or an array of them, which is added to the list
+type tableListValue struct {
+	overrides map[string]interface{}
+	name      string
+}
+
+func (v *tableListValue) String() string {
+	if v.overrides == nil || v.overrides[v.name] == nil {
+		return ""
+	}
+	b, _ := json.Marshal(v.overrides[v.name])
+	return string(b)
+}
+
+func (v *tableListValue) Set(value string) error {
+	var doc interface{}
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("Expected a JSON object: %s", err)
+	}
+	list, _ := v.overrides[v.name].([]map[string]interface{})
+	items, ok := doc.([]interface{})
+	if !ok {
+		items = []interface{}{doc}
+	}
+	for _, item := range items {
+		table, ok := normalizeConfigValue(item).(map[string]interface{})
+		if !ok {
+			return errors.New("Expected a JSON object")
+		}
+		list = append(list, table)
+	}
+	v.overrides[v.name] = list
+	return nil
+}
+
+// parseOptionValue parses a flag or environment value for an option of the
+// given type.  Types other than strings, numbers and booleans are JSON
+func parseOptionValue(t reflect.Type, value string) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.String:
+		return value, nil
+	case reflect.Bool:
+		return strconv.ParseBool(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(value, 10, 64)
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(value, 64)
+	}
+	var doc interface{}
+	dec := json.NewDecoder(strings.NewReader(value))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("Expected JSON: %s", err)
+	}
+	return doc, nil
+}
+
+// defineOptionFlags adds a flag for every option of the config file which
+// is not already covered by defineFlags.  Scalar options are also available
+// under their config file name, keys of tables are named table.key and lists
+// of tables take JSON objects.  Table flags override the same keys in the
+// config file while the other keys of the file are kept
+func (config *configOptions) defineOptionFlags(fs *flag.FlagSet) {
+	if config.overrides == nil {
+		config.overrides = make(map[string]interface{})
+	}
+	bound := make(map[uintptr]*flag.Flag)
+	fs.VisitAll(func(f *flag.Flag) {
+		bound[reflect.ValueOf(f.Value).Pointer()] = f
+	})
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || configInitSkipped[field.Name] {
+			continue
+		}
+		name := strings.ToLower(configOptionName(field))
+		if fs.Lookup(name) != nil {
+			continue
+		}
+		fv := v.Field(i)
+		ft := field.Type
+		switch {
+		case ft.Kind() == reflect.Struct || (ft.Kind() == reflect.Ptr && ft.Elem().Kind() == reflect.Struct):
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			for j := 0; j < ft.NumField(); j++ {
+				sub := ft.Field(j)
+				if sub.PkgPath != "" {
+					continue
+				}
+				key := strings.ToLower(configOptionName(sub))
+				fs.Var(&tableOptionValue{config.overrides, name, key, sub.Type}, name+"."+key,
+					fmt.Sprintf("%s: %s", optionDescriptions[name], key))
+			}
+		case ft.Kind() == reflect.Slice && isTableType(ft.Elem()):
+			fs.Var(&tableListValue{config.overrides, name}, name,
+				optionDescriptions[name]+" as a JSON object. Repeat to add more")
+		default:
+			if f := bound[fv.Addr().Pointer()]; f != nil {
+				fs.Var(f.Value, name, f.Usage)
+			} else {
+				fs.Var(&optionValue{fv}, name, optionDescriptions[name])
+			}
+		}
+	}
+}
+
+// loadFlagEnvironment sets each flag which was not given on the command line
+// from the environment variable MONSTACHE_ followed by the flag name in upper
+// case with dashes and dots replaced by underscores, so that the precedence
+// is flags, then environment, then config file.  Values of list flags are
+// split on the env delimiter
+func (config *configOptions) loadFlagEnvironment(fs *flag.FlagSet) error {
+	set := make(map[uintptr]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[reflect.ValueOf(f.Value).Pointer()] = true
+	})
+	skipped := make(map[uintptr]bool)
+	v := reflect.ValueOf(config).Elem()
+	for name := range configInitSkipped {
+		skipped[v.FieldByName(name).Addr().Pointer()] = true
+	}
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		ptr := reflect.ValueOf(f.Value).Pointer()
+		if err != nil || set[ptr] || skipped[ptr] {
+			return
+		}
+		val := os.Getenv(optionEnvName(f.Name))
+		if val == "" {
+			return
+		}
+		// aliases share a value which is only set once
+		set[ptr] = true
+		vals := []string{val}
+		switch fv := f.Value.(type) {
+		case *stringargs:
+			vals = strings.Split(val, config.EnvDelimiter)
+		case *tableOptionValue:
+			if fv.typ.Kind() == reflect.Slice {
+				vals = strings.Split(val, config.EnvDelimiter)
+			}
+		}
+		for _, val := range vals {
+			if err = f.Value.Set(val); err != nil {
+				err = fmt.Errorf("Invalid value for %s: %s", optionEnvName(f.Name), err)
+				return
+			}
+		}
+	})
+	return err
+}
+
+func optionEnvName(flagName string) string {
+	return "MONSTACHE_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(flagName))
+}
+
+func (config *configOptions) loadReplacements() {
+	if config.Relate != nil {
+		for _, r := range config.Relate {
+			if r.Namespace != "" || r.WithNamespace != "" {
+				dbCol := strings.SplitN(r.WithNamespace, ".", 2)
+				if len(dbCol) != 2 {
+					panic("Replacement namespace is invalid: " + r.WithNamespace)
+				}
+				database, collection := dbCol[0], dbCol[1]
+				r := &relation{
+					Namespace:     r.Namespace,
+					WithNamespace: r.WithNamespace,
+					SrcField:      r.SrcField,
+					MatchField:    r.MatchField,
+					DotNotation:   r.DotNotation,
+					KeepSrc:       r.KeepSrc,
+					MaxDepth:      r.MaxDepth,
+					db:            database,
+					col:           collection,
+				}
+				if r.SrcField == "" {
+					r.SrcField = "_id"
+				}
+				if r.MatchField == "" {
+					r.MatchField = "_id"
+				}
+				relates[r.Namespace] = append(relates[r.Namespace], r)
+			} else {
+				panic("Relates must specify namespace and with-namespace")
+			}
+		}
+	}
+}
+
+func (config *configOptions) loadIndexTypes() {
+	if config.Mapping != nil {
+		for _, m := range config.Mapping {
+			if m.Namespace != "" && (m.Index != "" || m.Type != "") {
+				mapIndexTypes[m.Namespace] = &indexTypeMapping{
+					Namespace: m.Namespace,
+					Index:     lowerIndexName(m.Index),
+					Type:      m.Type,
+				}
+				if isDatedIndex(m.Index) {
+					// deletes need the index recorded at index time
+					routingNamespaces[m.Namespace] = true
+				}
+			} else {
+				panic("Mappings must specify namespace and at least one of index and type")
+			}
+		}
+	}
+}
+
+func (config *configOptions) loadIndexTemplates() {
+	for _, t := range config.IndexTemplate {
+		if t.Namespace == "" {
+			panic("Index templates must specify namespace")
+		}
+		if _, exists := indexTemplates[t.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple index templates with namespace: %s", t.Namespace))
+		}
+		if t.Path != "" {
+			if len(t.Settings) > 0 || len(t.Mappings) > 0 {
+				panic("Index templates must specify path or settings/mappings but not both")
+			}
+			b, err := ioutil.ReadFile(t.Path)
+			if err != nil {
+				panic(fmt.Sprintf("Unable to load index template at path %s: %s", t.Path, err))
+			}
+			var fromFile struct {
+				Settings map[string]interface{} `json:"settings"`
+				Mappings map[string]interface{} `json:"mappings"`
+			}
+			if err = json.Unmarshal(b, &fromFile); err != nil {
+				panic(fmt.Sprintf("Unable to parse index template at path %s: %s", t.Path, err))
+			}
+			t.Settings, t.Mappings = fromFile.Settings, fromFile.Mappings
+		}
+		if len(t.Settings) == 0 && len(t.Mappings) == 0 {
+			panic(fmt.Sprintf("Index template for namespace %s must specify settings or mappings", t.Namespace))
+		}
+		it := &indexTemplate{
+			Namespace:     t.Namespace,
+			Name:          t.Name,
+			Path:          t.Path,
+			IndexPatterns: t.IndexPatterns,
+			Priority:      t.Priority,
+			Overwrite:     t.Overwrite,
+			Settings:      t.Settings,
+			Mappings:      t.Mappings,
+		}
+		if len(it.IndexPatterns) == 0 {
+			it.IndexPatterns = []string{it.indexName()}
+		}
+		if it.Name == "" {
+			it.Name = it.templateName()
+		}
+		indexTemplates[t.Namespace] = it
+	}
+}
+
+func (is *indexSettings) settings() map[string]interface{} {
+	index := make(map[string]interface{})
+	if is.Shards > 0 {
+		index["number_of_shards"] = is.Shards
+	}
+	if is.Replicas != nil {
+		index["number_of_replicas"] = *is.Replicas
+	}
+	if is.RefreshInterval != "" {
+		index["refresh_interval"] = is.RefreshInterval
+	}
+	settings := make(map[string]interface{})
+	if len(index) > 0 {
+		settings["index"] = index
+	}
+	if len(is.Analysis) > 0 {
+		settings["analysis"] = is.Analysis
+	}
+	return settings
+}
+
+// mergeSettings copies settings from src into dst without replacing values
+// already present in dst
+func mergeSettings(dst, src map[string]interface{}) {
+	for k, v := range src {
+		sm, srcMap := v.(map[string]interface{})
+		dm, dstMap := dst[k].(map[string]interface{})
+		if srcMap && dstMap {
+			mergeSettings(dm, sm)
+		} else if _, exists := dst[k]; !exists {
+			dst[k] = v
+		}
+	}
+}
+
+// namespaceTemplate returns the index template of a namespace, creating one
+// that matches the index of the namespace when none is configured
+func namespaceTemplate(ns string) *indexTemplate {
+	it := indexTemplates[ns]
+	if it == nil {
+		it = &indexTemplate{Namespace: ns, Overwrite: true}
+		it.IndexPatterns = []string{it.indexName()}
+		it.Name = it.templateName()
+		indexTemplates[ns] = it
+	}
+	return it
+}
+
+// loadIndexSettings applies per-namespace index settings through the index
+// template of the namespace so that they take effect when the index is created
+func (config *configOptions) loadIndexSettings() {
+	seen := make(map[string]bool)
+	for _, is := range config.IndexSettings {
+		if is.Namespace == "" {
+			panic("Index settings must specify namespace")
+		}
+		if seen[is.Namespace] {
+			panic(fmt.Sprintf("Multiple index settings with namespace: %s", is.Namespace))
+		}
+		seen[is.Namespace] = true
+		if is.Shards < 0 || (is.Replicas != nil && *is.Replicas < 0) {
+			panic(fmt.Sprintf("Index settings for namespace %s must not have negative shards or replicas", is.Namespace))
+		}
+		settings := is.settings()
+		if len(settings) == 0 {
+			continue
+		}
+		it := namespaceTemplate(is.Namespace)
+		if it.Settings == nil {
+			it.Settings = make(map[string]interface{})
+		}
+		mergeSettings(it.Settings, settings)
+	}
+}
+
+// loadRuntimeFields collects the runtime fields of each namespace and adds
+// them to the index template of the namespace so that new indexes get them
+func (config *configOptions) loadRuntimeFields() {
+	for _, rf := range config.RuntimeField {
+		if rf.Namespace == "" || rf.Name == "" || rf.Type == "" {
+			panic("Runtime fields must specify namespace, name and type")
+		}
+		fields := runtimeFields[rf.Namespace]
+		if fields == nil {
+			fields = make(map[string]interface{})
+			runtimeFields[rf.Namespace] = fields
+		}
+		if _, exists := fields[rf.Name]; exists {
+			panic(fmt.Sprintf("Multiple runtime fields named %s in namespace %s", rf.Name, rf.Namespace))
+		}
+		def := map[string]interface{}{"type": rf.Type}
+		if rf.Script != "" {
+			def["script"] = map[string]interface{}{"source": rf.Script}
+		}
+		fields[rf.Name] = def
+	}
+	for ns, fields := range runtimeFields {
+		it := namespaceTemplate(ns)
+		if it.Mappings == nil {
+			it.Mappings = make(map[string]interface{})
+		}
+		mergeSettings(it.Mappings, map[string]interface{}{"runtime": fields})
+	}
+}
+
+func (config *configOptions) loadIndexBulkSettings() {
+	for _, b := range config.IndexBulk {
+		if b.Index == "" {
+			panic("Index bulk settings must specify index")
+		}
+		index := strings.ToLower(b.Index)
+		if _, exists := indexBulkSettings[index]; exists {
+			panic(fmt.Sprintf("Multiple index bulk settings with index: %s", index))
+		}
+		if b.Workers < 0 || b.MaxSeconds < 0 {
+			panic(fmt.Sprintf("Index bulk settings for %s must not have negative workers or max-seconds", index))
+		}
+		indexBulkSettings[index] = &indexBulk{
+			Index:      index,
+			Workers:    b.Workers,
+			MaxDocs:    b.MaxDocs,
+			MaxBytes:   b.MaxBytes,
+			MaxSeconds: b.MaxSeconds,
+		}
+	}
+}
+
+func (config *configOptions) loadVersionFields() {
+	for _, v := range config.VersionField {
+		if v.Namespace == "" || v.Field == "" {
+			panic("Version fields must specify namespace and field")
+		}
+		if _, exists := versionFields[v.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple version fields with namespace: %s", v.Namespace))
+		}
+		versionType := v.VersionType
+		if versionType == "" {
+			versionType = "external"
+		}
+		if versionType != "external" && versionType != "external_gte" {
+			panic(fmt.Sprintf("Version type for namespace %s must be external or external_gte", v.Namespace))
+		}
+		versionFields[v.Namespace] = &versionField{
+			Namespace:   v.Namespace,
+			Field:       v.Field,
+			VersionType: versionType,
+		}
+	}
+}
+
+func (config *configOptions) loadReindexes() {
+	for _, r := range config.Reindex {
+		if r.Namespace == "" {
+			panic("Reindex entries must specify namespace")
+		}
+		if _, exists := reindexJobs[r.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple reindex entries with namespace: %s", r.Namespace))
+		}
+		job := &reindexJob{reindex: r}
+		if r.Path != "" {
+			b, err := ioutil.ReadFile(r.Path)
+			if err != nil {
+				panic(fmt.Sprintf("Unable to read reindex index file at %s: %s", r.Path, err))
+			}
+			if err = json.Unmarshal(b, &job.body); err != nil {
+				panic(fmt.Sprintf("Unable to parse reindex index file at %s: %s", r.Path, err))
+			}
+		}
+		reindexJobs[r.Namespace] = job
+	}
+}
+
+func (config *configOptions) loadShadows() {
+	for _, sh := range config.Shadow {
+		if sh.Namespace == "" {
+			panic("Shadow entries must specify namespace")
+		}
+		if _, exists := shadowIndexes[sh.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple shadow entries with namespace: %s", sh.Namespace))
+		}
+		if sh.Percent <= 0 || sh.Percent > 100 {
+			panic(fmt.Sprintf("Shadow percent for namespace %s must be greater than 0 and at most 100", sh.Namespace))
+		}
+		si := &shadowIndex{shadow: sh}
+		if sh.Path != "" {
+			b, err := ioutil.ReadFile(sh.Path)
+			if err != nil {
+				panic(fmt.Sprintf("Unable to read shadow index file at %s: %s", sh.Path, err))
+			}
+			if err = json.Unmarshal(b, &si.body); err != nil {
+				panic(fmt.Sprintf("Unable to parse shadow index file at %s: %s", sh.Path, err))
+			}
+		}
+		if sh.Plugin != "" {
+			p, err := plugin.Open(sh.Plugin)
+			if err != nil {
+				panic(fmt.Sprintf("Unable to load shadow plugin %s: %s", sh.Plugin, err))
+			}
+			mapper, err := p.Lookup("Map")
+			if err != nil {
+				panic(fmt.Sprintf("Shadow plugin %s must define a Map function", sh.Plugin))
+			}
+			var ok bool
+			if si.mapper, ok = mapper.(func(*monstachemap.MapperPluginInput) (*monstachemap.MapperPluginOutput, error)); !ok {
+				panic(fmt.Sprintf("Plugin 'Map' function must be typed %T", si.mapper))
+			}
+		}
+		shadowIndexes[sh.Namespace] = si
+	}
+}
+
+func (config *configOptions) loadIngestPipelines() {
+	defined := make(map[string]string)
+	for _, p := range config.IngestPipeline {
+		if p.Namespace == "" || p.Name == "" {
+			panic("Ingest pipelines must specify namespace and name")
+		}
+		if _, exists := ingestPipelines[p.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple ingest pipelines with namespace: %s", p.Namespace))
+		}
+		ip := &ingestPipeline{
+			Namespace: p.Namespace,
+			Name:      p.Name,
+			Path:      p.Path,
+		}
+		if p.Path != "" {
+			if path, exists := defined[p.Name]; exists && path != p.Path {
+				panic(fmt.Sprintf("Ingest pipeline %s is defined by multiple files", p.Name))
+			}
+			defined[p.Name] = p.Path
+			b, err := ioutil.ReadFile(p.Path)
+			if err != nil {
+				panic(fmt.Sprintf("Unable to read ingest pipeline file at %s: %s", p.Path, err))
+			}
+			if err = json.Unmarshal(b, &ip.definition); err != nil {
+				panic(fmt.Sprintf("Unable to parse ingest pipeline file at %s: %s", p.Path, err))
+			}
+		}
+		ingestPipelines[p.Namespace] = ip
+	}
+}
+
+func (config *configOptions) loadRollovers() {
+	for _, r := range config.Rollover {
+		if r.Namespace == "" {
+			panic("Rollovers must specify namespace")
+		}
+		if _, exists := rollovers[r.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple rollovers with namespace: %s", r.Namespace))
+		}
+		if r.MaxAge == "" && r.MaxDocs <= 0 && r.MaxSize == "" {
+			panic(fmt.Sprintf("Rollover for namespace %s must specify at least one of max-age, max-docs and max-size", r.Namespace))
+		}
+		if r.CheckSeconds < 0 {
+			panic(fmt.Sprintf("Rollover for namespace %s must not have negative check-seconds", r.Namespace))
+		}
+		ro := r
+		if ro.CheckSeconds == 0 {
+			ro.CheckSeconds = 60
+		}
+		rollovers[r.Namespace] = &ro
+	}
+}
+
+func (config *configOptions) loadUpdateConflicts() {
+	for _, uc := range config.UpdateConflict {
+		if uc.Namespace == "" {
+			panic("Update conflict settings must specify namespace")
+		}
+		if _, exists := updateConflicts[uc.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple update conflict settings with namespace: %s", uc.Namespace))
+		}
+		if uc.RetryOnConflict < 0 {
+			panic(fmt.Sprintf("Update conflict settings for %s must not have negative retry-on-conflict", uc.Namespace))
+		}
+		c := uc
+		switch c.Policy {
+		case "":
+			c.Policy = "retry"
+		case "retry", "refetch", "drop":
+		default:
+			panic(fmt.Sprintf("Update conflict policy for %s must be one of retry, refetch or drop", uc.Namespace))
+		}
+		updateConflicts[uc.Namespace] = &c
+	}
+}
+
+func (config *configOptions) loadRoutingExprs() {
+	for _, r := range config.Routing {
+		if r.Namespace == "" {
+			panic("Routing must specify namespace")
+		}
+		if (r.Field == "") == (r.Template == "") {
+			panic(fmt.Sprintf("Routing for namespace %s must specify one of field or template", r.Namespace))
+		}
+		if _, exists := routingExprs[r.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple routing with namespace: %s", r.Namespace))
+		}
+		re := r
+		re.compile()
+		routingExprs[r.Namespace] = &re
+		// deletes need the routing recorded at index time
+		routingNamespaces[r.Namespace] = true
+	}
+}
+
+func (config *configOptions) loadJoins() {
+	for _, j := range config.Join {
+		if j.Namespace == "" || j.Field == "" || j.Name == "" {
+			panic("Joins must specify namespace, field and name")
+		}
+		if _, exists := joins[j.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple joins with namespace: %s", j.Namespace))
+		}
+		if (j.ParentNamespace == "") != (j.ParentField == "") {
+			panic(fmt.Sprintf("Join for namespace %s must specify both parent-namespace and parent-field or neither", j.Namespace))
+		}
+		if routingExprs[j.Namespace] != nil {
+			panic(fmt.Sprintf("Join for namespace %s cannot be combined with routing", j.Namespace))
+		}
+		jr := j
+		joins[j.Namespace] = &jr
+		if j.ParentNamespace != "" {
+			// children are routed to their parent and deletes need that routing
+			routingNamespaces[j.Namespace] = true
+		}
+	}
+	for _, j := range joins {
+		if j.ParentNamespace == "" {
+			continue
+		}
+		parent := joins[j.ParentNamespace]
+		if parent == nil || parent.Field != j.Field {
+			panic(fmt.Sprintf("Join for namespace %s must have a parent join on %s with field %s", j.Namespace, j.ParentNamespace, j.Field))
+		}
+		child := mapIndexType(config, &gtm.Op{Namespace: j.Namespace}).Index
+		if index := mapIndexType(config, &gtm.Op{Namespace: j.ParentNamespace}).Index; index != child {
+			panic(fmt.Sprintf("Joined namespaces %s and %s must be indexed into the same index", j.Namespace, j.ParentNamespace))
+		}
+	}
+	// the join field is mapped once with every relation through the template
+	// of the namespace at the root of the joins
+	relations := make(map[string]map[string][]string)
+	for _, j := range joins {
+		if j.ParentNamespace == "" {
+			continue
+		}
+		root := j
+		for depth := 0; root.ParentNamespace != ""; depth++ {
+			if depth == len(joins) {
+				panic(fmt.Sprintf("Join for namespace %s must not have a cyclic parent", j.Namespace))
+			}
+			root = joins[root.ParentNamespace]
+		}
+		if relations[root.Namespace] == nil {
+			relations[root.Namespace] = make(map[string][]string)
+		}
+		parent := joins[j.ParentNamespace].Name
+		relations[root.Namespace][parent] = append(relations[root.Namespace][parent], j.Name)
+	}
+	for ns, rels := range relations {
+		for _, children := range rels {
+			sort.Strings(children)
+		}
+		it := namespaceTemplate(ns)
+		if it.Mappings == nil {
+			it.Mappings = make(map[string]interface{})
+		}
+		mergeSettings(it.Mappings, map[string]interface{}{
+			"properties": map[string]interface{}{
+				joins[ns].Field: map[string]interface{}{"type": "join", "relations": rels},
+			},
+		})
+	}
+}
+
+func (config *configOptions) loadUnwinds() {
+	for _, u := range config.Unwind {
+		if u.Namespace == "" || u.Field == "" {
+			panic("Unwinds must specify namespace and field")
+		}
+		if strings.Contains(u.Field, ".") {
+			panic(fmt.Sprintf("Unwind field for namespace %s must be a top level field", u.Namespace))
+		}
+		if _, exists := unwinds[u.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple unwinds with namespace: %s", u.Namespace))
+		}
+		if joins[u.Namespace] != nil {
+			panic(fmt.Sprintf("Unwind for namespace %s cannot be combined with a join", u.Namespace))
+		}
+		uw := u
+		if uw.ParentField == "" {
+			uw.ParentField = "_unwind_id"
+		}
+		// the parent field is matched exactly when the elements are removed
+		it := namespaceTemplate(uw.Namespace)
+		if it.Mappings == nil {
+			it.Mappings = make(map[string]interface{})
+		}
+		mergeSettings(it.Mappings, map[string]interface{}{
+			"properties": map[string]interface{}{
+				uw.ParentField: map[string]interface{}{"type": "keyword"},
+			},
+		})
+		unwinds[u.Namespace] = &uw
+	}
+}
+
+func (config *configOptions) loadNumberFormats() {
+	for _, nf := range config.NumberFormat {
+		if nf.Namespace == "" {
+			panic("Number formats must specify namespace")
+		}
+		if _, exists := numberFormats[nf.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple number formats with namespace: %s", nf.Namespace))
+		}
+		switch nf.Decimal {
+		case "", "number", "string":
+		case "scaled", "scaled_float":
+			if nf.ScalingFactor <= 0 {
+				panic(fmt.Sprintf("Number format for namespace %s requires a positive scaling-factor", nf.Namespace))
+			}
+		default:
+			panic(fmt.Sprintf("Decimal format for namespace %s must be one of number, string, scaled or scaled_float", nf.Namespace))
+		}
+		switch nf.Long {
+		case "", "number", "string":
+		default:
+			panic(fmt.Sprintf("Long format for namespace %s must be one of number or string", nf.Namespace))
+		}
+		f := nf
+		numberFormats[nf.Namespace] = &f
+	}
+}
+
+func (config *configOptions) loadDateFormats() {
+	for _, d := range config.DateFormat {
+		if d.Namespace == "" {
+			panic("Date formats must specify namespace")
+		}
+		if _, exists := dateFormats[d.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple date formats with namespace: %s", d.Namespace))
+		}
+		df := d
+		var err error
+		if df.Timezone != "" {
+			if df.location, err = time.LoadLocation(df.Timezone); err != nil {
+				panic(fmt.Sprintf("Invalid timezone for date format %s: %s", d.Namespace, err))
+			}
+		}
+		df.inputLocation = time.UTC
+		if df.InputTimezone != "" {
+			if df.inputLocation, err = time.LoadLocation(df.InputTimezone); err != nil {
+				panic(fmt.Sprintf("Invalid input-timezone for date format %s: %s", d.Namespace, err))
+			}
+		}
+		switch df.Format {
+		case "", "iso", "epoch_millis", "epoch_second":
+		default:
+			df.layout = indexDateLayout.Replace(df.Format)
+		}
+		if len(df.InputFormats) == 0 {
+			df.InputFormats = []string{"rfc3339"}
+		}
+		for _, field := range df.Fields {
+			df.paths = append(df.paths, strings.Split(field, "."))
+		}
+		dateFormats[d.Namespace] = &df
+	}
+}
+
+func (config *configOptions) loadBulkErrorPolicies() {
+	for _, be := range config.BulkError {
+		switch be.Class {
+		case "rejected", "conflict", "mapping", "other":
+		default:
+			panic("Bulk error class must be one of rejected, conflict, mapping or other")
+		}
+		if _, exists := bulkErrorPolicies[be.Class]; exists {
+			panic(fmt.Sprintf("Multiple bulk error policies with class: %s", be.Class))
+		}
+		if be.Retries < 0 || be.BackoffMs < 0 || be.MaxBackoffMs < 0 {
+			panic(fmt.Sprintf("Bulk error policy for %s must not have negative values", be.Class))
+		}
+		p := be
+		switch p.Action {
+		case "":
+			p.Action = "log"
+		case "log", "dead-letter", "drop":
+		default:
+			panic(fmt.Sprintf("Bulk error action for %s must be one of log, dead-letter or drop", be.Class))
+		}
+		if p.BackoffMs == 0 {
+			p.BackoffMs = 100
+		}
+		if p.MaxBackoffMs == 0 {
+			p.MaxBackoffMs = 60000
+		}
+		bulkErrorPolicies[be.Class] = &p
+	}
+	if len(bulkErrorPolicies) > 0 {
+		// the bulk processors no longer retry items so the transient failures
+		// of classes without a policy are retried like they did
+		defaultBulkErrorPolicy = &bulkErrorPolicy{Retries: 5, BackoffMs: 200, MaxBackoffMs: 10000, Action: "log"}
+	}
+}
+
+// bulkRetryStatusCodes are the item statuses the bulk processor retries
+var bulkRetryStatusCodes = map[int]bool{408: true, 429: true, 503: true, 507: true}
+
+// inherit fills the settings which are not set from the defaults.  Routing
+// is inherited only when neither routing-field nor routing-template is set
+func (ns namespaceSettings) inherit(defaults *namespaceSettings) *namespaceSettings {
+	if ns.Pipeline == "" {
+		ns.Pipeline = defaults.Pipeline
+	}
+	if ns.RoutingField == "" && ns.RoutingTemplate == "" {
+		ns.RoutingField, ns.RoutingTemplate = defaults.RoutingField, defaults.RoutingTemplate
+	}
+	if ns.ExcludeFields == nil {
+		ns.ExcludeFields = defaults.ExcludeFields
+	}
+	if ns.Workers == 0 {
+		ns.Workers = defaults.Workers
+	}
+	if ns.MaxDocs == 0 {
+		ns.MaxDocs = defaults.MaxDocs
+	}
+	if ns.MaxBytes == 0 {
+		ns.MaxBytes = defaults.MaxBytes
+	}
+	if ns.MaxSeconds == 0 {
+		ns.MaxSeconds = defaults.MaxSeconds
+	}
+	return &ns
+}
+
+// apply adds the settings to the namespace tables unless a dedicated table
+// already configures them.  The defaults are kept under the empty namespace.
+// Bulk sizes apply to the index of a listed namespace; other indexes use
+// the elasticsearch-max-* options
+func (ns *namespaceSettings) apply() {
+	if ns.RoutingField != "" && ns.RoutingTemplate != "" {
+		panic(fmt.Sprintf("Namespace settings for %q must not specify both routing-field and routing-template", ns.Namespace))
+	}
+	if ns.Workers < 0 || ns.MaxSeconds < 0 {
+		panic(fmt.Sprintf("Namespace settings for %q must not have negative workers or max-seconds", ns.Namespace))
+	}
+	if ns.Pipeline != "" && ingestPipelines[ns.Namespace] == nil {
+		ingestPipelines[ns.Namespace] = &ingestPipeline{Namespace: ns.Namespace, Name: ns.Pipeline}
+	}
+	if ns.RoutingField != "" || ns.RoutingTemplate != "" {
+		if routingExprs[ns.Namespace] == nil && joins[ns.Namespace] == nil {
+			re := &routingExpr{Namespace: ns.Namespace, Field: ns.RoutingField, Template: ns.RoutingTemplate}
+			re.compile()
+			routingExprs[ns.Namespace] = re
+			// deletes need the routing recorded at index time
+			routingNamespaces[ns.Namespace] = true
+		}
+	}
+	if _, exists := fieldExclusions[ns.Namespace]; ns.ExcludeFields != nil && !exists {
+		// an empty list turns off the default exclusions
+		fieldExclusions[ns.Namespace] = fieldPaths(ns.ExcludeFields)
+	}
+	if ns.Namespace == "" || ns.Workers+ns.MaxDocs+ns.MaxBytes+ns.MaxSeconds == 0 {
+		return
+	}
+	index := ns.Namespace
+	if m := mapIndexTypes[ns.Namespace]; m != nil && m.Index != "" {
+		index = m.Index
+	}
+	index = strings.ToLower(index)
+	if indexBulkSettings[index] == nil {
+		indexBulkSettings[index] = &indexBulk{
+			Index:      index,
+			Workers:    ns.Workers,
+			MaxDocs:    ns.MaxDocs,
+			MaxBytes:   ns.MaxBytes,
+			MaxSeconds: ns.MaxSeconds,
+		}
+	}
+}
+
+func (config *configOptions) loadNamespaceSettings() {
+	defaults := &namespaceSettings{}
+	if config.NamespaceDefaults != nil {
+		if config.NamespaceDefaults.Namespace != "" {
+			panic("Namespace defaults must not specify namespace")
+		}
+		defaults = config.NamespaceDefaults
+	}
+	seen := make(map[string]bool)
+	for _, ns := range config.Namespace {
+		if ns.Namespace == "" {
+			panic("Namespace settings must specify namespace")
+		}
+		if seen[ns.Namespace] {
+			panic(fmt.Sprintf("Multiple namespace settings with namespace: %s", ns.Namespace))
+		}
+		seen[ns.Namespace] = true
+		ns.inherit(defaults).apply()
+	}
+	defaults.apply()
+}
+
+// namespacePipeline is the ingest pipeline of a namespace or the default
+func namespacePipeline(ns string) *ingestPipeline {
+	if ip := ingestPipelines[ns]; ip != nil {
+		return ip
+	}
+	return ingestPipelines[""]
+}
+
+// namespaceRouting is the routing of a namespace or the default.  Joins
+// route by their own rules
+func namespaceRouting(ns string) *routingExpr {
+	if re := routingExprs[ns]; re != nil || joins[ns] != nil {
+		return re
+	}
+	return routingExprs[""]
+}
+
+// fieldPaths splits dotted field names once at load instead of per event
+func fieldPaths(fields []string) [][]string {
+	paths := make([][]string, 0, len(fields))
+	for _, field := range fields {
+		paths = append(paths, strings.Split(field, "."))
+	}
+	return paths
+}
+
+func (config *configOptions) loadFieldExclusions() {
+	for _, fe := range config.ExcludeFields {
+		if fe.Namespace == "" || len(fe.Fields) == 0 {
+			panic("Field exclusions must specify namespace and fields")
+		}
+		fieldExclusions[fe.Namespace] = append(fieldExclusions[fe.Namespace], fieldPaths(fe.Fields)...)
+	}
+}
+
+func (config *configOptions) loadRedactions() {
+	for _, fr := range config.Redact {
+		r := fr
+		if r.Namespace == "" || len(r.Fields) == 0 {
+			panic("Redactions must specify namespace and fields")
+		}
+		switch r.Action {
+		case "":
+			r.Action = "drop"
+		case "drop", "hash", "mask":
+		default:
+			panic(fmt.Sprintf("Redaction action for %s must be one of drop, hash or mask", r.Namespace))
+		}
+		if r.Action == "hash" && r.Salt == "" {
+			panic(fmt.Sprintf("Redaction by hash for %s must specify a salt", r.Namespace))
+		}
+		if r.KeepLast < 0 {
+			panic(fmt.Sprintf("Redaction keep-last for %s must not be negative", r.Namespace))
+		}
+		r.paths = fieldPaths(r.Fields)
+		redactions[r.Namespace] = append(redactions[r.Namespace], &r)
+	}
+}
+
+func (config *configOptions) loadPIIScans() {
+	for _, ps := range config.PII {
+		p := ps
+		if p.Namespace == "" || len(p.Fields) == 0 {
+			panic("PII scans must specify namespace and fields")
+		}
+		switch p.Action {
+		case "":
+			p.Action = "token"
+		case "token", "hash":
+		default:
+			panic(fmt.Sprintf("PII action for %s must be one of token or hash", p.Namespace))
+		}
+		if p.Salt == "" {
+			panic(fmt.Sprintf("PII scan for %s must specify a salt", p.Namespace))
+		}
+		if err := p.compile(); err != nil {
+			panic(err)
+		}
+		p.paths = fieldPaths(p.Fields)
+		piiScans[p.Namespace] = append(piiScans[p.Namespace], &p)
+	}
+}
+
+func (config *configOptions) loadCoercions() {
+	for _, c := range config.Coerce {
+		if c.Namespace == "" || c.Field == "" {
+			panic("Coercions must specify namespace and field")
+		}
+		switch c.Type {
+		case "date", "long", "double", "boolean", "string":
+		default:
+			panic(fmt.Sprintf("Coercion type for %s in %s must be one of date, long, double, boolean or string", c.Field, c.Namespace))
+		}
+		co := c
+		switch co.OnError {
+		case "":
+			co.OnError = "keep"
+		case "keep", "null", "drop-field", "skip-document":
+		default:
+			panic(fmt.Sprintf("Coercion on-error for %s in %s must be one of keep, null, drop-field or skip-document", c.Field, c.Namespace))
+		}
+		coercions[c.Namespace] = append(coercions[c.Namespace], &co)
+	}
+}
+
+func (config *configOptions) loadGeoFields() {
+	for _, g := range config.Geo {
+		if g.Namespace == "" || g.Field == "" {
+			panic("Geo fields must specify namespace and field")
+		}
+		gf := g
+		switch gf.Type {
+		case "":
+			gf.Type = "geo_point"
+		case "geo_point", "geo_shape":
+		default:
+			panic(fmt.Sprintf("Geo type for %s in %s must be one of geo_point or geo_shape", g.Field, g.Namespace))
+		}
+		switch gf.OnError {
+		case "":
+			gf.OnError = "drop-field"
+		case "keep", "null", "drop-field", "skip-document":
+		default:
+			panic(fmt.Sprintf("Geo on-error for %s in %s must be one of keep, null, drop-field or skip-document", g.Field, g.Namespace))
+		}
+		it := namespaceTemplate(gf.Namespace)
+		if it.Mappings == nil {
+			it.Mappings = make(map[string]interface{})
+		}
+		mergeSettings(it.Mappings, map[string]interface{}{
+			"properties": map[string]interface{}{
+				gf.Field: map[string]interface{}{"type": gf.Type},
+			},
+		})
+		geoFields[gf.Namespace] = append(geoFields[gf.Namespace], &gf)
+	}
+}
+
+func (config *configOptions) loadCopyFields() {
+	for _, c := range config.CopyField {
+		if c.Namespace == "" || len(c.Fields) == 0 || c.Target == "" {
+			panic("Copy fields must specify namespace, fields and target")
+		}
+		for _, field := range c.Fields {
+			if field == c.Target {
+				panic(fmt.Sprintf("Copy field target %s in %s cannot also be a source field", c.Target, c.Namespace))
+			}
+		}
+		cf := c
+		copyFields[c.Namespace] = append(copyFields[c.Namespace], &cf)
+	}
+}
+
+func (config *configOptions) loadReferences() {
+	for _, r := range config.Reference {
+		if r.Namespace == "" || !strings.Contains(r.Namespace, ".") {
+			panic("References must specify a namespace of the form db.collection")
+		}
+		if references == nil {
+			references = &referenceCache{collections: make(map[string]*referenceCollection)}
+		}
+		if references.collections[r.Namespace] != nil {
+			panic(fmt.Sprintf("Multiple references with namespace: %s", r.Namespace))
+		}
+		rc := r
+		dbCol := strings.SplitN(r.Namespace, ".", 2)
+		rc.db, rc.col = dbCol[0], dbCol[1]
+		if rc.Key == "" {
+			rc.Key = "_id"
+		}
+		if rc.MaxDocs <= 0 {
+			rc.MaxDocs = referenceMaxDocsDefault
+		}
+		references.collections[r.Namespace] = &rc
+	}
+}
+
+func (config *configOptions) loadEnrichments() {
+	for _, e := range config.Enrich {
+		if e.Namespace == "" || e.Reference == "" || e.Field == "" || e.Target == "" {
+			panic("Enrichments must specify namespace, reference, field and target")
+		}
+		if references == nil || references.collections[e.Reference] == nil {
+			panic(fmt.Sprintf("Enrichment of %s uses %s which is not a reference", e.Namespace, e.Reference))
+		}
+		en := e
+		enrichments[e.Namespace] = append(enrichments[e.Namespace], &en)
+	}
+}
+
+func (config *configOptions) loadDocumentSizes() {
+	for _, d := range config.DocumentSize {
+		if d.Namespace == "" || d.MaxBytes <= 0 {
+			panic("Document sizes must specify namespace and a positive max-bytes")
+		}
+		if _, exists := documentSizes[d.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple document sizes with namespace: %s", d.Namespace))
+		}
+		ds := d
+		switch ds.Action {
+		case "":
+			ds.Action = "truncate"
+		case "truncate", "drop":
+		default:
+			panic(fmt.Sprintf("Document size action for %s must be one of truncate or drop", d.Namespace))
+		}
+		documentSizes[d.Namespace] = &ds
+	}
+}
+
+func (config *configOptions) loadDeleteRoutings() {
+	for _, d := range config.DeleteRouting {
+		if d.Namespace == "" {
+			panic("Delete routings must specify namespace")
+		}
+		if _, exists := deleteRoutings[d.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple delete routings with namespace: %s", d.Namespace))
+		}
+		dr := d
+		switch dr.Strategy {
+		case "stateless":
+			dr.strategy = statelessDeleteStrategy
+		case "stateful":
+			dr.strategy = statefulDeleteStrategy
+		case "cache":
+			dr.strategy = cacheDeleteStrategy
+			if dr.CacheSize < 0 {
+				panic(fmt.Sprintf("Delete routing cache-size for %s must not be negative", d.Namespace))
+			}
+			if dr.CacheSize == 0 {
+				dr.CacheSize = deleteRoutingCacheSizeDefault
+			}
+			dr.cache = &routingTracker{size: dr.CacheSize, cache: make(map[string]routedCopy)}
+		case "pre-image":
+			dr.strategy = preImageDeleteStrategy
+		default:
+			panic(fmt.Sprintf("Delete routing strategy for %s must be one of stateless, stateful, cache or pre-image", d.Namespace))
+		}
+		deleteRoutings[d.Namespace] = &dr
+	}
+}
+
+func (config *configOptions) loadTombstones() {
+	for _, t := range config.Tombstone {
+		if t.Namespace == "" {
+			panic("Tombstones must specify namespace")
+		}
+		if _, exists := tombstones[t.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple tombstones with namespace: %s", t.Namespace))
+		}
+		ts := t
+		if ts.Field == "" {
+			ts.Field = "deleted"
+		}
+		if ts.DeletedAtField == "" {
+			ts.DeletedAtField = "deleted_at"
+		}
+		if ts.Retention != "" {
+			retention, err := time.ParseDuration(ts.Retention)
+			if err != nil || retention <= 0 {
+				panic(fmt.Sprintf("Tombstone retention for %s must be a positive duration such as 720h", t.Namespace))
+			}
+			ts.retention = retention
+		}
+		tombstones[t.Namespace] = &ts
+	}
+}
+
+func (config *configOptions) loadFileFilters() {
+	for _, f := range config.FileFilter {
+		if f.Namespace == "" {
+			panic("File filters must specify namespace")
+		}
+		if _, exists := fileFilters[f.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple file filters with namespace: %s", f.Namespace))
+		}
+		if f.MaxBytes < 0 {
+			panic(fmt.Sprintf("File filter max-bytes for %s must not be negative", f.Namespace))
+		}
+		ff := f
+		fileFilters[f.Namespace] = &ff
+	}
+}
+
+func (config *configOptions) loadTikaFields() {
+	for _, t := range config.TikaField {
+		if t.Namespace == "" || t.Field == "" || t.Target == "" {
+			panic("Tika fields must specify namespace, field and target")
+		}
+		tf := t
+		tikaFields[t.Namespace] = append(tikaFields[t.Namespace], &tf)
+	}
+}
+
+// languageAnalyzers are the built in analyzers of Elasticsearch by ISO 639-1
+// code.  und is the code of text whose language is unknown
+var languageAnalyzers = map[string]string{
+	"ar": "arabic", "hy": "armenian", "eu": "basque", "bn": "bengali",
+	"pt-br": "brazilian", "bg": "bulgarian", "ca": "catalan", "zh": "cjk",
+	"ja": "cjk", "ko": "cjk", "cs": "czech", "da": "danish", "nl": "dutch",
+	"en": "english", "et": "estonian", "fi": "finnish", "fr": "french",
+	"gl": "galician", "de": "german", "el": "greek", "hi": "hindi",
+	"hu": "hungarian", "id": "indonesian", "ga": "irish", "it": "italian",
+	"lv": "latvian", "lt": "lithuanian", "no": "norwegian", "nb": "norwegian",
+	"fa": "persian", "pt": "portuguese", "ro": "romanian", "ru": "russian",
+	"ckb": "sorani", "es": "spanish", "sv": "swedish", "tr": "turkish",
+	"th": "thai", "und": "standard",
+}
+
+func (config *configOptions) loadLanguageRoutings() {
+	for _, l := range config.LanguageRouting {
+		if l.Namespace == "" || len(l.Fields) == 0 || len(l.Languages) == 0 {
+			panic("Language routings must specify namespace, fields and languages")
+		}
+		if _, exists := languageRoutings[l.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple language routings with namespace: %s", l.Namespace))
+		}
+		lr := l
+		switch lr.Mode {
+		case "":
+			lr.Mode = "subfield"
+		case "subfield", "index":
+		default:
+			panic(fmt.Sprintf("Language routing mode for %s must be one of subfield or index", lr.Namespace))
+		}
+		if lr.LanguageField == "" {
+			lr.LanguageField = "language"
+		}
+		if lr.Default == "" {
+			lr.Default = "und"
+		}
+		lr.Default = strings.ToLower(lr.Default)
+		analyzers := make(map[string]string)
+		lr.supported = make(map[string]bool)
+		for _, lang := range append([]string{lr.Default}, lr.Languages...) {
+			lang = strings.ToLower(strings.Replace(lang, "_", "-", -1))
+			analyzer := lr.Analyzers[lang]
+			if analyzer == "" {
+				analyzer = languageAnalyzers[lang]
+			}
+			if analyzer == "" {
+				panic(fmt.Sprintf("No analyzer for language %s of %s. Set one with analyzers", lang, lr.Namespace))
+			}
+			analyzers[lang] = analyzer
+			lr.supported[lang] = true
+		}
+		lr.Analyzers = analyzers
+		if lr.Mode == "index" {
+			// documents move between the language indexes of the namespace
+			routingNamespaces[lr.Namespace] = true
+		} else {
+			it := namespaceTemplate(lr.Namespace)
+			if it.Mappings == nil {
+				it.Mappings = make(map[string]interface{})
+			}
+			mergeSettings(it.Mappings, lr.mappings(""))
+		}
+		languageRoutings[lr.Namespace] = &lr
+	}
+}
+
+// mappings maps the fields with the analyzer of a language or, without
+// one, maps the subfield of every language
+func (lr *languageRouting) mappings(lang string) map[string]interface{} {
+	props := make(map[string]interface{})
+	for _, field := range lr.Fields {
+		if lang != "" {
+			props[field] = map[string]interface{}{"type": "text", "analyzer": lr.Analyzers[lang]}
+			continue
+		}
+		subfields := make(map[string]interface{})
+		for code, analyzer := range lr.Analyzers {
+			subfields[code] = map[string]interface{}{"type": "text", "analyzer": analyzer}
+		}
+		props[field] = map[string]interface{}{"properties": subfields}
+	}
+	return map[string]interface{}{"properties": props}
+}
+
+// templates returns an index template per language in index mode.  Each
+// includes the template of the namespace so that it can take precedence over
+// it for the language index
+func (lr *languageRouting) templates() (templates []*indexTemplate) {
+	if lr.Mode != "index" {
+		return
+	}
+	base := indexTemplates[lr.Namespace]
+	if base == nil {
+		base = &indexTemplate{Namespace: lr.Namespace}
+		base.IndexPatterns = []string{base.indexName()}
+		base.Name = base.templateName()
+	}
+	var codes []string
+	for code := range lr.Analyzers {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		it := &indexTemplate{
+			Namespace: lr.Namespace,
+			Name:      base.Name + "-" + code,
+			Priority:  base.Priority + 1,
+			Overwrite: true,
+			Settings:  base.Settings,
+			Mappings:  lr.mappings(code),
+		}
+		for _, pattern := range base.IndexPatterns {
+			it.IndexPatterns = append(it.IndexPatterns, pattern+"-"+code)
+		}
+		mergeSettings(it.Mappings, base.Mappings)
+		templates = append(templates, it)
+	}
+	return
+}
+
+// language returns the supported language of a document.  The code in the
+// language field is tried first, by its primary subtag if the full tag is
+// not supported, then Tika detects the language of the text if enabled
+func (lr *languageRouting) language(op *gtm.Op) string {
+	if val, ok := fieldValue(op.Data, lr.LanguageField); ok {
+		if code, isString := val.(string); isString {
+			if lang := lr.code(code); lang != "" {
+				return lang
+			}
+		}
+	}
+	if !lr.Detect {
+		return lr.Default
+	}
+	var text []string
+	for _, field := range lr.Fields {
+		if val, ok := fieldValue(op.Data, field); ok {
+			if s, isString := val.(string); isString {
+				text = append(text, s)
+			}
+		}
+	}
+	if len(text) == 0 {
+		return lr.Default
+	}
+	code, err := tika.detectLanguage(strings.Join(text, "\n"))
+	if err != nil {
+		logWith(warnLog, opLogFields(op), "Unable to detect the language of document %v in %s: %s", op.Id, op.Namespace, err)
+		return lr.Default
+	}
+	if lang := lr.code(code); lang != "" {
+		return lang
+	}
+	return lr.Default
+}
+
+func (lr *languageRouting) code(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "_", "-", -1))
+	if lr.supported[code] {
+		return code
+	}
+	if dash := strings.Index(code, "-"); dash != -1 && lr.supported[code[:dash]] {
+		return code[:dash]
+	}
+	return ""
+}
+
+// apply moves the text fields under the language of the document or sets
+// the language index of the document
+func (lr *languageRouting) apply(config *configOptions, op *gtm.Op, meta *indexingMeta) {
+	lang := lr.language(op)
+	if lr.Mode == "index" {
+		meta.Index = meta.indexOr(mapIndexType(config, op).Index) + "-" + lang
+		return
+	}
+	for _, field := range lr.Fields {
+		parent, name, ok := fieldParent(op.Data, field)
+		if !ok || parent[name] == nil {
+			continue
+		}
+		if _, isMap := parent[name].(map[string]interface{}); isMap {
+			continue
+		}
+		parent[name] = map[string]interface{}{lang: parent[name]}
+	}
+}
+
+func (config *configOptions) loadEmbeddings() {
+	for _, e := range config.Embedding {
+		if e.Namespace == "" || len(e.Fields) == 0 || e.Target == "" || e.URL == "" {
+			panic("Embeddings must specify namespace, fields, target and url")
+		}
+		switch e.OnError {
+		case "":
+			e.OnError = "index"
+		case "index", "skip-document":
+		default:
+			panic(fmt.Sprintf("Embedding on-error for %s in %s must be one of index or skip-document", e.Target, e.Namespace))
+		}
+		if e.BatchSize <= 0 {
+			e.BatchSize = 16
+		}
+		if e.BatchMs <= 0 {
+			e.BatchMs = 50
+		}
+		if e.CacheSize <= 0 {
+			e.CacheSize = 10000
+		}
+		if e.TimeoutSeconds <= 0 {
+			e.TimeoutSeconds = 30
+		}
+		if e.Dims > 0 {
+			it := namespaceTemplate(e.Namespace)
+			if it.Mappings == nil {
+				it.Mappings = make(map[string]interface{})
+			}
+			mergeSettings(it.Mappings, map[string]interface{}{
+				"properties": map[string]interface{}{
+					e.Target: map[string]interface{}{"type": "dense_vector", "dims": e.Dims},
+				},
+			})
+		}
+		embeddings[e.Namespace] = append(embeddings[e.Namespace], e)
+	}
+}
+
+// loadSemanticFields maps semantic fields in the index template of the
+// namespace and generates the inference ingest pipeline for ELSER fields.
+// An ingest pipeline already configured for the namespace runs first
+func (config *configOptions) loadSemanticFields() {
+	processors := make(map[string][]interface{})
+	for _, sf := range config.SemanticField {
+		if sf.Namespace == "" || sf.Field == "" {
+			panic("Semantic fields must specify namespace and field")
+		}
+		var mapping map[string]interface{}
+		if sf.InferenceID != "" {
+			mapping = map[string]interface{}{
+				sf.Field: map[string]interface{}{"type": "semantic_text", "inference_id": sf.InferenceID},
+			}
+		} else {
+			if sf.ModelID == "" {
+				sf.ModelID = ".elser_model_2"
+			}
+			if sf.Target == "" {
+				sf.Target = sf.Field + "_tokens"
+			}
+			mapping = map[string]interface{}{
+				sf.Target: map[string]interface{}{"type": "sparse_vector"},
+			}
+			processors[sf.Namespace] = append(processors[sf.Namespace], map[string]interface{}{
+				"inference": map[string]interface{}{
+					"model_id": sf.ModelID,
+					"input_output": []interface{}{
+						map[string]interface{}{"input_field": sf.Field, "output_field": sf.Target},
+					},
+					"ignore_missing": true,
+					"on_failure": []interface{}{
+						map[string]interface{}{
+							"set": map[string]interface{}{
+								"field": "_monstache_inference_error",
+								"value": "{{ _ingest.on_failure_message }}",
+							},
+						},
+					},
+				},
+			})
+		}
+		it := namespaceTemplate(sf.Namespace)
+		if it.Mappings == nil {
+			it.Mappings = make(map[string]interface{})
+		}
+		mergeSettings(it.Mappings, map[string]interface{}{"properties": mapping})
+	}
+	for ns, procs := range processors {
+		chained := ingestPipelines[ns]
+		if chained != nil {
+			procs = append([]interface{}{
+				map[string]interface{}{"pipeline": map[string]interface{}{"name": chained.Name}},
+			}, procs...)
+		}
+		ingestPipelines[ns] = &ingestPipeline{
+			Namespace: ns,
+			Name:      "monstache-semantic-" + strings.ToLower(ns),
+			definition: map[string]interface{}{
+				"description": "Semantic inference for " + ns,
+				"processors":  procs,
+			},
+			chained: chained,
+		}
+	}
+}
+
+func (config *configOptions) loadPipelines() {
+	for _, s := range config.Pipeline {
+		if s.Path == "" && s.Script == "" {
+			panic("Pipelines must specify path or script attributes")
+		}
+		if s.Path != "" && s.Script != "" {
+			panic("Pipelines must specify path or script but not both")
+		}
+		if s.Path != "" {
+			if script, err := ioutil.ReadFile(s.Path); err == nil {
+				s.Script = string(script[:])
+			} else {
+				panic(fmt.Sprintf("Unable to load pipeline at path %s: %s", s.Path, err))
+			}
+		}
+		if _, exists := filterEnvs[s.Namespace]; exists {
+			panic(fmt.Sprintf("Multiple pipelines with namespace: %s", s.Namespace))
+		}
+		env := &executionEnv{
+			VM:     otto.New(),
+			Script: s.Script,
+			lock:   &sync.Mutex{},
+		}
+		if err := env.VM.Set("module", make(map[string]interface{})); err != nil {
+			panic(err)
+		}
+		if _, err := env.VM.Run(env.Script); err != nil {
+			panic(err)
+		}
+		val, err := env.VM.Run("module.exports")
+		if err != nil {
+			panic(err)
+		} else if !val.IsFunction() {
+			panic("module.exports must be a function")
+		}
+		pipeEnvs[s.Namespace] = env
+	}
+}
+
+func (config *configOptions) loadFilters() {
+	for _, s := range config.Filter {
+		if s.Script != "" || s.Path != "" {
+			if s.Path != "" && s.Script != "" {
+				panic("Filters must specify path or script but not both")
+			}
+			if s.Path != "" {
+				if script, err := ioutil.ReadFile(s.Path); err == nil {
+					s.Script = string(script[:])
+				} else {
+					panic(fmt.Sprintf("Unable to load filter at path %s: %s", s.Path, err))
+				}
+			}
+			if _, exists := filterEnvs[s.Namespace]; exists {
+				panic(fmt.Sprintf("Multiple filters with namespace: %s", s.Namespace))
+			}
+			env := &executionEnv{
+				VM:     otto.New(),
+				Script: s.Script,
+				lock:   &sync.Mutex{},
+			}
+			if err := env.VM.Set("module", make(map[string]interface{})); err != nil {
+				panic(err)
+			}
+			if _, err := env.VM.Run(env.Script); err != nil {
+				panic(err)
+			}
+			val, err := env.VM.Run("module.exports")
+			if err != nil {
+				panic(err)
+			} else if !val.IsFunction() {
+				panic("module.exports must be a function")
+			}
+			filterEnvs[s.Namespace] = env
+		} else {
+			panic("Filters must specify path or script attributes")
+		}
+	}
+}
+
+func (config *configOptions) loadScripts() {
+	for _, s := range config.Script {
+		if s.Script != "" || s.Path != "" {
+			if s.Path != "" && s.Script != "" {
+				panic("Scripts must specify path or script but not both")
+			}
+			if s.Path != "" {
+				if script, err := ioutil.ReadFile(s.Path); err == nil {
+					s.Script = string(script[:])
+				} else {
+					panic(fmt.Sprintf("Unable to load script at path %s: %s", s.Path, err))
+				}
+			}
+			if _, exists := mapEnvs[s.Namespace]; exists {
+				panic(fmt.Sprintf("Multiple scripts with namespace: %s", s.Namespace))
+			}
+			env := &executionEnv{
+				VM:     otto.New(),
+				Script: s.Script,
+				lock:   &sync.Mutex{},
+			}
+			if err := env.VM.Set("module", make(map[string]interface{})); err != nil {
+				panic(err)
+			}
+			if _, err := env.VM.Run(env.Script); err != nil {
+				panic(err)
+			}
+			val, err := env.VM.Run("module.exports")
+			if err != nil {
+				panic(err)
+			} else if !val.IsFunction() {
+				panic("module.exports must be a function")
+			}
+
+			mapEnvs[s.Namespace] = env
+			if s.Routing {
+				routingNamespaces[s.Namespace] = true
+			}
+		} else {
+			panic("Scripts must specify path or script")
+		}
+	}
+}
+
+func (config *configOptions) loadPlugins() *configOptions {
+	if config.MapperPluginPath != "" {
+		funcDefined := false
+		p, err := plugin.Open(config.MapperPluginPath)
+		if err != nil {
+			panic(fmt.Sprintf("Unable to load mapper plugin %s: %s", config.MapperPluginPath, err))
+		}
+		mapper, err := p.Lookup("Map")
+		if err == nil {
+			funcDefined = true
+			switch mapper.(type) {
+			case func(*monstachemap.MapperPluginInput) (*monstachemap.MapperPluginOutput, error):
+				mapperPlugin = mapper.(func(*monstachemap.MapperPluginInput) (*monstachemap.MapperPluginOutput, error))
+			default:
+				panic(fmt.Sprintf("Plugin 'Map' function must be typed %T", mapperPlugin))
+			}
+		}
+		filter, err := p.Lookup("Filter")
+		if err == nil {
+			funcDefined = true
+			switch filter.(type) {
+			case func(*monstachemap.MapperPluginInput) (bool, error):
+				filterPlugin = filter.(func(*monstachemap.MapperPluginInput) (bool, error))
+			default:
+				panic(fmt.Sprintf("Plugin 'Filter' function must be typed %T", filterPlugin))
+			}
+
+		}
+		process, err := p.Lookup("Process")
+		if err == nil {
+			funcDefined = true
+			switch process.(type) {
+			case func(*monstachemap.ProcessPluginInput) error:
+				processPlugin = process.(func(*monstachemap.ProcessPluginInput) error)
+			default:
+				panic(fmt.Sprintf("Plugin 'Process' function must be typed %T", processPlugin))
+			}
+		}
+		pipe, err := p.Lookup("Pipeline")
+		if err == nil {
+			funcDefined = true
+			switch pipe.(type) {
+			case func(string, bool) ([]interface{}, error):
+				pipePlugin = pipe.(func(string, bool) ([]interface{}, error))
+			default:
+				panic(fmt.Sprintf("Plugin 'Pipeline' function must be typed %T", pipePlugin))
+			}
+		}
+		sink, err := p.Lookup("Sink")
+		if err == nil {
+			funcDefined = true
+			switch sink.(type) {
+			case func() (monstachemap.Sink, error):
+				sinkPlugin = sink.(func() (monstachemap.Sink, error))
+			default:
+				panic(fmt.Sprintf("Plugin 'Sink' function must be typed %T", sinkPlugin))
+			}
+		}
+		if !funcDefined {
+			warnLog.Println("Plugin loaded but did not find a Map, Filter, Process, Pipeline or Sink function")
+		}
+	}
+	return config
+}
+
+// renderConfigTemplate executes the config file as a template with the
+// environment as data
+func renderConfigTemplate(tpl string) (string, error) {
+	env := map[string]string{}
+	for _, e := range os.Environ() {
+		pair := strings.SplitN(e, "=", 2)
+		if len(pair) < 2 {
+			continue
+		}
+		name, val := pair[0], pair[1]
+		env[name] = val
+	}
+	t, err := template.New("config").Parse(tpl)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err = t.Execute(&b, env); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+var envVarRegex = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv replaces ${VAR} and ${VAR:-default} with the value of the
+// environment variable.  The default is used when the variable is unset or
+// empty and $$ is a literal $
+func expandEnv(text string) string {
+	return envVarRegex.ReplaceAllStringFunc(text, func(ref string) string {
+		if ref == "$$" {
+			return "$"
+		}
+		m := envVarRegex.FindStringSubmatch(ref)
+		name, hasDefault, def := m[1], m[2] != "", m[3]
+		val, ok := os.LookupEnv(name)
+		if val == "" && hasDefault {
+			return def
+		}
+		if !ok {
+			warnLog.Printf("Environment variable %s referenced in the config file is not set", name)
+		}
+		return val
+	})
+}
+
+// readConfigText reads the config file and expands environment variables
+func readConfigText(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return expandEnv(string(b)), nil
+}
+
+// configToTOML converts a YAML or JSON config file, detected by extension,
+// to TOML so that it is decoded with the same option names and rules
+func configToTOML(path, text string) (string, error) {
+	var doc interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal([]byte(text), &doc); err != nil {
+			return "", err
+		}
+	case ".json":
+		dec := json.NewDecoder(strings.NewReader(text))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return "", err
+		}
+	default:
+		return text, nil
+	}
+	table, ok := normalizeConfigValue(doc).(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("Config file %s must contain a map of options", path)
+	}
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(table); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// normalizeConfigValue converts decoded YAML and JSON values to the types
+// of the TOML encoder.  Null values are left out
+func normalizeConfigValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			if val != nil {
+				m[fmt.Sprint(key)] = normalizeConfigValue(val)
+			}
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			if val != nil {
+				m[key] = normalizeConfigValue(val)
+			}
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, 0, len(v))
+		for _, val := range v {
+			if val != nil {
+				a = append(a, normalizeConfigValue(val))
+			}
+		}
+		return a
+	case bson.M:
+		return normalizeConfigValue(map[string]interface{}(v))
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case int:
+		return int64(v)
+	}
+	return v
+}
+
+// applyProfile merges the options of the selected [profiles.<name>] table
+// over the common options of the config file.  The profile is chosen by the
+// profile flag, MONSTACHE_PROFILE or the profile option in the file itself
+func applyProfile(text, profile string) (string, error) {
+	var doc map[string]interface{}
+	if _, err := toml.Decode(text, &doc); err != nil {
+		return "", err
+	}
+	profiles, ok := doc["profiles"]
+	if !ok {
+		if profile != "" {
+			return "", fmt.Errorf("Profile %s selected but the config file has no profiles", profile)
+		}
+		return text, nil
+	}
+	tables, ok := profiles.(map[string]interface{})
+	if !ok {
+		return "", errors.New("Profiles must be a table of named profiles")
+	}
+	delete(doc, "profiles")
+	if profile == "" {
+		profile, _ = doc["profile"].(string)
+	}
+	if profile != "" {
+		overrides, ok := tables[profile].(map[string]interface{})
+		if !ok {
+			return "", fmt.Errorf("Profile %s is not defined in the config file", profile)
+		}
+		mergeConfigTables(doc, overrides)
+		doc["profile"] = profile
+	}
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(doc); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// mergeConfigTables overrides the options in dst with those in src.  Tables
+// are merged recursively while other values, including arrays of tables,
+// are replaced
+func mergeConfigTables(dst, src map[string]interface{}) {
+	for key, val := range src {
+		if table, ok := val.(map[string]interface{}); ok {
+			if existing, ok := dst[key].(map[string]interface{}); ok {
+				mergeConfigTables(existing, table)
+				continue
+			}
+		}
+		dst[key] = val
+	}
+}
+
+// centralConfig reads options from a document in a MongoDB collection.  The
+// options of the document override those of the config file and the
+// document is watched with a change stream so that changes are reloaded
+type centralConfig struct {
+	session    *mgo.Session
+	database   string
+	collection string
+	id         string
+}
+
+// newCentralConfig connects to MongoDB with the connection options from the
+// command line, environment and config file in order to read the central
+// config document.  It returns nil when no config collection is set
+func (config *configOptions) newCentralConfig() (*centralConfig, error) {
+	boot := &configOptions{
+		MongoURL:             config.MongoURL,
+		MongoPemFile:         config.MongoPemFile,
+		MongoValidatePemFile: config.MongoValidatePemFile,
+		MongoAWSAuth:         config.MongoAWSAuth,
+		MongoTLSMinVersion:   config.MongoTLSMinVersion,
+		MongoTLSCipherSuites: config.MongoTLSCipherSuites,
+		MongoDialSettings:    config.MongoDialSettings,
+		MongoSessionSettings: config.MongoSessionSettings,
+		MongoX509Settings:    config.MongoX509Settings,
+		ConfigDatabaseName:   config.ConfigDatabaseName,
+		ConfigCollection:     config.ConfigCollection,
+		ConfigDocument:       config.ConfigDocument,
+	}
+	if config.ConfigFile != "" {
+		file, err := config.readConfigFile()
+		if err != nil {
+			return nil, err
+		}
+		if boot.MongoURL == "" {
+			boot.MongoURL = file.MongoURL
+		}
+		if boot.MongoPemFile == "" {
+			boot.MongoPemFile = file.MongoPemFile
+			boot.MongoValidatePemFile = file.MongoValidatePemFile
+		}
+		if !boot.MongoX509Settings.enabled() {
+			boot.MongoX509Settings = file.MongoX509Settings
+		}
+		if !boot.MongoKerberosSettings.enabled() {
+			boot.MongoKerberosSettings = file.MongoKerberosSettings
+		}
+		if !boot.MongoAWSAuth {
+			boot.MongoAWSAuth = file.MongoAWSAuth
+		}
+		if boot.MongoTLSMinVersion == "" {
+			boot.MongoTLSMinVersion = file.MongoTLSMinVersion
+		}
+		if len(boot.MongoTLSCipherSuites) == 0 {
+			boot.MongoTLSCipherSuites = file.MongoTLSCipherSuites
+		}
+		boot.MongoDialSettings = file.MongoDialSettings
+		boot.MongoSessionSettings = file.MongoSessionSettings
+		if boot.ConfigDatabaseName == "" {
+			boot.ConfigDatabaseName = file.ConfigDatabaseName
+		}
+		if boot.ConfigCollection == "" {
+			boot.ConfigCollection = file.ConfigCollection
+		}
+		if boot.ConfigDocument == "" {
+			boot.ConfigDocument = file.ConfigDocument
+		}
+	}
+	if boot.ConfigCollection == "" {
+		return nil, nil
+	}
+	if isSecretRef(boot.MongoURL) {
+		url, err := boot.resolveSecret(boot.MongoURL)
+		if err != nil {
+			return nil, err
+		}
+		boot.MongoURL = url
+	}
+	boot.setDefaults()
+	session, err := boot.dialMongo(boot.MongoURL)
+	// the config document may change the connection used to sync
+	mongoDialInfo = nil
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to MongoDB for the config collection: %s", err)
+	}
+	return &centralConfig{
+		session:    session,
+		database:   boot.ConfigDatabaseName,
+		collection: boot.ConfigCollection,
+		id:         boot.ConfigDocument,
+	}, nil
+}
+
+func (cc *centralConfig) String() string {
+	return fmt.Sprintf("%s in %s.%s", cc.id, cc.database, cc.collection)
+}
+
+// read returns the options of the config document
+func (cc *centralConfig) read() (map[string]interface{}, error) {
+	s := cc.session.Copy()
+	defer s.Close()
+	doc := bson.M{}
+	if err := s.DB(cc.database).C(cc.collection).FindId(cc.id).One(doc); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, fmt.Errorf("Config document %s not found", cc)
+		}
+		return nil, err
+	}
+	delete(doc, "_id")
+	return normalizeConfigValue(doc).(map[string]interface{}), nil
+}
+
+// merge overrides the options of the config file text with those of the
+// config document
+func (cc *centralConfig) merge(text string) (string, error) {
+	central, err := cc.read()
+	if err != nil {
+		return "", err
+	}
+	return mergeConfigText(text, central, mergeConfigTables)
+}
+
+func mergeConfigText(text string, overrides map[string]interface{}, merge func(dst, src map[string]interface{})) (string, error) {
+	doc := make(map[string]interface{})
+	if _, err := toml.Decode(text, &doc); err != nil {
+		return "", err
+	}
+	merge(doc, overrides)
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(doc); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// watch calls reload each time the config document changes.  The change
+// stream is opened again after errors
+func (cc *centralConfig) watch(reload func()) {
+	pipeline := []bson.M{{"$match": bson.M{"documentKey._id": cc.id}}}
+	for {
+		s := cc.session.Copy()
+		stream, err := s.DB(cc.database).C(cc.collection).Watch(pipeline, mgo.ChangeStreamOptions{
+			MaxAwaitTimeMS: time.Minute,
+		})
+		if err == nil {
+			var change bson.M
+			for {
+				if stream.Next(&change) {
+					reload()
+				} else if !stream.Timeout() {
+					break
+				}
+			}
+			err = stream.Err()
+			stream.Close()
+		}
+		s.Close()
+		if err != nil {
+			errorLog.Printf("Unable to watch config document %s: %s", cc, err)
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// configFileArgs collects the -f flags.  The first file is the config file
+// and the others are merged over it in order
+type configFileArgs struct {
+	config *configOptions
+}
+
+func (args *configFileArgs) String() string {
+	if args.config == nil {
+		return ""
+	}
+	return strings.Join(args.config.configFilePaths(), ",")
+}
+
+func (args *configFileArgs) Set(value string) error {
+	if args.config.ConfigFile == "" {
+		args.config.ConfigFile = value
+	} else {
+		args.config.extraConfigFiles = append(args.config.extraConfigFiles, value)
+	}
+	return nil
+}
+
+func (config *configOptions) configFilePaths() []string {
+	if config.ConfigFile == "" {
+		return nil
+	}
+	return append([]string{config.ConfigFile}, config.extraConfigFiles...)
+}
+
+// readConfigFiles merges the config files and the files they include into
+// one TOML document.  Later files take precedence over earlier ones
+func readConfigFiles(paths []string, tpl bool) (string, error) {
+	doc := make(map[string]interface{})
+	for _, path := range paths {
+		fragment, err := readConfigFragment(path, tpl, make(map[string]bool))
+		if err != nil {
+			return "", err
+		}
+		mergeConfigFragment(doc, fragment)
+	}
+	var b bytes.Buffer
+	if err := toml.NewEncoder(&b).Encode(doc); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// readConfigFragment reads a config file with the files named by its
+// include option merged beneath it.  Include paths are relative to the
+// file and may be glob patterns, whose matches are merged in lexical order
+func readConfigFragment(path string, tpl bool, parents map[string]bool) (map[string]interface{}, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if parents[abs] {
+		return nil, fmt.Errorf("Config file %s includes itself", path)
+	}
+	text, err := readConfigText(path)
+	if err != nil {
+		return nil, err
+	}
+	if tpl {
+		if text, err = renderConfigTemplate(text); err != nil {
+			return nil, err
+		}
+	}
+	if text, err = configToTOML(path, text); err != nil {
+		return nil, err
+	}
+	doc := make(map[string]interface{})
+	if _, err = toml.Decode(text, &doc); err != nil {
+		return nil, fmt.Errorf("Unable to parse config file %s: %s", path, err)
+	}
+	var patterns []string
+	switch include := doc["include"].(type) {
+	case nil:
+		return doc, nil
+	case string:
+		patterns = []string{include}
+	case []interface{}:
+		for _, p := range include {
+			s, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("Include in %s must be a list of paths", path)
+			}
+			patterns = append(patterns, s)
+		}
+	default:
+		return nil, fmt.Errorf("Include in %s must be a path or a list of paths", path)
+	}
+	delete(doc, "include")
+	parents[abs] = true
+	defer delete(parents, abs)
+	merged := make(map[string]interface{})
+	for _, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return nil, fmt.Errorf("Config file %s included by %s not found", pattern, path)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			fragment, err := readConfigFragment(match, tpl, parents)
+			if err != nil {
+				return nil, err
+			}
+			mergeConfigFragment(merged, fragment)
+		}
+	}
+	mergeConfigFragment(merged, doc)
+	return merged, nil
+}
+
+// mergeConfigFragment merges the options of a config file over those of
+// the files before it.  Tables are merged recursively and lists of tables,
+// such as mapping or script, are appended so that each file can add its own
+// namespaces.  Other values are replaced
+func mergeConfigFragment(dst, src map[string]interface{}) {
+	for key, val := range src {
+		switch v := val.(type) {
+		case map[string]interface{}:
+			if existing, ok := dst[key].(map[string]interface{}); ok {
+				mergeConfigFragment(existing, v)
+				continue
+			}
+		case []map[string]interface{}:
+			if existing, ok := dst[key].([]map[string]interface{}); ok {
+				dst[key] = append(existing, v...)
+				continue
+			}
+		}
+		dst[key] = val
+	}
+}
+
+// readConfigFile decodes the config file without merging it into config.
+// Keys which do not match an option are kept in unknownOptions
+func (config *configOptions) readConfigFile() (tomlConfig *configOptions, err error) {
+	tomlConfig = &configOptions{
+		ConfigFile:             config.ConfigFile,
+		DroppedDatabases:       true,
+		DroppedCollections:     true,
+		MongoValidatePemFile:   true,
+		ElasticValidatePemFile: true,
+		MongoDialSettings:      mongoDialSettings{Timeout: -1, ReadTimeout: -1, WriteTimeout: -1},
+		MongoSessionSettings:   mongoSessionSettings{SocketTimeout: -1, SyncTimeout: -1},
+		GtmSettings:            gtmDefaultSettings(),
+	}
+	var text string
+	if paths := config.configFilePaths(); len(paths) > 0 {
+		if text, err = readConfigFiles(paths, config.EnableTemplate); err != nil {
+			return
+		}
+	}
+	if config.central != nil {
+		if text, err = config.central.merge(text); err != nil {
+			return
+		}
+	}
+	if text, err = applyProfile(text, config.Profile); err != nil {
+		return
+	}
+	if len(config.overrides) > 0 {
+		if text, err = mergeConfigText(text, config.overrides, mergeConfigFragment); err != nil {
+			return
+		}
+	}
+	md, err := toml.Decode(text, tomlConfig)
+	if err != nil {
+		return
+	}
+	for _, key := range md.Undecoded() {
+		tomlConfig.unknownOptions = append(tomlConfig.unknownOptions, key.String())
+	}
+	return
+}
+
+func (config *configOptions) loadConfigFile() *configOptions {
+	if config.ConfigFile != "" || config.central != nil || len(config.overrides) > 0 {
+		tomlConfig, err := config.readConfigFile()
+		if err != nil {
+			panic(err)
+		}
+		config.unknownOptions = tomlConfig.unknownOptions
+		if config.Profile == "" {
+			config.Profile = tomlConfig.Profile
+		}
+		if config.MongoURL == "" {
+			config.MongoURL = tomlConfig.MongoURL
+		}
+		if config.MongoConfigURL == "" {
+			config.MongoConfigURL = tomlConfig.MongoConfigURL
+		}
+		if config.MongoPemFile == "" {
+			config.MongoPemFile = tomlConfig.MongoPemFile
+		}
+		if config.MongoValidatePemFile {
+			config.MongoValidatePemFile = tomlConfig.MongoValidatePemFile
+		}
+		if !config.MongoAWSAuth {
+			config.MongoAWSAuth = tomlConfig.MongoAWSAuth
+		}
+		if config.MongoTLSMinVersion == "" {
+			config.MongoTLSMinVersion = tomlConfig.MongoTLSMinVersion
+		}
+		if len(config.MongoTLSCipherSuites) == 0 {
+			config.MongoTLSCipherSuites = tomlConfig.MongoTLSCipherSuites
+		}
+		if config.MongoOpLogDatabaseName == "" {
+			config.MongoOpLogDatabaseName = tomlConfig.MongoOpLogDatabaseName
+		}
+		if config.MongoOpLogCollectionName == "" {
+			config.MongoOpLogCollectionName = tomlConfig.MongoOpLogCollectionName
+		}
+		if config.ElasticUser == "" {
+			config.ElasticUser = tomlConfig.ElasticUser
+		}
+		if config.ElasticPassword == "" {
+			config.ElasticPassword = tomlConfig.ElasticPassword
+		}
+		if config.ElasticAPIKey == "" {
+			config.ElasticAPIKey = tomlConfig.ElasticAPIKey
+		}
+		if config.ElasticAPIKeyFile == "" {
+			config.ElasticAPIKeyFile = tomlConfig.ElasticAPIKeyFile
+		}
+		if config.ElasticCloudID == "" {
+			config.ElasticCloudID = tomlConfig.ElasticCloudID
+		}
+		if config.ElasticPemFile == "" {
+			config.ElasticPemFile = tomlConfig.ElasticPemFile
+		}
+		if config.ElasticClientCert == "" {
+			config.ElasticClientCert = tomlConfig.ElasticClientCert
+		}
+		if config.ElasticClientKey == "" {
+			config.ElasticClientKey = tomlConfig.ElasticClientKey
+		}
+		if config.ElasticValidatePemFile && !tomlConfig.ElasticValidatePemFile {
+			config.ElasticValidatePemFile = false
+		}
+		if config.ElasticTLSMinVersion == "" {
+			config.ElasticTLSMinVersion = tomlConfig.ElasticTLSMinVersion
+		}
+		if len(config.ElasticTLSCipherSuites) == 0 {
+			config.ElasticTLSCipherSuites = tomlConfig.ElasticTLSCipherSuites
+		}
+		if config.ElasticVersion == "" {
+			config.ElasticVersion = tomlConfig.ElasticVersion
+		}
+		if !config.OpenSearch && tomlConfig.OpenSearch {
+			config.OpenSearch = true
+		}
+		if config.ElasticMaxConns == 0 {
+			config.ElasticMaxConns = tomlConfig.ElasticMaxConns
+		}
+		if config.ElasticHealth0 == 0 {
+			config.ElasticHealth0 = tomlConfig.ElasticHealth0
+		}
+		if config.ElasticHealth1 == 0 {
+			config.ElasticHealth1 = tomlConfig.ElasticHealth1
+		}
+		if config.DirectReadSplitMax == 0 {
+			config.DirectReadSplitMax = tomlConfig.DirectReadSplitMax
+		}
+		if config.DirectReadConcur == 0 {
+			config.DirectReadConcur = tomlConfig.DirectReadConcur
+		}
+		if config.LookupBatchWindowMs == 0 {
+			config.LookupBatchWindowMs = tomlConfig.LookupBatchWindowMs
+		}
+		if config.LookupBatchMax == 0 {
+			config.LookupBatchMax = tomlConfig.LookupBatchMax
+		}
+		if config.DirectReadBudget == 0 {
+			config.DirectReadBudget = tomlConfig.DirectReadBudget
+		}
+		if config.DirectReadRate == 0 {
+			config.DirectReadRate = tomlConfig.DirectReadRate
+		}
+		if !config.DirectReadNoTimeout && tomlConfig.DirectReadNoTimeout {
+			config.DirectReadNoTimeout = true
+		}
+		if !config.AdaptiveBackpressure && tomlConfig.AdaptiveBackpressure {
+			config.AdaptiveBackpressure = true
+		}
+		if !config.AdaptiveBulk && tomlConfig.AdaptiveBulk {
+			config.AdaptiveBulk = true
+		}
+		if config.AdaptiveBulkMinBytes == 0 {
+			config.AdaptiveBulkMinBytes = tomlConfig.AdaptiveBulkMinBytes
+		}
+		if config.AdaptiveBulkTargetMs == 0 {
+			config.AdaptiveBulkTargetMs = tomlConfig.AdaptiveBulkTargetMs
+		}
+		if !config.ElasticRetry && tomlConfig.ElasticRetry {
+			config.ElasticRetry = true
+		}
+		if config.ElasticMaxDocs == 0 {
+			config.ElasticMaxDocs = tomlConfig.ElasticMaxDocs
+		}
+		if config.ElasticMaxBytes == 0 {
+			config.ElasticMaxBytes = tomlConfig.ElasticMaxBytes
+		}
+		if config.ElasticMaxContentLength == 0 {
+			config.ElasticMaxContentLength = tomlConfig.ElasticMaxContentLength
+		}
+		if config.ElasticMaxSeconds == 0 {
+			config.ElasticMaxSeconds = tomlConfig.ElasticMaxSeconds
+		}
+		if config.ElasticClientTimeout == 0 {
+			config.ElasticClientTimeout = tomlConfig.ElasticClientTimeout
+		}
+		if config.SecretRefreshSeconds == 0 {
+			config.SecretRefreshSeconds = tomlConfig.SecretRefreshSeconds
+		}
+		if config.MaxFileSize == 0 {
+			config.MaxFileSize = tomlConfig.MaxFileSize
+		}
+		if config.FileChunkBytes == 0 {
+			config.FileChunkBytes = tomlConfig.FileChunkBytes
+		}
+		if config.TikaURL == "" {
+			config.TikaURL = tomlConfig.TikaURL
+		}
+		if config.TikaConcurrency == 0 {
+			config.TikaConcurrency = tomlConfig.TikaConcurrency
+		}
+		if config.TikaMaxBytes == 0 {
+			config.TikaMaxBytes = tomlConfig.TikaMaxBytes
+		}
+		if config.TikaTimeoutSeconds == 0 {
+			config.TikaTimeoutSeconds = tomlConfig.TikaTimeoutSeconds
+		}
+		if !config.IndexFiles {
+			config.IndexFiles = tomlConfig.IndexFiles
+		}
+		if config.FileDownloaders == 0 {
+			config.FileDownloaders = tomlConfig.FileDownloaders
+		}
+		if config.IndexWorkers == 0 {
+			config.IndexWorkers = tomlConfig.IndexWorkers
+		}
+		if config.MemoryBudgetMB == 0 {
+			config.MemoryBudgetMB = tomlConfig.MemoryBudgetMB
+		}
+		if config.SpillDir == "" {
+			config.SpillDir = tomlConfig.SpillDir
+		}
+		if config.DiskCompression == "" {
+			config.DiskCompression = tomlConfig.DiskCompression
+		}
+		if config.CoalesceWindowMs == 0 {
+			config.CoalesceWindowMs = tomlConfig.CoalesceWindowMs
+		}
+		if len(config.CoalesceNamespaces) == 0 {
+			config.CoalesceNamespaces = tomlConfig.CoalesceNamespaces
+		}
+		if config.RelateThreads == 0 {
+			config.RelateThreads = tomlConfig.RelateThreads
+		}
+		if config.RelateBuffer == 0 {
+			config.RelateBuffer = tomlConfig.RelateBuffer
+		}
+		if config.PostProcessors == 0 {
+			config.PostProcessors = tomlConfig.PostProcessors
+		}
+		if config.DeleteStrategy == 0 {
+			config.DeleteStrategy = tomlConfig.DeleteStrategy
+		}
+		if config.DeleteIndexPattern == "" {
+			config.DeleteIndexPattern = tomlConfig.DeleteIndexPattern
+		}
+		if config.DroppedDatabases && !tomlConfig.DroppedDatabases {
+			config.DroppedDatabases = false
+		}
+		if config.DroppedCollections && !tomlConfig.DroppedCollections {
+			config.DroppedCollections = false
+		}
+		if !config.Gzip && tomlConfig.Gzip {
+			config.Gzip = true
+		}
+		if config.GzipLevel == 0 {
+			config.GzipLevel = tomlConfig.GzipLevel
+		}
+		if !config.Verbose && tomlConfig.Verbose {
+			config.Verbose = true
+		}
+		if !config.Stats && tomlConfig.Stats {
+			config.Stats = true
+		}
+		if !config.Pprof && tomlConfig.Pprof {
+			config.Pprof = true
+		}
+		if config.PprofUser == "" {
+			config.PprofUser = tomlConfig.PprofUser
+		}
+		if config.PprofPassword == "" {
+			config.PprofPassword = tomlConfig.PprofPassword
+		}
+		if config.AdminUser == "" {
+			config.AdminUser = tomlConfig.AdminUser
+		}
+		if config.AdminPassword == "" {
+			config.AdminPassword = tomlConfig.AdminPassword
+		}
+		if !config.Metrics && tomlConfig.Metrics {
+			config.Metrics = true
+		}
+		if config.StatsdAddr == "" {
+			config.StatsdAddr = tomlConfig.StatsdAddr
+		}
+		if config.StatsdPrefix == "" {
+			config.StatsdPrefix = tomlConfig.StatsdPrefix
+		}
+		if config.StatsdFlushSeconds == 0 {
+			config.StatsdFlushSeconds = tomlConfig.StatsdFlushSeconds
+		}
+		if config.DrainTimeoutSeconds == 0 {
+			config.DrainTimeoutSeconds = tomlConfig.DrainTimeoutSeconds
+		}
+		if config.CheckpointInterval == 0 {
+			config.CheckpointInterval = tomlConfig.CheckpointInterval
+		}
+		if config.CheckpointMode == "" {
+			config.CheckpointMode = tomlConfig.CheckpointMode
+		}
+		if config.TracingEndpoint == "" {
+			config.TracingEndpoint = tomlConfig.TracingEndpoint
+		}
+		if config.ReadyLagSeconds == 0 {
+			config.ReadyLagSeconds = tomlConfig.ReadyLagSeconds
+		}
+		if config.ReplicationLagThreshold == 0 {
+			config.ReplicationLagThreshold = tomlConfig.ReplicationLagThreshold
+		}
+		if config.ReplicationLagAlertURL == "" {
+			config.ReplicationLagAlertURL = tomlConfig.ReplicationLagAlertURL
+		}
+		if config.TracingServiceName == "" {
+			config.TracingServiceName = tomlConfig.TracingServiceName
+		}
+		if config.TracingSampleRatio == 0 {
+			config.TracingSampleRatio = tomlConfig.TracingSampleRatio
+		}
+		if !config.EnableEasyJSON && tomlConfig.EnableEasyJSON {
+			config.EnableEasyJSON = true
+		}
+		if !config.DisableChangeEvents && tomlConfig.DisableChangeEvents {
+			config.DisableChangeEvents = true
+		}
+		if !config.IndexStats && tomlConfig.IndexStats {
+			config.IndexStats = true
+		}
+		if config.StatsDuration == "" {
+			config.StatsDuration = tomlConfig.StatsDuration
+		}
+		if config.StatsIndexFormat == "" {
+			config.StatsIndexFormat = tomlConfig.StatsIndexFormat
+		}
+		if config.DeadLetterIndex == "" {
+			config.DeadLetterIndex = tomlConfig.DeadLetterIndex
+		}
+		if config.DeadLetterFile == "" {
+			config.DeadLetterFile = tomlConfig.DeadLetterFile
+		}
+		if config.AuditIndex == "" {
+			config.AuditIndex = tomlConfig.AuditIndex
+		}
+		if config.DebugSampleRate == 0 {
+			config.DebugSampleRate = tomlConfig.DebugSampleRate
+		}
+		if len(config.DebugDocumentIds) == 0 {
+			config.DebugDocumentIds = tomlConfig.DebugDocumentIds
+		}
+		if config.NotifyRateLimit == 0 {
+			config.NotifyRateLimit = tomlConfig.NotifyRateLimit
+		}
+		if config.NotifyBulkFailureSeconds == 0 {
+			config.NotifyBulkFailureSeconds = tomlConfig.NotifyBulkFailureSeconds
+		}
+		if config.AuditFile == "" {
+			config.AuditFile = tomlConfig.AuditFile
+		}
+		if config.UUIDRepresentation == "" {
+			config.UUIDRepresentation = tomlConfig.UUIDRepresentation
+		}
+		if config.BinaryEncoding == "" {
+			config.BinaryEncoding = tomlConfig.BinaryEncoding
+		}
+		if !config.IndexAsUpdate && tomlConfig.IndexAsUpdate {
+			config.IndexAsUpdate = true
+		}
+		if !config.FileHighlighting && tomlConfig.FileHighlighting {
+			config.FileHighlighting = true
+		}
+		if !config.EnablePatches && tomlConfig.EnablePatches {
+			config.EnablePatches = true
+		}
+		if !config.PruneInvalidJSON && tomlConfig.PruneInvalidJSON {
+			config.PruneInvalidJSON = true
+		}
+		if !config.Debug && tomlConfig.Debug {
+			config.Debug = true
+		}
+		if !config.Replay && tomlConfig.Replay {
+			config.Replay = true
+		}
+		if !config.Resume && tomlConfig.Resume {
+			config.Resume = true
+		}
+		if !config.ResumeWriteUnsafe && tomlConfig.ResumeWriteUnsafe {
+			config.ResumeWriteUnsafe = true
+		}
+		if config.ResumeFromTimestamp == 0 {
+			config.ResumeFromTimestamp = tomlConfig.ResumeFromTimestamp
+		}
+		if config.ReplayUntil == "" {
+			config.ReplayUntil = tomlConfig.ReplayUntil
+		}
+		if len(config.ReplayNamespaces) == 0 {
+			config.ReplayNamespaces = tomlConfig.ReplayNamespaces
+		}
+		if config.VerifySample == 0 {
+			config.VerifySample = tomlConfig.VerifySample
+		}
+		if config.VerifyReport == "" {
+			config.VerifyReport = tomlConfig.VerifyReport
+		}
+		if config.VerifyReportFormat == "" {
+			config.VerifyReportFormat = tomlConfig.VerifyReportFormat
+		}
+		if config.VerifyReportIndex == "" {
+			config.VerifyReportIndex = tomlConfig.VerifyReportIndex
+		}
+		if config.ContentHashField == "" {
+			config.ContentHashField = tomlConfig.ContentHashField
+		}
+		if !config.RepairApply && tomlConfig.RepairApply {
+			config.RepairApply = true
+		}
+		if config.RepairBatchSize == 0 {
+			config.RepairBatchSize = tomlConfig.RepairBatchSize
+		}
+		if config.RepairRate == 0 {
+			config.RepairRate = tomlConfig.RepairRate
+		}
+		if config.OrphanSweepSeconds == 0 {
+			config.OrphanSweepSeconds = tomlConfig.OrphanSweepSeconds
+		}
+		if config.SchemaDriftSeconds == 0 {
+			config.SchemaDriftSeconds = tomlConfig.SchemaDriftSeconds
+		}
+		if config.OrphanSweepBatchSize == 0 {
+			config.OrphanSweepBatchSize = tomlConfig.OrphanSweepBatchSize
+		}
+		if !config.DeleteRoutingChanges && tomlConfig.DeleteRoutingChanges {
+			config.DeleteRoutingChanges = true
+		}
+		if config.RoutingCacheSize == 0 {
+			config.RoutingCacheSize = tomlConfig.RoutingCacheSize
+		}
+		if config.MergePatchAttr == "" {
+			config.MergePatchAttr = tomlConfig.MergePatchAttr
+		}
+		if !config.FailFast && tomlConfig.FailFast {
+			config.FailFast = true
+		}
+		if !config.IndexOplogTime && tomlConfig.IndexOplogTime {
+			config.IndexOplogTime = true
+		}
+		if config.OplogTsFieldName == "" {
+			config.OplogTsFieldName = tomlConfig.OplogTsFieldName
+		}
+		if config.OplogDateFieldName == "" {
+			config.OplogDateFieldName = tomlConfig.OplogDateFieldName
+		}
+		if config.OplogDateFieldFormat == "" {
+			config.OplogDateFieldFormat = tomlConfig.OplogDateFieldFormat
+		}
+		if config.ConfigDatabaseName == "" {
+			config.ConfigDatabaseName = tomlConfig.ConfigDatabaseName
+		}
+		if config.ConfigCollection == "" {
+			config.ConfigCollection = tomlConfig.ConfigCollection
+		}
+		if config.ConfigDocument == "" {
+			config.ConfigDocument = tomlConfig.ConfigDocument
+		}
+		if !config.ExitAfterDirectReads && tomlConfig.ExitAfterDirectReads {
+			config.ExitAfterDirectReads = true
+		}
+		if config.ResumeName == "" {
+			config.ResumeName = tomlConfig.ResumeName
+		}
+		if config.ClusterName == "" {
+			config.ClusterName = tomlConfig.ClusterName
+		}
+		if config.ClusterLeaseSeconds == 0 {
+			config.ClusterLeaseSeconds = tomlConfig.ClusterLeaseSeconds
+		}
+		if config.ClusterHeartbeatSeconds == 0 {
+			config.ClusterHeartbeatSeconds = tomlConfig.ClusterHeartbeatSeconds
+		}
+		if config.PartitionName == "" {
+			config.PartitionName = tomlConfig.PartitionName
+		}
+		if config.PartitionMember == "" {
+			config.PartitionMember = tomlConfig.PartitionMember
+		}
+		if config.NsRegex == "" {
+			config.NsRegex = tomlConfig.NsRegex
+		}
+		if config.NsDropRegex == "" {
+			config.NsDropRegex = tomlConfig.NsDropRegex
+		}
+		if config.NsExcludeRegex == "" {
+			config.NsExcludeRegex = tomlConfig.NsExcludeRegex
+		}
+		if config.NsDropExcludeRegex == "" {
+			config.NsDropExcludeRegex = tomlConfig.NsDropExcludeRegex
+		}
+		if config.IndexFiles {
+			if len(config.FileNamespaces) == 0 {
+				config.FileNamespaces = tomlConfig.FileNamespaces
+				config.loadGridFsConfig()
+			}
+		}
+		if len(config.FileMetadataNamespaces) == 0 {
+			config.FileMetadataNamespaces = tomlConfig.FileMetadataNamespaces
+			config.loadFileMetadataNamespaces()
+		}
+		if config.Worker == "" {
+			config.Worker = tomlConfig.Worker
+		}
+		if config.GraylogAddr == "" {
+			config.GraylogAddr = tomlConfig.GraylogAddr
+		}
+		if config.LogFormat == "" {
+			config.LogFormat = tomlConfig.LogFormat
+		}
+		if config.MapperPluginPath == "" {
+			config.MapperPluginPath = tomlConfig.MapperPluginPath
+		}
+		if config.EnablePatches {
+			if len(config.PatchNamespaces) == 0 {
+				config.PatchNamespaces = tomlConfig.PatchNamespaces
+				config.loadPatchNamespaces()
+			}
+		}
+		if len(config.PartialUpdateNamespaces) == 0 {
+			config.PartialUpdateNamespaces = tomlConfig.PartialUpdateNamespaces
+			config.loadPartialUpdateNamespaces()
+		}
+		if len(config.ArrayUpdateNamespaces) == 0 {
+			config.ArrayUpdateNamespaces = tomlConfig.ArrayUpdateNamespaces
+			config.loadArrayUpdateNamespaces()
+		}
+		if len(config.StreamJSONNamespaces) == 0 {
+			config.StreamJSONNamespaces = tomlConfig.StreamJSONNamespaces
+			config.loadStreamJSONNamespaces()
+		}
+		if len(config.SampleMappingNamespaces) == 0 {
+			config.SampleMappingNamespaces = tomlConfig.SampleMappingNamespaces
+		}
+		if config.MappingSampleSize == 0 {
+			config.MappingSampleSize = tomlConfig.MappingSampleSize
+		}
+		if len(config.RoutingNamespaces) == 0 {
+			config.RoutingNamespaces = tomlConfig.RoutingNamespaces
+			config.loadRoutingNamespaces()
+		}
+		if len(config.TimeMachineNamespaces) == 0 {
+			config.TimeMachineNamespaces = tomlConfig.TimeMachineNamespaces
+			config.loadTimeMachineNamespaces()
+		}
+		if config.TimeMachineIndexPrefix == "" {
+			config.TimeMachineIndexPrefix = tomlConfig.TimeMachineIndexPrefix
+		}
+		if config.TimeMachineIndexSuffix == "" {
+			config.TimeMachineIndexSuffix = tomlConfig.TimeMachineIndexSuffix
+		}
+		if !config.TimeMachineDirectReads {
+			config.TimeMachineDirectReads = tomlConfig.TimeMachineDirectReads
+		}
+		if !config.PipeAllowDisk {
+			config.PipeAllowDisk = tomlConfig.PipeAllowDisk
+		}
+		if len(config.DirectReadNs) == 0 {
+			config.DirectReadNs = tomlConfig.DirectReadNs
+		}
+		if len(config.ChangeStreamNs) == 0 {
+			config.ChangeStreamNs = tomlConfig.ChangeStreamNs
+		}
+		if len(config.ElasticUrls) == 0 {
+			config.ElasticUrls = tomlConfig.ElasticUrls
+		}
+		if len(config.SecondaryElasticUrls) == 0 {
+			config.SecondaryElasticUrls = tomlConfig.SecondaryElasticUrls
+		}
+		if config.SecondaryElasticUser == "" {
+			config.SecondaryElasticUser = tomlConfig.SecondaryElasticUser
+		}
+		if config.SecondaryElasticPassword == "" {
+			config.SecondaryElasticPassword = tomlConfig.SecondaryElasticPassword
+		}
+		if config.SecondaryElasticAPIKey == "" {
+			config.SecondaryElasticAPIKey = tomlConfig.SecondaryElasticAPIKey
+		}
+		if len(config.Workers) == 0 {
+			config.Workers = tomlConfig.Workers
+		}
+		if !config.EnableHTTPServer && tomlConfig.EnableHTTPServer {
+			config.EnableHTTPServer = true
+		}
+		if config.HTTPServerAddr == "" {
+			config.HTTPServerAddr = tomlConfig.HTTPServerAddr
+		}
+		if config.HTTPServerTLSCert == "" {
+			config.HTTPServerTLSCert = tomlConfig.HTTPServerTLSCert
+		}
+		if config.HTTPServerTLSKey == "" {
+			config.HTTPServerTLSKey = tomlConfig.HTTPServerTLSKey
+		}
+		if !config.AWSConnect.enabled() {
+			config.AWSConnect = tomlConfig.AWSConnect
+		}
+		if config.KafkaSink == nil {
+			config.KafkaSink = tomlConfig.KafkaSink
+		}
+		if config.RedisSink == nil {
+			config.RedisSink = tomlConfig.RedisSink
+		}
+		if config.NotificationSink == nil {
+			config.NotificationSink = tomlConfig.NotificationSink
+		}
+		if config.WebhookSink == nil {
+			config.WebhookSink = tomlConfig.WebhookSink
+		}
+		if config.ArchiveSink == nil {
+			config.ArchiveSink = tomlConfig.ArchiveSink
+		}
+		if config.OffloadStore == nil {
+			config.OffloadStore = tomlConfig.OffloadStore
+		}
+		if config.MeilisearchSink == nil {
+			config.MeilisearchSink = tomlConfig.MeilisearchSink
+		}
+		if config.TypesenseSink == nil {
+			config.TypesenseSink = tomlConfig.TypesenseSink
+		}
+		if config.PostgresSink == nil {
+			config.PostgresSink = tomlConfig.PostgresSink
+		}
+		if config.NATSSink == nil {
+			config.NATSSink = tomlConfig.NATSSink
+		}
+		if !config.DisableElasticsearch && tomlConfig.DisableElasticsearch {
+			config.DisableElasticsearch = true
+		}
+		if config.NDJSONFile == "" {
+			config.NDJSONFile = tomlConfig.NDJSONFile
+		}
+		if config.RecordFile == "" {
+			config.RecordFile = tomlConfig.RecordFile
+		}
+		if config.ReplayFile == "" {
+			config.ReplayFile = tomlConfig.ReplayFile
+		}
+		if !config.DryRun && tomlConfig.DryRun {
+			config.DryRun = true
+		}
+		if !config.Logs.enabled() {
+			config.Logs = tomlConfig.Logs
+		}
+		config.MongoDialSettings = tomlConfig.MongoDialSettings
+		config.MongoSessionSettings = tomlConfig.MongoSessionSettings
+		if !config.MongoX509Settings.enabled() {
+			config.MongoX509Settings = tomlConfig.MongoX509Settings
+		}
+		if !config.MongoKerberosSettings.enabled() {
+			config.MongoKerberosSettings = tomlConfig.MongoKerberosSettings
+		}
+		config.GtmSettings = tomlConfig.GtmSettings
+		config.CSFLE = tomlConfig.CSFLE
+		config.Chaos = tomlConfig.Chaos
+		config.Relate = tomlConfig.Relate
+		config.NotifyWebhooks = tomlConfig.NotifyWebhooks
+		config.HTTPCredentials = tomlConfig.HTTPCredentials
+		config.DirectReadPriorities = tomlConfig.DirectReadPriorities
+		config.NamespaceCursors = tomlConfig.NamespaceCursors
+		tomlConfig.loadScripts()
+		tomlConfig.loadFilters()
+		tomlConfig.loadPipelines()
+		tomlConfig.loadIndexTypes()
+		tomlConfig.loadIndexTemplates()
+		tomlConfig.loadIndexSettings()
+		tomlConfig.loadRuntimeFields()
+		tomlConfig.loadIndexBulkSettings()
+		tomlConfig.loadVersionFields()
+		tomlConfig.loadReindexes()
+		tomlConfig.loadShadows()
+		tomlConfig.loadIngestPipelines()
+		tomlConfig.loadRollovers()
+		tomlConfig.loadUpdateConflicts()
+		tomlConfig.loadBulkErrorPolicies()
+		tomlConfig.loadRoutingExprs()
+		tomlConfig.loadJoins()
+		tomlConfig.loadUnwinds()
+		tomlConfig.loadNumberFormats()
+		tomlConfig.loadDateFormats()
+		tomlConfig.loadFieldExclusions()
+		tomlConfig.loadRedactions()
+		tomlConfig.loadPIIScans()
+		tomlConfig.loadCoercions()
+		tomlConfig.loadGeoFields()
+		tomlConfig.loadCopyFields()
+		tomlConfig.loadReferences()
+		tomlConfig.loadEnrichments()
+		tomlConfig.loadDocumentSizes()
+		tomlConfig.loadOffloads()
+		tomlConfig.loadTombstones()
+		tomlConfig.loadDeleteRoutings()
+		tomlConfig.loadEmbeddings()
+		tomlConfig.loadTikaFields()
+		tomlConfig.loadFileFilters()
+		tomlConfig.loadSemanticFields()
+		tomlConfig.loadLanguageRoutings()
+		tomlConfig.loadReplacements()
+		tomlConfig.loadNamespaceSettings()
+	}
+	return config
+}
+
+func (config *configOptions) newLogger(path string) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    500, // megabytes
+		MaxBackups: 5,
+		MaxAge:     28, //days
+	}
+}
+
+func (config *configOptions) setupLogging() *configOptions {
+	if config.GraylogAddr != "" {
+		gelfWriter, err := gelf.NewUDPWriter(config.GraylogAddr)
+		if err != nil {
+			errorLog.Fatalf("Error creating gelf writer: %s", err)
+		}
+		infoLog.SetOutput(gelfWriter)
+		warnLog.SetOutput(gelfWriter)
+		errorLog.SetOutput(gelfWriter)
+		traceLog.SetOutput(gelfWriter)
+		statsLog.SetOutput(gelfWriter)
+	} else {
+		logs := config.Logs
+		if config.NDJSONFile == "-" {
+			// keep stdout for the NDJSON output
+			infoLog.SetOutput(os.Stderr)
+			warnLog.SetOutput(os.Stderr)
+			traceLog.SetOutput(os.Stderr)
+			statsLog.SetOutput(os.Stderr)
+		}
+		if logs.Info != "" {
+			infoLog.SetOutput(config.newLogger(logs.Info))
+		}
+		if logs.Warn != "" {
+			warnLog.SetOutput(config.newLogger(logs.Warn))
+		}
+		if logs.Error != "" {
+			errorLog.SetOutput(config.newLogger(logs.Error))
+		}
+		if logs.Trace != "" {
+			traceLog.SetOutput(config.newLogger(logs.Trace))
+		}
+		if logs.Stats != "" {
+			statsLog.SetOutput(config.newLogger(logs.Stats))
+		}
+	}
+	errorLog.SetOutput(io.MultiWriter(errorLog.Writer(), recentErrors))
+	if config.LogFormat == "json" {
+		for _, logger := range []*log.Logger{infoLog, warnLog, errorLog, traceLog, statsLog} {
+			setJSONOutput(logger)
+		}
+	}
+	if config.Debug {
+		mgo.SetDebug(true)
+		mgo.SetLogger(traceLog)
+	}
+	setVerbose(config.Verbose)
+	return config
+}
+
+func (config *configOptions) loadEnvironment() *configOptions {
+	del := config.EnvDelimiter
+	if del == "" {
+		del = ","
+	}
+	for _, e := range os.Environ() {
+		pair := strings.SplitN(e, "=", 2)
+		if len(pair) < 2 {
+			continue
+		}
+		name, val := pair[0], pair[1]
+		if val == "" {
+			continue
+		}
+		switch name {
+		case "MONSTACHE_MONGO_URL":
+			if config.MongoURL == "" {
+				config.MongoURL = val
+			}
+			break
+		case "MONSTACHE_MONGO_CONFIG_URL":
+			if config.MongoConfigURL == "" {
+				config.MongoConfigURL = val
+			}
+			break
+		case "MONSTACHE_MONGO_PEM":
+			if config.MongoPemFile == "" {
+				config.MongoPemFile = val
+			}
+			break
+		case "MONSTACHE_MONGO_VALIDATE_PEM":
+			v, err := strconv.ParseBool(val)
+			if err != nil {
+				errorLog.Fatalf("Failed to load MONSTACHE_MONGO_VALIDATE_PEM: %s", err)
+			}
+			config.MongoValidatePemFile = v
+			break
+		case "MONSTACHE_MONGO_OPLOG_DB":
+			if config.MongoOpLogDatabaseName == "" {
+				config.MongoOpLogDatabaseName = val
+			}
+			break
+		case "MONSTACHE_MONGO_OPLOG_COL":
+			if config.MongoOpLogCollectionName == "" {
+				config.MongoOpLogCollectionName = val
+			}
+			break
+		case "MONSTACHE_ES_URLS":
+			if len(config.ElasticUrls) == 0 {
+				config.ElasticUrls = strings.Split(val, del)
+			}
+			break
+		case "MONSTACHE_ES_USER":
+			if config.ElasticUser == "" {
+				config.ElasticUser = val
+			}
+			break
+		case "MONSTACHE_ES_PASS":
+			if config.ElasticPassword == "" {
+				config.ElasticPassword = val
+			}
+			break
+		case "MONSTACHE_PPROF_PASS":
+			if config.PprofPassword == "" {
+				config.PprofPassword = val
+			}
+			break
+		case "MONSTACHE_ADMIN_PASS":
+			if config.AdminPassword == "" {
+				config.AdminPassword = val
+			}
+			break
+		case "MONSTACHE_ES_API_KEY":
+			if config.ElasticAPIKey == "" {
+				config.ElasticAPIKey = val
+			}
+			break
+		case "MONSTACHE_ES_API_KEY_FILE":
+			if config.ElasticAPIKeyFile == "" {
+				config.ElasticAPIKeyFile = val
+			}
+			break
+		case "MONSTACHE_ES_CLOUD_ID":
+			if config.ElasticCloudID == "" {
+				config.ElasticCloudID = val
+			}
+			break
+		case "MONSTACHE_ES_PEM":
+			if config.ElasticPemFile == "" {
+				config.ElasticPemFile = val
+			}
+			break
+		case "MONSTACHE_MONGO_X509_CERT":
+			if config.MongoX509Settings.ClientCertPemFile == "" {
+				config.MongoX509Settings.ClientCertPemFile = val
+			}
+			break
+		case "MONSTACHE_MONGO_X509_KEY":
+			if config.MongoX509Settings.ClientKeyPemFile == "" {
+				config.MongoX509Settings.ClientKeyPemFile = val
+			}
+			break
+		case "MONSTACHE_MONGO_KERBEROS_PRINCIPAL":
+			if config.MongoKerberosSettings.Principal == "" {
+				config.MongoKerberosSettings.Principal = val
+			}
+			break
+		case "MONSTACHE_MONGO_KERBEROS_PASSWORD":
+			if config.MongoKerberosSettings.Password == "" {
+				config.MongoKerberosSettings.Password = val
+			}
+			break
+		case "MONSTACHE_MONGO_KERBEROS_KEYTAB":
+			if config.MongoKerberosSettings.Keytab == "" {
+				config.MongoKerberosSettings.Keytab = val
+			}
+			break
+		case "MONSTACHE_ES_CLIENT_CERT":
+			if config.ElasticClientCert == "" {
+				config.ElasticClientCert = val
+			}
+			break
+		case "MONSTACHE_ES_CLIENT_KEY":
+			if config.ElasticClientKey == "" {
+				config.ElasticClientKey = val
+			}
+			break
+		case "MONSTACHE_OPENSEARCH":
+			v, err := strconv.ParseBool(val)
+			if err != nil {
+				errorLog.Fatalf("Failed to load MONSTACHE_OPENSEARCH: %s", err)
+			}
+			config.OpenSearch = v
+			break
+		case "MONSTACHE_ES_VALIDATE_PEM":
+			v, err := strconv.ParseBool(val)
+			if err != nil {
+				errorLog.Fatalf("Failed to load MONSTACHE_ES_VALIDATE_PEM: %s", err)
+			}
+			config.ElasticValidatePemFile = v
+			break
+		case "MONSTACHE_WORKER":
+			if config.Worker == "" {
+				config.Worker = val
+			}
+			break
+		case "MONSTACHE_CLUSTER":
+			if config.ClusterName == "" {
+				config.ClusterName = val
+			}
+			break
+		case "MONSTACHE_DIRECT_READ_NS":
+			if len(config.DirectReadNs) == 0 {
+				config.DirectReadNs = strings.Split(val, del)
+			}
+			break
+		case "MONSTACHE_CHANGE_STREAM_NS":
+			if len(config.ChangeStreamNs) == 0 {
+				config.ChangeStreamNs = strings.Split(val, del)
+			}
+			break
+		case "MONSTACHE_NS_REGEX":
+			if config.NsRegex == "" {
+				config.NsRegex = val
+			}
+			break
+		case "MONSTACHE_NS_EXCLUDE_REGEX":
+			if config.NsExcludeRegex == "" {
+				config.NsExcludeRegex = val
+			}
+			break
+		case "MONSTACHE_NS_DROP_REGEX":
+			if config.NsDropRegex == "" {
+				config.NsDropRegex = val
+			}
+			break
+		case "MONSTACHE_NS_DROP_EXCLUDE_REGEX":
+			if config.NsDropExcludeRegex == "" {
+				config.NsDropExcludeRegex = val
+			}
+			break
+		case "MONSTACHE_CONFIG_COLLECTION":
+			if config.ConfigCollection == "" {
+				config.ConfigCollection = val
+			}
+			break
+		case "MONSTACHE_CONFIG_DOCUMENT":
+			if config.ConfigDocument == "" {
+				config.ConfigDocument = val
+			}
+			break
+		case "MONSTACHE_PROFILE":
+			if config.Profile == "" {
+				config.Profile = val
+			}
+			break
+		case "OTEL_EXPORTER_OTLP_ENDPOINT":
+			if config.TracingEndpoint == "" {
+				config.TracingEndpoint = val
+			}
+			break
+		case "OTEL_SERVICE_NAME":
+			if config.TracingServiceName == "" {
+				config.TracingServiceName = val
+			}
+			break
+		case "MONSTACHE_GRAYLOG_ADDR":
+			if config.GraylogAddr == "" {
+				config.GraylogAddr = val
+			}
+			break
+		case "MONSTACHE_AWS_ACCESS_KEY":
+			config.AWSConnect.AccessKey = val
+			break
+		case "MONSTACHE_AWS_SECRET_KEY":
+			config.AWSConnect.SecretKey = val
+			break
+		case "MONSTACHE_AWS_REGION":
+			config.AWSConnect.Region = val
+			break
+		case "MONSTACHE_LOG_DIR":
+			config.Logs.Info = val + "/info.log"
+			config.Logs.Warn = val + "/warn.log"
+			config.Logs.Error = val + "/error.log"
+			config.Logs.Trace = val + "/trace.log"
+			config.Logs.Stats = val + "/stats.log"
+			break
+		case "MONSTACHE_HTTP_ADDR":
+			if config.HTTPServerAddr == "" {
+				config.HTTPServerAddr = val
+			}
+			break
+		case "MONSTACHE_FILE_NS":
+			if len(config.FileNamespaces) == 0 {
+				config.FileNamespaces = strings.Split(val, del)
+			}
+			break
+		case "MONSTACHE_FILE_METADATA_NS":
+			if len(config.FileMetadataNamespaces) == 0 {
+				config.FileMetadataNamespaces = strings.Split(val, del)
+			}
+			break
+		case "MONSTACHE_PATCH_NS":
+			if len(config.PatchNamespaces) == 0 {
+				config.PatchNamespaces = strings.Split(val, del)
+			}
+			break
+		case "MONSTACHE_PARTIAL_UPDATE_NS":
+			if len(config.PartialUpdateNamespaces) == 0 {
+				config.PartialUpdateNamespaces = strings.Split(val, del)
+			}
+			break
+		case "MONSTACHE_ARRAY_UPDATE_NS":
+			if len(config.ArrayUpdateNamespaces) == 0 {
+				config.ArrayUpdateNamespaces = strings.Split(val, del)
+			}
+			break
+		case "MONSTACHE_TIME_MACHINE_NS":
+			if len(config.TimeMachineNamespaces) == 0 {
+				config.TimeMachineNamespaces = strings.Split(val, del)
+			}
+			break
+		default:
+			continue
+		}
+	}
+	return config
+}
+
+func (config *configOptions) loadRoutingNamespaces() *configOptions {
+	for _, namespace := range config.RoutingNamespaces {
+		routingNamespaces[namespace] = true
+	}
+	return config
+}
+
+func (config *configOptions) loadTimeMachineNamespaces() *configOptions {
+	for _, namespace := range config.TimeMachineNamespaces {
+		tmNamespaces[namespace] = true
+	}
+	return config
+}
+
+func (config *configOptions) loadPatchNamespaces() *configOptions {
+	for _, namespace := range config.PatchNamespaces {
+		patchNamespaces[namespace] = true
+	}
+	return config
+}
+
+func (config *configOptions) loadPartialUpdateNamespaces() *configOptions {
+	for _, namespace := range config.PartialUpdateNamespaces {
+		partialUpdateNamespaces[namespace] = true
+	}
+	return config
+}
+
+func (config *configOptions) loadArrayUpdateNamespaces() *configOptions {
+	for _, namespace := range config.ArrayUpdateNamespaces {
+		arrayUpdateNamespaces[namespace] = true
+	}
+	return config
+}
+
+func (config *configOptions) loadStreamJSONNamespaces() *configOptions {
+	for _, namespace := range config.StreamJSONNamespaces {
+		streamJSONNamespaces[namespace] = true
+	}
+	return config
+}
+
+func (config *configOptions) loadGridFsConfig() *configOptions {
+	for _, namespace := range config.FileNamespaces {
+		fileNamespaces[namespace] = true
+	}
+	return config
+}
+
+func (config *configOptions) loadFileMetadataNamespaces() *configOptions {
+	for _, namespace := range config.FileMetadataNamespaces {
+		fileMetadataNamespaces[namespace] = true
+	}
+	return config
+}
+
+func (config configOptions) dump() {
+	json, err := config.sanitized()
+	if err != nil {
+		errorLog.Printf("Unable to print configuration: %s", err)
+	} else {
+		infoLog.Println(string(json))
+	}
+}
+
+// sanitized returns the config as JSON with the credentials redacted
+func (config configOptions) sanitized() ([]byte, error) {
+	if len(config.HTTPCredentials) > 0 {
+		creds := make([]httpCredential, len(config.HTTPCredentials))
+		for i, c := range config.HTTPCredentials {
+			creds[i] = httpCredential{User: c.User, Role: c.Role}
+			if c.Password != "" {
+				creds[i].Password = redact
+			}
+			if c.Token != "" {
+				creds[i].Token = redact
+			}
+		}
+		config.HTTPCredentials = creds
+	}
+	if config.CSFLE.LocalMasterKey != "" {
+		config.CSFLE.LocalMasterKey = redact
+	}
+	if config.CSFLE.AWSSecretKey != "" {
+		config.CSFLE.AWSSecretKey = redact
+	}
+	if config.MongoKerberosSettings.Password != "" {
+		config.MongoKerberosSettings.Password = redact
+	}
+	if config.MongoURL != "" {
+		config.MongoURL = cleanMongoURL(config.MongoURL)
+	}
+	if config.MongoConfigURL != "" {
+		config.MongoConfigURL = cleanMongoURL(config.MongoConfigURL)
+	}
+	if config.ElasticUser != "" {
+		config.ElasticUser = redact
+	}
+	if config.ElasticPassword != "" {
+		config.ElasticPassword = redact
+	}
+	if config.ElasticAPIKey != "" {
+		config.ElasticAPIKey = redact
+	}
+	if config.SecondaryElasticUser != "" {
+		config.SecondaryElasticUser = redact
+	}
+	if config.SecondaryElasticPassword != "" {
+		config.SecondaryElasticPassword = redact
+	}
+	if config.SecondaryElasticAPIKey != "" {
+		config.SecondaryElasticAPIKey = redact
+	}
+	if config.PprofPassword != "" {
+		config.PprofPassword = redact
+	}
+	if config.AdminPassword != "" {
+		config.AdminPassword = redact
+	}
+	if isInlinePEM(config.ElasticClientKey) {
+		config.ElasticClientKey = redact
+	}
+	if config.AWSConnect.AccessKey != "" {
+		config.AWSConnect.AccessKey = redact
+	}
+	if config.AWSConnect.SecretKey != "" {
+		config.AWSConnect.SecretKey = redact
+	}
+	if config.AWSConnect.Region != "" {
+		config.AWSConnect.Region = redact
+	}
+	return json.MarshalIndent(config, "", "  ")
+}
+
+/*
+if ssl=true is set on the connection string, remove the option
+from the connection string and enable TLS because the mgo
+driver does not support the option in the connection string
+*/
+func (config *configOptions) parseMongoURL(inURL string) (outURL string) {
+	const queryDelim string = "?"
+	outURL = inURL
+	hostQuery := strings.SplitN(outURL, queryDelim, 2)
+	if len(hostQuery) == 2 {
+		host, query := hostQuery[0], hostQuery[1]
+		r := regexp.MustCompile(`ssl=true&?|&ssl=true$`)
+		qstr := r.ReplaceAllString(query, "")
+		if qstr != query {
+			config.MongoDialSettings.Ssl = true
+			if qstr == "" {
+				outURL = host
+			} else {
+				outURL = strings.Join([]string{host, qstr}, queryDelim)
+			}
+		}
+	}
+	return
+}
+
+func (config *configOptions) validate() {
+	const schemeSrv = "mongodb+srv://"
+	if strings.HasPrefix(config.MongoURL, schemeSrv) {
+		panic("The mongodb+srv scheme is not yet supported")
+	}
+	if config.DisableChangeEvents && len(config.DirectReadNs) == 0 && config.ReplayFile == "" {
+		panic("Direct read namespaces must be specified if change events are disabled")
+	}
+	if config.RecordFile != "" && config.ReplayFile != "" {
+		panic("Events must be recorded with record-file or replayed with replay-file but not both")
+	}
+	if config.DeadLetterIndex != "" && config.DeadLetterFile != "" {
+		panic("Failed bulk items must be written to dead-letter-index or dead-letter-file but not both")
+	}
+	if config.ReplayDeadLetters && config.DeadLetterIndex == "" && config.DeadLetterFile == "" {
+		panic("Replaying dead letters requires dead-letter-index or dead-letter-file")
+	}
+	if config.IndexWorkers < 0 {
+		panic("Index workers must not be negative")
+	}
+	if config.AdaptiveBulk {
+		if config.AdaptiveBulkMinBytes < 0 || config.AdaptiveBulkTargetMs < 0 {
+			panic("Adaptive bulk settings must not be negative")
+		}
+		if config.ElasticMaxBytes > 0 && config.AdaptiveBulkMinBytes > config.ElasticMaxBytes {
+			panic("Adaptive bulk min bytes must not exceed elasticsearch-max-bytes")
+		}
+	}
+	if config.ElasticMaxContentLength < 0 {
+		panic("Elasticsearch max content length must not be negative")
+	}
+	if config.ElasticMaxContentLength > 0 && config.ElasticMaxBytes >= config.ElasticMaxContentLength {
+		panic("elasticsearch-max-bytes must be less than elasticsearch-max-content-length")
+	}
+	if config.CoalesceWindowMs < 0 {
+		panic("Coalesce window must not be negative")
+	}
+	if config.LookupBatchWindowMs < 0 || config.LookupBatchMax < 0 {
+		panic("Lookup batch settings must not be negative")
+	}
+	if config.GtmSettings.ChangeStreamBatchSize < 0 || config.GtmSettings.MaxAwaitSecs < 0 {
+		panic("Change stream batch size and max await must not be negative")
+	}
+	if config.DirectReadBudget < 0 || config.DirectReadRate < 0 {
+		panic("Direct read budget and rate must not be negative")
+	}
+	for _, p := range config.DirectReadPriorities {
+		if p.Namespace == "" || p.Priority < 1 {
+			panic("Direct read priorities require a namespace and a priority of at least 1")
+		}
+	}
+	for _, c := range config.NamespaceCursors {
+		if c.Namespace == "" || c.BatchSize < 0 || c.MaxAwaitSecs < 0 {
+			panic("Namespace cursors require a namespace and must not have negative settings")
+		}
+	}
+	if config.FileChunkBytes < 0 {
+		panic("File chunk bytes must not be negative")
+	}
+	if c := config.DiskCompression; c != "" && c != "none" && c != "zstd" {
+		panic(fmt.Sprintf("Unsupported disk compression %s.  Use none or zstd", c))
+	}
+	if config.MemoryBudgetMB < 0 {
+		panic("Memory budget must not be negative")
+	}
+	if (config.PprofUser == "") != (config.PprofPassword == "") {
+		panic("Pprof user and password must be set together")
+	}
+	for i := range config.HTTPCredentials {
+		c := &config.HTTPCredentials[i]
+		switch c.Role {
+		case "":
+			c.Role = httpRoleRead
+		case httpRoleRead, httpRoleAdmin:
+		default:
+			panic("HTTP credential role must be one of read or admin")
+		}
+		if c.Token == "" && (c.User == "" || c.Password == "") {
+			panic("HTTP credentials must specify a token or a user and password")
+		}
+	}
+	if (config.HTTPServerTLSCert == "") != (config.HTTPServerTLSKey == "") {
+		panic("HTTP server TLS cert and key must be set together")
+	}
+	if (config.AdminUser == "") != (config.AdminPassword == "") {
+		panic("Admin user and password must be set together")
+	}
+	if (config.ElasticClientCert == "") != (config.ElasticClientKey == "") {
+		panic("Elasticsearch client cert and key must be set together")
+	}
+	if config.NotifyRateLimit < 0 {
+		panic("Notify rate limit must not be negative")
+	}
+	if config.NotifyBulkFailureSeconds < 0 {
+		panic("Notify bulk failure seconds must not be negative")
+	}
+	for _, hook := range config.NotifyWebhooks {
+		if _, err := url.ParseRequestURI(hook.URL); err != nil {
+			panic(fmt.Sprintf("Notify webhook URL is invalid: %s", err))
+		}
+		if hook.Format != "" && hook.Format != "json" && hook.Format != "slack" {
+			panic(fmt.Sprintf("Notify webhook format %s must be json or slack", hook.Format))
+		}
+		for _, event := range hook.Events {
+			switch event {
+			case notifyBulkFailure, notifyResumeGap, notifyPluginPanic, notifyReplicationLag, notifySchemaDrift:
+			default:
+				panic(fmt.Sprintf("Notify webhook event %s is not one of %s, %s, %s, %s or %s", event,
+					notifyBulkFailure, notifyResumeGap, notifyPluginPanic, notifyReplicationLag, notifySchemaDrift))
+			}
+		}
+	}
+	if config.DebugSampleRate < 0 || config.DebugSampleRate > 1 {
+		panic("Debug sample rate must be between 0 and 1")
+	}
+	if config.AuditIndex != "" && config.AuditFile != "" {
+		panic("The audit log must be written to audit-index or audit-file but not both")
+	}
+	for _, ns := range config.FileMetadataNamespaces {
+		if !strings.HasSuffix(ns, ".files") || strings.Count(ns, ".") < 2 {
+			panic(fmt.Sprintf("File metadata namespace %s must be a GridFS files collection such as db.fs.files", ns))
+		}
+		if fileNamespaces[ns] {
+			panic(fmt.Sprintf("Namespace %s must not be both a file namespace and a file metadata namespace", ns))
+		}
+	}
+	if config.VerifySample < 0 {
+		panic("Verify sample must not be negative")
+	}
+	if config.VerifyReportFormat != "" && config.VerifyReportFormat != "json" && config.VerifyReportFormat != "csv" {
+		panic(fmt.Sprintf("Verify report format %s must be json or csv", config.VerifyReportFormat))
+	}
+	if config.RepairBatchSize < 0 || config.RepairRate < 0 {
+		panic("Repair batch size and rate must not be negative")
+	}
+	if config.PreviewSize < 0 {
+		panic("Preview size must not be negative")
+	}
+	if config.OrphanSweepSeconds < 0 || config.OrphanSweepBatchSize < 0 {
+		panic("Orphan sweep seconds and batch size must not be negative")
+	}
+	if config.RoutingCacheSize < 0 {
+		panic("Routing cache size must not be negative")
+	}
+	if config.SchemaDriftSeconds < 0 {
+		panic("Schema drift seconds must not be negative")
+	}
+	if config.TikaConcurrency < 0 || config.TikaMaxBytes < 0 || config.TikaTimeoutSeconds < 0 {
+		panic("Tika concurrency, max bytes and timeout seconds must not be negative")
+	}
+	if len(tikaFields) > 0 && config.TikaURL == "" {
+		panic("Tika fields require tika-url")
+	}
+	for _, lr := range languageRoutings {
+		if lr.Detect && config.TikaURL == "" {
+			panic(fmt.Sprintf("Language detection for %s requires tika-url", lr.Namespace))
+		}
+	}
+	if config.SecretRefreshSeconds < 0 {
+		panic("Secret refresh seconds must not be negative")
+	}
+	if config.StatsdFlushSeconds < 0 {
+		panic("StatsD flush seconds must not be negative")
+	}
+	if config.CheckpointInterval < 0 {
+		panic("Checkpoint interval seconds must not be negative")
+	}
+	if config.CheckpointMode != "after-ack" && config.CheckpointMode != "before-ack" {
+		panic("Checkpoint mode must be after-ack or before-ack")
+	}
+	if config.DrainTimeoutSeconds < 0 {
+		panic("Drain timeout seconds must not be negative")
+	}
+	if config.ClusterLeaseSeconds < 0 || config.ClusterHeartbeatSeconds < 0 {
+		panic("Cluster lease and heartbeat seconds must not be negative")
+	}
+	if config.ClusterHeartbeatSeconds != 0 && config.ClusterHeartbeatSeconds >= config.ClusterLeaseSeconds {
+		panic("Cluster heartbeat seconds must be less than the cluster lease seconds")
+	}
+	if config.PartitionName != "" && (config.ClusterName != "" || config.Worker != "") {
+		panic("Partition name cannot be combined with cluster name or workers")
+	}
+	if config.DryRun && (config.ClusterName != "" || config.PartitionName != "" || config.ReplayDeadLetters) {
+		panic("Dry run cannot be combined with cluster name, partition name or replaying dead letters")
+	}
+	if config.ReplicationLagThreshold < 0 {
+		panic("Replication lag threshold must not be negative")
+	}
+	if config.ReadyLagSeconds < 0 {
+		panic("Ready lag seconds must not be negative")
+	}
+	if config.ReplicationLagAlertURL != "" {
+		if config.ReplicationLagThreshold == 0 {
+			panic("Replication lag alerts require replication-lag-threshold")
+		}
+		if _, err := url.ParseRequestURI(config.ReplicationLagAlertURL); err != nil {
+			panic(fmt.Sprintf("Replication lag alert URL is invalid: %s", err))
+		}
+	}
+	if config.LogFormat != "text" && config.LogFormat != "json" {
+		panic(fmt.Sprintf("Log format %s must be text or json", config.LogFormat))
+	}
+	if config.TracingSampleRatio <= 0 || config.TracingSampleRatio > 1 {
+		panic("Tracing sample ratio must be greater than 0 and at most 1")
+	}
+	if config.ElasticCloudID != "" {
+		if len(config.ElasticUrls) > 0 {
+			panic("Elasticsearch must be configured with elasticsearch-url or elasticsearch-cloud-id but not both")
+		}
+		cloudURL, err := cloudIDURL(config.ElasticCloudID)
+		if err != nil {
+			panic(err)
+		}
+		config.ElasticUrls = []string{cloudURL}
+	}
+	if err := monstachemap.SetBinaryEncoding(config.UUIDRepresentation, config.BinaryEncoding); err != nil {
+		panic(err)
+	}
+	for ns := range reindexJobs {
+		directRead := false
+		for _, drns := range config.DirectReadNs {
+			if drns == ns {
+				directRead = true
+				break
+			}
+		}
+		if !directRead {
+			panic(fmt.Sprintf("Reindex namespace %s must be listed in direct-read-namespaces", ns))
+		}
+		if len(relates[ns]) > 0 || patchNamespaces[ns] || tmNamespaces[ns] || routingNamespaces[""] || routingNamespaces[ns] {
+			panic(fmt.Sprintf("Reindex namespace %s cannot be used with relate, patch, time machine or routing configuration", ns))
+		}
+		if rollovers[ns] != nil {
+			panic(fmt.Sprintf("Reindex namespace %s cannot also be a rollover namespace", ns))
+		}
+	}
+	for ns := range rollovers {
+		if m := mapIndexTypes[ns]; m != nil && isDatedIndex(m.Index) {
+			panic(fmt.Sprintf("Rollover namespace %s cannot use a dated index name", ns))
+		}
+	}
+	if config.AWSConnect.enabled() {
+		if err := config.AWSConnect.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if config.KafkaSink.enabled() {
+		if err := config.KafkaSink.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if config.RedisSink.enabled() {
+		if err := config.RedisSink.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if config.NotificationSink.enabled() {
+		if err := config.NotificationSink.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if config.WebhookSink.enabled() {
+		if err := config.WebhookSink.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if len(config.Offload) > 0 && !config.OffloadStore.enabled() {
+		panic("Offloading fields requires an offload-store with a bucket")
+	}
+	if config.OffloadStore.enabled() {
+		if err := config.OffloadStore.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if config.ArchiveSink.enabled() {
+		if err := config.ArchiveSink.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if config.MeilisearchSink.enabled() {
+		if err := config.MeilisearchSink.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if config.TypesenseSink.enabled() {
+		if err := config.TypesenseSink.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if config.NATSSink.enabled() {
+		if err := config.NATSSink.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if config.DisableElasticsearch && len(config.sinkNames()) == 0 {
+		panic("Disabling Elasticsearch requires at least one sink")
+	}
+	if config.AWSConnect.serverless() {
+		// serverless collections do not support aliases or the rollover API
+		if len(rollovers) > 0 || len(reindexJobs) > 0 {
+			panic("Rollover and reindex are not supported by OpenSearch Serverless")
+		}
+	}
+	if config.GzipLevel < gzip.HuffmanOnly || config.GzipLevel > gzip.BestCompression {
+		panic(fmt.Sprintf("Gzip level must be between %d and %d", gzip.HuffmanOnly, gzip.BestCompression))
+	}
+	if config.ElasticAPIKey != "" && config.ElasticAPIKeyFile != "" {
+		panic("Elasticsearch API key must be configured with elasticsearch-api-key or elasticsearch-api-key-file but not both")
+	}
+	if config.ElasticUser != "" && (config.ElasticAPIKey != "" || config.ElasticAPIKeyFile != "") {
+		panic("Elasticsearch basic auth and API key authentication cannot be used together")
+	}
+	if config.MongoX509Settings.enabled() {
+		if err := config.MongoX509Settings.validate(); err != nil {
+			panic(err)
+		}
+	}
+	if config.MongoKerberosSettings.enabled() {
+		if err := config.MongoKerberosSettings.validate(); err != nil {
+			panic(err)
+		}
+		if config.MongoX509Settings.enabled() {
+			panic("MongoDB X509 and Kerberos authentication cannot be used together")
+		}
+	}
+	if err := config.CSFLE.validate(); err != nil {
+		panic(err)
+	}
+	if err := config.Chaos.validate(); err != nil {
+		panic(err)
+	}
+	if err := applyTLSSettings(&tls.Config{}, config.MongoTLSMinVersion, config.MongoTLSCipherSuites); err != nil {
+		panic(fmt.Sprintf("Invalid MongoDB TLS settings: %s", err))
+	}
+	if err := applyTLSSettings(&tls.Config{}, config.ElasticTLSMinVersion, config.ElasticTLSCipherSuites); err != nil {
+		panic(fmt.Sprintf("Invalid Elasticsearch TLS settings: %s", err))
+	}
+	if config.MongoAWSAuth && (config.MongoX509Settings.enabled() || config.MongoKerberosSettings.enabled()) {
+		panic("MongoDB AWS authentication cannot be used with X509 or Kerberos authentication")
+	}
+	ds := config.MongoDialSettings
+	ss := config.MongoSessionSettings
+	if ds.ReadTimeout < 1 {
+		panic("MongoDB read timeout must be greater than 0")
+	}
+	if ds.WriteTimeout < 1 {
+		panic("MongoDB write timeout must be greater than 0")
+	}
+	if ss.SyncTimeout < 1 {
+		panic("MongoDB sync timeout must be greater than 0")
+	}
+	if ds.ConnectTimeout < 0 || ds.MaxPoolSize < 0 || ds.MinPoolSize < 0 || ds.MaxIdleTimeMs < 0 || ds.PoolTimeout < 0 {
+		panic("MongoDB connect timeout and pool settings must not be negative")
+	}
+	if ds.MaxPoolSize > 0 && ds.MinPoolSize > ds.MaxPoolSize {
+		panic("MongoDB min-pool-size must not exceed max-pool-size")
+	}
+	if ds.ReadPreference != "" {
+		if _, err := parseReadPreference(ds.ReadPreference); err != nil {
+			panic(err)
+		}
+	}
+	if len(config.DirectReadNs) > 0 {
+		if config.ElasticMaxSeconds < 5 {
+			warnLog.Println("Direct read performance degrades with small values for elasticsearch-max-seconds. Set to 5s or greater to remove this warning.")
+		}
+		if config.ElasticMaxDocs > 0 {
+			warnLog.Println("For performance reasons it is recommended to use elasticsearch-max-bytes instead of elasticsearch-max-docs since doc size may vary")
+		}
+	}
+}
+
+func (config *configOptions) setDefaults() *configOptions {
+	if config.AWSConnect.serverless() {
+		// serverless collections do not report a version
+		config.OpenSearch = true
+		if config.ElasticVersion == "" {
+			config.ElasticVersion = serverlessVersionDefault
+		}
+	}
+	ds := config.MongoDialSettings
+	ss := config.MongoSessionSettings
+	if ds.Timeout == -1 {
+		config.MongoDialSettings.Timeout = 15
+	}
+	if ds.ReadTimeout == -1 {
+		config.MongoDialSettings.ReadTimeout = 30
+	}
+	if ds.WriteTimeout == -1 {
+		config.MongoDialSettings.WriteTimeout = 30
+	}
+	if ss.SyncTimeout == -1 {
+		config.MongoSessionSettings.SyncTimeout = 30
+	}
+	if ss.SocketTimeout == -1 {
+		config.MongoSessionSettings.SocketTimeout = 0
+	}
+	if config.MongoURL == "" {
+		config.MongoURL = mongoURLDefault
+	}
+	if config.MappingSampleSize == 0 {
+		config.MappingSampleSize = mappingSampleSizeDefault
+	}
+	if config.PreviewSize == 0 {
+		config.PreviewSize = previewSizeDefault
+	}
+	if config.RepairBatchSize == 0 {
+		config.RepairBatchSize = repairBatchSizeDefault
+	}
+	if config.OrphanSweepBatchSize == 0 {
+		config.OrphanSweepBatchSize = orphanSweepBatchSizeDefault
+	}
+	if config.RoutingCacheSize == 0 {
+		config.RoutingCacheSize = routingCacheSizeDefault
+	}
+	if config.DryRun {
+		// bulk actions are only written out as NDJSON
+		config.DisableElasticsearch = true
+		config.IndexStats = false
+		if config.NDJSONFile == "" {
+			config.NDJSONFile = "-"
+		}
+	}
+	if config.PartitionName != "" && config.PartitionMember == "" {
+		if host, err := os.Hostname(); err == nil {
+			config.PartitionMember = host
+		}
+	}
+	if config.ClusterName != "" {
+		if config.Worker != "" {
+			config.ResumeName = fmt.Sprintf("%s:%s", config.ClusterName, config.Worker)
+		} else {
+			config.ResumeName = config.ClusterName
+		}
+		config.Resume = true
+	} else if config.PartitionName != "" {
+		config.ResumeName = fmt.Sprintf("%s:%s", config.PartitionName, config.PartitionMember)
+		config.Resume = true
+	} else if config.Worker != "" {
+		config.ResumeName = config.Worker
+	} else if config.ResumeName == "" {
+		config.ResumeName = resumeNameDefault
+	}
+	if config.ElasticMaxConns == 0 {
+		config.ElasticMaxConns = elasticMaxConnsDefault
+	}
+	if config.ElasticClientTimeout == 0 {
+		config.ElasticClientTimeout = elasticClientTimeoutDefault
+	}
+	if config.SecretRefreshSeconds == 0 {
+		config.SecretRefreshSeconds = secretRefreshSecondsDefault
+	}
+	if config.TracingServiceName == "" {
+		config.TracingServiceName = tracingServiceNameDefault
+	}
+	if config.StatsdPrefix == "" {
+		config.StatsdPrefix = statsdPrefixDefault
+	}
+	if config.StatsdFlushSeconds == 0 {
+		config.StatsdFlushSeconds = statsdFlushSecondsDefault
+	}
+	if config.DrainTimeoutSeconds == 0 {
+		config.DrainTimeoutSeconds = drainTimeoutSecondsDefault
+	}
+	if config.CheckpointInterval == 0 {
+		config.CheckpointInterval = checkpointIntervalSecondsDefault
+	}
+	if config.CheckpointMode == "" {
+		config.CheckpointMode = "after-ack"
+	}
+	if config.ClusterLeaseSeconds == 0 {
+		config.ClusterLeaseSeconds = clusterLeaseSecondsDefault
+	}
+	if config.ClusterHeartbeatSeconds == 0 {
+		config.ClusterHeartbeatSeconds = clusterHeartbeatSecondsDefault
+	}
+	if config.LogFormat == "" {
+		config.LogFormat = "text"
+	}
+	if config.TracingSampleRatio == 0 {
+		config.TracingSampleRatio = 1
+	}
+	if config.NotifyRateLimit == 0 {
+		config.NotifyRateLimit = notifyRateLimitDefault
+	}
+	if config.NotifyBulkFailureSeconds == 0 {
+		config.NotifyBulkFailureSeconds = notifyBulkFailureSecondsDefault
+	}
+	if config.TikaConcurrency == 0 {
+		config.TikaConcurrency = tikaConcurrencyDefault
+	}
+	if config.TikaTimeoutSeconds == 0 {
+		config.TikaTimeoutSeconds = tikaTimeoutSecondsDefault
+	}
+	if config.GzipLevel == 0 {
+		config.GzipLevel = gzip.DefaultCompression
+	}
+	if config.MergePatchAttr == "" {
+		config.MergePatchAttr = "json-merge-patches"
+	}
+	if config.ElasticMaxSeconds == 0 {
+		if len(config.DirectReadNs) > 0 {
+			config.ElasticMaxSeconds = 5
+		} else {
+			config.ElasticMaxSeconds = 1
+		}
+	}
+	if config.ElasticMaxDocs == 0 {
+		config.ElasticMaxDocs = elasticMaxDocsDefault
+	}
+	if config.ElasticMaxBytes == 0 {
+		config.ElasticMaxBytes = elasticMaxBytesDefault
+	}
+	if config.ElasticMaxContentLength == 0 {
+		config.ElasticMaxContentLength = elasticMaxContentLengthDefault
+	}
+	if config.ElasticHealth0 == 0 {
+		config.ElasticHealth0 = 15
+	}
+	if config.ElasticHealth1 == 0 {
+		config.ElasticHealth1 = 5
+	}
+	if config.MongoURL != "" {
+		config.MongoURL = config.parseMongoURL(config.MongoURL)
+	}
+	if config.MongoConfigURL != "" {
+		config.MongoConfigURL = config.parseMongoURL(config.MongoConfigURL)
+	}
+	if config.HTTPServerAddr == "" {
+		config.HTTPServerAddr = ":8080"
+	}
+	if config.StatsIndexFormat == "" {
+		config.StatsIndexFormat = "monstache.stats.2006-01-02"
+	}
+	if config.TimeMachineIndexPrefix == "" {
+		config.TimeMachineIndexPrefix = "log"
+	}
+	if config.TimeMachineIndexSuffix == "" {
+		config.TimeMachineIndexSuffix = "2006-01-02"
+	}
+	if config.DeleteIndexPattern == "" {
+		config.DeleteIndexPattern = "*"
+	}
+	if config.FileDownloaders == 0 && config.IndexFiles {
+		config.FileDownloaders = fileDownloadersDefault
+	}
+	if config.IndexWorkers == 0 {
+		config.IndexWorkers = indexWorkersDefault
+	}
+	if config.AdaptiveBulkMinBytes == 0 {
+		config.AdaptiveBulkMinBytes = adaptiveBulkMinBytesDefault
+	}
+	if config.AdaptiveBulkTargetMs == 0 {
+		config.AdaptiveBulkTargetMs = adaptiveBulkTargetMsDefault
+	}
+	if config.RelateThreads == 0 {
+		config.RelateThreads = relateThreadsDefault
+	}
+	if config.RelateBuffer == 0 {
+		config.RelateBuffer = relateBufferDefault
+	}
+	if config.PostProcessors == 0 && processPlugin != nil {
+		config.PostProcessors = postProcessorsDefault
+	}
+	if config.OplogTsFieldName == "" {
+		config.OplogTsFieldName = "oplog_ts"
+	}
+	if config.OplogDateFieldName == "" {
+		config.OplogDateFieldName = "oplog_date"
+	}
+	if config.OplogDateFieldFormat == "" {
+		config.OplogDateFieldFormat = "2006/01/02 15:04:05"
+	}
+	if config.ConfigDatabaseName == "" {
+		config.ConfigDatabaseName = configDatabaseNameDefault
+	}
+	if config.ConfigCollection != "" && config.ConfigDocument == "" {
+		config.ConfigDocument = configDocumentDefault
+	}
+	if config.ResumeFromTimestamp > 0 {
+		if config.ResumeFromTimestamp <= math.MaxInt32 {
+			config.ResumeFromTimestamp = config.ResumeFromTimestamp << 32
+		}
+	}
+	return config
+}
+
+func cleanMongoURL(inURL string) string {
+	const scheme = "mongodb://"
+	const schemeSrv = "mongodb+srv://"
+	hasScheme := strings.HasPrefix(inURL, scheme)
+	hasSchemeSrv := strings.HasPrefix(inURL, schemeSrv)
+	url := strings.TrimPrefix(inURL, scheme)
+	url = strings.TrimPrefix(url, schemeSrv)
+	userEnd := strings.IndexAny(url, "@")
+	if userEnd != -1 {
+		url = redact + "@" + url[userEnd+1:]
+	}
+	if hasScheme {
+		url = scheme + url
+	} else if hasSchemeSrv {
+		url = schemeSrv + url
+	}
+	return url
+}
+
+// csfleDecrypter handles the fields encrypted by client-side field level
+// encryption before documents are mapped.  Encrypted fields are BSON binary
+// subtype 6.  With the decrypt policy they are decrypted with the data keys
+// of the key vault, otherwise they are stripped
+type csfleDecrypter struct {
+	policy   string
+	localKey []byte
+	creds    *credentials.Credentials
+	// lookup finds a data key document in the key vault by its UUID.
+	// Defaults to a query of the key vault collection
+	lookup func(id []byte) (*csfleKey, error)
+	keys   map[string][]byte
+	lock   sync.Mutex
+}
+
+type csfleKey struct {
+	KeyMaterial []byte                 `bson:"keyMaterial"`
+	MasterKey   map[string]interface{} `bson:"masterKey"`
+}
+
+func (s *csfleSettings) enabled() bool {
+	return s.Policy != "" && s.Policy != "keep"
+}
+
+func (s *csfleSettings) validate() error {
+	switch s.Policy {
+	case "", "keep", "strip":
+		return nil
+	case "decrypt":
+	default:
+		return errors.New("CSFLE policy must be one of keep, strip or decrypt")
+	}
+	if len(strings.SplitN(s.KeyVaultNamespace, ".", 2)) != 2 {
+		return errors.New("CSFLE decryption requires key-vault-namespace as db.collection")
+	}
+	if s.LocalMasterKey != "" {
+		key, err := base64.StdEncoding.DecodeString(s.LocalMasterKey)
+		if err != nil || len(key) != 96 {
+			return errors.New("CSFLE local-master-key must be 96 bytes encoded as base64")
+		}
+	}
+	return nil
+}
+
+func newCSFLE(config *configOptions, mongo *mgo.Session) *csfleDecrypter {
+	s := config.CSFLE
+	c := &csfleDecrypter{policy: s.Policy, keys: make(map[string][]byte)}
+	if s.Policy != "decrypt" {
+		return c
+	}
+	c.localKey, _ = base64.StdEncoding.DecodeString(s.LocalMasterKey)
+	c.creds = (&awsConnect{AccessKey: s.AWSAccessKey, SecretKey: s.AWSSecretKey}).credentials()
+	vault := strings.SplitN(s.KeyVaultNamespace, ".", 2)
+	c.lookup = func(id []byte) (*csfleKey, error) {
+		session := mongo.Copy()
+		defer session.Close()
+		key := &csfleKey{}
+		err := session.DB(vault[0]).C(vault[1]).FindId(bson.Binary{Kind: 4, Data: id}).One(key)
+		return key, err
+	}
+	return c
+}
+
+// apply decrypts or strips the encrypted fields of the document and of the
+// updated fields of a change
+func (c *csfleDecrypter) apply(op *gtm.Op) {
+	if c == nil {
+		return
+	}
+	if op.Data != nil {
+		c.walk(op, op.Data)
+	}
+	if fields, ok := op.UpdateDescription["updatedFields"].(map[string]interface{}); ok {
+		c.walk(op, fields)
+	}
+}
+
+func (c *csfleDecrypter) walk(op *gtm.Op, doc map[string]interface{}) {
+	for k, v := range doc {
+		if nv, keep := c.value(op, v); keep {
+			doc[k] = nv
+		} else {
+			delete(doc, k)
+		}
+	}
+}
+
+func (c *csfleDecrypter) value(op *gtm.Op, v interface{}) (interface{}, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		c.walk(op, t)
+	case bson.M:
+		c.walk(op, t)
+	case []interface{}:
+		kept := t[:0]
+		for _, elem := range t {
+			if nv, keep := c.value(op, elem); keep {
+				kept = append(kept, nv)
+			}
+		}
+		return kept, true
+	case bson.Binary:
+		if t.Kind != 6 {
+			break
+		}
+		if c.policy != "decrypt" {
+			return nil, false
+		}
+		plain, err := c.decrypt(t.Data)
+		if err != nil {
+			logWith(warnLog, opLogFields(op), "Stripping encrypted field of document %v in %s: %s", op.Id, op.Namespace, err)
+			return nil, false
+		}
+		return plain, true
+	}
+	return v, true
+}
+
+// decrypt returns the value of an encrypted field.  The payload is the blob
+// subtype, the UUID of the data key, the original BSON type and the
+// ciphertext, whose associated data is the 18 bytes before it
+func (c *csfleDecrypter) decrypt(payload []byte) (interface{}, error) {
+	if len(payload) < 18 || (payload[0] != 1 && payload[0] != 2) {
+		return nil, errors.New("unsupported encrypted value")
+	}
+	key, err := c.dataKey(payload[1:17])
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aeadDecrypt(key, payload[18:], payload[:18])
+	if err != nil {
+		return nil, err
+	}
+	// wrap the bare value in a document to decode it
+	doc := append([]byte{0, 0, 0, 0, payload[17], 'v', 0}, plain...)
+	doc = append(doc, 0)
+	binary.LittleEndian.PutUint32(doc, uint32(len(doc)))
+	var wrapped struct {
+		V interface{} `bson:"v"`
+	}
+	if err = bson.Unmarshal(doc, &wrapped); err != nil {
+		return nil, err
+	}
+	return wrapped.V, nil
+}
+
+// dataKey returns the data key with the UUID.  Data keys are unwrapped with
+// their KMS provider once and cached
+func (c *csfleDecrypter) dataKey(id []byte) ([]byte, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if key := c.keys[string(id)]; key != nil {
+		return key, nil
+	}
+	doc, err := c.lookup(id)
+	if err != nil {
+		return nil, fmt.Errorf("unable to find data key: %s", err)
+	}
+	var key []byte
+	provider, _ := doc.MasterKey["provider"].(string)
+	switch provider {
+	case "local":
+		if c.localKey == nil {
+			return nil, errors.New("data key uses the local KMS provider but no local-master-key is set")
+		}
+		key, err = aeadDecrypt(c.localKey, doc.KeyMaterial, nil)
+	case "aws":
+		region, _ := doc.MasterKey["region"].(string)
+		var sess *session.Session
+		if sess, err = session.NewSession(&aws.Config{Region: aws.String(region), Credentials: c.creds}); err != nil {
+			return nil, err
+		}
+		var out *kms.DecryptOutput
+		if out, err = kms.New(sess).Decrypt(&kms.DecryptInput{CiphertextBlob: doc.KeyMaterial}); err == nil {
+			key = out.Plaintext
+		}
+	default:
+		return nil, fmt.Errorf("unsupported KMS provider %q", provider)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap data key: %s", err)
+	}
+	c.keys[string(id)] = key
+	return key, nil
+}
+
+// aeadDecrypt reverses AEAD_AES_256_CBC_HMAC_SHA_512, the algorithm of
+// encrypted fields and of data keys wrapped by a local master key.  The
+// key is the MAC key, the encryption key and the IV key of 32 bytes each
+func aeadDecrypt(key, data, ad []byte) ([]byte, error) {
+	if len(key) != 96 {
+		return nil, errors.New("key must be 96 bytes")
+	}
+	if len(data) < 2*aes.BlockSize+32 || (len(data)-32)%aes.BlockSize != 0 {
+		return nil, errors.New("ciphertext has an invalid length")
+	}
+	body, tag := data[:len(data)-32], data[len(data)-32:]
+	mac := hmac.New(sha512.New, key[:32])
+	mac.Write(ad)
+	mac.Write(body)
+	bits := make([]byte, 8)
+	binary.BigEndian.PutUint64(bits, uint64(len(ad))*8)
+	mac.Write(bits)
+	if !hmac.Equal(mac.Sum(nil)[:32], tag) {
+		return nil, errors.New("authentication failed")
+	}
+	block, err := aes.NewCipher(key[32:64])
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, len(body)-aes.BlockSize)
+	cipher.NewCBCDecrypter(block, body[:aes.BlockSize]).CryptBlocks(plain, body[aes.BlockSize:])
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, errors.New("invalid padding")
+	}
+	return plain[:len(plain)-pad], nil
+}
+
+// mongoAWSAuth authenticates connections to MongoDB with MONGODB-AWS.  The
+// driver does not support the mechanism so each new connection runs the
+// SASL conversation before it is handed to the driver.  Credentials come
+// from the URL or the default AWS chain and are refreshed by their provider
+// ahead of expiry, so new connections always sign with live credentials
+type mongoAWSAuth struct {
+	creds   *credentials.Credentials
+	timeout time.Duration
+}
+
+// webIdentityProvider assumes the role in AWS_ROLE_ARN with the token in
+// AWS_WEB_IDENTITY_TOKEN_FILE, as given to pods by IAM roles for service
+// accounts
+type webIdentityProvider struct {
+	credentials.Expiry
+	roleARN     string
+	tokenFile   string
+	sessionName string
+	client      *sts.STS
+}
+
+type mongoSASLReply struct {
+	ConversationID int    `bson:"conversationId"`
+	Payload        []byte `bson:"payload"`
+	Done           bool   `bson:"done"`
+	Ok             bool   `bson:"ok"`
+	ErrMsg         string `bson:"errmsg"`
+}
+
+func (p *webIdentityProvider) Retrieve() (credentials.Value, error) {
+	token, err := ioutil.ReadFile(p.tokenFile)
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	out, err := p.client.AssumeRoleWithWebIdentity(&sts.AssumeRoleWithWebIdentityInput{
+		RoleArn:          aws.String(p.roleARN),
+		RoleSessionName:  aws.String(p.sessionName),
+		WebIdentityToken: aws.String(string(token)),
+	})
+	if err != nil {
+		return credentials.Value{}, err
+	}
+	p.SetExpiration(*out.Credentials.Expiration, 5*time.Minute)
+	return credentials.Value{
+		AccessKeyID:     *out.Credentials.AccessKeyId,
+		SecretAccessKey: *out.Credentials.SecretAccessKey,
+		SessionToken:    *out.Credentials.SessionToken,
+		ProviderName:    "WebIdentityProvider",
+	}, nil
+}
+
+// newMongoAWSAuth uses the access key and secret from the connection URL
+// when given.  Otherwise the credentials are looked up in a web identity
+// token and then in the default chain of environment, shared config,
+// container and instance roles
+func newMongoAWSAuth(user, password, props string, timeout time.Duration) (*mongoAWSAuth, error) {
+	auth := &mongoAWSAuth{timeout: timeout}
+	if user != "" {
+		var token string
+		if props != "" {
+			unescaped, err := url.QueryUnescape(props)
+			if err != nil {
+				return nil, err
+			}
+			for _, prop := range strings.Split(unescaped, ",") {
+				kv := strings.SplitN(prop, ":", 2)
+				if len(kv) == 2 && kv[0] == "AWS_SESSION_TOKEN" {
+					token = kv[1]
+				}
+			}
+		}
+		auth.creds = credentials.NewStaticCredentials(user, password, token)
+		return auth, nil
+	}
+	cfg, handlers := defaults.Config(), defaults.Handlers()
+	var providers []credentials.Provider
+	if tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"); tokenFile != "" && os.Getenv("AWS_ROLE_ARN") != "" {
+		region := os.Getenv("AWS_REGION")
+		if region == "" {
+			region = "us-east-1"
+		}
+		sess, err := session.NewSession(&aws.Config{Region: aws.String(region), Credentials: credentials.AnonymousCredentials})
+		if err != nil {
+			return nil, err
+		}
+		sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+		if sessionName == "" {
+			sessionName = "monstache"
+		}
+		providers = append(providers, &webIdentityProvider{
+			roleARN:     os.Getenv("AWS_ROLE_ARN"),
+			tokenFile:   tokenFile,
+			sessionName: sessionName,
+			client:      sts.New(sess),
+		})
+	}
+	providers = append(providers, defaults.CredProviders(cfg, handlers)...)
+	auth.creds = credentials.NewCredentials(&credentials.ChainProvider{Providers: providers, VerboseErrors: true})
+	return auth, nil
+}
+
+// stsRegion is the region of the STS host named by the server.  The global
+// endpoint and hosts without a region sign for us-east-1
+func stsRegion(host string) string {
+	parts := strings.Split(host, ".")
+	if host == "sts.amazonaws.com" || len(parts) < 2 {
+		return "us-east-1"
+	}
+	return parts[1]
+}
+
+// authenticate runs the MONGODB-AWS conversation on a new connection.  The
+// server checks the signed GetCallerIdentity request with STS
+func (a *mongoAWSAuth) authenticate(conn net.Conn) error {
+	if a.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(a.timeout))
+		defer conn.SetDeadline(time.Time{})
+	}
+	nonce := make([]byte, 32)
+	if _, err := crand.Read(nonce); err != nil {
+		return err
+	}
+	payload, err := bson.Marshal(bson.M{"r": nonce, "p": int32('n')})
+	if err != nil {
+		return err
+	}
+	var reply mongoSASLReply
+	cmd := bson.D{{Name: "saslStart", Value: 1}, {Name: "mechanism", Value: mongoAWSMechanism}, {Name: "payload", Value: payload}}
+	if err = runMongoCommand(conn, cmd, &reply); err != nil {
+		return err
+	}
+	var server struct {
+		Nonce []byte `bson:"s"`
+		Host  string `bson:"h"`
+	}
+	if err = bson.Unmarshal(reply.Payload, &server); err != nil {
+		return err
+	}
+	if len(server.Nonce) != 64 || !bytes.Equal(server.Nonce[:32], nonce) {
+		return errors.New("server nonce does not extend the client nonce")
+	}
+	if server.Host == "" || len(server.Host) > 255 || strings.Contains(server.Host, "..") {
+		return fmt.Errorf("invalid STS host %q", server.Host)
+	}
+	req, err := http.NewRequest("POST", "https://"+server.Host+"/", strings.NewReader(stsGetCallerIdentity))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Content-Length", strconv.Itoa(len(stsGetCallerIdentity)))
+	req.Header.Set("X-MongoDB-Server-Nonce", base64.StdEncoding.EncodeToString(server.Nonce))
+	req.Header.Set("X-MongoDB-GS2-CB-Flag", "n")
+	signer := v4.NewSigner(a.creds)
+	if _, err = signer.Sign(req, strings.NewReader(stsGetCallerIdentity), "sts", stsRegion(server.Host), time.Now().UTC()); err != nil {
+		return err
+	}
+	final := bson.M{"a": req.Header.Get("Authorization"), "d": req.Header.Get("X-Amz-Date")}
+	if token := req.Header.Get("X-Amz-Security-Token"); token != "" {
+		final["t"] = token
+	}
+	if payload, err = bson.Marshal(final); err != nil {
+		return err
+	}
+	cmd = bson.D{{Name: "saslContinue", Value: 1}, {Name: "conversationId", Value: reply.ConversationID}, {Name: "payload", Value: payload}}
+	if err = runMongoCommand(conn, cmd, &reply); err != nil {
+		return err
+	}
+	if !reply.Done {
+		return errors.New("authentication did not complete")
+	}
+	return nil
+}
+
+// runMongoCommand runs a command against the $external database of a
+// connection which has not yet been handed to the driver
+func runMongoCommand(conn net.Conn, cmd bson.D, result *mongoSASLReply) error {
+	doc, err := bson.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	const ns = "$external.$cmd"
+	msg := make([]byte, 16, 16+4+len(ns)+1+8+len(doc))
+	binary.LittleEndian.PutUint32(msg[4:], 1)
+	binary.LittleEndian.PutUint32(msg[12:], 2004) // OP_QUERY
+	msg = append(msg, 0, 0, 0, 0)
+	msg = append(msg, ns...)
+	msg = append(msg, 0)
+	msg = append(msg, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff) // skip 0, return -1
+	msg = append(msg, doc...)
+	binary.LittleEndian.PutUint32(msg, uint32(len(msg)))
+	if _, err = conn.Write(msg); err != nil {
+		return err
+	}
+	header := make([]byte, 16)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	size := int(binary.LittleEndian.Uint32(header))
+	if size < 16+20 || size > 16*1024*1024 {
+		return fmt.Errorf("invalid reply size %d", size)
+	}
+	if op := binary.LittleEndian.Uint32(header[12:]); op != 1 { // OP_REPLY
+		return fmt.Errorf("unexpected reply opcode %d", op)
+	}
+	body := make([]byte, size-16)
+	if _, err = io.ReadFull(conn, body); err != nil {
+		return err
+	}
+	*result = mongoSASLReply{}
+	if err = bson.Unmarshal(body[20:], result); err != nil {
+		return err
+	}
+	if !result.Ok {
+		return errors.New(result.ErrMsg)
+	}
+	return nil
+}
+
+func (config *configOptions) timeoutConnection(inURL string, mongoOk chan bool) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+	defer signal.Stop(sigs)
+	deadline := time.Duration(config.MongoDialSettings.Timeout) * time.Second
+	connT := time.NewTicker(deadline)
+	defer connT.Stop()
+	select {
+	case <-mongoOk:
+		return
+	case <-sigs:
+		os.Exit(exitStatus)
+	case <-connT.C:
+		errorLog.Fatalf("Unable to connect to MongoDB using URL %s: timed out after %d seconds",
+			cleanMongoURL(inURL), config.MongoDialSettings.Timeout)
+	}
+}
+
+// driverURLOptions are the connection URL options which the driver does not
+// parse itself
+var driverURLOptions = map[string]bool{
+	"connectTimeoutMS":        true,
+	"socketTimeoutMS":         true,
+	"compressors":             true,
+	"authMechanismProperties": true,
+}
+
+// splitDriverURLOptions removes the options in driverURLOptions from the
+// query of a connection URL and returns them
+func splitDriverURLOptions(inURL string) (string, map[string]string) {
+	opts := make(map[string]string)
+	i := strings.Index(inURL, "?")
+	if i == -1 {
+		return inURL, opts
+	}
+	var kept []string
+	for _, pair := range strings.FieldsFunc(inURL[i+1:], func(r rune) bool { return r == '&' || r == ';' }) {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 && driverURLOptions[kv[0]] {
+			opts[kv[0]] = kv[1]
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	if len(kept) == 0 {
+		return inURL[:i], opts
+	}
+	return inURL[:i+1] + strings.Join(kept, "&"), opts
+}
+
+func parseReadPreference(pref string) (mgo.Mode, error) {
+	switch pref {
+	case "primary":
+		return mgo.Primary, nil
+	case "primaryPreferred":
+		return mgo.PrimaryPreferred, nil
+	case "secondary":
+		return mgo.Secondary, nil
+	case "secondaryPreferred":
+		return mgo.SecondaryPreferred, nil
+	case "nearest":
+		return mgo.Nearest, nil
+	}
+	return 0, fmt.Errorf("MongoDB read preference %s must be one of primary, primaryPreferred, secondary, secondaryPreferred or nearest", pref)
+}
+
+// applyPoolSettings sets the pool sizes and read preference of the
+// mongo-dial-settings which the connection URL leaves unset
+func (config *configOptions) applyPoolSettings(dialInfo *mgo.DialInfo, inURL string) error {
+	ds := config.MongoDialSettings
+	if dialInfo.PoolLimit == 0 {
+		dialInfo.PoolLimit = ds.MaxPoolSize
+	}
+	if dialInfo.MinPoolSize == 0 {
+		dialInfo.MinPoolSize = ds.MinPoolSize
+	}
+	if dialInfo.MaxIdleTimeMS == 0 {
+		dialInfo.MaxIdleTimeMS = ds.MaxIdleTimeMs
+	}
+	dialInfo.PoolTimeout = time.Duration(ds.PoolTimeout) * time.Second
+	// the driver defaults the read preference to primary
+	if ds.ReadPreference != "" && !strings.Contains(inURL, "readPreference=") {
+		mode, err := parseReadPreference(ds.ReadPreference)
+		if err != nil {
+			return err
+		}
+		dialInfo.ReadPreference = &mgo.ReadPreference{Mode: mode}
+	}
+	return nil
+}
+
+func (config *configOptions) dialMongo(inURL string) (*mgo.Session, error) {
+	var x509Cert *x509.Certificate
+	parseURL, urlOpts := splitDriverURLOptions(inURL)
+	dialInfo, err := mgo.ParseURL(parseURL)
+	if err != nil {
+		return nil, err
+	}
+	if err = config.applyPoolSettings(dialInfo, parseURL); err != nil {
+		return nil, err
+	}
+	compressors := config.MongoDialSettings.Compressors
+	if urlOpts["compressors"] != "" {
+		compressors = strings.Split(urlOpts["compressors"], ",")
+	}
+	if len(compressors) > 0 {
+		warnLog.Printf("Ignoring MongoDB compressors %s: the driver does not support wire compression", strings.Join(compressors, ","))
+	}
+	// an authMechanism on the connection URL takes precedence
+	if ks := config.MongoKerberosSettings; ks.enabled() && dialInfo.Mechanism == "" {
+		if err = ks.apply(dialInfo); err != nil {
+			return nil, err
+		}
+	}
+	if mongoDialInfo == nil && (dialInfo.Mechanism == mongoAWSMechanism || config.MongoAWSAuth) {
+		timeout := time.Duration(config.MongoDialSettings.ConnectTimeout) * time.Second
+		if mongoAWS, err = newMongoAWSAuth(dialInfo.Username, dialInfo.Password, urlOpts["authMechanismProperties"], timeout); err != nil {
+			return nil, err
+		}
+		// the connections authenticate themselves when dialed
+		dialInfo.Mechanism, dialInfo.Username, dialInfo.Password = "", "", ""
+	}
+	if mongoDialInfo == nil {
+		// save the initial dial info so that it can be reused
+		// if connecting to shards
+		mongoDialInfo = dialInfo.Copy()
+	} else {
+		// copy the initial auth info when connecting to shards
+		dialInfo.Username = mongoDialInfo.Username
+		dialInfo.Password = mongoDialInfo.Password
+		dialInfo.Source = mongoDialInfo.Source
+		dialInfo.Mechanism = mongoDialInfo.Mechanism
+		dialInfo.Service = mongoDialInfo.Service
+		dialInfo.ServiceHost = mongoDialInfo.ServiceHost
+	}
+	dialInfo.AppName = "monstache"
+	dialInfo.Timeout = time.Duration(config.MongoDialSettings.ConnectTimeout) * time.Second
+	dialInfo.ReadTimeout = time.Duration(config.MongoDialSettings.ReadTimeout) * time.Second
+	dialInfo.WriteTimeout = time.Duration(config.MongoDialSettings.WriteTimeout) * time.Second
+	if ms, err := strconv.Atoi(urlOpts["socketTimeoutMS"]); err == nil && ms > 0 {
+		dialInfo.ReadTimeout = time.Duration(ms) * time.Millisecond
+		dialInfo.WriteTimeout = dialInfo.ReadTimeout
+	}
+	if ms, err := strconv.Atoi(urlOpts["connectTimeoutMS"]); err == nil && ms > 0 {
+		dialInfo.Timeout = time.Duration(ms) * time.Millisecond
+	}
+	ssl := config.MongoDialSettings.Ssl || config.MongoPemFile != "" || config.MongoX509Settings.enabled()
+	if ssl {
+		tlsConfig := &tls.Config{}
+		// Check to see if we don't need to validate the PEM
+		if config.MongoValidatePemFile == false {
+			// Turn off validation
+			tlsConfig.InsecureSkipVerify = true
+		}
+		if err = applyTLSSettings(tlsConfig, config.MongoTLSMinVersion, config.MongoTLSCipherSuites); err != nil {
+			return nil, err
+		}
+		if config.MongoPemFile != "" {
+			if mongoCAs == nil {
+				cas := &certPool{
+					target: "MongoDB",
+					source: func() string { return config.MongoPemFile },
+				}
+				if err = cas.start(); err != nil {
+					return nil, err
+				}
+				mongoCAs = cas
+			}
+			mongoCAs.apply(tlsConfig)
+		}
+		if config.MongoX509Settings.enabled() {
+			if mongoClientCert == nil {
+				cc := &clientCertificate{
+					target:  "MongoDB",
+					cert:    config.MongoX509Settings.ClientCertPemFile,
+					key:     config.MongoX509Settings.ClientKeyPemFile,
+					rotated: mongoLogins.rotateCertificate,
+				}
+				if err = cc.start(); err != nil {
+					return nil, err
+				}
+				mongoClientCert = cc
+			}
+			clientCert, _ := mongoClientCert.get(nil)
+			x509Cert = clientCert.Leaf
+			// the server must see the certificate to authenticate with it
+			tlsConfig.GetClientCertificate = mongoClientCert.get
+		}
+		dialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			conn, err := tls.Dial("tcp", addr.String(), tlsConfig)
+			if err != nil {
+				errorLog.Printf("Unable to dial MongoDB: %s", err)
+			}
+			return conn, err
+		}
+	}
+	if mongoAWS != nil {
+		dial := dialInfo.DialServer
+		if dial == nil {
+			dial = func(addr *mgo.ServerAddr) (net.Conn, error) {
+				return net.DialTimeout("tcp", addr.String(), dialInfo.Timeout)
+			}
+		}
+		dialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
+			conn, err := dial(addr)
+			if err != nil {
+				return nil, err
+			}
+			if err = mongoAWS.authenticate(conn); err != nil {
+				conn.Close()
+				errorLog.Printf("Unable to authenticate to MongoDB with %s: %s", mongoAWSMechanism, err)
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+	if chaos != nil {
+		dial := dialInfo.DialServer
+		if dial == nil {
+			dial = func(addr *mgo.ServerAddr) (net.Conn, error) {
+				return net.DialTimeout("tcp", addr.String(), dialInfo.Timeout)
+			}
+		}
+		dialInfo.DialServer = chaos.dialer(dial)
+	}
+	mongoOk := make(chan bool)
+	if config.MongoDialSettings.Timeout != 0 {
+		go config.timeoutConnection(inURL, mongoOk)
+	}
+	session, err := mgo.DialWithInfo(dialInfo)
+	close(mongoOk)
+	if err == nil {
+		session.SetSyncTimeout(time.Duration(config.MongoSessionSettings.SyncTimeout) * time.Second)
+		if socketTimeout := config.MongoSessionSettings.SocketTimeout; socketTimeout > 0 {
+			session.SetSocketTimeout(time.Duration(socketTimeout) * time.Second)
+		}
+	}
+	if x509Cert != nil {
+		cred := &mgo.Credential{Mechanism: "MONGODB-X509", Certificate: x509Cert}
+		if err := session.Login(cred); err != nil {
+			return nil, err
+		}
+		mongoLogins.lock.Lock()
+		mongoLogins.cred = cred
+		mongoLogins.lock.Unlock()
+	}
+	return session, err
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// applyTLSSettings sets the minimum TLS version and the cipher suites of a
+// TLS config.  Go does not allow the TLS 1.3 suites to be chosen so the
+// suites only restrict TLS 1.2 and earlier
+func applyTLSSettings(tlsConfig *tls.Config, minVersion string, suites []string) error {
+	if minVersion != "" {
+		v, ok := tlsVersions[minVersion]
+		if !ok {
+			return fmt.Errorf("TLS min version %s must be one of 1.0, 1.1, 1.2 or 1.3", minVersion)
+		}
+		tlsConfig.MinVersion = v
+	}
+	for _, name := range suites {
+		id, err := tlsCipherSuite(name)
+		if err != nil {
+			return err
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	return nil
+}
+
+func tlsCipherSuite(name string) (uint16, error) {
+	for _, cs := range tls.CipherSuites() {
+		if cs.Name != name {
+			continue
+		}
+		for _, v := range cs.SupportedVersions {
+			if v != tls.VersionTLS13 {
+				return cs.ID, nil
+			}
+		}
+		return 0, fmt.Errorf("TLS 1.3 cipher suite %s cannot be configured", name)
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		if cs.Name == name {
+			return 0, fmt.Errorf("TLS cipher suite %s is insecure", name)
+		}
+	}
+	return 0, fmt.Errorf("Unknown TLS cipher suite %s", name)
+}
+
+func (config *configOptions) NewHTTPClient() (client *http.Client, err error) {
+	tlsConfig := &tls.Config{}
+	p := config.secretPrefix
+	if config.ElasticClientCert != "" {
+		cc := &clientCertificate{
+			target:  "Elasticsearch",
+			certOpt: p + "elasticsearch-client-cert",
+			keyOpt:  p + "elasticsearch-client-key",
+			cert:    config.ElasticClientCert,
+			key:     config.ElasticClientKey,
+		}
+		if err = cc.start(); err != nil {
+			return client, fmt.Errorf("Unable to load Elasticsearch client certificate: %s", err)
+		}
+		tlsConfig.GetClientCertificate = cc.get
+	}
+	if config.ElasticValidatePemFile == false {
+		// Turn off validation
+		tlsConfig.InsecureSkipVerify = true
+	}
+	if config.ElasticPemFile != "" {
+		cas := &certPool{
+			target: "Elasticsearch",
+			source: func() string { return secretValue(p+"elasticsearch-pem-file", config.ElasticPemFile) },
+		}
+		if err = cas.start(); err != nil {
+			return client, err
+		}
+		cas.apply(tlsConfig)
+	}
+	if err = applyTLSSettings(tlsConfig, config.ElasticTLSMinVersion, config.ElasticTLSCipherSuites); err != nil {
+		return client, err
+	}
+	var transport http.RoundTripper = &http.Transport{
+		DisableCompression:  !config.Gzip,
+		TLSHandshakeTimeout: time.Duration(30) * time.Second,
+		TLSClientConfig:     tlsConfig,
+	}
+	if chaos != nil {
+		transport = &chaosTransport{transport: transport}
+	}
+	if hasSecret(p+"elasticsearch-user", p+"elasticsearch-password", p+"elasticsearch-api-key") {
+		transport = &secretAuthTransport{
+			transport: transport,
+			prefix:    p,
+			user:      config.ElasticUser,
+			password:  config.ElasticPassword,
+			apiKey:    config.ElasticAPIKey,
+		}
+	} else if config.ElasticAPIKey != "" || config.ElasticAPIKeyFile != "" {
+		if transport, err = newAPIKeyTransport(config, transport); err != nil {
+			return client, err
+		}
+	}
+	client = &http.Client{
+		Timeout:   time.Duration(config.ElasticClientTimeout) * time.Second,
+		Transport: transport,
+	}
+	if config.AWSConnect.enabled() {
+		service := config.AWSConnect.Service
+		if service == "" {
+			service = "es"
+		}
+		client.Transport = &awsSigningTransport{
+			transport: client.Transport,
+			signer:    v4.NewSigner(config.AWSConnect.credentials()),
+			region:    config.AWSConnect.Region,
+			service:   service,
+		}
+	}
+	if config.Gzip {
+		// compress outermost so that request signing covers the compressed body
+		client.Transport = &gzipTransport{
+			transport: client.Transport,
+			level:     config.GzipLevel,
+		}
+	}
+	return client, err
+}
+
+func doDrop(mongo *mgo.Session, elastic *elastic.Client, op *gtm.Op, config *configOptions) (err error) {
+	if db, drop := op.IsDropDatabase(); drop {
+		if config.DroppedDatabases {
+			if err = deleteIndexes(elastic, db, config); err == nil {
+				if e := dropDBMeta(mongo, db, config); e != nil {
+					errorLog.Printf("Unable to delete metadata for db: %s", e)
+				}
+			}
+		}
+	} else if col, drop := op.IsDropCollection(); drop {
+		if config.DroppedCollections {
+			if err = deleteIndex(elastic, op.GetDatabase()+"."+col, config); err == nil {
+				if e := dropCollectionMeta(mongo, op.GetDatabase()+"."+col, config); e != nil {
+					errorLog.Printf("Unable to delete metadata for collection: %s", e)
+				}
+			}
+		}
+	}
+	return
+}
+
+// normalizeFileMetadata sets the contentType of a GridFS file from its
+// metadata when the driver which uploaded it did not set the deprecated
+// top level field, so that the content type of every file is searchable in
+// the same field
+func normalizeFileMetadata(doc map[string]interface{}) {
+	if doc == nil || doc["contentType"] != nil {
+		return
+	}
+	if md, ok := doc["metadata"].(map[string]interface{}); ok && md["contentType"] != nil {
+		doc["contentType"] = md["contentType"]
+	}
+}
+
+// allows returns true if the content of a file is indexed.  A file must
+// match one of the content types or extensions when any are listed, must not
+// match an excluded one and must not exceed max-bytes
+func (ff *fileFilter) allows(name, contentType string, size int64) bool {
+	if ff.MaxBytes > 0 && size > ff.MaxBytes {
+		return false
+	}
+	contentType = strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+	ext := strings.ToLower(filepath.Ext(name))
+	matches := func(contentTypes, extensions []string) bool {
+		for _, pattern := range contentTypes {
+			if ok, _ := filepath.Match(strings.ToLower(pattern), contentType); ok && contentType != "" {
+				return true
+			}
+		}
+		for _, e := range extensions {
+			if e = strings.ToLower(e); ext != "" && (e == ext || "."+e == ext) {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(ff.ExcludeContentTypes, ff.ExcludeExtensions) {
+		return false
+	}
+	if len(ff.ContentTypes)+len(ff.Extensions) == 0 {
+		return true
+	}
+	return matches(ff.ContentTypes, ff.Extensions)
+}
+
+func hasFileContent(op *gtm.Op, config *configOptions) (ingest bool) {
+	if !config.IndexFiles || fileMetadataNamespaces[op.Namespace] {
+		return
+	}
+	return fileNamespaces[op.Namespace]
+}
+
+func addPatch(config *configOptions, client *elastic.Client, op *gtm.Op,
+	objectID string, indexType *indexTypeMapping, meta *indexingMeta) (err error) {
+	var merges []interface{}
+	var toJSON []byte
+	if op.IsSourceDirect() {
+		return nil
+	}
+	if op.Timestamp == 0 {
+		return nil
+	}
+	if op.IsUpdate() {
+		ctx := context.Background()
+		service := client.Get()
+		service.Id(objectID)
+		service.Index(indexType.Index)
+		service.Type(indexType.Type)
+		if indexType.Type == "" {
+			service.Type(typeFromFuture)
+		}
+		if meta.ID != "" {
+			service.Id(meta.ID)
+		}
+		if meta.Index != "" {
+			service.Index(meta.Index)
+		}
+		if meta.Type != "" {
+			service.Type(meta.Type)
+		}
+		if meta.Routing != "" {
+			service.Routing(meta.Routing)
+		}
+		if meta.Parent != "" {
+			service.Parent(meta.Parent)
+		}
+		var resp *elastic.GetResult
+		if resp, err = service.Do(ctx); err == nil {
+			if resp.Found {
+				var src map[string]interface{}
+				if err = json.Unmarshal(*resp.Source, &src); err == nil {
+					if val, ok := src[config.MergePatchAttr]; ok {
+						merges = val.([]interface{})
+						for _, m := range merges {
+							entry := m.(map[string]interface{})
+							entry["ts"] = int(entry["ts"].(float64))
+							entry["v"] = int(entry["v"].(float64))
+						}
+					}
+					delete(src, config.MergePatchAttr)
+					var fromJSON, mergeDoc []byte
+					if fromJSON, err = json.Marshal(src); err == nil {
+						if toJSON, err = json.Marshal(op.Data); err == nil {
+							if mergeDoc, err = jsonpatch.CreateMergePatch(fromJSON, toJSON); err == nil {
+								merge := make(map[string]interface{})
+								merge["ts"] = op.Timestamp >> 32
+								merge["p"] = string(mergeDoc)
+								merge["v"] = len(merges) + 1
+								merges = append(merges, merge)
+								op.Data[config.MergePatchAttr] = merges
+							}
+						}
+					}
+				}
+			} else {
+				err = errors.New("Last document revision not found")
+			}
+
+		}
+	} else {
+		if _, found := op.Data[config.MergePatchAttr]; !found {
+			if toJSON, err = json.Marshal(op.Data); err == nil {
+				merge := make(map[string]interface{})
+				merge["v"] = 1
+				merge["ts"] = op.Timestamp >> 32
+				merge["p"] = string(toJSON)
+				merges = append(merges, merge)
+				op.Data[config.MergePatchAttr] = merges
+			}
+		}
+	}
+	return
+}
+
+// transformDocument applies the field settings of its namespace to a mapped
+// document.  It returns false if the document cannot be indexed.  Skipped
+// documents are returned untransformed
+func transformDocument(config *configOptions, op *gtm.Op) (meta *indexingMeta, ok bool) {
+	if fileMetadataNamespaces[op.Namespace] {
+		normalizeFileMetadata(op.Data)
+	}
+	excludeFields(op)
+	if !coerceFields(op) || !convertGeoFields(op) {
+		return
+	}
+	meta = parseIndexMeta(op)
+	if meta.Skip {
+		return meta, true
+	}
+	if nf := numberFormats[op.Namespace]; nf != nil {
+		nf.format(op.Data)
+	}
+	if df := dateFormats[op.Namespace]; df != nil {
+		df.normalize(op.Data)
+	}
+	copyFieldValues(op)
+	enrichDocument(op)
+	extractTikaFields(op)
+	if !embedFields(op) {
+		return
+	}
+	if j := joins[op.Namespace]; j != nil {
+		if e := j.apply(op, meta); e != nil {
+			logWith(errorLog, opLogFields(op), "Unable to join document %v in %s: %s", op.Id, op.Namespace, e)
+		}
+	}
+	if lr := languageRoutings[op.Namespace]; lr != nil {
+		lr.apply(config, op, meta)
+	}
+	if config.useTypelessAPI() {
+		meta.Type = ""
+	}
+	prepareDataForIndexing(config, op)
+	scanPII(op.Namespace, op.Data)
+	redactFields(op.Namespace, op.Data)
+	if of := offloads[op.Namespace]; of != nil {
+		meta.offloads = of.apply(config.OffloadStore, op)
+	}
+	if !limitDocumentSize(op) {
+		return
+	}
+	if config.ContentHashField != "" && op.Data != nil {
+		op.Data[config.ContentHashField] = contentHash(op.Data, config.ContentHashField)
+	}
+	return meta, true
+}
+
+// contentHash is the hex SHA-256 of the JSON of a document with its keys
+// sorted, leaving out the hash field itself
+func contentHash(doc map[string]interface{}, field string) string {
+	fields := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		if k != field {
+			fields[k] = v
+		}
+	}
+	var canonical interface{}
+	if data, err := json.Marshal(fields); err == nil {
+		json.Unmarshal(data, &canonical)
+	}
+	data, _ := json.Marshal(canonical)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func doIndexing(config *configOptions, mongo *mgo.Session, bulk *elastic.BulkProcessor, client *elastic.Client, op *gtm.Op) (err error) {
+	meta, ok := transformDocument(config, op)
+	if !ok {
+		return
+	}
+	if meta.Skip {
+		recordDocument("skipped", op, mapIndexType(config, op).Index)
+		return
+	}
+	if len(meta.offloads) > 0 {
+		if err = config.OffloadStore.upload(meta.offloads); err != nil {
+			return
+		}
+	}
+	objectID, indexType := opIDToString(op), mapIndexType(config, op)
+	if len(sinks) > 0 {
+		emitSinkEvent(&sinkEvent{
+			Operation: "index",
+			Namespace: op.Namespace,
+			Index:     meta.indexOr(indexType.Index),
+			ID:        meta.idOr(objectID),
+			Timestamp: opTime(op),
+			Doc:       op.Data,
+			Changes:   redactChanges(op.Namespace, op.UpdateDescription),
+			position:  op.Timestamp,
+		})
+	}
+	if config.DisableElasticsearch && ndjsonOut == nil {
+		return
+	}
+	if config.EnablePatches {
+		if patchNamespaces[op.Namespace] {
+			if e := addPatch(config, client, op, objectID, indexType, meta); e != nil {
+				errorLog.Printf("Unable to save json-patch info: %s", e)
+			}
+		}
+	}
+	deleteRoutingChanges(config, mongo, client, bulk, op, objectID, meta.idOr(objectID),
+		routedCopy{Index: meta.indexOr(indexType.Index), Routing: meta.Routing})
+	ingestAttachment := false
+	if hasFileContent(op, config) {
+		ingestAttachment = op.Data["file"] != nil
+	}
+	if meta.Pipeline == "" && !ingestAttachment {
+		schemaDrift.observe(op.Namespace, meta.indexOr(indexType.Index), op.Data)
+	}
+	if config.IndexAsUpdate && meta.Pipeline == "" && ingestAttachment == false {
+		req := elastic.NewBulkUpdateRequest()
+		req.UseEasyJSON(config.EnableEasyJSON)
+		req.Id(objectID)
+		req.Index(indexType.Index)
+		req.Type(indexType.Type)
+		req.Doc(bulkDocument(config, op))
+		req.DocAsUpsert(true)
+		if ts := tombstones[op.Namespace]; ts != nil {
+			req.Doc(ts.revive(config, op))
+		}
+		if meta.ID != "" {
+			req.Id(meta.ID)
+		}
+		if meta.Index != "" {
+			req.Index(meta.Index)
+		}
+		if meta.Type != "" {
+			req.Type(meta.Type)
+		}
+		if meta.Routing != "" {
+			req.Routing(meta.Routing)
+		}
+		if meta.Parent != "" {
+			req.Parent(meta.Parent)
+		}
+		recordUpdateConflict(req, op, meta.RetryOnConflict)
+		if _, err = req.Source(); err == nil {
+			addBulkRequest(config, bulk, op, meta.indexOr(indexType.Index), req)
+			recordDocument(indexAction(op), op, meta.indexOr(indexType.Index))
+		}
+	} else {
+		req := elastic.NewBulkIndexRequest()
+		req.UseEasyJSON(config.EnableEasyJSON)
+		req.Id(objectID)
+		req.Index(indexType.Index)
+		req.Type(indexType.Type)
+		req.Doc(bulkDocument(config, op))
+		if meta.ID != "" {
+			req.Id(meta.ID)
+		}
+		if meta.Index != "" {
+			req.Index(meta.Index)
+		}
+		if meta.Type != "" {
+			req.Type(meta.Type)
+		}
+		if meta.Routing != "" {
+			req.Routing(meta.Routing)
+		}
+		if meta.Parent != "" {
+			req.Parent(meta.Parent)
+		}
+		if meta.Version != 0 {
+			req.Version(meta.Version)
+		}
+		if meta.VersionType != "" {
+			req.VersionType(meta.VersionType)
+		}
+		if meta.Pipeline != "" {
+			req.Pipeline(meta.Pipeline)
+		}
+		if meta.RetryOnConflict != 0 {
+			req.RetryOnConflict(meta.RetryOnConflict)
+		}
+		if ingestAttachment {
+			req.Pipeline("attachment")
+		}
+		if _, err = req.Source(); err == nil {
+			addBulkRequest(config, bulk, op, meta.indexOr(indexType.Index), req)
+			recordDocument(indexAction(op), op, meta.indexOr(indexType.Index))
+		}
+	}
+
+	if meta.shouldSave(config, op.Namespace) && !config.DryRun {
+		if e := setIndexMeta(mongo, op.Namespace, objectID, meta, config); e != nil {
+			errorLog.Printf("Unable to save routing info: %s", e)
+		}
+	}
+	deleteRoutings[op.Namespace].remember(objectID, routedCopy{Index: meta.indexOr(indexType.Index), Routing: meta.Routing})
+
+	if tmNamespaces[op.Namespace] {
+		if op.IsSourceOplog() || config.TimeMachineDirectReads {
+			t := time.Now().UTC()
+			tmIndex := func(idx string) string {
+				pre, suf := config.TimeMachineIndexPrefix, config.TimeMachineIndexSuffix
+				tmFormat := strings.Join([]string{pre, idx, t.Format(suf)}, ".")
+				return strings.ToLower(tmFormat)
+			}
+			data := make(map[string]interface{})
+			for k, v := range op.Data {
+				data[k] = v
+			}
+			data["_source_id"] = objectID
+			if config.IndexOplogTime == false {
+				secs := int64(op.Timestamp >> 32)
+				t := time.Unix(secs, 0).UTC()
+				data[config.OplogTsFieldName] = op.Timestamp
+				data[config.OplogDateFieldName] = t.Format(config.OplogDateFieldFormat)
+			}
+			req := elastic.NewBulkIndexRequest()
+			req.UseEasyJSON(config.EnableEasyJSON)
+			req.Index(tmIndex(indexType.Index))
+			req.Type(indexType.Type)
+			req.Routing(objectID)
+			req.Doc(data)
+			if meta.Index != "" {
+				req.Index(tmIndex(meta.Index))
+			}
+			if meta.Type != "" {
+				req.Type(meta.Type)
+			}
+			if meta.Pipeline != "" {
+				req.Pipeline(meta.Pipeline)
+			}
+			if ingestAttachment {
+				req.Pipeline("attachment")
+			}
+			if _, err = req.Source(); err == nil {
+				addBulkRequest(config, bulk, op, tmIndex(meta.indexOr(indexType.Index)), req)
+			}
+		}
+	}
+	return
+}
+
+func newSchemaDriftDetector(config *configOptions, client *elastic.Client) *schemaDriftDetector {
+	return &schemaDriftDetector{
+		client:   client,
+		config:   config,
+		indexes:  make(map[string]*observedSchema),
+		reported: make(map[string]bool),
+	}
+}
+
+// observe records the fields and types of a document as it is indexed
+func (d *schemaDriftDetector) observe(ns, index string, doc map[string]interface{}) {
+	if d == nil || doc == nil {
+		return
+	}
+	pattern := indexPattern(index)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	schema := d.indexes[pattern]
+	if schema == nil {
+		schema = &observedSchema{namespace: ns, fields: make(map[string]string)}
+		d.indexes[pattern] = schema
+	}
+	schema.observe("", doc)
+}
+
+func (s *observedSchema) observe(prefix string, doc map[string]interface{}) {
+	for k, v := range doc {
+		if k == "_id" || k == "_meta_monstache" {
+			continue
+		}
+		path := prefix + k
+		if sub, ok := v.(map[string]interface{}); ok {
+			if m := inferFieldMapping(sub); m != nil && m["properties"] != nil {
+				s.observe(path+".", sub)
+				continue
+			}
+		}
+		family := fieldFamily(inferFieldMapping(v))
+		if family == "" {
+			continue
+		}
+		if _, seen := s.fields[path]; !seen && len(s.fields) < schemaDriftMaxFields {
+			s.fields[path] = family
+		}
+	}
+}
+
+// fieldFamily groups mapping types whose values are interchangeable.  Types
+// outside the families are never reported as drift
+func fieldFamily(mapping map[string]interface{}) string {
+	if mapping == nil {
+		return ""
+	}
+	if mapping["properties"] != nil {
+		return "object"
+	}
+	switch mapping["type"] {
+	case "long", "integer", "short", "byte", "double", "float", "half_float", "scaled_float", "unsigned_long":
+		return "number"
+	case "boolean":
+		return "boolean"
+	case "date", "date_nanos":
+		return "date"
+	case "keyword", "text", "wildcard", "constant_keyword", "match_only_text", "search_as_you_type":
+		return "string"
+	case "geo_point", "geo_shape", "shape":
+		return "geo"
+	case "object", "nested":
+		return "object"
+	}
+	return ""
+}
+
+// compatibleFamilies returns true if values of the emitted family are indexed
+// as intended by a field of the mapped family.  Dates are sent as strings
+func compatibleFamilies(emitted, mapped string) bool {
+	if emitted == mapped || mapped == "" {
+		return true
+	}
+	return (emitted == "string" || emitted == "date") && (mapped == "string" || mapped == "date")
+}
+
+// mappedFields flattens the properties of a mapping into dotted paths and
+// their families
+func mappedFields(prefix string, props map[string]interface{}, fields map[string]string) {
+	for k, v := range props {
+		m := asMapping(v)
+		if m == nil {
+			continue
+		}
+		path := prefix + k
+		fields[path] = fieldFamily(m)
+		if sub := asMapping(m["properties"]); sub != nil {
+			mappedFields(path+".", sub, fields)
+		}
+	}
+}
+
+// mappingOf merges the field mappings of the indexes matching pattern.
+// Mappings with and without a type level are understood
+func (d *schemaDriftDetector) mappingOf(pattern string) (map[string]string, error) {
+	result, err := d.client.GetMapping().Index(pattern).Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]string)
+	for _, index := range result {
+		mappings := asMapping(asMapping(index)["mappings"])
+		if props := asMapping(mappings["properties"]); props != nil {
+			mappedFields("", props, fields)
+			continue
+		}
+		for _, typed := range mappings {
+			if props := asMapping(asMapping(typed)["properties"]); props != nil {
+				mappedFields("", props, fields)
+			}
+		}
+	}
+	return fields, nil
+}
+
+// fieldDrift is a field emitted differently from how it is mapped
+type fieldDrift struct {
+	Kind    string
+	Field   string
+	Emitted string
+	Mapped  string
+}
+
+// compareSchema returns the fields emitted without a mapping and those mapped
+// with an unexpected type, sorted by field
+func compareSchema(emitted, mapped map[string]string) (drifts []fieldDrift) {
+	for path, family := range emitted {
+		m, ok := mapped[path]
+		if !ok {
+			drifts = append(drifts, fieldDrift{Kind: "unmapped", Field: path, Emitted: family})
+		} else if !compatibleFamilies(family, m) {
+			drifts = append(drifts, fieldDrift{Kind: "type", Field: path, Emitted: family, Mapped: m})
+		}
+	}
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i].Field < drifts[j].Field })
+	return
+}
+
+// run compares the observed fields with the mappings every interval
+func (d *schemaDriftDetector) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.check()
+	}
+}
+
+// check reports the drift of each observed index.  A drift is reported once
+// until it is resolved
+func (d *schemaDriftDetector) check() {
+	d.lock.Lock()
+	observed := make(map[string]*observedSchema, len(d.indexes))
+	for pattern, schema := range d.indexes {
+		fields := make(map[string]string, len(schema.fields))
+		for k, v := range schema.fields {
+			fields[k] = v
+		}
+		observed[pattern] = &observedSchema{namespace: schema.namespace, fields: fields}
+	}
+	d.lock.Unlock()
+	for pattern, schema := range observed {
+		mapped, err := d.mappingOf(pattern)
+		if err != nil {
+			errorLog.Printf("Unable to get the mapping of %s to detect schema drift: %s", pattern, err)
+			continue
+		}
+		drifts := compareSchema(schema.fields, mapped)
+		counts := map[string]int{"unmapped": 0, "type": 0}
+		current := make(map[string]bool)
+		for _, drift := range drifts {
+			counts[drift.Kind]++
+			key := pattern + "/" + drift.Kind + "/" + drift.Field + "/" + drift.Mapped
+			current[key] = true
+			if d.reported[key] {
+				continue
+			}
+			d.reported[key] = true
+			var msg string
+			if drift.Kind == "unmapped" {
+				msg = fmt.Sprintf("Field %s of %s is emitted as %s but is not mapped in %s", drift.Field, schema.namespace, drift.Emitted, pattern)
+			} else {
+				msg = fmt.Sprintf("Field %s of %s is emitted as %s but is mapped as %s in %s", drift.Field, schema.namespace, drift.Emitted, drift.Mapped, pattern)
+			}
+			warnLog.Println(msg)
+			notifications.send(&notification{
+				Event:     notifySchemaDrift,
+				Status:    "firing",
+				Message:   msg,
+				Namespace: schema.namespace,
+			})
+		}
+		for key := range d.reported {
+			if strings.HasPrefix(key, pattern+"/") && !current[key] {
+				delete(d.reported, key)
+			}
+		}
+		for kind, n := range counts {
+			metrics.schemaDrift(pattern, kind, n)
+		}
+	}
+}
+
+func isPartialUpdate(config *configOptions, op *gtm.Op) bool {
+	ns := op.Namespace
+	if !(partialUpdateNamespaces[ns] || arrayUpdateNamespaces[ns]) || !op.IsUpdate() || !op.IsSourceOplog() {
+		return false
+	}
+	if mapperPlugin != nil || mapEnvs[""] != nil || mapEnvs[ns] != nil {
+		return false
+	}
+	if len(relates[ns]) > 0 || hasFileContent(op, config) {
+		return false
+	}
+	if patchNamespaces[ns] || tmNamespaces[ns] || routingNamespaces[""] || routingNamespaces[ns] {
+		return false
+	}
+	if versionFields[ns] != nil || reindexJobs[ns] != nil || namespacePipeline(ns) != nil || unwinds[ns] != nil || embeddings[ns] != nil || geoFields[ns] != nil {
+		return false
+	}
+	if documentSizes[ns] != nil || copyFields[ns] != nil || enrichments[ns] != nil || offloads[ns] != nil {
+		return false
+	}
+	if languageRoutings[ns] != nil {
+		// routed fields are nested under a language subfield
+		return false
+	}
+	if config.ContentHashField != "" {
+		return false
+	}
+	return true
+}
+
+// partialUpdateDoc expands the updatedFields of an update description into
+// a nested document suitable for an Elasticsearch doc merge.  ok is false
+// when the change cannot be expressed as a merge (removed fields, truncated
+// arrays or updates to array elements)
+func partialUpdateDoc(desc map[string]interface{}) (doc map[string]interface{}, ok bool) {
+	if desc == nil {
+		return
+	}
+	for _, key := range []string{"removedFields", "truncatedArrays"} {
+		switch v := desc[key].(type) {
+		case []string:
+			if len(v) > 0 {
+				return
+			}
+		case []interface{}:
+			if len(v) > 0 {
+				return
+			}
+		}
+	}
+	fields, _ := desc["updatedFields"].(map[string]interface{})
+	if len(fields) == 0 {
+		return
+	}
+	doc = make(map[string]interface{})
+	for path, val := range fields {
+		segs := strings.Split(path, ".")
+		node := doc
+		for i, seg := range segs {
+			if _, err := strconv.Atoi(seg); err == nil {
+				return nil, false
+			}
+			if i == len(segs)-1 {
+				if _, exists := node[seg]; exists {
+					return nil, false
+				}
+				node[seg] = val
+				break
+			}
+			switch child := node[seg].(type) {
+			case nil:
+				m := make(map[string]interface{})
+				node[seg] = m
+				node = m
+			case map[string]interface{}:
+				node = child
+			default:
+				return nil, false
+			}
+		}
+	}
+	return doc, true
+}
+
+func doPartialUpdate(config *configOptions, bulk *elastic.BulkProcessor, op *gtm.Op, doc map[string]interface{}) (err error) {
+	op.Data = doc
+	excludeFields(op)
+	if len(op.Data) == 0 || !coerceFields(op) {
+		return
+	}
+	if nf := numberFormats[op.Namespace]; nf != nil {
+		nf.format(op.Data)
+	}
+	if df := dateFormats[op.Namespace]; df != nil {
+		df.normalize(op.Data)
+	}
+	prepareDataForIndexing(config, op)
+	scanPII(op.Namespace, op.Data)
+	redactFields(op.Namespace, op.Data)
+	objectID, indexType := opIDToString(op), mapIndexType(config, op)
+	if len(sinks) > 0 {
+		emitSinkEvent(&sinkEvent{
+			Operation: "update",
+			Namespace: op.Namespace,
+			Index:     indexType.Index,
+			ID:        objectID,
+			Timestamp: opTime(op),
+			Doc:       op.Data,
+			Changes:   redactChanges(op.Namespace, op.UpdateDescription),
+			position:  op.Timestamp,
+		})
+	}
+	if config.DisableElasticsearch && ndjsonOut == nil {
+		return
+	}
+	req := elastic.NewBulkUpdateRequest()
+	req.UseEasyJSON(config.EnableEasyJSON)
+	req.Id(objectID)
+	req.Index(indexType.Index)
+	req.Type(indexType.Type)
+	req.Doc(bulkDocument(config, op))
+	req.DocAsUpsert(true)
+	recordUpdateConflict(req, op, 0)
+	if _, err = req.Source(); err == nil {
+		addBulkRequest(config, bulk, op, indexType.Index, req)
+		recordDocument("updated", op, indexType.Index)
+	}
+	return
+}
+
+// arrayUpdateSource applies the changes of an update description to the
+// source of a document.  Path segments address list elements by index
+// where the source holds a list.  Elements set past the end of a list are
+// appended, padding with nulls as MongoDB does
+const arrayUpdateSource = `
+for (def c : params.changes) {
+  def node = ctx._source;
+  int last = c.path.size() - 1;
+  for (int i = 0; i < last && node != null; i++) {
+    String seg = c.path[i];
+    def child = null;
+    if (node instanceof List) {
+      int idx = Integer.parseInt(seg);
+      if (idx < node.size()) { child = node.get(idx); }
+      if (child == null && c.op == 'set') {
+        child = new HashMap();
+        while (node.size() < idx) { node.add(null); }
+        if (idx < node.size()) { node.set(idx, child); } else { node.add(child); }
+      }
+    } else {
+      child = node.get(seg);
+      if (child == null && c.op == 'set') { child = new HashMap(); node.put(seg, child); }
+    }
+    node = child;
+  }
+  if (node == null) { continue; }
+  String key = c.path[last];
+  if (c.op == 'truncate') {
+    def arr = node instanceof List ? node.get(Integer.parseInt(key)) : node.get(key);
+    if (arr instanceof List) { while (arr.size() > c.length) { arr.remove(arr.size() - 1); } }
+  } else if (node instanceof List) {
+    int idx = Integer.parseInt(key);
+    if (c.op == 'unset') {
+      if (idx < node.size()) { node.set(idx, null); }
+    } else {
+      while (node.size() < idx) { node.add(null); }
+      if (idx < node.size()) { node.set(idx, c.value); } else { node.add(c.value); }
+    }
+  } else if (c.op == 'unset') {
+    node.remove(key);
+  } else {
+    node.put(key, c.value);
+  }
+}`
+
+// arrayUpdateChanges lists the changes of an update description in the
+// order MongoDB applies them: truncated arrays, removed fields and then
+// updated fields.  ok is false when the description has no changes or the
+// values would need transforming by field path
+func arrayUpdateChanges(ns string, desc map[string]interface{}) (changes []map[string]interface{}, ok bool) {
+	if desc == nil || hasPathTransforms(ns) {
+		return
+	}
+	truncated, _ := desc["truncatedArrays"].([]interface{})
+	for _, t := range truncated {
+		m, _ := t.(map[string]interface{})
+		field, _ := m["field"].(string)
+		size, isNum := geoNumber(m["newSize"])
+		if field == "" || !isNum {
+			return nil, false
+		}
+		changes = append(changes, map[string]interface{}{
+			"op":     "truncate",
+			"path":   strings.Split(field, "."),
+			"length": int(size),
+		})
+	}
+	var removed []string
+	switch v := desc["removedFields"].(type) {
+	case []string:
+		removed = v
+	case []interface{}:
+		for _, f := range v {
+			if field, isStr := f.(string); isStr {
+				removed = append(removed, field)
+			}
+		}
+	}
+	for _, field := range removed {
+		changes = append(changes, map[string]interface{}{
+			"op":   "unset",
+			"path": strings.Split(field, "."),
+		})
+	}
+	fields, _ := desc["updatedFields"].(map[string]interface{})
+	paths := make([]string, 0, len(fields))
+	for path := range fields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		changes = append(changes, map[string]interface{}{
+			"op":    "set",
+			"path":  strings.Split(path, "."),
+			"value": arrayUpdateValue(ns, fields[path]),
+		})
+	}
+	return changes, len(changes) > 0
+}
+
+// hasPathTransforms returns true if values of the namespace are excluded,
+// coerced, redacted or scanned by field path.  Paths into arrays by index
+// cannot be matched against these
+func hasPathTransforms(ns string) bool {
+	if len(fieldExclusions[ns]) > 0 || len(fieldExclusions[""]) > 0 || len(coercions[ns]) > 0 {
+		return true
+	}
+	if len(redactions[ns]) > 0 || len(piiScans[ns]) > 0 {
+		return true
+	}
+	return dateFormats[ns] != nil && len(dateFormats[ns].paths) > 0
+}
+
+// arrayUpdateValue formats a changed value as it would be in an indexed
+// document
+func arrayUpdateValue(ns string, val interface{}) interface{} {
+	if nf := numberFormats[ns]; nf != nil {
+		val = nf.format(val)
+	}
+	if df := dateFormats[ns]; df != nil {
+		val = df.format(val)
+	}
+	return monstachemap.ConvertMapForJSON(map[string]interface{}{"value": val})["value"]
+}
+
+// doArrayUpdate sends the changes of an update as a script so that a change
+// to a few elements of a large array does not resend the array or the
+// document.  Documents which cannot be updated in place, because they are
+// missing or their arrays differ from MongoDB, are reindexed from MongoDB
+func doArrayUpdate(config *configOptions, bulk *elastic.BulkProcessor, op *gtm.Op, changes []map[string]interface{}) (err error) {
+	objectID, indexType := opIDToString(op), mapIndexType(config, op)
+	if len(sinks) > 0 {
+		emitSinkEvent(&sinkEvent{
+			Operation: "update",
+			Namespace: op.Namespace,
+			Index:     indexType.Index,
+			ID:        objectID,
+			Timestamp: opTime(op),
+			Changes:   redactChanges(op.Namespace, op.UpdateDescription),
+			position:  op.Timestamp,
+		})
+	}
+	if config.DisableElasticsearch && ndjsonOut == nil {
+		return
+	}
+	req := elastic.NewBulkUpdateRequest()
+	req.UseEasyJSON(config.EnableEasyJSON)
+	req.Id(objectID)
+	req.Index(indexType.Index)
+	req.Type(indexType.Type)
+	req.Script(elastic.NewScript(arrayUpdateSource).Lang("painless").Param("changes", changes))
+	recordUpdateConflict(req, op, 0)
+	ns, id := op.Namespace, op.Id
+	onBulkItem(req, func(item *elastic.BulkResponseItem, err error) {
+		if err != nil || item == nil || item.Error == nil {
+			return
+		}
+		logWith(warnLog, opLogFields(op), "Reindexing document %v in %s after its update in place failed: %s", id, ns, item.Error.Reason)
+		select {
+		case updateConflictRefetchC <- &gtm.Op{
+			Id:        id,
+			Namespace: ns,
+			Operation: "u",
+			Source:    gtm.DirectQuerySource,
+			Timestamp: bson.MongoTimestamp(time.Now().Unix() << 32),
+		}:
+		default:
+			errorLog.Printf("Refetch queue is full. Dropping update of %v in %s.", id, ns)
+		}
+	})
+	if _, err = req.Source(); err == nil {
+		addBulkRequest(config, bulk, op, indexType.Index, req)
+		recordDocument("updated", op, indexType.Index)
+	}
+	return
+}
+
+// prepareDeltaUpdate makes an oplog update delivered as a delta ready for
+// routing.  Replacements already carry the full document.  Partial updates
+// are used as is unless a filter needs to see the full document, in which
+// case the document is fetched from MongoDB as gtm would have done
+func prepareDeltaUpdate(config *configOptions, mongo *mgo.Session, op *gtm.Op, filter gtm.OpFilter) (keep bool, err error) {
+	if len(op.UpdateDescription) == 0 {
+		replace := op.Data != nil
+		for k := range op.Data {
+			if strings.HasPrefix(k, "$") {
+				replace = false
+				break
+			}
+		}
+		if replace {
+			return filter == nil || filter(op), nil
+		}
+	} else if filter == nil && isPartialUpdate(config, op) {
+		if doc, ok := partialUpdateDoc(op.UpdateDescription); ok {
+			op.Data = doc
+			return true, nil
+		}
+		if arrayUpdateNamespaces[op.Namespace] {
+			if _, ok := arrayUpdateChanges(op.Namespace, op.UpdateDescription); ok {
+				// the script is built from the update description when indexed
+				op.Data = make(map[string]interface{})
+				return true, nil
+			}
+		}
+	}
+	session := mongo.Copy()
+	defer session.Close()
+	var doc map[string]interface{}
+	col := session.DB(op.GetDatabase()).C(op.GetCollection())
+	span := tracing.start(op, "document fetch")
+	err = col.FindId(op.Id).One(&doc)
+	span.finish(err)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			err = nil
+		}
+		return
+	}
+	op.Data = doc
+	return filter == nil || filter(op), nil
+}
+
+// elements splits a document into one document per element of the unwound
+// array.  The ids are the document id suffixed with the element key
+func (u *unwind) elements(op *gtm.Op) (ops []*gtm.Op) {
+	id := opIDToString(op)
+	arr, _ := op.Data[u.Field].([]interface{})
+	for i, elem := range arr {
+		key := strconv.Itoa(i)
+		if u.Key != "" {
+			m, _ := elem.(map[string]interface{})
+			val, ok := fieldValue(m, u.Key)
+			if !ok {
+				warnLog.Printf("Skipping element %d of %s in document %s: key %s not found", i, u.Field, id, u.Key)
+				continue
+			}
+			key = opIDToString(&gtm.Op{Id: val})
+		}
+		data := make(map[string]interface{}, len(op.Data)+1)
+		for k, v := range op.Data {
+			data[k] = v
+		}
+		data[u.Field] = elem
+		data[u.ParentField] = id
+		eop := *op
+		eop.Id = id + "_" + key
+		eop.Data = data
+		ops = append(ops, &eop)
+	}
+	return
+}
+
+// deleteElements removes the documents unwound from op except those in keep.
+// The elements are scrolled since an array may unwind to any number of them
+func (u *unwind) deleteElements(config *configOptions, client *elastic.Client, bulk *elastic.BulkProcessor, op *gtm.Op, keep map[string]bool) error {
+	indexType := mapIndexType(config, op)
+	query := elastic.NewTermQuery(u.ParentField, opIDToString(op))
+	scroll := client.Scroll(indexType.Index).Query(query).FetchSource(false).Size(1000)
+	defer scroll.Clear(context.Background())
+	for {
+		results, err := scroll.Do(context.Background())
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if elastic.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+		for _, hit := range results.Hits.Hits {
+			if keep[hit.Id] {
+				continue
+			}
+			req := elastic.NewBulkDeleteRequest().Index(hit.Index).Id(hit.Id)
+			if !config.useTypelessAPI() {
+				req.Type(hit.Type)
+			}
+			if config.IndexAsUpdate == false && versionFields[op.Namespace] == nil {
+				req.Version(int64(op.Timestamp))
+				req.VersionType("external")
+			}
+			addBulkRequest(config, bulk, op, hit.Index, req)
+		}
+	}
+}
+
+func indexDocument(config *configOptions, mongo *mgo.Session, bulk *elastic.BulkProcessor, client *elastic.Client, op *gtm.Op) (err error) {
+	u := unwinds[op.Namespace]
+	if u == nil {
+		return doIndexing(config, mongo, bulk, client, op)
+	}
+	keep := make(map[string]bool)
+	for _, eop := range u.elements(op) {
+		keep[eop.Id.(string)] = true
+		if err = doIndexing(config, mongo, bulk, client, eop); err != nil {
+			return
+		}
+	}
+	if op.IsSourceOplog() {
+		err = u.deleteElements(config, client, bulk, op, keep)
+	}
+	return
+}
+
+func deleteDocument(config *configOptions, client *elastic.Client, mongo *mgo.Session, bulk *elastic.BulkProcessor, op *gtm.Op) {
+	if docDumps.start(op) {
+		defer docDumps.finish(op)
+	}
+	u := unwinds[op.Namespace]
+	if u == nil {
+		doDelete(config, client, mongo, bulk, op)
+		return
+	}
+	if err := u.deleteElements(config, client, bulk, op, nil); err != nil {
+		logWith(errorLog, opLogFields(op), "Unable to delete unwound documents of %v: %s", op.Id, err)
+	}
+}
+
+func doIndex(config *configOptions, mongo *mgo.Session, bulk *elastic.BulkProcessor, client *elastic.Client, op *gtm.Op) (err error) {
+	// related documents are read after routing
+	csfle.apply(op)
+	if docDumps.start(op) {
+		defer docDumps.finish(op)
+		docDumps.dump(op, "before mapping", op.Data)
+		defer func() {
+			docDumps.dump(op, "after mapping", op.Data)
+		}()
+	}
+	if isPartialUpdate(config, op) {
+		if doc, ok := partialUpdateDoc(op.UpdateDescription); ok {
+			return doPartialUpdate(config, bulk, op, doc)
+		}
+		if arrayUpdateNamespaces[op.Namespace] {
+			if changes, ok := arrayUpdateChanges(op.Namespace, op.UpdateDescription); ok {
+				return doArrayUpdate(config, bulk, op, changes)
+			}
+		}
+	}
+	if sop := shadowCopy(op); sop != nil {
+		defer func() {
+			if err == nil {
+				indexShadow(config, mongo, bulk, op, sop)
+			}
+		}()
+	}
+	if err = mapData(mongo, config, op); err == nil {
+		rop := reindexCopy(op)
+		if op.Data != nil {
+			if rop != nil {
+				if err = indexDocument(config, mongo, bulk, client, rop); err != nil {
+					return
+				}
+			}
+			err = indexDocument(config, mongo, bulk, client, op)
+		} else if op.IsUpdate() {
+			deleteDocument(config, client, mongo, bulk, op)
+			if rop != nil {
+				deleteDocument(config, client, mongo, bulk, rop)
+			}
+		} else {
+			recordDocument("skipped", op, mapIndexType(config, op).Index)
+		}
+	}
+	return
+}
+
+func runProcessor(mongo *mgo.Session, bulk *elastic.BulkProcessor, client *elastic.Client, op *gtm.Op) (err error) {
+	session := mongo.Copy()
+	defer session.Close()
+	input := &monstachemap.ProcessPluginInput{
+		ElasticClient:        client,
+		ElasticBulkProcessor: bulk,
+		Timestamp:            op.Timestamp,
+	}
+	input.Document = op.Data
+	if op.IsDelete() {
+		input.Document = map[string]interface{}{
+			"_id": op.Id,
+		}
+	}
+	input.Namespace = op.Namespace
+	input.Database = op.GetDatabase()
+	input.Collection = op.GetCollection()
+	input.Operation = op.Operation
+	input.Session = session
+	input.UpdateDescription = op.UpdateDescription
+	input.Lookup = pluginLookups
+	if references != nil {
+		input.References = references
+	}
+	done := metrics.pluginTimer("process", op.Namespace)
+	err = callPlugin("process", op, func() error {
+		return processPlugin(input)
+	})
+	done()
+	return
+}
+
+func routeOp(config *configOptions, mongo *mgo.Session, bulk *elastic.BulkProcessor, client *elastic.Client, op *gtm.Op, out *outputChans) (err error) {
+	forwarded := false
+	defer func() {
+		// events handed to the index workers are finished there
+		if !forwarded {
+			tracing.finishEvent(op, err)
+			syncStatus.finishEvent(op, err)
+			checkpoints.finishEvent(op)
+			directReads.done(op)
+		}
+	}()
+	if config.useDeltaUpdates() && op.IsUpdate() && op.IsSourceOplog() {
+		var keep bool
+		if keep, err = prepareDeltaUpdate(config, mongo, op, out.filter); err != nil || !keep {
+			return
+		}
+	}
+	csfle.apply(op)
+	if processPlugin != nil {
+		rop := &gtm.Op{
+			Id:                op.Id,
+			Operation:         op.Operation,
+			Namespace:         op.Namespace,
+			Source:            op.Source,
+			Timestamp:         op.Timestamp,
+			UpdateDescription: op.UpdateDescription,
+		}
+		if op.Data != nil {
+			var data []byte
+			data, err = bson.Marshal(op.Data)
+			if err == nil {
+				var m map[string]interface{}
+				err = bson.Unmarshal(data, &m)
+				if err == nil {
+					rop.Data = m
+				}
+			}
+		}
+		out.processC <- rop
+	}
+	if op.IsDrop() {
+		flushBulks(bulk)
+		err = doDrop(mongo, client, op, config)
+	} else if op.IsDelete() {
+		if len(config.Relate) > 0 {
+			if rs := relates[op.Namespace]; len(rs) != 0 {
+				var delData map[string]interface{}
+				useFind := false
+				for _, r := range rs {
+					if r.SrcField != "_id" {
+						useFind = true
+						break
+					}
+				}
+				if useFind {
+					delData = findDeletedSrcDoc(config, client, op)
+				} else {
+					delData = map[string]interface{}{
+						"_id": op.Id,
+					}
+				}
+				if delData != nil {
+					rop := &gtm.Op{
+						Id:        op.Id,
+						Operation: op.Operation,
+						Namespace: op.Namespace,
+						Source:    op.Source,
+						Timestamp: op.Timestamp,
+						Data:      delData,
+					}
+					select {
+					case out.relateC <- rop:
+					default:
+						logWith(errorLog, opLogFields(rop), relateQueueOverloadMsg, rop.Namespace, rop.Id)
+					}
+				}
+			}
+		}
+		forwarded = true
+		out.indexC <- op
+	} else if op.Data != nil {
+		skip := false
+		if op.IsSourceOplog() && len(config.Relate) > 0 {
+			if rs := relates[op.Namespace]; len(rs) != 0 {
+				skip = true
+				for _, r := range rs {
+					if r.KeepSrc {
+						skip = false
+						break
+					}
+				}
+				if skip {
+					select {
+					case out.relateC <- op:
+					default:
+						logWith(errorLog, opLogFields(op), relateQueueOverloadMsg, op.Namespace, op.Id)
+					}
+				} else {
+					rop := &gtm.Op{
+						Id:                op.Id,
+						Operation:         op.Operation,
+						Namespace:         op.Namespace,
+						Source:            op.Source,
+						Timestamp:         op.Timestamp,
+						UpdateDescription: op.UpdateDescription,
+					}
+					var data []byte
+					data, err = bson.Marshal(op.Data)
+					if err == nil {
+						var m map[string]interface{}
+						err = bson.Unmarshal(data, &m)
+						if err == nil {
+							rop.Data = m
+						}
+					}
+					select {
+					case out.relateC <- rop:
+					default:
+						logWith(errorLog, opLogFields(rop), relateQueueOverloadMsg, rop.Namespace, rop.Id)
+					}
+				}
+			}
+		}
+		if !skip {
+			forwarded = true
+			if hasFileContent(op, config) {
+				out.fileC <- op
+			} else {
+				out.indexC <- op
+			}
+		}
+	}
+	return
+}
+
+func newCoalescer(config *configOptions, out func(*gtm.Op)) *coalescer {
+	c := &coalescer{
+		config:  config,
+		window:  time.Duration(config.CoalesceWindowMs) * time.Millisecond,
+		pending: make(map[string]*gtm.Op),
+		out:     out,
+	}
+	if len(config.CoalesceNamespaces) > 0 {
+		c.namespaces = make(map[string]bool)
+		for _, ns := range config.CoalesceNamespaces {
+			c.namespaces[ns] = true
+		}
+	}
+	return c
+}
+
+// coalescable returns true if only the latest state of the document in op
+// needs to be indexed.  Deletes, direct reads, partial updates and the
+// namespaces which keep a history of changes are never coalesced
+func (c *coalescer) coalescable(op *gtm.Op) bool {
+	if !(op.IsInsert() || op.IsUpdate()) || !op.IsSourceOplog() || op.Data == nil {
+		return false
+	}
+	if c.namespaces != nil && !c.namespaces[op.Namespace] {
+		return false
+	}
+	ns := op.Namespace
+	return !patchNamespaces[ns] && !tmNamespaces[ns] && !isPartialUpdate(c.config, op)
+}
+
+// add holds op for the coalesce window or replaces the op already held for
+// the document.  Other ops are passed on after any op held for the document
+// so that the order of changes to a document is kept
+func (c *coalescer) add(op *gtm.Op) {
+	key := fmt.Sprintf("%s.%v", op.Namespace, op.Id)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	prev := c.pending[key]
+	if !c.coalescable(op) {
+		if prev != nil {
+			delete(c.pending, key)
+			c.out(prev)
+		}
+		c.out(op)
+		return
+	}
+	c.pending[key] = op
+	if prev != nil {
+		atomic.AddInt64(&eventsCoalesced, 1)
+		tracing.finishEvent(prev, nil)
+		syncStatus.finishEvent(prev, nil)
+		checkpoints.finishEvent(prev)
+		return
+	}
+	time.AfterFunc(c.window, func() {
+		c.flush(key)
+	})
+}
+
+func (c *coalescer) flush(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if op := c.pending[key]; op != nil {
+		delete(c.pending, key)
+		c.out(op)
+	}
+}
+
+func (c *coalescer) flushAll() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, op := range c.pending {
+		delete(c.pending, key)
+		c.out(op)
+	}
+}
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+func isZstd(b []byte) bool {
+	return bytes.HasPrefix(b, zstdMagic)
+}
+
+// decompressDisk returns b decompressed if it was written compressed.  The
+// compression is detected so that data written before changing the disk
+// compression stays readable
+func decompressDisk(b []byte) ([]byte, error) {
+	if !isZstd(b) {
+		return b, nil
+	}
+	return zstdDecoder.DecodeAll(b, nil)
+}
+
+func newSpillQueue(dir string, budget int64, compress bool) (*spillQueue, error) {
+	file, err := ioutil.TempFile(dir, "monstache-spill-")
+	if err != nil {
+		return nil, err
+	}
+	// the spill file is unlinked right away so that it goes away with the
+	// process on platforms which allow removing open files
+	os.Remove(file.Name())
+	q := &spillQueue{budget: budget, file: file, compress: compress}
+	q.ready = sync.NewCond(&q.lock)
+	return q, nil
+}
+
+// push queues op.  If op does not fit into the memory budget its payload is
+// moved to the spill file and only the op itself is kept in memory so that
+// the order of events is kept
+func (q *spillQueue) push(op *gtm.Op) {
+	rec := spillRecord{
+		Data:              op.Data,
+		Doc:               op.Doc,
+		UpdateDescription: op.UpdateDescription,
+	}
+	data, err := bson.Marshal(&rec)
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	defer q.ready.Signal()
+	item := &spillItem{op: op, size: int64(len(data))}
+	if err != nil || q.used+item.size <= q.budget {
+		q.used += item.size
+		q.items = append(q.items, item)
+		return
+	}
+	if q.compress {
+		data = zstdEncoder.EncodeAll(data, nil)
+	}
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], uint32(len(data)))
+	if _, err = q.file.WriteAt(append(prefix[:], data...), q.writeOff); err != nil {
+		errorLog.Printf("Unable to spill event to %s: %s", q.file.Name(), err)
+		q.used += item.size
+		q.items = append(q.items, item)
+		return
+	}
+	if q.spilled == 0 {
+		infoLog.Printf("Memory budget for pending events exceeded, spilling events to %s", q.file.Name())
+	}
+	q.writeOff += int64(len(prefix) + len(data))
+	q.spilled++
+	item.spilled = true
+	op.Data, op.Doc, op.UpdateDescription = nil, nil, nil
+	q.items = append(q.items, item)
+}
+
+// pop blocks until an event is queued and returns it with its payload
+// restored.  It returns false once the queue is closed and drained
+func (q *spillQueue) pop() (*gtm.Op, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.ready.Wait()
+	}
+	if len(q.items) == 0 {
+		q.file.Close()
+		return nil, false
+	}
+	item := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	if !item.spilled {
+		q.used -= item.size
+		return item.op, true
+	}
+	if err := q.restore(item.op); err != nil {
+		errorLog.Printf("Unable to read spilled event %s.%v from %s: %s",
+			item.op.Namespace, item.op.Id, q.file.Name(), err)
+	}
+	q.spilled--
+	if q.spilled == 0 {
+		q.file.Truncate(0)
+		q.writeOff, q.readOff = 0, 0
+		infoLog.Println("Spilled events drained")
+	}
+	return item.op, true
+}
+
+func (q *spillQueue) restore(op *gtm.Op) error {
+	var prefix [4]byte
+	if _, err := q.file.ReadAt(prefix[:], q.readOff); err != nil {
+		return err
+	}
+	data := make([]byte, binary.BigEndian.Uint32(prefix[:]))
+	if _, err := q.file.ReadAt(data, q.readOff+int64(len(prefix))); err != nil {
+		return err
+	}
+	q.readOff += int64(len(prefix) + len(data))
+	data, err := decompressDisk(data)
+	if err != nil {
+		return err
+	}
+	var rec spillRecord
+	if err := bson.Unmarshal(data, &rec); err != nil {
+		return err
+	}
+	op.Data, op.Doc, op.UpdateDescription = rec.Data, rec.Doc, rec.UpdateDescription
+	return nil
+}
+
+func (q *spillQueue) len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items)
+}
+
+// close lets pop return false once the queued events are drained
+func (q *spillQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.ready.Broadcast()
+}
+
+// indexLane hashes the namespace and id of op so that the events of a
+// document are handled in order by the same index worker
+func indexLane(op *gtm.Op, lanes int) int {
+	h := fnv.New32a()
+	h.Write([]byte(op.Namespace))
+	fmt.Fprintf(h, "%v", op.Id)
+	return int(h.Sum32() % uint32(lanes))
+}
+
+// indexOp maps and indexes or deletes the document of an op taken from an
+// index lane
+func indexOp(config *configOptions, mongo *mgo.Session, bulk *elastic.BulkProcessor, client *elastic.Client, op *gtm.Op) error {
+	if op.IsDelete() {
+		deleteDocument(config, client, mongo, bulk, op)
+		if rop := reindexCopy(op); rop != nil {
+			deleteDocument(config, client, mongo, bulk, rop)
+		}
+		if si := shadowIndexes[op.Namespace]; si != nil && si.samples(op) {
+			si.delete(config, bulk, op)
+		}
+		return nil
+	}
+	return doIndex(config, mongo, bulk, client, op)
+}
+
+func processErr(err error, config *configOptions) {
+	mux.Lock()
+	defer mux.Unlock()
+	exitStatus = 1
+	logWith(errorLog, &logFields{ErrorClass: errorClass(err)}, "%s", err)
+	if config.FailFast {
+		os.Exit(exitStatus)
+	}
+}
+
+// processOpErr is processErr for a failure handling op
+func processOpErr(err error, config *configOptions, op *gtm.Op) {
+	mux.Lock()
+	defer mux.Unlock()
+	exitStatus = 1
+	fields := opLogFields(op)
+	fields.ErrorClass = errorClass(err)
+	logWith(errorLog, fields, "Unable to process document %v in %s: %s", op.Id, op.Namespace, err)
+	syncStatus.failed(op.Namespace, err.Error())
+	if config.FailFast {
+		os.Exit(exitStatus)
+	}
+}
+
+func doIndexStats(config *configOptions, bulkStats *elastic.BulkProcessor, stats elastic.BulkProcessorStats) (err error) {
+	var hostname string
+	doc := make(map[string]interface{})
+	t := time.Now().UTC()
+	doc["Timestamp"] = t.Format("2006-01-02T15:04:05")
+	hostname, err = os.Hostname()
+	if err == nil {
+		doc["Host"] = hostname
+	}
+	doc["Pid"] = os.Getpid()
+	doc["Stats"] = stats
+	doc["Namespaces"], doc["Indexes"] = docStats.snapshot()
+	index := strings.ToLower(t.Format(config.StatsIndexFormat))
+	typeName := "stats"
+	if config.useTypelessAPI() {
+		typeName = ""
+	} else if config.useTypeFromFuture() {
+		typeName = typeFromFuture
+	}
+	req := elastic.NewBulkIndexRequest().Index(index).Type(typeName)
+	req.UseEasyJSON(config.EnableEasyJSON)
+	req.Doc(doc)
+	bulkStats.Add(req)
+	return
+}
+
+func dropDBMeta(session *mgo.Session, db string, config *configOptions) (err error) {
+	if config.usesStatefulDeletes() {
+		col := session.DB(config.ConfigDatabaseName).C("meta")
+		q := bson.M{"db": db}
+		_, err = col.RemoveAll(q)
+	}
+	return
+}
+
+func dropCollectionMeta(session *mgo.Session, namespace string, config *configOptions) (err error) {
+	if config.deleteStrategyOf(namespace) == statefulDeleteStrategy {
+		col := session.DB(config.ConfigDatabaseName).C("meta")
+		q := bson.M{"namespace": namespace}
+		_, err = col.RemoveAll(q)
+	}
+	return
+}
+
+func (meta *indexingMeta) load(metaAttrs map[string]interface{}) {
+	var v interface{}
+	var ok bool
+	var s string
+	if _, ok = metaAttrs["skip"]; ok {
+		meta.Skip = true
+	}
+	if v, ok = metaAttrs["routing"]; ok {
+		meta.Routing = fmt.Sprintf("%v", v)
+	}
+	if v, ok = metaAttrs["index"]; ok {
+		meta.Index = fmt.Sprintf("%v", v)
+	}
+	if v, ok = metaAttrs["id"]; ok {
+		op := &gtm.Op{
+			Id: v,
+		}
+		meta.ID = opIDToString(op)
+	}
+	if v, ok = metaAttrs["type"]; ok {
+		meta.Type = fmt.Sprintf("%v", v)
+	}
+	if v, ok = metaAttrs["parent"]; ok {
+		meta.Parent = fmt.Sprintf("%v", v)
+	}
+	if v, ok = metaAttrs["version"]; ok {
+		s = fmt.Sprintf("%v", v)
+		if version, err := strconv.ParseInt(s, 10, 64); err == nil {
+			meta.Version = version
+		}
+	}
+	if v, ok = metaAttrs["versionType"]; ok {
+		meta.VersionType = fmt.Sprintf("%v", v)
+	}
+	if v, ok = metaAttrs["pipeline"]; ok {
+		meta.Pipeline = fmt.Sprintf("%v", v)
+	}
+	if v, ok = metaAttrs["retryOnConflict"]; ok {
+		s = fmt.Sprintf("%v", v)
+		if roc, err := strconv.Atoi(s); err == nil {
+			meta.RetryOnConflict = roc
+		}
+	}
+}
+
+func (meta *indexingMeta) idOr(id string) string {
+	if meta.ID != "" {
+		return meta.ID
+	}
+	return id
+}
+
+func (meta *indexingMeta) indexOr(index string) string {
+	if meta.Index != "" {
+		return meta.Index
+	}
+	return index
+}
+
+func (meta *indexingMeta) shouldSave(config *configOptions, ns string) bool {
+	if config.deleteStrategyOf(ns) == statefulDeleteStrategy {
+		return (meta.Routing != "" ||
+			meta.Index != "" ||
+			meta.Type != "" ||
+			meta.Parent != "" ||
+			meta.Pipeline != "")
+	}
+	return false
+}
+
+func setIndexMeta(session *mgo.Session, namespace, id string, meta *indexingMeta, config *configOptions) error {
+	col := session.DB(config.ConfigDatabaseName).C("meta")
+	metaID := fmt.Sprintf("%s.%s", namespace, id)
+	doc := make(map[string]interface{})
+	doc["id"] = meta.ID
+	doc["routing"] = meta.Routing
+	doc["index"] = meta.Index
+	doc["type"] = meta.Type
+	doc["parent"] = meta.Parent
+	doc["pipeline"] = meta.Pipeline
+	doc["db"] = strings.SplitN(namespace, ".", 2)[0]
+	doc["namespace"] = namespace
+	_, err := col.UpsertId(metaID, bson.M{"$set": doc})
+	return err
+}
+
+func getIndexMeta(session *mgo.Session, namespace, id string, config *configOptions) (meta *indexingMeta) {
+	if meta = peekIndexMeta(session, namespace, id, config); meta == nil {
+		meta = &indexingMeta{}
+	}
+	if !config.DryRun {
+		col := session.DB(config.ConfigDatabaseName).C("meta")
+		col.RemoveId(fmt.Sprintf("%s.%s", namespace, id))
+	}
+	return
+}
+
+// peekIndexMeta returns the saved indexing meta of a document without
+// removing it or nil if none was saved
+func peekIndexMeta(session *mgo.Session, namespace, id string, config *configOptions) (meta *indexingMeta) {
+	col := session.DB(config.ConfigDatabaseName).C("meta")
+	doc := make(map[string]interface{})
+	metaID := fmt.Sprintf("%s.%s", namespace, id)
+	if col.FindId(metaID).One(doc) != nil {
+		return nil
+	}
+	meta = &indexingMeta{}
+	if doc["id"] != nil {
+		meta.ID = doc["id"].(string)
+	}
+	if doc["routing"] != nil {
+		meta.Routing = doc["routing"].(string)
+	}
+	if doc["index"] != nil {
+		meta.Index = strings.ToLower(doc["index"].(string))
+	}
+	if doc["type"] != nil {
+		meta.Type = doc["type"].(string)
+	}
+	if doc["parent"] != nil {
+		meta.Parent = doc["parent"].(string)
+	}
+	if doc["pipeline"] != nil {
+		meta.Pipeline = doc["pipeline"].(string)
+	}
+	return
+}
+
+func loadBuiltinFunctions(s *mgo.Session, config *configOptions) {
+	for ns, env := range mapEnvs {
+		var fa *findConf
+		fa = &findConf{
+			session: s,
+			name:    "findId",
+			vm:      env.VM,
+			ns:      ns,
+			byId:    true,
+		}
+		if err := env.VM.Set(fa.name, makeFind(fa)); err != nil {
+			panic(err)
+		}
+		fa = &findConf{
+			session: s,
+			name:    "findOne",
+			vm:      env.VM,
+			ns:      ns,
+		}
+		if err := env.VM.Set(fa.name, makeFind(fa)); err != nil {
+			panic(err)
+		}
+		fa = &findConf{
+			session: s,
+			name:    "find",
+			vm:      env.VM,
+			ns:      ns,
+			multi:   true,
+		}
+		if err := env.VM.Set(fa.name, makeFind(fa)); err != nil {
+			panic(err)
+		}
+		fa = &findConf{
+			session:       s,
+			name:          "pipe",
+			vm:            env.VM,
+			ns:            ns,
+			multi:         true,
+			pipe:          true,
+			pipeAllowDisk: config.PipeAllowDisk,
+		}
+		if err := env.VM.Set(fa.name, makeFind(fa)); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func (fc *findCall) setDatabase(topts map[string]interface{}) (err error) {
+	if ov, ok := topts["database"]; ok {
+		if ovs, ok := ov.(string); ok {
+			fc.db = ovs
+		} else {
+			err = errors.New("Invalid database option value")
+		}
+	}
+	return
+}
+
+func (fc *findCall) setCollection(topts map[string]interface{}) (err error) {
+	if ov, ok := topts["collection"]; ok {
+		if ovs, ok := ov.(string); ok {
+			fc.col = ovs
+		} else {
+			err = errors.New("Invalid collection option value")
+		}
+	}
+	return
+}
+
+func (fc *findCall) setSelect(topts map[string]interface{}) (err error) {
+	if ov, ok := topts["select"]; ok {
+		if ovsel, ok := ov.(map[string]interface{}); ok {
+			for k, v := range ovsel {
+				if vi, ok := v.(int64); ok {
+					fc.sel[k] = int(vi)
+				}
 			}
+		} else {
+			err = errors.New("Invalid select option value")
 		}
-		if !funcDefined {
-			warnLog.Println("Plugin loaded but did not find a Map, Filter, Process or Pipeline function")
+	}
+	return
+}
+
+func (fc *findCall) setSort(topts map[string]interface{}) (err error) {
+	if ov, ok := topts["sort"]; ok {
+		if ovs, ok := ov.([]string); ok {
+			fc.sort = ovs
+		} else {
+			err = errors.New("Invalid sort option value")
 		}
 	}
-	return config
+	return
 }
 
-func (config *configOptions) decodeAsTemplate() *configOptions {
-	env := map[string]string{}
-	for _, e := range os.Environ() {
-		pair := strings.SplitN(e, "=", 2)
-		if len(pair) < 2 {
-			continue
+func (fc *findCall) setLimit(topts map[string]interface{}) (err error) {
+	if ov, ok := topts["limit"]; ok {
+		if ovl, ok := ov.(int64); ok {
+			fc.limit = int(ovl)
+		} else {
+			err = errors.New("Invalid limit option value")
 		}
-		name, val := pair[0], pair[1]
-		env[name] = val
 	}
-	tpl, err := ioutil.ReadFile(config.ConfigFile)
-	if err != nil {
-		panic(err)
+	return
+}
+
+func (fc *findCall) setQuery(v otto.Value) (err error) {
+	var q interface{}
+	if q, err = v.Export(); err == nil {
+		fc.query = fc.restoreIds(deepExportValue(q))
 	}
-	var t = template.Must(template.New("config").Parse(string(tpl)))
-	var b bytes.Buffer
-	err = t.Execute(&b, env)
-	if err != nil {
-		panic(err)
+	return
+}
+
+func (fc *findCall) setOptions(v otto.Value) (err error) {
+	var opts interface{}
+	if opts, err = v.Export(); err == nil {
+		switch topts := opts.(type) {
+		case map[string]interface{}:
+			if err = fc.setDatabase(topts); err != nil {
+				return
+			}
+			if err = fc.setCollection(topts); err != nil {
+				return
+			}
+			if err = fc.setSelect(topts); err != nil {
+				return
+			}
+			if fc.isMulti() {
+				if err = fc.setSort(topts); err != nil {
+					return
+				}
+				if err = fc.setLimit(topts); err != nil {
+					return
+				}
+			}
+		default:
+			err = errors.New("Invalid options argument")
+			return
+		}
+	} else {
+		err = errors.New("Invalid options argument")
 	}
-	if _, err := toml.Decode(b.String(), config); err != nil {
-		panic(err)
+	return
+}
+
+func (fc *findCall) setDefaults() {
+	if fc.config.ns != "" {
+		ns := strings.SplitN(fc.config.ns, ".", 2)
+		fc.db = ns[0]
+		fc.col = ns[1]
 	}
-	return config
 }
 
-func (config *configOptions) loadConfigFile() *configOptions {
-	if config.ConfigFile != "" {
-		var tomlConfig = configOptions{
-			ConfigFile:             config.ConfigFile,
-			DroppedDatabases:       true,
-			DroppedCollections:     true,
-			MongoValidatePemFile:   true,
-			ElasticValidatePemFile: true,
-			MongoDialSettings:      mongoDialSettings{Timeout: -1, ReadTimeout: -1, WriteTimeout: -1},
-			MongoSessionSettings:   mongoSessionSettings{SocketTimeout: -1, SyncTimeout: -1},
-			GtmSettings:            gtmDefaultSettings(),
-		}
-		if config.EnableTemplate {
-			tomlConfig.decodeAsTemplate()
+func (fc *findCall) getCollection() *mgo.Collection {
+	return fc.session.DB(fc.db).C(fc.col)
+}
+
+func (fc *findCall) getVM() *otto.Otto {
+	return fc.config.vm
+}
+
+func (fc *findCall) getFunctionName() string {
+	return fc.config.name
+}
+
+func (fc *findCall) isMulti() bool {
+	return fc.config.multi
+}
+
+func (fc *findCall) isPipe() bool {
+	return fc.config.pipe
+}
+
+func (fc *findCall) pipeAllowDisk() bool {
+	return fc.config.pipeAllowDisk
+}
+
+func (fc *findCall) logError(err error) {
+	errorLog.Printf("Error in function %s: %s\n", fc.getFunctionName(), err)
+}
+
+func (fc *findCall) restoreIds(v interface{}) (r interface{}) {
+	switch vt := v.(type) {
+	case string:
+		if bson.IsObjectIdHex(vt) {
+			r = bson.ObjectIdHex(vt)
 		} else {
-			if _, err := toml.DecodeFile(tomlConfig.ConfigFile, &tomlConfig); err != nil {
-				panic(err)
-			}
-		}
-		if config.MongoURL == "" {
-			config.MongoURL = tomlConfig.MongoURL
-		}
-		if config.MongoConfigURL == "" {
-			config.MongoConfigURL = tomlConfig.MongoConfigURL
-		}
-		if config.MongoPemFile == "" {
-			config.MongoPemFile = tomlConfig.MongoPemFile
-		}
-		if config.MongoValidatePemFile {
-			config.MongoValidatePemFile = tomlConfig.MongoValidatePemFile
-		}
-		if config.MongoOpLogDatabaseName == "" {
-			config.MongoOpLogDatabaseName = tomlConfig.MongoOpLogDatabaseName
-		}
-		if config.MongoOpLogCollectionName == "" {
-			config.MongoOpLogCollectionName = tomlConfig.MongoOpLogCollectionName
-		}
-		if config.ElasticUser == "" {
-			config.ElasticUser = tomlConfig.ElasticUser
-		}
-		if config.ElasticPassword == "" {
-			config.ElasticPassword = tomlConfig.ElasticPassword
-		}
-		if config.ElasticPemFile == "" {
-			config.ElasticPemFile = tomlConfig.ElasticPemFile
-		}
-		if config.ElasticValidatePemFile && !tomlConfig.ElasticValidatePemFile {
-			config.ElasticValidatePemFile = false
-		}
-		if config.ElasticVersion == "" {
-			config.ElasticVersion = tomlConfig.ElasticVersion
-		}
-		if config.ElasticMaxConns == 0 {
-			config.ElasticMaxConns = tomlConfig.ElasticMaxConns
-		}
-		if config.ElasticHealth0 == 0 {
-			config.ElasticHealth0 = tomlConfig.ElasticHealth0
-		}
-		if config.ElasticHealth1 == 0 {
-			config.ElasticHealth1 = tomlConfig.ElasticHealth1
-		}
-		if config.DirectReadSplitMax == 0 {
-			config.DirectReadSplitMax = tomlConfig.DirectReadSplitMax
-		}
-		if config.DirectReadConcur == 0 {
-			config.DirectReadConcur = tomlConfig.DirectReadConcur
-		}
-		if !config.DirectReadNoTimeout && tomlConfig.DirectReadNoTimeout {
-			config.DirectReadNoTimeout = true
-		}
-		if !config.ElasticRetry && tomlConfig.ElasticRetry {
-			config.ElasticRetry = true
-		}
-		if config.ElasticMaxDocs == 0 {
-			config.ElasticMaxDocs = tomlConfig.ElasticMaxDocs
-		}
-		if config.ElasticMaxBytes == 0 {
-			config.ElasticMaxBytes = tomlConfig.ElasticMaxBytes
-		}
-		if config.ElasticMaxSeconds == 0 {
-			config.ElasticMaxSeconds = tomlConfig.ElasticMaxSeconds
-		}
-		if config.ElasticClientTimeout == 0 {
-			config.ElasticClientTimeout = tomlConfig.ElasticClientTimeout
-		}
-		if config.MaxFileSize == 0 {
-			config.MaxFileSize = tomlConfig.MaxFileSize
-		}
-		if !config.IndexFiles {
-			config.IndexFiles = tomlConfig.IndexFiles
+			r = v
 		}
-		if config.FileDownloaders == 0 {
-			config.FileDownloaders = tomlConfig.FileDownloaders
+	case []map[string]interface{}:
+		var avs []interface{}
+		for _, av := range vt {
+			mvs := make(map[string]interface{})
+			for k, v := range av {
+				mvs[k] = fc.restoreIds(v)
+			}
+			avs = append(avs, mvs)
 		}
-		if config.RelateThreads == 0 {
-			config.RelateThreads = tomlConfig.RelateThreads
+		r = avs
+	case []interface{}:
+		var avs []interface{}
+		for _, av := range vt {
+			avs = append(avs, fc.restoreIds(av))
 		}
-		if config.RelateBuffer == 0 {
-			config.RelateBuffer = tomlConfig.RelateBuffer
+		r = avs
+	case map[string]interface{}:
+		mvs := make(map[string]interface{})
+		for k, v := range vt {
+			mvs[k] = fc.restoreIds(v)
 		}
-		if config.PostProcessors == 0 {
-			config.PostProcessors = tomlConfig.PostProcessors
+		r = mvs
+	default:
+		r = v
+	}
+	return
+}
+
+func (fc *findCall) execute() (r otto.Value, err error) {
+	var q *mgo.Query
+	col := fc.getCollection()
+	if fc.isMulti() {
+		if fc.isPipe() {
+			pipe := col.Pipe(fc.query)
+			if fc.pipeAllowDisk() {
+				pipe = pipe.AllowDiskUse()
+			}
+			var docs []map[string]interface{}
+			if err = pipe.All(&docs); err == nil {
+				var rdocs []map[string]interface{}
+				for _, doc := range docs {
+					rdocs = append(rdocs, convertMapJavascript(doc))
+				}
+				r, err = fc.getVM().ToValue(rdocs)
+			}
+		} else {
+			q = col.Find(fc.query)
+			if fc.limit > 0 {
+				q.Limit(fc.limit)
+			}
+			if len(fc.sort) > 0 {
+				q.Sort(fc.sort...)
+			}
+			if len(fc.sel) > 0 {
+				q.Select(fc.sel)
+			}
+			var docs []map[string]interface{}
+			if err = q.All(&docs); err == nil {
+				var rdocs []map[string]interface{}
+				for _, doc := range docs {
+					rdocs = append(rdocs, convertMapJavascript(doc))
+				}
+				r, err = fc.getVM().ToValue(rdocs)
+			}
 		}
-		if config.DeleteStrategy == 0 {
-			config.DeleteStrategy = tomlConfig.DeleteStrategy
+	} else {
+		if fc.config.byId {
+			q = col.FindId(fc.query)
+		} else {
+			q = col.Find(fc.query)
 		}
-		if config.DeleteIndexPattern == "" {
-			config.DeleteIndexPattern = tomlConfig.DeleteIndexPattern
+		if len(fc.sel) > 0 {
+			q.Select(fc.sel)
 		}
-		if config.DroppedDatabases && !tomlConfig.DroppedDatabases {
-			config.DroppedDatabases = false
+		doc := make(map[string]interface{})
+		if err = q.One(doc); err == nil {
+			rdoc := convertMapJavascript(doc)
+			r, err = fc.getVM().ToValue(rdoc)
 		}
-		if config.DroppedCollections && !tomlConfig.DroppedCollections {
-			config.DroppedCollections = false
+	}
+	return
+}
+
+func makeFind(fa *findConf) func(otto.FunctionCall) otto.Value {
+	return func(call otto.FunctionCall) (r otto.Value) {
+		var err error
+		fc := &findCall{
+			config:  fa,
+			session: fa.session.Copy(),
+			sel:     make(map[string]int),
 		}
-		if !config.Gzip && tomlConfig.Gzip {
-			config.Gzip = true
+		defer fc.session.Close()
+		fc.setDefaults()
+		args := call.ArgumentList
+		argLen := len(args)
+		r = otto.NullValue()
+		if argLen >= 1 {
+			if argLen >= 2 {
+				if err = fc.setOptions(call.Argument(1)); err != nil {
+					fc.logError(err)
+					return
+				}
+			}
+			if fc.db == "" || fc.col == "" {
+				fc.logError(errors.New("Find call must specify db and collection"))
+				return
+			}
+			if err = fc.setQuery(call.Argument(0)); err == nil {
+				var result otto.Value
+				if result, err = fc.execute(); err == nil {
+					r = result
+				} else if err != mgo.ErrNotFound {
+					fc.logError(err)
+				}
+			} else {
+				fc.logError(err)
+			}
+		} else {
+			fc.logError(errors.New("At least one argument is required"))
 		}
-		if !config.Verbose && tomlConfig.Verbose {
-			config.Verbose = true
+		return
+	}
+}
+
+func findDeletedSrcDoc(config *configOptions, client *elastic.Client, op *gtm.Op) map[string]interface{} {
+	objectID := opIDToString(op)
+	termQuery := elastic.NewTermQuery("_id", objectID)
+	search := client.Search()
+	searchResult, err := search.Size(1).Index(config.DeleteIndexPattern).Query(termQuery).Do(context.Background())
+	if err != nil {
+		errorLog.Printf("Unable to find deleted document %s: %s", objectID, err)
+		return nil
+	}
+	if searchResult.Hits == nil {
+		errorLog.Printf("Unable to find deleted document %s", objectID)
+		return nil
+	}
+	if searchResult.Hits.TotalHits == 0 {
+		errorLog.Printf("Found no hits for deleted document %s", objectID)
+		return nil
+	}
+	if searchResult.Hits.TotalHits > 1 {
+		errorLog.Printf("Found multiple hits for deleted document %s", objectID)
+		return nil
+	}
+	hit := searchResult.Hits.Hits[0]
+	if hit.Source == nil {
+		errorLog.Printf("Source unavailable for deleted document %s", objectID)
+		return nil
+	}
+	var src map[string]interface{}
+	if err = json.Unmarshal(*hit.Source, &src); err == nil {
+		src["_id"] = op.Id
+		return src
+	}
+	errorLog.Printf("Unable to unmarshal deleted document %s: %s", objectID, err)
+	return nil
+}
+
+func doDelete(config *configOptions, client *elastic.Client, mongo *mgo.Session, bulk *elastic.BulkProcessor, op *gtm.Op) {
+	strategy := config.deleteStrategyOf(op.Namespace)
+	if strategy == ignoreDeleteStrategy {
+		return
+	}
+	objectID, indexType, meta := opIDToString(op), mapIndexType(config, op), &indexingMeta{}
+	if len(sinks) > 0 {
+		emitSinkEvent(&sinkEvent{
+			Operation: "delete",
+			Namespace: op.Namespace,
+			Index:     indexType.Index,
+			ID:        objectID,
+			Timestamp: opTime(op),
+			position:  op.Timestamp,
+		})
+	}
+	if tombstones[op.Namespace] == nil {
+		config.OffloadStore.remove(op.Namespace, objectID)
+	}
+	if config.DisableElasticsearch && ndjsonOut == nil {
+		return
+	}
+	index, typ := indexType.Index, indexType.Type
+	routed := routingNamespaces[""] || routingNamespaces[op.Namespace] || deleteRoutings[op.Namespace] != nil
+	var ok bool
+	switch strategy {
+	case statefulDeleteStrategy:
+		if routed {
+			meta = getIndexMeta(mongo, op.Namespace, objectID, config)
 		}
-		if !config.Stats && tomlConfig.Stats {
-			config.Stats = true
+		if config.useTypelessAPI() {
+			meta.Type = ""
 		}
-		if !config.Pprof && tomlConfig.Pprof {
-			config.Pprof = true
+		if meta.Index != "" {
+			index = meta.Index
 		}
-		if !config.EnableEasyJSON && tomlConfig.EnableEasyJSON {
-			config.EnableEasyJSON = true
+		if meta.Type != "" {
+			typ = meta.Type
 		}
-		if !config.DisableChangeEvents && tomlConfig.DisableChangeEvents {
-			config.DisableChangeEvents = true
+	case statelessDeleteStrategy:
+		if routed {
+			if index, typ, meta, ok = searchDeleteRouting(config, client, objectID); !ok {
+				return
+			}
 		}
-		if !config.IndexStats && tomlConfig.IndexStats {
-			config.IndexStats = true
+	case cacheDeleteStrategy:
+		if c, cached := deleteRoutings[op.Namespace].take(objectID); cached {
+			index, meta.Routing = c.Index, c.Routing
+		} else if index, typ, meta, ok = searchDeleteRouting(config, client, objectID); !ok {
+			return
 		}
-		if config.StatsDuration == "" {
-			config.StatsDuration = tomlConfig.StatsDuration
+	case preImageDeleteStrategy:
+		var err error
+		var indexed bool
+		if index, meta, indexed, err = preImageDeleteRouting(config, mongo, op); err == nil && !indexed {
+			return
+		} else if err != nil {
+			logWith(warnLog, opLogFields(op), "Searching for deleted document %v in %s: %s", op.Id, op.Namespace, err)
+			if index, typ, meta, ok = searchDeleteRouting(config, client, objectID); !ok {
+				return
+			}
 		}
-		if config.StatsIndexFormat == "" {
-			config.StatsIndexFormat = tomlConfig.StatsIndexFormat
+	default:
+		return
+	}
+	if routingChanges != nil {
+		routingChanges.forget(op.Namespace + "." + objectID)
+	}
+	if ts := tombstones[op.Namespace]; ts != nil {
+		req := ts.request(config, op)
+		req.Id(objectID).Index(index).Type(typ)
+		if meta.Routing != "" {
+			req.Routing(meta.Routing)
 		}
-		if !config.IndexAsUpdate && tomlConfig.IndexAsUpdate {
-			config.IndexAsUpdate = true
+		if meta.Parent != "" {
+			req.Parent(meta.Parent)
 		}
-		if !config.FileHighlighting && tomlConfig.FileHighlighting {
-			config.FileHighlighting = true
+		addBulkRequest(config, bulk, op, index, req)
+	} else {
+		req := elastic.NewBulkDeleteRequest()
+		req.UseEasyJSON(config.EnableEasyJSON)
+		req.Id(objectID).Index(index).Type(typ)
+		if config.IndexAsUpdate == false && versionFields[op.Namespace] == nil {
+			req.Version(int64(op.Timestamp))
+			req.VersionType("external")
 		}
-		if !config.EnablePatches && tomlConfig.EnablePatches {
-			config.EnablePatches = true
+		if meta.Routing != "" {
+			req.Routing(meta.Routing)
 		}
-		if !config.PruneInvalidJSON && tomlConfig.PruneInvalidJSON {
-			config.PruneInvalidJSON = true
+		if meta.Parent != "" {
+			req.Parent(meta.Parent)
 		}
-		if !config.Debug && tomlConfig.Debug {
-			config.Debug = true
+		addBulkRequest(config, bulk, op, index, req)
+	}
+	recordDocument("deleted", op, index)
+	return
+}
+
+// deleteStrategyOf is the delete strategy of a namespace
+func (config *configOptions) deleteStrategyOf(ns string) deleteStrategy {
+	if dr := deleteRoutings[ns]; dr != nil {
+		return dr.strategy
+	}
+	return config.DeleteStrategy
+}
+
+// usesStatefulDeletes returns true if any namespace saves its routing in
+// MongoDB
+func (config *configOptions) usesStatefulDeletes() bool {
+	if config.DeleteStrategy == statefulDeleteStrategy {
+		return true
+	}
+	for _, dr := range deleteRoutings {
+		if dr.strategy == statefulDeleteStrategy {
+			return true
 		}
-		if !config.Replay && tomlConfig.Replay {
-			config.Replay = true
+	}
+	return false
+}
+
+// remember caches where a document was indexed for the cache strategy
+func (dr *deleteRouting) remember(id string, c routedCopy) {
+	if dr == nil || dr.cache == nil {
+		return
+	}
+	dr.cache.remember(id, c)
+}
+
+// take returns and forgets where a deleted document was indexed
+func (dr *deleteRouting) take(id string) (c routedCopy, ok bool) {
+	if dr == nil || dr.cache == nil {
+		return
+	}
+	if c, ok = dr.cache.lookup(id); ok {
+		dr.cache.forget(id)
+	}
+	return
+}
+
+// searchDeleteRouting finds the index and routing of a document by
+// searching the delete index pattern for its id.  ok is false unless
+// exactly one document is found
+func searchDeleteRouting(config *configOptions, client *elastic.Client, objectID string) (index, typ string, meta *indexingMeta, ok bool) {
+	meta = &indexingMeta{}
+	termQuery := elastic.NewTermQuery("_id", objectID)
+	searchResult, err := client.Search().FetchSource(false).Size(1).Index(config.DeleteIndexPattern).Query(termQuery).Do(context.Background())
+	if err != nil {
+		errorLog.Printf("Unable to delete document %s: %s", objectID, err)
+		return
+	}
+	if searchResult.Hits != nil && searchResult.Hits.TotalHits == 1 {
+		hit := searchResult.Hits.Hits[0]
+		index, typ = hit.Index, ""
+		if !config.useTypelessAPI() {
+			typ = hit.Type
 		}
-		if !config.Resume && tomlConfig.Resume {
-			config.Resume = true
+		meta.Routing, meta.Parent = hit.Routing, hit.Parent
+		return index, typ, meta, true
+	}
+	errorLog.Printf("Failed to find unique document %s for deletion using index pattern %s", objectID, config.DeleteIndexPattern)
+	return
+}
+
+// preImage reads a deleted document as it was before the delete from a
+// change stream opened at the time of the delete.  The collection must
+// record pre-images (MongoDB 6.0+ with changeStreamPreAndPostImages)
+func preImage(mongo *mgo.Session, op *gtm.Op) (doc map[string]interface{}, err error) {
+	session := mongo.Copy()
+	defer session.Close()
+	db, col := session.DB(op.GetDatabase()), op.GetCollection()
+	pipeline := []bson.M{
+		{"$changeStream": bson.M{"startAtOperationTime": op.Timestamp, "fullDocumentBeforeChange": "required"}},
+		{"$match": bson.M{"operationType": "delete", "documentKey._id": op.Id}},
+	}
+	var result struct {
+		Cursor struct {
+			ID         int64      `bson:"id"`
+			FirstBatch []bson.Raw `bson:"firstBatch"`
+			NextBatch  []bson.Raw `bson:"nextBatch"`
+		} `bson:"cursor"`
+	}
+	cmd := bson.D{{Name: "aggregate", Value: col}, {Name: "pipeline", Value: pipeline}, {Name: "cursor", Value: bson.M{}}}
+	if err = db.Run(cmd, &result); err != nil {
+		return
+	}
+	batch := result.Cursor.FirstBatch
+	for i := 0; len(batch) == 0 && result.Cursor.ID != 0 && i < preImageAttempts; i++ {
+		result.Cursor.NextBatch = nil
+		cmd = bson.D{{Name: "getMore", Value: result.Cursor.ID}, {Name: "collection", Value: col}, {Name: "maxTimeMS", Value: 1000}}
+		if err = db.Run(cmd, &result); err != nil {
+			return
 		}
-		if !config.ResumeWriteUnsafe && tomlConfig.ResumeWriteUnsafe {
-			config.ResumeWriteUnsafe = true
+		batch = result.Cursor.NextBatch
+	}
+	if result.Cursor.ID != 0 {
+		db.Run(bson.D{{Name: "killCursors", Value: col}, {Name: "cursors", Value: []int64{result.Cursor.ID}}}, nil)
+	}
+	if len(batch) == 0 {
+		return nil, fmt.Errorf("No delete of %v found in the change stream", op.Id)
+	}
+	var event struct {
+		Before map[string]interface{} `bson:"fullDocumentBeforeChange"`
+	}
+	if err = batch[0].Unmarshal(&event); err == nil && event.Before == nil {
+		err = fmt.Errorf("No pre-image of %v recorded", op.Id)
+	}
+	return event.Before, err
+}
+
+// preImageDeleteRouting maps the pre-image of a deleted document as it
+// would have been indexed to find its index and routing.  ok is false if
+// the document was not indexed
+func preImageDeleteRouting(config *configOptions, mongo *mgo.Session, op *gtm.Op) (index string, meta *indexingMeta, ok bool, err error) {
+	doc, err := preImage(mongo, op)
+	if err != nil {
+		return
+	}
+	pop := &gtm.Op{
+		Id:        op.Id,
+		Operation: "i",
+		Namespace: op.Namespace,
+		Source:    op.Source,
+		Timestamp: op.Timestamp,
+		Data:      doc,
+	}
+	if err = mapData(mongo, config, pop); err != nil || pop.Data == nil {
+		return
+	}
+	meta = parseIndexMeta(pop)
+	if meta.Skip {
+		return
+	}
+	return meta.indexOr(mapIndexType(config, pop).Index), meta, true, nil
+}
+
+// request marks a document deleted in place of deleting it
+func (ts *tombstone) request(config *configOptions, op *gtm.Op) *elastic.BulkUpdateRequest {
+	req := elastic.NewBulkUpdateRequest()
+	req.UseEasyJSON(config.EnableEasyJSON)
+	req.Doc(map[string]interface{}{
+		ts.Field:          true,
+		ts.DeletedAtField: opTime(op),
+	})
+	req.RetryOnConflict(3)
+	return req
+}
+
+// revive clears the tombstone of a document indexed again.  Only updates
+// need it since an index request replaces the whole document
+func (ts *tombstone) revive(config *configOptions, op *gtm.Op) interface{} {
+	data := make(map[string]interface{}, len(op.Data)+2)
+	for k, v := range op.Data {
+		data[k] = v
+	}
+	data[ts.Field] = false
+	data[ts.DeletedAtField] = nil
+	revived := *op
+	revived.Data = data
+	return bulkDocument(config, &revived)
+}
+
+// liveDocuments matches the documents of a namespace which are not
+// tombstones
+func liveDocuments(ns string) elastic.Query {
+	if ts := tombstones[ns]; ts != nil {
+		return elastic.NewBoolQuery().MustNot(elastic.NewTermQuery(ts.Field, true))
+	}
+	return elastic.NewMatchAllQuery()
+}
+
+// purgeTombstones deletes the tombstones kept longer than their retention
+// every interval
+func purgeTombstones(config *configOptions, client *elastic.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for ns, ts := range tombstones {
+			if ts.retention == 0 {
+				continue
+			}
+			index := indexPattern(mapIndexType(config, &gtm.Op{Namespace: ns}).Index)
+			purged, err := client.DeleteByQuery(index).
+				Query(ts.expired(time.Now())).
+				ProceedOnVersionConflict().
+				Do(context.Background())
+			if err != nil {
+				if !elastic.IsNotFound(err) {
+					errorLog.Printf("Unable to purge tombstones of index %s: %s", index, err)
+				}
+				continue
+			}
+			if purged.Deleted > 0 {
+				infoLog.Printf("Purged %d tombstones of %s from index %s", purged.Deleted, ns, index)
+			}
 		}
-		if config.ResumeFromTimestamp == 0 {
-			config.ResumeFromTimestamp = tomlConfig.ResumeFromTimestamp
+	}
+}
+
+// expired matches the tombstones deleted before the retention period
+func (ts *tombstone) expired(now time.Time) elastic.Query {
+	return elastic.NewBoolQuery().Filter(
+		elastic.NewTermQuery(ts.Field, true),
+		elastic.NewRangeQuery(ts.DeletedAtField).Lt(now.Add(-ts.retention).UTC().Format(time.RFC3339)),
+	)
+}
+
+func newRoutingTracker(config *configOptions) *routingTracker {
+	return &routingTracker{
+		size:  config.RoutingCacheSize,
+		cache: make(map[string]routedCopy),
+	}
+}
+
+func (t *routingTracker) lookup(key string) (c routedCopy, ok bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	c, ok = t.cache[key]
+	return
+}
+
+// remember caches where a document was indexed.  The oldest entry is
+// evicted once the cache is full
+func (t *routingTracker) remember(key string, c routedCopy) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.cache[key]; !ok {
+		if len(t.keys) < t.size {
+			t.keys = append(t.keys, key)
+		} else {
+			delete(t.cache, t.keys[t.next])
+			t.keys[t.next] = key
+			t.next = (t.next + 1) % t.size
 		}
-		if config.MergePatchAttr == "" {
-			config.MergePatchAttr = tomlConfig.MergePatchAttr
+	}
+	t.cache[key] = c
+}
+
+func (t *routingTracker) forget(key string) {
+	t.lock.Lock()
+	delete(t.cache, key)
+	t.lock.Unlock()
+}
+
+// previous returns the copies of a document indexed before.  The cache is
+// consulted first, then the routing saved by the stateful delete strategy
+// and, for updates, Elasticsearch
+func (t *routingTracker) previous(config *configOptions, mongo *mgo.Session, client *elastic.Client, op *gtm.Op, key, objectID, id string) ([]routedCopy, error) {
+	if c, ok := t.lookup(key); ok {
+		return []routedCopy{c}, nil
+	}
+	if config.deleteStrategyOf(op.Namespace) == statefulDeleteStrategy {
+		if meta := peekIndexMeta(mongo, op.Namespace, objectID, config); meta != nil {
+			index := meta.Index
+			if index == "" {
+				index = mapIndexType(config, op).Index
+			}
+			return []routedCopy{{Index: index, Routing: meta.Routing}}, nil
 		}
-		if !config.FailFast && tomlConfig.FailFast {
-			config.FailFast = true
+		return nil, nil
+	}
+	if !op.IsUpdate() {
+		return nil, nil
+	}
+	termQuery := elastic.NewTermQuery("_id", id)
+	result, err := client.Search().FetchSource(false).Size(10).Index(config.DeleteIndexPattern).Query(termQuery).Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	var copies []routedCopy
+	for _, hit := range result.Hits.Hits {
+		copies = append(copies, routedCopy{Index: hit.Index, Routing: hit.Routing})
+	}
+	return copies, nil
+}
+
+// deleteRoutingChanges deletes the copies of a document left under another
+// routing or index when its routing changed
+func deleteRoutingChanges(config *configOptions, mongo *mgo.Session, client *elastic.Client, bulk *elastic.BulkProcessor, op *gtm.Op, objectID, id string, current routedCopy) {
+	if routingChanges == nil || !(routingNamespaces[""] || routingNamespaces[op.Namespace]) {
+		return
+	}
+	key := op.Namespace + "." + id
+	copies, err := routingChanges.previous(config, mongo, client, op, key, objectID, id)
+	if err != nil {
+		errorLog.Printf("Unable to find the previous routing of %s in %s: %s", id, op.Namespace, err)
+	}
+	for _, c := range copies {
+		if c.Routing == current.Routing {
+			continue
 		}
-		if !config.IndexOplogTime && tomlConfig.IndexOplogTime {
-			config.IndexOplogTime = true
+		req := elastic.NewBulkDeleteRequest()
+		req.UseEasyJSON(config.EnableEasyJSON)
+		req.Index(c.Index)
+		req.Id(id)
+		if !config.useTypelessAPI() {
+			req.Type(mapIndexType(config, op).Type)
 		}
-		if config.OplogTsFieldName == "" {
-			config.OplogTsFieldName = tomlConfig.OplogTsFieldName
+		if c.Routing != "" {
+			req.Routing(c.Routing)
 		}
-		if config.OplogDateFieldName == "" {
-			config.OplogDateFieldName = tomlConfig.OplogDateFieldName
+		if config.IndexAsUpdate == false && versionFields[op.Namespace] == nil {
+			req.Version(int64(op.Timestamp))
+			req.VersionType("external")
 		}
-		if config.OplogDateFieldFormat == "" {
-			config.OplogDateFieldFormat = tomlConfig.OplogDateFieldFormat
+		infoLog.Printf("Deleting copy of %s in %s routed to %q after its routing changed to %q", id, c.Index, c.Routing, current.Routing)
+		addBulkRequest(config, bulk, op, c.Index, req)
+	}
+	routingChanges.remember(key, current)
+}
+
+// cursorFor is the cursor settings of a namespace.  Settings which are not
+// set for the namespace fall back to the global settings
+func (config *configOptions) cursorFor(ns string) namespaceCursor {
+	cursor := namespaceCursor{
+		Namespace:    ns,
+		BatchSize:    config.GtmSettings.ChangeStreamBatchSize,
+		MaxAwaitSecs: config.GtmSettings.MaxAwaitSecs,
+		NoTimeout:    config.DirectReadNoTimeout,
+	}
+	for _, c := range config.NamespaceCursors {
+		if c.Namespace != ns {
+			continue
 		}
-		if config.ConfigDatabaseName == "" {
-			config.ConfigDatabaseName = tomlConfig.ConfigDatabaseName
+		if c.BatchSize > 0 {
+			cursor.BatchSize = c.BatchSize
 		}
-		if !config.ExitAfterDirectReads && tomlConfig.ExitAfterDirectReads {
-			config.ExitAfterDirectReads = true
+		if c.MaxAwaitSecs > 0 {
+			cursor.MaxAwaitSecs = c.MaxAwaitSecs
 		}
-		if config.ResumeName == "" {
-			config.ResumeName = tomlConfig.ResumeName
+		if c.NoTimeout {
+			cursor.NoTimeout = true
 		}
-		if config.ClusterName == "" {
-			config.ClusterName = tomlConfig.ClusterName
+	}
+	return cursor
+}
+
+// cursorOptions splits the change streams and direct reads of opts by
+// namespace cursor.  gtm opens every cursor of a context with the same
+// settings, so each namespace with its own cursor settings is given
+// options for a context of its own.  The first options hold the remaining
+// namespaces
+func (config *configOptions) cursorOptions(opts *gtm.Options) (split []*gtm.Options, cursors []namespaceCursor) {
+	main := *opts
+	main.ChangeStreamNs, main.DirectReadNs = nil, nil
+	split = append(split, &main)
+	cursors = append(cursors, namespaceCursor{
+		BatchSize:    config.GtmSettings.ChangeStreamBatchSize,
+		MaxAwaitSecs: config.GtmSettings.MaxAwaitSecs,
+		NoTimeout:    config.DirectReadNoTimeout,
+	})
+	own := make(map[string]*gtm.Options)
+	for _, c := range config.NamespaceCursors {
+		if own[c.Namespace] != nil {
+			continue
 		}
-		if config.NsRegex == "" {
-			config.NsRegex = tomlConfig.NsRegex
+		o := *opts
+		// the oplog is tailed by the first context only
+		o.OpLogDisabled = true
+		o.ChangeStreamNs, o.DirectReadNs = nil, nil
+		cursor := config.cursorFor(c.Namespace)
+		o.MaxWaitSecs = cursor.MaxAwaitSecs
+		o.DirectReadNoTimeout = cursor.NoTimeout
+		own[c.Namespace] = &o
+		split = append(split, &o)
+		cursors = append(cursors, cursor)
+	}
+	for _, ns := range opts.ChangeStreamNs {
+		if o := own[ns]; o != nil {
+			o.ChangeStreamNs = append(o.ChangeStreamNs, ns)
+		} else {
+			main.ChangeStreamNs = append(main.ChangeStreamNs, ns)
 		}
-		if config.NsDropRegex == "" {
-			config.NsDropRegex = tomlConfig.NsDropRegex
+	}
+	for _, ns := range opts.DirectReadNs {
+		if o := own[ns]; o != nil {
+			o.DirectReadNs = append(o.DirectReadNs, ns)
+		} else {
+			main.DirectReadNs = append(main.DirectReadNs, ns)
 		}
-		if config.NsExcludeRegex == "" {
-			config.NsExcludeRegex = tomlConfig.NsExcludeRegex
+	}
+	// namespaces with cursor settings which are neither watched nor read
+	// do not need a context
+	n := 1
+	for i := 1; i < len(split); i++ {
+		if len(split[i].ChangeStreamNs) > 0 || len(split[i].DirectReadNs) > 0 {
+			split[n], cursors[n] = split[i], cursors[i]
+			n++
 		}
-		if config.NsDropExcludeRegex == "" {
-			config.NsDropExcludeRegex = tomlConfig.NsDropExcludeRegex
+	}
+	return split[:n], cursors[:n]
+}
+
+func gtmDefaultSettings() gtmSettings {
+	return gtmSettings{
+		ChannelSize:    gtmChannelSizeDefault,
+		BufferSize:     32,
+		BufferDuration: "75ms",
+	}
+}
+
+func notifySdFailed(config *configOptions, err error) {
+	if err != nil {
+		errorLog.Printf("Systemd notification failed: %s", err)
+	} else {
+		if verbose() {
+			warnLog.Println("Systemd notification not supported (i.e. NOTIFY_SOCKET is unset)")
 		}
-		if config.IndexFiles {
-			if len(config.FileNamespaces) == 0 {
-				config.FileNamespaces = tomlConfig.FileNamespaces
-				config.loadGridFsConfig()
-			}
+	}
+}
+
+func watchdogSdFailed(config *configOptions, err error) {
+	if err != nil {
+		errorLog.Printf("Error determining systemd WATCHDOG interval: %s", err)
+	} else {
+		if verbose() {
+			warnLog.Println("Systemd WATCHDOG not enabled")
 		}
-		if config.Worker == "" {
-			config.Worker = tomlConfig.Worker
+	}
+}
+
+func (ctx *httpServerCtx) serveHttp() {
+	s := ctx.httpServer
+	if verbose() {
+		infoLog.Printf("Starting http server at %s", s.Addr)
+	}
+	ctx.started = time.Now()
+	var err error
+	if ctx.config.HTTPServerTLSCert != "" {
+		err = s.ListenAndServeTLS(ctx.config.HTTPServerTLSCert, ctx.config.HTTPServerTLSKey)
+	} else {
+		err = s.ListenAndServe()
+	}
+	if !ctx.shutdown {
+		panic(fmt.Sprintf("Unable to serve http at address %s: %s", s.Addr, err))
+	}
+}
+
+func newConfigReloader(config *configOptions) (*configReloader, error) {
+	// reloaded options go to a copy since the config is read without a lock
+	live := *config
+	cr := &configReloader{config: config, live: &live}
+	if config.ConfigFile != "" || config.central != nil {
+		var err error
+		if cr.file, err = config.readConfigFile(); err != nil {
+			return nil, err
 		}
-		if config.GraylogAddr == "" {
-			config.GraylogAddr = tomlConfig.GraylogAddr
+	}
+	return cr, nil
+}
+
+// configOptionName is the name of an option in the config file
+func configOptionName(field reflect.StructField) string {
+	if tag := strings.Split(field.Tag.Get("toml"), ",")[0]; tag != "" {
+		return tag
+	}
+	return field.Name
+}
+
+// changedOptions lists the options which differ between two config files
+func changedOptions(before, after *configOptions) (names []string) {
+	bv, av := reflect.ValueOf(before).Elem(), reflect.ValueOf(after).Elem()
+	t := bv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
 		}
-		if config.MapperPluginPath == "" {
-			config.MapperPluginPath = tomlConfig.MapperPluginPath
+		if !reflect.DeepEqual(bv.Field(i).Interface(), av.Field(i).Interface()) {
+			names = append(names, configOptionName(field))
 		}
-		if config.EnablePatches {
-			if len(config.PatchNamespaces) == 0 {
-				config.PatchNamespaces = tomlConfig.PatchNamespaces
-				config.loadPatchNamespaces()
+	}
+	return
+}
+
+// reload re-reads the config file and applies the changes which are safe
+// to make while running
+func (cr *configReloader) reload() (result *configReload) {
+	result = &configReload{}
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if cr.config.ConfigFile == "" && cr.config.central == nil {
+		result.Error = "No config file to reload"
+		return
+	}
+	file, err := cr.config.readConfigFile()
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	next := *cr.live
+	var throttled, rated bool
+	for _, name := range changedOptions(cr.file, file) {
+		switch name {
+		case "namespace-regex":
+			next.NsRegex = file.NsRegex
+		case "namespace-drop-regex":
+			next.NsDropRegex = file.NsDropRegex
+		case "namespace-exclude-regex":
+			next.NsExcludeRegex = file.NsExcludeRegex
+		case "namespace-drop-exclude-regex":
+			next.NsDropExcludeRegex = file.NsDropExcludeRegex
+		case "Verbose":
+			next.Verbose = file.Verbose
+		case "Debug":
+			next.Debug = file.Debug
+		case "elasticsearch-max-conns":
+			next.ElasticMaxConns = reloadedInt(file.ElasticMaxConns, cr.config.ElasticMaxConns)
+			throttled = true
+		case "elasticsearch-max-docs":
+			next.ElasticMaxDocs = reloadedInt(file.ElasticMaxDocs, cr.config.ElasticMaxDocs)
+			throttled = true
+		case "elasticsearch-max-bytes":
+			next.ElasticMaxBytes = reloadedInt(file.ElasticMaxBytes, cr.config.ElasticMaxBytes)
+			throttled = true
+		case "elasticsearch-max-seconds":
+			next.ElasticMaxSeconds = reloadedInt(file.ElasticMaxSeconds, cr.config.ElasticMaxSeconds)
+			throttled = true
+		case "direct-read-rate":
+			if directReads == nil || file.DirectReadRate < 0 {
+				// there is no rate limiter without a rate at startup
+				result.Restart = append(result.Restart, name)
+				continue
 			}
+			next.DirectReadRate = file.DirectReadRate
+			rated = true
+		default:
+			result.Restart = append(result.Restart, name)
+			continue
 		}
-		if len(config.RoutingNamespaces) == 0 {
-			config.RoutingNamespaces = tomlConfig.RoutingNamespaces
-			config.loadRoutingNamespaces()
-		}
-		if len(config.TimeMachineNamespaces) == 0 {
-			config.TimeMachineNamespaces = tomlConfig.TimeMachineNamespaces
-			config.loadTimeMachineNamespaces()
-		}
-		if config.TimeMachineIndexPrefix == "" {
-			config.TimeMachineIndexPrefix = tomlConfig.TimeMachineIndexPrefix
-		}
-		if config.TimeMachineIndexSuffix == "" {
-			config.TimeMachineIndexSuffix = tomlConfig.TimeMachineIndexSuffix
+		result.Applied = append(result.Applied, name)
+	}
+	if err = nsFilter.set(&next); err != nil {
+		result.Error = err.Error()
+		result.Applied, result.Restart = nil, nil
+		return
+	}
+	if throttled {
+		restart := throttle.set(indexBulk{
+			Workers:    next.ElasticMaxConns,
+			MaxDocs:    next.ElasticMaxDocs,
+			MaxBytes:   next.ElasticMaxBytes,
+			MaxSeconds: next.ElasticMaxSeconds,
+		})
+		for _, name := range restart {
+			for i, applied := range result.Applied {
+				if applied == name {
+					result.Applied = append(result.Applied[:i], result.Applied[i+1:]...)
+					break
+				}
+			}
+			result.Restart = append(result.Restart, name)
 		}
-		if !config.TimeMachineDirectReads {
-			config.TimeMachineDirectReads = tomlConfig.TimeMachineDirectReads
+	}
+	if rated {
+		directReads.setRate(next.DirectReadRate)
+	}
+	setVerbose(next.Verbose)
+	cr.setDebug(next.Debug)
+	cr.live = &next
+	cr.file = file
+	return
+}
+
+// reloadedInt is the value of a numeric option in the reloaded config
+// file or the value at startup if the option was removed
+func reloadedInt(value, startup int) int {
+	if value == 0 {
+		return startup
+	}
+	return value
+}
+
+func (cr *configReloader) setDebug(debug bool) {
+	if cr.live.Debug != debug {
+		cr.live.Debug = debug
+		mgo.SetDebug(debug)
+		mgo.SetLogger(traceLog)
+	}
+}
+
+func (cr *configReloader) logLevel() *logLevel {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	on, debug := verbose(), cr.live.Debug
+	return &logLevel{Verbose: &on, Debug: &debug}
+}
+
+// options is a copy of the config with the options applied by reloads
+func (cr *configReloader) options() *configOptions {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	live := *cr.live
+	live.Verbose = verbose()
+	return &live
+}
+
+// setLogLevel changes the verbosity of the logs until the next restart or
+// config reload
+func (cr *configReloader) setLogLevel(level *logLevel) *logLevel {
+	cr.lock.Lock()
+	if level.Verbose != nil {
+		setVerbose(*level.Verbose)
+	}
+	if level.Debug != nil {
+		cr.setDebug(*level.Debug)
+	}
+	cr.lock.Unlock()
+	level = cr.logLevel()
+	infoLog.Printf("Log level changed to verbose %t and debug %t", *level.Verbose, *level.Debug)
+	return level
+}
+
+func (cr *configReloader) reloadAndLog() *configReload {
+	result := cr.reload()
+	if result.Error != "" {
+		errorLog.Printf("Unable to reload config file: %s", result.Error)
+	} else if len(result.Applied) == 0 && len(result.Restart) == 0 {
+		infoLog.Println("Reloaded config file without changes")
+	} else {
+		if len(result.Applied) > 0 {
+			infoLog.Printf("Reloaded config file and applied %s", strings.Join(result.Applied, ", "))
 		}
-		if !config.PipeAllowDisk {
-			config.PipeAllowDisk = tomlConfig.PipeAllowDisk
+		if len(result.Restart) > 0 {
+			warnLog.Printf("Changes to %s require a restart", strings.Join(result.Restart, ", "))
 		}
-		if len(config.DirectReadNs) == 0 {
-			config.DirectReadNs = tomlConfig.DirectReadNs
+	}
+	return result
+}
+
+func (ctx *httpServerCtx) buildServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/started", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+		data := (time.Now().Sub(ctx.started)).String()
+		w.Write([]byte(data))
+	})
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(200)
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		var data []byte
+		var ready bool
+		if req.URL.Query().Get("probe") == "startup" {
+			// startup probes only wait for the startup sequence
+			phase, err := readyState.startup(time.Now())
+			ready = err == nil
+			status := map[string]interface{}{"ready": ready, "phase": phase}
+			if err != nil {
+				status["error"] = err.Error()
+			}
+			data, _ = json.Marshal(status)
+		} else {
+			var checks map[string]string
+			checks, ready = ctx.readyChecks()
+			data, _ = json.Marshal(map[string]interface{}{
+				"ready":  ready,
+				"checks": checks,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(data)
+		fmt.Fprintln(w)
+	})
+	if ctx.config.Stats {
+		mux.HandleFunc("/stats", ctx.authorize(httpRoleRead, func(w http.ResponseWriter, req *http.Request) {
+			stats, err := json.MarshalIndent(statsOf(ctx.bulk), "", "    ")
+			if err == nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(200)
+				w.Write(stats)
+			} else {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Unable to print statistics: %s", err)
+			}
+		}))
+	}
+	mux.HandleFunc("/status", ctx.authorize(httpRoleRead, func(w http.ResponseWriter, req *http.Request) {
+		data, err := json.MarshalIndent(map[string]interface{}{
+			"namespaces": syncStatus.snapshot(),
+		}, "", "    ")
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Unable to print sync status: %s", err)
+			return
 		}
-		if len(config.ChangeStreamNs) == 0 {
-			config.ChangeStreamNs = tomlConfig.ChangeStreamNs
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		fmt.Fprintln(w)
+	}))
+	mux.HandleFunc("/instance", ctx.authorize(httpRoleRead, func(w http.ResponseWriter, req *http.Request) {
+		hostname, err := os.Hostname()
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Unable to get hostname for instance info: %s", err)
+			return
 		}
-		if len(config.ElasticUrls) == 0 {
-			config.ElasticUrls = tomlConfig.ElasticUrls
+		status := instanceStatus{
+			Pid:         os.Getpid(),
+			Hostname:    hostname,
+			ResumeName:  ctx.config.ResumeName,
+			ClusterName: ctx.config.ClusterName,
 		}
-		if len(config.Workers) == 0 {
-			config.Workers = tomlConfig.Workers
+		respC := make(chan *statusResponse)
+		statusReq := &statusRequest{
+			responseC: respC,
 		}
-		if !config.EnableHTTPServer && tomlConfig.EnableHTTPServer {
-			config.EnableHTTPServer = true
+		timer := time.NewTimer(5 * time.Second)
+		defer timer.Stop()
+		select {
+		case statusReqC <- statusReq:
+			srsp := <-respC
+			if srsp != nil {
+				status.Enabled = srsp.enabled
+				status.LastTs = srsp.lastTs
+				if srsp.lastTs != 0 {
+					status.LastTsFormat = time.Unix(int64(srsp.lastTs>>32), 0).Format("2006-01-02T15:04:05")
+				}
+			}
+			data, err := json.Marshal(status)
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintf(w, "Unable to print instance info: %s", err)
+				break
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(200)
+			w.Write(data)
+			fmt.Fprintln(w)
+			break
+		case <-timer.C:
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Timeout getting instance info")
+			break
 		}
-		if config.HTTPServerAddr == "" {
-			config.HTTPServerAddr = tomlConfig.HTTPServerAddr
+	}))
+	mux.HandleFunc("/config/reload", ctx.authorize(httpRoleAdmin, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
 		}
-		if !config.AWSConnect.enabled() {
-			config.AWSConnect = tomlConfig.AWSConnect
+		result := ctx.reloader.reloadAndLog()
+		data, _ := json.Marshal(result)
+		w.Header().Set("Content-Type", "application/json")
+		if result.Error != "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		w.Write(data)
+		fmt.Fprintln(w)
+	}))
+	mux.HandleFunc("/support-bundle", ctx.authorize(httpRoleAdmin, func(w http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		if err := ctx.writeSupportBundle(&buf); err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Unable to create support bundle: %s", err)
+			return
 		}
-		if !config.Logs.enabled() {
-			config.Logs = tomlConfig.Logs
+		name := fmt.Sprintf("monstache-support-%s.zip", time.Now().UTC().Format("20060102T150405Z"))
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		w.Write(buf.Bytes())
+	}))
+	viewLogLevel, setLogLevel := ctx.authorize(httpRoleRead, ctx.logLevel), ctx.authorize(httpRoleAdmin, ctx.logLevel)
+	mux.HandleFunc("/log-level", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" {
+			viewLogLevel(w, req)
+		} else {
+			setLogLevel(w, req)
 		}
-		config.MongoDialSettings = tomlConfig.MongoDialSettings
-		config.MongoSessionSettings = tomlConfig.MongoSessionSettings
-		config.MongoX509Settings = tomlConfig.MongoX509Settings
-		config.GtmSettings = tomlConfig.GtmSettings
-		config.Relate = tomlConfig.Relate
-		tomlConfig.loadScripts()
-		tomlConfig.loadFilters()
-		tomlConfig.loadPipelines()
-		tomlConfig.loadIndexTypes()
-		tomlConfig.loadReplacements()
+	})
+	if ctx.config.AdminUser != "" || ctx.hasRole(httpRoleAdmin) {
+		mux.HandleFunc("/pause", ctx.authorize(httpRoleAdmin, func(w http.ResponseWriter, req *http.Request) {
+			ctx.pauseSync(w, req, true)
+		}))
+		mux.HandleFunc("/resume", ctx.authorize(httpRoleAdmin, func(w http.ResponseWriter, req *http.Request) {
+			ctx.pauseSync(w, req, false)
+		}))
+		mux.HandleFunc("/resync", ctx.authorize(httpRoleAdmin, ctx.resync))
+	}
+	if ctx.config.Metrics {
+		mux.HandleFunc("/metrics", ctx.authorize(httpRoleRead, metrics.handler().ServeHTTP))
 	}
-	return config
+	if ctx.config.Pprof {
+		mux.HandleFunc("/debug/pprof/", ctx.pprofAuth(pprof.Index))
+		mux.HandleFunc("/debug/pprof/cmdline", ctx.pprofAuth(pprof.Cmdline))
+		mux.HandleFunc("/debug/pprof/profile", ctx.pprofAuth(pprof.Profile))
+		mux.HandleFunc("/debug/pprof/symbol", ctx.pprofAuth(pprof.Symbol))
+		mux.HandleFunc("/debug/pprof/trace", ctx.pprofAuth(pprof.Trace))
+	}
+	s := &http.Server{
+		Addr:      ctx.config.HTTPServerAddr,
+		Handler:   mux,
+		ErrorLog:  errorLog,
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+	ctx.httpServer = s
 }
 
-func (config *configOptions) newLogger(path string) *lumberjack.Logger {
-	return &lumberjack.Logger{
-		Filename:   path,
-		MaxSize:    500, // megabytes
-		MaxBackups: 5,
-		MaxAge:     28, //days
+// logLevel reports the current log level on GET and replaces it on PUT or
+// POST
+func (ctx *httpServerCtx) logLevel(w http.ResponseWriter, req *http.Request) {
+	var level *logLevel
+	switch req.Method {
+	case "GET":
+		level = ctx.reloader.logLevel()
+	case "PUT", "POST":
+		level = &logLevel{}
+		if err := json.NewDecoder(req.Body).Decode(level); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Unable to parse log level: %s", err)
+			return
+		}
+		level = ctx.reloader.setLogLevel(level)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
 	}
+	data, _ := json.Marshal(level)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+	fmt.Fprintln(w)
 }
 
-func (config *configOptions) setupLogging() *configOptions {
-	if config.GraylogAddr != "" {
-		gelfWriter, err := gelf.NewUDPWriter(config.GraylogAddr)
-		if err != nil {
-			errorLog.Fatalf("Error creating gelf writer: %s", err)
+// pprofAuth requires HTTP basic auth for a pprof endpoint when a pprof user
+// is configured.  Without one pprof falls back to the admin role
+func (ctx *httpServerCtx) pprofAuth(h http.HandlerFunc) http.HandlerFunc {
+	if ctx.config.PprofUser == "" {
+		return ctx.authorize(httpRoleAdmin, h)
+	}
+	return basicAuth("monstache pprof", ctx.config.PprofUser, func() string {
+		return secretValue("pprof-password", ctx.config.PprofPassword)
+	}, h)
+}
+
+// hasRole reports whether any http credential grants role
+func (ctx *httpServerCtx) hasRole(role string) bool {
+	for _, c := range ctx.config.HTTPCredentials {
+		if c.Role == role {
+			return true
 		}
-		infoLog.SetOutput(gelfWriter)
-		warnLog.SetOutput(gelfWriter)
-		errorLog.SetOutput(gelfWriter)
-		traceLog.SetOutput(gelfWriter)
-		statsLog.SetOutput(gelfWriter)
-	} else {
-		logs := config.Logs
-		if logs.Info != "" {
-			infoLog.SetOutput(config.newLogger(logs.Info))
+	}
+	return false
+}
+
+// role returns the role granted to the request by its bearer token or basic
+// auth, or the empty string.  The admin user counts as an admin credential.
+// Secrets are read per request so a refreshed secret applies without a
+// restart
+func (ctx *httpServerCtx) role(req *http.Request) string {
+	matches := func(a, b string) bool {
+		return b != "" && subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+	}
+	auth := req.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+		for i, c := range ctx.config.HTTPCredentials {
+			if matches(token, secretValue(fmt.Sprintf("http-credential.%d.token", i), c.Token)) {
+				return c.Role
+			}
 		}
-		if logs.Warn != "" {
-			warnLog.SetOutput(config.newLogger(logs.Warn))
+		return ""
+	}
+	u, p, ok := req.BasicAuth()
+	if !ok {
+		return ""
+	}
+	if ctx.config.AdminUser != "" && matches(u, ctx.config.AdminUser) &&
+		matches(p, secretValue("admin-password", ctx.config.AdminPassword)) {
+		return httpRoleAdmin
+	}
+	for i, c := range ctx.config.HTTPCredentials {
+		if c.User != "" && matches(u, c.User) &&
+			matches(p, secretValue(fmt.Sprintf("http-credential.%d.password", i), c.Password)) {
+			return c.Role
 		}
-		if logs.Error != "" {
-			errorLog.SetOutput(config.newLogger(logs.Error))
+	}
+	return ""
+}
+
+// authorize requires a credential granting role, or admin, for an endpoint.
+// Read endpoints stay open unless http credentials are configured and admin
+// endpoints stay open unless some credential is configured, which keeps
+// existing deployments working.  Missing or unknown credentials get a 401
+// and a credential with too little access gets a 403
+func (ctx *httpServerCtx) authorize(role string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		open := len(ctx.config.HTTPCredentials) == 0
+		if role == httpRoleAdmin && ctx.config.AdminUser != "" {
+			open = false
+		}
+		if open {
+			h(w, req)
+			return
 		}
-		if logs.Trace != "" {
-			traceLog.SetOutput(config.newLogger(logs.Trace))
+		switch ctx.role(req) {
+		case "":
+			w.Header().Set("WWW-Authenticate", `Basic realm="monstache"`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case httpRoleAdmin, role:
+			h(w, req)
+		default:
+			w.WriteHeader(http.StatusForbidden)
 		}
-		if logs.Stats != "" {
-			statsLog.SetOutput(config.newLogger(logs.Stats))
+	}
+}
+
+func basicAuth(realm, user string, password func() string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		u, p, ok := req.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password())) != 1 {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", realm))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
 		}
+		h(w, req)
 	}
-	if config.Debug {
-		mgo.SetDebug(true)
-		mgo.SetLogger(traceLog)
+}
+
+// pauseSync asks the event loop to pause or resume syncing the namespace
+// given by the namespace query parameter or, without one, everything
+func (ctx *httpServerCtx) pauseSync(w http.ResponseWriter, req *http.Request, pause bool) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	respC := make(chan *pauseStatus, 1)
+	pauseReq := &pauseRequest{
+		namespace: req.URL.Query().Get("namespace"),
+		pause:     pause,
+		responseC: respC,
+	}
+	timer := time.NewTimer(30 * time.Second)
+	defer timer.Stop()
+	select {
+	case pauseReqC <- pauseReq:
+		status := <-respC
+		data, _ := json.Marshal(status)
+		w.Header().Set("Content-Type", "application/json")
+		if status.Error != "" {
+			w.WriteHeader(http.StatusConflict)
+		}
+		w.Write(data)
+		fmt.Fprintln(w)
+	case <-timer.C:
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "Timeout waiting for the event loop")
 	}
-	return config
 }
 
-func (config *configOptions) loadEnvironment() *configOptions {
-	del := config.EnvDelimiter
-	if del == "" {
-		del = ","
+// resync starts a direct read of the namespace query parameter, limited by
+// the query document in the request body if any, and streams its progress
+// as one JSON line per second.  The read continues if the client goes away
+func (ctx *httpServerCtx) resync(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
 	}
-	for _, e := range os.Environ() {
-		pair := strings.SplitN(e, "=", 2)
-		if len(pair) < 2 {
-			continue
-		}
-		name, val := pair[0], pair[1]
-		if val == "" {
-			continue
-		}
-		switch name {
-		case "MONSTACHE_MONGO_URL":
-			if config.MongoURL == "" {
-				config.MongoURL = val
-			}
-			break
-		case "MONSTACHE_MONGO_CONFIG_URL":
-			if config.MongoConfigURL == "" {
-				config.MongoConfigURL = val
-			}
-			break
-		case "MONSTACHE_MONGO_PEM":
-			if config.MongoPemFile == "" {
-				config.MongoPemFile = val
-			}
-			break
-		case "MONSTACHE_MONGO_VALIDATE_PEM":
-			v, err := strconv.ParseBool(val)
-			if err != nil {
-				errorLog.Fatalf("Failed to load MONSTACHE_MONGO_VALIDATE_PEM: %s", err)
-			}
-			config.MongoValidatePemFile = v
-			break
-		case "MONSTACHE_MONGO_OPLOG_DB":
-			if config.MongoOpLogDatabaseName == "" {
-				config.MongoOpLogDatabaseName = val
-			}
-			break
-		case "MONSTACHE_MONGO_OPLOG_COL":
-			if config.MongoOpLogCollectionName == "" {
-				config.MongoOpLogCollectionName = val
-			}
-			break
-		case "MONSTACHE_ES_URLS":
-			if len(config.ElasticUrls) == 0 {
-				config.ElasticUrls = strings.Split(val, del)
-			}
-			break
-		case "MONSTACHE_ES_USER":
-			if config.ElasticUser == "" {
-				config.ElasticUser = val
-			}
-			break
-		case "MONSTACHE_ES_PASS":
-			if config.ElasticPassword == "" {
-				config.ElasticPassword = val
-			}
-			break
-		case "MONSTACHE_ES_PEM":
-			if config.ElasticPemFile == "" {
-				config.ElasticPemFile = val
-			}
-			break
-		case "MONSTACHE_ES_VALIDATE_PEM":
-			v, err := strconv.ParseBool(val)
-			if err != nil {
-				errorLog.Fatalf("Failed to load MONSTACHE_ES_VALIDATE_PEM: %s", err)
-			}
-			config.ElasticValidatePemFile = v
-			break
-		case "MONSTACHE_WORKER":
-			if config.Worker == "" {
-				config.Worker = val
-			}
-			break
-		case "MONSTACHE_CLUSTER":
-			if config.ClusterName == "" {
-				config.ClusterName = val
-			}
-			break
-		case "MONSTACHE_DIRECT_READ_NS":
-			if len(config.DirectReadNs) == 0 {
-				config.DirectReadNs = strings.Split(val, del)
-			}
-			break
-		case "MONSTACHE_CHANGE_STREAM_NS":
-			if len(config.ChangeStreamNs) == 0 {
-				config.ChangeStreamNs = strings.Split(val, del)
-			}
-			break
-		case "MONSTACHE_NS_REGEX":
-			if config.NsRegex == "" {
-				config.NsRegex = val
-			}
-			break
-		case "MONSTACHE_NS_EXCLUDE_REGEX":
-			if config.NsExcludeRegex == "" {
-				config.NsExcludeRegex = val
-			}
-			break
-		case "MONSTACHE_NS_DROP_REGEX":
-			if config.NsDropRegex == "" {
-				config.NsDropRegex = val
-			}
-			break
-		case "MONSTACHE_NS_DROP_EXCLUDE_REGEX":
-			if config.NsDropExcludeRegex == "" {
-				config.NsDropExcludeRegex = val
-			}
-			break
-		case "MONSTACHE_GRAYLOG_ADDR":
-			if config.GraylogAddr == "" {
-				config.GraylogAddr = val
-			}
-			break
-		case "MONSTACHE_AWS_ACCESS_KEY":
-			config.AWSConnect.AccessKey = val
-			break
-		case "MONSTACHE_AWS_SECRET_KEY":
-			config.AWSConnect.SecretKey = val
-			break
-		case "MONSTACHE_AWS_REGION":
-			config.AWSConnect.Region = val
-			break
-		case "MONSTACHE_LOG_DIR":
-			config.Logs.Info = val + "/info.log"
-			config.Logs.Warn = val + "/warn.log"
-			config.Logs.Error = val + "/error.log"
-			config.Logs.Trace = val + "/trace.log"
-			config.Logs.Stats = val + "/stats.log"
-			break
-		case "MONSTACHE_HTTP_ADDR":
-			if config.HTTPServerAddr == "" {
-				config.HTTPServerAddr = val
-			}
-			break
-		case "MONSTACHE_FILE_NS":
-			if len(config.FileNamespaces) == 0 {
-				config.FileNamespaces = strings.Split(val, del)
-			}
-			break
-		case "MONSTACHE_PATCH_NS":
-			if len(config.PatchNamespaces) == 0 {
-				config.PatchNamespaces = strings.Split(val, del)
-			}
-			break
-		case "MONSTACHE_TIME_MACHINE_NS":
-			if len(config.TimeMachineNamespaces) == 0 {
-				config.TimeMachineNamespaces = strings.Split(val, del)
+	ns := req.URL.Query().Get("namespace")
+	if len(strings.SplitN(ns, ".", 2)) != 2 {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Resync requires a namespace of the form db.collection")
+		return
+	}
+	var sel bson.M
+	body, err := ioutil.ReadAll(req.Body)
+	if err == nil && len(bytes.TrimSpace(body)) > 0 {
+		err = bson.UnmarshalJSON(body, &sel)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unable to parse resync filter: %s", err)
+		return
+	}
+	if resyncs == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "Resync is not available until syncing has started")
+		return
+	}
+	job, err := resyncs.start(ns, sel)
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		fmt.Fprint(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	write := func(progress *resyncProgress) {
+		data, _ := json.Marshal(progress)
+		w.Write(data)
+		fmt.Fprintln(w)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-job.doneC:
+			write(job.progress())
+			return
+		case <-ticker.C:
+			write(job.progress())
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func newResyncer(session *mgo.Session, options *gtm.Options, config *configOptions) *resyncer {
+	return &resyncer{
+		session: session,
+		options: options,
+		config:  config,
+		active:  make(map[string]*resyncJob),
+	}
+}
+
+// start begins a direct read of ns unless one is already running
+func (r *resyncer) start(ns string, sel bson.M) (*resyncJob, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.active[ns] != nil {
+		return nil, fmt.Errorf("A resync of namespace %s is already running", ns)
+	}
+	job := &resyncJob{
+		namespace: ns,
+		selector:  sel,
+		doneC:     make(chan struct{}),
+	}
+	r.active[ns] = job
+	go func() {
+		infoLog.Printf("Resyncing namespace %s", ns)
+		job.err = r.read(job)
+		if job.err != nil {
+			errorLog.Printf("Unable to resync namespace %s: %s", ns, job.err)
+		} else {
+			infoLog.Printf("Resync of namespace %s read %d documents", ns, atomic.LoadInt64(&job.read))
+		}
+		r.lock.Lock()
+		delete(r.active, ns)
+		r.lock.Unlock()
+		close(job.doneC)
+	}()
+	return job, nil
+}
+
+// read sends the documents of the namespace to the event loop as direct
+// read events, applying the same pipeline and filters as direct reads
+func (r *resyncer) read(job *resyncJob) (err error) {
+	s := r.session.Copy()
+	defer s.Close()
+	if r.config.DirectReadNoTimeout {
+		s.SetCursorTimeout(0)
+	}
+	parts := strings.SplitN(job.namespace, ".", 2)
+	col := s.DB(parts[0]).C(parts[1])
+	sel := job.selector
+	if sel == nil {
+		sel = bson.M{}
+	}
+	var iter *mgo.Iter
+	var pipeline []interface{}
+	if r.options.Pipe != nil {
+		if pipeline, err = r.options.Pipe(job.namespace, false); err != nil {
+			return
+		}
+	}
+	if len(pipeline) > 0 {
+		stages := append([]interface{}{bson.M{"$match": sel}}, pipeline...)
+		pipe := col.Pipe(stages)
+		if r.options.PipeAllowDisk {
+			pipe = pipe.AllowDiskUse()
+		}
+		iter = pipe.Iter()
+	} else {
+		iter = col.Find(sel).Iter()
+	}
+	doc := make(map[string]interface{})
+	for iter.Next(&doc) {
+		op := &gtm.Op{
+			Id:        doc["_id"],
+			Operation: "i",
+			Namespace: job.namespace,
+			Source:    gtm.DirectQuerySource,
+			Timestamp: bson.MongoTimestamp(time.Now().UTC().Unix() << 32),
+			Data:      doc,
+			Doc:       doc,
+		}
+		doc = make(map[string]interface{})
+		if r.options.DirectReadFilter != nil && !r.options.DirectReadFilter(op) {
+			continue
+		}
+		resyncOpC <- op
+		atomic.AddInt64(&job.read, 1)
+	}
+	return iter.Close()
+}
+
+// progress returns the documents read so far and, once done, the outcome
+func (job *resyncJob) progress() *resyncProgress {
+	p := &resyncProgress{
+		Namespace: job.namespace,
+		Read:      atomic.LoadInt64(&job.read),
+	}
+	select {
+	case <-job.doneC:
+		p.Done = true
+		if job.err != nil {
+			p.Error = job.err.Error()
+		}
+	default:
+	}
+	return p
+}
+
+func pausedName(namespace string) string {
+	if namespace == "" {
+		return "all namespaces"
+	}
+	return namespace
+}
+
+// holds returns true if the events of the op's namespace are paused
+func (sp *syncPause) holds(op *gtm.Op) bool {
+	return sp.all || sp.namespaces[op.Namespace]
+}
+
+func (sp *syncPause) hold(op *gtm.Op) {
+	sp.held = append(sp.held, op)
+}
+
+// pause stops syncing a namespace or, when empty, everything
+func (sp *syncPause) pause(namespace string) {
+	if namespace == "" {
+		sp.all = true
+		return
+	}
+	if sp.namespaces == nil {
+		sp.namespaces = make(map[string]bool)
+	}
+	sp.namespaces[namespace] = true
+}
+
+// resume syncs a namespace again or, when empty, everything and returns
+// the held events which are no longer paused in the order received
+func (sp *syncPause) resume(namespace string) (released []*gtm.Op) {
+	if namespace == "" {
+		sp.all = false
+		sp.namespaces = nil
+	} else {
+		delete(sp.namespaces, namespace)
+	}
+	var held []*gtm.Op
+	for _, op := range sp.held {
+		if sp.holds(op) {
+			held = append(held, op)
+		} else {
+			released = append(released, op)
+		}
+	}
+	sp.held = held
+	return
+}
+
+// checkpoint returns the timestamp which may be saved to resume from
+// without skipping a held event
+func (sp *syncPause) checkpoint(ts bson.MongoTimestamp) bson.MongoTimestamp {
+	for _, op := range sp.held {
+		if op.IsSourceOplog() && op.Timestamp <= ts {
+			ts = op.Timestamp - 1
+		}
+	}
+	return ts
+}
+
+func (sp *syncPause) status() *pauseStatus {
+	status := &pauseStatus{
+		Paused:     sp.all,
+		Namespaces: []string{},
+		Held:       len(sp.held),
+	}
+	for ns := range sp.namespaces {
+		status.Namespaces = append(status.Namespaces, ns)
+	}
+	sort.Strings(status.Namespaces)
+	return status
+}
+
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([]string, size)}
+}
+
+func (r *logRing) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		r.lines[r.next] = line
+		r.next = (r.next + 1) % len(r.lines)
+		if r.next == 0 {
+			r.full = true
+		}
+	}
+	return len(p), nil
+}
+
+// String returns the lines kept from oldest to newest
+func (r *logRing) String() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var lines []string
+	if r.full {
+		lines = append(lines, r.lines[r.next:]...)
+	}
+	lines = append(lines, r.lines[:r.next]...)
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// supportResume captures the last timestamp read by the event loop and the
+// saved resume position
+func (ctx *httpServerCtx) supportResume() *supportResume {
+	state := &supportResume{ResumeName: ctx.config.ResumeName}
+	respC := make(chan *statusResponse)
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+	select {
+	case statusReqC <- &statusRequest{responseC: respC}:
+		if srsp := <-respC; srsp != nil {
+			state.Enabled, state.LastTs = srsp.enabled, srsp.lastTs
+			if srsp.lastTs != 0 {
+				state.LastTsFormat = time.Unix(int64(srsp.lastTs>>32), 0).Format("2006-01-02T15:04:05")
 			}
-			break
-		default:
+		}
+	case <-timer.C:
+		state.Error = "Timeout getting instance info"
+	}
+	if ctx.mongo != nil && ctx.config.Resume {
+		session := ctx.mongo.Copy()
+		defer session.Close()
+		token, err := ctx.config.savedResumeToken(session)
+		if err != nil {
+			state.Error = fmt.Sprintf("Unable to read resume position: %s", err)
+		}
+		state.Saved = token
+	}
+	return state
+}
+
+// buildInfo describes the binary for support bundles
+func buildInfo() map[string]interface{} {
+	info := map[string]interface{}{
+		"version":    version,
+		"go":         runtime.Version(),
+		"os":         runtime.GOOS,
+		"arch":       runtime.GOARCH,
+		"cpus":       runtime.NumCPU(),
+		"goroutines": runtime.NumGoroutine(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		deps := make(map[string]string)
+		for _, dep := range bi.Deps {
+			deps[dep.Path] = dep.Version
+		}
+		info["path"] = bi.Path
+		info["dependencies"] = deps
+	}
+	return info
+}
+
+// goroutineDump returns the stacks of all goroutines
+func goroutineDump() []byte {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// writeSupportBundle zips the diagnostics attached to bug reports: the
+// sanitized config, resume state, stats, recent errors, goroutines and
+// build info
+func (ctx *httpServerCtx) writeSupportBundle(w io.Writer) error {
+	options := ctx.config
+	if ctx.reloader != nil {
+		options = ctx.reloader.options()
+	}
+	config, err := options.sanitized()
+	if err != nil {
+		return err
+	}
+	resume, _ := json.MarshalIndent(ctx.supportResume(), "", "  ")
+	build, _ := json.MarshalIndent(buildInfo(), "", "  ")
+	type bundleFile struct {
+		name string
+		data []byte
+	}
+	files := []bundleFile{
+		{"config.json", config},
+		{"resume.json", resume},
+		{"errors.log", []byte(recentErrors.String())},
+		{"goroutines.txt", goroutineDump()},
+		{"build.json", build},
+	}
+	if ctx.bulk != nil {
+		stats, _ := json.MarshalIndent(statsOf(ctx.bulk), "", "  ")
+		files = append(files, bundleFile{"stats.json", stats})
+	}
+	zw := zip.NewWriter(w)
+	for _, file := range files {
+		f, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if _, err = f.Write(file.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// fetchSupportBundle downloads a support bundle from the http server of a
+// running monstache to the file or a timestamped file in the current
+// directory
+func (config *configOptions) fetchSupportBundle(path string) int {
+	host, port, err := net.SplitHostPort(config.HTTPServerAddr)
+	if err != nil {
+		errorLog.Printf("Invalid http-server-addr %s: %s", config.HTTPServerAddr, err)
+		return 1
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Get(fmt.Sprintf("http://%s/support-bundle", net.JoinHostPort(host, port)))
+	if err != nil {
+		errorLog.Printf("Unable to fetch support bundle. Is monstache running with enable-http-server? %s", err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(resp.Body)
+		errorLog.Printf("Unable to fetch support bundle: %d %s", resp.StatusCode, body)
+		return 1
+	}
+	if path == "" {
+		path = fmt.Sprintf("monstache-support-%s.zip", time.Now().UTC().Format("20060102T150405Z"))
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		errorLog.Printf("Unable to write support bundle: %s", err)
+		return 1
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		errorLog.Printf("Unable to write support bundle: %s", err)
+		return 1
+	}
+	infoLog.Printf("Wrote support bundle to %s", path)
+	return 0
+}
+
+// notifySd tells systemd the process is ready once the event loop starts
+// and then pings the watchdog while the pipeline is alive
+func notifySd(config *configOptions, readyC chan bool) {
+	var interval time.Duration
+	<-readyC
+	if verbose() {
+		infoLog.Println("Sending systemd READY=1")
+	}
+	sent, err := daemon.SdNotify(false, "READY=1")
+	if sent {
+		if verbose() {
+			infoLog.Println("READY=1 successfully sent to systemd")
+		}
+	} else {
+		notifySdFailed(config, err)
+		return
+	}
+	interval, err = daemon.SdWatchdogEnabled(false)
+	if err != nil || interval == 0 {
+		watchdogSdFailed(config, err)
+		return
+	}
+	for {
+		time.Sleep(interval / 2)
+		if err = pipelineAlive(interval / 4); err != nil {
+			warnLog.Printf("Skipping systemd WATCHDOG=1: %s", err)
 			continue
 		}
+		if verbose() {
+			infoLog.Println("Sending systemd WATCHDOG=1")
+		}
+		sent, err = daemon.SdNotify(false, "WATCHDOG=1")
+		if sent {
+			if verbose() {
+				infoLog.Println("WATCHDOG=1 successfully sent to systemd")
+			}
+		} else {
+			notifySdFailed(config, err)
+			return
+		}
 	}
-	return config
 }
 
-func (config *configOptions) loadRoutingNamespaces() *configOptions {
-	for _, namespace := range config.RoutingNamespaces {
-		routingNamespaces[namespace] = true
+// pipelineAlive returns an error if the event loop does not answer within
+// timeout or the index workers have events queued but made no progress
+// for the resume stall timeout
+func pipelineAlive(timeout time.Duration) error {
+	respC := make(chan *statusResponse, 1)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case statusReqC <- &statusRequest{responseC: respC}:
+	case <-timer.C:
+		return fmt.Errorf("event loop did not respond within %s", timeout)
 	}
-	return config
+	idle := time.Since(time.Unix(0, atomic.LoadInt64(&lastIndexedAt)))
+	if depth := indexQueueDepth(); depth > 0 && idle > resumeStallTimeout {
+		return fmt.Errorf("index workers made no progress on %d queued events for %s", depth, idle.Truncate(time.Second))
+	}
+	return nil
 }
 
-func (config *configOptions) loadTimeMachineNamespaces() *configOptions {
-	for _, namespace := range config.TimeMachineNamespaces {
-		tmNamespaces[namespace] = true
+func (config *configOptions) makeShardInsertHandler() gtm.ShardInsertHandler {
+	return func(shardInfo *gtm.ShardInfo) (*mgo.Session, error) {
+		shardURL := shardInfo.GetURL()
+		infoLog.Printf("Adding shard found at %s\n", cleanMongoURL(shardURL))
+		return config.dialMongo(shardURL)
 	}
-	return config
 }
 
-func (config *configOptions) loadPatchNamespaces() *configOptions {
-	for _, namespace := range config.PatchNamespaces {
-		patchNamespaces[namespace] = true
+func buildPipe(config *configOptions) func(string, bool) ([]interface{}, error) {
+	if pipePlugin != nil {
+		if metrics == nil {
+			return pipePlugin
+		}
+		return func(ns string, changeEvent bool) ([]interface{}, error) {
+			defer metrics.pluginTimer("pipe", ns)()
+			return pipePlugin(ns, changeEvent)
+		}
+	} else if len(pipeEnvs) > 0 {
+		return func(ns string, changeEvent bool) ([]interface{}, error) {
+			mux.Lock()
+			defer mux.Unlock()
+			nss := []string{"", ns}
+			for _, ns := range nss {
+				if env := pipeEnvs[ns]; env != nil {
+					env.lock.Lock()
+					defer env.lock.Unlock()
+					val, err := env.VM.Call("module.exports", ns, ns, changeEvent)
+					if err != nil {
+						return nil, err
+					}
+					if strings.ToLower(val.Class()) == "array" {
+						data, err := val.Export()
+						if err != nil {
+							return nil, err
+						} else if data == val {
+							return nil, errors.New("Exported pipeline function must return an array")
+						} else {
+							switch data.(type) {
+							case []map[string]interface{}:
+								ds := data.([]map[string]interface{})
+								var is []interface{} = make([]interface{}, len(ds))
+								for i, d := range ds {
+									is[i] = deepExportValue(d)
+								}
+								return is, nil
+							case []interface{}:
+								ds := data.([]interface{})
+								if len(ds) > 0 {
+									panic("Pipeline function must return an array of objects")
+								}
+								return nil, nil
+							default:
+								panic("Pipeline function must return an array of objects")
+							}
+						}
+					} else {
+						return nil, errors.New("Exported pipeline function must return an array")
+					}
+				}
+			}
+			return nil, nil
+		}
 	}
-	return config
+	return nil
+}
+
+// shutdown flushes the bulk processors and exits.  The checkpoint, if any,
+// is saved once everything sent to the bulk processors was indexed
+func shutdown(timeout int, hsc *httpServerCtx, bulk *elastic.BulkProcessor, bulkStats *elastic.BulkProcessor, mongo *mgo.Session, config *configOptions, checkpoint func()) {
+	infoLog.Println("Shutting down")
+	closeC := make(chan bool)
+	go func() {
+		if mongo != nil && config.ClusterName != "" {
+			resetClusterState(mongo, config)
+		}
+		partition.leave()
+		if hsc != nil {
+			hsc.shutdown = true
+			hsc.httpServer.Shutdown(context.Background())
+		}
+		if bulk != nil {
+			orphans.stop()
+			if err := stopBulks(bulk); err != nil && checkpoint != nil {
+				errorLog.Println("Not saving the resume point since the sinks were not flushed")
+				checkpoint = nil
+			}
+		}
+		if checkpoint != nil {
+			checkpoint()
+		}
+		if bulkStats != nil {
+			bulkStats.Stop()
+		}
+		deadLetters.close()
+		audit.close()
+		tracing.flush()
+		close(closeC)
+	}()
+	doneC := make(chan bool)
+	go func() {
+		closeT := time.NewTicker(time.Duration(timeout) * time.Second)
+		done := false
+		for !done {
+			select {
+			case <-closeC:
+				done = true
+				close(doneC)
+			case <-closeT.C:
+				done = true
+				close(doneC)
+			}
+		}
+	}()
+	<-doneC
+	stopService(exitStatus)
+	os.Exit(exitStatus)
 }
 
-func (config *configOptions) loadGridFsConfig() *configOptions {
-	for _, namespace := range config.FileNamespaces {
-		fileNamespaces[namespace] = true
+// waitUntil runs wait and returns true if it returned before the deadline.
+// Otherwise wait is left running
+func waitUntil(deadline time.Time, wait func()) bool {
+	doneC := make(chan bool)
+	go func() {
+		wait()
+		close(doneC)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-doneC:
+		return true
+	case <-timer.C:
+		return false
 	}
-	return config
 }
 
-func (config configOptions) dump() {
-	if config.MongoURL != "" {
-		config.MongoURL = cleanMongoURL(config.MongoURL)
-	}
-	if config.MongoConfigURL != "" {
-		config.MongoConfigURL = cleanMongoURL(config.MongoConfigURL)
-	}
-	if config.ElasticUser != "" {
-		config.ElasticUser = redact
-	}
-	if config.ElasticPassword != "" {
-		config.ElasticPassword = redact
-	}
-	if config.AWSConnect.AccessKey != "" {
-		config.AWSConnect.AccessKey = redact
+// checkedNamespaces lists the namespaces named in the configuration
+func (config *configOptions) checkedNamespaces() []string {
+	seen := make(map[string]bool)
+	for _, names := range [][]string{
+		config.DirectReadNs, config.ChangeStreamNs, config.FileNamespaces, config.FileMetadataNamespaces,
+		config.PatchNamespaces, config.TimeMachineNamespaces, config.RoutingNamespaces,
+	} {
+		for _, ns := range names {
+			seen[ns] = true
+		}
 	}
-	if config.AWSConnect.SecretKey != "" {
-		config.AWSConnect.SecretKey = redact
+	for ns := range mapIndexTypes {
+		seen[ns] = true
 	}
-	if config.AWSConnect.Region != "" {
-		config.AWSConnect.Region = redact
+	for _, envs := range []map[string]*executionEnv{mapEnvs, filterEnvs, pipeEnvs} {
+		for ns := range envs {
+			seen[ns] = true
+		}
 	}
-	json, err := json.MarshalIndent(config, "", "  ")
-	if err != nil {
-		errorLog.Printf("Unable to print configuration: %s", err)
-	} else {
-		infoLog.Println(string(json))
+	delete(seen, "")
+	var namespaces []string
+	for ns := range seen {
+		namespaces = append(namespaces, ns)
 	}
+	sort.Strings(namespaces)
+	return namespaces
 }
 
-/*
-if ssl=true is set on the connection string, remove the option
-from the connection string and enable TLS because the mgo
-driver does not support the option in the connection string
-*/
-func (config *configOptions) parseMongoURL(inURL string) (outURL string) {
-	const queryDelim string = "?"
-	outURL = inURL
-	hostQuery := strings.SplitN(outURL, queryDelim, 2)
-	if len(hostQuery) == 2 {
-		host, query := hostQuery[0], hostQuery[1]
-		r := regexp.MustCompile(`ssl=true&?|&ssl=true$`)
-		qstr := r.ReplaceAllString(query, "")
-		if qstr != query {
-			config.MongoDialSettings.Ssl = true
-			if qstr == "" {
-				outURL = host
-			} else {
-				outURL = strings.Join([]string{host, qstr}, queryDelim)
-			}
+// namespaceExists reports whether a database or a database.collection
+// namespace exists
+func namespaceExists(session *mgo.Session, ns string) (bool, error) {
+	db, col := ns, ""
+	if dot := strings.Index(ns, "."); dot != -1 {
+		db, col = ns[:dot], ns[dot+1:]
+	}
+	names, err := session.DB(db).CollectionNames()
+	if err != nil {
+		return false, err
+	}
+	if col == "" {
+		return len(names) > 0, nil
+	}
+	for _, name := range names {
+		if name == col {
+			return true, nil
 		}
 	}
-	return
+	return false, nil
 }
 
-func (config *configOptions) validate() {
-	const schemeSrv = "mongodb+srv://"
-	if strings.HasPrefix(config.MongoURL, schemeSrv) {
-		panic("The mongodb+srv scheme is not yet supported")
+// check tests the configuration and connections without syncing and
+// returns the exit status.  Invalid options have already been rejected by
+// validate
+func (config *configOptions) check() int {
+	failed := false
+	fail := func(format string, args ...interface{}) {
+		failed = true
+		errorLog.Printf(format, args...)
 	}
-	if config.DisableChangeEvents && len(config.DirectReadNs) == 0 {
-		panic("Direct read namespaces must be specified if change events are disabled")
+	if len(config.unknownOptions) > 0 {
+		fail("Unknown options in config file: %s", strings.Join(config.unknownOptions, ", "))
 	}
-	if config.AWSConnect.enabled() {
-		if err := config.AWSConnect.validate(); err != nil {
-			panic(err)
-		}
+	if err := nsFilter.set(config); err != nil {
+		fail("%s", err)
 	}
-	if config.MongoX509Settings.enabled() {
-		if err := config.MongoX509Settings.validate(); err != nil {
-			panic(err)
-		}
+	if config.MapperPluginPath != "" {
+		infoLog.Printf("Loaded plugin %s", config.MapperPluginPath)
 	}
-	ds := config.MongoDialSettings
-	ss := config.MongoSessionSettings
-	if ds.ReadTimeout < 1 {
-		panic("MongoDB read timeout must be greater than 0")
+	if !config.DisableElasticsearch {
+		if client, err := config.newElasticClient(); err != nil {
+			fail("Unable to create Elasticsearch client: %s", err)
+		} else if err = config.testElasticsearchConn(client); err != nil {
+			fail("Unable to validate connection to Elasticsearch: %s", err)
+		}
 	}
-	if ds.WriteTimeout < 1 {
-		panic("MongoDB write timeout must be greater than 0")
+	// an unreachable MongoDB ends the check when the dial timeout expires
+	if mongo, err := config.dialMongo(config.MongoURL); err != nil {
+		fail("Unable to connect to MongoDB using URL %s: %s", cleanMongoURL(config.MongoURL), err)
+	} else {
+		if mongoInfo, err := mongo.BuildInfo(); err == nil {
+			infoLog.Printf("Successfully connected to MongoDB version %s", mongoInfo.Version)
+		}
+		for _, ns := range config.checkedNamespaces() {
+			exists, err := namespaceExists(mongo, ns)
+			if err != nil {
+				fail("Unable to verify namespace %s: %s", ns, err)
+			} else if !exists {
+				warnLog.Printf("Namespace %s does not exist in MongoDB", ns)
+			}
+		}
+		mongo.Close()
 	}
-	if ss.SyncTimeout < 1 {
-		panic("MongoDB sync timeout must be greater than 0")
+	config.dump()
+	if failed {
+		errorLog.Println("Configuration check failed")
+		return 1
 	}
-	if len(config.DirectReadNs) > 0 {
-		if config.ElasticMaxSeconds < 5 {
-			warnLog.Println("Direct read performance degrades with small values for elasticsearch-max-seconds. Set to 5s or greater to remove this warning.")
+	infoLog.Println("Configuration check passed")
+	return 0
+}
+
+// namespacePreview is what the preview command prints for a namespace: the
+// documents as they would be indexed and the mapping inferred from them per
+// index
+type namespacePreview struct {
+	Namespace string                            `json:"namespace"`
+	Sampled   int                               `json:"sampled"`
+	Skipped   int                               `json:"skipped"`
+	Documents []*previewDocument                `json:"documents"`
+	Mappings  map[string]map[string]interface{} `json:"mappings"`
+}
+
+type previewDocument struct {
+	Index    string      `json:"_index"`
+	ID       string      `json:"_id"`
+	Routing  string      `json:"_routing,omitempty"`
+	Pipeline string      `json:"pipeline,omitempty"`
+	Source   interface{} `json:"_source"`
+}
+
+// previewDocuments runs sampled documents through the mapping and
+// transformations of a namespace the way they are indexed.  Documents which
+// are dropped or skipped are counted but not shown
+func previewDocuments(mongo *mgo.Session, config *configOptions, ns string, docs []map[string]interface{}) (*namespacePreview, error) {
+	p := &namespacePreview{
+		Namespace: ns,
+		Sampled:   len(docs),
+		Documents: []*previewDocument{},
+		Mappings:  make(map[string]map[string]interface{}),
+	}
+	for _, doc := range docs {
+		op := &gtm.Op{
+			Id:        doc["_id"],
+			Namespace: ns,
+			Operation: "i",
+			Data:      doc,
+			Source:    gtm.DirectQuerySource,
+		}
+		objectID := opIDToString(op)
+		if err := mapData(mongo, config, op); err != nil {
+			return nil, fmt.Errorf("Unable to map document %s: %s", objectID, err)
+		}
+		if op.Data == nil {
+			p.Skipped++
+			continue
 		}
-		if config.ElasticMaxDocs > 0 {
-			warnLog.Println("For performance reasons it is recommended to use elasticsearch-max-bytes instead of elasticsearch-max-docs since doc size may vary")
+		meta, ok := transformDocument(config, op)
+		if !ok || meta.Skip {
+			p.Skipped++
+			continue
+		}
+		index := meta.indexOr(mapIndexType(config, op).Index)
+		p.Documents = append(p.Documents, &previewDocument{
+			Index:    index,
+			ID:       meta.idOr(objectID),
+			Routing:  meta.Routing,
+			Pipeline: meta.Pipeline,
+			Source:   indexedDocument(config, op),
+		})
+		mapping := p.Mappings[index]
+		if mapping == nil {
+			mapping = map[string]interface{}{"properties": make(map[string]interface{})}
+			p.Mappings[index] = mapping
 		}
+		inferProperties(op.Data, mapping["properties"].(map[string]interface{}))
 	}
+	return p, nil
 }
 
-func (config *configOptions) setDefaults() *configOptions {
-	ds := config.MongoDialSettings
-	ss := config.MongoSessionSettings
-	if ds.Timeout == -1 {
-		config.MongoDialSettings.Timeout = 15
-	}
-	if ds.ReadTimeout == -1 {
-		config.MongoDialSettings.ReadTimeout = 30
-	}
-	if ds.WriteTimeout == -1 {
-		config.MongoDialSettings.WriteTimeout = 30
-	}
-	if ss.SyncTimeout == -1 {
-		config.MongoSessionSettings.SyncTimeout = 30
+// preview prints the documents of a random sample of each namespace given
+// with ns as they would be indexed along with the inferred mapping.
+// Nothing is written to Elasticsearch
+func (config *configOptions) preview() int {
+	if len(config.PreviewNamespaces) == 0 {
+		errorLog.Println("Usage: monstache preview -ns db.collection [-preview-size n] [flags]")
+		return 2
 	}
-	if ss.SocketTimeout == -1 {
-		config.MongoSessionSettings.SocketTimeout = 0
+	mongo, err := config.dialMongo(config.MongoURL)
+	if err != nil {
+		errorLog.Printf("Unable to connect to MongoDB using URL %s: %s", cleanMongoURL(config.MongoURL), err)
+		return 1
 	}
-	if config.MongoURL == "" {
-		config.MongoURL = mongoURLDefault
+	defer mongo.Close()
+	references.start(mongo)
+	if mapperPlugin != nil || processPlugin != nil {
+		pluginLookups = monstachemap.NewBatcher(mongo,
+			time.Duration(config.LookupBatchWindowMs)*time.Millisecond, config.LookupBatchMax)
 	}
-	if config.ClusterName != "" {
-		if config.Worker != "" {
-			config.ResumeName = fmt.Sprintf("%s:%s", config.ClusterName, config.Worker)
-		} else {
-			config.ResumeName = config.ClusterName
+	loadBuiltinFunctions(mongo, config)
+	var previews []*namespacePreview
+	for _, ns := range config.PreviewNamespaces {
+		dot := strings.Index(ns, ".")
+		if dot == -1 {
+			errorLog.Printf("Invalid preview namespace %s: expected db.collection", ns)
+			return 2
+		}
+		var docs []map[string]interface{}
+		pipe := []bson.M{{"$sample": bson.M{"size": config.PreviewSize}}}
+		if err := mongo.DB(ns[:dot]).C(ns[dot+1:]).Pipe(pipe).All(&docs); err != nil {
+			errorLog.Printf("Unable to sample namespace %s: %s", ns, err)
+			return 1
+		}
+		p, err := previewDocuments(mongo, config, ns, docs)
+		if err != nil {
+			errorLog.Printf("Unable to preview namespace %s: %s", ns, err)
+			return 1
 		}
-		config.Resume = true
-	} else if config.Worker != "" {
-		config.ResumeName = config.Worker
-	} else if config.ResumeName == "" {
-		config.ResumeName = resumeNameDefault
-	}
-	if config.ElasticMaxConns == 0 {
-		config.ElasticMaxConns = elasticMaxConnsDefault
+		previews = append(previews, p)
 	}
-	if config.ElasticClientTimeout == 0 {
-		config.ElasticClientTimeout = elasticClientTimeoutDefault
+	data, err := json.MarshalIndent(previews, "", "  ")
+	if err != nil {
+		errorLog.Printf("Unable to encode preview: %s", err)
+		return 1
 	}
-	if config.MergePatchAttr == "" {
-		config.MergePatchAttr = "json-merge-patches"
+	fmt.Println(string(data))
+	return 0
+}
+
+// subcommands lists the commands accepted as the first argument and the
+// actions of those which take one.  Without a command monstache syncs
+var subcommands = map[string][]string{
+	"sync":           nil,
+	"check":          nil,
+	"verify":         nil,
+	"repair":         nil,
+	"replay":         nil,
+	"preview":        nil,
+	"resume":         {"export", "import"},
+	"config":         {"init", "migrate"},
+	"init":           nil,
+	"support-bundle": nil,
+	"service":        {"install", "uninstall", "run"},
+}
+
+// parseSubcommand splits the command and its action from the remaining
+// arguments, which are parsed as flags
+func parseSubcommand(args []string) (command string, rest []string, err error) {
+	if len(args) == 0 {
+		return "sync", args, nil
+	}
+	actions, ok := subcommands[args[0]]
+	if !ok {
+		return "sync", args, nil
+	}
+	command, rest = args[0], args[1:]
+	if actions == nil {
+		return
 	}
-	if config.ElasticMaxSeconds == 0 {
-		if len(config.DirectReadNs) > 0 {
-			config.ElasticMaxSeconds = 5
-		} else {
-			config.ElasticMaxSeconds = 1
+	if len(rest) > 0 {
+		for _, action := range actions {
+			if rest[0] == action {
+				return command + " " + action, rest[1:], nil
+			}
 		}
 	}
-	if config.ElasticMaxDocs == 0 {
-		config.ElasticMaxDocs = elasticMaxDocsDefault
+	return "", nil, fmt.Errorf("Usage: monstache %s %s [flags] [file]", command, strings.Join(actions, "|"))
+}
+
+// parseReplayTimestamp reads the position given to the replay command as
+// an RFC3339 time, seconds since the epoch or a MongoDB timestamp
+func parseReplayTimestamp(arg string) (int64, error) {
+	if t, err := time.Parse(time.RFC3339, arg); err == nil {
+		return t.Unix() << 32, nil
 	}
-	if config.ElasticMaxBytes == 0 {
-		config.ElasticMaxBytes = elasticMaxBytesDefault
+	ts, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || ts <= 0 {
+		return 0, fmt.Errorf("Invalid replay timestamp %s: expected an RFC3339 time or a positive number", arg)
 	}
-	if config.ElasticHealth0 == 0 {
-		config.ElasticHealth0 = 15
+	return ts, nil
+}
+
+// replayFrom sets the starting point of the replay command.  Without a
+// timestamp the entire oplog is replayed.  The position may also be a file
+// written by resume export.  The replay stops at replay-until, which
+// defaults to the time it starts, and leaves the saved resume position to
+// the processes which sync continuously
+func (config *configOptions) replayFrom(args []string) error {
+	config.Replay, config.ResumeFromTimestamp = true, 0
+	config.Resume = false
+	if config.ReplayUntil == "" {
+		config.ReplayUntil = "now"
+	}
+	if len(args) == 0 {
+		return nil
 	}
-	if config.ElasticHealth1 == 0 {
-		config.ElasticHealth1 = 5
+	ts, err := parseReplayTimestamp(args[0])
+	if err != nil {
+		token, terr := readResumeToken(args[0])
+		if terr != nil {
+			return err
+		}
+		ts = token.Ts
 	}
-	if config.MongoURL != "" {
-		config.MongoURL = config.parseMongoURL(config.MongoURL)
+	config.Replay, config.ResumeFromTimestamp = false, ts
+	return nil
+}
+
+// replayBound stops reading events once those up to a timestamp have been
+// read and restricts the events read to the replayed namespaces
+type replayBound struct {
+	until      bson.MongoTimestamp
+	namespaces map[string]bool
+	seen       int64
+	idleChecks int
+	stopped    int32
+}
+
+var replayEnd *replayBound
+
+func newReplayBound(config *configOptions, now time.Time) (*replayBound, error) {
+	b := &replayBound{namespaces: make(map[string]bool)}
+	for _, ns := range config.ReplayNamespaces {
+		b.namespaces[ns] = true
+	}
+	switch config.ReplayUntil {
+	case "":
+	case "now":
+		b.until = bson.MongoTimestamp(now.Unix()<<32 | math.MaxUint32)
+	default:
+		ts, err := parseReplayTimestamp(config.ReplayUntil)
+		if err != nil {
+			return nil, err
+		}
+		if ts <= math.MaxInt32 {
+			ts = ts << 32
+		}
+		b.until = bson.MongoTimestamp(ts)
 	}
-	if config.MongoConfigURL != "" {
-		config.MongoConfigURL = config.parseMongoURL(config.MongoConfigURL)
+	return b, nil
+}
+
+// filter sees every change event before the namespace filters.  Events past
+// the bound end the replay
+func (b *replayBound) filter(op *gtm.Op) bool {
+	if op.IsSourceOplog() {
+		atomic.AddInt64(&b.seen, 1)
+		if b.until != 0 && op.Timestamp > b.until {
+			b.stop()
+			return false
+		}
 	}
-	if config.HTTPServerAddr == "" {
-		config.HTTPServerAddr = ":8080"
+	return len(b.namespaces) == 0 || b.namespaces[op.Namespace]
+}
+
+// idle returns true once no change events were read in two checks after
+// the bound has passed.  An idle oplog has nothing left to replay
+func (b *replayBound) idle(now time.Time) bool {
+	if atomic.SwapInt64(&b.seen, 0) != 0 || b.until == 0 || now.Unix() <= int64(b.until>>32) {
+		b.idleChecks = 0
+		return false
 	}
-	if config.StatsIndexFormat == "" {
-		config.StatsIndexFormat = "monstache.stats.2006-01-02"
+	b.idleChecks++
+	return b.idleChecks >= 2
+}
+
+func (b *replayBound) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if b.idle(time.Now()) {
+			b.stop()
+			return
+		}
 	}
-	if config.TimeMachineIndexPrefix == "" {
-		config.TimeMachineIndexPrefix = "log"
+}
+
+func (b *replayBound) stop() {
+	if !atomic.CompareAndSwapInt32(&b.stopped, 0, 1) {
+		return
 	}
-	if config.TimeMachineIndexSuffix == "" {
-		config.TimeMachineIndexSuffix = "2006-01-02"
+	t := time.Unix(int64(b.until>>32), 0).UTC()
+	infoLog.Printf("Replayed the events up to %s", t.Format(time.RFC3339))
+	select {
+	case shutdownSigs <- syscall.SIGTERM:
+	default:
 	}
-	if config.DeleteIndexPattern == "" {
-		config.DeleteIndexPattern = "*"
+}
+
+// resumeToken is the saved resume position as written by resume export
+type resumeToken struct {
+	ResumeName string `json:"resume-name"`
+	Ts         int64  `json:"ts"`
+	Time       string `json:"time,omitempty"`
+}
+
+// exportResume writes the saved resume position to the file or to stdout
+func (config *configOptions) exportResume(path string) int {
+	mongo, err := config.dialMongo(config.MongoURL)
+	if err != nil {
+		errorLog.Printf("Unable to connect to MongoDB using URL %s: %s", cleanMongoURL(config.MongoURL), err)
+		return 1
 	}
-	if config.FileDownloaders == 0 && config.IndexFiles {
-		config.FileDownloaders = fileDownloadersDefault
+	defer mongo.Close()
+	token, err := config.savedResumeToken(mongo)
+	if err != nil {
+		errorLog.Printf("Unable to read resume position %s: %s", config.ResumeName, err)
+		return 1
 	}
-	if config.RelateThreads == 0 {
-		config.RelateThreads = relateThreadsDefault
+	b, _ := json.MarshalIndent(token, "", "  ")
+	b = append(b, '\n')
+	if path == "" || path == "-" {
+		_, err = os.Stdout.Write(b)
+	} else {
+		if strings.HasSuffix(path, ".zst") || config.DiskCompression == "zstd" {
+			b = zstdEncoder.EncodeAll(b, nil)
+		}
+		err = ioutil.WriteFile(path, b, 0644)
 	}
-	if config.RelateBuffer == 0 {
-		config.RelateBuffer = relateBufferDefault
+	if err != nil {
+		errorLog.Printf("Unable to write resume position: %s", err)
+		return 1
 	}
-	if config.PostProcessors == 0 && processPlugin != nil {
-		config.PostProcessors = postProcessorsDefault
+	return 0
+}
+
+// savedResumeToken reads the resume position saved under the resume name
+func (config *configOptions) savedResumeToken(mongo *mgo.Session) (*resumeToken, error) {
+	doc := make(map[string]interface{})
+	col := mongo.DB(config.ConfigDatabaseName).C("monstache")
+	if err := col.FindId(config.ResumeName).One(doc); err != nil {
+		return nil, err
 	}
-	if config.OplogTsFieldName == "" {
-		config.OplogTsFieldName = "oplog_ts"
+	ts, _ := doc["ts"].(bson.MongoTimestamp)
+	token := &resumeToken{ResumeName: config.ResumeName, Ts: int64(ts)}
+	if ts != 0 {
+		token.Time = time.Unix(int64(ts>>32), 0).UTC().Format(time.RFC3339)
 	}
-	if config.OplogDateFieldName == "" {
-		config.OplogDateFieldName = "oplog_date"
+	return token, nil
+}
+
+// readResumeToken reads a position written by resume export from the file
+// or from stdin
+func readResumeToken(path string) (*resumeToken, error) {
+	var b []byte
+	var err error
+	if path == "" || path == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(path)
 	}
-	if config.OplogDateFieldFormat == "" {
-		config.OplogDateFieldFormat = "2006/01/02 15:04:05"
+	if err == nil {
+		b, err = decompressDisk(b)
 	}
-	if config.ConfigDatabaseName == "" {
-		config.ConfigDatabaseName = configDatabaseNameDefault
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read resume position: %s", err)
 	}
-	if config.ResumeFromTimestamp > 0 {
-		if config.ResumeFromTimestamp <= math.MaxInt32 {
-			config.ResumeFromTimestamp = config.ResumeFromTimestamp << 32
-		}
+	var token resumeToken
+	if err = json.Unmarshal(b, &token); err != nil || token.Ts <= 0 {
+		return nil, fmt.Errorf("Invalid resume position in %s", path)
 	}
-	return config
+	return &token, nil
 }
 
-func cleanMongoURL(inURL string) string {
-	const scheme = "mongodb://"
-	const schemeSrv = "mongodb+srv://"
-	hasScheme := strings.HasPrefix(inURL, scheme)
-	hasSchemeSrv := strings.HasPrefix(inURL, schemeSrv)
-	url := strings.TrimPrefix(inURL, scheme)
-	url = strings.TrimPrefix(url, schemeSrv)
-	userEnd := strings.IndexAny(url, "@")
-	if userEnd != -1 {
-		url = redact + "@" + url[userEnd+1:]
+// importResume saves a position written by resume export under the
+// configured resume name, which may differ from the exported one
+func (config *configOptions) importResume(path string) int {
+	token, err := readResumeToken(path)
+	if err != nil {
+		errorLog.Println(err)
+		return 1
 	}
-	if hasScheme {
-		url = scheme + url
-	} else if hasSchemeSrv {
-		url = schemeSrv + url
+	mongo, err := config.dialMongo(config.MongoURL)
+	if err != nil {
+		errorLog.Printf("Unable to connect to MongoDB using URL %s: %s", cleanMongoURL(config.MongoURL), err)
+		return 1
 	}
-	return url
+	defer mongo.Close()
+	if err = saveTimestamp(mongo, bson.MongoTimestamp(token.Ts), config); err != nil {
+		errorLog.Printf("Unable to save resume position: %s", err)
+		return 1
+	}
+	infoLog.Printf("Saved resume position %d for %s", token.Ts, config.ResumeName)
+	return 0
 }
 
-func (config *configOptions) readClientCert() (*tls.Certificate, error) {
-	x509Settings := config.MongoX509Settings
-	// Read in the PEM encoded X509 certificate.
-	clientCertPEM, err := ioutil.ReadFile(x509Settings.ClientCertPemFile)
-	if err != nil {
-		return nil, err
+// verify compares each direct read collection with its Elasticsearch index
+// and returns the exit status.  Documents are mapped as they would be
+// indexed and compared by checksums over ranges of ids, in full or in the
+// verify-sample ranges starting at random ids.  The documents of ranges
+// whose checksums differ are compared one by one and the missing, extra and
+// mismatched ids are reported.  Nothing is modified.  Extra documents are
+// only found by a full comparison and counts are only comparable when a
+// collection is the sole source of its index.  With repair the missing and
+// stale documents are reindexed and the extra documents deleted
+func (config *configOptions) verify(repair bool) int {
+	client, err := config.newElasticClient()
+	if err == nil {
+		err = config.testElasticsearchConn(client)
 	}
-	// Read in the PEM encoded private key.
-	clientKeyPEM, err := ioutil.ReadFile(x509Settings.ClientKeyPemFile)
 	if err != nil {
-		return nil, err
+		errorLog.Printf("Unable to connect to Elasticsearch: %s", err)
+		return 1
 	}
-	// Parse the private key, and the public key contained within the
-	// certificate.
-	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	mongo, err := config.dialMongo(config.MongoURL)
 	if err != nil {
-		return nil, err
+		errorLog.Printf("Unable to connect to MongoDB using URL %s: %s", cleanMongoURL(config.MongoURL), err)
+		return 1
 	}
-	// Parse the actual certificate data
-	clientCert.Leaf, err = x509.ParseCertificate(clientCert.Certificate[0])
+	defer mongo.Close()
+	namespaces, err := expandNamespaces(mongo, config.DirectReadNs)
 	if err != nil {
-		return nil, err
+		errorLog.Println(err)
+		return 1
+	}
+	if len(namespaces) == 0 {
+		errorLog.Println("Verify requires direct-read-namespaces")
+		return 1
+	}
+	var reports []*verifyReport
+	mismatched, failed := 0, 0
+	for _, ns := range namespaces {
+		v := &verifier{config: config, mongo: mongo, client: client}
+		if repair {
+			v.repair = &repairer{
+				apply: config.RepairApply,
+				size:  config.RepairBatchSize,
+				rate:  config.RepairRate,
+				bulk:  client.Bulk(),
+			}
+		}
+		started := time.Now()
+		report, err := v.run(ns)
+		if err == nil && v.repair != nil {
+			err = v.repair.flush()
+		}
+		if err != nil {
+			errorLog.Printf("Unable to verify namespace %s: %s", ns, err)
+			return 1
+		}
+		report.Command = "verify"
+		if repair {
+			report.Command = "repair"
+		}
+		report.Started, report.Finished = started.UTC(), time.Now().UTC()
+		report.DurationMs = int64(report.Finished.Sub(report.Started) / time.Millisecond)
+		report.Synced = report.synced()
+		reports = append(reports, report)
+		if v.repair != nil && report.ReindexCount+report.DeleteCount > 0 {
+			if config.RepairApply {
+				failed += v.repair.failed
+				infoLog.Printf("Repaired namespace %s by reindexing %d and deleting %d documents. %d failed",
+					ns, report.ReindexCount, report.DeleteCount, v.repair.failed)
+			} else {
+				infoLog.Printf("Dry run: repairing namespace %s would reindex %d and delete %d documents",
+					ns, report.ReindexCount, report.DeleteCount)
+			}
+		}
+		if report.synced() {
+			infoLog.Printf("Namespace %s and index %s both have %d documents and %d checked documents match",
+				ns, report.Index, report.Documents, report.Checked)
+			continue
+		}
+		mismatched++
+		warnLog.Printf("Namespace %s has %d documents and index %s has %d. Of %d checked documents %d are missing, %d extra and %d mismatched",
+			ns, report.Documents, report.Index, report.Indexed, report.Checked,
+			report.MissingCount, report.ExtraCount, report.MismatchedCount)
+	}
+	if config.VerifyReport != "" {
+		var buf bytes.Buffer
+		err := writeVerifyReports(&buf, config.VerifyReportFormat, reports)
+		if err == nil {
+			err = ioutil.WriteFile(config.VerifyReport, buf.Bytes(), 0644)
+		}
+		if err != nil {
+			errorLog.Printf("Unable to write verify report to %s: %s", config.VerifyReport, err)
+			return 1
+		}
+		infoLog.Printf("Wrote verify report to %s", config.VerifyReport)
+	}
+	if config.VerifyReportIndex != "" {
+		if err := config.indexVerifyReports(client, reports); err != nil {
+			errorLog.Printf("Unable to index verify report in %s: %s", config.VerifyReportIndex, err)
+			return 1
+		}
+		infoLog.Printf("Indexed verify report in %s", config.VerifyReportIndex)
+	}
+	if repair && config.RepairApply {
+		if failed > 0 {
+			errorLog.Printf("Repair failed for %d documents", failed)
+			return 1
+		}
+		infoLog.Printf("Repaired %d of %d namespaces", mismatched, len(namespaces))
+		return 0
+	}
+	if mismatched > 0 {
+		if repair {
+			infoLog.Println("Run repair with repair-apply to make the changes reported")
+		}
+		errorLog.Printf("Verify found %d of %d namespaces out of sync", mismatched, len(namespaces))
+		return 1
 	}
-	return &clientCert, nil
+	infoLog.Println("Verify passed")
+	return 0
 }
 
-func (config *configOptions) timeoutConnection(inURL string, mongoOk chan bool) {
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
-	defer signal.Stop(sigs)
-	deadline := time.Duration(config.MongoDialSettings.Timeout) * time.Second
-	connT := time.NewTicker(deadline)
-	defer connT.Stop()
-	select {
-	case <-mongoOk:
-		return
-	case <-sigs:
-		os.Exit(exitStatus)
-	case <-connT.C:
-		errorLog.Fatalf("Unable to connect to MongoDB using URL %s: timed out after %d seconds",
-			cleanMongoURL(inURL), config.MongoDialSettings.Timeout)
+// writeVerifyReports writes the reports as a JSON array or as CSV with a row
+// per namespace.  In CSV the ids of each kind are separated by spaces
+func writeVerifyReports(w io.Writer, format string, reports []*verifyReport) error {
+	if format != "csv" {
+		data, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
 	}
+	out := csv.NewWriter(w)
+	out.Write([]string{"namespace", "index", "command", "started", "finished", "durationMs", "synced",
+		"documents", "indexed", "checked", "missingCount", "extraCount", "mismatchedCount",
+		"reindexCount", "deleteCount", "missing", "extra", "mismatched"})
+	for _, r := range reports {
+		var mismatched []string
+		for _, m := range r.Mismatched {
+			mismatched = append(mismatched, m.ID)
+		}
+		out.Write([]string{r.Namespace, r.Index, r.Command,
+			r.Started.Format(time.RFC3339), r.Finished.Format(time.RFC3339),
+			strconv.FormatInt(r.DurationMs, 10), strconv.FormatBool(r.Synced),
+			strconv.Itoa(r.Documents), strconv.FormatInt(r.Indexed, 10), strconv.Itoa(r.Checked),
+			strconv.Itoa(r.MissingCount), strconv.Itoa(r.ExtraCount), strconv.Itoa(r.MismatchedCount),
+			strconv.Itoa(r.ReindexCount), strconv.Itoa(r.DeleteCount),
+			strings.Join(r.Missing, " "), strings.Join(r.Extra, " "), strings.Join(mismatched, " ")})
+	}
+	out.Flush()
+	return out.Error()
 }
 
-func (config *configOptions) dialMongo(inURL string) (*mgo.Session, error) {
-	var x509Cert *x509.Certificate
-	dialInfo, err := mgo.ParseURL(inURL)
+// indexVerifyReports records a document per namespace report
+func (config *configOptions) indexVerifyReports(client *elastic.Client, reports []*verifyReport) error {
+	index, typeName := strings.ToLower(config.VerifyReportIndex), "verify"
+	if config.useTypelessAPI() {
+		typeName = ""
+	} else if config.useTypeFromFuture() {
+		typeName = typeFromFuture
+	}
+	bulk := client.Bulk()
+	for _, r := range reports {
+		req := elastic.NewBulkIndexRequest().Index(index).Doc(r)
+		if typeName != "" {
+			req.Type(typeName)
+		}
+		bulk.Add(req)
+	}
+	res, err := bulk.Do(context.Background())
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if mongoDialInfo == nil {
-		// save the initial dial info so that it can be reused
-		// if connecting to shards
-		mongoDialInfo = dialInfo.Copy()
-	} else {
-		// copy the initial auth info when connecting to shards
-		dialInfo.Username = mongoDialInfo.Username
-		dialInfo.Password = mongoDialInfo.Password
-		dialInfo.Source = mongoDialInfo.Source
-		dialInfo.Mechanism = mongoDialInfo.Mechanism
+	if failed := res.Failed(); len(failed) > 0 {
+		return fmt.Errorf("%d of %d reports failed", len(failed), len(reports))
 	}
-	dialInfo.AppName = "monstache"
-	dialInfo.Timeout = time.Duration(0)
-	dialInfo.ReadTimeout = time.Duration(config.MongoDialSettings.ReadTimeout) * time.Second
-	dialInfo.WriteTimeout = time.Duration(config.MongoDialSettings.WriteTimeout) * time.Second
-	ssl := config.MongoDialSettings.Ssl || config.MongoPemFile != ""
-	if ssl {
-		tlsConfig := &tls.Config{}
-		// Check to see if we don't need to validate the PEM
-		if config.MongoValidatePemFile == false {
-			// Turn off validation
-			tlsConfig.InsecureSkipVerify = true
+	return nil
+}
+
+// expandNamespaces replaces the databases among namespaces with their
+// collections
+func expandNamespaces(mongo *mgo.Session, names []string) (namespaces []string, err error) {
+	for _, ns := range names {
+		if strings.Contains(ns, ".") {
+			namespaces = append(namespaces, ns)
+			continue
 		}
-		certs := x509.NewCertPool()
-		if config.MongoPemFile != "" {
-			if ca, err := ioutil.ReadFile(config.MongoPemFile); err == nil {
-				if ok := certs.AppendCertsFromPEM(ca); !ok {
-					errorLog.Printf("No certs parsed successfully from %s", config.MongoPemFile)
-				}
-			} else {
-				return nil, err
-			}
-			tlsConfig.RootCAs = certs
+		var colls []string
+		if colls, err = mongo.DB(ns).CollectionNames(); err != nil {
+			return nil, fmt.Errorf("Unable to list collections of %s: %s", ns, err)
 		}
-		if config.MongoX509Settings.enabled() {
-			clientCert, err := config.readClientCert()
-			if err != nil {
-				return nil, err
-			}
-			x509Cert = clientCert.Leaf
-			if tlsConfig.InsecureSkipVerify {
-				certs.AddCert(x509Cert)
-				tlsConfig.RootCAs = certs
-			} else {
-				tlsConfig.Certificates = []tls.Certificate{*clientCert}
+		for _, name := range colls {
+			if !strings.HasPrefix(name, "system.") {
+				namespaces = append(namespaces, ns+"."+name)
 			}
 		}
-		dialInfo.DialServer = func(addr *mgo.ServerAddr) (net.Conn, error) {
-			conn, err := tls.Dial("tcp", addr.String(), tlsConfig)
-			if err != nil {
-				errorLog.Printf("Unable to dial MongoDB: %s", err)
-			}
-			return conn, err
+	}
+	return
+}
+
+// run compares a namespace with its index
+func (v *verifier) run(ns string) (report *verifyReport, err error) {
+	dot := strings.Index(ns, ".")
+	coll := v.mongo.DB(ns[:dot]).C(ns[dot+1:])
+	index := indexPattern(mapIndexType(v.config, &gtm.Op{Namespace: ns}).Index)
+	report = &verifyReport{Namespace: ns, Index: index}
+	v.report = report
+	if report.Documents, err = coll.Count(); err != nil {
+		return
+	}
+	if report.Indexed, err = v.client.Count(index).Query(liveDocuments(ns)).Do(context.Background()); err != nil {
+		if !elastic.IsNotFound(err) {
+			return
 		}
+		err = nil
 	}
-	mongoOk := make(chan bool)
-	if config.MongoDialSettings.Timeout != 0 {
-		go config.timeoutConnection(inURL, mongoOk)
+	if v.config.VerifySample == 0 {
+		v.seen = make(map[string]bool)
+		iter := coll.Find(nil).Sort("_id").Batch(verifyRangeSize).Iter()
+		if err = v.compareRanges(ns, iter, 0); err != nil {
+			return
+		}
+		err = v.findExtra(ns, index)
+		return
 	}
-	session, err := mgo.DialWithInfo(dialInfo)
-	close(mongoOk)
-	if err == nil {
-		session.SetSyncTimeout(time.Duration(config.MongoSessionSettings.SyncTimeout) * time.Second)
+	var starts []bson.M
+	sample := []bson.M{{"$sample": bson.M{"size": v.config.VerifySample}}, {"$project": bson.M{"_id": 1}}}
+	if err = coll.Pipe(sample).All(&starts); err != nil {
+		return
 	}
-	if x509Cert != nil {
-		cred := &mgo.Credential{Mechanism: "MONGODB-X509", Certificate: x509Cert}
-		if err := session.Login(cred); err != nil {
-			return nil, err
+	for _, start := range starts {
+		iter := coll.Find(bson.M{"_id": bson.M{"$gte": start["_id"]}}).Sort("_id").Limit(verifyRangeSize).Iter()
+		if err = v.compareRanges(ns, iter, verifyRangeSize); err != nil {
+			return
 		}
 	}
-	return session, err
+	return
 }
 
-func (config *configOptions) NewHTTPClient() (client *http.Client, err error) {
-	tlsConfig := &tls.Config{}
-	if config.ElasticPemFile != "" {
-		var ca []byte
-		certs := x509.NewCertPool()
-		if ca, err = ioutil.ReadFile(config.ElasticPemFile); err == nil {
-			if ok := certs.AppendCertsFromPEM(ca); !ok {
-				errorLog.Printf("No certs parsed successfully from %s", config.ElasticPemFile)
+// compareRanges compares the documents read by iter in ranges of
+// verifyRangeSize ids.  A positive limit stops after that many documents
+func (v *verifier) compareRanges(ns string, iter *mgo.Iter, limit int) error {
+	var docs []map[string]interface{}
+	read := 0
+	for {
+		doc := make(map[string]interface{})
+		if !iter.Next(&doc) {
+			break
+		}
+		docs = append(docs, doc)
+		read++
+		if len(docs) == verifyRangeSize {
+			if err := v.compareRange(ns, docs); err != nil {
+				iter.Close()
+				return err
 			}
-			tlsConfig.RootCAs = certs
-		} else {
-			return client, err
+			docs = nil
+		}
+		if limit > 0 && read == limit {
+			break
 		}
 	}
-	if config.ElasticValidatePemFile == false {
-		// Turn off validation
-		tlsConfig.InsecureSkipVerify = true
-	}
-	transport := &http.Transport{
-		DisableCompression:  !config.Gzip,
-		TLSHandshakeTimeout: time.Duration(30) * time.Second,
-		TLSClientConfig:     tlsConfig,
-	}
-	client = &http.Client{
-		Timeout:   time.Duration(config.ElasticClientTimeout) * time.Second,
-		Transport: transport,
+	if err := iter.Close(); err != nil {
+		return err
 	}
-	if config.AWSConnect.enabled() {
-		client = aws.NewV4SigningClientWithHTTPClient(credentials.NewStaticCredentials(
-			config.AWSConnect.AccessKey,
-			config.AWSConnect.SecretKey,
-			"",
-		), config.AWSConnect.Region, client)
+	if len(docs) > 0 {
+		return v.compareRange(ns, docs)
 	}
-	return client, err
+	return nil
 }
 
-func doDrop(mongo *mgo.Session, elastic *elastic.Client, op *gtm.Op, config *configOptions) (err error) {
-	if db, drop := op.IsDropDatabase(); drop {
-		if config.DroppedDatabases {
-			if err = deleteIndexes(elastic, db, config); err == nil {
-				if e := dropDBMeta(mongo, db, config); e != nil {
-					errorLog.Printf("Unable to delete metadata for db: %s", e)
+// compareRange maps a range of documents as they would be indexed and
+// compares the checksum of the range with the checksum of the documents in
+// Elasticsearch.  Only ranges whose checksums differ are compared by document
+func (v *verifier) compareRange(ns string, docs []map[string]interface{}) error {
+	type expectation struct {
+		id      string
+		index   string
+		routing string
+		doc     interface{}
+		compare interface{}
+		req     elastic.BulkableRequest
+	}
+	hashField := v.config.ContentHashField
+	var expected []*expectation
+	mget := v.client.Mget().Realtime(false)
+	for _, doc := range docs {
+		op := &gtm.Op{
+			Id:        doc["_id"],
+			Namespace: ns,
+			Operation: "i",
+			Data:      doc,
+			Source:    gtm.DirectQuerySource,
+		}
+		objectID := opIDToString(op)
+		if err := mapData(v.mongo, v.config, op); err != nil {
+			return fmt.Errorf("Unable to map document %s: %s", objectID, err)
+		}
+		exp := &expectation{id: objectID}
+		item := elastic.NewMultiGetItem().Id(objectID).FetchSource(elastic.NewFetchSourceContext(true))
+		if hashField != "" {
+			item.FetchSource(elastic.NewFetchSourceContext(true).Include(hashField))
+		}
+		indexType := mapIndexType(v.config, op)
+		exp.index = indexType.Index
+		if op.Data != nil {
+			if meta, ok := transformDocument(v.config, op); ok && !meta.Skip {
+				exp.id, exp.index = meta.idOr(objectID), meta.indexOr(indexType.Index)
+				exp.routing = meta.Routing
+				exp.doc = indexedDocument(v.config, op)
+				exp.compare = exp.doc
+				if hashField != "" && exp.doc != nil {
+					exp.compare = map[string]interface{}{hashField: op.Data[hashField]}
+				}
+				item.Id(exp.id)
+				if meta.Routing != "" {
+					item.Routing(meta.Routing)
+				}
+				if v.repair != nil {
+					req := elastic.NewBulkIndexRequest().Index(exp.index).Id(exp.id).Doc(exp.doc)
+					if !v.config.useTypelessAPI() {
+						req.Type(indexType.Type)
+						if meta.Type != "" {
+							req.Type(meta.Type)
+						}
+					}
+					if meta.Routing != "" {
+						req.Routing(meta.Routing)
+					}
+					if meta.Pipeline != "" {
+						req.Pipeline(meta.Pipeline)
+					}
+					exp.req = req
 				}
 			}
 		}
-	} else if col, drop := op.IsDropCollection(); drop {
-		if config.DroppedCollections {
-			if err = deleteIndex(elastic, op.GetDatabase()+"."+col, config); err == nil {
-				if e := dropCollectionMeta(mongo, op.GetDatabase()+"."+col, config); e != nil {
-					errorLog.Printf("Unable to delete metadata for collection: %s", e)
+		if !v.config.useTypelessAPI() {
+			item.Type(indexType.Type)
+		}
+		item.Index(exp.index)
+		mget.Add(item)
+		expected = append(expected, exp)
+		if v.seen != nil {
+			v.seen[exp.id] = true
+		}
+	}
+	res, err := mget.Do(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(res.Docs) != len(expected) {
+		return fmt.Errorf("Expected %d documents from Elasticsearch but got %d", len(expected), len(res.Docs))
+	}
+	actual := make([]interface{}, len(expected))
+	var want, got [sha256.Size]byte
+	for i, exp := range expected {
+		if d := res.Docs[i]; d.Found && d.Source != nil {
+			actual[i] = d.Source
+		}
+		verifyChecksum(&want, exp.id, exp.compare)
+		verifyChecksum(&got, exp.id, actual[i])
+	}
+	v.report.Checked += len(docs)
+	v.report.Ranges++
+	if want == got {
+		return nil
+	}
+	v.report.DifferingRanges++
+	for i, exp := range expected {
+		switch {
+		case exp.doc == nil && actual[i] == nil:
+		case actual[i] == nil:
+			v.report.MissingCount++
+			v.report.Missing = appendVerifyID(v.report.Missing, exp.id)
+			if err := v.reindex(exp.req); err != nil {
+				return err
+			}
+		case exp.doc == nil:
+			v.report.ExtraCount++
+			v.report.Extra = appendVerifyID(v.report.Extra, exp.id)
+			if err := v.delete(exp.index, exp.id, exp.routing); err != nil {
+				return err
+			}
+		default:
+			diff, err := compareShadow(exp.compare, actual[i])
+			if err != nil {
+				return err
+			}
+			if diff != nil {
+				v.report.MismatchedCount++
+				if len(v.report.Mismatched) < verifyReportMaxIds {
+					v.report.Mismatched = append(v.report.Mismatched, &verifyMismatch{ID: exp.id, shadowDiff: diff})
+				}
+				if err := v.reindex(exp.req); err != nil {
+					return err
 				}
 			}
 		}
 	}
-	return
+	return nil
 }
 
-func hasFileContent(op *gtm.Op, config *configOptions) (ingest bool) {
-	if !config.IndexFiles {
-		return
+// reindex repairs a missing or stale document
+func (v *verifier) reindex(req elastic.BulkableRequest) error {
+	if v.repair == nil {
+		return nil
 	}
-	return fileNamespaces[op.Namespace]
+	v.report.ReindexCount++
+	return v.repair.add(req)
 }
 
-func addPatch(config *configOptions, client *elastic.Client, op *gtm.Op,
-	objectID string, indexType *indexTypeMapping, meta *indexingMeta) (err error) {
-	var merges []interface{}
-	var toJSON []byte
-	if op.IsSourceDirect() {
+// delete repairs a document which no longer exists in MongoDB
+func (v *verifier) delete(index, id, routing string) error {
+	if v.repair == nil {
 		return nil
 	}
-	if op.Timestamp == 0 {
+	v.report.DeleteCount++
+	req := elastic.NewBulkDeleteRequest().Index(index).Id(id)
+	if !v.config.useTypelessAPI() {
+		req.Type(mapIndexType(v.config, &gtm.Op{Namespace: v.report.Namespace}).Type)
+	}
+	if routing != "" {
+		req.Routing(routing)
+	}
+	return v.repair.add(req)
+}
+
+// add queues a repair and sends the queue once it holds a batch.  In a dry
+// run nothing is sent
+func (r *repairer) add(req elastic.BulkableRequest) error {
+	if !r.apply {
 		return nil
 	}
-	if op.IsUpdate() {
-		ctx := context.Background()
-		service := client.Get()
-		service.Id(objectID)
-		service.Index(indexType.Index)
-		service.Type(indexType.Type)
-		if meta.ID != "" {
-			service.Id(meta.ID)
-		}
-		if meta.Index != "" {
-			service.Index(meta.Index)
-		}
-		if meta.Type != "" {
-			service.Type(meta.Type)
+	r.bulk.Add(req)
+	if r.bulk.NumberOfActions() >= r.size {
+		return r.flush()
+	}
+	return nil
+}
+
+// flush sends the queued repairs.  Batches are spaced so that no more than
+// repair-rate documents are sent per second
+func (r *repairer) flush() error {
+	n := r.bulk.NumberOfActions()
+	if n == 0 {
+		return nil
+	}
+	if r.rate > 0 {
+		wait := time.Duration(n) * time.Second / time.Duration(r.rate)
+		if d := time.Until(r.last.Add(wait)); d > 0 {
+			time.Sleep(d)
 		}
-		if meta.Routing != "" {
-			service.Routing(meta.Routing)
+	}
+	res, err := r.bulk.Do(context.Background())
+	r.last = time.Now()
+	if err != nil {
+		return err
+	}
+	for _, item := range res.Failed() {
+		r.failed++
+		reason := ""
+		if item.Error != nil {
+			reason = item.Error.Reason
 		}
-		if meta.Parent != "" {
-			service.Parent(meta.Parent)
+		errorLog.Printf("Unable to repair document %s in %s: %s", item.Id, item.Index, reason)
+	}
+	return nil
+}
+
+// findExtra reports the documents in the index whose ids were not compared.
+// Ids are matched without the index which may be an alias.  Tombstones are
+// not extra
+func (v *verifier) findExtra(ns, index string) error {
+	scroll := v.client.Scroll(index).Query(liveDocuments(ns)).FetchSource(false).Size(1000)
+	defer scroll.Clear(context.Background())
+	for {
+		results, err := scroll.Do(context.Background())
+		if err == io.EOF {
+			return nil
 		}
-		var resp *elastic.GetResult
-		if resp, err = service.Do(ctx); err == nil {
-			if resp.Found {
-				var src map[string]interface{}
-				if err = json.Unmarshal(*resp.Source, &src); err == nil {
-					if val, ok := src[config.MergePatchAttr]; ok {
-						merges = val.([]interface{})
-						for _, m := range merges {
-							entry := m.(map[string]interface{})
-							entry["ts"] = int(entry["ts"].(float64))
-							entry["v"] = int(entry["v"].(float64))
-						}
-					}
-					delete(src, config.MergePatchAttr)
-					var fromJSON, mergeDoc []byte
-					if fromJSON, err = json.Marshal(src); err == nil {
-						if toJSON, err = json.Marshal(op.Data); err == nil {
-							if mergeDoc, err = jsonpatch.CreateMergePatch(fromJSON, toJSON); err == nil {
-								merge := make(map[string]interface{})
-								merge["ts"] = op.Timestamp >> 32
-								merge["p"] = string(mergeDoc)
-								merge["v"] = len(merges) + 1
-								merges = append(merges, merge)
-								op.Data[config.MergePatchAttr] = merges
-							}
-						}
-					}
-				}
-			} else {
-				err = errors.New("Last document revision not found")
+		if err != nil {
+			if elastic.IsNotFound(err) {
+				return nil
 			}
-
+			return err
 		}
-	} else {
-		if _, found := op.Data[config.MergePatchAttr]; !found {
-			if toJSON, err = json.Marshal(op.Data); err == nil {
-				merge := make(map[string]interface{})
-				merge["v"] = 1
-				merge["ts"] = op.Timestamp >> 32
-				merge["p"] = string(toJSON)
-				merges = append(merges, merge)
-				op.Data[config.MergePatchAttr] = merges
+		for _, hit := range results.Hits.Hits {
+			if !v.seen[hit.Id] {
+				v.report.ExtraCount++
+				v.report.Extra = appendVerifyID(v.report.Extra, hit.Id)
+				if err := v.delete(hit.Index, hit.Id, hit.Routing); err != nil {
+					return err
+				}
 			}
 		}
 	}
-	return
 }
 
-func doIndexing(config *configOptions, mongo *mgo.Session, bulk *elastic.BulkProcessor, client *elastic.Client, op *gtm.Op) (err error) {
-	meta := parseIndexMeta(op)
-	if meta.Skip {
+// verifyChecksum adds a document to the checksum of a range.  Documents are
+// compared by their canonical JSON so the order of the fields and of the
+// documents does not matter
+func verifyChecksum(sum *[sha256.Size]byte, id string, doc interface{}) {
+	if doc == nil {
 		return
 	}
-	prepareDataForIndexing(config, op)
-	objectID, indexType := opIDToString(op), mapIndexType(config, op)
-	if config.EnablePatches {
-		if patchNamespaces[op.Namespace] {
-			if e := addPatch(config, client, op, objectID, indexType, meta); e != nil {
-				errorLog.Printf("Unable to save json-patch info: %s", e)
-			}
+	var canonical interface{}
+	if data, err := json.Marshal(doc); err == nil {
+		json.Unmarshal(data, &canonical)
+	}
+	data, _ := json.Marshal(canonical)
+	h := sha256.New()
+	h.Write([]byte(id))
+	h.Write([]byte{0})
+	h.Write(data)
+	for i, b := range h.Sum(nil) {
+		sum[i] ^= b
+	}
+}
+
+func appendVerifyID(ids []string, id string) []string {
+	if len(ids) < verifyReportMaxIds {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (report *verifyReport) synced() bool {
+	return int64(report.Documents) == report.Indexed &&
+		report.MissingCount+report.ExtraCount+report.MismatchedCount == 0
+}
+
+var errSweepStopped = errors.New("Orphan sweep stopped")
+
+// start sweeps the indexes every interval until stop is called
+func (o *orphanSweeper) start() {
+	if o == nil {
+		return
+	}
+	o.stopC, o.doneC = make(chan bool), make(chan bool)
+	go o.run()
+}
+
+// stop stops sweeping and waits for a sweep in progress to end
+func (o *orphanSweeper) stop() {
+	if o == nil || o.stopC == nil {
+		return
+	}
+	close(o.stopC)
+	<-o.doneC
+	o.stopC = nil
+}
+
+func (o *orphanSweeper) run() {
+	defer close(o.doneC)
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			o.sweep()
+		case <-o.stopC:
+			return
 		}
 	}
-	ingestAttachment := false
-	if hasFileContent(op, config) {
-		ingestAttachment = op.Data["file"] != nil
+}
+
+func (o *orphanSweeper) stopped() bool {
+	select {
+	case <-o.stopC:
+		return true
+	default:
+		return !bulkState.active()
 	}
-	if config.IndexAsUpdate && meta.Pipeline == "" && ingestAttachment == false {
-		req := elastic.NewBulkUpdateRequest()
-		req.UseEasyJSON(config.EnableEasyJSON)
-		req.Id(objectID)
-		req.Index(indexType.Index)
-		req.Type(indexType.Type)
-		req.Doc(op.Data)
-		req.DocAsUpsert(true)
-		if meta.ID != "" {
-			req.Id(meta.ID)
+}
+
+// sweep looks for orphans in the index of each synced collection.  An index
+// shared by several collections is skipped because its ids cannot be told
+// apart
+func (o *orphanSweeper) sweep() {
+	if o.stopped() {
+		return
+	}
+	session := o.mongo.Copy()
+	defer session.Close()
+	names := append(append([]string{}, o.config.DirectReadNs...), o.config.ChangeStreamNs...)
+	namespaces, err := expandNamespaces(session, names)
+	if err != nil {
+		errorLog.Printf("Unable to sweep orphans: %s", err)
+		return
+	}
+	indexes := make(map[string][]string)
+	for _, ns := range namespaces {
+		if !partition.owns(ns) {
+			continue
 		}
-		if meta.Index != "" {
-			req.Index(meta.Index)
+		index := indexPattern(mapIndexType(o.config, &gtm.Op{Namespace: ns}).Index)
+		indexes[index] = append(indexes[index], ns)
+	}
+	for index, nss := range indexes {
+		if len(nss) > 1 {
+			warnLog.Printf("Skipping orphan sweep of index %s shared by %s", index, strings.Join(nss, ", "))
+			continue
 		}
-		if meta.Type != "" {
-			req.Type(meta.Type)
+		checked, deleted, err := o.sweepIndex(session, nss[0], index)
+		if err == errSweepStopped {
+			return
 		}
-		if meta.Routing != "" {
-			req.Routing(meta.Routing)
+		if err != nil {
+			errorLog.Printf("Unable to sweep orphans of index %s: %s", index, err)
+			continue
 		}
-		if meta.Parent != "" {
-			req.Parent(meta.Parent)
+		if deleted > 0 {
+			infoLog.Printf("Deleted %d orphans of %d documents in index %s", deleted, checked, index)
 		}
-		if meta.RetryOnConflict != 0 {
-			req.RetryOnConflict(meta.RetryOnConflict)
+	}
+}
+
+// sweepIndex scrolls the ids of an index and deletes those whose documents
+// no longer exist in the collection.  The deletes are versioned at the time
+// the batch is checked so that a document recreated since is not deleted.
+// A batch which is mostly orphans suggests ids which are not mapped from _id
+// and stops the sweep of the index
+func (o *orphanSweeper) sweepIndex(session *mgo.Session, ns, index string) (checked, deleted int, err error) {
+	dot := strings.Index(ns, ".")
+	coll := session.DB(ns[:dot]).C(ns[dot+1:])
+	scroll := o.client.Scroll(index).Query(liveDocuments(ns)).FetchSource(false).Size(o.config.OrphanSweepBatchSize)
+	defer scroll.Clear(context.Background())
+	for {
+		if o.stopped() {
+			return checked, deleted, errSweepStopped
 		}
-		if _, err = req.Source(); err == nil {
-			bulk.Add(req)
+		var results *elastic.SearchResult
+		if results, err = scroll.Do(context.Background()); err != nil {
+			if err == io.EOF || elastic.IsNotFound(err) {
+				err = nil
+			}
+			return
 		}
-	} else {
-		req := elastic.NewBulkIndexRequest()
-		req.UseEasyJSON(config.EnableEasyJSON)
-		req.Id(objectID)
-		req.Index(indexType.Index)
-		req.Type(indexType.Type)
-		req.Doc(op.Data)
-		if meta.ID != "" {
-			req.Id(meta.ID)
+		version := int64(bson.MongoTimestamp(time.Now().Unix() << 32))
+		var ids []interface{}
+		for _, hit := range results.Hits.Hits {
+			ids = append(ids, orphanIDCandidates(hit.Id)...)
 		}
-		if meta.Index != "" {
-			req.Index(meta.Index)
+		var found []bson.M
+		if err = coll.Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"_id": 1}).All(&found); err != nil {
+			return
 		}
-		if meta.Type != "" {
-			req.Type(meta.Type)
+		exists := make(map[string]bool, len(found))
+		for _, doc := range found {
+			exists[opIDToString(&gtm.Op{Id: doc["_id"]})] = true
 		}
-		if meta.Routing != "" {
-			req.Routing(meta.Routing)
+		var orphans []*elastic.SearchHit
+		for _, hit := range results.Hits.Hits {
+			if !exists[hit.Id] {
+				orphans = append(orphans, hit)
+			}
 		}
-		if meta.Parent != "" {
-			req.Parent(meta.Parent)
+		checked += len(results.Hits.Hits)
+		if len(orphans) > 0 && len(orphans)*2 > len(results.Hits.Hits) {
+			err = fmt.Errorf("%d of %d documents have no match by _id in %s. Stopping in case the ids are mapped", len(orphans), len(results.Hits.Hits), ns)
+			return
 		}
-		if meta.Version != 0 {
-			req.Version(meta.Version)
+		for _, hit := range orphans {
+			req := elastic.NewBulkDeleteRequest()
+			req.UseEasyJSON(o.config.EnableEasyJSON)
+			req.Index(hit.Index)
+			req.Id(hit.Id)
+			if !o.config.useTypelessAPI() {
+				req.Type(hit.Type)
+			}
+			if hit.Routing != "" {
+				req.Routing(hit.Routing)
+			}
+			if o.config.IndexAsUpdate == false && versionFields[ns] == nil {
+				req.Version(version)
+				req.VersionType("external")
+			}
+			if !bulkState.add(o.bulk, req) {
+				return checked, deleted, errSweepStopped
+			}
+			deleted++
 		}
-		if meta.VersionType != "" {
-			req.VersionType(meta.VersionType)
+	}
+}
+
+// orphanIDCandidates returns the _id values an id in Elasticsearch may have
+// been mapped from
+func orphanIDCandidates(id string) []interface{} {
+	candidates := []interface{}{id}
+	if docID := documentID(id); docID != id {
+		candidates = append(candidates, docID)
+	}
+	return candidates
+}
+
+// configInitSkipped are fields of configOptions which are not read from the
+// config file
+var configInitSkipped = map[string]bool{
+	"EnableTemplate":         true,
+	"EnvDelimiter":           true,
+	"ConfigFile":             true,
+	"Version":                true,
+	"Print":                  true,
+	"ElasticMajorVersion":    true,
+	"ElasticMinorVersion":    true,
+	"OpenSearchMajorVersion": true,
+	"OpenSearchMinorVersion": true,
+	"PreviewNamespaces":      true,
+	"PreviewSize":            true,
+}
+
+// optionDescriptions describe the options which have no command line flag.
+// The other options are described by the usage of their flag
+var optionDescriptions = map[string]string{
+	"mongo-dial-settings":    "Timeouts in seconds, TLS, pool sizes and read preference of connections to MongoDB",
+	"mongo-session-settings": "Socket and sync timeouts in seconds of MongoDB sessions",
+	"mongo-x509-settings":    "Client certificate and key for X509 authentication to MongoDB. Either may be a path or inline PEM",
+	"gtm-settings":           "Sizes of the buffers between the change stream reader and the indexers and change stream cursor settings",
+	"aws-connect":            "Credentials and region used to sign requests to Amazon Elasticsearch Service or OpenSearch",
+	"kafka-sink":             "Publish changes to Kafka through a Confluent REST Proxy",
+	"redis-sink":             "Keep documents in Redis under namespace:id keys",
+	"notification-sink":      "Send changes to an SQS queue or an SNS topic",
+	"webhook-sink":           "POST batches of changes to an HTTP endpoint",
+	"archive-sink":           "Archive changes as gzipped NDJSON objects in S3",
+	"meilisearch-sink":       "Index documents in Meilisearch",
+	"typesense-sink":         "Index documents in Typesense",
+	"postgres-sink":          "Keep documents as jsonb rows in PostgreSQL",
+	"nats-sink":              "Publish changes to NATS JetStream subjects derived from the namespace",
+	"logs":                   "Files to write the info, warn, error, trace and stats logs to",
+	"elasticsearch-healthcheck-timeout-startup": "Number of seconds to wait for Elasticsearch to respond at startup",
+	"elasticsearch-healthcheck-timeout":         "Number of seconds to wait for Elasticsearch to respond to health checks",
+	"chaos":                                     "Inject MongoDB read errors, Elasticsearch 429 and 503 responses, plugin timeouts and pauses at random to test recovery. Never use in production",
+	"csfle":                                     "Decrypt or strip fields encrypted by client-side field level encryption before mapping. Data keys are unwrapped with a local master key or AWS KMS",
+	"mongo-kerberos-settings":                   "Principal and password or keytab for GSSAPI (Kerberos) authentication to MongoDB. Requires a build with -tags sasl",
+	"script":                                    "JavaScript which maps the documents of a namespace",
+	"filter":                                    "JavaScript which decides whether the documents of a namespace are indexed",
+	"pipeline":                                  "JavaScript which returns an aggregation pipeline for a namespace",
+	"mapping":                                   "Index and type overrides for a namespace",
+	"index-template":                            "Index template installed in Elasticsearch at startup",
+	"index-bulk":                                "Bulk processor settings for the documents of a namespace",
+	"index-settings":                            "Shards, replicas and settings of the index created for a namespace",
+	"runtime-field":                             "Runtime field added to the mapping of an index",
+	"version-field":                             "Document field used as an external version",
+	"reindex":                                   "Reindex a namespace into a new index and switch an alias",
+	"shadow":                                    "Send a sample of a namespace to a shadow index and report how it differs",
+	"ingest-pipeline":                           "Ingest pipeline installed in Elasticsearch and applied to a namespace",
+	"rollover":                                  "Write a namespace through an alias which rolls over",
+	"update-conflict":                           "How version conflicts are resolved for a namespace",
+	"bulk-error":                                "How failed bulk items are handled by error type",
+	"routing":                                   "Expression which computes the routing of documents",
+	"join":                                      "Parent child join relation between two namespaces",
+	"unwind":                                    "Index the elements of an array field as separate documents",
+	"date-format":                               "Timezone and output format of the dates of a namespace and the formats of fields holding dates as strings or numbers",
+	"number-format":                             "Format of decimal and long values of a namespace",
+	"exclude-fields":                            "Fields left out of the documents of a namespace",
+	"pii":                                       "Text fields of a namespace scanned for emails, phone numbers and national IDs, which are replaced with stable tokens or hashes",
+	"redact":                                    "Fields of a namespace which are dropped, hashed with a salt or masked before documents leave monstache",
+	"coerce":                                    "Convert a field of a namespace to another type",
+	"geo":                                       "Build a geo_point from longitude and latitude fields",
+	"copy-field":                                "Copy a field to another field",
+	"reference":                                 "Small collection cached in memory and kept current for enrichments and plugins",
+	"enrich":                                    "Set a field to the reference documents matching the keys in a field",
+	"offload":                                   "Move fields of large documents of a namespace to the offload store. Each field is indexed as an object with the url, bytes, content_type and a preview of the content",
+	"offload-store":                             "The S3 compatible bucket holding the fields moved by offload",
+	"delete-routing":                            "How the index and routing of the deleted documents of a namespace are found: stateless, stateful, cache or pre-image",
+	"document-size":                             "Limit on the size of the documents of a namespace",
+	"file-filter":                               "Content types, extensions and size of the GridFS files of a namespace whose content is indexed",
+	"tika-field":                                "Extract the text and metadata of the content at the URL in a field with Tika",
+	"tombstone":                                 "Mark the deleted documents of a namespace with a flag and the delete time instead of deleting them",
+	"embedding":                                 "Compute vector embeddings of fields with an embedding API",
+	"semantic-field":                            "Copy fields to a semantic_text field",
+	"language-routing":                          "Route text fields to a subfield or index per language of the document, each mapped with the analyzer of the language",
+	"relate":                                    "Index a related namespace when a document changes",
+	"http-credential":                           "Basic auth user and password or bearer token granting the read or admin role on the http server",
+	"notify-webhook":                            "Webhook notified of sustained bulk failures, resume gaps, plugin panics, replication lag and schema drift",
+	"direct-read-priority":                      "Share of the direct read budget of a namespace",
+	"namespace-cursor":                          "Change stream batch size and max await and direct read cursor timeout of a namespace",
+	"namespace-defaults":                        "Settings applied to every namespace without its own settings",
+	"namespace":                                 "Pipeline, routing, excluded fields and bulk settings of a namespace",
+}
+
+// exampleConfig renders every config option with its default value and
+// description.  Scalar options and settings tables are set to their
+// defaults while sinks and lists of tables are commented out
+func exampleConfig() (string, error) {
+	defaults := &configOptions{
+		MongoValidatePemFile: true,
+		MongoDialSettings:    mongoDialSettings{Timeout: -1, ReadTimeout: -1, WriteTimeout: -1},
+		MongoSessionSettings: mongoSessionSettings{SocketTimeout: -1, SyncTimeout: -1},
+		GtmSettings:          gtmDefaultSettings(),
+	}
+	fs := flag.NewFlagSet("monstache", flag.ContinueOnError)
+	defaults.defineFlags(fs)
+	defaults.setDefaults()
+	usage := make(map[uintptr]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		usage[reflect.ValueOf(f.Value).Pointer()] = f.Usage
+	})
+	var scalars, tables bytes.Buffer
+	v := reflect.ValueOf(defaults).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" || configInitSkipped[field.Name] {
+			continue
 		}
-		if meta.Pipeline != "" {
-			req.Pipeline(meta.Pipeline)
+		name := strings.ToLower(configOptionName(field))
+		fv := v.Field(i)
+		desc := usage[fv.Addr().Pointer()]
+		if desc == "" {
+			desc = optionDescriptions[name]
+		}
+		if desc == "" {
+			return "", fmt.Errorf("Option %s has no description", name)
+		}
+		value, out, prefix := fv.Interface(), &scalars, ""
+		switch {
+		case fv.Kind() == reflect.Ptr:
+			value, out, prefix = reflect.New(field.Type.Elem()).Interface(), &tables, "# "
+		case fv.Kind() == reflect.Struct:
+			out = &tables
+		case fv.Kind() == reflect.Slice && isTableType(field.Type.Elem()):
+			elems := reflect.MakeSlice(field.Type, 1, 1)
+			if field.Type.Elem().Kind() == reflect.Ptr {
+				elems.Index(0).Set(reflect.New(field.Type.Elem().Elem()))
+			}
+			value, out, prefix = elems.Interface(), &tables, "# "
 		}
-		if meta.RetryOnConflict != 0 {
-			req.RetryOnConflict(meta.RetryOnConflict)
+		var b bytes.Buffer
+		if err := toml.NewEncoder(&b).Encode(map[string]interface{}{name: value}); err != nil {
+			return "", fmt.Errorf("Unable to encode option %s: %s", name, err)
 		}
-		if ingestAttachment {
-			req.Pipeline("attachment")
+		text := strings.TrimSpace(b.String())
+		if text == "" {
+			text = name + " = []"
 		}
-		if _, err = req.Source(); err == nil {
-			bulk.Add(req)
+		fmt.Fprintf(out, "\n# %s\n", desc)
+		for _, line := range strings.Split(text, "\n") {
+			if line = strings.TrimRight(line, " "); line != "" {
+				line = exampleKeyRegex.ReplaceAllStringFunc(line, strings.ToLower)
+				fmt.Fprintf(out, "%s%s\n", prefix, line)
+			}
 		}
 	}
+	return fmt.Sprintf("# monstache %s configuration with the default value of every option\n", version) +
+		scalars.String() + tables.String(), nil
+}
 
-	if meta.shouldSave(config) {
-		if e := setIndexMeta(mongo, op.Namespace, objectID, meta, config); e != nil {
-			errorLog.Printf("Unable to save routing info: %s", e)
-		}
+var exampleKeyRegex = regexp.MustCompile(`^\s*\w+ =`)
+
+func isTableType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
 	}
+	return t.Kind() == reflect.Struct
+}
 
-	if tmNamespaces[op.Namespace] {
-		if op.IsSourceOplog() || config.TimeMachineDirectReads {
-			t := time.Now().UTC()
-			tmIndex := func(idx string) string {
-				pre, suf := config.TimeMachineIndexPrefix, config.TimeMachineIndexSuffix
-				tmFormat := strings.Join([]string{pre, idx, t.Format(suf)}, ".")
-				return strings.ToLower(tmFormat)
-			}
-			data := make(map[string]interface{})
-			for k, v := range op.Data {
-				data[k] = v
-			}
-			data["_source_id"] = objectID
-			if config.IndexOplogTime == false {
-				secs := int64(op.Timestamp >> 32)
-				t := time.Unix(secs, 0).UTC()
-				data[config.OplogTsFieldName] = op.Timestamp
-				data[config.OplogDateFieldName] = t.Format(config.OplogDateFieldFormat)
+// initConfig writes the example config to the file or to stdout
+func initConfig(path string) int {
+	text, err := exampleConfig()
+	if err != nil {
+		errorLog.Println(err)
+		return 1
+	}
+	if path == "" || path == "-" {
+		_, err = os.Stdout.WriteString(text)
+	} else {
+		err = ioutil.WriteFile(path, []byte(text), 0644)
+	}
+	if err != nil {
+		errorLog.Printf("Unable to write config: %s", err)
+		return 1
+	}
+	return 0
+}
+
+// collectionProbe describes a collection found by init
+type collectionProbe struct {
+	Namespace string
+	Count     int
+	Size      int64
+}
+
+// deploymentProbe is what init learns about MongoDB and Elasticsearch
+type deploymentProbe struct {
+	MongoURL       string
+	MongoVersion   string
+	ChangeStreams  bool
+	Collections    []collectionProbe
+	ElasticUrls    []string
+	ElasticVersion string
+	OpenSearch     bool
+	Templates      []string
+}
+
+// starterOptions are the choices made when generating a starter config
+type starterOptions struct {
+	Namespaces  []string
+	DirectReads bool
+	Resume      bool
+}
+
+// largeCollectionCount is the number of documents above which the starter
+// config splits direct reads of a collection
+const largeCollectionCount = 1000000
+
+// probeDeployment collects the collections of MongoDB with their sizes,
+// whether change streams are supported and the version and index templates
+// of Elasticsearch
+func (config *configOptions) probeDeployment() (*deploymentProbe, error) {
+	p := &deploymentProbe{MongoURL: config.MongoURL, ElasticUrls: config.ElasticUrls}
+	mongo, err := config.dialMongo(config.MongoURL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to MongoDB using URL %s: %s", cleanMongoURL(config.MongoURL), err)
+	}
+	defer mongo.Close()
+	info, err := mongo.BuildInfo()
+	if err != nil {
+		return nil, err
+	}
+	p.MongoVersion = info.Version
+	var isMaster struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err = mongo.Run("isMaster", &isMaster); err == nil {
+		p.ChangeStreams = info.VersionAtLeast(3, 6) && (isMaster.SetName != "" || isMaster.Msg == "isdbgrid")
+	}
+	dbs, err := mongo.DatabaseNames()
+	if err != nil {
+		return nil, err
+	}
+	for _, db := range dbs {
+		if db == "admin" || db == "local" || db == "config" || db == config.ConfigDatabaseName {
+			continue
+		}
+		cols, err := mongo.DB(db).CollectionNames()
+		if err != nil {
+			return nil, err
+		}
+		for _, col := range cols {
+			if strings.HasPrefix(col, "system.") || chunksRegex.MatchString(col) {
+				continue
 			}
-			req := elastic.NewBulkIndexRequest()
-			req.UseEasyJSON(config.EnableEasyJSON)
-			req.Index(tmIndex(indexType.Index))
-			req.Type(indexType.Type)
-			req.Routing(objectID)
-			req.Doc(data)
-			if meta.Index != "" {
-				req.Index(tmIndex(meta.Index))
+			var stats struct {
+				Count int   `bson:"count"`
+				Size  int64 `bson:"size"`
 			}
-			if meta.Type != "" {
-				req.Type(meta.Type)
+			mongo.DB(db).Run(bson.D{{Name: "collStats", Value: col}}, &stats)
+			p.Collections = append(p.Collections, collectionProbe{
+				Namespace: db + "." + col,
+				Count:     stats.Count,
+				Size:      stats.Size,
+			})
+		}
+	}
+	client, err := config.newElasticClient()
+	if err == nil {
+		err = config.testElasticsearchConn(client)
+	}
+	if err != nil {
+		warnLog.Printf("Unable to connect to Elasticsearch: %s", err)
+		return p, nil
+	}
+	p.ElasticVersion = fmt.Sprintf("%d.%d", config.ElasticMajorVersion, config.ElasticMinorVersion)
+	p.OpenSearch = config.OpenSearch
+	if config.OpenSearch {
+		p.ElasticVersion = fmt.Sprintf("%d.%d", config.OpenSearchMajorVersion, config.OpenSearchMinorVersion)
+	}
+	path := "/_template"
+	if config.OpenSearch || config.ElasticMajorVersion >= 7 {
+		path = "/_index_template"
+	}
+	resp, err := client.PerformRequest(context.Background(), elastic.PerformRequestOptions{
+		Method: "GET",
+		Path:   path,
+	})
+	if err == nil {
+		var names []string
+		if path == "/_template" {
+			var templates map[string]interface{}
+			json.Unmarshal(resp.Body, &templates)
+			for name := range templates {
+				names = append(names, name)
 			}
-			if meta.Pipeline != "" {
-				req.Pipeline(meta.Pipeline)
+		} else {
+			var templates struct {
+				IndexTemplates []struct {
+					Name string
+				} `json:"index_templates"`
 			}
-			if ingestAttachment {
-				req.Pipeline("attachment")
+			json.Unmarshal(resp.Body, &templates)
+			for _, t := range templates.IndexTemplates {
+				names = append(names, t.Name)
 			}
-			if _, err = req.Source(); err == nil {
-				bulk.Add(req)
+		}
+		for _, name := range names {
+			if !strings.HasPrefix(name, ".") {
+				p.Templates = append(p.Templates, name)
 			}
 		}
+		sort.Strings(p.Templates)
 	}
-	return
+	return p, nil
 }
 
-func doIndex(config *configOptions, mongo *mgo.Session, bulk *elastic.BulkProcessor, client *elastic.Client, op *gtm.Op) (err error) {
-	if err = mapData(mongo, config, op); err == nil {
-		if op.Data != nil {
-			err = doIndexing(config, mongo, bulk, client, op)
-		} else if op.IsUpdate() {
-			doDelete(config, client, mongo, bulk, op)
-		}
+// defaultOptions syncs every collection, copies existing documents and
+// resumes after restarts
+func (p *deploymentProbe) defaultOptions() *starterOptions {
+	opts := &starterOptions{DirectReads: true, Resume: true}
+	for _, c := range p.Collections {
+		opts.Namespaces = append(opts.Namespaces, c.Namespace)
+	}
+	return opts
+}
+
+// ask prompts with a yes or no question and returns the answer or def
+func ask(in *bufio.Reader, out io.Writer, question string, def bool) bool {
+	choices := "Y/n"
+	if !def {
+		choices = "y/N"
+	}
+	fmt.Fprintf(out, "%s [%s] ", question, choices)
+	line, _ := in.ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return true
+	case "n", "no":
+		return false
 	}
-	return
+	return def
 }
 
-func runProcessor(mongo *mgo.Session, bulk *elastic.BulkProcessor, client *elastic.Client, op *gtm.Op) (err error) {
-	session := mongo.Copy()
-	defer session.Close()
-	input := &monstachemap.ProcessPluginInput{
-		ElasticClient:        client,
-		ElasticBulkProcessor: bulk,
-		Timestamp:            op.Timestamp,
+// chooseOptions asks which collections to sync and how
+func (p *deploymentProbe) chooseOptions(in *bufio.Reader, out io.Writer) *starterOptions {
+	opts := &starterOptions{}
+	fmt.Fprintf(out, "MongoDB %s at %s\n", p.MongoVersion, cleanMongoURL(p.MongoURL))
+	if !p.ChangeStreams {
+		fmt.Fprintln(out, "Change streams are not supported. MongoDB 3.6+ running as a replica set or sharded cluster is required")
+	}
+	for _, c := range p.Collections {
+		question := fmt.Sprintf("Sync %s (%d documents, %s)?", c.Namespace, c.Count, formatBytes(c.Size))
+		if ask(in, out, question, true) {
+			opts.Namespaces = append(opts.Namespaces, c.Namespace)
+		}
+	}
+	opts.DirectReads = ask(in, out, "Copy the existing documents of these collections at startup?", true)
+	opts.Resume = ask(in, out, "Resume from the last synced change after a restart?", true)
+	return opts
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
 	}
-	input.Document = op.Data
-	if op.IsDelete() {
-		input.Document = map[string]interface{}{
-			"_id": op.Id,
-		}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
 	}
-	input.Namespace = op.Namespace
-	input.Database = op.GetDatabase()
-	input.Collection = op.GetCollection()
-	input.Operation = op.Operation
-	input.Session = session
-	input.UpdateDescription = op.UpdateDescription
-	err = processPlugin(input)
-	return
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
 }
 
-func routeOp(config *configOptions, mongo *mgo.Session, bulk *elastic.BulkProcessor, client *elastic.Client, op *gtm.Op, out *outputChans) (err error) {
-	if processPlugin != nil {
-		rop := &gtm.Op{
-			Id:                op.Id,
-			Operation:         op.Operation,
-			Namespace:         op.Namespace,
-			Source:            op.Source,
-			Timestamp:         op.Timestamp,
-			UpdateDescription: op.UpdateDescription,
-		}
-		if op.Data != nil {
-			var data []byte
-			data, err = bson.Marshal(op.Data)
-			if err == nil {
-				var m map[string]interface{}
-				err = bson.Unmarshal(data, &m)
-				if err == nil {
-					rop.Data = m
+// starterConfig renders a config for the probed deployment and choices
+func (p *deploymentProbe) starterConfig(opts *starterOptions) string {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# monstache %s starter configuration generated by monstache init\n", version)
+	fmt.Fprintf(&b, "# MongoDB %s", p.MongoVersion)
+	if p.ElasticVersion != "" {
+		engine := "Elasticsearch"
+		if p.OpenSearch {
+			engine = "OpenSearch"
+		}
+		fmt.Fprintf(&b, ", %s %s", engine, p.ElasticVersion)
+	}
+	b.WriteString("\n\n")
+	fmt.Fprintf(&b, "mongo-url = %q\n", p.MongoURL)
+	if len(p.ElasticUrls) > 0 {
+		urls := make([]string, len(p.ElasticUrls))
+		for i, u := range p.ElasticUrls {
+			urls[i] = strconv.Quote(u)
+		}
+		fmt.Fprintf(&b, "elasticsearch-urls = [%s]\n", strings.Join(urls, ", "))
+	}
+	quoted := make([]string, len(opts.Namespaces))
+	for i, ns := range opts.Namespaces {
+		quoted[i] = strconv.Quote(ns)
+	}
+	list := "[" + strings.Join(quoted, ", ") + "]"
+	if p.ChangeStreams {
+		b.WriteString("\n# listen for changes to the selected collections\n")
+		fmt.Fprintf(&b, "change-stream-namespaces = %s\n", list)
+	} else {
+		b.WriteString("\n# change streams are not supported so the oplog is tailed\n")
+		fmt.Fprintf(&b, "namespace-regex = %q\n", namespaceListRegex(opts.Namespaces))
+	}
+	if opts.DirectReads {
+		b.WriteString("\n# copy the existing documents at startup\n")
+		fmt.Fprintf(&b, "direct-read-namespaces = %s\n", list)
+		large := false
+		for _, c := range p.Collections {
+			for _, ns := range opts.Namespaces {
+				if ns == c.Namespace && c.Count > largeCollectionCount {
+					large = true
 				}
 			}
 		}
-		out.processC <- rop
+		if large {
+			b.WriteString("# some collections are large so reads are split into concurrent segments\n")
+			b.WriteString("direct-read-split-max = 9\n")
+			b.WriteString("direct-read-concur = 4\n")
+			b.WriteString("elasticsearch-max-bytes = 16777216\n")
+			b.WriteString("elasticsearch-max-seconds = 5\n")
+		}
 	}
-	if op.IsDrop() {
-		bulk.Flush()
-		err = doDrop(mongo, client, op, config)
-	} else if op.IsDelete() {
-		if len(config.Relate) > 0 {
-			if rs := relates[op.Namespace]; len(rs) != 0 {
-				var delData map[string]interface{}
-				useFind := false
-				for _, r := range rs {
-					if r.SrcField != "_id" {
-						useFind = true
-						break
-					}
-				}
-				if useFind {
-					delData = findDeletedSrcDoc(config, client, op)
-				} else {
-					delData = map[string]interface{}{
-						"_id": op.Id,
-					}
-				}
-				if delData != nil {
-					rop := &gtm.Op{
-						Id:        op.Id,
-						Operation: op.Operation,
-						Namespace: op.Namespace,
-						Source:    op.Source,
-						Timestamp: op.Timestamp,
-						Data:      delData,
-					}
-					select {
-					case out.relateC <- rop:
-					default:
-						errorLog.Printf(relateQueueOverloadMsg, rop.Namespace, rop.Id)
-					}
-				}
+	if opts.Resume {
+		b.WriteString("\n# save the position of the last synced change and resume from it\n")
+		b.WriteString("resume = true\n")
+	}
+	if len(p.Templates) > 0 {
+		b.WriteString("\n# index templates found in the cluster which may apply to the new indexes:\n")
+		for _, name := range p.Templates {
+			fmt.Fprintf(&b, "#   %s\n", name)
+		}
+	}
+	return b.String()
+}
+
+// namespaceListRegex matches exactly the given namespaces
+func namespaceListRegex(namespaces []string) string {
+	quoted := make([]string, len(namespaces))
+	for i, ns := range namespaces {
+		quoted[i] = regexp.QuoteMeta(ns)
+	}
+	return "^(" + strings.Join(quoted, "|") + ")$"
+}
+
+// initStarterConfig probes the deployment and writes a starter config to
+// the file given after the flags or to stdout.  With -interactive the
+// collections and options are chosen at prompts
+func (config *configOptions) initStarterConfig(args []string) int {
+	fs := flag.NewFlagSet("monstache init", flag.ExitOnError)
+	config.defineFlags(fs)
+	interactive := fs.Bool("interactive", false, "Choose the collections and options to sync at prompts")
+	fs.Parse(args)
+	// keep stdout for the config
+	infoLog.SetOutput(os.Stderr)
+	warnLog.SetOutput(os.Stderr)
+	if err := config.loadFlagEnvironment(fs); err != nil {
+		errorLog.Println(err)
+		return 1
+	}
+	config.setDefaults()
+	p, err := config.probeDeployment()
+	if err != nil {
+		errorLog.Println(err)
+		return 1
+	}
+	var opts *starterOptions
+	if *interactive {
+		opts = p.chooseOptions(bufio.NewReader(os.Stdin), os.Stderr)
+	} else {
+		opts = p.defaultOptions()
+	}
+	text := p.starterConfig(opts)
+	path := fs.Arg(0)
+	if path == "" || path == "-" {
+		_, err = os.Stdout.WriteString(text)
+	} else {
+		err = ioutil.WriteFile(path, []byte(text), 0644)
+	}
+	if err != nil {
+		errorLog.Printf("Unable to write config: %s", err)
+		return 1
+	}
+	return 0
+}
+
+// optionNotes describe changes in the behavior of options which are
+// reported when migrating a config that sets them
+var optionNotes = map[string]string{
+	"replay":                 "replay replays the entire oplog on every start. Use the replay subcommand to replay once",
+	"resume-from-timestamp":  "values up to 2147483647 are read as seconds since the epoch rather than a MongoDB timestamp",
+	"elasticsearch-max-docs": "elasticsearch-max-bytes is preferred since the size of documents varies",
+	"index-files":            "indexing files requires the ingest-attachment plugin since mapper-attachments is deprecated",
+}
+
+// migrationTargets maps the names of the command line flags to the name of
+// the option they set when the two differ.  Older configs used some flag
+// names, such as elasticsearch-url, as option names
+func migrationTargets() map[string]reflect.StructField {
+	config := &configOptions{}
+	fs := flag.NewFlagSet("monstache", flag.ContinueOnError)
+	config.defineFlags(fs)
+	fields := make(map[uintptr]reflect.StructField)
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if field := v.Type().Field(i); field.PkgPath == "" && !configInitSkipped[field.Name] {
+			fields[v.Field(i).Addr().Pointer()] = field
+		}
+	}
+	targets := make(map[string]reflect.StructField)
+	fs.VisitAll(func(f *flag.Flag) {
+		if field, ok := fields[reflect.ValueOf(f.Value).Pointer()]; ok {
+			if name := strings.ToLower(configOptionName(field)); name != f.Name {
+				targets[f.Name] = field
 			}
 		}
-		doDelete(config, client, mongo, bulk, op)
-	} else if op.Data != nil {
-		skip := false
-		if op.IsSourceOplog() && len(config.Relate) > 0 {
-			if rs := relates[op.Namespace]; len(rs) != 0 {
-				skip = true
-				for _, r := range rs {
-					if r.KeepSrc {
-						skip = false
-						break
-					}
-				}
-				if skip {
-					select {
-					case out.relateC <- op:
-					default:
-						errorLog.Printf(relateQueueOverloadMsg, op.Namespace, op.Id)
-					}
-				} else {
-					rop := &gtm.Op{
-						Id:                op.Id,
-						Operation:         op.Operation,
-						Namespace:         op.Namespace,
-						Source:            op.Source,
-						Timestamp:         op.Timestamp,
-						UpdateDescription: op.UpdateDescription,
-					}
-					var data []byte
-					data, err = bson.Marshal(op.Data)
-					if err == nil {
-						var m map[string]interface{}
-						err = bson.Unmarshal(data, &m)
-						if err == nil {
-							rop.Data = m
-						}
-					}
-					select {
-					case out.relateC <- rop:
-					default:
-						errorLog.Printf(relateQueueOverloadMsg, rop.Namespace, rop.Id)
-					}
-				}
+	})
+	return targets
+}
+
+var topLevelKeyRegex = regexp.MustCompile(`^(\s*)("?)([A-Za-z0-9_-]+)("?)(\s*=\s*)(.*)$`)
+
+// scalarValueRegex splits a string or bare value from a trailing comment
+var scalarValueRegex = regexp.MustCompile(`^("(?:[^"\\]|\\.)*"|'[^']*'|[^#\s]+)(\s*#.*)?$`)
+
+// migrateConfig rewrites a config written for an older version.  Options
+// named like their flag are renamed to the option, with a single value
+// turned into a list where the option is a list.  Other unknown options are
+// commented out.  Comments and layout are kept.  The report lists each
+// change and the notes for options whose behavior changed
+func migrateConfig(text string) (string, []string, error) {
+	md, err := toml.Decode(text, &configOptions{})
+	if err != nil {
+		return "", nil, err
+	}
+	var report []string
+	unknown := make(map[string]bool)
+	for _, key := range md.Undecoded() {
+		if len(key) == 1 {
+			unknown[key[0]] = true
+		} else {
+			report = append(report, fmt.Sprintf("%s is not an option and must be removed by hand", key.String()))
+		}
+	}
+	targets := migrationTargets()
+	var out []string
+	inTable, removing, depth := false, false, 0
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if removing {
+			depth += strings.Count(trimmed, "[") - strings.Count(trimmed, "]")
+			removing = depth > 0
+			out = append(out, "# "+line)
+			continue
+		}
+		if strings.HasPrefix(trimmed, "[") {
+			inTable = true
+		}
+		m := topLevelKeyRegex.FindStringSubmatch(line)
+		if inTable || m == nil || !unknown[m[3]] {
+			out = append(out, line)
+			continue
+		}
+		key, value := m[3], m[6]
+		field, ok := targets[key]
+		name := ""
+		if ok {
+			name = strings.ToLower(configOptionName(field))
+		}
+		if ok && md.IsDefined(name) {
+			report = append(report, fmt.Sprintf("%s was removed since %s is already set", key, name))
+			ok = false
+		}
+		if !ok {
+			depth = strings.Count(value, "[") - strings.Count(value, "]")
+			removing = depth > 0
+			if name == "" {
+				report = append(report, fmt.Sprintf("%s is no longer an option and was commented out", key))
 			}
+			out = append(out, "# "+line)
+			continue
 		}
-		if !skip {
-			if hasFileContent(op, config) {
-				out.fileC <- op
-			} else {
-				out.indexC <- op
+		if field.Type.Kind() == reflect.Slice && !strings.HasPrefix(value, "[") {
+			if v := scalarValueRegex.FindStringSubmatch(value); v != nil {
+				value = "[" + v[1] + "]" + v[2]
 			}
+			report = append(report, fmt.Sprintf("%s was renamed to %s which takes a list", key, name))
+		} else {
+			report = append(report, fmt.Sprintf("%s was renamed to %s", key, name))
 		}
+		out = append(out, m[1]+name+m[5]+value)
 	}
-	return
+	migrated := strings.Join(out, "\n")
+	md, err = toml.Decode(migrated, &configOptions{})
+	if err != nil {
+		return "", nil, fmt.Errorf("Unable to migrate config: %s", err)
+	}
+	for _, key := range md.Keys() {
+		if note := optionNotes[key.String()]; note != "" {
+			report = append(report, fmt.Sprintf("%s: %s", key, note))
+		}
+	}
+	return migrated, report, nil
 }
 
-func processErr(err error, config *configOptions) {
-	mux.Lock()
-	defer mux.Unlock()
-	exitStatus = 1
-	errorLog.Println(err)
-	if config.FailFast {
-		os.Exit(exitStatus)
+// migrateConfigFile migrates the config file at path and writes it to out
+// or to stdout.  The report is written to stderr
+func migrateConfigFile(path, out string) int {
+	if path == "" {
+		errorLog.Println("Usage: monstache config migrate old-config [new-config]")
+		return 1
+	}
+	text, err := readConfigText(path)
+	if err == nil {
+		text, err = configToTOML(path, text)
+	}
+	if err != nil {
+		errorLog.Printf("Unable to read config %s: %s", path, err)
+		return 1
+	}
+	migrated, report, err := migrateConfig(text)
+	if err != nil {
+		errorLog.Println(err)
+		return 1
+	}
+	if out == "" || out == "-" {
+		_, err = os.Stdout.WriteString(migrated)
+	} else {
+		err = ioutil.WriteFile(out, []byte(migrated), 0644)
 	}
+	if err != nil {
+		errorLog.Printf("Unable to write config: %s", err)
+		return 1
+	}
+	if len(report) == 0 {
+		fmt.Fprintln(os.Stderr, "No changes were needed")
+	}
+	for _, line := range report {
+		fmt.Fprintln(os.Stderr, line)
+	}
+	return 0
 }
 
-func doIndexStats(config *configOptions, bulkStats *elastic.BulkProcessor, stats elastic.BulkProcessorStats) (err error) {
-	var hostname string
-	doc := make(map[string]interface{})
-	t := time.Now().UTC()
-	doc["Timestamp"] = t.Format("2006-01-02T15:04:05")
-	hostname, err = os.Hostname()
-	if err == nil {
-		doc["Host"] = hostname
+func newMetrics() *monstacheMetrics {
+	m := &monstacheMetrics{
+		registry: prometheus.NewRegistry(),
+		queues:   make(map[string]func() int),
+	}
+	m.events = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "monstache",
+		Name:      "events_read_total",
+		Help:      "Change events and direct read documents read from MongoDB",
+	}, []string{"namespace", "operation"})
+	m.documents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "monstache",
+		Name:      "documents_total",
+		Help:      "Documents indexed, updated, deleted or skipped",
+	}, []string{"namespace", "index", "action"})
+	m.bulkLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "monstache",
+		Name:      "bulk_request_duration_seconds",
+		Help:      "Time taken by bulk requests to Elasticsearch including retries",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"bulk"})
+	m.bulkFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "monstache",
+		Name:      "bulk_failures_total",
+		Help:      "Failed bulk items by error class",
+	}, []string{"index", "class"})
+	m.pluginDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "monstache",
+		Name:      "plugin_duration_seconds",
+		Help:      "Time spent in golang plugin functions",
+	}, []string{"plugin", "namespace"})
+	m.lag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "monstache",
+		Name:      "replication_lag_seconds",
+		Help:      "Seconds between the cluster time of the latest event read and its receipt",
+	}, []string{"namespace"})
+	m.schemaDrifts = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "monstache",
+		Name:      "schema_drift_fields",
+		Help:      "Fields emitted to an index which are unmapped or mapped with an unexpected type",
+	}, []string{"index", "kind"})
+	m.faults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "monstache",
+		Name:      "faults_injected_total",
+		Help:      "Failures injected by chaos testing",
+	}, []string{"fault"})
+	checkpointAge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "monstache",
+		Name:      "checkpoint_age_seconds",
+		Help:      "Seconds between the cluster time of the saved resume position and now",
+	}, m.checkpointAge)
+	m.registry.MustRegister(m.events, m.documents, m.bulkLatency, m.bulkFailures, m.pluginDuration, m.lag, m.schemaDrifts, m.faults, checkpointAge)
+	m.registry.MustRegister(prometheus.NewGoCollector())
+	m.registry.MustRegister(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	return m
+}
+
+func (m *monstacheMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{ErrorLog: errorLog})
+}
+
+func (m *monstacheMetrics) eventRead(op *gtm.Op) {
+	if m == nil {
+		return
 	}
-	doc["Pid"] = os.Getpid()
-	doc["Stats"] = stats
-	index := strings.ToLower(t.Format(config.StatsIndexFormat))
-	typeName := "stats"
-	if config.useTypeFromFuture() {
-		typeName = typeFromFuture
+	m.events.WithLabelValues(op.Namespace, op.Operation).Inc()
+	m.statsd.count("events_read", 1, "namespace:"+op.Namespace, "operation:"+op.Operation)
+}
+
+func (m *monstacheMetrics) document(action string, op *gtm.Op, index string) {
+	if m == nil {
+		return
+	}
+	m.documents.WithLabelValues(op.Namespace, index, action).Inc()
+	m.statsd.count("documents", 1, "namespace:"+op.Namespace, "index:"+index, "action:"+action)
+}
+
+func (m *monstacheMetrics) bulkStarted(name string, id int64) {
+	if m == nil {
+		return
+	}
+	m.bulkStarts.Store(bulkExecution{name, id}, time.Now())
+}
+
+func (m *monstacheMetrics) bulkFinished(name string, id int64) {
+	if m == nil {
+		return
+	}
+	key := bulkExecution{name, id}
+	if started, ok := m.bulkStarts.Load(key); ok {
+		m.bulkStarts.Delete(key)
+		took := time.Since(started.(time.Time))
+		m.bulkLatency.WithLabelValues(name).Observe(took.Seconds())
+		m.statsd.timing("bulk_request_duration", took, "bulk:"+name)
+	}
+}
+
+func (m *monstacheMetrics) replicationLag(namespace string, lag time.Duration) {
+	if m == nil {
+		return
+	}
+	m.lag.WithLabelValues(namespace).Set(lag.Seconds())
+	m.statsd.gauge("replication_lag_seconds", lag.Seconds(), "namespace:"+namespace)
+}
+
+func (m *monstacheMetrics) schemaDrift(index, kind string, fields int) {
+	if m == nil {
+		return
+	}
+	m.schemaDrifts.WithLabelValues(index, kind).Set(float64(fields))
+	m.statsd.gauge("schema_drift_fields", float64(fields), "index:"+index, "kind:"+kind)
+}
+
+func (m *monstacheMetrics) faultInjected(fault string) {
+	if m == nil {
+		return
+	}
+	m.faults.WithLabelValues(fault).Inc()
+	m.statsd.count("faults_injected", 1, "fault:"+fault)
+}
+
+func (m *monstacheMetrics) checkpointSaved(ts bson.MongoTimestamp) {
+	if m == nil {
+		return
+	}
+	atomic.StoreInt64(&m.checkpointTs, int64(ts))
+}
+
+// checkpointAge is the number of events a restart would read again in
+// seconds.  It is 0 until a resume position is saved
+func (m *monstacheMetrics) checkpointAge() float64 {
+	ts := atomic.LoadInt64(&m.checkpointTs)
+	if ts == 0 {
+		return 0
+	}
+	return time.Since(time.Unix(ts>>32, 0)).Seconds()
+}
+
+func (m *monstacheMetrics) bulkFailed(index, class string) {
+	if m == nil {
+		return
+	}
+	m.bulkFailures.WithLabelValues(index, class).Inc()
+	m.statsd.count("bulk_failures", 1, "index:"+index, "class:"+class)
+}
+
+// pluginTimer starts timing a plugin call.  The returned func records it
+func (m *monstacheMetrics) pluginTimer(plugin, namespace string) func() {
+	if m == nil {
+		return func() {}
+	}
+	started := time.Now()
+	return func() {
+		took := time.Since(started)
+		m.pluginDuration.WithLabelValues(plugin, namespace).Observe(took.Seconds())
+		m.statsd.timing("plugin_duration", took, "plugin:"+plugin, "namespace:"+namespace)
 	}
-	req := elastic.NewBulkIndexRequest().Index(index).Type(typeName)
-	req.UseEasyJSON(config.EnableEasyJSON)
-	req.Doc(doc)
-	bulkStats.Add(req)
-	return
 }
 
-func dropDBMeta(session *mgo.Session, db string, config *configOptions) (err error) {
-	if config.DeleteStrategy == statefulDeleteStrategy {
-		col := session.DB(config.ConfigDatabaseName).C("meta")
-		q := bson.M{"db": db}
-		_, err = col.RemoveAll(q)
+// watchQueue reports the number of items waiting in a queue when scraped
+// or flushed to StatsD
+func (m *monstacheMetrics) watchQueue(name string, depth func() int) {
+	if m == nil {
+		return
 	}
-	return
+	m.queueLock.Lock()
+	m.queues[name] = depth
+	m.queueLock.Unlock()
+	m.registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   "monstache",
+		Name:        "queue_depth",
+		Help:        "Items waiting in internal queues",
+		ConstLabels: prometheus.Labels{"queue": name},
+	}, func() float64 {
+		return float64(depth())
+	}))
 }
 
-func dropCollectionMeta(session *mgo.Session, namespace string, config *configOptions) (err error) {
-	if config.DeleteStrategy == statefulDeleteStrategy {
-		col := session.DB(config.ConfigDatabaseName).C("meta")
-		q := bson.M{"namespace": namespace}
-		_, err = col.RemoveAll(q)
+// indexAction is the documents_total action of a document being indexed
+func indexAction(op *gtm.Op) string {
+	if op.IsUpdate() {
+		return "updated"
 	}
-	return
+	return "indexed"
 }
 
-func (meta *indexingMeta) load(metaAttrs map[string]interface{}) {
-	var v interface{}
-	var ok bool
-	var s string
-	if _, ok = metaAttrs["skip"]; ok {
-		meta.Skip = true
-	}
-	if v, ok = metaAttrs["routing"]; ok {
-		meta.Routing = fmt.Sprintf("%v", v)
+// bulkRequestIndex extracts the target index from the action line of a
+// bulk request
+func bulkRequestIndex(req elastic.BulkableRequest) string {
+	lines, err := req.Source()
+	if err != nil || len(lines) == 0 {
+		return ""
 	}
-	if v, ok = metaAttrs["index"]; ok {
-		meta.Index = fmt.Sprintf("%v", v)
+	var action map[string]struct {
+		Index string `json:"_index"`
 	}
-	if v, ok = metaAttrs["id"]; ok {
-		op := &gtm.Op{
-			Id: v,
-		}
-		meta.ID = opIDToString(op)
+	if json.Unmarshal([]byte(lines[0]), &action) != nil {
+		return ""
 	}
-	if v, ok = metaAttrs["type"]; ok {
-		meta.Type = fmt.Sprintf("%v", v)
+	for _, a := range action {
+		return a.Index
 	}
-	if v, ok = metaAttrs["parent"]; ok {
-		meta.Parent = fmt.Sprintf("%v", v)
+	return ""
+}
+
+func newTracer(config *configOptions) *tracer {
+	endpoint := strings.TrimSuffix(config.TracingEndpoint, "/")
+	if !strings.HasSuffix(endpoint, "/v1/traces") {
+		endpoint += "/v1/traces"
+	}
+	return &tracer{
+		endpoint:    endpoint,
+		serviceName: config.TracingServiceName,
+		sampleRatio: config.TracingSampleRatio,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spansC:      make(chan *traceSpan, tracingBatchSize*4),
+		flushC:      make(chan chan bool),
 	}
-	if v, ok = metaAttrs["version"]; ok {
-		s = fmt.Sprintf("%v", v)
-		if version, err := strconv.ParseInt(s, 10, 64); err == nil {
-			meta.Version = version
-		}
+}
+
+func (t *tracer) newSpan(name string) *traceSpan {
+	span := &traceSpan{
+		tracer:     t,
+		name:       name,
+		start:      time.Now(),
+		attributes: make(map[string]string),
+	}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// startEvent starts the root span of a change event if it is sampled
+func (t *tracer) startEvent(op *gtm.Op) {
+	if t == nil || rand.Float64() >= t.sampleRatio {
+		return
 	}
-	if v, ok = metaAttrs["versionType"]; ok {
-		meta.VersionType = fmt.Sprintf("%v", v)
+	span := t.newSpan("change event")
+	rand.Read(span.traceID[:])
+	span.set("namespace", op.Namespace)
+	span.set("operation", op.Operation)
+	span.set("id", fmt.Sprintf("%v", op.Id))
+	if op.IsSourceOplog() {
+		span.set("source", "oplog")
+	} else {
+		span.set("source", "direct")
 	}
-	if v, ok = metaAttrs["pipeline"]; ok {
-		meta.Pipeline = fmt.Sprintf("%v", v)
+	t.events.Store(op, span)
+}
+
+// finishEvent ends the root span of a change event once it was handed to
+// the bulk processor or dropped
+func (t *tracer) finishEvent(op *gtm.Op, err error) {
+	if t == nil {
+		return
 	}
-	if v, ok = metaAttrs["retryOnConflict"]; ok {
-		s = fmt.Sprintf("%v", v)
-		if roc, err := strconv.Atoi(s); err == nil {
-			meta.RetryOnConflict = roc
-		}
+	if span, ok := t.events.Load(op); ok {
+		t.events.Delete(op)
+		span.(*traceSpan).finish(err)
 	}
 }
 
-func (meta *indexingMeta) shouldSave(config *configOptions) bool {
-	if config.DeleteStrategy == statefulDeleteStrategy {
-		return (meta.Routing != "" ||
-			meta.Index != "" ||
-			meta.Type != "" ||
-			meta.Parent != "" ||
-			meta.Pipeline != "")
+// start begins a child span of the change event of op.  Untraced events
+// yield a nil span which is safe to use
+func (t *tracer) start(op *gtm.Op, name string) *traceSpan {
+	if t == nil {
+		return nil
 	}
-	return false
+	event, ok := t.events.Load(op)
+	if !ok {
+		return nil
+	}
+	return event.(*traceSpan).child(name)
 }
 
-func setIndexMeta(session *mgo.Session, namespace, id string, meta *indexingMeta, config *configOptions) error {
-	col := session.DB(config.ConfigDatabaseName).C("meta")
-	metaID := fmt.Sprintf("%s.%s", namespace, id)
-	doc := make(map[string]interface{})
-	doc["id"] = meta.ID
-	doc["routing"] = meta.Routing
-	doc["index"] = meta.Index
-	doc["type"] = meta.Type
-	doc["parent"] = meta.Parent
-	doc["pipeline"] = meta.Pipeline
-	doc["db"] = strings.SplitN(namespace, ".", 2)[0]
-	doc["namespace"] = namespace
-	_, err := col.UpsertId(metaID, bson.M{"$set": doc})
-	return err
+// enqueue remembers the span which queued req so the bulk flush can link
+// back to it
+func (t *tracer) enqueue(span *traceSpan, req elastic.BulkableRequest) {
+	if t == nil || span == nil {
+		return
+	}
+	t.enqueued.Store(req, traceLink{span.traceID, span.spanID})
 }
 
-func getIndexMeta(session *mgo.Session, namespace, id string, config *configOptions) (meta *indexingMeta) {
-	meta = &indexingMeta{}
-	col := session.DB(config.ConfigDatabaseName).C("meta")
-	doc := make(map[string]interface{})
-	metaID := fmt.Sprintf("%s.%s", namespace, id)
-	col.FindId(metaID).One(doc)
-	if doc["id"] != nil {
-		meta.ID = doc["id"].(string)
+// bulkStarted opens a bulk flush span linked to the traced events it carries
+func (t *tracer) bulkStarted(name string, id int64, requests []elastic.BulkableRequest) {
+	if t == nil {
+		return
 	}
-	if doc["routing"] != nil {
-		meta.Routing = doc["routing"].(string)
+	var links []traceLink
+	for _, req := range requests {
+		if link, ok := t.enqueued.Load(req); ok {
+			t.enqueued.Delete(req)
+			if len(links) < tracingMaxLinks {
+				links = append(links, link.(traceLink))
+			}
+		}
 	}
-	if doc["index"] != nil {
-		meta.Index = strings.ToLower(doc["index"].(string))
+	if len(links) == 0 {
+		return
 	}
-	if doc["type"] != nil {
-		meta.Type = doc["type"].(string)
+	span := t.newSpan("bulk flush")
+	rand.Read(span.traceID[:])
+	span.set("bulk", name)
+	span.set("requests", strconv.Itoa(len(requests)))
+	span.links = links
+	t.flushes.Store(bulkExecution{name, id}, span)
+}
+
+func (t *tracer) bulkFinished(name string, id int64, response *elastic.BulkResponse, err error) {
+	if t == nil {
+		return
 	}
-	if doc["parent"] != nil {
-		meta.Parent = doc["parent"].(string)
+	key := bulkExecution{name, id}
+	s, ok := t.flushes.Load(key)
+	if !ok {
+		return
 	}
-	if doc["pipeline"] != nil {
-		meta.Pipeline = doc["pipeline"].(string)
+	t.flushes.Delete(key)
+	span := s.(*traceSpan)
+	if response != nil {
+		span.set("failed", strconv.Itoa(len(response.Failed())))
+		if err == nil && response.Errors {
+			err = errors.New("bulk response contains failed items")
+		}
 	}
-	col.RemoveId(metaID)
-	return
+	span.finish(err)
 }
 
-func loadBuiltinFunctions(s *mgo.Session, config *configOptions) {
-	for ns, env := range mapEnvs {
-		var fa *findConf
-		fa = &findConf{
-			session: s,
-			name:    "findId",
-			vm:      env.VM,
-			ns:      ns,
-			byId:    true,
-		}
-		if err := env.VM.Set(fa.name, makeFind(fa)); err != nil {
-			panic(err)
-		}
-		fa = &findConf{
-			session: s,
-			name:    "findOne",
-			vm:      env.VM,
-			ns:      ns,
-		}
-		if err := env.VM.Set(fa.name, makeFind(fa)); err != nil {
-			panic(err)
-		}
-		fa = &findConf{
-			session: s,
-			name:    "find",
-			vm:      env.VM,
-			ns:      ns,
-			multi:   true,
-		}
-		if err := env.VM.Set(fa.name, makeFind(fa)); err != nil {
-			panic(err)
-		}
-		fa = &findConf{
-			session:       s,
-			name:          "pipe",
-			vm:            env.VM,
-			ns:            ns,
-			multi:         true,
-			pipe:          true,
-			pipeAllowDisk: config.PipeAllowDisk,
+// export sends finished spans to the collector in batches
+func (t *tracer) export() {
+	var batch []*traceSpan
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	send := func() {
+		if len(batch) == 0 {
+			return
 		}
-		if err := env.VM.Set(fa.name, makeFind(fa)); err != nil {
-			panic(err)
+		if err := t.send(batch); err != nil {
+			errorLog.Printf("Unable to export %d spans: %s", len(batch), err)
 		}
+		batch = nil
 	}
-}
-
-func (fc *findCall) setDatabase(topts map[string]interface{}) (err error) {
-	if ov, ok := topts["database"]; ok {
-		if ovs, ok := ov.(string); ok {
-			fc.db = ovs
-		} else {
-			err = errors.New("Invalid database option value")
+	for {
+		select {
+		case span := <-t.spansC:
+			batch = append(batch, span)
+			if len(batch) >= tracingBatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case done := <-t.flushC:
+			for n := len(t.spansC); n > 0; n-- {
+				batch = append(batch, <-t.spansC)
+			}
+			send()
+			close(done)
 		}
 	}
-	return
 }
 
-func (fc *findCall) setCollection(topts map[string]interface{}) (err error) {
-	if ov, ok := topts["collection"]; ok {
-		if ovs, ok := ov.(string); ok {
-			fc.col = ovs
-		} else {
-			err = errors.New("Invalid collection option value")
-		}
+// flush exports the spans finished so far
+func (t *tracer) flush() {
+	if t == nil {
+		return
 	}
-	return
+	done := make(chan bool)
+	t.flushC <- done
+	<-done
 }
 
-func (fc *findCall) setSelect(topts map[string]interface{}) (err error) {
-	if ov, ok := topts["select"]; ok {
-		if ovsel, ok := ov.(map[string]interface{}); ok {
-			for k, v := range ovsel {
-				if vi, ok := v.(int64); ok {
-					fc.sel[k] = int(vi)
-				}
-			}
-		} else {
-			err = errors.New("Invalid select option value")
-		}
+func (t *tracer) send(batch []*traceSpan) error {
+	spans := make([]interface{}, len(batch))
+	for i, span := range batch {
+		spans[i] = span.otlp()
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{
+						"service.name":    t.serviceName,
+						"service.version": version,
+					}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "monstache", "version": version},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
 	}
-	return
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector responded with status %d", resp.StatusCode)
+	}
+	return nil
 }
 
-func (fc *findCall) setSort(topts map[string]interface{}) (err error) {
-	if ov, ok := topts["sort"]; ok {
-		if ovs, ok := ov.([]string); ok {
-			fc.sort = ovs
-		} else {
-			err = errors.New("Invalid sort option value")
-		}
+func (s *traceSpan) child(name string) *traceSpan {
+	if s == nil {
+		return nil
 	}
-	return
+	span := s.tracer.newSpan(name)
+	span.traceID = s.traceID
+	span.parentID = s.spanID
+	for _, k := range []string{"namespace", "id"} {
+		span.attributes[k] = s.attributes[k]
+	}
+	return span
 }
 
-func (fc *findCall) setLimit(topts map[string]interface{}) (err error) {
-	if ov, ok := topts["limit"]; ok {
-		if ovl, ok := ov.(int64); ok {
-			fc.limit = int(ovl)
-		} else {
-			err = errors.New("Invalid limit option value")
-		}
+func (s *traceSpan) set(key, value string) {
+	if s == nil {
+		return
 	}
-	return
+	s.attributes[key] = value
 }
 
-func (fc *findCall) setQuery(v otto.Value) (err error) {
-	var q interface{}
-	if q, err = v.Export(); err == nil {
-		fc.query = fc.restoreIds(deepExportValue(q))
+// lookup is handed to golang plugins to trace lookups made while mapping
+func (s *traceSpan) lookup(name string) func() {
+	span := s.child(name)
+	return func() {
+		span.finish(nil)
 	}
-	return
 }
 
-func (fc *findCall) setOptions(v otto.Value) (err error) {
-	var opts interface{}
-	if opts, err = v.Export(); err == nil {
-		switch topts := opts.(type) {
-		case map[string]interface{}:
-			if err = fc.setDatabase(topts); err != nil {
-				return
-			}
-			if err = fc.setCollection(topts); err != nil {
-				return
-			}
-			if err = fc.setSelect(topts); err != nil {
-				return
-			}
-			if fc.isMulti() {
-				if err = fc.setSort(topts); err != nil {
-					return
-				}
-				if err = fc.setLimit(topts); err != nil {
-					return
-				}
-			}
-		default:
-			err = errors.New("Invalid options argument")
-			return
-		}
-	} else {
-		err = errors.New("Invalid options argument")
+// finish ends the span and queues it for export.  Spans are dropped rather
+// than slowing down indexing when the collector cannot keep up
+func (s *traceSpan) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	select {
+	case s.tracer.spansC <- s:
+	default:
 	}
-	return
 }
 
-func (fc *findCall) setDefaults() {
-	if fc.config.ns != "" {
-		ns := strings.SplitN(fc.config.ns, ".", 2)
-		fc.db = ns[0]
-		fc.col = ns[1]
+func (s *traceSpan) otlp() map[string]interface{} {
+	span := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              1,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+		"attributes":        otlpAttributes(s.attributes),
+	}
+	if s.parentID != [8]byte{} {
+		span["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	if len(s.links) > 0 {
+		links := make([]interface{}, len(s.links))
+		for i, l := range s.links {
+			links[i] = map[string]interface{}{
+				"traceId": hex.EncodeToString(l.traceID[:]),
+				"spanId":  hex.EncodeToString(l.spanID[:]),
+			}
+		}
+		span["links"] = links
 	}
+	if s.err != "" {
+		span["status"] = map[string]interface{}{"code": 2, "message": s.err}
+	}
+	return span
 }
 
-func (fc *findCall) getCollection() *mgo.Collection {
-	return fc.session.DB(fc.db).C(fc.col)
+func otlpAttributes(attrs map[string]string) []interface{} {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	result := make([]interface{}, len(keys))
+	for i, k := range keys {
+		result[i] = map[string]interface{}{
+			"key":   k,
+			"value": map[string]interface{}{"stringValue": attrs[k]},
+		}
+	}
+	return result
 }
 
-func (fc *findCall) getVM() *otto.Otto {
-	return fc.config.vm
+// setJSONOutput makes logger write JSON lines to its current output
+func setJSONOutput(logger *log.Logger) {
+	if _, ok := logger.Writer().(*jsonLogWriter); ok {
+		return
+	}
+	level := strings.TrimSpace(logger.Prefix())
+	logger.SetOutput(&jsonLogWriter{out: logger.Writer(), level: level})
+	logger.SetPrefix("")
+	logger.SetFlags(0)
 }
 
-func (fc *findCall) getFunctionName() string {
-	return fc.config.name
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	if err := w.write(strings.TrimSuffix(string(p), "\n"), nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
-func (fc *findCall) isMulti() bool {
-	return fc.config.multi
+func (w *jsonLogWriter) write(msg string, fields *logFields) error {
+	entry := &jsonLogEntry{
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Level:   w.level,
+		Message: msg,
+	}
+	if fields != nil {
+		entry.logFields = *fields
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		// ids which cannot be encoded must not lose the message
+		entry.ID = fmt.Sprintf("%v", entry.ID)
+		if b, err = json.Marshal(entry); err != nil {
+			return err
+		}
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	_, err = w.out.Write(append(b, '\n'))
+	return err
 }
 
-func (fc *findCall) isPipe() bool {
-	return fc.config.pipe
+// logWith logs a message along with correlation fields for JSON logs
+func logWith(logger *log.Logger, fields *logFields, format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if w, ok := logger.Writer().(*jsonLogWriter); ok {
+		if err := w.write(msg, fields); err == nil {
+			return
+		}
+	}
+	logger.Output(2, msg)
 }
 
-func (fc *findCall) pipeAllowDisk() bool {
-	return fc.config.pipeAllowDisk
+func opLogFields(op *gtm.Op) *logFields {
+	fields := &logFields{
+		Namespace: op.Namespace,
+		ID:        op.Id,
+		Operation: op.Operation,
+	}
+	if op.Timestamp != 0 {
+		fields.ResumeTs = fmt.Sprintf("%d:%d", op.Timestamp>>32, uint32(op.Timestamp))
+	}
+	return fields
 }
 
-func (fc *findCall) logError(err error) {
-	errorLog.Printf("Error in function %s: %s\n", fc.getFunctionName(), err)
+// errorClass groups errors by the system they originate from
+func errorClass(err error) string {
+	switch e := err.(type) {
+	case nil:
+		return ""
+	case *elastic.Error:
+		if isRejection(e.Status, "") {
+			return "rejected"
+		}
+		return "elasticsearch"
+	case *mgo.QueryError, *mgo.LastError, *mgo.BulkError:
+		return "mongodb"
+	case net.Error:
+		return "network"
+	}
+	if err == mgo.ErrNotFound || err == mgo.ErrCursor {
+		return "mongodb"
+	}
+	return "other"
 }
 
-func (fc *findCall) restoreIds(v interface{}) (r interface{}) {
-	switch vt := v.(type) {
-	case string:
-		if bson.IsObjectIdHex(vt) {
-			r = bson.ObjectIdHex(vt)
-		} else {
-			r = v
-		}
-	case []map[string]interface{}:
-		var avs []interface{}
-		for _, av := range vt {
-			mvs := make(map[string]interface{})
-			for k, v := range av {
-				mvs[k] = fc.restoreIds(v)
-			}
-			avs = append(avs, mvs)
-		}
-		r = avs
-	case []interface{}:
-		var avs []interface{}
-		for _, av := range vt {
-			avs = append(avs, fc.restoreIds(av))
-		}
-		r = avs
-	case map[string]interface{}:
-		mvs := make(map[string]interface{})
-		for k, v := range vt {
-			mvs[k] = fc.restoreIds(v)
-		}
-		r = mvs
-	default:
-		r = v
+func newLagMonitor(config *configOptions) *lagMonitor {
+	return &lagMonitor{
+		threshold:   time.Duration(config.ReplicationLagThreshold) * time.Second,
+		alertURL:    config.ReplicationLagAlertURL,
+		clusterName: config.ClusterName,
+		resumeName:  config.ResumeName,
+		client:      &http.Client{Timeout: 10 * time.Second},
 	}
-	return
 }
 
-func (fc *findCall) execute() (r otto.Value, err error) {
-	var q *mgo.Query
-	col := fc.getCollection()
-	if fc.isMulti() {
-		if fc.isPipe() {
-			pipe := col.Pipe(fc.query)
-			if fc.pipeAllowDisk() {
-				pipe = pipe.AllowDiskUse()
-			}
-			var docs []map[string]interface{}
-			if err = pipe.All(&docs); err == nil {
-				var rdocs []map[string]interface{}
-				for _, doc := range docs {
-					rdocs = append(rdocs, convertMapJavascript(doc))
-				}
-				r, err = fc.getVM().ToValue(rdocs)
-			}
-		} else {
-			q = col.Find(fc.query)
-			if fc.limit > 0 {
-				q.Limit(fc.limit)
-			}
-			if len(fc.sort) > 0 {
-				q.Sort(fc.sort...)
-			}
-			if len(fc.sel) > 0 {
-				q.Select(fc.sel)
-			}
-			var docs []map[string]interface{}
-			if err = q.All(&docs); err == nil {
-				var rdocs []map[string]interface{}
-				for _, doc := range docs {
-					rdocs = append(rdocs, convertMapJavascript(doc))
-				}
-				r, err = fc.getVM().ToValue(rdocs)
-			}
-		}
+// observe measures the lag of a change event.  Events are read in cluster
+// time order so the latest event gives the lag of the whole stream
+func (lm *lagMonitor) observe(op *gtm.Op) {
+	if lm == nil || !op.IsSourceOplog() || op.Timestamp == 0 {
+		return
+	}
+	lag := time.Since(time.Unix(int64(op.Timestamp>>32), 0))
+	if lag < 0 {
+		lag = 0
+	}
+	metrics.replicationLag(op.Namespace, lag)
+	if lm.threshold == 0 {
+		return
+	}
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	lm.namespace, lm.lag = op.Namespace, lag
+	exceeded := lag > lm.threshold
+	if exceeded == lm.exceeded {
+		return
+	}
+	lm.exceeded = exceeded
+	alert := &lagAlert{
+		Status:           "resolved",
+		Namespace:        op.Namespace,
+		LagSeconds:       lag.Seconds(),
+		ThresholdSeconds: lm.threshold.Seconds(),
+		ResumeName:       lm.resumeName,
+		ClusterName:      lm.clusterName,
+		Timestamp:        time.Now().UTC().Format(time.RFC3339),
+	}
+	if exceeded {
+		alert.Status = "firing"
+		warnLog.Printf("Replication lag of %s in %s exceeds %s", lag.Truncate(time.Second), op.Namespace, lm.threshold)
 	} else {
-		if fc.config.byId {
-			q = col.FindId(fc.query)
-		} else {
-			q = col.Find(fc.query)
-		}
-		if len(fc.sel) > 0 {
-			q.Select(fc.sel)
-		}
-		doc := make(map[string]interface{})
-		if err = q.One(doc); err == nil {
-			rdoc := convertMapJavascript(doc)
-			r, err = fc.getVM().ToValue(rdoc)
-		}
+		infoLog.Printf("Replication lag of %s is back under %s", lag.Truncate(time.Second), lm.threshold)
+	}
+	notifications.send(&notification{
+		Event:     notifyReplicationLag,
+		Status:    alert.Status,
+		Message:   fmt.Sprintf("Replication lag of %s in %s against a threshold of %s", lag.Truncate(time.Second), op.Namespace, lm.threshold),
+		Namespace: op.Namespace,
+	})
+	if lm.alertURL != "" {
+		go lm.alert(alert)
 	}
-	return
 }
 
-func makeFind(fa *findConf) func(otto.FunctionCall) otto.Value {
-	return func(call otto.FunctionCall) (r otto.Value) {
-		var err error
-		fc := &findCall{
-			config:  fa,
-			session: fa.session.Copy(),
-			sel:     make(map[string]int),
-		}
-		defer fc.session.Close()
-		fc.setDefaults()
-		args := call.ArgumentList
-		argLen := len(args)
-		r = otto.NullValue()
-		if argLen >= 1 {
-			if argLen >= 2 {
-				if err = fc.setOptions(call.Argument(1)); err != nil {
-					fc.logError(err)
-					return
-				}
-			}
-			if fc.db == "" || fc.col == "" {
-				fc.logError(errors.New("Find call must specify db and collection"))
-				return
-			}
-			if err = fc.setQuery(call.Argument(0)); err == nil {
-				var result otto.Value
-				if result, err = fc.execute(); err == nil {
-					r = result
-				} else if err != mgo.ErrNotFound {
-					fc.logError(err)
-				}
-			} else {
-				fc.logError(err)
-			}
-		} else {
-			fc.logError(errors.New("At least one argument is required"))
-		}
-		return
+// check returns an error while the replication lag exceeds the threshold
+func (lm *lagMonitor) check() error {
+	if lm == nil {
+		return nil
 	}
+	lm.lock.Lock()
+	defer lm.lock.Unlock()
+	if lm.exceeded {
+		return fmt.Errorf("replication lag of %s in %s exceeds %s", lm.lag.Truncate(time.Second), lm.namespace, lm.threshold)
+	}
+	return nil
 }
 
-func findDeletedSrcDoc(config *configOptions, client *elastic.Client, op *gtm.Op) map[string]interface{} {
-	objectID := opIDToString(op)
-	termQuery := elastic.NewTermQuery("_id", objectID)
-	search := client.Search()
-	searchResult, err := search.Size(1).Index(config.DeleteIndexPattern).Query(termQuery).Do(context.Background())
+func (lm *lagMonitor) alert(alert *lagAlert) {
+	body, err := json.Marshal(alert)
 	if err != nil {
-		errorLog.Printf("Unable to find deleted document %s: %s", objectID, err)
-		return nil
+		errorLog.Printf("Unable to marshal replication lag alert: %s", err)
+		return
 	}
-	if searchResult.Hits == nil {
-		errorLog.Printf("Unable to find deleted document %s", objectID)
-		return nil
+	resp, err := lm.client.Post(lm.alertURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		errorLog.Printf("Unable to send replication lag alert: %s", err)
+		return
 	}
-	if searchResult.Hits.TotalHits == 0 {
-		errorLog.Printf("Found no hits for deleted document %s", objectID)
-		return nil
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		errorLog.Printf("Replication lag alert returned status %d", resp.StatusCode)
 	}
-	if searchResult.Hits.TotalHits > 1 {
-		errorLog.Printf("Found multiple hits for deleted document %s", objectID)
-		return nil
+}
+
+func (r *readiness) directReads(pending bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.directReadsPending = pending
+	if !pending {
+		r.catchUpSince = time.Now()
 	}
-	hit := searchResult.Hits.Hits[0]
-	if hit.Source == nil {
-		errorLog.Printf("Source unavailable for deleted document %s", objectID)
-		return nil
+}
+
+// catchUp sets how close to the cluster time the change events must be
+// before the process has started
+func (r *readiness) catchUp(lag time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.catchUpLag, r.catchUpSince = lag, time.Now()
+}
+
+// observe records the lag of the latest change event read
+func (r *readiness) observe(op *gtm.Op) {
+	if !op.IsSourceOplog() || op.Timestamp == 0 {
+		return
 	}
-	var src map[string]interface{}
-	if err = json.Unmarshal(*hit.Source, &src); err == nil {
-		src["_id"] = op.Id
-		return src
+	now := time.Now()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.started || r.catchUpLag == 0 {
+		return
 	}
-	errorLog.Printf("Unable to unmarshal deleted document %s: %s", objectID, err)
-	return nil
+	r.eventLag = now.Sub(time.Unix(int64(op.Timestamp>>32), 0))
+	r.eventAt = now
 }
 
-func doDelete(config *configOptions, client *elastic.Client, mongo *mgo.Session, bulk *elastic.BulkProcessor, op *gtm.Op) {
-	req := elastic.NewBulkDeleteRequest()
-	req.UseEasyJSON(config.EnableEasyJSON)
-	if config.DeleteStrategy == ignoreDeleteStrategy {
-		return
+// startup returns the phase of the startup sequence: direct-reads,
+// catching-up or started.  The change events have caught up once the
+// latest is within the lag or none were read for as long
+func (r *readiness) startup(now time.Time) (phase string, err error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.started {
+		return "started", nil
+	}
+	if r.directReadsPending {
+		return "direct-reads", errors.New("direct reads in progress")
+	}
+	if r.catchUpLag > 0 {
+		idleSince := r.catchUpSince
+		if r.eventAt.After(idleSince) {
+			idleSince = r.eventAt
+		}
+		caughtUp := !r.eventAt.IsZero() && r.eventLag <= r.catchUpLag
+		if !caughtUp && now.Sub(idleSince) <= r.catchUpLag {
+			return "catching-up", fmt.Errorf("change events trail the cluster time by %s", r.eventLag.Truncate(time.Second))
+		}
+	}
+	r.started = true
+	return "started", nil
+}
+
+// progress records the latest timestamps read and saved.  The resume
+// timestamp is advancing while it keeps up with the events read
+func (r *readiness) progress(lastTs, savedTs bson.MongoTimestamp) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if savedTs > r.savedTs || lastTs <= savedTs {
+		r.lastAdvance = time.Now()
+	}
+	r.lastTs, r.savedTs = lastTs, savedTs
+}
+
+func (r *readiness) check() (directReads, resume error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.directReadsPending {
+		directReads = errors.New("direct reads in progress")
 	}
-	objectID, indexType, meta := opIDToString(op), mapIndexType(config, op), &indexingMeta{}
-	req.Id(objectID)
-	if config.IndexAsUpdate == false {
-		req.Version(int64(op.Timestamp))
-		req.VersionType("external")
+	if stalled := time.Since(r.lastAdvance); stalled > resumeStallTimeout {
+		resume = fmt.Errorf("resume timestamp has not advanced for %s", stalled.Truncate(time.Second))
 	}
-	if config.DeleteStrategy == statefulDeleteStrategy {
-		if routingNamespaces[""] || routingNamespaces[op.Namespace] {
-			meta = getIndexMeta(mongo, op.Namespace, objectID, config)
-		}
-		req.Index(indexType.Index)
-		req.Type(indexType.Type)
-		if meta.Index != "" {
-			req.Index(meta.Index)
-		}
-		if meta.Type != "" {
-			req.Type(meta.Type)
-		}
-		if meta.Routing != "" {
-			req.Routing(meta.Routing)
-		}
-		if meta.Parent != "" {
-			req.Parent(meta.Parent)
-		}
-	} else if config.DeleteStrategy == statelessDeleteStrategy {
-		if routingNamespaces[""] || routingNamespaces[op.Namespace] {
-			termQuery := elastic.NewTermQuery("_id", objectID)
-			searchResult, err := client.Search().FetchSource(false).Size(1).Index(config.DeleteIndexPattern).Query(termQuery).Do(context.Background())
-			if err != nil {
-				errorLog.Printf("Unable to delete document %s: %s", objectID, err)
-				return
-			}
-			if searchResult.Hits != nil && searchResult.Hits.TotalHits == 1 {
-				hit := searchResult.Hits.Hits[0]
-				req.Index(hit.Index)
-				req.Type(hit.Type)
-				if hit.Routing != "" {
-					req.Routing(hit.Routing)
-				}
-				if hit.Parent != "" {
-					req.Parent(hit.Parent)
-				}
-			} else {
-				errorLog.Printf("Failed to find unique document %s for deletion using index pattern %s", objectID, config.DeleteIndexPattern)
-				return
-			}
+	return
+}
+
+// readyChecks runs the checks behind /readyz
+func (ctx *httpServerCtx) readyChecks() (checks map[string]string, ready bool) {
+	checks = make(map[string]string)
+	ready = true
+	result := func(name string, err error) {
+		if err != nil {
+			checks[name] = err.Error()
+			ready = false
 		} else {
-			req.Index(indexType.Index)
-			req.Type(indexType.Type)
+			checks[name] = "ok"
 		}
-	} else {
-		return
 	}
-	bulk.Add(req)
+	if ctx.mongo != nil {
+		session := ctx.mongo.Copy()
+		result("mongodb", session.Ping())
+		session.Close()
+	}
+	if ctx.client != nil && !ctx.config.DisableElasticsearch {
+		c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err := ctx.client.ClusterHealth().Do(c)
+		cancel()
+		result("elasticsearch", err)
+	}
+	_, startup := readyState.startup(time.Now())
+	result("startup", startup)
+	directReads, resume := readyState.check()
+	result("direct-reads", directReads)
+	if ctx.config.Resume {
+		result("resume", resume)
+	}
+	if replicationLag != nil && ctx.config.ReplicationLagThreshold > 0 {
+		result("replication-lag", replicationLag.check())
+	}
 	return
 }
 
-func gtmDefaultSettings() gtmSettings {
-	return gtmSettings{
-		ChannelSize:    gtmChannelSizeDefault,
-		BufferSize:     32,
-		BufferDuration: "75ms",
+// exportStatsd flushes the metrics to StatsD every interval
+func (m *monstacheMetrics) exportStatsd(interval time.Duration) {
+	for range time.Tick(interval) {
+		m.queueLock.Lock()
+		for name, depth := range m.queues {
+			m.statsd.gauge("queue_depth", float64(depth()), "queue:"+name)
+		}
+		m.queueLock.Unlock()
+		m.statsd.gauge("checkpoint_age_seconds", m.checkpointAge())
+		if err := m.statsd.flush(); err != nil {
+			errorLog.Printf("Unable to send metrics to StatsD: %s", err)
+		}
 	}
 }
 
-func notifySdFailed(config *configOptions, err error) {
+func newStatsdClient(addr, prefix string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
 	if err != nil {
-		errorLog.Printf("Systemd notification failed: %s", err)
-	} else {
-		if config.Verbose {
-			warnLog.Println("Systemd notification not supported (i.e. NOTIFY_SOCKET is unset)")
-		}
+		return nil, err
 	}
+	return &statsdClient{
+		conn:     conn,
+		prefix:   prefix,
+		counters: make(map[string]int64),
+		gauges:   make(map[string]float64),
+	}, nil
 }
 
-func watchdogSdFailed(config *configOptions, err error) {
-	if err != nil {
-		errorLog.Printf("Error determining systemd WATCHDOG interval: %s", err)
-	} else {
-		if config.Verbose {
-			warnLog.Println("Systemd WATCHDOG not enabled")
-		}
+// statsdKey is the name and DogStatsD tags of a metric
+func statsdKey(name string, tags []string) string {
+	if len(tags) == 0 {
+		return name
 	}
+	clean := make([]string, len(tags))
+	for i, tag := range tags {
+		clean[i] = strings.NewReplacer(",", "_", "|", "_", "#", "_").Replace(tag)
+	}
+	return name + "|#" + strings.Join(clean, ",")
 }
 
-func (ctx *httpServerCtx) serveHttp() {
-	s := ctx.httpServer
-	if ctx.config.Verbose {
-		infoLog.Printf("Starting http server at %s", s.Addr)
+func (c *statsdClient) count(name string, n int64, tags ...string) {
+	if c == nil {
+		return
 	}
-	ctx.started = time.Now()
-	err := s.ListenAndServe()
-	if !ctx.shutdown {
-		panic(fmt.Sprintf("Unable to serve http at address %s: %s", s.Addr, err))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counters[statsdKey(name, tags)] += n
+}
+
+func (c *statsdClient) gauge(name string, value float64, tags ...string) {
+	if c == nil {
+		return
 	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.gauges[statsdKey(name, tags)] = value
 }
 
-func (ctx *httpServerCtx) buildServer() {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/started", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(200)
-		data := (time.Now().Sub(ctx.started)).String()
-		w.Write([]byte(data))
-	})
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
-		w.WriteHeader(200)
-		w.Write([]byte("ok"))
-	})
-	if ctx.config.Stats {
-		mux.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
-			stats, err := json.MarshalIndent(ctx.bulk.Stats(), "", "    ")
-			if err == nil {
-				w.Header().Set("Content-Type", "application/json")
-				w.WriteHeader(200)
-				w.Write(stats)
-			} else {
-				w.WriteHeader(500)
-				fmt.Fprintf(w, "Unable to print statistics: %s", err)
-			}
-		})
+func (c *statsdClient) timing(name string, d time.Duration, tags ...string) {
+	if c == nil {
+		return
 	}
-	mux.HandleFunc("/instance", func(w http.ResponseWriter, req *http.Request) {
-		hostname, err := os.Hostname()
+	ms := strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.write(name, ms+"|ms", tags)
+}
+
+// write buffers a line and sends the buffer once another line would not
+// fit in a single datagram.  It must be called with the lock held
+func (c *statsdClient) write(name, value string, tags []string) error {
+	key := statsdKey(name, tags)
+	var line string
+	if i := strings.Index(key, "|#"); i >= 0 {
+		line = c.prefix + key[:i] + ":" + value + key[i:]
+	} else {
+		line = c.prefix + key + ":" + value
+	}
+	var err error
+	if c.buf.Len() > 0 && c.buf.Len()+len(line)+1 > statsdMaxPacket {
+		err = c.send()
+	}
+	if c.buf.Len() > 0 {
+		c.buf.WriteByte('\n')
+	}
+	c.buf.WriteString(line)
+	return err
+}
+
+func (c *statsdClient) send() error {
+	if c.buf.Len() == 0 {
+		return nil
+	}
+	_, err := c.conn.Write(c.buf.Bytes())
+	c.buf.Reset()
+	return err
+}
+
+// flush sends the aggregated counters and gauges along with any buffered
+// timings
+func (c *statsdClient) flush() error {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var errs []string
+	record := func(err error) {
 		if err != nil {
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "Unable to get hostname for instance info: %s", err)
-			return
-		}
-		status := instanceStatus{
-			Pid:         os.Getpid(),
-			Hostname:    hostname,
-			ResumeName:  ctx.config.ResumeName,
-			ClusterName: ctx.config.ClusterName,
-		}
-		respC := make(chan *statusResponse)
-		statusReq := &statusRequest{
-			responseC: respC,
-		}
-		timer := time.NewTimer(5 * time.Second)
-		defer timer.Stop()
-		select {
-		case statusReqC <- statusReq:
-			srsp := <-respC
-			if srsp != nil {
-				status.Enabled = srsp.enabled
-				status.LastTs = srsp.lastTs
-				if srsp.lastTs != 0 {
-					status.LastTsFormat = time.Unix(int64(srsp.lastTs>>32), 0).Format("2006-01-02T15:04:05")
-				}
-			}
-			data, err := json.Marshal(status)
-			if err != nil {
-				w.WriteHeader(500)
-				fmt.Fprintf(w, "Unable to print instance info: %s", err)
-				break
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(200)
-			w.Write(data)
-			fmt.Fprintln(w)
-			break
-		case <-timer.C:
-			w.WriteHeader(500)
-			fmt.Fprintf(w, "Timeout getting instance info")
-			break
+			errs = append(errs, err.Error())
 		}
-	})
-	if ctx.config.Pprof {
-		mux.HandleFunc("/debug/pprof/", pprof.Index)
-		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	}
-	s := &http.Server{
-		Addr:     ctx.config.HTTPServerAddr,
-		Handler:  mux,
-		ErrorLog: errorLog,
+	for key, n := range c.counters {
+		record(c.write(key, strconv.FormatInt(n, 10)+"|c", nil))
 	}
-	ctx.httpServer = s
+	for key, v := range c.gauges {
+		record(c.write(key, strconv.FormatFloat(v, 'f', -1, 64)+"|g", nil))
+	}
+	c.counters = make(map[string]int64)
+	record(c.send())
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
 }
 
-func notifySd(config *configOptions) {
-	var interval time.Duration
-	if config.Verbose {
-		infoLog.Println("Sending systemd READY=1")
+func newDocumentDumper(config *configOptions) *documentDumper {
+	dd := &documentDumper{
+		rate: config.DebugSampleRate,
+		ids:  make(map[string]bool),
 	}
-	sent, err := daemon.SdNotify(false, "READY=1")
-	if sent {
-		if config.Verbose {
-			infoLog.Println("READY=1 successfully sent to systemd")
-		}
+	for _, id := range config.DebugDocumentIds {
+		dd.ids[id] = true
+	}
+	return dd
+}
+
+// start decides whether op is dumped.  Sampled ops must be finished
+func (dd *documentDumper) start(op *gtm.Op) bool {
+	if dd == nil {
+		return false
+	}
+	if _, ok := dd.sampled.Load(op); ok {
+		// already sampled by an enclosing call
+		return false
+	}
+	if !dd.ids[fmt.Sprintf("%v", op.Id)] && rand.Float64() >= dd.rate {
+		return false
+	}
+	dd.sampled.Store(op, true)
+	return true
+}
+
+func (dd *documentDumper) finish(op *gtm.Op) {
+	dd.sampled.Delete(op)
+}
+
+func (dd *documentDumper) dump(op *gtm.Op, stage string, doc map[string]interface{}) {
+	if dd == nil {
+		return
+	}
+	if _, ok := dd.sampled.Load(op); !ok {
+		return
+	}
+	if len(redactions[op.Namespace])+len(piiScans[op.Namespace]) > 0 && doc != nil {
+		doc = copyValue(doc).(map[string]interface{})
+		scanPII(op.Namespace, doc)
+		redactFields(op.Namespace, doc)
+	}
+	var text string
+	if doc == nil {
+		text = "null"
+	} else if b, err := json.Marshal(doc); err == nil {
+		text = string(b)
 	} else {
-		notifySdFailed(config, err)
+		text = fmt.Sprintf("%v", doc)
+	}
+	if len(text) > dumpMaxBytes {
+		text = text[:dumpMaxBytes] + "...(truncated)"
+	}
+	logWith(traceLog, opLogFields(op), "Document %v in %s %s: %s", op.Id, op.Namespace, stage, text)
+}
+
+// action dumps the bulk action generated for a sampled op
+func (dd *documentDumper) action(op *gtm.Op, req elastic.BulkableRequest) {
+	if dd == nil || op == nil {
 		return
 	}
-	interval, err = daemon.SdWatchdogEnabled(false)
-	if err != nil || interval == 0 {
-		watchdogSdFailed(config, err)
+	if _, ok := dd.sampled.Load(op); !ok {
 		return
 	}
-	for {
-		if config.Verbose {
-			infoLog.Println("Sending systemd WATCHDOG=1")
-		}
-		sent, err = daemon.SdNotify(false, "WATCHDOG=1")
-		if sent {
-			if config.Verbose {
-				infoLog.Println("WATCHDOG=1 successfully sent to systemd")
-			}
-		} else {
-			notifySdFailed(config, err)
+	lines, err := req.Source()
+	if err != nil {
+		return
+	}
+	text := strings.Join(lines, "\n")
+	if len(text) > dumpMaxBytes {
+		text = text[:dumpMaxBytes] + "...(truncated)"
+	}
+	fields, id, ns := opLogFields(op), op.Id, op.Namespace
+	logWith(traceLog, fields, "Document %v in %s bulk action: %s", id, ns, text)
+	onBulkItem(req, func(item *elastic.BulkResponseItem, err error) {
+		if err != nil {
+			logWith(traceLog, fields, "Document %v in %s bulk request failed: %s", id, ns, err)
 			return
 		}
-		time.Sleep(interval / 2)
+		b, _ := json.Marshal(item)
+		logWith(traceLog, fields, "Document %v in %s bulk response: %s", id, ns, string(b))
+	})
+}
+
+func (s *chaosSettings) enabled() bool {
+	return s.MongoErrorRate > 0 || s.ElasticErrorRate > 0 || s.PluginTimeoutRate > 0 || s.PauseRate > 0
+}
+
+func (s *chaosSettings) validate() error {
+	rates := map[string]float64{
+		"mongo-error-rate":         s.MongoErrorRate,
+		"elasticsearch-error-rate": s.ElasticErrorRate,
+		"plugin-timeout-rate":      s.PluginTimeoutRate,
+		"pause-rate":               s.PauseRate,
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("Chaos %s must be between 0 and 1", name)
+		}
 	}
+	if s.PauseSeconds < 0 {
+		return errors.New("Chaos pause-seconds must not be negative")
+	}
+	return nil
 }
 
-func (config *configOptions) makeShardInsertHandler() gtm.ShardInsertHandler {
-	return func(shardInfo *gtm.ShardInfo) (*mgo.Session, error) {
-		shardURL := shardInfo.GetURL()
-		infoLog.Printf("Adding shard found at %s\n", cleanMongoURL(shardURL))
-		return config.dialMongo(shardURL)
+func newFaultInjector(config *configOptions) *faultInjector {
+	settings := config.Chaos
+	if settings.PauseSeconds == 0 {
+		settings.PauseSeconds = chaosPauseSecondsDefault
+	}
+	seed := settings.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
 	}
+	warnLog.Printf("Chaos testing is enabled with seed %d. Failures will be injected", seed)
+	return &faultInjector{settings: settings, random: rand.New(rand.NewSource(seed))}
 }
 
-func buildPipe(config *configOptions) func(string, bool) ([]interface{}, error) {
-	if pipePlugin != nil {
-		return pipePlugin
-	} else if len(pipeEnvs) > 0 {
-		return func(ns string, changeEvent bool) ([]interface{}, error) {
-			mux.Lock()
-			defer mux.Unlock()
-			nss := []string{"", ns}
-			for _, ns := range nss {
-				if env := pipeEnvs[ns]; env != nil {
-					env.lock.Lock()
-					defer env.lock.Unlock()
-					val, err := env.VM.Call("module.exports", ns, ns, changeEvent)
-					if err != nil {
-						return nil, err
-					}
-					if strings.ToLower(val.Class()) == "array" {
-						data, err := val.Export()
-						if err != nil {
-							return nil, err
-						} else if data == val {
-							return nil, errors.New("Exported pipeline function must return an array")
-						} else {
-							switch data.(type) {
-							case []map[string]interface{}:
-								ds := data.([]map[string]interface{})
-								var is []interface{} = make([]interface{}, len(ds))
-								for i, d := range ds {
-									is[i] = deepExportValue(d)
-								}
-								return is, nil
-							case []interface{}:
-								ds := data.([]interface{})
-								if len(ds) > 0 {
-									panic("Pipeline function must return an array of objects")
-								}
-								return nil, nil
-							default:
-								panic("Pipeline function must return an array of objects")
-							}
-						}
-					} else {
-						return nil, errors.New("Exported pipeline function must return an array")
-					}
-				}
-			}
-			return nil, nil
+// inject returns true if the next operation of kind fails at rate
+func (fi *faultInjector) inject(kind string, rate float64) bool {
+	if fi == nil || rate <= 0 {
+		return false
+	}
+	fi.lock.Lock()
+	hit := fi.random.Float64() < rate
+	fi.lock.Unlock()
+	if hit {
+		metrics.faultInjected(kind)
+	}
+	return hit
+}
+
+// elasticError returns the status of an injected Elasticsearch failure or
+// 0 if the request should be sent
+func (fi *faultInjector) elasticError() int {
+	if !fi.inject("elasticsearch", fi.settings.ElasticErrorRate) {
+		return 0
+	}
+	fi.lock.Lock()
+	defer fi.lock.Unlock()
+	if fi.random.Intn(2) == 0 {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusServiceUnavailable
+}
+
+// pluginTimeout returns an error in place of calling a plugin
+func (fi *faultInjector) pluginTimeout(kind string) error {
+	if fi == nil || !fi.inject("plugin", fi.settings.PluginTimeoutRate) {
+		return nil
+	}
+	return fmt.Errorf("%s plugin timed out (injected by chaos testing)", kind)
+}
+
+// pause stalls the caller as a long garbage collection or a stopped
+// process would
+func (fi *faultInjector) pause() {
+	if fi == nil || !fi.inject("pause", fi.settings.PauseRate) {
+		return
+	}
+	d := time.Duration(fi.settings.PauseSeconds) * time.Second
+	warnLog.Printf("Pausing for %s (injected by chaos testing)", d)
+	time.Sleep(d)
+}
+
+// dialer wraps dial so that reads from the connections may fail
+func (fi *faultInjector) dialer(dial func(*mgo.ServerAddr) (net.Conn, error)) func(*mgo.ServerAddr) (net.Conn, error) {
+	return func(addr *mgo.ServerAddr) (net.Conn, error) {
+		conn, err := dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		return &chaosConn{Conn: conn}, nil
+	}
+}
+
+func (c *chaosConn) Read(b []byte) (int, error) {
+	if chaos.inject("mongo", chaos.settings.MongoErrorRate) {
+		c.Conn.Close()
+		return 0, errors.New("connection reset (injected by chaos testing)")
+	}
+	return c.Conn.Read(b)
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	status := chaos.elasticError()
+	if status == 0 {
+		return t.transport.RoundTrip(req)
+	}
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	errType := "es_rejected_execution_exception"
+	if status == http.StatusServiceUnavailable {
+		errType = "cluster_block_exception"
+	}
+	body := fmt.Sprintf(`{"error":{"type":%q,"reason":"injected by chaos testing"},"status":%d}`, errType, status)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// callPlugin runs a golang plugin function for op.  A panic in the plugin
+// quarantines the document by failing it instead of crashing the process
+func callPlugin(kind string, op *gtm.Op, call func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%s plugin panicked: %v", kind, r)
+			logWith(errorLog, opLogFields(op), "Quarantined document %v in %s after %s", op.Id, op.Namespace, err)
+			notifications.send(&notification{
+				Event:     notifyPluginPanic,
+				Status:    "firing",
+				Message:   fmt.Sprintf("Quarantined document %v in %s after %s", op.Id, op.Namespace, err),
+				Namespace: op.Namespace,
+			})
 		}
+	}()
+	if err = chaos.pluginTimeout(kind); err != nil {
+		return err
 	}
-	return nil
+	return call()
 }
 
-func shutdown(timeout int, hsc *httpServerCtx, bulk *elastic.BulkProcessor, bulkStats *elastic.BulkProcessor, mongo *mgo.Session, config *configOptions) {
-	infoLog.Println("Shutting down")
-	closeC := make(chan bool)
-	go func() {
-		if mongo != nil && config.ClusterName != "" {
-			resetClusterState(mongo, config)
+// isResumeGap returns true if err means the change events following the
+// resume point have rolled off the oplog
+func isResumeGap(err error) bool {
+	if qe, ok := err.(*mgo.QueryError); ok {
+		switch qe.Code {
+		// CappedPositionLost, ChangeStreamFatalError, ChangeStreamHistoryLost
+		case 136, 280, 286:
+			return true
 		}
-		if hsc != nil {
-			hsc.shutdown = true
-			hsc.httpServer.Shutdown(context.Background())
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "ChangeStreamHistoryLost") ||
+		strings.Contains(msg, "resume point may no longer be in the oplog")
+}
+
+func newNotifier(config *configOptions) *notifier {
+	return &notifier{
+		webhooks:          config.NotifyWebhooks,
+		interval:          time.Duration(config.NotifyRateLimit) * time.Second,
+		bulkFailureWindow: time.Duration(config.NotifyBulkFailureSeconds) * time.Second,
+		clusterName:       config.ClusterName,
+		resumeName:        config.ResumeName,
+		client:            &http.Client{Timeout: 10 * time.Second},
+		sent:              make(map[string]time.Time),
+		suppressed:        make(map[string]int),
+	}
+}
+
+// bulkOutcome tracks the number of failed requests in each bulk response and
+// notifies once bulk requests have kept failing for the bulk failure window
+func (nt *notifier) bulkOutcome(failed int) {
+	if nt == nil {
+		return
+	}
+	var n *notification
+	nt.lock.Lock()
+	if failed == 0 {
+		if nt.bulkFailing {
+			n = &notification{
+				Event:   notifyBulkFailure,
+				Status:  "resolved",
+				Message: fmt.Sprintf("Bulk requests are succeeding again after %d failures", nt.bulkFailures),
+			}
 		}
-		if bulk != nil {
-			bulk.Stop()
+		nt.failingSince, nt.bulkFailures, nt.bulkFailing = time.Time{}, 0, false
+	} else {
+		now := time.Now()
+		if nt.failingSince.IsZero() {
+			nt.failingSince = now
+		}
+		nt.bulkFailures += failed
+		if !nt.bulkFailing && now.Sub(nt.failingSince) >= nt.bulkFailureWindow {
+			nt.bulkFailing = true
+			n = &notification{
+				Event:   notifyBulkFailure,
+				Status:  "firing",
+				Message: fmt.Sprintf("%d bulk requests have failed over the last %s", nt.bulkFailures, now.Sub(nt.failingSince).Truncate(time.Second)),
+			}
 		}
-		if bulkStats != nil {
-			bulkStats.Stop()
+	}
+	nt.lock.Unlock()
+	if n != nil {
+		nt.send(n)
+	}
+}
+
+// send posts n to the webhooks subscribed to its event unless the same
+// notification was sent within the rate limit interval
+func (nt *notifier) send(n *notification) {
+	if nt == nil {
+		return
+	}
+	key := strings.Join([]string{n.Event, n.Status, n.Namespace}, "/")
+	now := time.Now()
+	nt.lock.Lock()
+	if last, ok := nt.sent[key]; ok && now.Sub(last) < nt.interval {
+		nt.suppressed[key]++
+		nt.lock.Unlock()
+		return
+	}
+	nt.sent[key] = now
+	n.Suppressed = nt.suppressed[key]
+	delete(nt.suppressed, key)
+	nt.lock.Unlock()
+	n.ResumeName = nt.resumeName
+	n.ClusterName = nt.clusterName
+	n.Timestamp = now.UTC().Format(time.RFC3339)
+	for _, hook := range nt.webhooks {
+		if hook.subscribed(n.Event) {
+			go nt.post(hook, n)
 		}
-		close(closeC)
-	}()
-	doneC := make(chan bool)
-	go func() {
-		closeT := time.NewTicker(time.Duration(timeout) * time.Second)
-		done := false
-		for !done {
-			select {
-			case <-closeC:
-				done = true
-				close(doneC)
-			case <-closeT.C:
-				done = true
-				close(doneC)
-			}
+	}
+}
+
+// subscribed returns true if the webhook receives notifications of event.
+// Webhooks without a list of events receive all of them
+func (hook notifyWebhook) subscribed(event string) bool {
+	if len(hook.Events) == 0 {
+		return true
+	}
+	for _, e := range hook.Events {
+		if e == event {
+			return true
 		}
-	}()
-	<-doneC
-	os.Exit(exitStatus)
+	}
+	return false
+}
+
+func (nt *notifier) post(hook notifyWebhook, n *notification) {
+	var payload interface{} = n
+	if hook.Format == "slack" {
+		payload = n.slack()
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		errorLog.Printf("Unable to marshal %s notification: %s", n.Event, err)
+		return
+	}
+	resp, err := nt.client.Post(hook.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		errorLog.Printf("Unable to send %s notification: %s", n.Event, err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		errorLog.Printf("Notification webhook for %s returned status %d", n.Event, resp.StatusCode)
+	}
+}
+
+func (n *notification) slack() *slackMessage {
+	color := "danger"
+	if n.Status == "resolved" {
+		color = "good"
+	}
+	fields := []slackField{
+		{Title: "Event", Value: n.Event, Short: true},
+		{Title: "Resume name", Value: n.ResumeName, Short: true},
+	}
+	if n.Namespace != "" {
+		fields = append(fields, slackField{Title: "Namespace", Value: n.Namespace, Short: true})
+	}
+	if n.ClusterName != "" {
+		fields = append(fields, slackField{Title: "Cluster name", Value: n.ClusterName, Short: true})
+	}
+	if n.Suppressed > 0 {
+		fields = append(fields, slackField{Title: "Suppressed repeats", Value: strconv.Itoa(n.Suppressed), Short: true})
+	}
+	return &slackMessage{
+		Text:        fmt.Sprintf("[monstache %s] %s", n.Status, n.Message),
+		Attachments: []slackAttachment{{Color: color, Fields: fields}},
+	}
 }
 
 func handlePanic() {
@@ -3874,17 +23172,57 @@ func main() {
 		MongoSessionSettings: mongoSessionSettings{SocketTimeout: -1, SyncTimeout: -1},
 		GtmSettings:          gtmDefaultSettings(),
 	}
+	command, args, err := parseSubcommand(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if command == "init" {
+		os.Exit(config.initStarterConfig(args))
+	}
+	os.Args = append(os.Args[:1], args...)
 	config.parseCommandLineFlags()
 	if config.Version {
 		fmt.Println(version)
 		os.Exit(0)
 	}
+	switch command {
+	case "config init":
+		os.Exit(initConfig(flag.Arg(0)))
+	case "config migrate":
+		os.Exit(migrateConfigFile(flag.Arg(0), flag.Arg(1)))
+	case "service install":
+		os.Exit(installService(args))
+	case "service uninstall":
+		os.Exit(uninstallService())
+	}
 	config.loadEnvironment()
 	config.loadTimeMachineNamespaces()
 	config.loadRoutingNamespaces()
 	config.loadPatchNamespaces()
+	config.loadPartialUpdateNamespaces()
+	config.loadArrayUpdateNamespaces()
+	config.loadStreamJSONNamespaces()
 	config.loadGridFsConfig()
+	config.loadFileMetadataNamespaces()
+	if config.central, err = config.newCentralConfig(); err != nil {
+		panic(err)
+	}
 	config.loadConfigFile()
+	if err := config.resolveSecrets(); err != nil {
+		panic(err)
+	}
+	if command == "replay" {
+		if err := config.replayFrom(flag.Args()); err != nil {
+			panic(err)
+		}
+	}
+	if config.ReplayFile != "" {
+		// the recording is the only source of events and the resume
+		// position is left to the processes which sync continuously
+		config.DisableChangeEvents, config.DirectReadNs = true, nil
+		config.Replay, config.Resume = false, false
+	}
 	config.loadPlugins()
 	config.setDefaults()
 	if config.Print {
@@ -3892,15 +23230,93 @@ func main() {
 		os.Exit(0)
 	}
 	config.setupLogging()
+	if command == "service run" {
+		if err := startService(config); err != nil {
+			panic(fmt.Sprintf("Unable to run as a service: %s", err))
+		}
+	}
 	config.validate()
+	if config.TikaURL != "" {
+		tika = newTikaClient(config)
+	}
+	if config.Chaos.enabled() {
+		chaos = newFaultInjector(config)
+	}
+	if config.OffloadStore.enabled() {
+		if err := config.OffloadStore.start(); err != nil {
+			panic(fmt.Sprintf("Unable to connect to the offload store: %s", err))
+		}
+	}
+	switch command {
+	case "check":
+		os.Exit(config.check())
+	case "verify":
+		os.Exit(config.verify(false))
+	case "repair":
+		os.Exit(config.verify(true))
+	case "preview":
+		os.Exit(config.preview())
+	case "resume export":
+		os.Exit(config.exportResume(flag.Arg(0)))
+	case "resume import":
+		os.Exit(config.importResume(flag.Arg(0)))
+	case "support-bundle":
+		os.Exit(config.fetchSupportBundle(flag.Arg(0)))
+	}
 
-	sigs := make(chan os.Signal, 1)
+	if len(secrets) > 0 {
+		go config.refreshSecrets()
+	}
+	if config.Metrics || config.StatsdAddr != "" {
+		metrics = newMetrics()
+	}
+	if config.StatsdAddr != "" {
+		if metrics.statsd, err = newStatsdClient(config.StatsdAddr, config.StatsdPrefix); err != nil {
+			panic(fmt.Sprintf("Unable to connect to StatsD at %s: %s", config.StatsdAddr, err))
+		}
+		go metrics.exportStatsd(time.Duration(config.StatsdFlushSeconds) * time.Second)
+	}
+	if config.Stats || config.IndexStats {
+		docStats = newDocumentStats()
+	}
+	if config.DebugSampleRate > 0 || len(config.DebugDocumentIds) > 0 {
+		docDumps = newDocumentDumper(config)
+		warnLog.Println("Logging sampled documents to the trace log")
+	}
+	if !config.MongoValidatePemFile {
+		warnLog.Println("INSECURE: TLS certificates of MongoDB are not verified and connections can be intercepted. Only disable mongo-validate-pem-file for testing")
+	}
+	if !config.ElasticValidatePemFile {
+		warnLog.Println("INSECURE: TLS certificates of Elasticsearch are not verified and connections can be intercepted. Only disable elasticsearch-validate-pem-file for testing")
+	}
+	if len(config.NotifyWebhooks) > 0 {
+		notifications = newNotifier(config)
+	}
+	if config.DeleteRoutingChanges {
+		routingChanges = newRoutingTracker(config)
+	}
+	if metrics != nil || config.ReplicationLagThreshold > 0 {
+		replicationLag = newLagMonitor(config)
+	}
+	if config.TracingEndpoint != "" {
+		tracing = newTracer(config)
+		go tracing.export()
+		infoLog.Printf("Exporting traces to %s", config.TracingEndpoint)
+	}
+
+	sigs := shutdownSigs
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
 	mongo, err := config.dialMongo(config.MongoURL)
 	if err != nil {
 		panic(fmt.Sprintf("Unable to connect to MongoDB using URL %s: %s", cleanMongoURL(config.MongoURL), err))
 	}
 	infoLog.Printf("Started monstache version %s", version)
+	mongoLogins.track(mongo)
+	references.start(mongo)
+	if mapperPlugin != nil || processPlugin != nil {
+		pluginLookups = monstachemap.NewBatcher(mongo,
+			time.Duration(config.LookupBatchWindowMs)*time.Millisecond, config.LookupBatchMax)
+	}
 	if mongoInfo, err := mongo.BuildInfo(); err == nil {
 		infoLog.Printf("Successfully connected to MongoDB version %s", mongoInfo.Version)
 	} else {
@@ -3913,20 +23329,57 @@ func main() {
 	if err != nil {
 		panic(fmt.Sprintf("Unable to create Elasticsearch client: %s", err))
 	}
-	if config.ElasticVersion == "" {
+	if config.DryRun {
+		infoLog.Printf("Dry run is enabled. Bulk actions are written to %s", config.NDJSONFile)
+	} else if config.DisableElasticsearch {
+		infoLog.Printf("Writing to Elasticsearch is disabled. Changes are written to %s", strings.Join(config.sinkNames(), ", "))
+	} else if config.ElasticVersion == "" {
 		if err := config.testElasticsearchConn(elasticClient); err != nil {
 			panic(fmt.Sprintf("Unable to validate connection to Elasticsearch: %s", err))
 		}
 	} else {
-		if err := config.parseElasticsearchVersion(config.ElasticVersion); err != nil {
+		if err := config.parseServerVersion(config.ElasticVersion); err != nil {
 			panic(fmt.Sprintf("Elasticsearch version must conform to major.minor.fix: %s", err))
 		}
 	}
+	if config.ReplayDeadLetters {
+		if err := replayDeadLetters(elasticClient, config); err != nil {
+			panic(fmt.Sprintf("Unable to replay dead letters: %s", err))
+		}
+		return
+	}
+	if deadLetters, err = config.newDeadLetterQueue(elasticClient); err != nil {
+		panic(fmt.Sprintf("Unable to open dead letter queue: %s", err))
+	}
+	defer deadLetters.close()
+	if audit, err = config.newAuditLog(elasticClient); err != nil {
+		panic(fmt.Sprintf("Unable to open audit log: %s", err))
+	}
+	defer audit.close()
+	if secondary, err = config.newSecondaryCluster(); err != nil {
+		panic(fmt.Sprintf("Unable to connect to the secondary Elasticsearch cluster: %s", err))
+	}
+	if err = config.newSinks(); err != nil {
+		panic(fmt.Sprintf("Unable to start sinks: %s", err))
+	}
+	if config.NDJSONFile != "" {
+		if ndjsonOut, err = newNDJSONWriter(config.NDJSONFile); err != nil {
+			panic(fmt.Sprintf("Unable to open NDJSON output: %s", err))
+		}
+	}
+	if config.RecordFile != "" {
+		if recorder, err = newEventRecorder(config.RecordFile, config.DiskCompression == "zstd"); err != nil {
+			panic(fmt.Sprintf("Unable to open recording: %s", err))
+		}
+	}
 	bulk, err := config.newBulkProcessor(elasticClient)
 	if err != nil {
 		panic(fmt.Sprintf("Unable to start bulk processor: %s", err))
 	}
-	defer bulk.Stop()
+	defer stopBulks(bulk)
+	if err = config.newIndexBulkProcessors(elasticClient); err != nil {
+		panic(fmt.Sprintf("Unable to start index bulk processors: %s", err))
+	}
 	var bulkStats *elastic.BulkProcessor
 	if config.IndexStats {
 		bulkStats, err = config.newStatsBulkProcessor(elasticClient)
@@ -3936,18 +23389,45 @@ func main() {
 		defer bulkStats.Stop()
 	}
 
-	go notifySd(config)
+	reloader, err := newConfigReloader(config)
+	if err != nil {
+		panic(fmt.Sprintf("Unable to read config file: %s", err))
+	}
+	reloadC := make(chan os.Signal, 1)
+	signal.Notify(reloadC, syscall.SIGHUP)
+	go func() {
+		for range reloadC {
+			reloader.reloadAndLog()
+		}
+	}()
+	if config.central != nil {
+		go config.central.watch(func() {
+			reloader.reloadAndLog()
+		})
+	}
+
+	if config.Resume && config.CheckpointMode == "after-ack" {
+		checkpoints = newCheckpointTracker()
+	}
+	// the startup sequence is set before /readyz is served
+	readyState.catchUp(time.Duration(config.ReadyLagSeconds) * time.Second)
+	readyState.directReads(len(config.DirectReadNs) > 0)
 	var hsc *httpServerCtx
 	if config.EnableHTTPServer {
+		syncStatus = newSyncStatusTracker(mongo)
 		hsc = &httpServerCtx{
-			bulk:   bulk,
-			config: config,
+			bulk:     bulk,
+			mongo:    mongo,
+			client:   elasticClient,
+			config:   config,
+			reloader: reloader,
 		}
 		hsc.buildServer()
 		go hsc.serveHttp()
 	}
 
 	eventLoopC := make(chan bool)
+	go notifySd(config, eventLoopC)
 	go func() {
 		select {
 		case <-eventLoopC:
@@ -3982,32 +23462,74 @@ func main() {
 		}
 	}
 
+	if config.CSFLE.enabled() {
+		csfle = newCSFLE(config, mongo)
+	}
+
+	if len(indexTemplates) > 0 || len(languageRoutings) > 0 {
+		if err := ensureIndexTemplates(elasticClient, config); err != nil {
+			panic(err)
+		}
+	}
+
+	if err := ensureIngestPipelines(elasticClient); err != nil {
+		panic(err)
+	}
+
+	if err := ensureSampledMappings(mongo, elasticClient, config); err != nil {
+		panic(err)
+	}
+
+	if err := ensureRuntimeFields(elasticClient, config); err != nil {
+		panic(err)
+	}
+
+	if err := startReindexes(elasticClient, config); err != nil {
+		panic(err)
+	}
+
+	if err := startShadows(elasticClient, config); err != nil {
+		panic(err)
+	}
+
+	if err := startRollovers(elasticClient, config); err != nil {
+		panic(err)
+	}
+
 	if config.IndexFiles {
 		if len(config.FileNamespaces) == 0 {
 			errorLog.Fatalln("File indexing is ON but no file namespaces are configured")
 		}
-		if err := ensureFileMapping(elasticClient); err != nil {
-			panic(err)
+		if tika == nil {
+			if err := ensureFileMapping(elasticClient, config); err != nil {
+				panic(err)
+			}
 		}
 	}
 
-	var nsFilter, filter, directReadFilter, pluginFilter gtm.OpFilter
+	var filter, directReadFilter, pluginFilter gtm.OpFilter
 	filterChain := []gtm.OpFilter{notMonstache(config), notSystem, notChunks}
 	filterArray := []gtm.OpFilter{}
 	if config.readShards() {
 		filterChain = append(filterChain, notConfig)
 	}
-	if config.NsRegex != "" {
-		filterChain = append(filterChain, filterWithRegex(config.NsRegex))
-	}
-	if config.NsDropRegex != "" {
-		filterChain = append(filterChain, filterDropWithRegex(config.NsDropRegex))
+	if err := nsFilter.set(config); err != nil {
+		panic(err)
 	}
-	if config.NsExcludeRegex != "" {
-		filterChain = append(filterChain, filterInverseWithRegex(config.NsExcludeRegex))
+	filterChain = append(filterChain, nsFilter.match)
+	if config.ReplayUntil != "" || len(config.ReplayNamespaces) > 0 {
+		if replayEnd, err = newReplayBound(config, time.Now()); err != nil {
+			panic(fmt.Sprintf("Invalid replay-until: %s", err))
+		}
+		filterChain = append([]gtm.OpFilter{replayEnd.filter}, filterChain...)
+		if replayEnd.until != 0 {
+			go replayEnd.watch(time.Duration(config.GtmSettings.MaxAwaitSecs+10) * time.Second)
+		}
 	}
-	if config.NsDropExcludeRegex != "" {
-		filterChain = append(filterChain, filterDropInverseWithRegex(config.NsDropExcludeRegex))
+	if config.PartitionName != "" {
+		filterArray = append(filterArray, func(op *gtm.Op) bool {
+			return partition.owns(op.Namespace)
+		})
 	}
 	if config.Worker != "" {
 		workerFilter, err := consistent.ConsistentHashFilter(config.Worker, config.Workers)
@@ -4025,9 +23547,24 @@ func main() {
 		pluginFilter = filterWithScript()
 		filterArray = append(filterArray, pluginFilter)
 	}
-	nsFilter = gtm.ChainOpFilters(filterChain...)
-	filter = gtm.ChainOpFilters(filterArray...)
-	directReadFilter = gtm.ChainOpFilters(filterArray...)
+	chainedFilter := gtm.ChainOpFilters(filterChain...)
+	directReadFilter = scheduleDirectReads(countReindexReads(gtm.ChainOpFilters(filterArray...)))
+	if config.DirectReadBudget > 0 || config.DirectReadRate > 0 {
+		directReads = newDirectReadScheduler(config)
+	}
+	if config.useDeltaUpdates() && pluginFilter != nil {
+		// delta updates are filtered in routeOp once the document is known
+		deltaFilters := append([]gtm.OpFilter{}, filterArray[:len(filterArray)-1]...)
+		deltaFilters = append(deltaFilters, func(op *gtm.Op) bool {
+			if op.IsUpdate() && op.IsSourceOplog() {
+				return true
+			}
+			return pluginFilter(op)
+		})
+		filter = gtm.ChainOpFilters(deltaFilters...)
+	} else {
+		filter = gtm.ChainOpFilters(filterArray...)
+	}
 	var oplogDatabaseName, oplogCollectionName *string
 	if config.MongoOpLogDatabaseName != "" {
 		oplogDatabaseName = &config.MongoOpLogDatabaseName
@@ -4046,6 +23583,17 @@ func main() {
 			panic(fmt.Sprintf("Unable to determine enabled cluster process: %s", err))
 		}
 	}
+	if config.PartitionName != "" {
+		partition = newNamespacePartition(mongo, config)
+		if err = partition.ensureTTL(); err == nil {
+			_, err = partition.join()
+		}
+		if err != nil {
+			panic(fmt.Sprintf("Unable to join partition group %s: %s", config.PartitionName, err))
+		}
+		infoLog.Printf("Joined partition group %s as %s", config.PartitionName, config.PartitionMember)
+		go partition.run(time.Duration(config.ClusterHeartbeatSeconds) * time.Second)
+	}
 	gtmBufferDuration, err := time.ParseDuration(config.GtmSettings.BufferDuration)
 	if err != nil {
 		panic(fmt.Sprintf("Unable to parse gtm buffer duration %s: %s", config.GtmSettings.BufferDuration, err))
@@ -4058,6 +23606,7 @@ func main() {
 		if err != nil {
 			panic(fmt.Sprintf("Unable to connect to mongodb config server using URL %s: %s", cleanMongoURL(config.MongoConfigURL), err))
 		}
+		mongoLogins.track(configSession)
 		// get the list of shard servers
 		shardInfos := gtm.GetShards(configSession)
 		if len(shardInfos) == 0 {
@@ -4072,11 +23621,22 @@ func main() {
 				panic(fmt.Sprintf("Unable to connect to mongodb shard using URL %s: %s", cleanMongoURL(shardURL), err))
 			}
 			defer shard.Close()
+			mongoLogins.track(shard)
 			mongos = append(mongos, shard)
 		}
 	} else {
 		mongos = append(mongos, mongo)
 	}
+	if batch := config.GtmSettings.ChangeStreamBatchSize; batch > 0 {
+		// the batch size of change streams is taken from the session they
+		// are opened with so gtm is given copies limited to the batch size
+		for i, m := range mongos {
+			s := m.Copy()
+			defer s.Close()
+			s.SetBatch(batch)
+			mongos[i] = s
+		}
+	}
 
 	changeStreamNs := config.ChangeStreamNs
 	if config.DisableChangeEvents {
@@ -4086,7 +23646,7 @@ func main() {
 	gtmOpts := &gtm.Options{
 		After:               after,
 		Filter:              filter,
-		NamespaceFilter:     nsFilter,
+		NamespaceFilter:     chainedFilter,
 		OpLogDisabled:       config.DisableChangeEvents || len(config.ChangeStreamNs) > 0,
 		OpLogDatabaseName:   oplogDatabaseName,
 		OpLogCollectionName: oplogCollectionName,
@@ -4095,6 +23655,7 @@ func main() {
 		WorkerCount:         10,
 		BufferDuration:      gtmBufferDuration,
 		BufferSize:          config.GtmSettings.BufferSize,
+		MaxWaitSecs:         config.GtmSettings.MaxAwaitSecs,
 		DirectReadNs:        config.DirectReadNs,
 		DirectReadSplitMax:  config.DirectReadSplitMax,
 		DirectReadConcur:    config.DirectReadConcur,
@@ -4104,15 +23665,18 @@ func main() {
 		Pipe:                buildPipe(config),
 		PipeAllowDisk:       config.PipeAllowDisk,
 		ChangeStreamNs:      changeStreamNs,
+		UpdateDataAsDelta:   config.useDeltaUpdates(),
 	}
 
-	heartBeat := time.NewTicker(10 * time.Second)
+	resyncs = newResyncer(mongo, gtmOpts, config)
+
+	heartBeat := time.NewTicker(time.Duration(config.ClusterHeartbeatSeconds) * time.Second)
 	if config.ClusterName != "" {
 		if enabled {
 			infoLog.Printf("Starting work for cluster %s", config.ClusterName)
 		} else {
 			infoLog.Printf("Pausing work for cluster %s", config.ClusterName)
-			bulk.Stop()
+			stopBulks(bulk)
 			wait := true
 			for wait {
 				select {
@@ -4123,7 +23687,7 @@ func main() {
 					if enabled {
 						wait = false
 						infoLog.Printf("Resuming work for cluster %s", config.ClusterName)
-						bulk.Start(context.Background())
+						startBulks(bulk)
 						break
 					}
 				}
@@ -4132,13 +23696,30 @@ func main() {
 	} else {
 		heartBeat.Stop()
 	}
+	if config.OrphanSweepSeconds > 0 && !config.DisableElasticsearch {
+		orphans = &orphanSweeper{config: config, mongo: mongo, client: elasticClient, bulk: bulk,
+			interval: time.Duration(config.OrphanSweepSeconds) * time.Second}
+		orphans.start()
+	}
+	if len(tombstones) > 0 && !config.DisableElasticsearch {
+		go purgeTombstones(config, elasticClient, tombstonePurgeInterval)
+	}
+	if config.SchemaDriftSeconds > 0 && !config.DisableElasticsearch {
+		schemaDrift = newSchemaDriftDetector(config, elasticClient)
+		go schemaDrift.run(time.Duration(config.SchemaDriftSeconds) * time.Second)
+	}
 
-	gtmCtx := gtm.StartMulti(mongos, gtmOpts)
+	split, cursors := config.cursorOptions(gtmOpts)
+	gtmCtx := startGtm(mongos, split, cursors)
+	metrics.watchQueue("events", func() int { return len(gtmCtx.OpC) })
+	if config.ReplayFile != "" {
+		go replayRecording(config.ReplayFile, resyncOpC)
+	}
 
 	if config.readShards() && !config.DisableChangeEvents {
 		gtmCtx.AddShardListener(configSession, gtmOpts, config.makeShardInsertHandler())
 	}
-	timestampTicker := time.NewTicker(10 * time.Second)
+	timestampTicker := time.NewTicker(time.Duration(config.CheckpointInterval) * time.Second)
 	if config.Resume == false {
 		timestampTicker.Stop()
 	}
@@ -4155,9 +23736,13 @@ func main() {
 	}
 	var lastTimestamp, lastSavedTimestamp bson.MongoTimestamp
 	var allOpsVisited bool
+	var paused syncPause
 	var fileWg, indexWg, processWg, relateWg sync.WaitGroup
 	doneC := make(chan int)
-	opsConsumed := make(chan bool)
+	opsConsumed := make(chan bool, 1)
+	if len(updateConflicts) > 0 || len(arrayUpdateNamespaces) > 0 {
+		go refetchConflicts(config, mongo, bulk, elasticClient)
+	}
 	outputChs := &outputChans{
 		indexC:   make(chan *gtm.Op),
 		processC: make(chan *gtm.Op),
@@ -4165,6 +23750,8 @@ func main() {
 		relateC:  make(chan *gtm.Op, config.RelateBuffer),
 		filter:   pluginFilter,
 	}
+	metrics.watchQueue("relate", func() int { return len(outputChs.relateC) })
+	metrics.watchQueue("conflict-refetch", func() int { return len(updateConflictRefetchC) })
 	if len(config.Relate) > 0 {
 		for i := 0; i < config.RelateThreads; i++ {
 			relateWg.Add(1)
@@ -4172,23 +23759,93 @@ func main() {
 				defer relateWg.Done()
 				for op := range outputChs.relateC {
 					if err := processRelated(mongo, bulk, elasticClient, config, op, outputChs); err != nil {
-						processErr(err, config)
+						processOpErr(err, config, op)
 					}
 				}
 			}()
 		}
 	}
-	for i := 0; i < 5; i++ {
+	if config.AdaptiveBackpressure {
+		pressure = newBackpressure(config.IndexWorkers, pressuredBulks)
+		go pressure.flush()
+	}
+	if config.AdaptiveBulk {
+		sizer = newBulkSizer(config, bulk)
+	}
+	go throttle.flush()
+	lanes := make([]chan *gtm.Op, config.IndexWorkers)
+	for i := range lanes {
+		lanes[i] = make(chan *gtm.Op, indexLaneBuffer)
 		indexWg.Add(1)
-		go func() {
+		go func(lane chan *gtm.Op) {
 			defer indexWg.Done()
-			for op := range outputChs.indexC {
-				if err := doIndex(config, mongo, bulk, elasticClient, op); err != nil {
-					processErr(err, config)
+			for op := range lane {
+				atomic.StoreInt64(&lastIndexedAt, time.Now().UnixNano())
+				pressure.acquire()
+				sizer.acquire()
+				err := indexOp(config, mongo, bulk, elasticClient, op)
+				if err != nil {
+					processOpErr(err, config, op)
 				}
+				tracing.finishEvent(op, err)
+				syncStatus.finishEvent(op, err)
+				checkpoints.finishEvent(op)
+				atomic.StoreInt64(&lastIndexedAt, time.Now().UnixNano())
+				sizer.release()
+				pressure.release()
+				reindexReadDone(op)
+				directReads.done(op)
+			}
+		}(lanes[i])
+	}
+	indexQueueDepth = func() (depth int) {
+		for _, lane := range lanes {
+			depth += len(lane)
+		}
+		return
+	}
+	metrics.watchQueue("index", indexQueueDepth)
+	dispatch := func(op *gtm.Op) {
+		lanes[indexLane(op, len(lanes))] <- op
+	}
+	var merge *coalescer
+	if config.CoalesceWindowMs > 0 {
+		merge = newCoalescer(config, dispatch)
+	}
+	next := func() (*gtm.Op, bool) {
+		op, ok := <-outputChs.indexC
+		return op, ok
+	}
+	if config.MemoryBudgetMB > 0 {
+		spill, err := newSpillQueue(config.SpillDir, int64(config.MemoryBudgetMB)*1024*1024,
+			config.DiskCompression == "zstd")
+		if err != nil {
+			errorLog.Fatalf("Unable to create spill file: %s", err)
+		}
+		metrics.watchQueue("spill", spill.len)
+		go func() {
+			for op := range outputChs.indexC {
+				spill.push(op)
 			}
+			spill.close()
 		}()
+		next = spill.pop
 	}
+	go func() {
+		for op, ok := next(); ok; op, ok = next() {
+			if merge != nil {
+				merge.add(op)
+			} else {
+				dispatch(op)
+			}
+		}
+		if merge != nil {
+			merge.flushAll()
+		}
+		for _, lane := range lanes {
+			close(lane)
+		}
+	}()
 	for i := 0; i < config.FileDownloaders; i++ {
 		fileWg.Add(1)
 		go func() {
@@ -4196,7 +23853,7 @@ func main() {
 			for op := range outputChs.fileC {
 				err := addFileContent(mongo, op, config)
 				if err != nil {
-					processErr(err, config)
+					processOpErr(err, config, op)
 				}
 				outputChs.indexC <- op
 			}
@@ -4208,29 +23865,44 @@ func main() {
 			defer processWg.Done()
 			for op := range outputChs.processC {
 				if err := runProcessor(mongo, bulk, elasticClient, op); err != nil {
-					processErr(err, config)
+					processOpErr(err, config, op)
 				}
 			}
 		}()
 	}
+	// drained is true once every event read before shutting down was
+	// handed to the bulk processors within the drain timeout
+	var drained bool
 	var tearDown = func() {
 		infoLog.Println("Stopping all workers")
-		gtmCtx.Stop()
-		<-opsConsumed
-		close(outputChs.relateC)
-		relateWg.Wait()
-		close(outputChs.fileC)
-		fileWg.Wait()
-		close(outputChs.indexC)
-		indexWg.Wait()
-		close(outputChs.processC)
-		processWg.Wait()
-		doneC <- 30
+		deadline := time.Now().Add(time.Duration(config.DrainTimeoutSeconds) * time.Second)
+		drained = waitUntil(deadline, func() {
+			gtmCtx.Stop()
+			<-opsConsumed
+			close(outputChs.relateC)
+			relateWg.Wait()
+			close(outputChs.fileC)
+			fileWg.Wait()
+			close(outputChs.indexC)
+			indexWg.Wait()
+			close(outputChs.processC)
+			processWg.Wait()
+		})
+		if !drained {
+			warnLog.Printf("Workers did not finish within %d seconds. The resume point will not be saved.", config.DrainTimeoutSeconds)
+		}
+		remaining := int(math.Ceil(time.Until(deadline).Seconds()))
+		if remaining < 1 {
+			remaining = 1
+		}
+		doneC <- remaining
 	}
 	if len(config.DirectReadNs) > 0 {
 		go func() {
 			gtmCtx.DirectReadWg.Wait()
+			readyState.directReads(false)
 			infoLog.Println("Direct reads completed")
+			finishReindexes(elasticClient, bulk)
 			if config.Resume {
 				saveTimestampFromReplStatus(mongo, config)
 			}
@@ -4248,28 +23920,82 @@ func main() {
 		}()
 		tearDown()
 	}()
+	processOp := func(op *gtm.Op) {
+		if err := recorder.record(op); err != nil {
+			errorLog.Printf("Unable to record event %v in %s: %s", op.Id, op.Namespace, err)
+		}
+		chaos.pause()
+		metrics.eventRead(op)
+		replicationLag.observe(op)
+		readyState.observe(op)
+		tracing.startEvent(op)
+		syncStatus.startEvent(op)
+		checkpoints.startEvent(op)
+		if op.IsSourceOplog() {
+			lastTimestamp = op.Timestamp
+		}
+		if err = routeOp(config, mongo, bulk, elasticClient, op, outputChs); err != nil {
+			processOpErr(err, config, op)
+		}
+	}
+	// saveCheckpoint saves the resume position.  The sinks are flushed first
+	// and in after-ack mode the bulk processors too so that the events
+	// before it are acknowledged.  The position does not move while a sink
+	// fails to write
+	saveCheckpoint := func() error {
+		ts := paused.checkpoint(checkpoints.position(config, lastTimestamp))
+		if ts <= lastSavedTimestamp {
+			return nil
+		}
+		var err error
+		if config.CheckpointMode == "after-ack" {
+			err = flushBulks(bulk)
+		} else {
+			err = flushSinks()
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to save the resume point until the sinks are flushed: %s", err)
+		}
+		if err = saveTimestamp(mongo, ts, config); err != nil {
+			return err
+		}
+		lastSavedTimestamp = ts
+		metrics.checkpointSaved(ts)
+		return nil
+	}
 	infoLog.Println("Listening for events")
 	for {
 		select {
 		case timeout := <-doneC:
 			if enabled {
 				enabled = false
-				shutdown(timeout, hsc, bulk, bulkStats, mongo, config)
+				var checkpoint func()
+				if config.Resume && drained {
+					ts := paused.checkpoint(lastTimestamp)
+					checkpoint = func() {
+						if ts <= lastSavedTimestamp {
+							return
+						}
+						if err := saveTimestamp(mongo, ts, config); err != nil {
+							errorLog.Printf("Unable to save the resume point: %s", err)
+						} else {
+							metrics.checkpointSaved(ts)
+							infoLog.Println("Saved the resume point")
+						}
+					}
+				}
+				shutdown(timeout, hsc, bulk, bulkStats, mongo, config, checkpoint)
 			} else {
-				shutdown(timeout, hsc, nil, nil, nil, config)
+				shutdown(timeout, hsc, nil, nil, nil, config, nil)
 			}
 			return
 		case <-timestampTicker.C:
+			readyState.progress(lastTimestamp, lastSavedTimestamp)
 			if !enabled {
 				break
 			}
-			if lastTimestamp > lastSavedTimestamp {
-				bulk.Flush()
-				if saveTimestamp(mongo, lastTimestamp, config); err == nil {
-					lastSavedTimestamp = lastTimestamp
-				} else {
-					processErr(err, config)
-				}
+			if err = saveCheckpoint(); err != nil {
+				processErr(err, config)
 			}
 		case <-heartBeat.C:
 			if config.ClusterName == "" {
@@ -4280,7 +24006,8 @@ func main() {
 				if !enabled {
 					infoLog.Printf("Pausing work for cluster %s", config.ClusterName)
 					gtmCtx.Pause()
-					bulk.Stop()
+					orphans.stop()
+					stopBulks(bulk)
 					wait := true
 					for wait {
 						select {
@@ -4291,8 +24018,12 @@ func main() {
 							if enabled {
 								wait = false
 								infoLog.Printf("Resuming work for cluster %s", config.ClusterName)
-								bulk.Start(context.Background())
+								startBulks(bulk)
+								orphans.start()
 								resumeWork(gtmCtx, mongo, config)
+								if paused.all {
+									gtmCtx.Pause()
+								}
 								break
 							}
 						}
@@ -4302,8 +24033,11 @@ func main() {
 				enabled, err = enableProcess(mongo, config)
 				if enabled {
 					infoLog.Printf("Resuming work for cluster %s", config.ClusterName)
-					bulk.Start(context.Background())
+					startBulks(bulk)
 					resumeWork(gtmCtx, mongo, config)
+					if paused.all {
+						gtmCtx.Pause()
+					}
 				}
 			}
 			if err != nil {
@@ -4314,11 +24048,11 @@ func main() {
 				break
 			}
 			if config.IndexStats {
-				if err := doIndexStats(config, bulkStats, bulk.Stats()); err != nil {
+				if err := doIndexStats(config, bulkStats, bulkStatsOf(bulk)); err != nil {
 					errorLog.Printf("Error indexing statistics: %s", err)
 				}
 			} else {
-				stats, err := json.Marshal(bulk.Stats())
+				stats, err := json.Marshal(statsOf(bulk))
 				if err != nil {
 					errorLog.Printf("Unable to log statistics: %s", err)
 				} else {
@@ -4332,13 +24066,60 @@ func main() {
 				lastTs:  l,
 			}
 			req.responseC <- statusResp
+		case req := <-pauseReqC:
+			if !req.pause {
+				if req.namespace == "" && paused.all {
+					gtmCtx.Resume()
+				}
+				released := paused.resume(req.namespace)
+				infoLog.Printf("Resuming sync of %s with %d held events", pausedName(req.namespace), len(released))
+				for _, op := range released {
+					processOp(op)
+				}
+				req.responseC <- paused.status()
+				break
+			}
+			paused.pause(req.namespace)
+			status := paused.status()
+			if req.namespace == "" {
+				if config.Resume && enabled {
+					if err = saveCheckpoint(); err != nil {
+						processErr(err, config)
+						status.Error = fmt.Sprintf("Unable to save checkpoint: %s", err)
+					}
+				}
+				gtmCtx.Pause()
+			}
+			if lastSavedTimestamp != 0 {
+				status.Checkpoint = time.Unix(int64(lastSavedTimestamp>>32), 0).Format("2006-01-02T15:04:05")
+			}
+			infoLog.Printf("Paused sync of %s", pausedName(req.namespace))
+			req.responseC <- status
 		case err = <-gtmCtx.ErrC:
 			if err == nil {
 				break
 			}
 			processErr(err, config)
+			if isResumeGap(err) {
+				notifications.send(&notification{
+					Event:   notifyResumeGap,
+					Status:  "firing",
+					Message: fmt.Sprintf("Change events after the resume point are no longer available: %s", err),
+				})
+			}
+		case op := <-resyncOpC:
+			if !enabled {
+				directReads.done(op)
+				break
+			}
+			if paused.holds(op) {
+				paused.hold(op)
+				break
+			}
+			processOp(op)
 		case op, open := <-gtmCtx.OpC:
 			if !enabled {
+				directReads.done(op)
 				break
 			}
 			if op == nil {
@@ -4348,12 +24129,11 @@ func main() {
 				}
 				break
 			}
-			if op.IsSourceOplog() {
-				lastTimestamp = op.Timestamp
-			}
-			if err = routeOp(config, mongo, bulk, elasticClient, op, outputChs); err != nil {
-				processErr(err, config)
+			if paused.holds(op) {
+				paused.hold(op)
+				break
 			}
+			processOp(op)
 		}
 	}
 }
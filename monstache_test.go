@@ -1,14 +1,56 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"math"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/BurntSushi/toml"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/olivere/elastic"
@@ -452,3 +494,5498 @@ func TestDropCollection(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestIndexTemplateBody(t *testing.T) {
+	it := &indexTemplate{
+		Namespace:     "db.col",
+		Name:          "monstache-db.col",
+		IndexPatterns: []string{"db.col"},
+		Mappings: map[string]interface{}{
+			"properties": map[string]interface{}{
+				"name": map[string]interface{}{"type": "keyword"},
+			},
+		},
+	}
+	c := &configOptions{ElasticMajorVersion: 7, ElasticMinorVersion: 10}
+	body, err := it.body(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body["template"] == nil || body["mappings"] != nil {
+		t.Fatalf("Expected composable template body: %v", body)
+	}
+	again, _ := it.body(c)
+	if body["version"] != again["version"] {
+		t.Fatalf("Expected stable template version")
+	}
+	c = &configOptions{ElasticMajorVersion: 6, ElasticMinorVersion: 8}
+	legacy, err := it.body(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if legacy["template"] != nil || legacy["mappings"] == nil {
+		t.Fatalf("Expected legacy template body: %v", legacy)
+	}
+	if legacy["version"] != body["version"] {
+		t.Fatalf("Expected version to depend only on template content")
+	}
+}
+
+func TestParseServerInfo(t *testing.T) {
+	esInfo := []byte(`{"name":"n","version":{"number":"8.11.1","build_flavor":"default"},"tagline":"You Know, for Search"}`)
+	osInfo := []byte(`{"name":"n","version":{"distribution":"opensearch","number":"2.11.0"},"tagline":"The OpenSearch Project: https://opensearch.org/"}`)
+	number, openSearch, err := parseServerInfo(esInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number != "8.11.1" || openSearch {
+		t.Fatalf("Expected Elasticsearch 8.11.1 but got %s (opensearch=%v)", number, openSearch)
+	}
+	c := &configOptions{}
+	if err = c.parseServerVersion(number); err != nil {
+		t.Fatal(err)
+	}
+	if !c.useTypelessAPI() || !c.useComposableTemplates() {
+		t.Fatalf("Expected typeless API and composable templates for Elasticsearch 8")
+	}
+	number, openSearch, err = parseServerInfo(osInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number != "2.11.0" || !openSearch {
+		t.Fatalf("Expected OpenSearch 2.11.0 but got %s (opensearch=%v)", number, openSearch)
+	}
+	c = &configOptions{OpenSearch: true}
+	if err = c.parseServerVersion(number); err != nil {
+		t.Fatal(err)
+	}
+	if c.OpenSearchMajorVersion != 2 || c.OpenSearchMinorVersion != 11 {
+		t.Fatalf("Expected OpenSearch version 2.11")
+	}
+	if !c.useTypeFromFuture() || !c.useTypelessAPI() {
+		t.Fatalf("Expected typeless API for OpenSearch 2")
+	}
+	c = &configOptions{OpenSearch: true}
+	if err = c.parseServerVersion("1.3.0"); err != nil {
+		t.Fatal(err)
+	}
+	if c.useTypelessAPI() || !c.useComposableTemplates() {
+		t.Fatalf("Expected _doc type and composable templates for OpenSearch 1")
+	}
+}
+
+func TestAPIKeyHeader(t *testing.T) {
+	if h := apiKeyHeader("VuaCfGcBCdbkQm-e5aOx:ui2lp2axTNmsyakw9tvNnw"); h != "ApiKey VnVhQ2ZHY0JDZGJrUW0tZTVhT3g6dWkybHAyYXhUTm1zeWFrdzl0dk5udw==" {
+		t.Fatalf("Expected id:key form to be base64 encoded but got %s", h)
+	}
+	if h := apiKeyHeader("VnVhQ2ZHY0JDZGJrUW0tZTVhT3g6dWkybHAyYXhUTm1zeWFrdzl0dk5udw==\n"); h != "ApiKey VnVhQ2ZHY0JDZGJrUW0tZTVhT3g6dWkybHAyYXhUTm1zeWFrdzl0dk5udw==" {
+		t.Fatalf("Expected encoded form to be used as is but got %s", h)
+	}
+}
+
+func TestGzipTransport(t *testing.T) {
+	body := []byte(`{"index":{"_index":"test"}}` + "\n" + `{"data":"data"}` + "\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("Expected gzip content encoding")
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("Unable to read gzip body: %s", err)
+			return
+		}
+		b, _ := ioutil.ReadAll(zr)
+		if !bytes.Equal(b, body) {
+			t.Errorf("Expected body %s but got %s", body, b)
+		}
+	}))
+	defer server.Close()
+	client := &http.Client{
+		Transport: &gzipTransport{transport: http.DefaultTransport, level: gzip.BestSpeed},
+	}
+	resp, err := client.Post(server.URL, "application/x-ndjson", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestPartialUpdateDoc(t *testing.T) {
+	desc := map[string]interface{}{
+		"updatedFields": map[string]interface{}{
+			"name":         "a",
+			"address.city": "b",
+			"address.zip":  "c",
+		},
+		"removedFields": []string{},
+	}
+	doc, ok := partialUpdateDoc(desc)
+	if !ok {
+		t.Fatalf("Expected partial update for %v", desc)
+	}
+	address, _ := doc["address"].(map[string]interface{})
+	if doc["name"] != "a" || address["city"] != "b" || address["zip"] != "c" {
+		t.Fatalf("Unexpected partial document %v", doc)
+	}
+	desc["removedFields"] = []string{"name"}
+	if _, ok = partialUpdateDoc(desc); ok {
+		t.Fatalf("Expected removed fields to require a full document")
+	}
+	desc = map[string]interface{}{
+		"updatedFields": map[string]interface{}{
+			"tags.1": "x",
+		},
+	}
+	if _, ok = partialUpdateDoc(desc); ok {
+		t.Fatalf("Expected array element update to require a full document")
+	}
+}
+
+func TestDocumentVersion(t *testing.T) {
+	doc := map[string]interface{}{
+		"rev": int32(7),
+		"meta": map[string]interface{}{
+			"modified": time.Unix(10, 0),
+		},
+		"bad": "x",
+	}
+	if v, ok := documentVersion(doc, "rev"); !ok || v != 7 {
+		t.Fatalf("Expected version 7 but got %d", v)
+	}
+	if v, ok := documentVersion(doc, "meta.modified"); !ok || v != 10000 {
+		t.Fatalf("Expected version 10000 but got %d", v)
+	}
+	if _, ok := documentVersion(doc, "bad"); ok {
+		t.Fatalf("Expected invalid version")
+	}
+	if _, ok := documentVersion(doc, "missing"); ok {
+		t.Fatalf("Expected missing version")
+	}
+}
+
+func TestReindexIndexMapping(t *testing.T) {
+	config := &configOptions{ElasticMajorVersion: 7}
+	job := &reindexJob{reindex: reindex{Namespace: "db.reindex"}}
+	job.target, job.previous, job.active = "db.reindex-1", []string{"db.reindex-0"}, 1
+	reindexJobs[job.Namespace] = job
+	defer delete(reindexJobs, job.Namespace)
+	op := &gtm.Op{Namespace: "db.reindex", Source: gtm.OplogQuerySource, Data: map[string]interface{}{"a": 1}}
+	if index := mapIndexType(config, op).Index; index != "db.reindex" {
+		t.Fatalf("Expected change events to be written to the alias but got %s", index)
+	}
+	rop := reindexCopy(op)
+	if rop == nil {
+		t.Fatalf("Expected change events to be copied to the new index")
+	}
+	if index := mapIndexType(config, rop).Index; index != "db.reindex-1" {
+		t.Fatalf("Expected copy to be written to the new index but got %s", index)
+	}
+	job.active = 0
+	if reindexCopy(op) != nil {
+		t.Fatalf("Expected no copy after alias swap")
+	}
+}
+
+func TestDocumentID(t *testing.T) {
+	oid := bson.NewObjectId()
+	if id := documentID(oid.Hex()); id != oid {
+		t.Fatalf("Expected object id %v but got %v", oid, id)
+	}
+	if id := documentID("42"); id != int64(42) {
+		t.Fatalf("Expected numeric id but got %v", id)
+	}
+	if id := documentID("abc"); id != "abc" {
+		t.Fatalf("Expected string id but got %v", id)
+	}
+}
+
+func TestUpdateConflictPolicy(t *testing.T) {
+	updateConflicts["db.refetch"] = &updateConflict{Namespace: "db.refetch", RetryOnConflict: 2, Policy: "refetch"}
+	defer delete(updateConflicts, "db.refetch")
+	// the _id is a string which reads like a number in Elasticsearch
+	op := &gtm.Op{Id: "42", Namespace: "db.refetch"}
+	req := elastic.NewBulkUpdateRequest().Index("shared").Id("42").Doc(map[string]interface{}{"a": 1})
+	recordUpdateConflict(req, op, 0)
+	other := elastic.NewBulkUpdateRequest().Index("shared").Id("43").Doc(map[string]interface{}{"a": 1})
+	recordUpdateConflict(other, &gtm.Op{Id: "43", Namespace: "db.other"}, 0)
+	defer forgetBulkItem(other)
+	item := &elastic.BulkResponseItem{Index: "shared", Id: "42", Status: 409}
+	if handleUpdateConflict(&elastic.BulkResponseItem{Index: "shared", Id: "43", Status: 409}, other) {
+		t.Fatalf("Expected no policy for a namespace without one sharing the index")
+	}
+	if !handleUpdateConflict(item, req) {
+		t.Fatalf("Expected the conflict policy of the namespace to apply")
+	}
+	select {
+	case rop := <-updateConflictRefetchC:
+		if rop.Id != "42" || rop.Namespace != "db.refetch" {
+			t.Fatalf("Expected the document to be refetched by its original id but got %#v in %s", rop.Id, rop.Namespace)
+		}
+	default:
+		t.Fatalf("Expected the document to be queued for a refetch")
+	}
+	bulkItemDone(req, item, nil)
+	if handleUpdateConflict(item, req) {
+		t.Fatalf("Expected the update to be forgotten once done")
+	}
+}
+
+func TestDeadLetterFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "monstache-dead-letters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	config := &configOptions{DeadLetterFile: f.Name()}
+	dlq, err := config.newDeadLetterQueue(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := elastic.NewBulkIndexRequest().Index("test").Type("_doc").Id("1").Doc(map[string]interface{}{"a": 1})
+	dlq.add(req, 400, "mapper_parsing_exception")
+	dlq.close()
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dl deadLetter
+	if err = json.Unmarshal(bytes.TrimSpace(b), &dl); err != nil {
+		t.Fatal(err)
+	}
+	if dl.Status != 400 || dl.Document != `{"a":1}` {
+		t.Fatalf("Unexpected dead letter %+v", dl)
+	}
+	if lines, _ := dl.request().Source(); len(lines) != 2 || lines[0] != dl.Action {
+		t.Fatalf("Expected dead letter to resubmit the original request lines")
+	}
+}
+
+func TestRoutingExpr(t *testing.T) {
+	doc := map[string]interface{}{
+		"org": "acme",
+		"loc": map[string]interface{}{
+			"region": "eu",
+		},
+	}
+	re := &routingExpr{Field: "loc.region"}
+	if r, err := re.eval(doc); err != nil || r != "eu" {
+		t.Fatalf("Expected routing eu but got %s: %v", r, err)
+	}
+	re = &routingExpr{Template: "{org}-{loc.region}"}
+	if r, err := re.eval(doc); err != nil || r != "acme-eu" {
+		t.Fatalf("Expected routing acme-eu but got %s: %v", r, err)
+	}
+	re = &routingExpr{Template: "{missing}"}
+	if _, err := re.eval(doc); err == nil {
+		t.Fatalf("Expected error for missing routing field")
+	}
+}
+
+func TestJoinRelation(t *testing.T) {
+	parentID := bson.NewObjectId()
+	op := &gtm.Op{Data: map[string]interface{}{"question": parentID}}
+	meta := &indexingMeta{}
+	j := &joinRelation{Field: "qa", Name: "answer", ParentNamespace: "db.questions", ParentField: "question"}
+	if err := j.apply(op, meta); err != nil {
+		t.Fatal(err)
+	}
+	join, _ := op.Data["qa"].(map[string]interface{})
+	if join["name"] != "answer" || join["parent"] != parentID.Hex() || meta.Routing != parentID.Hex() {
+		t.Fatalf("Unexpected join %v with routing %s", join, meta.Routing)
+	}
+	op = &gtm.Op{Data: map[string]interface{}{}}
+	j = &joinRelation{Field: "qa", Name: "question"}
+	if err := j.apply(op, &indexingMeta{}); err != nil || op.Data["qa"] != "question" {
+		t.Fatalf("Expected parent join name but got %v", op.Data["qa"])
+	}
+}
+
+func TestJoinMapping(t *testing.T) {
+	for _, ns := range []string{"db.questions", "db.answers", "db.comments"} {
+		mapIndexTypes[ns] = &indexTypeMapping{Namespace: ns, Index: "qa"}
+		defer delete(mapIndexTypes, ns)
+		defer delete(joins, ns)
+		defer delete(routingNamespaces, ns)
+		defer delete(indexTemplates, ns)
+	}
+	config := &configOptions{Join: []joinRelation{
+		{Namespace: "db.questions", Field: "qa", Name: "question"},
+		{Namespace: "db.answers", Field: "qa", Name: "answer", ParentNamespace: "db.questions", ParentField: "question"},
+		{Namespace: "db.comments", Field: "qa", Name: "comment", ParentNamespace: "db.answers", ParentField: "answer"},
+	}}
+	config.loadJoins()
+	if indexTemplates["db.answers"] != nil || indexTemplates["db.comments"] != nil {
+		t.Fatalf("Expected the join to be mapped only through the root namespace")
+	}
+	props := indexTemplates["db.questions"].Mappings["properties"].(map[string]interface{})
+	qa := props["qa"].(map[string]interface{})
+	rels := qa["relations"].(map[string][]string)
+	if qa["type"] != "join" || len(rels) != 2 || rels["question"][0] != "answer" || rels["answer"][0] != "comment" {
+		t.Fatalf("Unexpected join mapping %v", qa)
+	}
+}
+
+func TestUnwindElements(t *testing.T) {
+	op := &gtm.Op{
+		Id: "order1",
+		Data: map[string]interface{}{
+			"customer": "c1",
+			"items": []interface{}{
+				map[string]interface{}{"sku": "a"},
+				map[string]interface{}{"sku": "b"},
+			},
+		},
+	}
+	u := &unwind{Field: "items", Key: "sku", ParentField: "_unwind_id"}
+	ops := u.elements(op)
+	if len(ops) != 2 {
+		t.Fatalf("Expected 2 unwound documents but got %d", len(ops))
+	}
+	if ops[1].Id != "order1_b" || ops[1].Data["customer"] != "c1" || ops[1].Data["_unwind_id"] != "order1" {
+		t.Fatalf("Unexpected unwound document %v: %v", ops[1].Id, ops[1].Data)
+	}
+	if _, ok := op.Data["_unwind_id"]; ok {
+		t.Fatalf("Expected source document to be unchanged")
+	}
+}
+
+func TestUnwindDeleteElements(t *testing.T) {
+	config := &configOptions{Unwind: []unwind{{Namespace: "db.orders", Field: "items"}}}
+	config.loadUnwinds()
+	defer delete(unwinds, "db.orders")
+	defer delete(indexTemplates, "db.orders")
+	props := indexTemplates["db.orders"].Mappings["properties"].(map[string]interface{})
+	if parent, _ := props["_unwind_id"].(map[string]interface{}); parent["type"] != "keyword" {
+		t.Fatalf("Expected the parent field to be mapped as keyword but got %v", props)
+	}
+	var lock sync.Mutex
+	var scrolls int
+	var deleted []string
+	client := newTestElasticClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "DELETE":
+			fmt.Fprint(w, `{"succeeded":true}`)
+		case strings.HasSuffix(r.URL.Path, "/_bulk"):
+			var items []string
+			for _, line := range bytes.Split(bytes.TrimSpace(body), []byte("\n")) {
+				var action map[string]map[string]interface{}
+				json.Unmarshal(line, &action)
+				deleted = append(deleted, action["delete"]["_id"].(string))
+				items = append(items, `{"delete":{"status":200}}`)
+			}
+			fmt.Fprintf(w, `{"took":1,"errors":false,"items":[%s]}`, strings.Join(items, ","))
+		default:
+			if scrolls == 0 && !bytes.Contains(body, []byte(`"_unwind_id":"order1"`)) {
+				t.Errorf("Expected a term query on the parent field but got %s", body)
+			}
+			// the elements arrive over more than one page
+			pages := [][]string{{"order1_0", "order1_1"}, {"order1_2"}, nil}
+			var hits []string
+			for _, id := range pages[scrolls] {
+				hits = append(hits, fmt.Sprintf(`{"_index":"db.orders","_id":"%s"}`, id))
+			}
+			scrolls++
+			fmt.Fprintf(w, `{"_scroll_id":"s1","hits":{"total":3,"hits":[%s]}}`, strings.Join(hits, ","))
+		}
+	})
+	bulk, err := client.BulkProcessor().Workers(1).Do(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to start bulk processor: %s", err)
+	}
+	config.ElasticMajorVersion = 8
+	op := &gtm.Op{Id: "order1", Namespace: "db.orders", Operation: "u"}
+	if err := unwinds["db.orders"].deleteElements(config, client, bulk, op, map[string]bool{"order1_1": true}); err != nil {
+		t.Fatalf("Unable to delete elements: %s", err)
+	}
+	bulk.Flush()
+	bulk.Stop()
+	lock.Lock()
+	defer lock.Unlock()
+	if scrolls != 3 {
+		t.Fatalf("Expected the elements to be scrolled to the end but got %d pages", scrolls)
+	}
+	if len(deleted) != 2 || deleted[0] != "order1_0" || deleted[1] != "order1_2" {
+		t.Fatalf("Expected the elements not kept to be deleted but got %v", deleted)
+	}
+}
+
+func TestNumberFormat(t *testing.T) {
+	dec, err := bson.ParseDecimal128("12345678901234567.125")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := map[string]interface{}{
+		"price": dec,
+		"big":   int64(9007199254740993),
+		"items": []interface{}{dec},
+	}
+	nf := &numberFormat{Decimal: "string", Long: "string"}
+	nf.format(doc)
+	if doc["price"] != "12345678901234567.125" || doc["big"] != "9007199254740993" {
+		t.Fatalf("Unexpected string format %v", doc)
+	}
+	if items := doc["items"].([]interface{}); items[0] != "12345678901234567.125" {
+		t.Fatalf("Expected array elements to be formatted")
+	}
+	nf = &numberFormat{Decimal: "scaled", ScalingFactor: 100}
+	if v := nf.formatDecimal(dec); v != int64(1234567890123456713) {
+		t.Fatalf("Expected scaled integer but got %v", v)
+	}
+	nf = &numberFormat{Decimal: "scaled_float", ScalingFactor: 100}
+	if v := nf.formatDecimal(dec); v != "12345678901234567.13" {
+		t.Fatalf("Expected rounded decimal string but got %v", v)
+	}
+}
+
+func TestIndexSettings(t *testing.T) {
+	replicas := 0
+	is := &indexSettings{Shards: 3, Replicas: &replicas, RefreshInterval: "30s"}
+	settings := map[string]interface{}{
+		"index": map[string]interface{}{
+			"number_of_shards": 1,
+		},
+	}
+	mergeSettings(settings, is.settings())
+	index := settings["index"].(map[string]interface{})
+	if index["number_of_shards"] != 1 {
+		t.Fatalf("Expected template settings to take precedence")
+	}
+	if index["number_of_replicas"] != 0 || index["refresh_interval"] != "30s" {
+		t.Fatalf("Unexpected merged settings %v", index)
+	}
+}
+
+func TestRuntimeFields(t *testing.T) {
+	defer func() {
+		runtimeFields = make(map[string]map[string]interface{})
+		delete(indexTemplates, "db.rt")
+	}()
+	config := &configOptions{
+		RuntimeField: []runtimeField{
+			{Namespace: "db.rt", Name: "day", Type: "keyword", Script: "emit(doc['ts'].value.dayOfWeekEnum.toString())"},
+		},
+	}
+	config.loadRuntimeFields()
+	it := indexTemplates["db.rt"]
+	if it == nil {
+		t.Fatalf("Expected an index template for the namespace")
+	}
+	runtime := it.Mappings["runtime"].(map[string]interface{})
+	day := runtime["day"].(map[string]interface{})
+	if day["type"] != "keyword" || day["script"] == nil {
+		t.Fatalf("Unexpected runtime field %v", day)
+	}
+}
+
+func TestEmbedding(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var req struct {
+			Input []string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var data []map[string]interface{}
+		for i, text := range req.Input {
+			data = append(data, map[string]interface{}{"index": i, "embedding": []float64{float64(len(text)), 1}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	defer ts.Close()
+	e := &embedding{Fields: []string{"title", "body"}, Target: "vec", URL: ts.URL, Dims: 2, BatchSize: 1, BatchMs: 1, CacheSize: 10, TimeoutSeconds: 5}
+	doc := map[string]interface{}{"title": "ab", "body": "cd"}
+	for i := 0; i < 2; i++ {
+		vector, err := e.embed(doc)
+		if err != nil {
+			t.Fatalf("Unexpected embedding error: %s", err)
+		}
+		if len(vector) != 2 || vector[0] != 5 {
+			t.Fatalf("Unexpected vector %v", vector)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("Expected cached vector but endpoint was called %d times", calls)
+	}
+	if vector, err := e.embed(map[string]interface{}{}); vector != nil || err != nil {
+		t.Fatalf("Expected no vector for a document without text")
+	}
+}
+
+func TestSemanticFields(t *testing.T) {
+	defer func() {
+		delete(ingestPipelines, "db.sem")
+		delete(indexTemplates, "db.sem")
+	}()
+	ingestPipelines["db.sem"] = &ingestPipeline{Namespace: "db.sem", Name: "custom"}
+	config := &configOptions{
+		SemanticField: []semanticField{
+			{Namespace: "db.sem", Field: "content"},
+			{Namespace: "db.sem", Field: "summary", InferenceID: "my-elser"},
+		},
+	}
+	config.loadSemanticFields()
+	ip := ingestPipelines["db.sem"]
+	if ip.Name != "monstache-semantic-db.sem" || ip.chained == nil || ip.chained.Name != "custom" {
+		t.Fatalf("Unexpected semantic pipeline %v", ip)
+	}
+	procs := ip.definition["processors"].([]interface{})
+	if len(procs) != 2 {
+		t.Fatalf("Expected a chained pipeline and one inference processor but got %v", procs)
+	}
+	props := indexTemplates["db.sem"].Mappings["properties"].(map[string]interface{})
+	if props["content_tokens"].(map[string]interface{})["type"] != "sparse_vector" {
+		t.Fatalf("Expected sparse_vector mapping for ELSER tokens")
+	}
+	if props["summary"].(map[string]interface{})["type"] != "semantic_text" {
+		t.Fatalf("Expected semantic_text mapping")
+	}
+}
+
+func TestBulkRequestLimit(t *testing.T) {
+	const maxContentLength = 600
+	var lock sync.Mutex
+	var indexed, oversized int
+	client := newTestElasticClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		if len(body) > maxContentLength {
+			oversized++
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		var items []string
+		for range bytes.Split(bytes.TrimSpace(body), []byte("\n"))[1:] {
+			items = append(items, `{"index":{"status":201}}`)
+		}
+		indexed += (len(items) + 1) / 2
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"took":1,"errors":false,"items":[%s]}`, strings.Join(items[:(len(items)+1)/2], ","))
+	})
+	config := &configOptions{
+		ElasticMaxConns:         1,
+		ElasticMaxDocs:          -1,
+		ElasticMaxBytes:         300,
+		ElasticMaxContentLength: maxContentLength,
+	}
+	bulk, err := config.newBulkProcessor(client)
+	if err != nil {
+		t.Fatalf("Unable to start bulk processor: %s", err)
+	}
+	defer delete(bulkRequestLimits, bulk)
+	var refused []string
+	for i, size := range []int{200, 400, 100, 200, 100} {
+		id := strconv.Itoa(i)
+		req := elastic.NewBulkIndexRequest().Index("test").Type("_doc").Id(id).
+			Doc(map[string]string{"v": strings.Repeat("x", size)})
+		onBulkItem(req, func(item *elastic.BulkResponseItem, err error) {
+			if err == errBulkRequestTooLarge {
+				refused = append(refused, id)
+			}
+		})
+		addBulkRequest(config, bulk, &gtm.Op{Id: id, Namespace: "db.test"}, "test", req)
+	}
+	bulk.Flush()
+	bulk.Stop()
+	lock.Lock()
+	defer lock.Unlock()
+	if oversized != 0 {
+		t.Fatalf("Expected no batch to exceed the max content length but %d did", oversized)
+	}
+	if len(refused) != 1 || refused[0] != "1" {
+		t.Fatalf("Expected only the request larger than the limit to be refused but got %v", refused)
+	}
+	if indexed != 4 {
+		t.Fatalf("Expected 4 documents to be indexed but got %d", indexed)
+	}
+}
+
+func TestBulkSplit(t *testing.T) {
+	const maxContentLength = 600
+	var lock sync.Mutex
+	var sent []string
+	var indexed []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		actions, err := parseBulkActions(body)
+		if err != nil {
+			t.Errorf("Unable to parse bulk request: %s", err)
+		}
+		var ids, items []string
+		for _, action := range actions {
+			ids = append(ids, action.meta["_id"].(string))
+			items = append(items, `{"index":{"status":201}}`)
+		}
+		sent = append(sent, strings.Join(ids, ""))
+		if len(body) > maxContentLength {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		indexed = append(indexed, ids...)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"took":1,"errors":false,"items":[%s]}`, strings.Join(items, ","))
+	}))
+	defer server.Close()
+	httpClient := &http.Client{Transport: &bulkSplitTransport{transport: http.DefaultTransport}}
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false),
+		elastic.SetHealthcheck(false), elastic.SetHttpClient(httpClient))
+	if err != nil {
+		t.Fatalf("Unable to create client: %s", err)
+	}
+	f, err := ioutil.TempFile("", "monstache-dead-letters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	deadLetters = &deadLetterQueue{file: f}
+	defer func() {
+		deadLetters = nil
+		f.Close()
+	}()
+	// the configured limit is larger than the one of the cluster
+	config := &configOptions{
+		ElasticMaxConns:         1,
+		ElasticMaxDocs:          -1,
+		ElasticMaxBytes:         1 << 20,
+		ElasticMaxContentLength: elasticMaxContentLengthDefault,
+	}
+	bulk, err := config.newBulkProcessor(client)
+	if err != nil {
+		t.Fatalf("Unable to start bulk processor: %s", err)
+	}
+	defer delete(bulkRequestLimits, bulk)
+	outcomes := make(map[string]int)
+	for i, size := range []int{100, 100, 700, 100, 100} {
+		id := strconv.Itoa(i)
+		req := elastic.NewBulkIndexRequest().Index("test").Type("_doc").Id(id).
+			Doc(map[string]string{"v": strings.Repeat("x", size)})
+		onBulkItem(req, func(item *elastic.BulkResponseItem, err error) {
+			outcomes[id] = item.Status
+		})
+		addBulkRequest(config, bulk, &gtm.Op{Id: id, Namespace: "db.test"}, "test", req)
+	}
+	bulk.Flush()
+	bulk.Flush()
+	bulk.Stop()
+	lock.Lock()
+	defer lock.Unlock()
+	if strings.Join(sent, ",") != "01234,01,234,2,34" {
+		t.Fatalf("Expected the batch to be bisected once and not resent but got %v", sent)
+	}
+	if strings.Join(indexed, "") != "0134" {
+		t.Fatalf("Expected all but the oversized document to be indexed but got %v", indexed)
+	}
+	if outcomes["2"] != http.StatusRequestEntityTooLarge || outcomes["0"] != 201 || len(outcomes) != 5 {
+		t.Fatalf("Unexpected outcomes %v", outcomes)
+	}
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(b)), "\n"); len(lines) != 1 ||
+		!strings.Contains(lines[0], `\"_id\":\"2\"`) || !strings.Contains(lines[0], `"status":413`) {
+		t.Fatalf("Expected only the oversized document to be dead-lettered but got %s", b)
+	}
+}
+
+func TestDatedIndexName(t *testing.T) {
+	index := lowerIndexName("Audit-{created:yyyy.MM}")
+	if index != "audit-{created:yyyy.MM}" {
+		t.Fatalf("Unexpected lowercased index %s", index)
+	}
+	created := time.Date(2015, time.March, 9, 0, 0, 0, 0, time.UTC)
+	if name := datedIndexName(index, map[string]interface{}{"created": created}); name != "audit-2015.03" {
+		t.Fatalf("Expected audit-2015.03 but got %s", name)
+	}
+	if name := datedIndexName(index, map[string]interface{}{}); name != "audit-undated" {
+		t.Fatalf("Expected audit-undated but got %s", name)
+	}
+	if pattern := indexPattern(index); pattern != "audit-*" {
+		t.Fatalf("Expected audit-* but got %s", pattern)
+	}
+}
+
+func TestGeoFields(t *testing.T) {
+	point := &geoField{Type: "geo_point"}
+	out, err := point.convert(map[string]interface{}{"type": "Point", "coordinates": []interface{}{-73.97, 40.77}})
+	if err != nil {
+		t.Fatalf("Unexpected geo error: %s", err)
+	}
+	if p := out.(map[string]interface{}); p["lat"] != 40.77 || p["lon"] != -73.97 {
+		t.Fatalf("Unexpected geo_point %v", p)
+	}
+	if _, err = point.convert([]interface{}{200.0, 10.0}); err == nil {
+		t.Fatalf("Expected out of range longitude to fail")
+	}
+	shape := &geoField{Type: "geo_shape"}
+	open := map[string]interface{}{
+		"type":        "Polygon",
+		"coordinates": []interface{}{[]interface{}{[]interface{}{0.0, 0.0}, []interface{}{1.0, 0.0}, []interface{}{1.0, 1.0}, []interface{}{0.0, 1.0}}},
+	}
+	if _, err = shape.convert(open); err == nil {
+		t.Fatalf("Expected open polygon ring to fail")
+	}
+	geoFields["db.geo"] = []*geoField{{Namespace: "db.geo", Field: "loc.pos", Type: "geo_point", OnError: "drop-field"}}
+	defer delete(geoFields, "db.geo")
+	op := &gtm.Op{Namespace: "db.geo", Data: map[string]interface{}{"loc": map[string]interface{}{"pos": "bad"}}}
+	if !convertGeoFields(op) {
+		t.Fatalf("Expected document to be kept")
+	}
+	if _, exists := op.Data["loc"].(map[string]interface{})["pos"]; exists {
+		t.Fatalf("Expected malformed geometry to be dropped")
+	}
+}
+
+func TestBinaryEncoding(t *testing.T) {
+	defer monstachemap.SetBinaryEncoding("", "")
+	data := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	legacy := monstachemap.Binary{Binary: bson.Binary{Kind: 0x03, Data: data}}
+	if err := monstachemap.SetBinaryEncoding("java-legacy", "drop"); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if enc := monstachemap.EncodeBinData(legacy); enc != "07060504-0302-0100-0f0e-0d0c0b0a0908" {
+		t.Fatalf("Unexpected java legacy UUID %s", enc)
+	}
+	doc := monstachemap.ConvertMapForJSON(map[string]interface{}{
+		"blob": bson.Binary{Kind: 0x00, Data: data},
+		"list": []interface{}{bson.Binary{Kind: 0x00, Data: data}, 1},
+	})
+	if _, exists := doc["blob"]; exists || len(doc["list"].([]interface{})) != 1 {
+		t.Fatalf("Expected binary values to be dropped but got %v", doc)
+	}
+	monstachemap.SetBinaryEncoding("csharp-legacy", "hex")
+	if enc := monstachemap.EncodeBinData(legacy); enc != "03020100-0504-0706-0809-0a0b0c0d0e0f" {
+		t.Fatalf("Unexpected csharp legacy UUID %s", enc)
+	}
+	if enc := monstachemap.EncodeBinData(monstachemap.Binary{Binary: bson.Binary{Kind: 0x00, Data: data[:2]}}); enc != "0001" {
+		t.Fatalf("Unexpected hex encoding %s", enc)
+	}
+	if err := monstachemap.SetBinaryEncoding("bogus", ""); err == nil {
+		t.Fatalf("Expected invalid UUID representation to fail")
+	}
+}
+
+func TestDocumentSize(t *testing.T) {
+	ds := &documentSize{MaxBytes: 200, Action: "truncate"}
+	doc := map[string]interface{}{
+		"title": "short",
+		"body":  strings.Repeat("x", 500),
+		"tags":  []interface{}{"a", "b"},
+	}
+	truncated, ok := ds.enforce(doc)
+	if !ok || len(truncated) != 1 || truncated[0] != "body" {
+		t.Fatalf("Expected body to be truncated but got %v", truncated)
+	}
+	if jsonSize(doc) > ds.MaxBytes || doc["title"] != "short" || len(doc["body"].(string)) == 0 {
+		t.Fatalf("Unexpected truncated document %v", doc)
+	}
+	ds = &documentSize{MaxBytes: 50, Fields: []string{"body"}, Action: "drop"}
+	doc = map[string]interface{}{"body": strings.Repeat("x", 500), "keep": strings.Repeat("y", 100)}
+	if _, ok = ds.enforce(doc); ok {
+		t.Fatalf("Expected document to remain too large")
+	}
+	if _, exists := doc["body"]; exists {
+		t.Fatalf("Expected body to be dropped")
+	}
+}
+
+func TestSecondaryCluster(t *testing.T) {
+	sc := &secondaryCluster{}
+	sc.before(1, nil)
+	atomic.AddInt64(&sc.pending, 2)
+	requests := []elastic.BulkableRequest{elastic.NewBulkIndexRequest(), elastic.NewBulkIndexRequest()}
+	response := &elastic.BulkResponse{Items: []map[string]*elastic.BulkResponseItem{
+		{"index": {Status: 201}},
+		{"index": {Status: 400, Error: &elastic.ErrorDetails{Type: "mapper_parsing_exception"}}},
+	}}
+	sc.after(1, requests, response, nil)
+	stats := sc.stats()
+	if stats.Pending != 0 || stats.Failed != 1 {
+		t.Fatalf("Unexpected secondary stats %+v", stats)
+	}
+	if _, ok := sc.started.Load(int64(1)); ok {
+		t.Fatalf("Expected execution start time to be cleared")
+	}
+}
+
+func TestCloudIDURL(t *testing.T) {
+	id := "my-deployment:" + base64.StdEncoding.EncodeToString([]byte("us-east-1.aws.found.io$abc123$def456"))
+	url, err := cloudIDURL(id)
+	if err != nil {
+		t.Fatalf("Unexpected cloud id error: %s", err)
+	}
+	if url != "https://abc123.us-east-1.aws.found.io:443" {
+		t.Fatalf("Unexpected cloud url %s", url)
+	}
+	id = base64.StdEncoding.EncodeToString([]byte("example.com:9243$abc123"))
+	if url, _ = cloudIDURL(id); url != "https://abc123.example.com:9243" {
+		t.Fatalf("Unexpected cloud url with port %s", url)
+	}
+	if _, err = cloudIDURL("name:bm9ob3N0"); err == nil {
+		t.Fatalf("Expected cloud id without uuid to fail")
+	}
+}
+
+func TestAWSSigningTransport(t *testing.T) {
+	var auth, sha string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, sha = r.Header.Get("Authorization"), r.Header.Get("X-Amz-Content-Sha256")
+	}))
+	defer ts.Close()
+	ac := &awsConnect{AccessKey: "id", SecretKey: "secret", Region: "us-east-1", Service: "aoss"}
+	if err := ac.validate(); err != nil {
+		t.Fatalf("Unexpected validation error: %s", err)
+	}
+	client := &http.Client{Transport: &awsSigningTransport{
+		transport: ts.Client().Transport,
+		signer:    v4.NewSigner(ac.credentials()),
+		region:    ac.Region,
+		service:   ac.Service,
+	}}
+	resp, err := client.Post(ts.URL+"/_bulk", "application/json", strings.NewReader("{}\n"))
+	if err != nil {
+		t.Fatalf("Unexpected request error: %s", err)
+	}
+	resp.Body.Close()
+	if !strings.Contains(auth, "/us-east-1/aoss/aws4_request") || sha == "" {
+		t.Fatalf("Expected request signed for aoss but got %q", auth)
+	}
+	if err := (&awsConnect{Service: "aoss"}).validate(); err == nil {
+		t.Fatalf("Expected default credentials chain without region to fail")
+	}
+}
+
+func TestCopyFields(t *testing.T) {
+	copyFields["db.copy"] = []*copyField{
+		{Namespace: "db.copy", Fields: []string{"title", "meta.author"}, Target: "full_text"},
+		{Namespace: "db.copy", Fields: []string{"tags"}, Target: "full_text"},
+	}
+	defer delete(copyFields, "db.copy")
+	op := &gtm.Op{Namespace: "db.copy", Data: map[string]interface{}{
+		"title": "Go",
+		"meta":  map[string]interface{}{"author": "rob"},
+		"tags":  []interface{}{"lang", 1},
+	}}
+	copyFieldValues(op)
+	values := op.Data["full_text"].([]interface{})
+	if len(values) != 4 || values[0] != "Go" || values[1] != "rob" || values[3] != "1" {
+		t.Fatalf("Unexpected copied values %v", values)
+	}
+	if op.Data["title"] != "Go" {
+		t.Fatalf("Expected source field to be kept")
+	}
+}
+
+func TestKafkaSink(t *testing.T) {
+	var path string
+	var records []map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		dec := json.NewDecoder(r.Body)
+		for dec.More() {
+			var record map[string]interface{}
+			dec.Decode(&record)
+			records = append(records, record)
+			fmt.Fprintln(w, `{"error_code":200}`)
+		}
+	}))
+	defer ts.Close()
+	ks := &kafkaSink{RestURL: ts.URL, ClusterID: "c1", TopicPrefix: "cdc.", BatchSize: 2}
+	ks.start()
+	defer close(ks.stopC)
+	ts0 := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+	if err := ks.write(&sinkEvent{Operation: "index", Namespace: "db.col", ID: "1", Timestamp: ts0, Doc: map[string]interface{}{"a": 1}}); err != nil {
+		t.Fatalf("Unexpected write error: %s", err)
+	}
+	if err := ks.write(&sinkEvent{Operation: "delete", Namespace: "db.col", ID: "2", Timestamp: ts0}); err != nil {
+		t.Fatalf("Unexpected write error: %s", err)
+	}
+	if path != "/v3/clusters/c1/topics/cdc.db.col/records" || len(records) != 2 {
+		t.Fatalf("Expected a batch of 2 records for the namespace topic but got %d at %s", len(records), path)
+	}
+	if _, tombstone := records[1]["value"]; tombstone {
+		t.Fatalf("Expected delete to be published without a value")
+	}
+}
+
+func TestNDJSONOutput(t *testing.T) {
+	var buf bytes.Buffer
+	ndjsonOut = &ndjsonWriter{w: &buf}
+	defer func() { ndjsonOut = nil }()
+	config := &configOptions{DisableElasticsearch: true}
+	req := elastic.NewBulkIndexRequest().Index("test").Type("_doc").Id("1").Doc(map[string]interface{}{"a": 1})
+	addBulkRequest(config, nil, nil, "test", req)
+	addBulkRequest(config, nil, nil, "test", elastic.NewBulkDeleteRequest().Index("test").Type("_doc").Id("2"))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || lines[1] != `{"a":1}` || !strings.Contains(lines[2], `"delete"`) {
+		t.Fatalf("Unexpected NDJSON output %q", buf.String())
+	}
+}
+
+func TestRedisSink(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer ln.Close()
+	commands := make(chan []interface{}, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			cmd, err := readRedisReply(r)
+			if err != nil {
+				return
+			}
+			commands <- cmd.([]interface{})
+			fmt.Fprint(conn, "+OK\r\n")
+		}
+	}()
+	rs := &redisSink{Address: ln.Addr().String(), Mode: "hash"}
+	if err = rs.write(&sinkEvent{Operation: "index", Namespace: "db.col", ID: "1", Doc: map[string]interface{}{"n": 1}}); err != nil {
+		t.Fatalf("Unexpected write error: %s", err)
+	}
+	if err = rs.write(&sinkEvent{Operation: "delete", Namespace: "db.col", ID: "1"}); err != nil {
+		t.Fatalf("Unexpected write error: %s", err)
+	}
+	rs.close()
+	var names []interface{}
+	for i := 0; i < 5; i++ {
+		cmd := <-commands
+		names = append(names, cmd[0])
+		if cmd[0] == "HSET" && (cmd[1] != "db.col:1" || cmd[3] != "1") {
+			t.Fatalf("Unexpected HSET %v", cmd)
+		}
+	}
+	if fmt.Sprint(names) != "[MULTI DEL HSET EXEC DEL]" {
+		t.Fatalf("Unexpected commands %v", names)
+	}
+}
+
+type fakeSQS struct {
+	sqsiface.SQSAPI
+	lock    sync.Mutex
+	batches []*sqs.SendMessageBatchInput
+	fail    int
+}
+
+func (f *fakeSQS) SendMessageBatch(in *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(in.Entries) > 10 {
+		return nil, errors.New("AWS.SimpleQueueService.TooManyEntriesInBatchRequest")
+	}
+	f.batches = append(f.batches, in)
+	out := &sqs.SendMessageBatchOutput{}
+	if f.fail > 0 {
+		f.fail--
+		out.Failed = []*sqs.BatchResultErrorEntry{{Id: in.Entries[0].Id, Message: aws.String("throttled"), SenderFault: aws.Bool(false)}}
+	}
+	return out, nil
+}
+
+func TestNotificationSink(t *testing.T) {
+	fake := &fakeSQS{}
+	ns := &notificationSink{QueueURL: "https://sqs/queue.fifo", Payload: "diff", sqs: fake}
+	changes := map[string]interface{}{"updatedFields": map[string]interface{}{"a": 2}}
+	for i := 0; i < 10; i++ {
+		ev := &sinkEvent{Operation: "update", Namespace: "db.col", ID: fmt.Sprint(i), Doc: map[string]interface{}{"a": 2}, Changes: changes}
+		if err := ns.write(ev); err != nil {
+			t.Fatalf("Unexpected write error: %s", err)
+		}
+	}
+	if len(fake.batches) != 1 || len(fake.batches[0].Entries) != 10 {
+		t.Fatalf("Expected one batch of 10 messages")
+	}
+	entry := fake.batches[0].Entries[3]
+	if *entry.MessageGroupId != "db.col:3" || entry.MessageDeduplicationId == nil {
+		t.Fatalf("Expected FIFO attributes on %v", entry)
+	}
+	var msg map[string]interface{}
+	json.Unmarshal([]byte(*entry.MessageBody), &msg)
+	if msg["changes"] == nil || msg["document"] != nil {
+		t.Fatalf("Expected diff payload but got %v", msg)
+	}
+}
+
+func TestNotificationSinkBatches(t *testing.T) {
+	fake := &fakeSQS{fail: 1}
+	ns := &notificationSink{QueueURL: "https://sqs/queue", Payload: "id", sqs: fake}
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 12; i++ {
+				ns.write(&sinkEvent{Operation: "index", Namespace: "db.col", ID: fmt.Sprintf("%d-%d", w, i)})
+			}
+		}(w)
+	}
+	wg.Wait()
+	if err := ns.flush(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	sent := make(map[string]bool)
+	for _, batch := range fake.batches {
+		for _, entry := range batch.Entries {
+			sent[*entry.MessageBody] = true
+		}
+	}
+	if len(sent) != 96 || len(ns.entries) != 0 {
+		t.Fatalf("Expected 96 messages in batches of at most 10 but got %d", len(sent))
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var lock sync.Mutex
+	var posts, events int
+	ws := &webhookSink{Secret: "s3cret", BatchSize: 2, MaxRetries: 3, RetryBackoffMs: 1}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("X-Monstache-Signature") != ws.signature(body) {
+			t.Errorf("Expected a valid signature")
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if posts++; posts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var batch []map[string]interface{}
+		json.Unmarshal(body, &batch)
+		events += len(batch)
+	}))
+	defer server.Close()
+	ws.URL = server.URL
+	ws.start()
+	for i := 0; i < 3; i++ {
+		ws.write(&sinkEvent{Operation: "index", Namespace: "db.col", ID: fmt.Sprint(i), Doc: map[string]interface{}{"i": i}})
+	}
+	if err := ws.close(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if events != 3 || posts != 3 {
+		t.Fatalf("Expected 3 events in 2 batches after a retry but got %d events in %d posts", events, posts)
+	}
+}
+
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+}
+
+func (f *fakeS3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	b, _ := ioutil.ReadAll(in.Body)
+	f.objects[*in.Key] = b
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObject(in *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	delete(f.objects, *in.Key)
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func TestArchiveSink(t *testing.T) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	as := &archiveSink{Prefix: "changes/", MaxEvents: 2, s3: fake, batches: make(map[string][]*sinkEvent)}
+	ts := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	as.write(&sinkEvent{Operation: "index", Namespace: "db.a", ID: "1", Timestamp: ts, Doc: map[string]interface{}{"n": 1}})
+	as.write(&sinkEvent{Operation: "delete", Namespace: "db.a", ID: "1", Timestamp: ts})
+	as.write(&sinkEvent{Operation: "index", Namespace: "db.b", ID: "2", Timestamp: ts.Add(time.Hour)})
+	if len(fake.objects) != 1 {
+		t.Fatalf("Expected a full batch to be uploaded")
+	}
+	as.flush()
+	if len(fake.objects) != 2 {
+		t.Fatalf("Expected the remaining batch to be uploaded on flush")
+	}
+	for key, b := range fake.objects {
+		if !strings.HasPrefix(key, "changes/namespace=db.a/hour=2020-03-04-05/") {
+			if !strings.HasPrefix(key, "changes/namespace=db.b/hour=2020-03-04-06/") {
+				t.Fatalf("Unexpected object key %s", key)
+			}
+			continue
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("Expected gzipped object: %s", err)
+		}
+		lines, _ := ioutil.ReadAll(zr)
+		if n := strings.Count(string(lines), "\n"); n != 2 {
+			t.Fatalf("Expected 2 events but got %d", n)
+		}
+	}
+}
+
+func TestMeilisearchSink(t *testing.T) {
+	var requests []string
+	var added []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			if r.URL.Path == "/tasks/3" {
+				fmt.Fprint(w, `{"status":"failed","error":{"code":"invalid_document_id","message":"bad id"}}`)
+			} else {
+				fmt.Fprint(w, `{"status":"succeeded"}`)
+			}
+			return
+		}
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/documents") {
+			json.NewDecoder(r.Body).Decode(&added)
+		}
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `{"taskUid":%d}`, len(requests))
+	}))
+	defer server.Close()
+	ms := &meilisearchSink{URL: server.URL, BatchSize: 100, FlushSeconds: 60}
+	if err := ms.start(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer ms.close()
+	ms.write(&sinkEvent{Operation: "index", Namespace: "db.col", ID: "1", Doc: map[string]interface{}{"a": 1}})
+	ms.write(&sinkEvent{Operation: "index", Namespace: "db.col", ID: "2", Doc: map[string]interface{}{"a": 2}})
+	ms.write(&sinkEvent{Operation: "update", Namespace: "db.col", ID: "1", Doc: map[string]interface{}{"b": 1}})
+	ms.write(&sinkEvent{Operation: "delete", Namespace: "db.col", ID: "2"})
+	err := ms.flush()
+	expected := []string{
+		"POST /indexes/db_col/documents",
+		"PUT /indexes/db_col/documents",
+		"POST /indexes/db_col/documents/delete-batch",
+	}
+	if strings.Join(requests, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected runs %v but got %v", expected, requests)
+	}
+	if len(added) != 2 || added[1]["id"] != "2" {
+		t.Fatalf("Expected documents keyed by id but got %v", added)
+	}
+	if err == nil || !strings.Contains(err.Error(), "bad id") {
+		t.Fatalf("Expected the failed task to be reported but got %v", err)
+	}
+}
+
+func TestTypesenseSink(t *testing.T) {
+	var requests []string
+	var schema map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-TYPESENSE-API-KEY") != "key" {
+			t.Errorf("Expected the api key header")
+		}
+		requests = append(requests, r.Method+" "+r.URL.RequestURI())
+		switch {
+		case r.URL.Path == "/collections":
+			json.NewDecoder(r.Body).Decode(&schema)
+			w.WriteHeader(http.StatusCreated)
+		case strings.HasSuffix(r.URL.Path, "/import"):
+			body, _ := ioutil.ReadAll(r.Body)
+			for range strings.Split(strings.TrimSpace(string(body)), "\n") {
+				fmt.Fprintln(w, `{"success":true}`)
+			}
+		default:
+			fmt.Fprint(w, `{"num_deleted":1}`)
+		}
+	}))
+	defer server.Close()
+	ts := &typesenseSink{
+		URL:    server.URL,
+		APIKey: "key",
+		Schemas: map[string]map[string]interface{}{
+			"db.col": {"fields": []map[string]interface{}{{"name": "title", "type": "string"}}},
+		},
+	}
+	if err := ts.start(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer ts.close()
+	if schema["name"] != "db.col" {
+		t.Fatalf("Expected the collection to be created but got %v", schema)
+	}
+	ts.write(&sinkEvent{Operation: "index", Namespace: "db.col", ID: "1", Doc: map[string]interface{}{"title": "a"}})
+	ts.write(&sinkEvent{Operation: "update", Namespace: "db.col", ID: "1", Doc: map[string]interface{}{"title": "b"}})
+	ts.write(&sinkEvent{Operation: "delete", Namespace: "db.col", ID: "1"})
+	if err := ts.flush(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	expected := []string{
+		"POST /collections",
+		"POST /collections/db.col/documents/import?action=upsert",
+		"POST /collections/db.col/documents/import?action=emplace",
+		"DELETE /collections/db.col/documents?filter_by=id%3A%5B%601%60%5D",
+	}
+	if strings.Join(requests, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected requests %v but got %v", expected, requests)
+	}
+}
+
+func TestPostgresSinkStatements(t *testing.T) {
+	ps := &postgresSink{Table: "analytics.docs"}
+	var runs []*sinkRun
+	for _, ev := range []*sinkEvent{
+		{Operation: "update", Namespace: "db.col", ID: "1", Doc: map[string]interface{}{"a": 1}},
+		{Operation: "update", Namespace: "db.col", ID: "1", Doc: map[string]interface{}{"b": 2}},
+		{Operation: "update", Namespace: "db.col", ID: "2", Doc: map[string]interface{}{"a": 3}},
+		{Operation: "delete", Namespace: "db.col", ID: "1"},
+	} {
+		runs = appendSinkRun(runs, ev.Operation, ev)
+	}
+	if len(runs) != 2 {
+		t.Fatalf("Expected 2 runs but got %d", len(runs))
+	}
+	query, args, err := ps.statement(runs[0])
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if !strings.Contains(query, `"analytics"."docs".doc, '{}'::jsonb) || excluded.doc`) {
+		t.Fatalf("Expected a merging upsert but got %s", query)
+	}
+	if len(args) != 8 || args[2] != `{"a":1,"b":2}` {
+		t.Fatalf("Expected the updates to document 1 to be combined but got %v", args)
+	}
+	query, args, _ = ps.statement(runs[1])
+	if query != `DELETE FROM "analytics"."docs" WHERE (namespace, id) IN (($1, $2))` || len(args) != 2 {
+		t.Fatalf("Unexpected delete statement %s %v", query, args)
+	}
+}
+
+type recordingSink struct {
+	calls []string
+}
+
+func (rs *recordingSink) Index(doc *monstachemap.SinkDocument) error {
+	rs.calls = append(rs.calls, "index "+doc.ID)
+	return nil
+}
+
+func (rs *recordingSink) Update(doc *monstachemap.SinkDocument) error {
+	rs.calls = append(rs.calls, "update "+doc.ID)
+	return nil
+}
+
+func (rs *recordingSink) Delete(doc *monstachemap.SinkDocument) error {
+	rs.calls = append(rs.calls, "delete "+doc.ID)
+	return nil
+}
+
+func (rs *recordingSink) Flush() error {
+	rs.calls = append(rs.calls, "flush")
+	return nil
+}
+
+func (rs *recordingSink) Close() error {
+	rs.calls = append(rs.calls, "close")
+	return nil
+}
+
+func TestPluginSink(t *testing.T) {
+	rs := &recordingSink{}
+	ps := &pluginSink{sink: rs}
+	for _, op := range []string{"index", "update", "delete"} {
+		ps.write(&sinkEvent{Operation: op, Namespace: "db.col", ID: "1"})
+	}
+	ps.close()
+	expected := "index 1,update 1,delete 1,flush,close"
+	if strings.Join(rs.calls, ",") != expected {
+		t.Fatalf("Expected calls %s but got %v", expected, rs.calls)
+	}
+}
+
+func TestConfigReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "monstache-reload")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.Remove(f.Name())
+	ioutil.WriteFile(f.Name(), []byte("namespace-regex = \"^db\\\\.a$\"\nelasticsearch-max-docs = 100\n"), 0644)
+	config := &configOptions{ConfigFile: f.Name(), NsRegex: "^db\\.a$"}
+	if err = nsFilter.set(config); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer nsFilter.set(&configOptions{})
+	throttle = newBulkThrottle(nil, &indexBulk{Workers: 4, MaxDocs: 100, MaxBytes: 1 << 20, MaxSeconds: 1})
+	defer func() {
+		throttle = nil
+	}()
+	reloader, err := newConfigReloader(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer setVerbose(false)
+	ioutil.WriteFile(f.Name(), []byte("namespace-regex = \"^db\\\\.b$\"\nelasticsearch-max-docs = 200\n"+
+		"elasticsearch-max-bytes = 1024\nelasticsearch-max-seconds = 3\nverbose = true\n"), 0644)
+	result := reloader.reload()
+	if result.Error != "" {
+		t.Fatalf("Unexpected error: %s", result.Error)
+	}
+	if strings.Join(result.Applied, ",") != "namespace-regex,Verbose,elasticsearch-max-bytes,elasticsearch-max-seconds" {
+		t.Fatalf("Expected the namespace regex, verbose and throttle to be applied but got %v", result.Applied)
+	}
+	if strings.Join(result.Restart, ",") != "elasticsearch-max-docs" {
+		t.Fatalf("Expected raising max docs to require a restart but got %v", result.Restart)
+	}
+	if !verbose() || nsFilter.match(&gtm.Op{Namespace: "db.a"}) || !nsFilter.match(&gtm.Op{Namespace: "db.b"}) {
+		t.Fatalf("Expected the reloaded options to be in effect")
+	}
+	if limits := throttle.current(); limits.MaxDocs != 100 || limits.MaxBytes != 1024 || limits.MaxSeconds != 3 {
+		t.Fatalf("Expected the throttle to be lowered but got %+v", limits)
+	}
+	if config.NsRegex != "^db\\.a$" || reloader.options().NsRegex != "^db\\.b$" {
+		t.Fatalf("Expected the reloaded options to be kept apart from the startup config")
+	}
+	ioutil.WriteFile(f.Name(), []byte("namespace-regex = \"(\"\n"), 0644)
+	if result = reloader.reload(); result.Error == "" || !nsFilter.match(&gtm.Op{Namespace: "db.b"}) {
+		t.Fatalf("Expected an invalid regex to be rejected")
+	}
+}
+
+func TestConfigReloadRace(t *testing.T) {
+	f, err := ioutil.TempFile("", "monstache-reload")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.Remove(f.Name())
+	ioutil.WriteFile(f.Name(), []byte("namespace-regex = \"^db\\\\.a$\"\n"), 0644)
+	config := &configOptions{
+		ConfigFile:        f.Name(),
+		NsRegex:           "^db\\.a$",
+		ElasticMaxConns:   2,
+		ElasticMaxDocs:    -1,
+		ElasticMaxBytes:   1 << 20,
+		ElasticMaxSeconds: 1,
+	}
+	if err = nsFilter.set(config); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer nsFilter.set(&configOptions{})
+	var indexed, requests int32
+	client := newTestElasticClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		items := make([]string, strings.Count(string(body), "\n")/2)
+		for i := range items {
+			items[i] = `{"index":{"_index":"a","status":201}}`
+		}
+		atomic.AddInt32(&indexed, int32(len(items)))
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"took":1,"errors":false,"items":[%s]}`, strings.Join(items, ","))
+	})
+	bulk, err := config.newBulkProcessor(client)
+	if err != nil {
+		t.Fatalf("Unable to start bulk processor: %s", err)
+	}
+	defer func() {
+		throttle = nil
+	}()
+	defer delete(bulkRequestLimits, bulk)
+	defer bulk.Stop()
+	reloader, err := newConfigReloader(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer setVerbose(false)
+	reload := func(i int) {
+		text := fmt.Sprintf("namespace-regex = \"^db\\\\.%c$\"\nelasticsearch-max-docs = %d\nelasticsearch-max-conns = %d\nverbose = %t\n",
+			'a'+i%2, 10+i%20, 1+i%2, i%2 == 0)
+		ioutil.WriteFile(f.Name(), []byte(text), 0644)
+		if result := reloader.reload(); result.Error != "" || len(result.Restart) > 0 {
+			t.Errorf("Expected the reload to be applied but got %+v", result)
+		}
+		reloader.options()
+	}
+	reload(0)
+	done := make(chan bool)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			reload(i)
+		}
+	}()
+	for i := 0; i < 500; i++ {
+		op := &gtm.Op{Id: i, Namespace: "db.a"}
+		nsFilter.match(op)
+		req := elastic.NewBulkIndexRequest().Index("a").Type("_doc").Id(strconv.Itoa(i)).Doc(map[string]interface{}{"n": i})
+		addBulkRequest(config, bulk, op, "a", req)
+	}
+	close(done)
+	wg.Wait()
+	for atomic.LoadInt32(&throttle.flushing) != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&requests) == 0 {
+		t.Fatalf("Expected the lowered max docs to flush the bulk processor early")
+	}
+	bulk.Flush()
+	if n := atomic.LoadInt32(&indexed); n != 500 {
+		t.Fatalf("Expected all requests to be indexed while reloading but got %d", n)
+	}
+	if limits := throttle.current(); limits.MaxDocs < 10 || limits.MaxDocs >= 30 || limits.Workers > 2 {
+		t.Fatalf("Expected the reloaded limits to be applied but got %+v", limits)
+	}
+}
+
+func TestExpandEnv(t *testing.T) {
+	os.Setenv("MONSTACHE_TEST_HOST", "es.example.com")
+	os.Setenv("MONSTACHE_TEST_EMPTY", "")
+	defer os.Unsetenv("MONSTACHE_TEST_HOST")
+	defer os.Unsetenv("MONSTACHE_TEST_EMPTY")
+	text := `urls = ["https://${MONSTACHE_TEST_HOST}:${MONSTACHE_TEST_PORT:-9200}"]
+user = "${MONSTACHE_TEST_EMPTY:-elastic}${MONSTACHE_TEST_UNSET}"
+regex = "^db\\.col$"
+price = "$${MONSTACHE_TEST_HOST}"`
+	expected := `urls = ["https://es.example.com:9200"]
+user = "elastic"
+regex = "^db\\.col$"
+price = "${MONSTACHE_TEST_HOST}"`
+	if expanded := expandEnv(text); expanded != expected {
+		t.Fatalf("Expected %s but got %s", expected, expanded)
+	}
+}
+
+func TestUnknownConfigOptions(t *testing.T) {
+	f, err := ioutil.TempFile("", "monstache-check")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.Remove(f.Name())
+	ioutil.WriteFile(f.Name(), []byte("verbose = true\nelasticsearch-max-doc = 10\n[gtm-settings]\nbuffer-sizes = 5\n"), 0644)
+	config := &configOptions{ConfigFile: f.Name()}
+	config.loadConfigFile()
+	expected := "elasticsearch-max-doc,gtm-settings.buffer-sizes"
+	if strings.Join(config.unknownOptions, ",") != expected {
+		t.Fatalf("Expected unknown options %s but got %v", expected, config.unknownOptions)
+	}
+	if !config.Verbose {
+		t.Fatalf("Expected known options to be loaded")
+	}
+}
+
+func TestYAMLAndJSONConfig(t *testing.T) {
+	files := map[string]string{
+		".yaml": `
+elasticsearch-urls: ["http://es:9200"]
+elasticsearch-max-docs: 100
+verbose: true
+gtm-settings:
+  buffer-size: 64
+mapping:
+  - namespace: db.col
+    index: col
+`,
+		".json": `{
+  "elasticsearch-urls": ["http://es:9200"],
+  "elasticsearch-max-docs": 100,
+  "verbose": true,
+  "gtm-settings": {"buffer-size": 64},
+  "mapping": [{"namespace": "db.col", "index": "col"}]
+}`,
+	}
+	for ext, text := range files {
+		f, err := ioutil.TempFile("", "monstache-config-*"+ext)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		defer os.Remove(f.Name())
+		ioutil.WriteFile(f.Name(), []byte(text), 0644)
+		config, err := (&configOptions{ConfigFile: f.Name()}).readConfigFile()
+		if err != nil {
+			t.Fatalf("Unable to read %s config: %s", ext, err)
+		}
+		if config.ElasticUrls[0] != "http://es:9200" || config.ElasticMaxDocs != 100 || !config.Verbose {
+			t.Fatalf("Expected options from the %s config but got %+v", ext, config)
+		}
+		if config.GtmSettings.BufferSize != 64 || len(config.Mapping) != 1 || config.Mapping[0].Index != "col" {
+			t.Fatalf("Expected tables from the %s config", ext)
+		}
+		if len(config.unknownOptions) != 0 {
+			t.Fatalf("Unexpected unknown options %v", config.unknownOptions)
+		}
+	}
+}
+
+func TestNamespaceSettings(t *testing.T) {
+	defer func() {
+		for _, ns := range []string{"", "db.orders", "db.users", "db.logs"} {
+			delete(ingestPipelines, ns)
+			delete(routingExprs, ns)
+			delete(routingNamespaces, ns)
+			delete(fieldExclusions, ns)
+		}
+		delete(indexBulkSettings, "orders")
+		delete(mapIndexTypes, "db.orders")
+	}()
+	mapIndexTypes["db.orders"] = &indexTypeMapping{Namespace: "db.orders", Index: "Orders"}
+	ingestPipelines["db.logs"] = &ingestPipeline{Namespace: "db.logs", Name: "logs"}
+	config := &configOptions{
+		NamespaceDefaults: &namespaceSettings{
+			Pipeline:      "common",
+			RoutingField:  "tenant",
+			ExcludeFields: []string{"password"},
+			MaxDocs:       1000,
+		},
+		Namespace: []namespaceSettings{
+			{Namespace: "db.orders", RoutingTemplate: "{region}", MaxBytes: 5},
+			{Namespace: "db.users", Pipeline: "users", ExcludeFields: []string{}},
+		},
+	}
+	config.loadNamespaceSettings()
+	if namespacePipeline("db.orders").Name != "common" || namespacePipeline("db.users").Name != "users" {
+		t.Fatalf("Expected pipelines to be inherited or overridden")
+	}
+	if namespacePipeline("db.logs").Name != "logs" || namespacePipeline("db.other").Name != "common" {
+		t.Fatalf("Expected the dedicated pipeline to win and the default to apply elsewhere")
+	}
+	if re := namespaceRouting("db.orders"); re.Template != "{region}" || re.Field != "" {
+		t.Fatalf("Expected the routing override but got %+v", re)
+	}
+	if re := namespaceRouting("db.other"); re.Field != "tenant" || !routingNamespaces[""] {
+		t.Fatalf("Expected the default routing")
+	}
+	if b := indexBulkSettings["orders"]; b == nil || b.MaxDocs != 1000 || b.MaxBytes != 5 {
+		t.Fatalf("Expected bulk sizes for the orders index but got %+v", b)
+	}
+	op := &gtm.Op{Namespace: "db.users", Data: map[string]interface{}{"password": "x"}}
+	excludeFields(op)
+	if _, ok := op.Data["password"]; !ok {
+		t.Fatalf("Expected an empty exclude-fields to turn off the default")
+	}
+	op = &gtm.Op{Namespace: "db.other", Data: map[string]interface{}{"password": "x"}}
+	excludeFields(op)
+	if _, ok := op.Data["password"]; ok {
+		t.Fatalf("Expected the default exclusions to apply")
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/monstache":
+			w.Write([]byte(`{"data":{"data":{"password":"s3cret","port":9200}}}`))
+		case "/v1/kv/monstache":
+			w.Write([]byte(`{"data":{"url":"mongodb://user:pass@db:27017"}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+	os.Setenv("VAULT_ADDR", vault.URL)
+	os.Setenv("VAULT_TOKEN", "token")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+	defer func() { secrets = make(map[string]*secret) }()
+
+	config := &configOptions{
+		MongoURL:        "vault:kv/monstache#url",
+		ElasticUser:     "elastic",
+		ElasticPassword: "vault:secret/data/monstache#password",
+		WebhookSink:     &webhookSink{Secret: "vault:secret/data/monstache#port"},
+	}
+	if err := config.resolveSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if config.MongoURL != "mongodb://user:pass@db:27017" {
+		t.Fatalf("Expected KV v1 secret but got %s", config.MongoURL)
+	}
+	if config.ElasticPassword != "s3cret" || config.WebhookSink.Secret != "9200" {
+		t.Fatalf("Expected KV v2 secrets but got %s and %s", config.ElasticPassword, config.WebhookSink.Secret)
+	}
+	if config.ElasticUser != "elastic" || hasSecret("elasticsearch-user") {
+		t.Fatalf("Expected plain option to be left alone")
+	}
+	if secretValue("elasticsearch-password", "") != "s3cret" {
+		t.Fatalf("Expected resolved secret to be recorded")
+	}
+
+	secretsLock.Lock()
+	secrets["elasticsearch-password"].value = "rotated"
+	secretsLock.Unlock()
+	var auth string
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer es.Close()
+	tr := &secretAuthTransport{
+		transport: http.DefaultTransport,
+		user:      config.ElasticUser,
+		password:  config.ElasticPassword,
+	}
+	req, _ := http.NewRequest("GET", es.URL, nil)
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("elastic:rotated"))
+	if auth != expected {
+		t.Fatalf("Expected rotated credentials but got %s", auth)
+	}
+
+	for _, ref := range []string{"vault:secret/data/monstache", "vault:secret/data/monstache#missing", "vault:kv/absent#url"} {
+		if _, err := config.resolveSecret(ref); err == nil {
+			t.Fatalf("Expected error resolving %s", ref)
+		}
+	}
+}
+
+func TestSubcommands(t *testing.T) {
+	tests := []struct {
+		args    []string
+		command string
+		rest    int
+	}{
+		{nil, "sync", 0},
+		{[]string{"-f", "config.toml"}, "sync", 2},
+		{[]string{"sync", "-verbose"}, "sync", 1},
+		{[]string{"check", "-f", "config.toml"}, "check", 2},
+		{[]string{"verify"}, "verify", 0},
+		{[]string{"replay", "-f", "config.toml", "1700000000"}, "replay", 3},
+		{[]string{"resume", "export", "out.json"}, "resume export", 1},
+		{[]string{"resume", "import", "-f", "config.toml", "in.json"}, "resume import", 3},
+	}
+	for _, test := range tests {
+		command, rest, err := parseSubcommand(test.args)
+		if err != nil {
+			t.Fatalf("Unexpected error for %v: %s", test.args, err)
+		}
+		if command != test.command || len(rest) != test.rest {
+			t.Fatalf("Expected %s with %d args for %v but got %s with %v", test.command, test.rest, test.args, command, rest)
+		}
+	}
+	for _, args := range [][]string{{"resume"}, {"resume", "delete"}} {
+		if _, _, err := parseSubcommand(args); err == nil {
+			t.Fatalf("Expected error for %v", args)
+		}
+	}
+
+	config := &configOptions{ResumeFromTimestamp: 10}
+	if err := config.replayFrom(nil); err != nil || !config.Replay || config.ResumeFromTimestamp != 0 {
+		t.Fatalf("Expected replay of the entire oplog")
+	}
+	if err := config.replayFrom([]string{"2023-11-14T22:13:20Z"}); err != nil {
+		t.Fatal(err)
+	}
+	if config.Replay || config.ResumeFromTimestamp != 1700000000<<32 {
+		t.Fatalf("Expected replay from timestamp but got %d", config.ResumeFromTimestamp)
+	}
+	if err := config.replayFrom([]string{"1700000000"}); err != nil || config.ResumeFromTimestamp != 1700000000 {
+		t.Fatalf("Expected replay from seconds")
+	}
+	if err := config.replayFrom([]string{"yesterday"}); err == nil {
+		t.Fatalf("Expected error for invalid timestamp")
+	}
+}
+
+func TestConfigProfiles(t *testing.T) {
+	text := `
+profile = "dev"
+elasticsearch-urls = ["http://localhost:9200"]
+elasticsearch-max-docs = 100
+verbose = true
+
+[gtm-settings]
+buffer-size = 64
+channel-size = 512
+
+[profiles.dev]
+elasticsearch-max-docs = 10
+
+[profiles.prod]
+elasticsearch-urls = ["https://es1:9200", "https://es2:9200"]
+verbose = false
+
+[profiles.prod.gtm-settings]
+buffer-size = 2048
+
+[[profiles.prod.mapping]]
+namespace = "db.col"
+index = "col"
+`
+	f, err := ioutil.TempFile("", "monstache-config-*.toml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.Remove(f.Name())
+	ioutil.WriteFile(f.Name(), []byte(text), 0644)
+
+	config, err := (&configOptions{ConfigFile: f.Name()}).readConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Profile != "dev" || config.ElasticMaxDocs != 10 || !config.Verbose || len(config.ElasticUrls) != 1 {
+		t.Fatalf("Expected the default dev profile but got %+v", config)
+	}
+	if len(config.unknownOptions) != 0 {
+		t.Fatalf("Unexpected unknown options %v", config.unknownOptions)
+	}
+
+	config, err = (&configOptions{ConfigFile: f.Name(), Profile: "prod"}).readConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Profile != "prod" || config.ElasticMaxDocs != 100 || config.Verbose || len(config.ElasticUrls) != 2 {
+		t.Fatalf("Expected the prod profile but got %+v", config)
+	}
+	if config.GtmSettings.BufferSize != 2048 || config.GtmSettings.ChannelSize != 512 {
+		t.Fatalf("Expected tables to be merged but got %+v", config.GtmSettings)
+	}
+	if len(config.Mapping) != 1 || config.Mapping[0].Index != "col" {
+		t.Fatalf("Expected the prod mapping")
+	}
+
+	if _, err = (&configOptions{ConfigFile: f.Name(), Profile: "qa"}).readConfigFile(); err == nil {
+		t.Fatalf("Expected error for undefined profile")
+	}
+}
+
+func TestCentralConfigMerge(t *testing.T) {
+	text := `
+elasticsearch-urls = ["http://localhost:9200"]
+elasticsearch-max-docs = 100
+direct-read-namespaces = ["db.a"]
+
+[gtm-settings]
+buffer-size = 64
+channel-size = 512
+`
+	doc := bson.M{
+		"elasticsearch-max-docs": 500,
+		"namespace-regex":        "^db\\.",
+		"gtm-settings":           bson.M{"buffer-size": 1024},
+		"direct-read-namespaces": []interface{}{"db.b", "db.c"},
+	}
+	central := normalizeConfigValue(doc).(map[string]interface{})
+	merged, err := mergeConfigText(text, central, mergeConfigTables)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &configOptions{}
+	if _, err = toml.Decode(merged, config); err != nil {
+		t.Fatal(err)
+	}
+	if config.ElasticMaxDocs != 500 || config.NsRegex != "^db\\." || len(config.ElasticUrls) != 1 {
+		t.Fatalf("Expected the config document to override the file but got %+v", config)
+	}
+	if config.GtmSettings.BufferSize != 1024 || config.GtmSettings.ChannelSize != 512 {
+		t.Fatalf("Expected tables to be merged but got %+v", config.GtmSettings)
+	}
+	if len(config.DirectReadNs) != 2 || config.DirectReadNs[0] != "db.b" {
+		t.Fatalf("Expected arrays to be replaced but got %v", config.DirectReadNs)
+	}
+}
+
+func TestExampleConfig(t *testing.T) {
+	text, err := exampleConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &configOptions{}
+	md, err := toml.Decode(text, config)
+	if err != nil {
+		t.Fatalf("Unable to decode example config: %s", err)
+	}
+	if undecoded := md.Undecoded(); len(undecoded) != 0 {
+		t.Fatalf("Unexpected unknown options %v", undecoded)
+	}
+	if config.ElasticMaxBytes != elasticMaxBytesDefault || config.ConfigDatabaseName != configDatabaseNameDefault {
+		t.Fatalf("Expected default values but got %d and %s", config.ElasticMaxBytes, config.ConfigDatabaseName)
+	}
+	if config.MongoDialSettings.Timeout != 15 || config.KafkaSink != nil || len(config.Mapping) != 0 {
+		t.Fatalf("Expected settings tables to be set and sinks and lists to be commented out")
+	}
+	for _, expected := range []string{
+		"# MongoDB server or router server connection URL\nmongo-url = ",
+		"# Index and type overrides for a namespace\n# [[mapping]]\n#   namespace = \"\"",
+	} {
+		if !strings.Contains(text, expected) {
+			t.Fatalf("Expected example config to contain %q", expected)
+		}
+	}
+	if _, rest, err := parseSubcommand([]string{"config", "init", "out.toml"}); err != nil || len(rest) != 1 {
+		t.Fatalf("Expected config init subcommand")
+	}
+}
+
+func TestConfigIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monstache-config")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"base.toml": `
+elasticsearch-max-docs = 100
+verbose = true
+[gtm-settings]
+buffer-size = 64
+`,
+		"teams/a.toml": `
+direct-read-namespaces = ["a.col"]
+[[mapping]]
+namespace = "a.col"
+index = "a"
+`,
+		"teams/b.yaml": `
+mapping:
+  - namespace: b.col
+    index: b
+`,
+		"monstache.toml": `
+include = ["base.toml", "teams/*"]
+elasticsearch-max-docs = 200
+`,
+		"local.toml": `
+verbose = false
+[gtm-settings]
+channel-size = 128
+`,
+		"loop.toml": `include = "loop.toml"`,
+	}
+	os.Mkdir(filepath.Join(dir, "teams"), 0755)
+	for name, text := range files {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(text), 0644)
+	}
+	config := &configOptions{}
+	fs := flag.NewFlagSet("monstache", flag.ContinueOnError)
+	fs.Var(&configFileArgs{config}, "f", "")
+	fs.Parse([]string{"-f", filepath.Join(dir, "monstache.toml"), "-f", filepath.Join(dir, "local.toml")})
+	file, err := config.readConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.ElasticMaxDocs != 200 || file.Verbose {
+		t.Fatalf("Expected later files to take precedence but got %+v", file)
+	}
+	if file.GtmSettings.BufferSize != 64 || file.GtmSettings.ChannelSize != 128 {
+		t.Fatalf("Expected tables to be merged but got %+v", file.GtmSettings)
+	}
+	if len(file.Mapping) != 2 || file.Mapping[0].Index != "a" || file.Mapping[1].Index != "b" {
+		t.Fatalf("Expected mappings of both teams in order but got %+v", file.Mapping)
+	}
+	if len(file.DirectReadNs) != 1 || len(file.unknownOptions) != 0 {
+		t.Fatalf("Unexpected options %+v", file)
+	}
+	if _, err = (&configOptions{ConfigFile: filepath.Join(dir, "loop.toml")}).readConfigFile(); err == nil {
+		t.Fatalf("Expected error for an include cycle")
+	}
+	ioutil.WriteFile(filepath.Join(dir, "missing.toml"), []byte(`include = "absent.toml"`), 0644)
+	if _, err = (&configOptions{ConfigFile: filepath.Join(dir, "missing.toml")}).readConfigFile(); err == nil {
+		t.Fatalf("Expected error for missing include")
+	}
+}
+
+func TestOptionFlagsAndEnvironment(t *testing.T) {
+	f, err := ioutil.TempFile("", "monstache-config-*.toml")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer os.Remove(f.Name())
+	ioutil.WriteFile(f.Name(), []byte(`
+elasticsearch-healthcheck-timeout = 10
+elasticsearch-max-docs = 100
+[gtm-settings]
+buffer-size = 64
+channel-size = 128
+[[mapping]]
+namespace = "db.a"
+index = "a"
+`), 0644)
+	os.Setenv("MONSTACHE_ELASTICSEARCH_MAX_DOCS", "300")
+	os.Setenv("MONSTACHE_GTM_SETTINGS_CHANNEL_SIZE", "256")
+	os.Setenv("MONSTACHE_DIRECT_READ_NAMESPACES", "db.a,db.b")
+	os.Setenv("MONSTACHE_ELASTICSEARCH_HEALTHCHECK_TIMEOUT", "20")
+	defer os.Unsetenv("MONSTACHE_ELASTICSEARCH_MAX_DOCS")
+	defer os.Unsetenv("MONSTACHE_GTM_SETTINGS_CHANNEL_SIZE")
+	defer os.Unsetenv("MONSTACHE_DIRECT_READ_NAMESPACES")
+	defer os.Unsetenv("MONSTACHE_ELASTICSEARCH_HEALTHCHECK_TIMEOUT")
+
+	config := &configOptions{GtmSettings: gtmDefaultSettings()}
+	fs := flag.NewFlagSet("monstache", flag.ContinueOnError)
+	config.defineFlags(fs)
+	err = fs.Parse([]string{
+		"-f", f.Name(),
+		"-elasticsearch-healthcheck-timeout", "30",
+		"-gtm-settings.buffer-size", "1024",
+		"-mapping", `{"namespace": "db.b", "index": "b"}`,
+		"-kafka-sink.rest-url", "http://kafka:8082",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = config.loadFlagEnvironment(fs); err != nil {
+		t.Fatal(err)
+	}
+	if config.ElasticHealth1 != 30 || config.ElasticMaxDocs != 300 {
+		t.Fatalf("Expected flags to take precedence over the environment but got %d and %d", config.ElasticHealth1, config.ElasticMaxDocs)
+	}
+	if len(config.DirectReadNs) != 2 || config.DirectReadNs[1] != "db.b" {
+		t.Fatalf("Expected list from the environment but got %v", config.DirectReadNs)
+	}
+	file, err := config.readConfigFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file.GtmSettings.BufferSize != 1024 || file.GtmSettings.ChannelSize != 256 {
+		t.Fatalf("Expected table keys from flags and environment but got %+v", file.GtmSettings)
+	}
+	if len(file.Mapping) != 2 || file.Mapping[1].Index != "b" {
+		t.Fatalf("Expected mapping from flag to be added but got %+v", file.Mapping)
+	}
+	if file.KafkaSink == nil || file.KafkaSink.RestURL != "http://kafka:8082" {
+		t.Fatalf("Expected kafka sink from flag")
+	}
+	if file.ElasticMaxDocs != 100 {
+		t.Fatalf("Expected scalar options of the file to be kept in the file")
+	}
+
+	os.Setenv("MONSTACHE_ELASTICSEARCH_MAX_BYTES", "lots")
+	defer os.Unsetenv("MONSTACHE_ELASTICSEARCH_MAX_BYTES")
+	config = &configOptions{}
+	fs = flag.NewFlagSet("monstache", flag.ContinueOnError)
+	config.defineFlags(fs)
+	fs.Parse(nil)
+	if err = config.loadFlagEnvironment(fs); err == nil {
+		t.Fatalf("Expected error for invalid environment value")
+	}
+}
+
+func TestStarterConfig(t *testing.T) {
+	p := &deploymentProbe{
+		MongoURL:       "mongodb://localhost:27017",
+		MongoVersion:   "6.0.5",
+		ChangeStreams:  true,
+		ElasticUrls:    []string{"http://localhost:9200"},
+		ElasticVersion: "8.11",
+		Templates:      []string{"logs"},
+		Collections: []collectionProbe{
+			{Namespace: "shop.orders", Count: 2000000, Size: 3 << 30},
+			{Namespace: "shop.users", Count: 10, Size: 2048},
+		},
+	}
+	var out bytes.Buffer
+	opts := p.chooseOptions(bufio.NewReader(strings.NewReader("n\n\n\nno\n")), &out)
+	if len(opts.Namespaces) != 1 || opts.Namespaces[0] != "shop.users" || !opts.DirectReads || opts.Resume {
+		t.Fatalf("Unexpected choices %+v", opts)
+	}
+	if !strings.Contains(out.String(), "Sync shop.orders (2000000 documents, 3.0 GiB)?") {
+		t.Fatalf("Expected collection sizes in prompts but got %s", out.String())
+	}
+	text := p.starterConfig(p.defaultOptions())
+	config := &configOptions{}
+	if _, err := toml.Decode(text, config); err != nil {
+		t.Fatalf("Unable to decode starter config: %s\n%s", err, text)
+	}
+	if len(config.ChangeStreamNs) != 2 || len(config.DirectReadNs) != 2 || !config.Resume {
+		t.Fatalf("Expected every collection to be synced but got %+v", config)
+	}
+	if config.DirectReadSplitMax != 9 || !strings.Contains(text, "#   logs") {
+		t.Fatalf("Expected split reads for large collections and templates in\n%s", text)
+	}
+	p.ChangeStreams = false
+	text = p.starterConfig(opts)
+	config = &configOptions{}
+	if _, err := toml.Decode(text, config); err != nil {
+		t.Fatal(err)
+	}
+	if config.NsRegex != `^(shop\.users)$` || len(config.ChangeStreamNs) != 0 || config.DirectReadSplitMax != 0 {
+		t.Fatalf("Expected oplog namespace regex but got %+v", config)
+	}
+}
+
+func TestMigrateConfig(t *testing.T) {
+	text := `# connection
+mongo-url = "mongodb://localhost:27017"
+elasticsearch-url = "http://es:9200" # primary
+direct-read-namespace = ["db.a", "db.b"]
+mongo-cursor-timeout = "10s"
+old-list = [
+  "a",
+  "b",
+]
+replay = true
+
+[gtm-settings]
+buffer-size = 64
+stale-key = 1
+`
+	migrated, report, err := migrateConfig(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &configOptions{}
+	md, err := toml.Decode(migrated, config)
+	if err != nil {
+		t.Fatalf("Unable to decode migrated config: %s\n%s", err, migrated)
+	}
+	if len(config.ElasticUrls) != 1 || config.ElasticUrls[0] != "http://es:9200" || len(config.DirectReadNs) != 2 {
+		t.Fatalf("Expected renamed options but got %+v", config)
+	}
+	if !strings.Contains(migrated, "# connection\n") || !strings.Contains(migrated, "# mongo-cursor-timeout") || !strings.Contains(migrated, "#   \"b\",") {
+		t.Fatalf("Expected comments to be kept and removed options commented out in\n%s", migrated)
+	}
+	if len(md.Undecoded()) != 1 {
+		t.Fatalf("Expected only the unknown table key to remain but got %v", md.Undecoded())
+	}
+	expected := []string{
+		"gtm-settings.stale-key is not an option and must be removed by hand",
+		"elasticsearch-url was renamed to elasticsearch-urls which takes a list",
+		"direct-read-namespace was renamed to direct-read-namespaces",
+		"mongo-cursor-timeout is no longer an option and was commented out",
+		"old-list is no longer an option and was commented out",
+		"replay: " + optionNotes["replay"],
+	}
+	if strings.Join(report, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("Unexpected report:\n%s", strings.Join(report, "\n"))
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := newMetrics()
+	op := &gtm.Op{Id: "1", Namespace: "db.col", Operation: "u"}
+	m.eventRead(op)
+	m.eventRead(op)
+	m.document(indexAction(op), op, "db.col")
+	m.bulkFailed("db.col", "mapping")
+	m.bulkStarted("monstache", 1)
+	m.bulkFinished("monstache", 1)
+	m.pluginTimer("map", "db.col")()
+	m.watchQueue("relate", func() int { return 3 })
+	var none *monstacheMetrics
+	none.eventRead(op)
+	none.pluginTimer("map", "db.col")()
+	rec := httptest.NewRecorder()
+	m.handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`monstache_events_read_total{namespace="db.col",operation="u"} 2`,
+		`monstache_documents_total{action="updated",index="db.col",namespace="db.col"} 1`,
+		`monstache_bulk_failures_total{class="mapping",index="db.col"} 1`,
+		`monstache_bulk_request_duration_seconds_count{bulk="monstache"} 1`,
+		`monstache_plugin_duration_seconds_count{namespace="db.col",plugin="map"} 1`,
+		`monstache_queue_depth{queue="relate"} 3`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Fatalf("Expected metrics to contain %s: %s", line, body)
+		}
+	}
+	req := elastic.NewBulkDeleteRequest().Index("idx").Id("1")
+	if index := bulkRequestIndex(req); index != "idx" {
+		t.Fatalf("Expected index idx but got %s", index)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var received []map[string]interface{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("Unexpected collector path %s", r.URL.Path)
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		received = append(received, body)
+	}))
+	defer collector.Close()
+	config := &configOptions{
+		TracingEndpoint:    collector.URL,
+		TracingServiceName: "test",
+		TracingSampleRatio: 1,
+	}
+	tr := newTracer(config)
+	go tr.export()
+	op := &gtm.Op{Id: "1", Namespace: "db.col", Operation: "i"}
+	tr.startEvent(op)
+	span := tr.start(op, "map")
+	span.lookup("lookup")()
+	span.finish(nil)
+	req := elastic.NewBulkIndexRequest().Index("db.col").Id("1")
+	enqueue := tr.start(op, "bulk enqueue")
+	tr.enqueue(enqueue, req)
+	enqueue.finish(nil)
+	tr.finishEvent(op, nil)
+	tr.bulkStarted("monstache", 1, []elastic.BulkableRequest{req})
+	tr.bulkFinished("monstache", 1, nil, errors.New("failed"))
+	var untraced *tracer
+	untraced.startEvent(op)
+	untraced.start(op, "map").finish(nil)
+	tr.flush()
+	if len(received) != 1 {
+		t.Fatalf("Expected 1 export but got %d", len(received))
+	}
+	rs := received[0]["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	spans := rs["scopeSpans"].([]interface{})[0].(map[string]interface{})["spans"].([]interface{})
+	byName := make(map[string]map[string]interface{})
+	for _, s := range spans {
+		span := s.(map[string]interface{})
+		byName[span["name"].(string)] = span
+	}
+	if len(byName) != 5 {
+		t.Fatalf("Expected 5 spans but got %v", byName)
+	}
+	event := byName["change event"]
+	for _, name := range []string{"map", "bulk enqueue"} {
+		if byName[name]["parentSpanId"] != event["spanId"] || byName[name]["traceId"] != event["traceId"] {
+			t.Fatalf("Expected %s to be a child of the change event", name)
+		}
+	}
+	if byName["lookup"]["parentSpanId"] != byName["map"]["spanId"] {
+		t.Fatalf("Expected lookup to be a child of map")
+	}
+	flush := byName["bulk flush"]
+	links := flush["links"].([]interface{})
+	if len(links) != 1 || links[0].(map[string]interface{})["spanId"] != byName["bulk enqueue"]["spanId"] {
+		t.Fatalf("Expected bulk flush to link the enqueue span: %v", flush)
+	}
+	if flush["status"].(map[string]interface{})["message"] != "failed" {
+		t.Fatalf("Expected bulk flush to record the error: %v", flush)
+	}
+}
+
+func TestJSONLogging(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(&buf, "WARN ", log.Flags())
+	setJSONOutput(logger)
+	setJSONOutput(logger)
+	op := &gtm.Op{Id: "1", Namespace: "db.col", Operation: "u", Timestamp: bson.MongoTimestamp(5<<32 | 2)}
+	fields := opLogFields(op)
+	fields.ErrorClass = errorClass(&elastic.Error{Status: 429})
+	logWith(logger, fields, "Skipping document %v", op.Id)
+	logger.Println("plain")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log lines but got %v", lines)
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"level":       "WARN",
+		"msg":         "Skipping document 1",
+		"namespace":   "db.col",
+		"id":          "1",
+		"operation":   "u",
+		"resume_ts":   "5:2",
+		"error_class": "rejected",
+	}
+	for k, v := range expected {
+		if entry[k] != v {
+			t.Fatalf("Expected %s to be %v but got %v", k, v, entry[k])
+		}
+	}
+	entry = nil
+	json.Unmarshal([]byte(lines[1]), &entry)
+	if entry["msg"] != "plain" || entry["namespace"] != nil {
+		t.Fatalf("Unexpected plain log entry %v", entry)
+	}
+	buf.Reset()
+	text := log.New(&buf, "WARN ", 0)
+	logWith(text, fields, "Skipping document %v", op.Id)
+	if buf.String() != "WARN Skipping document 1\n" {
+		t.Fatalf("Unexpected text log line %q", buf.String())
+	}
+}
+
+func TestReplicationLag(t *testing.T) {
+	alerts := make(chan *lagAlert, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		alert := &lagAlert{}
+		json.NewDecoder(r.Body).Decode(alert)
+		alerts <- alert
+	}))
+	defer hook.Close()
+	lm := newLagMonitor(&configOptions{
+		ReplicationLagThreshold: 60,
+		ReplicationLagAlertURL:  hook.URL,
+		ResumeName:              "default",
+	})
+	ts := func(ago time.Duration) bson.MongoTimestamp {
+		return bson.MongoTimestamp(time.Now().Add(-ago).Unix() << 32)
+	}
+	lm.observe(&gtm.Op{Namespace: "db.col", Source: gtm.OplogQuerySource, Timestamp: ts(time.Second)})
+	if err := lm.check(); err != nil {
+		t.Fatalf("Expected healthy lag: %s", err)
+	}
+	lm.observe(&gtm.Op{Namespace: "db.col", Source: gtm.DirectQuerySource})
+	lm.observe(&gtm.Op{Namespace: "db.other", Source: gtm.OplogQuerySource, Timestamp: ts(2 * time.Minute)})
+	if err := lm.check(); err == nil || !strings.Contains(err.Error(), "db.other") {
+		t.Fatalf("Expected lag in db.other to fail the check: %v", err)
+	}
+	alert := <-alerts
+	if alert.Status != "firing" || alert.Namespace != "db.other" || alert.ThresholdSeconds != 60 || alert.LagSeconds < 120 {
+		t.Fatalf("Unexpected alert %+v", alert)
+	}
+	lm.observe(&gtm.Op{Namespace: "db.col", Source: gtm.OplogQuerySource, Timestamp: ts(0)})
+	if err := lm.check(); err != nil {
+		t.Fatalf("Expected lag to recover: %s", err)
+	}
+	if alert = <-alerts; alert.Status != "resolved" {
+		t.Fatalf("Expected a resolved alert but got %+v", alert)
+	}
+	var none *lagMonitor
+	none.observe(&gtm.Op{})
+	if none.check() != nil {
+		t.Fatalf("Expected a disabled monitor to be healthy")
+	}
+}
+
+func TestDocumentStats(t *testing.T) {
+	docStats = newDocumentStats()
+	defer func() { docStats = nil }()
+	insert := &gtm.Op{Id: "1", Namespace: "db.col", Operation: "i"}
+	update := &gtm.Op{Id: "2", Namespace: "db.col", Operation: "u"}
+	recordDocument(indexAction(insert), insert, "col")
+	recordDocument(indexAction(update), update, "col")
+	recordDocument("skipped", insert, "col")
+	recordDocument("deleted", &gtm.Op{Id: "3", Namespace: "db.other", Operation: "d"}, "other")
+	req := elastic.NewBulkIndexRequest().Index("col").Id("1")
+	docStats.enqueue(insert, req)
+	afterBulk(nil, []elastic.BulkableRequest{req}, &elastic.BulkResponse{
+		Items: []map[string]*elastic.BulkResponseItem{
+			{"index": {Index: "col", Id: "1", Status: 400, Error: &elastic.ErrorDetails{Type: "mapper_parsing_exception"}}},
+		},
+	}, nil)
+	namespaces, indexes := docStats.snapshot()
+	expected := documentCounts{Indexed: 1, Updated: 1, Skipped: 1, Failed: 1}
+	if namespaces["db.col"] != expected || indexes["col"] != expected {
+		t.Fatalf("Unexpected counts %+v %+v", namespaces["db.col"], indexes["col"])
+	}
+	if namespaces["db.other"].Deleted != 1 || indexes["other"].Deleted != 1 {
+		t.Fatalf("Expected a delete in db.other: %+v", namespaces)
+	}
+	if _, ok := docStats.pending.Load(req); ok {
+		t.Fatalf("Expected the request to be done after its bulk response")
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	saved := readyState
+	defer func() { readyState = saved }()
+	readyState = &readiness{lastAdvance: time.Now()}
+	ctx := &httpServerCtx{config: &configOptions{Resume: true}}
+	ctx.buildServer()
+	get := func(path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		ctx.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec
+	}
+	readyState.directReads(true)
+	if rec := get("/readyz"); rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), "direct reads in progress") {
+		t.Fatalf("Expected not ready during direct reads: %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := get("/healthz"); rec.Code != 200 {
+		t.Fatalf("Expected alive during direct reads but got %d", rec.Code)
+	}
+	readyState.directReads(false)
+	readyState.progress(10, 5)
+	if rec := get("/readyz"); rec.Code != 200 {
+		t.Fatalf("Expected ready but got %d %s", rec.Code, rec.Body.String())
+	}
+	readyState.lastAdvance = time.Now().Add(-2 * resumeStallTimeout)
+	readyState.progress(20, 5)
+	if _, err := readyState.check(); err == nil {
+		t.Fatalf("Expected a stalled resume timestamp")
+	}
+	readyState.progress(20, 20)
+	if _, err := readyState.check(); err != nil {
+		t.Fatalf("Expected the resume timestamp to advance: %s", err)
+	}
+}
+
+func TestStatsdExport(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	client, err := newStatsdClient(pc.LocalAddr().String(), "monstache.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMetrics()
+	m.statsd = client
+	op := &gtm.Op{Id: "1", Namespace: "db.col", Operation: "i"}
+	m.eventRead(op)
+	m.eventRead(op)
+	m.bulkFailed("a,b", "mapping")
+	m.replicationLag("db.col", 3*time.Second)
+	m.statsd.timing("bulk_request_duration", 1500*time.Microsecond, "bulk:monstache")
+	if err := client.flush(); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, statsdMaxPacket)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(buf[:n]), "\n")
+	expected := map[string]bool{
+		"monstache.bulk_request_duration:1.5|ms|#bulk:monstache":  true,
+		"monstache.events_read:2|c|#namespace:db.col,operation:i": true,
+		"monstache.bulk_failures:1|c|#index:a_b,class:mapping":    true,
+		"monstache.replication_lag_seconds:3|g|#namespace:db.col": true,
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d lines but got %v", len(expected), lines)
+	}
+	for _, line := range lines {
+		if !expected[line] {
+			t.Fatalf("Unexpected line %s in %v", line, lines)
+		}
+	}
+	if len(client.counters) != 0 {
+		t.Fatalf("Expected counters to reset after a flush")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monstache-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	config := &configOptions{AuditFile: path}
+	if audit, err = config.newAuditLog(nil); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { audit = nil }()
+	insert := &gtm.Op{Id: "1", Namespace: "db.col", Operation: "i", Timestamp: bson.MongoTimestamp(7<<32 | 1)}
+	remove := &gtm.Op{Id: "2", Namespace: "db.col", Operation: "d"}
+	ok := elastic.NewBulkIndexRequest().Index("col").Id("1")
+	failed := elastic.NewBulkDeleteRequest().Index("col").Id("2")
+	audit.enqueue(insert, "col", ok)
+	audit.enqueue(remove, "col", failed)
+	afterBulk(nil, []elastic.BulkableRequest{ok, failed}, &elastic.BulkResponse{
+		Items: []map[string]*elastic.BulkResponseItem{
+			{"index": {Index: "col", Id: "1", Status: 201}},
+			{"delete": {Index: "col", Id: "2", Status: 403, Error: &elastic.ErrorDetails{Type: "cluster_block_exception", Reason: "read only"}}},
+		},
+	}, nil)
+	audit.close()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 audit entries but got %v", lines)
+	}
+	var first, second auditEntry
+	json.Unmarshal([]byte(lines[0]), &first)
+	json.Unmarshal([]byte(lines[1]), &second)
+	if first.ID != "1" || first.Action != "index" || first.Outcome != "ok" || first.Status != 201 || first.ResumeTs != "7:1" {
+		t.Fatalf("Unexpected audit entry %+v", first)
+	}
+	if second.Action != "delete" || second.Outcome != "failed" || second.Error != "cluster_block_exception: read only" {
+		t.Fatalf("Unexpected audit entry %+v", second)
+	}
+	if _, pending := audit.pending.Load(ok); pending {
+		t.Fatalf("Expected audited requests to be done")
+	}
+}
+
+func TestDocumentDump(t *testing.T) {
+	var buf bytes.Buffer
+	out := traceLog.Writer()
+	traceLog.SetOutput(&buf)
+	defer traceLog.SetOutput(out)
+	docDumps = newDocumentDumper(&configOptions{DebugDocumentIds: stringargs{"1"}})
+	defer func() { docDumps = nil }()
+	sampled := &gtm.Op{Id: "1", Namespace: "db.col", Operation: "i", Data: map[string]interface{}{"a": 1}}
+	skipped := &gtm.Op{Id: "2", Namespace: "db.col", Operation: "i", Data: map[string]interface{}{"a": 2}}
+	for _, op := range []*gtm.Op{sampled, skipped} {
+		if docDumps.start(op) {
+			docDumps.dump(op, "before mapping", op.Data)
+			docDumps.action(op, elastic.NewBulkIndexRequest().Index("col").Id(op.Id.(string)).Doc(op.Data))
+			docDumps.finish(op)
+		}
+	}
+	text := buf.String()
+	if !strings.Contains(text, `before mapping: {"a":1}`) {
+		t.Fatalf("Expected document dump but got %s", text)
+	}
+	if !strings.Contains(text, `bulk action: {"index":{"_index":"col","_id":"1"}}`) {
+		t.Fatalf("Expected bulk action dump but got %s", text)
+	}
+	if strings.Contains(text, "Document 2") {
+		t.Fatalf("Expected unsampled document to be skipped but got %s", text)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	received := make(chan map[string]interface{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		body["path"] = r.URL.Path
+		received <- body
+	}))
+	defer server.Close()
+	notifications = newNotifier(&configOptions{
+		NotifyWebhooks: []notifyWebhook{
+			{URL: server.URL + "/json"},
+			{URL: server.URL + "/slack", Format: "slack", Events: []string{notifyPluginPanic}},
+		},
+		NotifyRateLimit: 300,
+		ResumeName:      "default",
+	})
+	defer func() { notifications = nil }()
+	notifications.bulkOutcome(2)
+	payload := <-received
+	if payload["path"] != "/json" || payload["event"] != notifyBulkFailure || payload["status"] != "firing" {
+		t.Fatalf("Expected a bulk failure notification but got %v", payload)
+	}
+	op := &gtm.Op{Id: "1", Namespace: "db.col"}
+	for i := 0; i < 3; i++ {
+		err := callPlugin("map", op, func() error {
+			panic("boom")
+		})
+		if err == nil || !strings.Contains(err.Error(), "boom") {
+			t.Fatalf("Expected plugin panic to be returned as an error but got %v", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		payload = <-received
+		if payload["path"] == "/slack" {
+			if text, _ := payload["text"].(string); !strings.Contains(text, "Quarantined document 1 in db.col") {
+				t.Fatalf("Expected a slack message but got %v", payload)
+			}
+		} else if payload["event"] != notifyPluginPanic {
+			t.Fatalf("Expected a plugin panic notification but got %v", payload)
+		}
+	}
+	notifications.bulkOutcome(0)
+	payload = <-received
+	if payload["event"] != notifyBulkFailure || payload["status"] != "resolved" {
+		t.Fatalf("Expected a resolved bulk failure notification but got %v", payload)
+	}
+	select {
+	case payload = <-received:
+		t.Fatalf("Expected repeated notifications to be rate limited but got %v", payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if !isResumeGap(&mgo.QueryError{Code: 286, Message: "history lost"}) || isResumeGap(errors.New("timeout")) {
+		t.Fatalf("Expected only lost change stream history to be a resume gap")
+	}
+}
+
+func TestPprofAuth(t *testing.T) {
+	ctx := &httpServerCtx{config: &configOptions{Pprof: true, PprofUser: "ops", PprofPassword: "secret"}}
+	ctx.buildServer()
+	get := func(user, password string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/debug/pprof/cmdline", nil)
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		ctx.httpServer.Handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := get("", ""); code != http.StatusUnauthorized {
+		t.Fatalf("Expected pprof to require auth but got %d", code)
+	}
+	if code := get("ops", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("Expected a wrong password to be rejected but got %d", code)
+	}
+	if code := get("ops", "secret"); code != 200 {
+		t.Fatalf("Expected pprof to be served with valid auth but got %d", code)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	config := &configOptions{}
+	reloader, _ := newConfigReloader(config)
+	defer setVerbose(false)
+	ctx := &httpServerCtx{config: config, reloader: reloader}
+	ctx.buildServer()
+	rec := httptest.NewRecorder()
+	ctx.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest("PUT", "/log-level", strings.NewReader(`{"verbose": true}`)))
+	if rec.Code != 200 || !verbose() || reloader.options().Debug {
+		t.Fatalf("Expected verbose logging to be enabled: %d %s", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	ctx.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/log-level", nil))
+	if strings.TrimSpace(rec.Body.String()) != `{"verbose":true,"debug":false}` {
+		t.Fatalf("Expected the current log level but got %s", rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	ctx.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest("PUT", "/log-level", strings.NewReader(`verbose`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an invalid log level to be rejected but got %d", rec.Code)
+	}
+}
+
+func TestSupportBundle(t *testing.T) {
+	go func() {
+		req := <-statusReqC
+		req.responseC <- &statusResponse{enabled: true, lastTs: bson.MongoTimestamp(1700000000 << 32)}
+	}()
+	recentErrors.Write([]byte("ERROR 2026/01/01 00:00:00 bulk failed\n"))
+	ctx := &httpServerCtx{config: &configOptions{ResumeName: "default", ElasticPassword: "secret"}}
+	var buf bytes.Buffer
+	if err := ctx.writeSupportBundle(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(r)
+		r.Close()
+		files[f.Name] = string(data)
+	}
+	if strings.Contains(files["config.json"], "secret") || !strings.Contains(files["config.json"], redact) {
+		t.Fatalf("Expected credentials to be redacted but got %s", files["config.json"])
+	}
+	if !strings.Contains(files["resume.json"], `"lastTs": 7301444403200000000`) {
+		t.Fatalf("Expected the last timestamp read but got %s", files["resume.json"])
+	}
+	if !strings.Contains(files["errors.log"], "bulk failed") {
+		t.Fatalf("Expected recent errors but got %s", files["errors.log"])
+	}
+	if !strings.Contains(files["goroutines.txt"], "TestSupportBundle") || !strings.Contains(files["build.json"], version) {
+		t.Fatalf("Expected goroutines and build info in the bundle")
+	}
+}
+
+func TestIndexLane(t *testing.T) {
+	op := &gtm.Op{Id: bson.ObjectIdHex("5c4f5e3d2f9d1a0001a2b3c4"), Namespace: "db.col"}
+	lane := indexLane(op, 8)
+	if lane < 0 || lane >= 8 {
+		t.Fatalf("Expected a lane between 0 and 7 but got %d", lane)
+	}
+	same := &gtm.Op{Id: bson.ObjectIdHex("5c4f5e3d2f9d1a0001a2b3c4"), Namespace: "db.col", Operation: "d"}
+	if indexLane(same, 8) != lane {
+		t.Fatalf("Expected events of the same document to share a lane")
+	}
+	used := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		used[indexLane(&gtm.Op{Id: i, Namespace: "db.col"}, 8)] = true
+	}
+	if len(used) < 8 {
+		t.Fatalf("Expected documents to be spread over all lanes but used %d", len(used))
+	}
+}
+
+func TestCoalescer(t *testing.T) {
+	var out []*gtm.Op
+	var lock sync.Mutex
+	c := newCoalescer(&configOptions{CoalesceWindowMs: 50}, func(op *gtm.Op) {
+		lock.Lock()
+		defer lock.Unlock()
+		out = append(out, op)
+	})
+	for i := 0; i < 3; i++ {
+		c.add(&gtm.Op{Id: "hot", Namespace: "db.col", Operation: "u", Source: gtm.OplogQuerySource, Data: map[string]interface{}{"n": i}})
+	}
+	c.add(&gtm.Op{Id: "cold", Namespace: "db.col", Operation: "i", Source: gtm.OplogQuerySource, Data: map[string]interface{}{"n": 0}})
+	c.add(&gtm.Op{Id: "cold", Namespace: "db.col", Operation: "d", Source: gtm.OplogQuerySource})
+	lock.Lock()
+	if len(out) != 2 || out[0].Operation != "i" || out[1].Operation != "d" {
+		t.Fatalf("Expected a delete to pass on the held insert first but got %v", out)
+	}
+	lock.Unlock()
+	time.Sleep(200 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(out) != 3 || out[2].Data["n"] != 2 {
+		t.Fatalf("Expected the updates to be coalesced into the latest but got %v", out)
+	}
+}
+
+func TestStreamedDocumentJSON(t *testing.T) {
+	doc := map[string]interface{}{
+		"name":   "<b>\"quoted\"</b>\n\u2028\xff",
+		"count":  42,
+		"big":    int64(1) << 40,
+		"ratio":  0.000000125,
+		"huge":   1e22,
+		"ok":     true,
+		"none":   nil,
+		"when":   time.Date(2019, 1, 2, 3, 4, 5, 6000000, time.UTC),
+		"oid":    bson.ObjectIdHex("5c4f5e3d2f9d1a0001a2b3c4"),
+		"uuid":   bson.Binary{Kind: 0x04, Data: []byte("0123456789abcdef")},
+		"price":  bson.Decimal128{},
+		"ts":     bson.MongoTimestamp(7 << 32),
+		"nested": map[string]interface{}{"tags": []interface{}{"a", 1.5, map[string]interface{}{"z": "y"}}},
+	}
+	expected, err := json.Marshal(monstachemap.ConvertMapForJSON(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamed, err := json.Marshal(monstachemap.Document(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(streamed) != string(expected) {
+		t.Fatalf("Expected streamed JSON\n%s\nto equal\n%s", streamed, expected)
+	}
+	if _, err = json.Marshal(monstachemap.Document{"nan": math.NaN()}); err == nil {
+		t.Fatalf("Expected NaN to fail like encoding/json")
+	}
+}
+
+func TestMongoDriverOptions(t *testing.T) {
+	url, opts := splitDriverURLOptions("mongodb://a:27017,b:27017/db?replicaSet=rs0&socketTimeoutMS=5000&compressors=zstd,snappy&maxPoolSize=20")
+	if url != "mongodb://a:27017,b:27017/db?replicaSet=rs0&maxPoolSize=20" {
+		t.Fatalf("Expected driver options to be removed from the URL but got %s", url)
+	}
+	if opts["socketTimeoutMS"] != "5000" || opts["compressors"] != "zstd,snappy" {
+		t.Fatalf("Expected driver options to be returned but got %v", opts)
+	}
+	if url, _ = splitDriverURLOptions("mongodb://a/db?connectTimeoutMS=100"); url != "mongodb://a/db" {
+		t.Fatalf("Expected an empty query to be dropped but got %s", url)
+	}
+	config := &configOptions{MongoDialSettings: mongoDialSettings{MaxPoolSize: 50, MinPoolSize: 5, ReadPreference: "secondaryPreferred"}}
+	dialInfo, err := mgo.ParseURL("mongodb://a/db?maxPoolSize=20")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = config.applyPoolSettings(dialInfo, "mongodb://a/db?maxPoolSize=20"); err != nil {
+		t.Fatal(err)
+	}
+	if dialInfo.PoolLimit != 20 || dialInfo.MinPoolSize != 5 || dialInfo.ReadPreference.Mode != mgo.SecondaryPreferred {
+		t.Fatalf("Expected URL options to override the dial settings: %+v", dialInfo)
+	}
+	if _, err = parseReadPreference("fastest"); err == nil {
+		t.Fatalf("Expected an invalid read preference to be rejected")
+	}
+}
+
+func TestBulkSizer(t *testing.T) {
+	config := &configOptions{
+		ElasticMaxBytes:      1000,
+		AdaptiveBulkMinBytes: 100,
+		AdaptiveBulkTargetMs: 1000,
+		IndexWorkers:         4,
+	}
+	bs := newBulkSizer(config, nil)
+	bs.started(1)
+	bs.finished(1, true)
+	if bs.size != 500 || bs.allowed != 2 {
+		t.Fatalf("Expected rejection to shrink the bulk size and workers: %d %d", bs.size, bs.allowed)
+	}
+	bs.starts.Store(int64(2), time.Now().Add(-2*time.Second))
+	bs.finished(2, false)
+	if bs.size != 250 || bs.allowed != 1 {
+		t.Fatalf("Expected slow bulk to shrink the bulk size and workers: %d %d", bs.size, bs.allowed)
+	}
+	bs.finished(3, false)
+	for i := int64(4); i < 20; i++ {
+		bs.started(i)
+		bs.finished(i, false)
+	}
+	if bs.size != 1000 || bs.allowed != 4 {
+		t.Fatalf("Expected fast bulks to grow the bulk size and workers: %d %d", bs.size, bs.allowed)
+	}
+	bs.size = 50
+	bs.starts.Store(int64(20), time.Now().Add(-2*time.Second))
+	bs.finished(20, false)
+	if bs.size != 100 {
+		t.Fatalf("Expected bulk size not below the minimum: %d", bs.size)
+	}
+	var none *bulkSizer
+	none.acquire()
+	none.release()
+	none.started(1)
+	none.finished(1, true)
+}
+
+func TestSpillQueue(t *testing.T) {
+	q, err := newSpillQueue(os.TempDir(), 64, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []*gtm.Op
+	for i := 0; i < 5; i++ {
+		op := &gtm.Op{
+			Id:        i,
+			Operation: "i",
+			Namespace: "db.col",
+			Data:      map[string]interface{}{"_id": i, "name": strings.Repeat("x", 20)},
+		}
+		ops = append(ops, op)
+		q.push(op)
+	}
+	if q.spilled == 0 {
+		t.Fatalf("Expected events over the memory budget to be spilled")
+	}
+	if ops[4].Data != nil {
+		t.Fatalf("Expected the payload of a spilled event to be released")
+	}
+	q.close()
+	for i := 0; i < 5; i++ {
+		op, ok := q.pop()
+		if !ok {
+			t.Fatalf("Expected event %d", i)
+		}
+		if op != ops[i] {
+			t.Fatalf("Expected events in order")
+		}
+		if op.Data["_id"] != i || op.Data["name"] != strings.Repeat("x", 20) {
+			t.Fatalf("Expected payload of event %d to be restored: %v", i, op.Data)
+		}
+	}
+	if q.spilled != 0 || q.used != 0 {
+		t.Fatalf("Expected queue to be drained")
+	}
+	if _, ok := q.pop(); ok {
+		t.Fatalf("Expected closed queue to be empty")
+	}
+}
+
+func TestEncodeFile(t *testing.T) {
+	data := []byte(strings.Repeat("monstache", 100))
+	content, err := encodeFile(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content != base64.StdEncoding.EncodeToString(data) {
+		t.Fatalf("Expected file content to be base64 encoded")
+	}
+	chunks, err := encodeFileChunks(bytes.NewReader(data), int64(len(data)), 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 {
+		t.Fatalf("Expected 3 chunks but got %d", len(chunks))
+	}
+	var decoded []byte
+	for _, chunk := range chunks {
+		b, err := base64.StdEncoding.DecodeString(chunk["data"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded = append(decoded, b...)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Fatalf("Expected chunks to decode to the file content")
+	}
+	chunks, err = encodeFileChunks(bytes.NewReader(nil), 0, 400)
+	if err != nil || len(chunks) != 0 {
+		t.Fatalf("Expected no chunks for an empty file")
+	}
+}
+
+func TestDirectReadScheduler(t *testing.T) {
+	config := &configOptions{
+		DirectReadBudget: 2,
+		DirectReadPriorities: []directReadPriority{
+			{Namespace: "db.high", Priority: 3},
+		},
+	}
+	s := newDirectReadScheduler(config)
+	s.waiting["db.high"] = 1
+	s.waiting["db.low"] = 1
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		ns := s.next()
+		counts[ns]++
+		s.served[ns] += 1 / s.weight(ns)
+	}
+	if counts["db.high"] != 6 || counts["db.low"] != 2 {
+		t.Fatalf("Expected namespaces served by priority: %v", counts)
+	}
+	s = newDirectReadScheduler(config)
+	a := &gtm.Op{Namespace: "db.low"}
+	b := &gtm.Op{Namespace: "db.low"}
+	s.acquire(a)
+	s.acquire(b)
+	if s.ready("db.low") {
+		t.Fatalf("Expected budget to be exhausted")
+	}
+	s.done(a)
+	s.done(a)
+	if s.inflight != 1 {
+		t.Fatalf("Expected budget to be returned once: %d", s.inflight)
+	}
+	s.waiting["db.low"] = 1
+	if !s.ready("db.low") {
+		t.Fatalf("Expected budget to be available")
+	}
+	s = newDirectReadScheduler(&configOptions{DirectReadRate: 1})
+	s.acquire(a)
+	s.waiting["db.low"] = 1
+	if s.ready("db.low") {
+		t.Fatalf("Expected rate to be exhausted")
+	}
+	var none *directReadScheduler
+	none.acquire(a)
+	none.done(a)
+}
+
+func TestLookupBatcher(t *testing.T) {
+	var queries int32
+	b := monstachemap.NewBatcher(nil, 20*time.Millisecond, 0)
+	b.Query = func(db, col, field string, values []interface{}) ([]map[string]interface{}, error) {
+		atomic.AddInt32(&queries, 1)
+		if db != "db" || col != "users" || field != "account.id" {
+			t.Errorf("Unexpected lookup of %s.%s by %s", db, col, field)
+		}
+		var docs []map[string]interface{}
+		for _, v := range values {
+			docs = append(docs, map[string]interface{}{
+				"account": map[string]interface{}{"id": int64(v.(int))},
+			})
+		}
+		return docs, nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			doc, err := b.FindOne("db", "users", "account.id", id%5)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if doc == nil {
+				t.Errorf("Expected document for id %d", id%5)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Fatalf("Expected lookups to be batched into 1 query but got %d", n)
+	}
+	b.MaxBatch = 1
+	if doc, err := b.FindOne("db", "users", "account.id", 7); err != nil || doc == nil {
+		t.Fatalf("Expected full batch to be queried at once")
+	}
+}
+
+func TestDiskCompression(t *testing.T) {
+	q, err := newSpillQueue(os.TempDir(), 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := &gtm.Op{
+		Id:        1,
+		Namespace: "db.col",
+		Data:      map[string]interface{}{"_id": 1, "text": strings.Repeat("monstache ", 1000)},
+	}
+	q.push(op)
+	if q.writeOff >= 1000 {
+		t.Fatalf("Expected spilled event to be compressed: %d bytes", q.writeOff)
+	}
+	q.close()
+	if op, _ = q.pop(); op.Data["text"] != strings.Repeat("monstache ", 1000) {
+		t.Fatalf("Expected compressed event to be restored")
+	}
+	plain := []byte("{}\n")
+	if b, err := decompressDisk(plain); err != nil || !bytes.Equal(b, plain) {
+		t.Fatalf("Expected uncompressed data to be read unchanged")
+	}
+	frames := append(zstdEncoder.EncodeAll([]byte("a\n"), nil), zstdEncoder.EncodeAll([]byte("b\n"), nil)...)
+	if b, err := decompressDisk(frames); err != nil || string(b) != "a\nb\n" {
+		t.Fatalf("Expected appended frames to be read as a whole: %q %v", b, err)
+	}
+}
+
+func TestCursorSettings(t *testing.T) {
+	config := &configOptions{GtmSettings: gtmDefaultSettings()}
+	text := `
+[gtm-settings]
+change-stream-batch-size = 50
+max-await-secs = 2
+`
+	if _, err := toml.Decode(text, config); err != nil {
+		t.Fatal(err)
+	}
+	if config.GtmSettings.ChangeStreamBatchSize != 50 || config.GtmSettings.MaxAwaitSecs != 2 {
+		t.Fatalf("Expected cursor settings to be loaded: %+v", config.GtmSettings)
+	}
+	if config.GtmSettings.BufferSize != 32 {
+		t.Fatalf("Expected other gtm settings to keep their defaults: %+v", config.GtmSettings)
+	}
+	config.GtmSettings.MaxAwaitSecs = -1
+	defer func() {
+		if r := recover(); !strings.Contains(fmt.Sprint(r), "max await") {
+			t.Fatalf("Expected negative max await to be rejected but got %v", r)
+		}
+	}()
+	config.validate()
+}
+
+func TestNamespaceCursors(t *testing.T) {
+	config := &configOptions{GtmSettings: gtmDefaultSettings()}
+	text := `
+[gtm-settings]
+change-stream-batch-size = 100
+max-await-secs = 5
+
+[[namespace-cursor]]
+namespace = "db.a"
+batch-size = 10
+max-await-secs = 1
+
+[[namespace-cursor]]
+namespace = "db.b"
+batch-size = 1000
+no-timeout = true
+
+[[namespace-cursor]]
+namespace = "db.unused"
+batch-size = 1
+`
+	if _, err := toml.Decode(text, config); err != nil {
+		t.Fatal(err)
+	}
+	for ns, expected := range map[string]namespaceCursor{
+		"db.a": {Namespace: "db.a", BatchSize: 10, MaxAwaitSecs: 1},
+		"db.b": {Namespace: "db.b", BatchSize: 1000, MaxAwaitSecs: 5, NoTimeout: true},
+		"db.c": {Namespace: "db.c", BatchSize: 100, MaxAwaitSecs: 5},
+	} {
+		if cursor := config.cursorFor(ns); cursor != expected {
+			t.Fatalf("Expected cursor settings %+v of %s but got %+v", expected, ns, cursor)
+		}
+	}
+	opts := &gtm.Options{
+		OpLogDisabled:  true,
+		MaxWaitSecs:    5,
+		ChangeStreamNs: []string{"db.a", "db.b", "db.c"},
+		DirectReadNs:   []string{"db.b", "db.d"},
+	}
+	split, cursors := config.cursorOptions(opts)
+	if len(split) != 3 || len(cursors) != 3 {
+		t.Fatalf("Expected a context for the remaining namespaces and each namespace cursor in use but got %d", len(split))
+	}
+	main, a, b := split[0], split[1], split[2]
+	if strings.Join(main.ChangeStreamNs, ",") != "db.c" || strings.Join(main.DirectReadNs, ",") != "db.d" || main.MaxWaitSecs != 5 {
+		t.Fatalf("Expected the remaining namespaces to keep the global settings: %+v", main)
+	}
+	if strings.Join(a.ChangeStreamNs, ",") != "db.a" || len(a.DirectReadNs) != 0 || a.MaxWaitSecs != 1 || cursors[1].BatchSize != 10 {
+		t.Fatalf("Expected the change stream of db.a to have its own settings: %+v %+v", a, cursors[1])
+	}
+	if strings.Join(b.ChangeStreamNs, ",") != "db.b" || strings.Join(b.DirectReadNs, ",") != "db.b" ||
+		b.MaxWaitSecs != 5 || !b.DirectReadNoTimeout || cursors[2].BatchSize != 1000 {
+		t.Fatalf("Expected the change stream and direct reads of db.b to have their own settings: %+v %+v", b, cursors[2])
+	}
+	if len(opts.ChangeStreamNs) != 3 || len(opts.DirectReadNs) != 2 {
+		t.Fatalf("Expected the options to be split into copies")
+	}
+}
+
+func TestPrecompiledMatchers(t *testing.T) {
+	doc := map[string]interface{}{
+		"org": "acme",
+		"n":   3,
+		"loc": map[string]interface{}{"region": "eu"},
+	}
+	for _, re := range []routingExpr{
+		{Field: "loc.region"},
+		{Field: "missing"},
+		{Template: "{org}-{loc.region}"},
+		{Template: "x{n}y{org}z"},
+		{Template: "{org}{missing}"},
+		{Template: "static"},
+	} {
+		r1, err1 := re.eval(doc)
+		re.compile()
+		r2, err2 := re.eval(doc)
+		if (err1 == nil) != (err2 == nil) || (err1 == nil && r1 != r2) {
+			t.Fatalf("Expected compiled routing %+v to match: %q %v, %q %v", re, r1, err1, r2, err2)
+		}
+	}
+	var nf namespaceFilter
+	if err := nf.set(&configOptions{NsRegex: "^db\\.a$"}); err != nil {
+		t.Fatal(err)
+	}
+	op := &gtm.Op{Namespace: "db.a", Operation: "i"}
+	if !nf.match(op) || !nf.match(op) {
+		t.Fatalf("Expected namespace to match")
+	}
+	if nf.match(&gtm.Op{Namespace: "db.b", Operation: "i"}) {
+		t.Fatalf("Expected namespace not to match")
+	}
+	if err := nf.set(&configOptions{NsRegex: "^db\\.b$"}); err != nil {
+		t.Fatal(err)
+	}
+	if nf.match(op) {
+		t.Fatalf("Expected cached decision to be reset with the regexes")
+	}
+}
+
+func TestBulkItemCallbacks(t *testing.T) {
+	var outcomes []string
+	record := func(item *elastic.BulkResponseItem, err error) {
+		if err != nil {
+			outcomes = append(outcomes, err.Error())
+		} else {
+			outcomes = append(outcomes, fmt.Sprint(item.Status))
+		}
+	}
+	ok := elastic.NewBulkIndexRequest().Index("a").Id("1").Doc(map[string]interface{}{})
+	failed := elastic.NewBulkIndexRequest().Index("a").Id("2").Doc(map[string]interface{}{})
+	onBulkItem(ok, record)
+	onBulkItem(failed, record)
+	onBulkItem(rawBulkRequest{}, record)
+	response := &elastic.BulkResponse{
+		Items: []map[string]*elastic.BulkResponseItem{
+			{"index": {Index: "a", Id: "1", Status: 201}},
+			{"index": {Index: "a", Id: "2", Status: 409}},
+		},
+	}
+	afterBulk(nil, []elastic.BulkableRequest{ok, failed}, response, nil)
+	afterBulk(nil, []elastic.BulkableRequest{ok}, response, nil)
+	if strings.Join(outcomes, ",") != "201,409" {
+		t.Fatalf("Expected each callback to be told its outcome once: %v", outcomes)
+	}
+	outcomes = nil
+	onBulkItem(ok, record)
+	afterBulk(nil, []elastic.BulkableRequest{ok}, nil, errors.New("unavailable"))
+	if len(outcomes) != 0 {
+		t.Fatalf("Expected no outcome while the bulk processor retries the request: %v", outcomes)
+	}
+	bulkState.set(true)
+	defer bulkState.set(false)
+	afterBulk(nil, []elastic.BulkableRequest{ok}, nil, errors.New("unavailable"))
+	if strings.Join(outcomes, ",") != "unavailable" {
+		t.Fatalf("Expected callback to be told the bulk request error: %v", outcomes)
+	}
+	outcomes = nil
+	unsent := elastic.NewBulkIndexRequest().Index("a").Id("3").Doc(map[string]interface{}{})
+	onBulkItem(unsent, record)
+	addBulkRequest(&configOptions{DisableElasticsearch: true}, nil, nil, "a", unsent)
+	invalid := elastic.NewBulkIndexRequest().Index("a").Id("4").Doc(map[string]interface{}{"c": make(chan int)})
+	onBulkItem(invalid, record)
+	addBulkRequest(&configOptions{}, nil, nil, "a", invalid)
+	_, leaked := bulkCallbacks.Load(unsent)
+	if _, pending := bulkCallbacks.Load(invalid); leaked || pending || len(outcomes) != 1 {
+		t.Fatalf("Expected the callbacks of requests which are not sent to be released: %v", outcomes)
+	}
+}
+
+func TestBulkErrorPolicyDefaults(t *testing.T) {
+	config := &configOptions{
+		BulkError:               []bulkErrorPolicy{{Class: "mapping", Action: "drop"}},
+		ElasticMaxConns:         1,
+		ElasticMaxDocs:          -1,
+		ElasticMaxBytes:         1 << 20,
+		ElasticMaxContentLength: elasticMaxContentLengthDefault,
+	}
+	config.loadBulkErrorPolicies()
+	defer func() {
+		delete(bulkErrorPolicies, "mapping")
+		defaultBulkErrorPolicy = nil
+	}()
+	var requests int32
+	client := newTestElasticClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if atomic.AddInt32(&requests, 1) == 1 {
+			fmt.Fprint(w, `{"took":1,"errors":true,"items":[{"index":{"_index":"a","_id":"1","status":429,`+
+				`"error":{"type":"es_rejected_execution_exception"}}}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"took":1,"errors":false,"items":[{"index":{"_index":"a","_id":"1","status":201}}]}`)
+	})
+	bulk, err := config.newBulkProcessor(client)
+	if err != nil {
+		t.Fatalf("Unable to start bulk processor: %s", err)
+	}
+	defer delete(bulkRequestLimits, bulk)
+	defer bulk.Stop()
+	outcome := make(chan int, 1)
+	req := elastic.NewBulkIndexRequest().Index("a").Type("_doc").Id("1").Doc(map[string]interface{}{})
+	onBulkItem(req, func(item *elastic.BulkResponseItem, err error) {
+		outcome <- item.Status
+	})
+	addBulkRequest(config, bulk, &gtm.Op{Id: "1", Namespace: "db.a"}, "a", req)
+	timeout := time.After(5 * time.Second)
+	for {
+		bulk.Flush()
+		select {
+		case status := <-outcome:
+			if status != 201 || atomic.LoadInt32(&requests) != 2 {
+				t.Fatalf("Expected the rejected item to be retried and indexed but got %d after %d requests", status, requests)
+			}
+			return
+		case <-timeout:
+			t.Fatalf("Expected the rejected item to be retried without a policy for its class")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func TestReferenceEnrichment(t *testing.T) {
+	defer func() {
+		references = nil
+		delete(enrichments, "db.posts")
+	}()
+	config := &configOptions{
+		Reference: []referenceCollection{{Namespace: "db.tags", Key: "code"}},
+		Enrich: []enrichment{
+			{Namespace: "db.posts", Reference: "db.tags", Field: "tag_codes", Target: "tags", Fields: []string{"name"}},
+			{Namespace: "db.posts", Reference: "db.tags", Field: "main", Target: "main_tag"},
+		},
+	}
+	config.loadReferences()
+	config.loadEnrichments()
+	c := references.collections["db.tags"]
+	references.reset(c)
+	references.put(c, map[string]interface{}{"_id": 1, "code": "go", "name": "Go"})
+	references.put(c, map[string]interface{}{"_id": 2, "code": "es", "name": "Elasticsearch", "meta": bson.M{"a": 1}})
+	references.apply(c, &referenceChange{
+		OperationType: "update",
+		FullDocument:  map[string]interface{}{"_id": int64(1), "code": "golang", "name": "Golang"},
+	})
+	if references.Get("db.tags", "go") != nil || references.Get("db.tags", "golang") == nil {
+		t.Fatalf("Expected updated reference to be cached by its new key")
+	}
+	op := &gtm.Op{
+		Namespace: "db.posts",
+		Data: map[string]interface{}{
+			"tag_codes": []interface{}{"golang", "missing", "es"},
+			"main":      "es",
+		},
+	}
+	enrichDocument(op)
+	tags, _ := op.Data["tags"].([]interface{})
+	if len(tags) != 2 || tags[0].(map[string]interface{})["name"] != "Golang" || len(tags[1].(map[string]interface{})) != 1 {
+		t.Fatalf("Expected projected reference documents but got %v", op.Data["tags"])
+	}
+	main := op.Data["main_tag"].(map[string]interface{})
+	main["meta"].(map[string]interface{})["a"] = 2
+	if references.Get("db.tags", "es")["meta"].(bson.M)["a"] != 1 {
+		t.Fatalf("Expected cached reference document to be copied")
+	}
+	references.apply(c, &referenceChange{OperationType: "delete", DocumentKey: map[string]interface{}{"_id": 2}})
+	if references.Get("db.tags", "es") != nil {
+		t.Fatalf("Expected deleted reference to be removed")
+	}
+	var none *referenceCache
+	if none.Get("db.tags", "go") != nil {
+		t.Fatalf("Expected no references")
+	}
+}
+
+func TestSyncPause(t *testing.T) {
+	var paused syncPause
+	op := func(ns string, ts bson.MongoTimestamp) *gtm.Op {
+		return &gtm.Op{Namespace: ns, Timestamp: ts, Source: gtm.OplogQuerySource}
+	}
+	paused.pause("db.a")
+	for i, ns := range []string{"db.a", "db.b", "db.a"} {
+		if o := op(ns, bson.MongoTimestamp(10+i)); paused.holds(o) {
+			paused.hold(o)
+		}
+	}
+	if status := paused.status(); status.Held != 2 || status.Paused || len(status.Namespaces) != 1 {
+		t.Fatalf("Expected only events of db.a to be held: %+v", status)
+	}
+	if ts := paused.checkpoint(20); ts != 9 {
+		t.Fatalf("Expected the checkpoint to stop before the first held event but got %d", ts)
+	}
+	paused.pause("")
+	if !paused.holds(op("db.c", 30)) {
+		t.Fatalf("Expected a global pause to hold every namespace")
+	}
+	if released := paused.resume("db.a"); len(released) != 0 {
+		t.Fatalf("Expected held events to stay held during a global pause")
+	}
+	released := paused.resume("")
+	if len(released) != 2 || released[0].Timestamp != 10 || released[1].Timestamp != 12 {
+		t.Fatalf("Expected held events to be released in order: %v", released)
+	}
+	if ts := paused.checkpoint(20); ts != 20 {
+		t.Fatalf("Expected the checkpoint to advance after resuming but got %d", ts)
+	}
+	ctx := &httpServerCtx{config: &configOptions{AdminUser: "ops", AdminPassword: "secret"}}
+	ctx.buildServer()
+	rec := httptest.NewRecorder()
+	ctx.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest("POST", "/pause", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected pause to require auth but got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/resume", nil)
+	req.SetBasicAuth("ops", "secret")
+	ctx.httpServer.Handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected resume to require POST but got %d", rec.Code)
+	}
+}
+
+func TestResyncEndpoint(t *testing.T) {
+	ctx := &httpServerCtx{config: &configOptions{AdminUser: "ops", AdminPassword: "secret"}}
+	ctx.buildServer()
+	post := func(query, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/resync"+query, strings.NewReader(body))
+		req.SetBasicAuth("ops", "secret")
+		ctx.httpServer.Handler.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := post("?namespace=db", ""); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected a namespace without a collection to be rejected but got %d", rec.Code)
+	}
+	if rec := post("?namespace=db.col", "{bad"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected an invalid filter to be rejected but got %d", rec.Code)
+	}
+	defer func() { resyncs = nil }()
+	resyncs = nil
+	if rec := post("?namespace=db.col", `{"status": "active"}`); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected resync to be unavailable before syncing starts but got %d", rec.Code)
+	}
+	resyncs = newResyncer(nil, &gtm.Options{}, &configOptions{})
+	running := &resyncJob{namespace: "db.col", doneC: make(chan struct{})}
+	resyncs.active["db.col"] = running
+	if rec := post("?namespace=db.col", ""); rec.Code != http.StatusConflict {
+		t.Fatalf("Expected a second resync of a namespace to be rejected but got %d", rec.Code)
+	}
+	running.read = 3
+	running.err = errors.New("cursor killed")
+	close(running.doneC)
+	if p := running.progress(); !p.Done || p.Read != 3 || p.Error != "cursor killed" {
+		t.Fatalf("Expected the final progress of the resync: %+v", p)
+	}
+}
+
+func TestSyncStatus(t *testing.T) {
+	defer func() { syncStatus = nil }()
+	syncStatus = newSyncStatusTracker(nil)
+	ts := bson.MongoTimestamp(time.Now().Add(-5*time.Second).Unix() << 32)
+	oplog := &gtm.Op{Namespace: "db.col", Operation: "i", Timestamp: ts, Source: gtm.OplogQuerySource}
+	direct := &gtm.Op{Namespace: "db.col", Operation: "i", Source: gtm.DirectQuerySource}
+	syncStatus.startEvent(oplog)
+	syncStatus.startEvent(direct)
+	if st := syncStatus.snapshot()["db.col"]; st.Pending != 2 || st.DirectRead == nil || st.DirectRead.Read != 1 {
+		t.Fatalf("Expected two pending events and one direct read: %+v", st)
+	}
+	syncStatus.finishEvent(oplog, nil)
+	syncStatus.finishEvent(direct, errors.New("mapping failed"))
+	syncStatus.finishEvent(direct, nil)
+	st := syncStatus.snapshot()["db.col"]
+	if st.Pending != 0 || st.LastAppliedTs != ts || st.LagSeconds < 4 || st.LastError != "mapping failed" {
+		t.Fatalf("Expected the applied event, lag and error to be recorded: %+v", st)
+	}
+	req := elastic.NewBulkIndexRequest()
+	syncStatus.enqueue(&gtm.Op{Namespace: "db.other"}, req)
+	bulkItemDone(req, &elastic.BulkResponseItem{Status: 400, Error: &elastic.ErrorDetails{Type: "mapper_parsing_exception", Reason: "bad"}}, nil)
+	if st := syncStatus.snapshot()["db.other"]; st.LastError != "mapper_parsing_exception: bad" {
+		t.Fatalf("Expected the bulk failure to be recorded: %+v", st)
+	}
+	rec := httptest.NewRecorder()
+	ctx := &httpServerCtx{config: &configOptions{}}
+	ctx.buildServer()
+	ctx.httpServer.Handler.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"db.other"`) {
+		t.Fatalf("Expected the status of each namespace: %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestWaitUntil(t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	if !waitUntil(deadline, func() {}) {
+		t.Fatalf("Expected finished workers to be drained")
+	}
+	block := make(chan bool)
+	defer close(block)
+	start := time.Now()
+	if waitUntil(time.Now().Add(50*time.Millisecond), func() { <-block }) {
+		t.Fatalf("Expected blocked workers not to be drained")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Expected the wait to end at the deadline")
+	}
+	config := &configOptions{}
+	config.setDefaults()
+	if config.DrainTimeoutSeconds != drainTimeoutSecondsDefault {
+		t.Fatalf("Expected the default drain timeout but got %d", config.DrainTimeoutSeconds)
+	}
+}
+
+func TestClusterLease(t *testing.T) {
+	config := &configOptions{ClusterName: "ha"}
+	config.setDefaults()
+	if config.ClusterLeaseSeconds != 30 || config.ClusterHeartbeatSeconds != 10 {
+		t.Fatalf("Expected the default lease and heartbeat: %+v", config)
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	sel, doc := clusterLease(config, 42, "host-a", now)
+	if sel["_id"] != "ha" || doc["_id"] != "ha" {
+		t.Fatalf("Expected the lease to be named after the cluster: %v %v", sel, doc)
+	}
+	or := sel["$or"].([]bson.M)
+	if len(or) != 2 || or[0]["leaseUntil"].(bson.M)["$lt"] != now || or[1]["pid"] != 42 || or[1]["host"] != "host-a" {
+		t.Fatalf("Expected an expired lease or one held by the process to be taken: %v", sel)
+	}
+	if doc["leaseUntil"] != now.Add(30*time.Second) {
+		t.Fatalf("Expected the lease to be held for the lease seconds: %v", doc)
+	}
+	config.ClusterHeartbeatSeconds = 30
+	defer func() {
+		if r := recover(); !strings.Contains(fmt.Sprint(r), "heartbeat") {
+			t.Fatalf("Expected a heartbeat as long as the lease to be rejected but got %v", r)
+		}
+	}()
+	config.validate()
+}
+
+func TestNamespacePartition(t *testing.T) {
+	var namespaces []string
+	for i := 0; i < 200; i++ {
+		namespaces = append(namespaces, fmt.Sprintf("db.col%d", i))
+	}
+	three := []string{"a", "b", "c"}
+	two := []string{"a", "b"}
+	owned := make(map[string]int)
+	for _, ns := range namespaces {
+		owner := partitionOwner(three, ns)
+		owned[owner]++
+		if after := partitionOwner(two, ns); owner != "c" && after != owner {
+			t.Fatalf("Expected %s to stay with %s when c leaves but it moved to %s", ns, owner, after)
+		}
+	}
+	for _, member := range three {
+		if owned[member] < 40 {
+			t.Fatalf("Expected namespaces to be spread across members: %v", owned)
+		}
+	}
+	p := &namespacePartition{member: "a", members: three}
+	mine := 0
+	for _, ns := range namespaces {
+		if p.owns(ns) {
+			mine++
+		}
+	}
+	if mine != owned["a"] {
+		t.Fatalf("Expected member a to own %d namespaces but it owns %d", owned["a"], mine)
+	}
+	if !p.owns("db") {
+		t.Fatalf("Expected database wide events to be applied by every member")
+	}
+	var nilPartition *namespacePartition
+	if !nilPartition.owns("db.col") {
+		t.Fatalf("Expected every namespace to be owned without partitioning")
+	}
+}
+
+func TestPipelineAlive(t *testing.T) {
+	if err := pipelineAlive(10 * time.Millisecond); err == nil {
+		t.Fatalf("Expected a stopped event loop not to be alive")
+	}
+	stop := make(chan bool)
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case req := <-statusReqC:
+				req.responseC <- nil
+			case <-stop:
+				return
+			}
+		}
+	}()
+	if err := pipelineAlive(time.Second); err != nil {
+		t.Fatalf("Expected a responsive event loop to be alive: %s", err)
+	}
+	depth, last := indexQueueDepth, atomic.LoadInt64(&lastIndexedAt)
+	defer func() {
+		indexQueueDepth = depth
+		atomic.StoreInt64(&lastIndexedAt, last)
+	}()
+	indexQueueDepth = func() int { return 5 }
+	atomic.StoreInt64(&lastIndexedAt, time.Now().Add(-2*resumeStallTimeout).UnixNano())
+	if err := pipelineAlive(time.Second); err == nil || !strings.Contains(err.Error(), "no progress") {
+		t.Fatalf("Expected stalled index workers not to be alive but got %v", err)
+	}
+}
+
+func TestServiceSubcommand(t *testing.T) {
+	command, rest, err := parseSubcommand([]string{"service", "install", "-f", "monstache.toml"})
+	if err != nil || command != "service install" || len(rest) != 2 || rest[1] != "monstache.toml" {
+		t.Fatalf("Expected the service action and its flags: %q %v %v", command, rest, err)
+	}
+	if _, _, err := parseSubcommand([]string{"service", "start"}); err == nil {
+		t.Fatalf("Expected an unknown service action to be rejected")
+	}
+	if runtime.GOOS != "windows" {
+		if err := startService(&configOptions{}); err == nil {
+			t.Fatalf("Expected services to be unsupported on %s", runtime.GOOS)
+		}
+		stopService(0)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	config := &configOptions{DryRun: true, IndexStats: true, KafkaSink: &kafkaSink{RestURL: "http://localhost:8082"}}
+	config.setDefaults()
+	if !config.DisableElasticsearch || config.IndexStats {
+		t.Fatalf("Expected a dry run not to write to Elasticsearch: %+v", config)
+	}
+	if config.NDJSONFile != "-" {
+		t.Fatalf("Expected a dry run to write bulk actions to stdout but got %q", config.NDJSONFile)
+	}
+	if names := config.sinkNames(); len(names) != 1 || names[0] != "ndjson" {
+		t.Fatalf("Expected a dry run to skip the sinks but got %v", names)
+	}
+	if err := saveTimestamp(nil, bson.MongoTimestamp(1), config); err != nil {
+		t.Fatalf("Expected a dry run not to save the resume timestamp: %s", err)
+	}
+	config = &configOptions{DryRun: true, NDJSONFile: "actions.ndjson"}
+	config.setDefaults()
+	if config.NDJSONFile != "actions.ndjson" {
+		t.Fatalf("Expected a dry run to keep the NDJSON file but got %q", config.NDJSONFile)
+	}
+	config.ClusterName = "ha"
+	defer func() {
+		if r := recover(); !strings.Contains(fmt.Sprint(r), "Dry run") {
+			t.Fatalf("Expected a dry run in a cluster to be rejected but got %v", r)
+		}
+	}()
+	config.validate()
+}
+
+func TestShadowIndex(t *testing.T) {
+	si := &shadowIndex{shadow: shadow{Namespace: "db.shadow", Percent: 25}, target: "shadow-test"}
+	shadowIndexes[si.Namespace] = si
+	defer delete(shadowIndexes, si.Namespace)
+	sampled := 0
+	for i := 0; i < 4000; i++ {
+		if si.samples(&gtm.Op{Id: i, Namespace: si.Namespace}) {
+			sampled++
+		}
+	}
+	if sampled < 800 || sampled > 1200 {
+		t.Fatalf("Expected about a quarter of the documents to be sampled but got %d", sampled)
+	}
+	var op *gtm.Op
+	for i := 0; op == nil; i++ {
+		op = shadowCopy(&gtm.Op{Id: i, Namespace: si.Namespace, Data: map[string]interface{}{
+			"name": "a", "tags": []interface{}{"x"}, "address": map[string]interface{}{"city": "b"},
+		}})
+	}
+	cp := shadowCopy(op)
+	cp.Data["address"].(map[string]interface{})["city"] = "c"
+	if op.Data["address"].(map[string]interface{})["city"] != "b" {
+		t.Fatalf("Expected the shadow copy not to share nested documents")
+	}
+	delete(cp.Data, "name")
+	cp.Data["rank"] = 1
+	diff, err := compareShadow(op.Data, cp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff == nil || fmt.Sprint(diff.Added) != "[rank]" || fmt.Sprint(diff.Removed) != "[name]" ||
+		fmt.Sprint(diff.Changed) != "[address.city]" {
+		t.Fatalf("Unexpected shadow diff: %+v", diff)
+	}
+	if diff, _ = compareShadow(op.Data, op.Data); diff != nil {
+		t.Fatalf("Expected the same documents not to differ: %+v", diff)
+	}
+	if shadowCopy(&gtm.Op{Id: 1, Namespace: "db.other", Data: op.Data}) != nil {
+		t.Fatalf("Expected namespaces without a shadow not to be copied")
+	}
+	stats := shadowStatsOf()
+	if stats[si.Namespace].Index != "shadow-test" {
+		t.Fatalf("Expected the shadow index in the stats: %+v", stats)
+	}
+}
+
+func TestReplayBound(t *testing.T) {
+	config := &configOptions{ResumeFromTimestamp: 10, Resume: true}
+	if err := config.replayFrom(nil); err != nil || config.Resume || config.ReplayUntil != "now" {
+		t.Fatalf("Expected the replay to stop now without saving the resume position: %+v", config)
+	}
+	token := filepath.Join(t.TempDir(), "resume.json")
+	if err := ioutil.WriteFile(token, []byte(`{"resume-name":"default","ts":7301041961607266305}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.replayFrom([]string{token}); err != nil || config.ResumeFromTimestamp != 7301041961607266305 {
+		t.Fatalf("Expected replay from the resume token but got %d: %v", config.ResumeFromTimestamp, err)
+	}
+	config.ReplayUntil = "2023-11-14T22:13:20Z"
+	config.ReplayNamespaces = stringargs{"db.col"}
+	b, err := newReplayBound(config, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.until>>32 != 1700000000 {
+		t.Fatalf("Expected the bound at the end of the second but got %d", b.until)
+	}
+	if !b.filter(&gtm.Op{Namespace: "db.col", Timestamp: 1700000000 << 32}) {
+		t.Fatalf("Expected events of a replayed namespace up to the bound to be read")
+	}
+	if b.filter(&gtm.Op{Namespace: "db.other", Timestamp: 1700000000 << 32}) {
+		t.Fatalf("Expected events of other namespaces to be skipped")
+	}
+	after := time.Unix(1700000001, 0)
+	if b.idle(after) || b.idle(after) || !b.idle(after) {
+		t.Fatalf("Expected the replay to end after two checks without events")
+	}
+	config.ReplayUntil = "tomorrow"
+	if _, err = newReplayBound(config, time.Now()); err == nil {
+		t.Fatalf("Expected error for an invalid bound")
+	}
+}
+
+func TestCheckpointTracker(t *testing.T) {
+	config := &configOptions{}
+	config.setDefaults()
+	if config.CheckpointInterval != checkpointIntervalSecondsDefault || config.CheckpointMode != "after-ack" {
+		t.Fatalf("Expected the default checkpoint settings: %+v", config)
+	}
+	c := newCheckpointTracker()
+	first := &gtm.Op{Timestamp: bson.MongoTimestamp(5 << 32)}
+	second := &gtm.Op{Timestamp: bson.MongoTimestamp(6 << 32)}
+	c.startEvent(first)
+	c.startEvent(second)
+	c.startEvent(&gtm.Op{Timestamp: bson.MongoTimestamp(1 << 32), Source: gtm.DirectQuerySource})
+	if ts := c.position(config, second.Timestamp); ts != first.Timestamp-1 {
+		t.Fatalf("Expected the position before the first event in flight but got %d", ts)
+	}
+	c.finishEvent(first)
+	if ts := c.position(config, second.Timestamp); ts != second.Timestamp-1 {
+		t.Fatalf("Expected the position before the second event but got %d", ts)
+	}
+	c.finishEvent(second)
+	if ts := c.position(config, second.Timestamp); ts != second.Timestamp {
+		t.Fatalf("Expected the position of the last event read but got %d", ts)
+	}
+	c.startEvent(first)
+	config.CheckpointMode = "before-ack"
+	if ts := c.position(config, second.Timestamp); ts != second.Timestamp {
+		t.Fatalf("Expected before-ack to save the position read but got %d", ts)
+	}
+	m := &monstacheMetrics{}
+	m.checkpointSaved(bson.MongoTimestamp(time.Now().Add(-time.Minute).Unix() << 32))
+	if age := m.checkpointAge(); age < 59 || age > 61 {
+		t.Fatalf("Expected a checkpoint age of a minute but got %v", age)
+	}
+}
+
+func TestReadinessStartup(t *testing.T) {
+	r := &readiness{lastAdvance: time.Now()}
+	r.catchUp(30 * time.Second)
+	r.directReads(true)
+	if phase, err := r.startup(time.Now()); phase != "direct-reads" || err == nil {
+		t.Fatalf("Expected to wait for direct reads but got %s", phase)
+	}
+	r.directReads(false)
+	r.observe(&gtm.Op{Timestamp: bson.MongoTimestamp(time.Now().Add(-time.Hour).Unix() << 32)})
+	if phase, err := r.startup(time.Now()); phase != "catching-up" || err == nil {
+		t.Fatalf("Expected to wait for change events to catch up but got %s", phase)
+	}
+	r.observe(&gtm.Op{Timestamp: bson.MongoTimestamp(time.Now().Unix() << 32)})
+	if phase, err := r.startup(time.Now()); phase != "started" || err != nil {
+		t.Fatalf("Expected to start once caught up but got %s: %v", phase, err)
+	}
+	r.observe(&gtm.Op{Timestamp: bson.MongoTimestamp(time.Now().Add(-time.Hour).Unix() << 32)})
+	if phase, _ := r.startup(time.Now()); phase != "started" {
+		t.Fatalf("Expected the process to stay started but got %s", phase)
+	}
+	idle := &readiness{}
+	idle.catchUp(time.Second)
+	if phase, _ := idle.startup(time.Now().Add(2 * time.Second)); phase != "started" {
+		t.Fatalf("Expected an idle change stream to be caught up but got %s", phase)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	serial := int64(0)
+	pemPair := func() (string, string) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serial++
+		tmpl := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := x509.MarshalPKCS8PrivateKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+			string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}))
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	cert, key := pemPair()
+	ioutil.WriteFile(certFile, []byte(cert), 0600)
+	ioutil.WriteFile(keyFile, []byte(key), 0600)
+	es := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	es.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	es.StartTLS()
+	defer es.Close()
+	config := &configOptions{ElasticClientCert: certFile, ElasticClientKey: keyFile, ElasticClientTimeout: 5}
+	client, err := config.NewHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify = true
+	resp, err := client.Get(es.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the client certificate to be presented but got status %d", resp.StatusCode)
+	}
+	c := &clientCertificate{cert: certFile, key: keyFile}
+	if err = c.reload(); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := c.get(nil)
+	cert, key = pemPair()
+	ioutil.WriteFile(certFile, []byte(cert), 0600)
+	if c.reload() == nil {
+		t.Fatalf("Expected a certificate not matching its key to be rejected")
+	}
+	if current, _ := c.get(nil); current != first {
+		t.Fatalf("Expected the previous certificate to be kept")
+	}
+	ioutil.WriteFile(keyFile, []byte(key), 0600)
+	if err = c.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := c.get(nil); current == first {
+		t.Fatalf("Expected the rotated certificate to be loaded")
+	}
+	inline := &clientCertificate{cert: cert, key: key}
+	if err = inline.reload(); err != nil {
+		t.Fatalf("Expected inline PEM to be loaded: %s", err)
+	}
+}
+
+func TestKerberosSettings(t *testing.T) {
+	keytab := filepath.Join(t.TempDir(), "monstache.keytab")
+	ioutil.WriteFile(keytab, []byte{5, 2}, 0600)
+	ks := kerberosSettings{Principal: "monstache@EXAMPLE.COM", Keytab: keytab, ServiceName: "mongo"}
+	if err := ks.validate(); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Unsetenv("KRB5_CLIENT_KTNAME")
+	dialInfo := &mgo.DialInfo{}
+	if err := ks.apply(dialInfo); err != nil {
+		t.Fatal(err)
+	}
+	if dialInfo.Mechanism != "GSSAPI" || dialInfo.Source != "$external" || dialInfo.Username != ks.Principal || dialInfo.Service != "mongo" {
+		t.Fatalf("Expected GSSAPI credentials but got %+v", dialInfo)
+	}
+	if os.Getenv("KRB5_CLIENT_KTNAME") != keytab {
+		t.Fatalf("Expected the keytab to be exported to the GSSAPI library")
+	}
+	ks.Password = "secret"
+	if ks.validate() == nil {
+		t.Fatalf("Expected a password and a keytab to be rejected")
+	}
+	ks = kerberosSettings{Keytab: keytab}
+	if ks.validate() == nil {
+		t.Fatalf("Expected a missing principal to be rejected")
+	}
+	ks = kerberosSettings{Principal: "monstache@EXAMPLE.COM", Keytab: keytab + ".missing"}
+	if ks.validate() == nil {
+		t.Fatalf("Expected a missing keytab to be rejected")
+	}
+}
+
+func TestMongoAWSAuth(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	readCommand := func() bson.M {
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(server, header); err != nil {
+			t.Fatal(err)
+		}
+		body := make([]byte, binary.LittleEndian.Uint32(header)-16)
+		io.ReadFull(server, body)
+		doc := body[4+bytes.IndexByte(body[4:], 0)+1+8:]
+		var cmd bson.M
+		if err := bson.Unmarshal(doc, &cmd); err != nil {
+			t.Fatal(err)
+		}
+		return cmd
+	}
+	reply := func(doc bson.M) {
+		data, _ := bson.Marshal(doc)
+		msg := make([]byte, 36, 36+len(data))
+		binary.LittleEndian.PutUint32(msg[12:], 1)
+		msg = append(msg, data...)
+		binary.LittleEndian.PutUint32(msg, uint32(len(msg)))
+		server.Write(msg)
+	}
+	final := make(chan bson.M, 1)
+	go func() {
+		cmd := readCommand()
+		var first struct {
+			Nonce []byte `bson:"r"`
+		}
+		bson.Unmarshal(cmd["payload"].([]byte), &first)
+		payload, _ := bson.Marshal(bson.M{"s": append(first.Nonce, make([]byte, 32)...), "h": "sts.us-west-2.amazonaws.com"})
+		reply(bson.M{"ok": 1, "conversationId": 1, "payload": payload})
+		cmd = readCommand()
+		var second bson.M
+		bson.Unmarshal(cmd["payload"].([]byte), &second)
+		final <- second
+		reply(bson.M{"ok": 1, "conversationId": 1, "done": true})
+	}()
+	auth, err := newMongoAWSAuth("AKIDEXAMPLE", "secret", "AWS_SESSION_TOKEN%3Atoken", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = auth.authenticate(client); err != nil {
+		t.Fatal(err)
+	}
+	second := <-final
+	authz, _ := second["a"].(string)
+	if !strings.Contains(authz, "Credential=AKIDEXAMPLE/") || !strings.Contains(authz, "/us-west-2/sts/aws4_request") {
+		t.Fatalf("Expected a request signed for STS in us-west-2 but got %s", authz)
+	}
+	for _, h := range []string{"content-length", "content-type", "host", "x-amz-date", "x-amz-security-token", "x-mongodb-gs2-cb-flag", "x-mongodb-server-nonce"} {
+		if !strings.Contains(authz, h) {
+			t.Fatalf("Expected %s to be signed but got %s", h, authz)
+		}
+	}
+	if second["t"] != "token" || second["d"] == "" {
+		t.Fatalf("Expected the date and session token to be sent but got %v", second)
+	}
+	if stsRegion("sts.amazonaws.com") != "us-east-1" || stsRegion("sts.eu-west-1.amazonaws.com") != "eu-west-1" || stsRegion("localhost") != "us-east-1" {
+		t.Fatalf("Expected the region to be derived from the STS host")
+	}
+}
+
+func TestSanitizedConfig(t *testing.T) {
+	config := configOptions{
+		ElasticAPIKey:   "secret",
+		Embedding:       []*embedding{{Namespace: "db.col", APIKey: "secret"}},
+		MeilisearchSink: &meilisearchSink{APIKey: "secret"},
+	}
+	data, err := config.sanitized()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret") {
+		t.Fatalf("Expected the api keys to be left out of the config but got %s", data)
+	}
+}
+
+func TestRedactFields(t *testing.T) {
+	config := &configOptions{Redact: []fieldRedaction{
+		{Namespace: "db.users", Fields: []string{"password"}},
+		{Namespace: "db.users", Fields: []string{"email", "cards.number"}, Action: "hash", Salt: "pepper"},
+		{Namespace: "db.users", Fields: []string{"phone"}, Action: "mask", KeepLast: 4},
+	}}
+	config.loadRedactions()
+	defer delete(redactions, "db.users")
+	doc := map[string]interface{}{
+		"password": "hunter2",
+		"email":    "a@example.com",
+		"phone":    "5551234567",
+		"cards":    []interface{}{map[string]interface{}{"number": "4111"}, map[string]interface{}{"number": "4111"}},
+	}
+	redactFields("db.users", doc)
+	if _, found := doc["password"]; found {
+		t.Fatalf("Expected password to be dropped")
+	}
+	if doc["phone"] != "******4567" {
+		t.Fatalf("Expected phone to be masked but got %v", doc["phone"])
+	}
+	email := doc["email"].(string)
+	if len(email) != 64 || strings.Contains(email, "example") {
+		t.Fatalf("Expected email to be hashed but got %v", email)
+	}
+	cards := doc["cards"].([]interface{})
+	first, second := cards[0].(map[string]interface{})["number"], cards[1].(map[string]interface{})["number"]
+	if first == "4111" || first != second {
+		t.Fatalf("Expected equal card numbers to hash alike but got %v and %v", first, second)
+	}
+	changes := map[string]interface{}{
+		"updatedFields": map[string]interface{}{
+			"password":       "secret",
+			"cards.1.number": "4222",
+			"cards.0":        map[string]interface{}{"number": "4333", "exp": "12/30"},
+		},
+		"removedFields": []interface{}{"nickname"},
+	}
+	redacted := redactChanges("db.users", changes)
+	fields := redacted["updatedFields"].(map[string]interface{})
+	if _, found := fields["password"]; found {
+		t.Fatalf("Expected password to be dropped from the changes")
+	}
+	if fields["cards.1.number"] == "4222" || fields["cards.0"].(map[string]interface{})["number"] == "4333" {
+		t.Fatalf("Expected card numbers to be hashed in the changes but got %v", fields)
+	}
+	if changes["updatedFields"].(map[string]interface{})["password"] != "secret" {
+		t.Fatalf("Expected the original changes to be left as they were")
+	}
+	if redactChanges("db.orders", changes)["updatedFields"].(map[string]interface{})["password"] != "secret" {
+		t.Fatalf("Expected other namespaces to be left as they were")
+	}
+}
+
+func TestCSFLE(t *testing.T) {
+	encrypt := func(key, plain, ad []byte) []byte {
+		pad := aes.BlockSize - len(plain)%aes.BlockSize
+		plain = append(plain, bytes.Repeat([]byte{byte(pad)}, pad)...)
+		iv := make([]byte, aes.BlockSize)
+		rand.Read(iv)
+		block, _ := aes.NewCipher(key[32:64])
+		body := make([]byte, len(plain))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(body, plain)
+		body = append(iv, body...)
+		mac := hmac.New(sha512.New, key[:32])
+		mac.Write(ad)
+		mac.Write(body)
+		bits := make([]byte, 8)
+		binary.BigEndian.PutUint64(bits, uint64(len(ad))*8)
+		mac.Write(bits)
+		return append(body, mac.Sum(nil)[:32]...)
+	}
+	master, dataKey, keyID := make([]byte, 96), make([]byte, 96), make([]byte, 16)
+	rand.Read(master)
+	rand.Read(dataKey)
+	rand.Read(keyID)
+	vault := map[string]*csfleKey{
+		string(keyID): {KeyMaterial: encrypt(master, dataKey, nil), MasterKey: map[string]interface{}{"provider": "local"}},
+	}
+	// an encrypted string field
+	value := []byte{7, 0, 0, 0, 's', 'e', 'c', 'r', 'e', 't', 0}
+	payload := append(append([]byte{2}, keyID...), 0x02)
+	payload = append(payload, encrypt(dataKey, value, payload)...)
+	newOp := func() *gtm.Op {
+		return &gtm.Op{Id: 1, Namespace: "db.patients", Data: map[string]interface{}{
+			"name": "pat",
+			"ssn":  bson.Binary{Kind: 6, Data: payload},
+			"tags": []interface{}{bson.Binary{Kind: 6, Data: payload}, "open"},
+		}}
+	}
+	c := &csfleDecrypter{policy: "decrypt", localKey: master, keys: make(map[string][]byte)}
+	c.lookup = func(id []byte) (*csfleKey, error) {
+		if k := vault[string(id)]; k != nil {
+			return k, nil
+		}
+		return nil, mgo.ErrNotFound
+	}
+	op := newOp()
+	c.apply(op)
+	if op.Data["ssn"] != "secret" || fmt.Sprint(op.Data["tags"]) != "[secret open]" {
+		t.Fatalf("Expected the encrypted fields to be decrypted but got %v", op.Data)
+	}
+	payload[len(payload)-1] ^= 1
+	op = newOp()
+	c.apply(op)
+	if _, found := op.Data["ssn"]; found {
+		t.Fatalf("Expected a field which fails to decrypt to be stripped")
+	}
+	strip := &csfleDecrypter{policy: "strip"}
+	op = newOp()
+	strip.apply(op)
+	if _, found := op.Data["ssn"]; found || fmt.Sprint(op.Data["tags"]) != "[open]" || op.Data["name"] != "pat" {
+		t.Fatalf("Expected only the encrypted fields to be stripped but got %v", op.Data)
+	}
+	if (&csfleSettings{Policy: "decrypt"}).validate() == nil {
+		t.Fatalf("Expected decryption without a key vault to be rejected")
+	}
+}
+
+func TestScanPII(t *testing.T) {
+	config := &configOptions{PII: []piiScan{
+		{Namespace: "db.tickets", Fields: []string{"body", "notes.text"}, Salt: "pepper", Allow: []string{`.*@example\.com`}},
+	}}
+	config.loadPIIScans()
+	defer delete(piiScans, "db.tickets")
+	doc := map[string]interface{}{
+		"body":    "Reach Jo at Jo.Doe@Mail.org or (555) 123-4567, SSN 123-45-6789. Support: help@example.com",
+		"notes":   []interface{}{map[string]interface{}{"text": "call 555.123.4567 or mail jo.doe@mail.org"}},
+		"subject": "jo.doe@mail.org",
+	}
+	scanPII("db.tickets", doc)
+	body := doc["body"].(string)
+	for _, leaked := range []string{"Jo.Doe", "123-4567", "6789"} {
+		if strings.Contains(body, leaked) {
+			t.Fatalf("Expected %s to be tokenized but got %s", leaked, body)
+		}
+	}
+	if !strings.Contains(body, "help@example.com") || !strings.Contains(body, "<ssn:") {
+		t.Fatalf("Expected allowed values to be kept and tokens to name the PII but got %s", body)
+	}
+	tokens := regexp.MustCompile(`<(email|phone):[0-9a-f]{16}>`)
+	note := doc["notes"].([]interface{})[0].(map[string]interface{})["text"].(string)
+	bodyTokens, noteTokens := tokens.FindAllString(body, -1), tokens.FindAllString(note, -1)
+	if len(bodyTokens) != 2 || len(noteTokens) != 2 || bodyTokens[0] != noteTokens[1] || bodyTokens[1] != noteTokens[0] {
+		t.Fatalf("Expected the same PII to yield the same tokens but got %v and %v", bodyTokens, noteTokens)
+	}
+	if doc["subject"] != "jo.doe@mail.org" {
+		t.Fatalf("Expected fields which are not scanned to be kept")
+	}
+	changes := redactChanges("db.tickets", map[string]interface{}{
+		"updatedFields": map[string]interface{}{"notes.0.text": "ssn 123-45-6789"},
+	})
+	if text := changes["updatedFields"].(map[string]interface{})["notes.0.text"]; !strings.HasPrefix(text.(string), "ssn <ssn:") {
+		t.Fatalf("Expected the PII in changes to be tokenized but got %v", text)
+	}
+}
+
+func TestTLSSettings(t *testing.T) {
+	tlsConfig := &tls.Config{}
+	if err := applyTLSSettings(tlsConfig, "1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}); err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.MinVersion != tls.VersionTLS12 || len(tlsConfig.CipherSuites) != 1 || tlsConfig.CipherSuites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("Expected the min version and cipher suite to be set but got %+v", tlsConfig)
+	}
+	for _, bad := range [][]string{{"1.4"}, {"", "TLS_AES_128_GCM_SHA256"}, {"", "TLS_RSA_WITH_RC4_128_SHA"}, {"", "TLS_NOPE"}} {
+		if applyTLSSettings(&tls.Config{}, bad[0], bad[1:]) == nil {
+			t.Fatalf("Expected %v to be rejected", bad)
+		}
+	}
+	es := httptest.NewUnstartedServer(http.NotFoundHandler())
+	es.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	es.StartTLS()
+	defer es.Close()
+	config := &configOptions{ElasticTLSMinVersion: "1.3", ElasticClientTimeout: 5}
+	client, err := config.NewHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Get(es.URL); err == nil || !strings.Contains(err.Error(), "version") {
+		t.Fatalf("Expected a TLS 1.2 server to be refused but got %v", err)
+	}
+}
+
+func TestHTTPAuthorize(t *testing.T) {
+	ctx := &httpServerCtx{config: &configOptions{}}
+	ok := func(w http.ResponseWriter, req *http.Request) {}
+	status := func(role string, setup func(*http.Request)) int {
+		req := httptest.NewRequest("GET", "/status", nil)
+		if setup != nil {
+			setup(req)
+		}
+		w := httptest.NewRecorder()
+		ctx.authorize(role, ok)(w, req)
+		return w.Code
+	}
+	if code := status(httpRoleAdmin, nil); code != 200 {
+		t.Fatalf("Expected open admin endpoint without credentials: %d", code)
+	}
+	ctx.config.AdminUser, ctx.config.AdminPassword = "root", "pw"
+	if code := status(httpRoleRead, nil); code != 200 {
+		t.Fatalf("Expected open read endpoint with only an admin user: %d", code)
+	}
+	if code := status(httpRoleAdmin, nil); code != 401 {
+		t.Fatalf("Expected 401 without credentials: %d", code)
+	}
+	if code := status(httpRoleAdmin, func(r *http.Request) { r.SetBasicAuth("root", "pw") }); code != 200 {
+		t.Fatalf("Expected admin user to be accepted: %d", code)
+	}
+	ctx.config.HTTPCredentials = []httpCredential{
+		{Token: "viewer", Role: httpRoleRead},
+		{User: "ops", Password: "secret", Role: httpRoleAdmin},
+	}
+	bearer := func(token string) func(*http.Request) {
+		return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) }
+	}
+	if code := status(httpRoleRead, nil); code != 401 {
+		t.Fatalf("Expected 401 for read endpoint without credentials: %d", code)
+	}
+	if code := status(httpRoleRead, bearer("viewer")); code != 200 {
+		t.Fatalf("Expected read token to view: %d", code)
+	}
+	if code := status(httpRoleAdmin, bearer("viewer")); code != 403 {
+		t.Fatalf("Expected 403 for read token on admin endpoint: %d", code)
+	}
+	if code := status(httpRoleAdmin, bearer("wrong")); code != 401 {
+		t.Fatalf("Expected 401 for unknown token: %d", code)
+	}
+	if code := status(httpRoleRead, func(r *http.Request) { r.SetBasicAuth("ops", "secret") }); code != 200 {
+		t.Fatalf("Expected admin credential to imply read: %d", code)
+	}
+	if code := status(httpRoleAdmin, func(r *http.Request) { r.SetBasicAuth("ops", "nope") }); code != 401 {
+		t.Fatalf("Expected 401 for a wrong password: %d", code)
+	}
+}
+
+func TestCertPool(t *testing.T) {
+	newCA := func() (*x509.Certificate, *ecdsa.PrivateKey, string) {
+		priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(time.Now().UnixNano()),
+			Subject:               pkix.Name{CommonName: "monstache test CA"},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ca, _ := x509.ParseCertificate(der)
+		return ca, priv, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	}
+	ca, caKey, caPEM := newCA()
+	_, _, otherPEM := newCA()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &priv.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}}}
+	server.StartTLS()
+	defer server.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	ioutil.WriteFile(caFile, []byte(otherPEM), 0600)
+	config := &configOptions{ElasticPemFile: caFile, ElasticValidatePemFile: true, ElasticClientTimeout: 5}
+	client, err := config.NewHTTPClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Get(server.URL); err == nil {
+		t.Fatalf("Expected a server signed by another CA to be rejected")
+	}
+	cas := &certPool{source: func() string { return caFile }}
+	if err = cas.start(); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{}
+	cas.apply(tlsConfig)
+	conn, err := tls.Dial("tcp", server.Listener.Addr().String(), tlsConfig)
+	if err == nil {
+		conn.Close()
+		t.Fatalf("Expected the server to be rejected before the CA rotates")
+	}
+	ioutil.WriteFile(caFile, []byte("partly written"), 0600)
+	if cas.reload() == nil {
+		t.Fatalf("Expected a bundle without certificates to be rejected")
+	}
+	ioutil.WriteFile(caFile, []byte(caPEM), 0600)
+	if err = cas.reload(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err = tls.Dial("tcp", server.Listener.Addr().String(), tlsConfig)
+	if err != nil {
+		t.Fatalf("Expected the rotated CA to verify the server: %s", err)
+	}
+	conn.Close()
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	raw := json.RawMessage(`{"b":[1,2],"a":{"y":"z","x":1}}`)
+	doc := map[string]interface{}{"a": map[string]interface{}{"x": 1, "y": "z"}, "b": []int{1, 2}}
+	var want, got [sha256.Size]byte
+	verifyChecksum(&want, "1", doc)
+	verifyChecksum(&want, "2", map[string]interface{}{"c": true})
+	flag := json.RawMessage(`{"c":true}`)
+	verifyChecksum(&got, "2", &flag)
+	verifyChecksum(&got, "1", &raw)
+	if want != got {
+		t.Fatalf("Expected the checksums of the same documents to match")
+	}
+	verifyChecksum(&got, "3", nil)
+	if want != got {
+		t.Fatalf("Expected a missing document to leave the checksum unchanged")
+	}
+	var other [sha256.Size]byte
+	verifyChecksum(&other, "1", map[string]interface{}{"a": map[string]interface{}{"x": 2, "y": "z"}, "b": []int{1, 2}})
+	verifyChecksum(&other, "2", map[string]interface{}{"c": true})
+	if want == other {
+		t.Fatalf("Expected a changed document to change the checksum")
+	}
+	report := &verifyReport{Documents: 2, Indexed: 2}
+	if !report.synced() {
+		t.Fatalf("Expected a report without differences to be synced")
+	}
+	for i := 0; i <= verifyReportMaxIds; i++ {
+		report.MissingCount++
+		report.Missing = appendVerifyID(report.Missing, strconv.Itoa(i))
+	}
+	if report.synced() || len(report.Missing) != verifyReportMaxIds {
+		t.Fatalf("Expected at most %d missing ids but got %d", verifyReportMaxIds, len(report.Missing))
+	}
+}
+
+func TestRepairer(t *testing.T) {
+	var batches []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		lines := strings.Count(string(b), "\n")
+		batches = append(batches, lines)
+		w.Header().Set("Content-Type", "application/json")
+		if lines == 1 {
+			fmt.Fprint(w, `{"errors":true,"items":[{"delete":{"_index":"test","_id":"3","status":500,"error":{"type":"x","reason":"failed"}}}]}`)
+			return
+		}
+		fmt.Fprint(w, `{"errors":false,"items":[{"delete":{"_index":"test","_id":"1","status":200}},{"delete":{"_index":"test","_id":"2","status":200}}]}`)
+	}))
+	defer server.Close()
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dryRun := &repairer{size: 2, bulk: client.Bulk()}
+	for _, id := range []string{"1", "2", "3"} {
+		if err = dryRun.add(elastic.NewBulkDeleteRequest().Index("test").Id(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = dryRun.flush(); err != nil || len(batches) != 0 {
+		t.Fatalf("Expected a dry run to send nothing but sent %v: %v", batches, err)
+	}
+	r := &repairer{apply: true, size: 2, rate: 20, bulk: client.Bulk()}
+	start := time.Now()
+	for _, id := range []string{"1", "2", "3"} {
+		if err = r.add(elastic.NewBulkDeleteRequest().Index("test").Id(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = r.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 2 || batches[0] != 2 || batches[1] != 1 {
+		t.Fatalf("Expected batches of 2 and 1 deletes but got %v", batches)
+	}
+	if r.failed != 1 {
+		t.Fatalf("Expected 1 failed repair but got %d", r.failed)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("Expected the rate to space the batches but took %s", elapsed)
+	}
+}
+
+func TestOrphanIDCandidates(t *testing.T) {
+	oid := bson.NewObjectId()
+	if c := orphanIDCandidates(oid.Hex()); len(c) != 2 || c[1] != oid {
+		t.Fatalf("Expected the hex id and its ObjectId but got %v", c)
+	}
+	if c := orphanIDCandidates("42"); len(c) != 2 || c[0] != "42" || c[1] != int64(42) {
+		t.Fatalf("Expected the string and numeric id but got %v", c)
+	}
+	if c := orphanIDCandidates("abc"); len(c) != 1 {
+		t.Fatalf("Expected only the string id but got %v", c)
+	}
+	for _, c := range orphanIDCandidates(oid.Hex()) {
+		if opIDToString(&gtm.Op{Id: c}) != oid.Hex() {
+			t.Fatalf("Expected candidate %v to map back to %s", c, oid.Hex())
+		}
+	}
+}
+
+func TestRoutingTracker(t *testing.T) {
+	defer func() { routingChanges = nil }()
+	routingChanges = newRoutingTracker(&configOptions{RoutingCacheSize: 2})
+	routingNamespaces["db.assets"] = true
+	defer delete(routingNamespaces, "db.assets")
+	var deletes []string
+	ndjson := &bytes.Buffer{}
+	ndjsonOut = &ndjsonWriter{w: ndjson}
+	defer func() { ndjsonOut = nil }()
+	config := &configOptions{DisableElasticsearch: true}
+	op := &gtm.Op{Id: "a1", Namespace: "db.assets", Operation: "u", Timestamp: bson.MongoTimestamp(7 << 32)}
+	routingChanges.remember("db.assets.a1", routedCopy{Index: "assets", Routing: "org1"})
+	deleteRoutingChanges(config, nil, nil, nil, op, "a1", "a1", routedCopy{Index: "assets", Routing: "org1"})
+	deleteRoutingChanges(config, nil, nil, nil, op, "a1", "a1", routedCopy{Index: "assets", Routing: "org2"})
+	for _, line := range strings.Split(strings.TrimSpace(ndjson.String()), "\n") {
+		if strings.Contains(line, `"delete"`) {
+			deletes = append(deletes, line)
+		}
+	}
+	if len(deletes) != 1 || !strings.Contains(deletes[0], `"routing":"org1"`) {
+		t.Fatalf("Expected one delete of the copy routed to org1 but got %v", deletes)
+	}
+	if c, _ := routingChanges.lookup("db.assets.a1"); c.Routing != "org2" {
+		t.Fatalf("Expected the new routing to be remembered but got %q", c.Routing)
+	}
+	routingChanges.remember("db.assets.a2", routedCopy{Routing: "x"})
+	routingChanges.remember("db.assets.a3", routedCopy{Routing: "y"})
+	if _, ok := routingChanges.lookup("db.assets.a1"); ok {
+		t.Fatalf("Expected the oldest entry to be evicted")
+	}
+}
+
+func TestSchemaDrift(t *testing.T) {
+	d := newSchemaDriftDetector(&configOptions{}, nil)
+	d.observe("db.col", "col", map[string]interface{}{
+		"_id":     bson.NewObjectId(),
+		"name":    "widget",
+		"price":   12.5,
+		"created": "2020-01-02T03:04:05Z",
+		"owner":   map[string]interface{}{"age": 40, "active": true},
+		"tags":    []interface{}{"a", "b"},
+		"extra":   "new",
+	})
+	props := map[string]interface{}{
+		"name":    map[string]interface{}{"type": "text"},
+		"price":   map[string]interface{}{"type": "float"},
+		"created": map[string]interface{}{"type": "keyword"},
+		"tags":    map[string]interface{}{"type": "keyword"},
+		"owner": map[string]interface{}{"properties": map[string]interface{}{
+			"age":    map[string]interface{}{"type": "text"},
+			"active": map[string]interface{}{"type": "boolean"},
+		}},
+	}
+	mapped := make(map[string]string)
+	mappedFields("", props, mapped)
+	if mapped["owner.age"] != "string" || mapped["owner"] != "object" {
+		t.Fatalf("Expected flattened mapping but got %v", mapped)
+	}
+	drifts := compareSchema(d.indexes["col"].fields, mapped)
+	expected := []fieldDrift{
+		{Kind: "unmapped", Field: "extra", Emitted: "string"},
+		{Kind: "type", Field: "owner.age", Emitted: "number", Mapped: "string"},
+	}
+	if fmt.Sprint(drifts) != fmt.Sprint(expected) {
+		t.Fatalf("Expected drift %v but got %v", expected, drifts)
+	}
+	var none *schemaDriftDetector
+	none.observe("db.col", "col", map[string]interface{}{"a": 1})
+}
+
+func TestTombstone(t *testing.T) {
+	config := &configOptions{Tombstone: []tombstone{{Namespace: "db.tomb", Retention: "720h"}}}
+	config.loadTombstones()
+	defer delete(tombstones, "db.tomb")
+	ts := tombstones["db.tomb"]
+	if ts == nil || ts.Field != "deleted" || ts.DeletedAtField != "deleted_at" || ts.retention != 720*time.Hour {
+		t.Fatalf("Unexpected tombstone %+v", ts)
+	}
+	op := &gtm.Op{Id: "1", Namespace: "db.tomb", Operation: "d", Timestamp: bson.MongoTimestamp(1600000000 << 32)}
+	req := ts.request(config, op)
+	req.Id("1").Index("db.tomb")
+	lines, err := req.Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || !strings.Contains(lines[0], `"update"`) || lines[1] != `{"doc":{"deleted":true,"deleted_at":"2020-09-13T12:26:40Z"}}` {
+		t.Fatalf("Unexpected tombstone request %v", lines)
+	}
+	op.Data = map[string]interface{}{"name": "a"}
+	revived := ts.revive(config, op).(map[string]interface{})
+	if revived["deleted"] != false || revived["deleted_at"] != nil || len(op.Data) != 1 {
+		t.Fatalf("Unexpected revived document %v", revived)
+	}
+	src, err := liveDocuments("db.tomb").Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := json.Marshal(src); string(b) != `{"bool":{"must_not":{"term":{"deleted":true}}}}` {
+		t.Fatalf("Unexpected live documents query %s", b)
+	}
+	src, err = ts.expired(time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)).Source()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := json.Marshal(src); !strings.Contains(string(b), `"to":"2020-01-02T00:00:00Z"`) {
+		t.Fatalf("Unexpected expired query %s", b)
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	a := map[string]interface{}{"b": 1, "a": map[string]interface{}{"y": "2", "x": true}}
+	b := map[string]interface{}{"a": map[string]interface{}{"x": true, "y": "2"}, "b": 1.0, "hash": "stale"}
+	if contentHash(a, "hash") != contentHash(b, "hash") {
+		t.Fatalf("Expected the hash to ignore key order and the hash field")
+	}
+	sum := sha256.Sum256([]byte(`{"a":{"x":true,"y":"2"},"b":1}`))
+	if contentHash(a, "hash") != hex.EncodeToString(sum[:]) {
+		t.Fatalf("Expected the hash of the sorted JSON")
+	}
+	config := &configOptions{ContentHashField: "hash"}
+	op := &gtm.Op{Id: "1", Namespace: "db.hash", Operation: "i", Data: b}
+	if _, ok := transformDocument(config, op); !ok || op.Data["hash"] != contentHash(a, "hash") {
+		t.Fatalf("Expected the hash field to be set but got %v", op.Data["hash"])
+	}
+	if isPartialUpdate(config, op) {
+		t.Fatalf("Expected no partial updates with a content hash")
+	}
+}
+
+func TestWriteVerifyReports(t *testing.T) {
+	started := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	reports := []*verifyReport{{
+		Namespace:       "db.col",
+		Index:           "db.col",
+		Command:         "verify",
+		Started:         started,
+		Finished:        started.Add(1500 * time.Millisecond),
+		DurationMs:      1500,
+		Documents:       3,
+		Indexed:         3,
+		Checked:         3,
+		MissingCount:    2,
+		MismatchedCount: 1,
+		Missing:         []string{"a", "b"},
+		Mismatched:      []*verifyMismatch{{ID: "c"}},
+	}}
+	var buf bytes.Buffer
+	if err := writeVerifyReports(&buf, "csv", reports); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || len(rows[0]) != len(rows[1]) {
+		t.Fatalf("Expected a header and a row but got %v", rows)
+	}
+	expected := []string{"db.col", "db.col", "verify", "2020-01-02T03:04:05Z", "2020-01-02T03:04:06Z", "1500", "false",
+		"3", "3", "3", "2", "0", "1", "0", "0", "a b", "", "c"}
+	if strings.Join(rows[1], ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected row %v but got %v", expected, rows[1])
+	}
+	buf.Reset()
+	if err := writeVerifyReports(&buf, "", reports); err != nil {
+		t.Fatal(err)
+	}
+	var decoded []map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); err != nil || len(decoded) != 1 || decoded[0]["durationMs"] != 1500.0 {
+		t.Fatalf("Unexpected JSON report %s", buf.String())
+	}
+}
+
+func TestFileMetadataNamespaces(t *testing.T) {
+	config := &configOptions{IndexFiles: true, FileNamespaces: []string{"db.fs.files"}}
+	fileMetadataNamespaces["db.fs.files"] = true
+	defer delete(fileMetadataNamespaces, "db.fs.files")
+	fileNamespaces["db.fs.files"] = true
+	defer delete(fileNamespaces, "db.fs.files")
+	op := &gtm.Op{Id: "1", Namespace: "db.fs.files", Operation: "i", Data: map[string]interface{}{
+		"filename": "a.pdf",
+		"length":   int64(42),
+		"metadata": map[string]interface{}{"contentType": "application/pdf", "owner": "bob"},
+	}}
+	if hasFileContent(op, config) {
+		t.Fatalf("Expected the content of a file metadata namespace not to be read")
+	}
+	if _, ok := transformDocument(config, op); !ok || op.Data["contentType"] != "application/pdf" || op.Data["file"] != nil {
+		t.Fatalf("Unexpected file metadata document %v", op.Data)
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("Expected a namespace which is not a files collection to be rejected")
+		} else if !strings.Contains(fmt.Sprint(r), "db.files") {
+			t.Fatalf("Unexpected panic %v", r)
+		}
+	}()
+	(&configOptions{FileMetadataNamespaces: []string{"db.files"}}).validate()
+}
+
+func TestTikaFields(t *testing.T) {
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/large.pdf" {
+			w.Write(bytes.Repeat([]byte("x"), 100))
+			return
+		}
+		w.Write([]byte("%PDF-1.4 report"))
+	}))
+	defer files.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method != "PUT" || r.URL.Path != "/rmeta/text" || string(body) != "%PDF-1.4 report" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`[{"Content-Type":"application/pdf","dc:title":"Report","X-TIKA:content":" Quarterly report ","X-TIKA:parse_time_millis":"5"},
+			{"Content-Type":"image/png","X-TIKA:content":"embedded"}]`))
+	}))
+	defer server.Close()
+	tika = newTikaClient(&configOptions{TikaURL: server.URL + "/", TikaConcurrency: 1, TikaMaxBytes: 50, TikaTimeoutSeconds: 5})
+	defer func() { tika = nil }()
+	tikaFields["db.tika"] = []*tikaField{{Namespace: "db.tika", Field: "doc.url", Target: "attachment"}}
+	defer delete(tikaFields, "db.tika")
+	op := &gtm.Op{Id: "1", Namespace: "db.tika", Data: map[string]interface{}{
+		"doc": map[string]interface{}{"url": files.URL + "/report.pdf"},
+	}}
+	extractTikaFields(op)
+	attachment, _ := op.Data["attachment"].(map[string]interface{})
+	if attachment == nil || attachment["content"] != "Quarterly report\nembedded" || attachment["content_type"] != "application/pdf" {
+		t.Fatalf("Unexpected attachment %v", op.Data["attachment"])
+	}
+	metadata := attachment["metadata"].(map[string]interface{})
+	if metadata["dc:title"] != "Report" || metadata["X-TIKA:parse_time_millis"] != nil {
+		t.Fatalf("Unexpected metadata %v", metadata)
+	}
+	op.Data = map[string]interface{}{"doc": map[string]interface{}{"url": files.URL + "/large.pdf"}}
+	extractTikaFields(op)
+	if op.Data["attachment"] != nil {
+		t.Fatalf("Expected content over tika-max-bytes not to be extracted")
+	}
+}
+
+func TestFileFilter(t *testing.T) {
+	ff := &fileFilter{
+		ContentTypes:        []string{"application/pdf"},
+		Extensions:          []string{"docx", ".DOC"},
+		ExcludeContentTypes: []string{"video/*"},
+		MaxBytes:            20 * 1024 * 1024,
+	}
+	for _, c := range []struct {
+		name, contentType string
+		size              int64
+		allowed           bool
+	}{
+		{"report.pdf", "application/pdf; charset=binary", 1024, true},
+		{"notes.doc", "", 1024, true},
+		{"Notes.DOCX", "application/octet-stream", 1024, true},
+		{"big.pdf", "application/pdf", 21 * 1024 * 1024, false},
+		{"clip.doc", "video/mp4", 1024, false},
+		{"image.png", "image/png", 1024, false},
+		{"README", "", 10, false},
+	} {
+		if ff.allows(c.name, c.contentType, c.size) != c.allowed {
+			t.Fatalf("Expected %s of type %q allowed to be %t", c.name, c.contentType, c.allowed)
+		}
+	}
+	ff = &fileFilter{ExcludeExtensions: []string{"mp4"}}
+	if !ff.allows("a.txt", "", 1) || ff.allows("a.mp4", "", 1) {
+		t.Fatalf("Expected only excluded extensions to be filtered")
+	}
+}
+
+func TestRecordedEvents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monstache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.json")
+	r, err := newEventRecorder(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := bson.NewObjectId()
+	when := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	ops := []*gtm.Op{
+		{
+			Id:        id,
+			Operation: "i",
+			Namespace: "db.col",
+			Timestamp: bson.MongoTimestamp(6 << 32),
+			Source:    gtm.OplogQuerySource,
+			Data: map[string]interface{}{
+				"_id":     id,
+				"created": when,
+				"address": map[string]interface{}{"city": "Paris"},
+			},
+		},
+		{Id: "b", Operation: "d", Namespace: "db.col", Timestamp: bson.MongoTimestamp(7 << 32)},
+	}
+	for _, op := range ops {
+		if err := r.record(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.close()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 recorded events but got %d", len(lines))
+	}
+	op, err := readRecordedEvent([]byte(lines[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Id != id || op.Operation != "i" || op.Namespace != "db.col" || op.Timestamp != ops[0].Timestamp || !op.IsSourceOplog() {
+		t.Fatalf("Unexpected replayed event %+v", op)
+	}
+	if op.Data["_id"] != id {
+		t.Fatalf("Expected ObjectId %v but got %#v", id, op.Data["_id"])
+	}
+	if created, ok := op.Data["created"].(time.Time); !ok || !created.Equal(when) {
+		t.Fatalf("Expected date %v but got %#v", when, op.Data["created"])
+	}
+	if address, ok := op.Data["address"].(map[string]interface{}); !ok || address["city"] != "Paris" {
+		t.Fatalf("Unexpected nested document %#v", op.Data["address"])
+	}
+	op, err = readRecordedEvent([]byte(lines[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op.Id != "b" || !op.IsDelete() || op.Data != nil {
+		t.Fatalf("Unexpected replayed delete %+v", op)
+	}
+	zpath := filepath.Join(dir, "events.json.zst")
+	if r, err = newEventRecorder(zpath, true); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range ops {
+		if err := r.record(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.close()
+	if data, err = ioutil.ReadFile(zpath); err != nil || !isZstd(data) {
+		t.Fatalf("Expected the recording to be compressed: %v", err)
+	}
+	for _, p := range []string{path, zpath} {
+		opC := make(chan *gtm.Op, len(ops))
+		replayRecording(p, opC)
+		if len(opC) != len(ops) {
+			t.Fatalf("Expected %d events to be replayed from %s but got %d", len(ops), p, len(opC))
+		}
+		if op = <-opC; op.Id != id || op.Data["address"].(map[string]interface{})["city"] != "Paris" {
+			t.Fatalf("Unexpected replayed event %+v", op)
+		}
+	}
+}
+
+func TestChaos(t *testing.T) {
+	defer func() { chaos = nil }()
+	if err := (&chaosSettings{ElasticErrorRate: 1.5}).validate(); err == nil {
+		t.Fatalf("Expected a rate above 1 to be invalid")
+	}
+	if (&chaosSettings{PauseSeconds: 3}).enabled() {
+		t.Fatalf("Expected chaos testing to be disabled without rates")
+	}
+	var called int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called++
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	config := &configOptions{Chaos: chaosSettings{ElasticErrorRate: 1, PluginTimeoutRate: 1, Seed: 7}}
+	chaos = newFaultInjector(config)
+	if chaos.settings.PauseSeconds != chaosPauseSecondsDefault {
+		t.Fatalf("Expected the default pause but got %d", chaos.settings.PauseSeconds)
+	}
+	client := &http.Client{Transport: &chaosTransport{transport: http.DefaultTransport}}
+	resp, err := client.Post(server.URL, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 429 && resp.StatusCode != 503 {
+		t.Fatalf("Expected an injected 429 or 503 but got %d", resp.StatusCode)
+	}
+	if called != 0 {
+		t.Fatalf("Expected the failed request not to be sent")
+	}
+	err = callPlugin("map", &gtm.Op{Id: "1", Namespace: "db.col"}, func() error {
+		t.Fatalf("Expected the plugin not to be called")
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("Expected an injected plugin timeout but got %v", err)
+	}
+	chaos.settings.ElasticErrorRate = 0
+	if resp, err = client.Get(server.URL); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 || called != 1 {
+		t.Fatalf("Expected the request to be sent but got status %d", resp.StatusCode)
+	}
+	client1, client2 := net.Pipe()
+	defer client2.Close()
+	chaos.settings.MongoErrorRate = 1
+	conn, err := chaos.dialer(func(*mgo.ServerAddr) (net.Conn, error) { return client1, nil })(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Expected an injected read error")
+	}
+}
+
+func TestOffload(t *testing.T) {
+	defer delete(offloads, "db.docs")
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	store := &offloadStore{Bucket: "heavy", Prefix: "docs/", s3: fake}
+	config := &configOptions{Offload: []offload{{Namespace: "db.docs", Fields: []string{"body", "raw.data", "missing"}, MinBytes: 100, PreviewBytes: 5}}}
+	config.loadOffloads()
+	of := offloads["db.docs"]
+	small := &gtm.Op{Id: "1", Namespace: "db.docs", Data: map[string]interface{}{"body": "short"}}
+	if objects := of.apply(store, small); len(objects) != 0 || small.Data["body"] != "short" {
+		t.Fatalf("Expected a small document to be indexed as is")
+	}
+	body := strings.Repeat("héllo ", 50)
+	op := &gtm.Op{Id: "a/b", Namespace: "db.docs", Data: map[string]interface{}{
+		"title": "Report",
+		"body":  body,
+		"raw":   map[string]interface{}{"data": []interface{}{1, 2}},
+	}}
+	objects := of.apply(store, op)
+	if len(objects) != 2 {
+		t.Fatalf("Expected 2 fields to be offloaded but got %d", len(objects))
+	}
+	pointer, ok := op.Data["body"].(map[string]interface{})
+	if !ok || pointer["url"] != "s3://heavy/docs/db.docs/a%2Fb/body" || pointer["bytes"] != len(body) || pointer["preview"] != "héll" {
+		t.Fatalf("Unexpected pointer %v", op.Data["body"])
+	}
+	raw := op.Data["raw"].(map[string]interface{})["data"].(map[string]interface{})
+	if raw["content_type"] != "application/json" || raw["preview"] != "[1,2]" {
+		t.Fatalf("Unexpected pointer %v", raw)
+	}
+	if op.Data["title"] != "Report" {
+		t.Fatalf("Expected other fields to be kept")
+	}
+	if err := store.upload(objects); err != nil {
+		t.Fatal(err)
+	}
+	if string(fake.objects["docs/db.docs/a%2Fb/body"]) != body || string(fake.objects["docs/db.docs/a%2Fb/raw.data"]) != "[1,2]" {
+		t.Fatalf("Unexpected objects %v", fake.objects)
+	}
+	store.remove("db.docs", "a/b")
+	if len(fake.objects) != 0 {
+		t.Fatalf("Expected the objects of a deleted document to be removed but got %d", len(fake.objects))
+	}
+}
+
+func TestDateFormat(t *testing.T) {
+	defer func() {
+		delete(dateFormats, "db.iso")
+		delete(dateFormats, "db.millis")
+	}()
+	config := &configOptions{DateFormat: []dateFormat{
+		{
+			Namespace:     "db.iso",
+			Timezone:      "UTC",
+			Format:        "iso",
+			Fields:        []string{"legacy", "events.at"},
+			InputFormats:  []string{"rfc3339", "dd/MM/yyyy HH:mm", "unix"},
+			InputTimezone: "Europe/Paris",
+		},
+		{Namespace: "db.millis", Format: "epoch_millis"},
+	}}
+	config.loadDateFormats()
+	paris := time.FixedZone("CET", 3600)
+	doc := map[string]interface{}{
+		"created": time.Date(2021, 1, 2, 13, 4, 5, 0, paris),
+		"legacy":  "02/01/2021 13:04",
+		"events": []interface{}{
+			map[string]interface{}{"at": "2021-01-02T12:04:05Z"},
+			map[string]interface{}{"at": int64(1609589045)},
+			map[string]interface{}{"at": "yesterday"},
+		},
+		"name": "02/01/2021 13:04",
+	}
+	dateFormats["db.iso"].normalize(doc)
+	expected := map[string]interface{}{
+		"created": "2021-01-02T12:04:05.000Z",
+		"legacy":  "2021-01-02T12:04:00.000Z",
+		"name":    "02/01/2021 13:04",
+	}
+	for field, want := range expected {
+		if doc[field] != want {
+			t.Fatalf("Expected %s to be %v but got %v", field, want, doc[field])
+		}
+	}
+	events := doc["events"].([]interface{})
+	for i, want := range []interface{}{"2021-01-02T12:04:05.000Z", "2021-01-02T12:04:05.000Z", "yesterday"} {
+		if at := events[i].(map[string]interface{})["at"]; at != want {
+			t.Fatalf("Expected event %d at %v but got %v", i, want, at)
+		}
+	}
+	doc = map[string]interface{}{"created": time.Date(2021, 1, 2, 12, 4, 5, 0, time.UTC)}
+	dateFormats["db.millis"].normalize(doc)
+	if doc["created"] != int64(1609589045000) {
+		t.Fatalf("Expected epoch millis but got %v", doc["created"])
+	}
+}
+
+func TestArrayUpdateChanges(t *testing.T) {
+	id := bson.NewObjectId()
+	desc := map[string]interface{}{
+		"updatedFields": map[string]interface{}{
+			"editors.12":      id,
+			"editors.3.role":  "owner",
+			"meta.updated_by": "bob",
+		},
+		"removedFields":   []interface{}{"draft"},
+		"truncatedArrays": []interface{}{map[string]interface{}{"field": "users", "newSize": 2}},
+	}
+	changes, ok := arrayUpdateChanges("db.docs", desc)
+	if !ok || len(changes) != 5 {
+		t.Fatalf("Expected 5 changes but got %v", changes)
+	}
+	expected := []string{
+		"truncate [users] <nil> 2",
+		"unset [draft] <nil> <nil>",
+		"set [editors 12] \"" + id.Hex() + "\" <nil>",
+		"set [editors 3 role] \"owner\" <nil>",
+		"set [meta updated_by] \"bob\" <nil>",
+	}
+	for i, c := range changes {
+		value := "<nil>"
+		if c["value"] != nil {
+			b, _ := json.Marshal(c["value"])
+			value = string(b)
+		}
+		if got := fmt.Sprint(c["op"], " ", c["path"], " ", value, " ", c["length"]); got != expected[i] {
+			t.Fatalf("Expected change %d to be %s but got %s", i, expected[i], got)
+		}
+	}
+	if _, ok := arrayUpdateChanges("db.docs", map[string]interface{}{"updatedFields": map[string]interface{}{}}); ok {
+		t.Fatalf("Expected an empty update description to have no changes")
+	}
+	fieldExclusions["db.docs"] = [][]string{{"secret"}}
+	defer delete(fieldExclusions, "db.docs")
+	if _, ok := arrayUpdateChanges("db.docs", desc); ok {
+		t.Fatalf("Expected changes to be refused when fields are excluded")
+	}
+}
+
+func TestDeleteRouting(t *testing.T) {
+	defer func() {
+		delete(deleteRoutings, "db.cached")
+		delete(deleteRoutings, "db.saved")
+	}()
+	config := &configOptions{DeleteRouting: []deleteRouting{
+		{Namespace: "db.cached", Strategy: "cache", CacheSize: 2},
+		{Namespace: "db.saved", Strategy: "stateful"},
+	}}
+	config.loadDeleteRoutings()
+	if config.deleteStrategyOf("db.cached") != cacheDeleteStrategy || config.deleteStrategyOf("db.other") != statelessDeleteStrategy {
+		t.Fatalf("Expected the delete strategy of the namespace to override the default")
+	}
+	if !config.usesStatefulDeletes() {
+		t.Fatalf("Expected a stateful namespace to need the meta collection")
+	}
+	meta := &indexingMeta{Routing: "tenant1"}
+	if !meta.shouldSave(config, "db.saved") || meta.shouldSave(config, "db.cached") {
+		t.Fatalf("Expected routing to be saved only for the stateful namespace")
+	}
+	dr := deleteRoutings["db.cached"]
+	dr.remember("1", routedCopy{Index: "docs-a", Routing: "tenant1"})
+	dr.remember("2", routedCopy{Index: "docs-b", Routing: "tenant2"})
+	dr.remember("3", routedCopy{Index: "docs-c", Routing: "tenant3"})
+	if _, ok := dr.take("1"); ok {
+		t.Fatalf("Expected the oldest entry to be evicted")
+	}
+	if c, ok := dr.take("3"); !ok || c.Index != "docs-c" || c.Routing != "tenant3" {
+		t.Fatalf("Unexpected cached routing %v", c)
+	}
+	if _, ok := dr.take("3"); ok {
+		t.Fatalf("Expected the routing of a deleted document to be forgotten")
+	}
+	var missing *deleteRouting
+	missing.remember("1", routedCopy{})
+	if _, ok := missing.take("1"); ok {
+		t.Fatalf("Expected nothing to be cached without a cache")
+	}
+}
+
+func TestPreviewDocuments(t *testing.T) {
+	config := &configOptions{}
+	created := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	docs := []map[string]interface{}{
+		{"_id": 1, "name": "a", "count": 2, "created": created},
+		{"_id": 2, "name": "b", "count": 2.5, "address": map[string]interface{}{"city": "x"}},
+	}
+	p, err := previewDocuments(nil, config, "db.Users", docs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if p.Sampled != 2 || p.Skipped != 0 || len(p.Documents) != 2 {
+		t.Fatalf("Expected 2 previewed documents but got %d of %d", len(p.Documents), p.Sampled)
+	}
+	if d := p.Documents[0]; d.Index != "db.users" || d.ID != "1" {
+		t.Fatalf("Expected document 1 in db.users but got %s in %s", d.ID, d.Index)
+	}
+	data, _ := json.Marshal(p.Mappings["db.users"])
+	expected := `{"properties":{"address":{"properties":{"city":{"type":"keyword"}}},"count":{"type":"double"},"created":{"type":"date"},"name":{"type":"keyword"}}}`
+	if string(data) != expected {
+		t.Fatalf("Expected mapping %s but got %s", expected, data)
+	}
+	if _, rest, err := parseSubcommand([]string{"preview", "-ns", "db.users"}); err != nil || len(rest) != 2 {
+		t.Fatalf("Expected preview subcommand")
+	}
+}
+
+func TestLanguageRouting(t *testing.T) {
+	defer func() {
+		languageRoutings = make(map[string]*languageRouting)
+		indexTemplates = make(map[string]*indexTemplate)
+		routingNamespaces = make(map[string]bool)
+		delete(partialUpdateNamespaces, "db.posts")
+	}()
+	config := &configOptions{LanguageRouting: []languageRouting{
+		{Namespace: "db.posts", Fields: []string{"title", "body.text"}, Languages: []string{"en", "de"}},
+		{Namespace: "db.pages", Fields: []string{"content"}, Languages: []string{"fr"}, Mode: "index",
+			LanguageField: "lang", Default: "en", Analyzers: map[string]string{"fr": "french_light"}},
+	}}
+	config.loadLanguageRoutings()
+	partialUpdateNamespaces["db.posts"] = true
+	update := &gtm.Op{Namespace: "db.posts", Operation: "u", Source: gtm.OplogQuerySource}
+	if isPartialUpdate(config, update) {
+		t.Fatalf("Expected no partial updates of language routed fields")
+	}
+	op := &gtm.Op{Namespace: "db.posts", Data: map[string]interface{}{
+		"language": "de-AT", "title": "Hallo", "body": map[string]interface{}{"text": "Welt"},
+	}}
+	languageRoutings["db.posts"].apply(config, op, &indexingMeta{})
+	data, _ := json.Marshal(op.Data)
+	if expected := `{"body":{"text":{"de":"Welt"}},"language":"de-AT","title":{"de":"Hallo"}}`; string(data) != expected {
+		t.Fatalf("Expected %s but got %s", expected, data)
+	}
+	op = &gtm.Op{Namespace: "db.posts", Data: map[string]interface{}{"language": "ja", "title": "x"}}
+	languageRoutings["db.posts"].apply(config, op, &indexingMeta{})
+	if title, _ := json.Marshal(op.Data["title"]); string(title) != `{"und":"x"}` {
+		t.Fatalf("Expected an unsupported language to use und but got %s", title)
+	}
+	mapping, _ := json.Marshal(indexTemplates["db.posts"].Mappings["properties"].(map[string]interface{})["title"])
+	if expected := `{"properties":{"de":{"analyzer":"german","type":"text"},"en":{"analyzer":"english","type":"text"},"und":{"analyzer":"standard","type":"text"}}}`; string(mapping) != expected {
+		t.Fatalf("Expected mapping %s but got %s", expected, mapping)
+	}
+	meta := &indexingMeta{}
+	op = &gtm.Op{Namespace: "db.pages", Data: map[string]interface{}{"lang": "FR", "content": "Bonjour"}}
+	languageRoutings["db.pages"].apply(config, op, meta)
+	if meta.Index != "db.pages-fr" || op.Data["content"] != "Bonjour" || !routingNamespaces["db.pages"] {
+		t.Fatalf("Expected the document to be routed to db.pages-fr but got %s", meta.Index)
+	}
+	templates := languageRoutings["db.pages"].templates()
+	if len(templates) != 2 || templates[1].Name != "monstache-db.pages-fr" || templates[1].IndexPatterns[0] != "db.pages-fr" {
+		t.Fatalf("Expected a template per language but got %d", len(templates))
+	}
+	if m, _ := json.Marshal(templates[1].Mappings); string(m) != `{"properties":{"content":{"analyzer":"french_light","type":"text"}}}` {
+		t.Fatalf("Unexpected language template mapping %s", m)
+	}
+}
+
+func TestNATSSink(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	defer ln.Close()
+	type published struct {
+		subject, hdr, data string
+	}
+	messages := make(chan published, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(conn, "INFO {\"headers\":true}\r\n")
+		r := bufio.NewReader(conn)
+		seen := make(map[string]bool)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch fields[0] {
+			case "PING":
+				fmt.Fprint(conn, "PONG\r\n")
+			case "HPUB":
+				hdrLen, _ := strconv.Atoi(fields[3])
+				total, _ := strconv.Atoi(fields[4])
+				body := make([]byte, total+2)
+				io.ReadFull(r, body)
+				hdr := string(body[:hdrLen])
+				ack := fmt.Sprintf(`{"stream":"CDC","seq":%d,"duplicate":%t}`, len(seen)+1, seen[hdr])
+				seen[hdr] = true
+				fmt.Fprintf(conn, "MSG %s 1 %d\r\n%s\r\n", fields[2], len(ack), ack)
+				messages <- published{fields[1], hdr, string(body[hdrLen:total])}
+			}
+		}
+	}()
+	s := &natsSink{URL: "nats://" + ln.Addr().String(), Payload: "id", BatchSize: 10}
+	s.start()
+	index := &sinkEvent{Operation: "index", Namespace: "db.my col", ID: "1", Doc: map[string]interface{}{"a": 1}, position: 42}
+	for _, ev := range []*sinkEvent{index, {Operation: "delete", Namespace: "db.col", ID: "2"}, index} {
+		if err = s.write(ev); err != nil {
+			t.Fatalf("Unexpected write error: %s", err)
+		}
+	}
+	if err = s.close(); err != nil {
+		t.Fatalf("Unexpected close error: %s", err)
+	}
+	first, second, third := <-messages, <-messages, <-messages
+	if first.subject != "monstache.db.my_col" || second.subject != "monstache.db.col" {
+		t.Fatalf("Unexpected subjects %s and %s", first.subject, second.subject)
+	}
+	if !strings.Contains(first.hdr, "Nats-Msg-Id: db.my col:1:index:42\r\n") || first.hdr != third.hdr {
+		t.Fatalf("Expected the id of the resume position in both publishes but got %q and %q", first.hdr, third.hdr)
+	}
+	if !strings.Contains(second.hdr, "Monstache-Operation: delete\r\n") {
+		t.Fatalf("Expected the operation header but got %q", second.hdr)
+	}
+	if strings.Contains(first.data, `"document"`) || !strings.Contains(first.data, `"id":"1"`) {
+		t.Fatalf("Expected the id payload but got %s", first.data)
+	}
+	if err = natsAckError([]byte("NATS/1.0 503\r\n\r\n"), nil); err == nil {
+		t.Fatalf("Expected an error for a subject without a stream")
+	}
+}
+
+// newTestElasticClient returns a client of a stub Elasticsearch server
+func newTestElasticClient(t *testing.T, handler http.HandlerFunc) *elastic.Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client, err := elastic.NewClient(elastic.SetURL(server.URL), elastic.SetSniff(false),
+		elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatalf("Unable to create client: %s", err)
+	}
+	return client
+}
+
+func TestBulkGate(t *testing.T) {
+	var requests int32
+	client := newTestElasticClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"took":1,"errors":false,"items":[{"delete":{"_index":"db.col","_id":"1","status":200}}]}`)
+	})
+	bulk, err := client.BulkProcessor().Workers(1).Do(context.Background())
+	if err != nil {
+		t.Fatalf("Unable to start bulk processor: %s", err)
+	}
+	defer bulkState.set(false)
+	req := elastic.NewBulkDeleteRequest().Index("db.col").Id("1")
+	if !bulkState.add(bulk, req) {
+		t.Fatalf("Expected the request to be added to a running processor")
+	}
+	orphans := &orphanSweeper{bulk: bulk, interval: time.Hour}
+	orphans.start()
+	orphans.stop()
+	stopBulks(bulk)
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Fatalf("Expected the request to be flushed when stopping")
+	}
+	if bulkState.add(bulk, req) || !orphans.stopped() {
+		t.Fatalf("Expected requests to a stopped processor to be refused")
+	}
+	policy := &bulkErrorPolicy{Retries: 1, BackoffMs: 1, MaxBackoffMs: 1}
+	if !policy.retry(bulk, req) {
+		t.Fatalf("Expected a retry")
+	}
+	time.Sleep(20 * time.Millisecond)
+	startBulks(bulk)
+	defer bulk.Stop()
+	if !bulkState.add(bulk, req) {
+		t.Fatalf("Expected requests to be added once restarted")
+	}
+}
+
+func TestSinkRequeue(t *testing.T) {
+	var lock sync.Mutex
+	var published []string
+	var fail bool
+	kafka := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		dec := json.NewDecoder(r.Body)
+		for dec.More() {
+			var record map[string]interface{}
+			dec.Decode(&record)
+			id := fmt.Sprint(record["key"].(map[string]interface{})["data"])
+			if fail && id == "2" {
+				fmt.Fprintln(w, `{"error_code":500,"message":"unavailable"}`)
+				continue
+			}
+			published = append(published, id)
+			fmt.Fprintln(w, `{"error_code":200}`)
+		}
+	}))
+	defer kafka.Close()
+	ks := &kafkaSink{RestURL: kafka.URL, ClusterID: "c1", BatchSize: 100}
+	ks.start()
+	defer close(ks.stopC)
+	var imports []string
+	typesense := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		imports = append(imports, r.Method+" "+r.URL.Query().Get("action"))
+		body, _ := ioutil.ReadAll(r.Body)
+		for range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			fmt.Fprintln(w, `{"success":true}`)
+		}
+	}))
+	defer typesense.Close()
+	ts := &typesenseSink{URL: typesense.URL, BatchSize: 100}
+	if err := ts.start(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	defer close(ts.stopC)
+	sinks = []sink{ks, ts}
+	defer func() { sinks = nil }()
+	fail = true
+	for i := 1; i <= 3; i++ {
+		emitSinkEvent(&sinkEvent{Operation: "index", Namespace: "db.col", ID: fmt.Sprint(i), Doc: map[string]interface{}{"i": i}})
+	}
+	emitSinkEvent(&sinkEvent{Operation: "delete", Namespace: "db.col", ID: "1"})
+	if err := flushSinks(); err == nil {
+		t.Fatalf("Expected the flush to report the failed writes")
+	}
+	if strings.Join(published, ",") != "1,3,1" || len(imports) != 0 {
+		t.Fatalf("Expected the failed changes to stay queued but got %v and %v", published, imports)
+	}
+	fail = false
+	if err := flushSinks(); err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if strings.Join(published, ",") != "1,3,1,2" {
+		t.Fatalf("Expected the failed record to be published again but got %v", published)
+	}
+	if strings.Join(imports, ",") != "POST upsert,DELETE " || ts.pending != 0 {
+		t.Fatalf("Expected the queued runs to be applied in order but got %v", imports)
+	}
+	if err := flushSinks(); err != nil || len(published) != 4 || len(imports) != 2 {
+		t.Fatalf("Expected nothing left to flush")
+	}
+}
+
+func TestIndexBulkProcessors(t *testing.T) {
+	var lock sync.Mutex
+	sent := make(map[string]int)
+	client := newTestElasticClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var items []string
+		dec := json.NewDecoder(r.Body)
+		lock.Lock()
+		for dec.More() {
+			var action map[string]map[string]interface{}
+			var doc map[string]interface{}
+			dec.Decode(&action)
+			dec.Decode(&doc)
+			sent[fmt.Sprint(action["index"]["_index"])]++
+			items = append(items, `{"index":{"status":201}}`)
+		}
+		lock.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"took":1,"errors":false,"items":[%s]}`, strings.Join(items, ","))
+	})
+	sentTo := func(index string) int {
+		lock.Lock()
+		defer lock.Unlock()
+		return sent[index]
+	}
+	indexBulkSettings["logs"] = &indexBulk{Index: "logs", MaxDocs: 1}
+	defer func() {
+		delete(indexBulkSettings, "logs")
+		delete(indexBulks, "logs")
+		bulkState.set(false)
+	}()
+	config := &configOptions{ElasticMaxConns: 1, ElasticMaxDocs: 100, ElasticMaxBytes: 1 << 20}
+	if err := config.newIndexBulkProcessors(client); err != nil {
+		t.Fatalf("Unable to start index bulk processors: %s", err)
+	}
+	bulk, err := config.newBulkProcessor(client)
+	if err != nil {
+		t.Fatalf("Unable to start bulk processor: %s", err)
+	}
+	logs := indexBulks["logs"]
+	if logs == nil || bulkForIndex(bulk, "Logs") != logs || bulkForIndex(bulk, "orders") != bulk {
+		t.Fatalf("Expected requests for logs to go to its dedicated bulk processor")
+	}
+	add := func(index, id string) {
+		bulkForIndex(bulk, index).Add(elastic.NewBulkIndexRequest().Index(index).Type("_doc").Id(id).Doc(map[string]interface{}{"id": id}))
+	}
+	add("logs", "1")
+	add("orders", "1")
+	for i := 0; i < 100 && sentTo("logs") == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if sentTo("logs") != 1 || sentTo("orders") != 0 {
+		t.Fatalf("Expected logs to be sent after each document and orders to be held but got %v", sent)
+	}
+	flushBulks(bulk)
+	if sentTo("orders") != 1 {
+		t.Fatalf("Expected flushing to send the held orders but got %v", sent)
+	}
+	add("orders", "2")
+	stopBulks(bulk)
+	if sentTo("orders") != 2 {
+		t.Fatalf("Expected stopping to send the held orders but got %v", sent)
+	}
+	startBulks(bulk)
+	add("logs", "2")
+	add("orders", "3")
+	flushBulks(bulk)
+	stopBulks(bulk)
+	if sentTo("logs") != 2 || sentTo("orders") != 3 {
+		t.Fatalf("Expected the restarted processors to send documents but got %v", sent)
+	}
+}
+
+func TestVerboseLogging(t *testing.T) {
+	var buf bytes.Buffer
+	out := traceLog.Writer()
+	traceLog.SetOutput(&buf)
+	defer traceLog.SetOutput(out)
+	setVerbose(false)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &traceTransport{transport: http.DefaultTransport}}
+	get := func() {
+		resp, err := client.Get(server.URL + "/_cluster/health")
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != `{"acknowledged":true}` {
+			t.Fatalf("Expected the response body to be intact but got %s", body)
+		}
+	}
+	reloader, _ := newConfigReloader(&configOptions{})
+	get()
+	if buf.Len() != 0 {
+		t.Fatalf("Expected no trace output but got %s", buf.String())
+	}
+	on, off := true, false
+	if level := reloader.setLogLevel(&logLevel{Verbose: &on}); !*level.Verbose {
+		t.Fatalf("Expected verbose logging to be on")
+	}
+	get()
+	if trace := buf.String(); !strings.Contains(trace, "GET /_cluster/health") || !strings.Contains(trace, `{"acknowledged":true}`) {
+		t.Fatalf("Expected the request and response to be traced but got %s", trace)
+	}
+	reloader.setLogLevel(&logLevel{Verbose: &off})
+	buf.Reset()
+	get()
+	verboseLogger{traceLog}.Printf("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("Expected no trace output after verbose logging was switched off but got %s", buf.String())
+	}
+}
+
+func TestIngestPipelines(t *testing.T) {
+	f, err := ioutil.TempFile("", "monstache-pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, `{"processors":[{"attachment":{"field":"data"}}]}`)
+	f.Close()
+	config := &configOptions{IngestPipeline: []ingestPipeline{
+		{Namespace: "db.files", Name: "attachments", Path: f.Name()},
+		{Namespace: "db.archive", Name: "attachments", Path: f.Name()},
+		{Namespace: "db.visits", Name: "geoip"},
+	}}
+	config.loadIngestPipelines()
+	defer func() {
+		for _, p := range config.IngestPipeline {
+			delete(ingestPipelines, p.Namespace)
+		}
+	}()
+	if ip := namespacePipeline("db.files"); ip == nil || ip.Name != "attachments" || ip.definition == nil {
+		t.Fatalf("Expected the pipeline definition to be loaded but got %v", ip)
+	}
+	if ip := namespacePipeline("db.visits"); ip == nil || ip.definition != nil {
+		t.Fatalf("Expected a pipeline without a definition to be assigned only but got %v", ip)
+	}
+	if ip := namespacePipeline("db.other"); ip != nil {
+		t.Fatalf("Expected no pipeline for an unassigned namespace but got %v", ip)
+	}
+	var lock sync.Mutex
+	var puts []string
+	client := newTestElasticClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		if !bytes.Contains(body, []byte("attachment")) {
+			t.Errorf("Unexpected pipeline definition %s", body)
+		}
+		puts = append(puts, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	})
+	if err := ensureIngestPipelines(client); err != nil {
+		t.Fatalf("Unable to install the pipelines: %s", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(puts) != 1 || puts[0] != "PUT /_ingest/pipeline/attachments" {
+		t.Fatalf("Expected the shared pipeline to be installed once but got %v", puts)
+	}
+}
+
+func TestIngestPipelineConflict(t *testing.T) {
+	f, err := ioutil.TempFile("", "monstache-pipeline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	fmt.Fprint(f, `{"processors":[]}`)
+	f.Close()
+	config := &configOptions{IngestPipeline: []ingestPipeline{
+		{Namespace: "db.files", Name: "attachments", Path: f.Name()},
+		{Namespace: "db.archive", Name: "attachments", Path: f.Name() + ".other"},
+	}}
+	defer delete(ingestPipelines, "db.files")
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(fmt.Sprint(r), "defined by multiple files") {
+			t.Fatalf("Expected a panic for a pipeline defined twice but got %v", r)
+		}
+	}()
+	config.loadIngestPipelines()
+}
+
+func TestRolloverConditions(t *testing.T) {
+	config := &configOptions{Rollover: []rollover{{Namespace: "db.logs", MaxAge: "7d", MaxDocs: 1000}}}
+	config.loadRollovers()
+	defer delete(rollovers, "db.logs")
+	ro := rollovers["db.logs"]
+	if ro.CheckSeconds != 60 {
+		t.Fatalf("Expected the default check interval but got %d", ro.CheckSeconds)
+	}
+	conditions := ro.conditions()
+	if len(conditions) != 2 || conditions["max_age"] != "7d" || conditions["max_docs"] != int64(1000) {
+		t.Fatalf("Unexpected rollover conditions %v", conditions)
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Fatalf("Expected a panic for a rollover without conditions")
+		}
+	}()
+	config = &configOptions{Rollover: []rollover{{Namespace: "db.events"}}}
+	config.loadRollovers()
+}
+
+func TestEnsureAlias(t *testing.T) {
+	var lock sync.Mutex
+	var aliasStatus, indexStatus int
+	var requests []string
+	var created map[string]interface{}
+	client := newTestElasticClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "HEAD" && strings.HasPrefix(r.URL.Path, "/_alias/"):
+			w.WriteHeader(aliasStatus)
+		case r.Method == "HEAD":
+			w.WriteHeader(indexStatus)
+		default:
+			json.Unmarshal(body, &created)
+			fmt.Fprint(w, `{"acknowledged":true}`)
+		}
+	})
+	config := &configOptions{ElasticMajorVersion: 7}
+	ro := &rollover{Namespace: "db.logs", MaxDocs: 1}
+	reset := func(alias, index int) {
+		lock.Lock()
+		defer lock.Unlock()
+		aliasStatus, indexStatus, requests, created = alias, index, nil, nil
+	}
+	reset(200, 404)
+	if err := ro.ensureAlias(client, config, "logs"); err != nil || len(requests) != 1 {
+		t.Fatalf("Expected an existing alias to be kept but got %v: %v", err, requests)
+	}
+	reset(404, 200)
+	if err := ro.ensureAlias(client, config, "logs"); err == nil || len(requests) != 2 {
+		t.Fatalf("Expected an index named like the alias to be refused but got %v: %v", err, requests)
+	}
+	reset(404, 404)
+	if err := ro.ensureAlias(client, config, "logs"); err != nil {
+		t.Fatalf("Unable to create the rollover alias: %s", err)
+	}
+	if len(requests) != 3 || requests[2] != "PUT /logs-000001" {
+		t.Fatalf("Expected the first index to be created but got %v", requests)
+	}
+	aliases, _ := created["aliases"].(map[string]interface{})
+	if alias, _ := aliases["logs"].(map[string]interface{}); alias["is_write_index"] != true {
+		t.Fatalf("Expected the first index to be the write index of the alias but got %v", created)
+	}
+}
+
+func TestClassifyBulkError(t *testing.T) {
+	items := map[string]*elastic.BulkResponseItem{
+		"rejected": {Status: 429},
+		"conflict": {Status: 409},
+		"mapping":  {Status: 400, Error: &elastic.ErrorDetails{Type: "mapper_parsing_exception"}},
+		"other":    {Status: 500, Error: &elastic.ErrorDetails{Type: "exception"}},
+	}
+	for class, item := range items {
+		if c := classifyBulkError(item); c != class {
+			t.Fatalf("Expected class %s but got %s", class, c)
+		}
+	}
+	p := &bulkErrorPolicy{BackoffMs: 100, MaxBackoffMs: 300}
+	if b := p.backoff(1); b != 200*time.Millisecond {
+		t.Fatalf("Expected backoff to double but got %s", b)
+	}
+	if b := p.backoff(5); b != 300*time.Millisecond {
+		t.Fatalf("Expected backoff to be capped but got %s", b)
+	}
+}
+
+func TestBackpressure(t *testing.T) {
+	bp := newBackpressure(5, []*pressuredBulk{{workers: 4, interval: time.Second}, {workers: 2}})
+	bp.rejected()
+	if bp.allowed() != 2 || bp.pause() != 500*time.Millisecond {
+		t.Fatalf("Expected reduced workers and longer pause at level 1")
+	}
+	if bp.allowedBulks() != 3 || bp.flushInterval(time.Second) != 2*time.Second {
+		t.Fatalf("Expected fewer bulk requests in flight and a longer flush interval at level 1")
+	}
+	bp.rejected()
+	if bp.level != 1 {
+		t.Fatalf("Expected rejections during the pause to keep the level")
+	}
+	bp.until = time.Now()
+	bp.rejected()
+	if bp.level != 2 || bp.allowedBulks() != 1 {
+		t.Fatalf("Expected a rejection after the pause to raise the level")
+	}
+	bp.beginBulk()
+	started := make(chan bool)
+	go func() {
+		bp.beginBulk()
+		close(started)
+		bp.endBulk()
+	}()
+	select {
+	case <-started:
+		t.Fatalf("Expected the bulk request to wait for the one in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+	bp.endBulk()
+	<-started
+	bp.level = 1
+	bp.succeeded()
+	if bp.level != 1 {
+		t.Fatalf("Expected level to be kept until the decay period passes")
+	}
+	bp.lastChange = time.Now().Add(-backpressureDecay)
+	bp.succeeded()
+	if bp.level != 0 || bp.allowed() != 5 {
+		t.Fatalf("Expected full concurrency after recovery")
+	}
+}
+
+func TestExcludeFields(t *testing.T) {
+	fieldExclusions["db.users"] = fieldPaths([]string{"password", "profile.ssn", "cards.number"})
+	defer delete(fieldExclusions, "db.users")
+	op := &gtm.Op{
+		Namespace: "db.users",
+		Data: map[string]interface{}{
+			"name":     "a",
+			"password": "secret",
+			"profile":  map[string]interface{}{"ssn": "1", "age": 2},
+			"cards": []interface{}{
+				map[string]interface{}{"number": "4111", "brand": "visa"},
+			},
+		},
+	}
+	excludeFields(op)
+	profile := op.Data["profile"].(map[string]interface{})
+	card := op.Data["cards"].([]interface{})[0].(map[string]interface{})
+	if _, ok := op.Data["password"]; ok || profile["ssn"] != nil || card["number"] != nil {
+		t.Fatalf("Expected excluded fields to be removed but got %v", op.Data)
+	}
+	if op.Data["name"] != "a" || profile["age"] != 2 || card["brand"] != "visa" {
+		t.Fatalf("Expected other fields to be kept but got %v", op.Data)
+	}
+}
+
+func TestInferProperties(t *testing.T) {
+	docs := []map[string]interface{}{
+		{"_id": 1, "name": "abc", "count": 1, "at": time.Now(), "loc": map[string]interface{}{"lat": 1.0, "lon": 2.0}},
+		{"_id": 2, "name": "a longer description with spaces", "count": 1.5, "tags": []interface{}{"x", "y"}},
+	}
+	var props map[string]interface{}
+	for _, doc := range docs {
+		props = inferProperties(doc, props)
+	}
+	expect := map[string]string{"name": "text", "count": "double", "at": "date", "loc": "geo_point", "tags": "keyword"}
+	for field, typ := range expect {
+		if m := asMapping(props[field]); m["type"] != typ {
+			t.Fatalf("Expected %s to be %s but got %v", field, typ, m)
+		}
+	}
+	if _, ok := props["_id"]; ok {
+		t.Fatalf("Expected _id to be excluded from the mapping")
+	}
+}
+
+func TestCoerceFields(t *testing.T) {
+	coercions["db.coerce"] = []*coercion{
+		{Field: "created", Type: "date", Format: "2006-01-02", OnError: "keep"},
+		{Field: "items.qty", Type: "long", OnError: "drop-field"},
+		{Field: "price", Type: "double", OnError: "null"},
+	}
+	defer delete(coercions, "db.coerce")
+	op := &gtm.Op{
+		Namespace: "db.coerce",
+		Data: map[string]interface{}{
+			"created": "2019-07-01",
+			"price":   "n/a",
+			"items": []interface{}{
+				map[string]interface{}{"qty": "3"},
+				map[string]interface{}{"qty": "x"},
+			},
+		},
+	}
+	if !coerceFields(op) {
+		t.Fatalf("Expected document to be kept")
+	}
+	if created, ok := op.Data["created"].(time.Time); !ok || created.Year() != 2019 {
+		t.Fatalf("Expected created to be a date but got %v", op.Data["created"])
+	}
+	items := op.Data["items"].([]interface{})
+	if items[0].(map[string]interface{})["qty"] != int64(3) {
+		t.Fatalf("Expected qty to be coerced but got %v", items[0])
+	}
+	if _, ok := items[1].(map[string]interface{})["qty"]; ok {
+		t.Fatalf("Expected invalid qty to be dropped")
+	}
+	if v, ok := op.Data["price"]; !ok || v != nil {
+		t.Fatalf("Expected invalid price to be null")
+	}
+	coercions["db.coerce"] = []*coercion{{Field: "price", Type: "double", OnError: "skip-document"}}
+	op.Data["price"] = "n/a"
+	if coerceFields(op) {
+		t.Fatalf("Expected document to be skipped")
+	}
+}
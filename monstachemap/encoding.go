@@ -3,15 +3,24 @@ package monstachemap
 import (
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/globalsign/mgo/bson"
 )
 
 const timeJsonFormat = "2006-01-02T15:04:05.000Z07:00"
 
+var uuidRepresentation = "standard"
+var binaryEncoding = "base64"
+
 type Time struct {
 	time.Time
 }
@@ -55,11 +64,64 @@ func (bi Binary) MarshalJSON() ([]byte, error) {
 	return b, nil
 }
 
+// SetBinaryEncoding configures how binary values are rendered.  uuid is the
+// byte order of legacy subtype 3 UUIDs: one of standard, java-legacy,
+// csharp-legacy or python-legacy.  other is the encoding of the remaining
+// subtypes: one of base64, hex or drop
+func SetBinaryEncoding(uuid, other string) error {
+	switch uuid {
+	case "":
+		uuid = "standard"
+	case "standard", "java-legacy", "csharp-legacy", "python-legacy":
+	default:
+		return fmt.Errorf("UUID representation %s must be one of standard, java-legacy, csharp-legacy or python-legacy", uuid)
+	}
+	switch other {
+	case "":
+		other = "base64"
+	case "base64", "hex", "drop":
+	default:
+		return fmt.Errorf("Binary encoding %s must be one of base64, hex or drop", other)
+	}
+	uuidRepresentation, binaryEncoding = uuid, other
+	return nil
+}
+
+func reverseBytes(b []byte) {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+}
+
+// uuidBytes returns the bytes of a UUID in standard order
+func uuidBytes(bi Binary) []byte {
+	data := bi.Data
+	if bi.Kind != 0x03 || len(data) != 16 {
+		return data
+	}
+	switch uuidRepresentation {
+	case "java-legacy":
+		data = append([]byte(nil), data...)
+		reverseBytes(data[0:8])
+		reverseBytes(data[8:16])
+	case "csharp-legacy":
+		data = append([]byte(nil), data...)
+		reverseBytes(data[0:4])
+		reverseBytes(data[4:6])
+		reverseBytes(data[6:8])
+	}
+	return data
+}
+
+func isDropped(bi bson.Binary) bool {
+	return binaryEncoding == "drop" && bi.Kind != 0x03 && bi.Kind != 0x04
+}
+
 func EncodeBinData(bi Binary) string {
 	var enc string
 	if bi.Kind == 0x03 || bi.Kind == 0x04 {
 		// UUID
-		hex := hex.EncodeToString(bi.Data)
+		hex := hex.EncodeToString(uuidBytes(bi))
 		if len(hex) == 32 {
 			enc = strings.Join(
 				[]string{
@@ -74,6 +136,8 @@ func EncodeBinData(bi Binary) string {
 		} else {
 			enc = hex
 		}
+	} else if binaryEncoding == "hex" {
+		enc = hex.EncodeToString(bi.Data)
 	} else {
 		// other binary types
 		enc = base64.StdEncoding.EncodeToString(bi.Data)
@@ -82,8 +146,8 @@ func EncodeBinData(bi Binary) string {
 }
 
 func ConvertSliceForJSON(a []interface{}) []interface{} {
-	var avs = make([]interface{}, len(a))
-	for i, av := range a {
+	var avs = make([]interface{}, 0, len(a))
+	for _, av := range a {
 		var avc interface{}
 		switch achild := av.(type) {
 		case map[string]interface{}:
@@ -91,6 +155,9 @@ func ConvertSliceForJSON(a []interface{}) []interface{} {
 		case []interface{}:
 			avc = ConvertSliceForJSON(achild)
 		case bson.Binary:
+			if isDropped(achild) {
+				continue
+			}
 			avc = Binary{achild}
 		case bson.Decimal128:
 			avc = Decimal128{achild}
@@ -99,7 +166,7 @@ func ConvertSliceForJSON(a []interface{}) []interface{} {
 		default:
 			avc = av
 		}
-		avs[i] = avc
+		avs = append(avs, avc)
 	}
 	return avs
 }
@@ -113,7 +180,9 @@ func ConvertMapForJSON(m map[string]interface{}) map[string]interface{} {
 		case []interface{}:
 			o[k] = ConvertSliceForJSON(child)
 		case bson.Binary:
-			o[k] = Binary{child}
+			if !isDropped(child) {
+				o[k] = Binary{child}
+			}
 		case bson.Decimal128:
 			o[k] = Decimal128{child}
 		case time.Time:
@@ -124,3 +193,171 @@ func ConvertMapForJSON(m map[string]interface{}) map[string]interface{} {
 	}
 	return o
 }
+
+// Document is a document which is converted for JSON as it is encoded
+// rather than copied with ConvertMapForJSON beforehand.  The encoding is the
+// same as that of json.Marshal on the converted copy
+type Document map[string]interface{}
+
+func (doc Document) MarshalJSON() ([]byte, error) {
+	return appendMapJSON(make([]byte, 0, 512), doc)
+}
+
+func appendMapJSON(b []byte, m map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k, v := range m {
+		if bi, ok := v.(bson.Binary); ok && isDropped(bi) {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var err error
+	b = append(b, '{')
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = appendStringJSON(b, k)
+		b = append(b, ':')
+		if b, err = appendValueJSON(b, m[k]); err != nil {
+			return nil, err
+		}
+	}
+	return append(b, '}'), nil
+}
+
+func appendSliceJSON(b []byte, a []interface{}) ([]byte, error) {
+	var err error
+	first := true
+	b = append(b, '[')
+	for _, v := range a {
+		if bi, ok := v.(bson.Binary); ok && isDropped(bi) {
+			continue
+		}
+		if !first {
+			b = append(b, ',')
+		}
+		first = false
+		if b, err = appendValueJSON(b, v); err != nil {
+			return nil, err
+		}
+	}
+	return append(b, ']'), nil
+}
+
+func appendValueJSON(b []byte, v interface{}) ([]byte, error) {
+	switch val := v.(type) {
+	case nil:
+		return append(b, "null"...), nil
+	case map[string]interface{}:
+		return appendMapJSON(b, val)
+	case []interface{}:
+		return appendSliceJSON(b, val)
+	case string:
+		return appendStringJSON(b, val), nil
+	case bool:
+		return strconv.AppendBool(b, val), nil
+	case int:
+		return strconv.AppendInt(b, int64(val), 10), nil
+	case int32:
+		return strconv.AppendInt(b, int64(val), 10), nil
+	case int64:
+		return strconv.AppendInt(b, val, 10), nil
+	case float64:
+		return appendFloatJSON(b, val)
+	case bson.ObjectId:
+		return appendStringJSON(b, val.Hex()), nil
+	case time.Time:
+		if y := val.Year(); y < 0 || y >= 10000 {
+			return nil, errors.New("Time.MarshalJSON: year outside of range [0,9999]")
+		}
+		b = append(b, '"')
+		b = val.AppendFormat(b, timeJsonFormat)
+		return append(b, '"'), nil
+	case bson.Binary:
+		b = append(b, '"')
+		b = append(b, EncodeBinData(Binary{val})...)
+		return append(b, '"'), nil
+	case bson.Decimal128:
+		enc, _ := Decimal128{val}.MarshalJSON()
+		return append(b, enc...), nil
+	default:
+		enc, err := json.Marshal(val)
+		if err != nil {
+			return nil, err
+		}
+		return append(b, enc...), nil
+	}
+}
+
+// appendFloatJSON formats f like encoding/json
+func appendFloatJSON(b []byte, f float64) ([]byte, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, fmt.Errorf("json: unsupported value: %s", strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	b = strconv.AppendFloat(b, f, format, -1, 64)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(b)
+		if n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return b, nil
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendStringJSON quotes s with the HTML safe escaping of encoding/json
+func appendStringJSON(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&' {
+				i++
+				continue
+			}
+			b = append(b, s[start:i]...)
+			switch c {
+			case '"', '\\':
+				b = append(b, '\\', c)
+			case '\n':
+				b = append(b, '\\', 'n')
+			case '\r':
+				b = append(b, '\\', 'r')
+			case '\t':
+				b = append(b, '\\', 't')
+			default:
+				b = append(b, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xF])
+			}
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, s[start:i]...)
+			b = append(b, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			b = append(b, s[start:i]...)
+			b = append(b, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
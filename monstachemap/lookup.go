@@ -0,0 +1,179 @@
+package monstachemap
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Batcher coalesces lookups of documents by the value of a field made by
+// concurrent Map calls.  Lookups of the same field of a collection made
+// within the batch window are answered by a single $in query
+type Batcher struct {
+	Session  *mgo.Session  // MongoDB session handle copied for each query
+	Window   time.Duration // how long to wait for more lookups of a field
+	MaxBatch int           // the max number of values in a single query
+	// Query finds the documents whose field matches any of the values.
+	// Defaults to an $in query using Session
+	Query   func(db, col, field string, values []interface{}) ([]map[string]interface{}, error)
+	lock    sync.Mutex
+	pending map[batchKey]*batch
+}
+
+type batchKey struct {
+	db, col, field string
+}
+
+type batch struct {
+	values  []interface{}
+	waiters map[interface{}][]chan batchResult
+	timer   *time.Timer
+}
+
+type batchResult struct {
+	docs []map[string]interface{}
+	err  error
+}
+
+// NewBatcher returns a Batcher querying session.  A window of 0 defaults
+// to 5 milliseconds and a max batch of 0 to 500 values
+func NewBatcher(session *mgo.Session, window time.Duration, maxBatch int) *Batcher {
+	if window <= 0 {
+		window = 5 * time.Millisecond
+	}
+	if maxBatch <= 0 {
+		maxBatch = 500
+	}
+	return &Batcher{
+		Session:  session,
+		Window:   window,
+		MaxBatch: maxBatch,
+		pending:  make(map[batchKey]*batch),
+	}
+}
+
+// Find returns the documents of db.col whose field matches value.  Nested
+// fields are given in dot notation
+func (b *Batcher) Find(db, col, field string, value interface{}) ([]map[string]interface{}, error) {
+	key := batchKey{db, col, field}
+	result := make(chan batchResult, 1)
+	b.lock.Lock()
+	bt := b.pending[key]
+	if bt == nil {
+		bt = &batch{waiters: make(map[interface{}][]chan batchResult)}
+		b.pending[key] = bt
+		bt.timer = time.AfterFunc(b.Window, func() {
+			b.flush(key, bt)
+		})
+	}
+	vk := LookupKey(value)
+	if bt.waiters[vk] == nil {
+		bt.values = append(bt.values, value)
+	}
+	bt.waiters[vk] = append(bt.waiters[vk], result)
+	full := len(bt.values) >= b.MaxBatch
+	b.lock.Unlock()
+	if full {
+		b.flush(key, bt)
+	}
+	r := <-result
+	return r.docs, r.err
+}
+
+// FindOne returns the first document of db.col whose field matches value or
+// nil if there is none
+func (b *Batcher) FindOne(db, col, field string, value interface{}) (map[string]interface{}, error) {
+	docs, err := b.Find(db, col, field, value)
+	if err != nil || len(docs) == 0 {
+		return nil, err
+	}
+	return docs[0], nil
+}
+
+// FindId returns the document of db.col with the _id id or nil if there is
+// none
+func (b *Batcher) FindId(db, col string, id interface{}) (map[string]interface{}, error) {
+	return b.FindOne(db, col, "_id", id)
+}
+
+func (b *Batcher) flush(key batchKey, bt *batch) {
+	b.lock.Lock()
+	if b.pending[key] != bt {
+		b.lock.Unlock()
+		return
+	}
+	delete(b.pending, key)
+	bt.timer.Stop()
+	b.lock.Unlock()
+	query := b.Query
+	if query == nil {
+		query = b.find
+	}
+	docs, err := query(key.db, key.col, key.field, bt.values)
+	matches := make(map[interface{}][]map[string]interface{})
+	if err == nil {
+		for _, doc := range docs {
+			for _, v := range fieldValues(doc, key.field) {
+				vk := LookupKey(v)
+				matches[vk] = append(matches[vk], doc)
+			}
+		}
+	}
+	for vk, waiters := range bt.waiters {
+		for _, w := range waiters {
+			w <- batchResult{docs: matches[vk], err: err}
+		}
+	}
+}
+
+func (b *Batcher) find(db, col, field string, values []interface{}) (docs []map[string]interface{}, err error) {
+	s := b.Session.Copy()
+	defer s.Close()
+	sel := bson.M{field: bson.M{"$in": values}}
+	err = s.DB(db).C(col).Find(sel).All(&docs)
+	return
+}
+
+// fieldValues returns the values of a field in dot notation.  Arrays yield
+// each of their elements since $in matches any of them
+func fieldValues(doc map[string]interface{}, field string) []interface{} {
+	var v interface{} = doc
+	for _, name := range strings.Split(field, ".") {
+		switch m := v.(type) {
+		case map[string]interface{}:
+			v = m[name]
+		case bson.M:
+			v = m[name]
+		default:
+			return nil
+		}
+	}
+	if a, ok := v.([]interface{}); ok {
+		return a
+	}
+	return []interface{}{v}
+}
+
+// LookupKey normalizes a value for use as a map key.  Numbers of any type
+// yield the same key, as they match the same documents in MongoDB
+func LookupKey(v interface{}) interface{} {
+	switch n := v.(type) {
+	case int:
+		return float64(n)
+	case int32:
+		return float64(n)
+	case int64:
+		return float64(n)
+	case float32:
+		return float64(n)
+	}
+	if v != nil && !reflect.TypeOf(v).Comparable() {
+		return fmt.Sprintf("%v", v)
+	}
+	return v
+}
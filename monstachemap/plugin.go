@@ -1,6 +1,8 @@
 package monstachemap
 
 import (
+	"time"
+
 	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/olivere/elastic"
@@ -12,6 +14,10 @@ import (
 // plugins must implement a function named "Map" with the following signature
 // func Map(input *monstachemap.MapperPluginInput) (output *monstachemap.MapperPluginOutput, err error)
 
+// plugins may implement a function named "Sink" with the following signature
+// func Sink() (monstachemap.Sink, error)
+// the returned Sink receives the same changes as Elasticsearch
+
 // plugins can be compiled using go build -buildmode=plugin -o myplugin.so myplugin.go
 // to enable the plugin start with monstache -mapper-plugin-path /path/to/myplugin.so
 
@@ -24,6 +30,9 @@ type MapperPluginInput struct {
 	Operation         string                 // "i" for a insert or "u" for update
 	Session           *mgo.Session           // MongoDB session handle
 	UpdateDescription map[string]interface{} // map describing changes to the document
+	Span              func(string) func()    // starts a tracing span, e.g. around a lookup; call the returned func to end it
+	Lookup            *Batcher               // batches lookups of documents across concurrent Map calls into $in queries
+	References        ReferenceCache         // documents of the reference collections cached by monstache
 }
 
 // MapperPluginOutput is the output of the Map function
@@ -50,3 +59,34 @@ type ProcessPluginInput struct {
 	ElasticBulkProcessor *elastic.BulkProcessor
 	Timestamp            bson.MongoTimestamp
 }
+
+// ReferenceCache holds the documents of the reference collections which
+// monstache preloads and keeps current with change streams
+type ReferenceCache interface {
+	// Get returns the document of the reference namespace whose key field
+	// has the value key or nil.  The document is shared and must not be
+	// changed
+	Get(namespace string, key interface{}) map[string]interface{}
+}
+
+// SinkDocument is a change delivered to a Sink
+type SinkDocument struct {
+	ID                string                 // the id of the document
+	Index             string                 // the index the document would be written to in Elasticsearch
+	Namespace         string                 // the origin namespace in MongoDB
+	Timestamp         time.Time              // the time of the change
+	Document          map[string]interface{} // the mapped document; the changed fields for an update and nil for a delete
+	UpdateDescription map[string]interface{} // map describing changes to the document
+}
+
+// Sink is an output for changes implemented by plugins.  The methods are
+// called from the indexing goroutines so implementations must be safe for
+// concurrent use.  Flush is called when Elasticsearch requests are flushed
+// and before shutdown.  If the Sink also has a Close() error method it is
+// called after the final Flush
+type Sink interface {
+	Index(doc *SinkDocument) error
+	Update(doc *SinkDocument) error
+	Delete(doc *SinkDocument) error
+	Flush() error
+}
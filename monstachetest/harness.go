@@ -0,0 +1,329 @@
+// Package monstachetest starts MongoDB and Elasticsearch or OpenSearch in
+// docker containers and runs monstache against them so that plugins can be
+// tested end to end.  Tests are skipped when docker is not available.
+//
+//	func TestMapper(t *testing.T) {
+//		env := monstachetest.Start(t, monstachetest.Options{})
+//		env.Run(t, "-mapper-plugin-path", "./plugin.so", "-change-stream-namespace", "db.col")
+//		session := env.Mongo(t)
+//		defer session.Close()
+//		session.DB("db").C("col").Insert(bson.M{"_id": "1", "name": "x"})
+//		env.AssertIndexed(t, "db.col", "1", map[string]interface{}{"name": "X"}, time.Minute)
+//	}
+package monstachetest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/globalsign/mgo"
+)
+
+const (
+	mongoImageDefault      = "mongo:4.4"
+	elasticImageDefault    = "docker.elastic.co/elasticsearch/elasticsearch-oss:7.10.2"
+	openSearchImageDefault = "opensearchproject/opensearch:2.11.0"
+	startTimeoutDefault    = 3 * time.Minute
+	pollInterval           = 250 * time.Millisecond
+)
+
+// Options configure the containers started by Start
+type Options struct {
+	MongoImage   string        // defaults to mongo:4.4
+	ElasticImage string        // defaults to Elasticsearch 7 or OpenSearch 2
+	OpenSearch   bool          // start OpenSearch instead of Elasticsearch
+	StartTimeout time.Duration // how long to wait for the containers to be ready
+	// Binary is the monstache executable run by Run.  Defaults to the
+	// MONSTACHE_BIN environment variable or else a build of
+	// github.com/rwynn/monstache
+	Binary string
+}
+
+// Env is a running MongoDB replica set and search cluster
+type Env struct {
+	MongoURL   string // direct connection URL of the single member replica set
+	ElasticURL string
+	opts       Options
+	client     *http.Client
+	buildOnce  sync.Once
+	binary     string
+	buildErr   error
+}
+
+// Start starts the containers and stops them when the test ends.  The test
+// is skipped if docker is not installed or not running
+func Start(t testing.TB, opts Options) *Env {
+	t.Helper()
+	if err := exec.Command("docker", "version").Run(); err != nil {
+		t.Skipf("Skipping test which requires docker: %s", err)
+	}
+	if opts.MongoImage == "" {
+		opts.MongoImage = mongoImageDefault
+	}
+	if opts.ElasticImage == "" {
+		opts.ElasticImage = elasticImageDefault
+		if opts.OpenSearch {
+			opts.ElasticImage = openSearchImageDefault
+		}
+	}
+	if opts.StartTimeout == 0 {
+		opts.StartTimeout = startTimeoutDefault
+	}
+	env := &Env{opts: opts, client: &http.Client{Timeout: 10 * time.Second}}
+	mongo := env.container(t, "27017", opts.MongoImage, nil, "--replSet", "rs0", "--bind_ip_all")
+	env.MongoURL = fmt.Sprintf("mongodb://%s/?connect=direct", mongo.addr)
+	search := []string{"-e", "discovery.type=single-node", "-e", "ES_JAVA_OPTS=-Xms512m -Xmx512m"}
+	if opts.OpenSearch {
+		search = append(search, "-e", "DISABLE_SECURITY_PLUGIN=true", "-e", "DISABLE_INSTALL_DEMO_CONFIG=true")
+	}
+	es := env.container(t, "9200", opts.ElasticImage, search)
+	env.ElasticURL = "http://" + es.addr
+	Eventually(t, opts.StartTimeout, func() error {
+		return mongo.initiate()
+	})
+	Eventually(t, opts.StartTimeout, func() error {
+		_, err := env.request("GET", "/_cluster/health?wait_for_status=yellow&timeout=1s", nil)
+		return err
+	})
+	return env
+}
+
+type container struct {
+	id   string
+	addr string
+}
+
+// container runs an image with the port published on a random local port
+func (env *Env) container(t testing.TB, port, image string, runArgs []string, cmdArgs ...string) *container {
+	t.Helper()
+	args := append([]string{"run", "-d", "-p", "127.0.0.1::" + port}, runArgs...)
+	args = append(append(args, image), cmdArgs...)
+	out, err := exec.Command("docker", args...).Output()
+	if err != nil {
+		t.Fatalf("Unable to start container %s: %s", image, commandError(err))
+	}
+	c := &container{id: strings.TrimSpace(string(out))}
+	t.Cleanup(func() {
+		exec.Command("docker", "rm", "-f", "-v", c.id).Run()
+	})
+	out, err = exec.Command("docker", "port", c.id, port+"/tcp").Output()
+	if err != nil {
+		t.Fatalf("Unable to find the port of container %s: %s", c.id, commandError(err))
+	}
+	c.addr = strings.TrimSpace(strings.Split(string(out), "\n")[0])
+	return c
+}
+
+// initiate initiates the replica set and returns nil once the member is
+// primary.  mongosh is used with images which no longer ship the mongo shell
+func (c *container) initiate() error {
+	script := `try { rs.initiate({_id: "rs0", members: [{_id: 0, host: "127.0.0.1:27017"}]}) } catch (e) {}
+if (!db.isMaster().ismaster) { throw new Error("not primary") }`
+	var err error
+	for _, shell := range []string{"mongosh", "mongo"} {
+		if err = exec.Command("docker", "exec", c.id, shell, "--quiet", "--eval", script).Run(); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("Replica set is not ready: %s", commandError(err))
+}
+
+func commandError(err error) string {
+	if ee, ok := err.(*exec.ExitError); ok && len(ee.Stderr) > 0 {
+		return strings.TrimSpace(string(ee.Stderr))
+	}
+	return err.Error()
+}
+
+// Mongo returns a session connected to the replica set
+func (env *Env) Mongo(t testing.TB) *mgo.Session {
+	t.Helper()
+	session, err := mgo.DialWithTimeout(env.MongoURL, 30*time.Second)
+	if err != nil {
+		t.Fatalf("Unable to connect to MongoDB: %s", err)
+	}
+	return session
+}
+
+// Run starts monstache connected to the containers with the extra args and
+// stops it when the test ends.  Its output is logged if the test fails
+func (env *Env) Run(t testing.TB, args ...string) *exec.Cmd {
+	t.Helper()
+	binary, err := env.monstache()
+	if err != nil {
+		t.Fatalf("Unable to build monstache: %s", err)
+	}
+	args = append([]string{"-mongo-url", env.MongoURL, "-elasticsearch-url", env.ElasticURL}, args...)
+	cmd := exec.Command(binary, args...)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("Unable to start monstache: %s", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if t.Failed() {
+			t.Logf("monstache output:\n%s", out.String())
+		}
+	})
+	return cmd
+}
+
+// monstache returns the executable to run, building it once if needed
+func (env *Env) monstache() (string, error) {
+	if env.opts.Binary != "" {
+		return env.opts.Binary, nil
+	}
+	if bin := os.Getenv("MONSTACHE_BIN"); bin != "" {
+		return bin, nil
+	}
+	env.buildOnce.Do(func() {
+		dir, err := ioutil.TempDir("", "monstachetest")
+		if err != nil {
+			env.buildErr = err
+			return
+		}
+		env.binary = filepath.Join(dir, "monstache")
+		out, err := exec.Command("go", "build", "-o", env.binary, "github.com/rwynn/monstache").CombinedOutput()
+		if err != nil {
+			env.buildErr = fmt.Errorf("%s: %s", err, out)
+		}
+	})
+	return env.binary, env.buildErr
+}
+
+// request sends a request to the search cluster and returns the response
+// body.  Statuses other than 2xx are errors
+func (env *Env) request(method, path string, body interface{}) ([]byte, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, env.ElasticURL+path, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := env.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return out, fmt.Errorf("%s %s returned status %d: %s", method, path, resp.StatusCode, out)
+	}
+	return out, nil
+}
+
+// Document returns the source of a document.  found is false if the index
+// or the document does not exist
+func (env *Env) Document(index, id string) (source map[string]interface{}, found bool, err error) {
+	query := map[string]interface{}{"query": map[string]interface{}{
+		"ids": map[string]interface{}{"values": []string{id}},
+	}}
+	out, err := env.request("POST", "/"+index+"/_search", query)
+	if err != nil {
+		if strings.Contains(err.Error(), "index_not_found_exception") {
+			err = nil
+		}
+		return
+	}
+	var result struct {
+		Hits struct {
+			Hits []struct {
+				Source map[string]interface{} `json:"_source"`
+			}
+		}
+	}
+	if err = json.Unmarshal(out, &result); err != nil || len(result.Hits.Hits) == 0 {
+		return
+	}
+	return result.Hits.Hits[0].Source, true, nil
+}
+
+// Eventually calls check until it returns nil and fails the test with the
+// last error if it does not within timeout
+func Eventually(t testing.TB, timeout time.Duration, check func() error) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition not met after %s: %s", timeout, err)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// AssertIndexed waits until the document is indexed with the fields in
+// want.  Fields of the document not in want are not compared.  Values are
+// compared by their JSON encoding
+func (env *Env) AssertIndexed(t testing.TB, index, id string, want map[string]interface{}, timeout time.Duration) {
+	t.Helper()
+	Eventually(t, timeout, func() error {
+		source, found, err := env.Document(index, id)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("Document %s not found in %s", id, index)
+		}
+		return matchFields(want, source)
+	})
+}
+
+// AssertDeleted waits until the document is no longer in the index
+func (env *Env) AssertDeleted(t testing.TB, index, id string, timeout time.Duration) {
+	t.Helper()
+	Eventually(t, timeout, func() error {
+		_, found, err := env.Document(index, id)
+		if err != nil {
+			return err
+		}
+		if found {
+			return fmt.Errorf("Document %s still in %s", id, index)
+		}
+		return nil
+	})
+}
+
+// matchFields returns an error naming the first field of want whose value
+// differs in source
+func matchFields(want, source map[string]interface{}) error {
+	var expected map[string]interface{}
+	data, err := json.Marshal(want)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, &expected); err != nil {
+		return err
+	}
+	for k, v := range expected {
+		if !reflect.DeepEqual(v, source[k]) {
+			return fmt.Errorf("Field %s is %v but %v is expected", k, source[k], v)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+func installService(args []string) int {
+	fmt.Fprintln(os.Stderr, "Services can only be installed on Windows. Use systemd on Linux")
+	return 1
+}
+
+func uninstallService() int {
+	fmt.Fprintln(os.Stderr, "Services can only be uninstalled on Windows")
+	return 1
+}
+
+func startService(config *configOptions) error {
+	return errors.New("services are only supported on Windows")
+}
+
+func stopService(status int) {}
@@ -0,0 +1,182 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "monstache"
+
+// windowsService reports the state of the sync to the service control
+// manager and turns stop requests into a graceful shutdown
+type windowsService struct {
+	exitC chan uint32
+	doneC chan bool
+}
+
+var service *windowsService
+
+// eventLogWriter writes each log line as an event
+type eventLogWriter func(eid uint32, msg string) error
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	if err := w(1, strings.TrimRight(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// installService registers the executable as an automatically started
+// service which runs with args and restarts when it fails
+func installService(args []string) int {
+	exe, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to find the monstache executable: %s\n", err)
+		return 1
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to the service manager: %s\n", err)
+		return 1
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		fmt.Fprintf(os.Stderr, "Service %s is already installed\n", serviceName)
+		return 1
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Monstache",
+		Description: "Syncs MongoDB to Elasticsearch",
+		StartType:   mgr.StartAutomatic,
+	}, append([]string{"service", "run"}, args...)...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to install service %s: %s\n", serviceName, err)
+		return 1
+	}
+	defer s.Close()
+	restart := []mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: 10 * time.Second}}
+	if err = s.SetRecoveryActions(restart, uint32((24 * time.Hour).Seconds())); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to set the recovery actions of service %s: %s\n", serviceName, err)
+	}
+	err = eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil && !strings.Contains(err.Error(), "exists") {
+		s.Delete()
+		fmt.Fprintf(os.Stderr, "Unable to install the event log source %s: %s\n", serviceName, err)
+		return 1
+	}
+	fmt.Printf("Installed service %s\n", serviceName)
+	return 0
+}
+
+func uninstallService() int {
+	m, err := mgr.Connect()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to the service manager: %s\n", err)
+		return 1
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Service %s is not installed\n", serviceName)
+		return 1
+	}
+	defer s.Close()
+	if err = s.Delete(); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to uninstall service %s: %s\n", serviceName, err)
+		return 1
+	}
+	if err = eventlog.Remove(serviceName); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to remove the event log source %s: %s\n", serviceName, err)
+	}
+	fmt.Printf("Uninstalled service %s\n", serviceName)
+	return 0
+}
+
+// startService reports to the service control manager and sends the logs
+// which are not written to files or Graylog to the event log
+func startService(config *configOptions) error {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return err
+	}
+	if !isService {
+		return errors.New("service run must be started by the service control manager")
+	}
+	elog, err := eventlog.Open(serviceName)
+	if err != nil {
+		return err
+	}
+	if config.GraylogAddr == "" {
+		logs := config.Logs
+		if logs.Info == "" {
+			infoLog.SetOutput(eventLogWriter(elog.Info))
+		}
+		if logs.Warn == "" {
+			warnLog.SetOutput(eventLogWriter(elog.Warning))
+		}
+		if logs.Error == "" {
+			errorLog.SetOutput(io.MultiWriter(eventLogWriter(elog.Error), recentErrors))
+		}
+		if logs.Stats == "" {
+			statsLog.SetOutput(eventLogWriter(elog.Info))
+		}
+	}
+	service = &windowsService{
+		exitC: make(chan uint32, 1),
+		doneC: make(chan bool),
+	}
+	go func() {
+		if err := svc.Run(serviceName, service); err != nil {
+			errorLog.Printf("Service %s failed: %s", serviceName, err)
+		}
+		close(service.doneC)
+	}()
+	return nil
+}
+
+// stopService reports the exit status to the service control manager
+// before the process exits
+func stopService(status int) {
+	if service == nil {
+		return
+	}
+	service.exitC <- uint32(status)
+	select {
+	case <-service.doneC:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+func (ws *windowsService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				changes <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				select {
+				case shutdownSigs <- syscall.SIGTERM:
+				default:
+				}
+			}
+		case status := <-ws.exitC:
+			return false, status
+		}
+	}
+}